@@ -0,0 +1,293 @@
+package applehealth
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Export is an Apple Health `export.zip`, created by the Health app (Profile -> Export All Health Data). The archive contains:
+//
+// - apple_health_export/export.xml - every HealthKit sample (Record, Workout, etc), this file may be several GB in size
+// - apple_health_export/clinical-records/*.json - FHIR resources downloaded from healthcare providers (Health Records)
+// - apple_health_export/export_cda.xml, workout-routes/*.gpx, electrocardiograms/*.csv - ignored
+type Export struct {
+	exportFile          *zip.File
+	clinicalRecordFiles map[string]*zip.File
+}
+
+// Resource is a FHIR R4 resource converted from the export
+type Resource struct {
+	ResourceType string
+	ResourceId   string
+	SortTitle    *string
+	SortDate     *time.Time
+	ResourceRaw  json.RawMessage
+}
+
+// ClinicalRecord is a clinical record listed in export.xml, the FHIR resource is stored in a separate file
+type ClinicalRecord struct {
+	Type             string `json:"type"`
+	FhirVersion      string `json:"fhir_version"`
+	ResourceFilePath string `json:"resource_file_path"`
+}
+
+// Summary describes the content of export.xml, once it has been read (see Export.ReadHealthData)
+type Summary struct {
+	RecordCount        int              `json:"record_count"`
+	ObservationCount   int              `json:"observation_count"`
+	InvalidRecordCount int              `json:"invalid_record_count,omitempty"`
+	SkippedRecordTypes map[string]int   `json:"skipped_record_types,omitempty"` //records which do not have a LOINC mapping, by HealthKit type identifier
+	ClinicalRecords    []ClinicalRecord `json:"-"`
+}
+
+// appleHealthDateTimeLayout is the format of every date in export.xml, eg. `2023-03-15 08:14:25 -0700`
+const appleHealthDateTimeLayout = "2006-01-02 15:04:05 -0700"
+
+// NewExport opens an Apple Health export.zip, returns an error if the archive does not contain an export.xml file
+func NewExport(exportZip io.ReaderAt, size int64) (*Export, error) {
+	zipReader, err := zip.NewReader(exportZip, size)
+	if err != nil {
+		return nil, fmt.Errorf("could not open Apple Health export: %w", err)
+	}
+
+	export := &Export{clinicalRecordFiles: map[string]*zip.File{}}
+	for _, zipFile := range zipReader.File {
+		//files are usually stored in an `apple_health_export` directory, but the name of the directory is not important
+		switch {
+		case path.Base(zipFile.Name) == "export.xml":
+			export.exportFile = zipFile
+		case path.Base(path.Dir(zipFile.Name)) == "clinical-records" && path.Ext(zipFile.Name) == ".json":
+			export.clinicalRecordFiles[path.Base(zipFile.Name)] = zipFile
+		}
+	}
+	if export.exportFile == nil {
+		return nil, errors.New("Apple Health export does not contain an export.xml file")
+	}
+	return export, nil
+}
+
+// ReadHealthData stream-parses export.xml (it is never loaded into memory), and calls the resourceFn for the Patient and for the
+// Observation converted from each supported Record (see quantityTypes). Reading stops if the resourceFn returns an error.
+//
+// Observation ids are generated from the content of the Record, so reading the same export again generates the same resources.
+// Records correlated by HealthKit (eg. blood pressure) are converted once, since they generate the same ids.
+func (e *Export) ReadHealthData(patientId string, resourceFn func(resource Resource) error) (*Summary, error) {
+	exportXml, err := e.exportFile.Open()
+	if err != nil {
+		return nil, fmt.Errorf("could not open export.xml: %w", err)
+	}
+	defer exportXml.Close()
+
+	summary := &Summary{SkippedRecordTypes: map[string]int{}}
+	patientFound := false
+	decoder := xml.NewDecoder(exportXml)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return summary, fmt.Errorf("could not parse export.xml: %w", err)
+		}
+		startElement, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		attrs := elementAttrs(startElement)
+
+		switch startElement.Name.Local {
+		case "Me":
+			if err := resourceFn(convertPatient(patientId, attrs)); err != nil {
+				return summary, err
+			}
+			patientFound = true
+		case "Record":
+			summary.RecordCount++
+			quantityType, ok := quantityTypes[attrs["type"]]
+			if !ok {
+				summary.SkippedRecordTypes[attrs["type"]]++
+				continue
+			}
+			observation, err := convertObservation(patientId, quantityType, attrs)
+			if err != nil {
+				summary.InvalidRecordCount++
+				continue
+			}
+			if err := resourceFn(*observation); err != nil {
+				return summary, err
+			}
+			summary.ObservationCount++
+		case "ClinicalRecord":
+			summary.ClinicalRecords = append(summary.ClinicalRecords, ClinicalRecord{
+				Type:             attrs["type"],
+				FhirVersion:      attrs["fhirVersion"],
+				ResourceFilePath: attrs["resourceFilePath"],
+			})
+		}
+	}
+
+	//the Me element is optional, the Patient is required since every Observation references it
+	if !patientFound {
+		if err := resourceFn(convertPatient(patientId, map[string]string{})); err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
+
+// WriteClinicalRecordsBundle writes the clinical records listed in export.xml (see Summary.ClinicalRecords) as a FHIR R4 `collection`
+// Bundle. Only FHIR R4 records are included, older exports store DSTU2 records, which are skipped (and returned as warnings).
+// Returns the number of resources written to the bundle.
+func (e *Export) WriteClinicalRecordsBundle(bundleWriter io.Writer, clinicalRecords []ClinicalRecord) (int, []string, error) {
+	warnings := []string{}
+	entries := []map[string]json.RawMessage{}
+	for _, clinicalRecord := range clinicalRecords {
+		fileName := path.Base(clinicalRecord.ResourceFilePath)
+		if !strings.HasPrefix(clinicalRecord.FhirVersion, "4.") {
+			warnings = append(warnings, fmt.Sprintf("%s: FHIR version %s is not supported, skipped", fileName, clinicalRecord.FhirVersion))
+			continue
+		}
+		zipFile, ok := e.clinicalRecordFiles[fileName]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("%s: file not found in export, skipped", fileName))
+			continue
+		}
+		resourceRaw, err := readZipFile(zipFile)
+		if err != nil {
+			return 0, warnings, fmt.Errorf("could not read clinical record %s: %w", fileName, err)
+		}
+		if !json.Valid(resourceRaw) {
+			warnings = append(warnings, fmt.Sprintf("%s: file is not valid json, skipped", fileName))
+			continue
+		}
+		entries = append(entries, map[string]json.RawMessage{"resource": resourceRaw})
+	}
+
+	bundle := map[string]interface{}{
+		"resourceType": "Bundle",
+		"type":         "collection",
+		"entry":        entries,
+	}
+	if err := json.NewEncoder(bundleWriter).Encode(bundle); err != nil {
+		return 0, warnings, err
+	}
+	return len(entries), warnings, nil
+}
+
+// convertPatient converts the characteristics of the user (Me element) into a Patient resource
+func convertPatient(patientId string, attrs map[string]string) Resource {
+	patient := map[string]interface{}{
+		"resourceType": "Patient",
+		"id":           patientId,
+	}
+	if birthDate, err := time.Parse("2006-01-02", attrs["HKCharacteristicTypeIdentifierDateOfBirth"]); err == nil {
+		patient["birthDate"] = birthDate.Format("2006-01-02")
+	}
+	switch attrs["HKCharacteristicTypeIdentifierBiologicalSex"] {
+	case "HKBiologicalSexFemale":
+		patient["gender"] = "female"
+	case "HKBiologicalSexMale":
+		patient["gender"] = "male"
+	case "HKBiologicalSexOther":
+		patient["gender"] = "other"
+	}
+	patientRaw, _ := json.Marshal(patient)
+	return Resource{ResourceType: "Patient", ResourceId: patientId, ResourceRaw: patientRaw}
+}
+
+// convertObservation converts a Record into an Observation, returns an error if the record does not have a numeric value or valid dates
+func convertObservation(patientId string, quantityType quantityType, attrs map[string]string) (*Resource, error) {
+	startDate, err := time.Parse(appleHealthDateTimeLayout, attrs["startDate"])
+	if err != nil {
+		return nil, err
+	}
+	endDate, err := time.Parse(appleHealthDateTimeLayout, attrs["endDate"])
+	if err != nil {
+		return nil, err
+	}
+	valueQuantity, err := quantityType.valueQuantity(attrs["value"], attrs["unit"])
+	if err != nil {
+		return nil, err
+	}
+
+	loincCode, display := quantityType.loincCode, quantityType.display
+	if valueQuantity["code"] == "mmol/L" && len(quantityType.molarLoincCode) > 0 {
+		loincCode, display = quantityType.molarLoincCode, quantityType.molarDisplay
+	}
+
+	observationId := uuid.NewSHA1(uuid.NameSpaceOID, []byte(strings.Join([]string{
+		attrs["type"], attrs["sourceName"], attrs["startDate"], attrs["endDate"], attrs["value"], attrs["unit"],
+	}, "|"))).String()
+
+	observation := map[string]interface{}{
+		"resourceType": "Observation",
+		"id":           observationId,
+		"status":       "final",
+		"category": []interface{}{map[string]interface{}{
+			"coding": []interface{}{map[string]interface{}{
+				"system": "http://terminology.hl7.org/CodeSystem/observation-category",
+				"code":   quantityType.category,
+			}},
+		}},
+		"code": map[string]interface{}{
+			"coding": []interface{}{map[string]interface{}{
+				"system":  "http://loinc.org",
+				"code":    loincCode,
+				"display": display,
+			}},
+			"text": display,
+		},
+		"subject":       map[string]interface{}{"reference": "Patient/" + patientId},
+		"valueQuantity": valueQuantity,
+	}
+	if startDate.Equal(endDate) {
+		observation["effectiveDateTime"] = startDate.Format(time.RFC3339)
+	} else {
+		observation["effectivePeriod"] = map[string]interface{}{
+			"start": startDate.Format(time.RFC3339),
+			"end":   endDate.Format(time.RFC3339),
+		}
+	}
+	if len(attrs["sourceName"]) > 0 {
+		//the app or device which recorded the sample, eg. `Apple Watch`
+		observation["device"] = map[string]interface{}{"display": attrs["sourceName"]}
+	}
+
+	observationRaw, err := json.Marshal(observation)
+	if err != nil {
+		return nil, err
+	}
+	sortTitle := display
+	return &Resource{
+		ResourceType: "Observation",
+		ResourceId:   observationId,
+		SortTitle:    &sortTitle,
+		SortDate:     &startDate,
+		ResourceRaw:  observationRaw,
+	}, nil
+}
+
+func elementAttrs(startElement xml.StartElement) map[string]string {
+	attrs := map[string]string{}
+	for _, attr := range startElement.Attr {
+		attrs[attr.Name.Local] = attr.Value
+	}
+	return attrs
+}
+
+func readZipFile(zipFile *zip.File) ([]byte, error) {
+	fileReader, err := zipFile.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer fileReader.Close()
+	return io.ReadAll(fileReader)
+}
@@ -0,0 +1,161 @@
+package applehealth
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/validation"
+	"github.com/stretchr/testify/require"
+)
+
+// zipExport creates an export.zip from the testdata/apple_health_export directory
+func zipExport(t *testing.T) *bytes.Reader {
+	var exportZip bytes.Buffer
+	zipWriter := zip.NewWriter(&exportZip)
+	err := filepath.Walk("testdata/apple_health_export", func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel("testdata", filePath)
+		if err != nil {
+			return err
+		}
+		fileContent, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		zipFile, err := zipWriter.Create(filepath.ToSlash(relPath))
+		if err != nil {
+			return err
+		}
+		_, err = zipFile.Write(fileContent)
+		return err
+	})
+	require.NoError(t, err)
+	require.NoError(t, zipWriter.Close())
+	return bytes.NewReader(exportZip.Bytes())
+}
+
+func TestNewExport_WithoutExportXml(t *testing.T) {
+	var exportZip bytes.Buffer
+	zipWriter := zip.NewWriter(&exportZip)
+	_, err := zipWriter.Create("apple_health_export/export_cda.xml")
+	require.NoError(t, err)
+	require.NoError(t, zipWriter.Close())
+
+	_, err = NewExport(bytes.NewReader(exportZip.Bytes()), int64(exportZip.Len()))
+	require.EqualError(t, err, "Apple Health export does not contain an export.xml file")
+
+	_, err = NewExport(bytes.NewReader([]byte("not a zip")), 9)
+	require.Error(t, err)
+}
+
+func TestExport_ReadHealthData(t *testing.T) {
+	exportZip := zipExport(t)
+	export, err := NewExport(exportZip, exportZip.Size())
+	require.NoError(t, err)
+
+	resources := []Resource{}
+	summary, err := export.ReadHealthData("patient-1", func(resource Resource) error {
+		resources = append(resources, resource)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 12, summary.RecordCount)
+	//blood pressure records are included in the correlation and as standalone records
+	require.Equal(t, 9, summary.ObservationCount)
+	require.Equal(t, 1, summary.InvalidRecordCount)
+	require.Equal(t, map[string]int{
+		"HKCategoryTypeIdentifierSleepAnalysis":      1,
+		"HKQuantityTypeIdentifierActiveEnergyBurned": 1,
+	}, summary.SkippedRecordTypes)
+	require.Len(t, summary.ClinicalRecords, 3)
+
+	//patient
+	require.Equal(t, "Patient", resources[0].ResourceType)
+	require.JSONEq(t, `{"resourceType":"Patient","id":"patient-1","birthDate":"1980-05-04","gender":"female"}`, string(resources[0].ResourceRaw))
+
+	//observations
+	require.Len(t, resources, 10)
+	for _, resource := range resources {
+		operationOutcome := validation.ValidateResource(resource.ResourceRaw, validation.Options{})
+		require.False(t, validation.HasErrors(operationOutcome), "Expected %s/%s to be valid: %v", resource.ResourceType, resource.ResourceId, operationOutcome)
+	}
+	var steps map[string]interface{}
+	require.NoError(t, json.Unmarshal(resources[1].ResourceRaw, &steps))
+	require.Equal(t, "55423-8", steps["code"].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{})["code"])
+	require.Equal(t, map[string]interface{}{"start": "2023-03-15T08:00:00-07:00", "end": "2023-03-15T08:10:00-07:00"}, steps["effectivePeriod"])
+	require.Equal(t, map[string]interface{}{"value": float64(1024), "unit": "steps", "system": "http://unitsofmeasure.org", "code": "{steps}"}, steps["valueQuantity"])
+	require.Equal(t, map[string]interface{}{"reference": "Patient/patient-1"}, steps["subject"])
+	require.Equal(t, "Number of steps", *resources[1].SortTitle)
+	require.Equal(t, "2023-03-15T08:00:00-07:00", resources[1].SortDate.Format("2006-01-02T15:04:05Z07:00"))
+
+	var heartRate map[string]interface{}
+	require.NoError(t, json.Unmarshal(resources[2].ResourceRaw, &heartRate))
+	require.Equal(t, "2023-03-15T08:14:25-07:00", heartRate["effectiveDateTime"])
+	require.Equal(t, map[string]interface{}{"display": "Jane's Apple Watch"}, heartRate["device"])
+	require.Equal(t, "/min", heartRate["valueQuantity"].(map[string]interface{})["code"])
+
+	var oxygenSaturation map[string]interface{}
+	require.NoError(t, json.Unmarshal(resources[4].ResourceRaw, &oxygenSaturation))
+	require.Equal(t, float64(97), oxygenSaturation["valueQuantity"].(map[string]interface{})["value"])
+
+	var bloodGlucose map[string]interface{}
+	require.NoError(t, json.Unmarshal(resources[5].ResourceRaw, &bloodGlucose))
+	require.Equal(t, "15074-8", bloodGlucose["code"].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{})["code"])
+	require.Equal(t, "mmol/L", bloodGlucose["valueQuantity"].(map[string]interface{})["code"])
+
+	//correlated records generate the same resources as the standalone records
+	require.Equal(t, resources[6], resources[8])
+	require.Equal(t, resources[7], resources[9])
+
+	//reading the export again generates the same resources
+	resourcesAgain := []Resource{}
+	_, err = export.ReadHealthData("patient-1", func(resource Resource) error {
+		resourcesAgain = append(resourcesAgain, resource)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, resources, resourcesAgain)
+}
+
+func TestExport_WriteClinicalRecordsBundle(t *testing.T) {
+	exportZip := zipExport(t)
+	export, err := NewExport(exportZip, exportZip.Size())
+	require.NoError(t, err)
+	summary, err := export.ReadHealthData("patient-1", func(resource Resource) error { return nil })
+	require.NoError(t, err)
+
+	var bundleJson bytes.Buffer
+	count, warnings, err := export.WriteClinicalRecordsBundle(&bundleJson, append(summary.ClinicalRecords, ClinicalRecord{
+		FhirVersion:      "4.0.1",
+		ResourceFilePath: "/clinical-records/Missing.json",
+	}))
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	require.Equal(t, []string{
+		"Immunization-7D8E9F0A-3B4C-4D5E-9F0A-2B3C4D5E6F7A.json: FHIR version 1.0.2 is not supported, skipped",
+		"Missing.json: file not found in export, skipped",
+	}, warnings)
+
+	var bundle struct {
+		ResourceType string `json:"resourceType"`
+		Entry        []struct {
+			Resource struct {
+				ResourceType string `json:"resourceType"`
+				Id           string `json:"id"`
+			} `json:"resource"`
+		} `json:"entry"`
+	}
+	require.NoError(t, json.Unmarshal(bundleJson.Bytes(), &bundle))
+	require.Equal(t, "Bundle", bundle.ResourceType)
+	require.Len(t, bundle.Entry, 2)
+	require.Equal(t, "Observation", bundle.Entry[0].Resource.ResourceType)
+	require.Equal(t, "eGlucose.1", bundle.Entry[0].Resource.Id)
+	require.Equal(t, "Condition", bundle.Entry[1].Resource.ResourceType)
+}
@@ -0,0 +1,88 @@
+package applehealth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// quantityType maps a HealthKit quantity type (HKQuantityTypeIdentifier*) to the LOINC code of the Observation
+type quantityType struct {
+	loincCode string
+	display   string
+	category  string //http://terminology.hl7.org/CodeSystem/observation-category
+
+	//unit of dimensionless values (HealthKit `count` unit), eg. `{steps}`
+	countUnit string
+	//LOINC code of values measured in a molar unit (eg. mmol/L), since the code depends on the property (mass or substance concentration)
+	molarLoincCode string
+	molarDisplay   string
+	//HealthKit stores percentages as a fraction (0.97), FHIR Observations use the percentage (97%)
+	fraction bool
+}
+
+// quantityTypes are the supported HealthKit quantity types, records of other types are skipped
+var quantityTypes = map[string]quantityType{
+	"HKQuantityTypeIdentifierStepCount":              {loincCode: "55423-8", display: "Number of steps", category: "activity", countUnit: "{steps}"},
+	"HKQuantityTypeIdentifierHeartRate":              {loincCode: "8867-4", display: "Heart rate", category: "vital-signs"},
+	"HKQuantityTypeIdentifierRestingHeartRate":       {loincCode: "40443-4", display: "Heart rate --resting", category: "vital-signs"},
+	"HKQuantityTypeIdentifierBloodPressureSystolic":  {loincCode: "8480-6", display: "Systolic blood pressure", category: "vital-signs"},
+	"HKQuantityTypeIdentifierBloodPressureDiastolic": {loincCode: "8462-4", display: "Diastolic blood pressure", category: "vital-signs"},
+	"HKQuantityTypeIdentifierBodyMass":               {loincCode: "29463-7", display: "Body weight", category: "vital-signs"},
+	"HKQuantityTypeIdentifierHeight":                 {loincCode: "8302-2", display: "Body height", category: "vital-signs"},
+	"HKQuantityTypeIdentifierBodyMassIndex":          {loincCode: "39156-5", display: "Body mass index (BMI) [Ratio]", category: "vital-signs", countUnit: "kg/m2"},
+	"HKQuantityTypeIdentifierBodyTemperature":        {loincCode: "8310-5", display: "Body temperature", category: "vital-signs"},
+	"HKQuantityTypeIdentifierOxygenSaturation":       {loincCode: "59408-5", display: "Oxygen saturation in Arterial blood by Pulse oximetry", category: "vital-signs", fraction: true},
+	"HKQuantityTypeIdentifierRespiratoryRate":        {loincCode: "9279-1", display: "Respiratory rate", category: "vital-signs"},
+	"HKQuantityTypeIdentifierBloodGlucose":           {loincCode: "2339-0", display: "Glucose [Mass/volume] in Blood", category: "laboratory", molarLoincCode: "15074-8", molarDisplay: "Glucose [Moles/volume] in Blood"},
+}
+
+// ucumUnits maps HealthKit units to UCUM units (http://unitsofmeasure.org)
+var ucumUnits = map[string]string{
+	"count/min": "/min",
+	"kg":        "kg",
+	"g":         "g",
+	"lb":        "[lb_av]",
+	"cm":        "cm",
+	"m":         "m",
+	"in":        "[in_i]",
+	"ft":        "[ft_i]",
+	"mmHg":      "mm[Hg]",
+	"degC":      "Cel",
+	"degF":      "[degF]",
+	"%":         "%",
+	"mg/dL":     "mg/dL",
+}
+
+// valueQuantity converts the value & unit of a record into an Observation.valueQuantity
+func (q quantityType) valueQuantity(value string, unit string) (map[string]interface{}, error) {
+	numericValue, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("record value (%s) is not numeric", value)
+	}
+	if q.fraction {
+		//round to avoid floating point noise (0.97 * 100 = 97.00000000000001)
+		numericValue, _ = strconv.ParseFloat(strconv.FormatFloat(numericValue*100, 'f', 4, 64), 64)
+	}
+
+	var ucumUnit string
+	switch {
+	case unit == "count" && len(q.countUnit) > 0:
+		ucumUnit = q.countUnit
+	case strings.HasPrefix(unit, "mmol<") && strings.HasSuffix(unit, ">/L"):
+		//HealthKit includes the molar mass of the substance in the unit, eg. `mmol<180.1558800000541>/L`
+		ucumUnit = "mmol/L"
+	default:
+		ucumUnit = ucumUnits[unit]
+	}
+	if len(ucumUnit) == 0 {
+		return nil, fmt.Errorf("record unit (%s) is not supported", unit)
+	}
+
+	return map[string]interface{}{
+		"value":  numericValue,
+		"unit":   strings.Trim(ucumUnit, "{}"),
+		"system": "http://unitsofmeasure.org",
+		"code":   ucumUnit,
+	}, nil
+}
@@ -0,0 +1,497 @@
+package ccda
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+)
+
+// cdaNamespace is the namespace of every CDA document element
+const cdaNamespace = "urn:hl7-org:v3"
+
+// Warning describes a part of the document which could not be converted (and was skipped), or was converted with missing data.
+type Warning struct {
+	Section string `json:"section,omitempty"` //the title of the section, empty for document level warnings
+	Message string `json:"message"`
+}
+
+func (w Warning) String() string {
+	if len(w.Section) == 0 {
+		return w.Message
+	}
+	return fmt.Sprintf("%s: %s", w.Section, w.Message)
+}
+
+// Conversion is the result of converting a C-CDA document into FHIR R4 resources
+type Conversion struct {
+	//a `collection` Bundle containing the Patient, the original document (as a Binary & DocumentReference) and the resources converted from each supported section
+	Bundle fhir401.Bundle
+	//the id of the Patient resource (converted from the recordTarget of the document)
+	PatientId string
+	Warnings  []Warning
+}
+
+// IsDocument returns true if the document is a CDA document (eg. a C-CDA Continuity of Care Document). Only the root element is read,
+// the document is rewound before returning.
+func IsDocument(document io.ReadSeeker) (bool, error) {
+	defer document.Seek(0, io.SeekStart)
+	if _, err := document.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	decoder := xml.NewDecoder(document)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			//not a (well formed) xml document
+			return false, nil
+		}
+		switch typedToken := token.(type) {
+		case xml.StartElement:
+			return typedToken.Name.Space == cdaNamespace && typedToken.Name.Local == "ClinicalDocument", nil
+		case xml.CharData:
+			if len(bytes.TrimSpace(typedToken)) > 0 {
+				return false, nil
+			}
+		}
+	}
+}
+
+// Convert converts a C-CDA document into a FHIR R4 Bundle. The following sections are converted, entries in other sections are
+// skipped (and reported as warnings):
+//
+// - Problems -> Condition
+// - Medications -> MedicationStatement
+// - Allergies -> AllergyIntolerance
+// - Results & Vital Signs -> Observation
+// - Immunizations -> Immunization
+// - Encounters -> Encounter
+// - Procedures -> Procedure
+//
+// Resource ids are generated from the CDA entry ids (or the location of the entry in the document), so converting the same
+// document again generates the same resources.
+func Convert(document []byte) (*Conversion, error) {
+	var cdaDocument clinicalDocument
+	if err := xml.Unmarshal(document, &cdaDocument); err != nil {
+		return nil, fmt.Errorf("could not parse C-CDA document: %w", err)
+	}
+	if cdaDocument.XMLName.Space != cdaNamespace {
+		return nil, fmt.Errorf("document is not a CDA document, expected a ClinicalDocument element in the %s namespace", cdaNamespace)
+	}
+	if len(cdaDocument.RecordTargets) == 0 {
+		return nil, errors.New("C-CDA document does not contain a recordTarget (patient)")
+	}
+
+	documentKey := instanceIdentifierKey(cdaDocument.ID)
+	if len(documentKey) == 0 {
+		//documents without an id are identified by their content
+		documentKey = uuid.NewSHA1(uuid.NameSpaceOID, document).String()
+	}
+	c := &converter{
+		documentKey: documentKey,
+		resourceIds: map[string]bool{},
+		bundle:      fhir401.Bundle{Type: fhir401.BundleTypeCollection},
+		warnings:    []Warning{},
+	}
+
+	c.convertPatient(cdaDocument.RecordTargets[0])
+	if len(cdaDocument.RecordTargets) > 1 {
+		c.warn("document contains %d recordTargets, only the first patient was converted", len(cdaDocument.RecordTargets))
+	}
+	c.convertDocument(cdaDocument, document)
+	for sectionNdx, cdaSection := range cdaDocument.Sections {
+		c.convertSection(sectionNdx, cdaSection)
+	}
+
+	return &Conversion{Bundle: c.bundle, PatientId: c.patientId, Warnings: c.warnings}, nil
+}
+
+// converter stores the state of a conversion, the resources are appended to the bundle as each entry is converted
+type converter struct {
+	documentKey string
+	patientId   string
+	resourceIds map[string]bool
+	bundle      fhir401.Bundle
+	warnings    []Warning
+
+	//the section being converted
+	sectionTitle string
+	narrative    map[string]string
+}
+
+// resource is a FHIR resource, resources are generated as maps so that only the elements with a value are included (the
+// gofhir-models structs serialize some required choice elements even when they're empty)
+type resource map[string]interface{}
+
+// warn records a warning for the section being converted
+func (c *converter) warn(format string, args ...interface{}) {
+	c.warnings = append(c.warnings, Warning{Section: c.sectionTitle, Message: fmt.Sprintf(format, args...)})
+}
+
+// addResource generates the resource id, and appends the resource to the bundle. The id is generated from the first CDA id
+// of the entry, `fallbackKey` (the location of the entry in the document) is used if the entry does not have an id, or the
+// id has already been used by another resource (of the same type).
+func (c *converter) addResource(resourceType string, ids []instanceIdentifier, fallbackKey string, fhirResource resource) string {
+	resourceId := ""
+	for _, cdaId := range ids {
+		if key := instanceIdentifierKey(&cdaId); len(key) > 0 {
+			resourceId = uuid.NewSHA1(uuid.NameSpaceOID, []byte(resourceType+"|"+key)).String()
+			break
+		}
+	}
+	if len(resourceId) == 0 || c.resourceIds[resourceType+"/"+resourceId] {
+		resourceId = uuid.NewSHA1(uuid.NameSpaceOID, []byte(resourceType+"|"+c.documentKey+"|"+fallbackKey)).String()
+	}
+	c.resourceIds[resourceType+"/"+resourceId] = true
+
+	fhirResource["resourceType"] = resourceType
+	fhirResource["id"] = resourceId
+	if identifiers := fhirIdentifiers(ids); len(identifiers) > 0 {
+		fhirResource["identifier"] = identifiers
+	}
+
+	resourceJson, _ := json.Marshal(fhirResource)
+	c.bundle.Entry = append(c.bundle.Entry, fhir401.BundleEntry{
+		FullUrl:  lo.ToPtr("urn:uuid:" + resourceId),
+		Resource: resourceJson,
+	})
+	return resourceId
+}
+
+func (c *converter) patientReference() fhir401.Reference {
+	return fhir401.Reference{Reference: lo.ToPtr("Patient/" + c.patientId)}
+}
+
+func (c *converter) convertPatient(cdaPatientRole patientRole) {
+	patient := resource{}
+	names := []fhir401.HumanName{}
+	for _, cdaName := range cdaPatientRole.Patient.Names {
+		name := fhir401.HumanName{
+			Family: optionalString(cdaName.Family),
+			Given:  trimmedStrings(cdaName.Given),
+			Prefix: trimmedStrings(cdaName.Prefix),
+			Suffix: trimmedStrings(cdaName.Suffix),
+		}
+		if name.Family != nil || len(name.Given) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		patient["name"] = names
+	}
+	if cdaPatientRole.Patient.Gender != nil {
+		//http://hl7.org/fhir/R4/valueset-administrative-gender.html
+		switch cdaPatientRole.Patient.Gender.Code {
+		case "M":
+			patient["gender"] = "male"
+		case "F":
+			patient["gender"] = "female"
+		case "UN":
+			patient["gender"] = "other"
+		default:
+			patient["gender"] = "unknown"
+		}
+	}
+	if birthDate, ok := fhirDate(cdaPatientRole.Patient.BirthTime); ok {
+		patient["birthDate"] = birthDate
+	}
+
+	addresses := []fhir401.Address{}
+	for _, cdaAddress := range cdaPatientRole.Addresses {
+		fhirAddress := fhir401.Address{
+			Line:       trimmedStrings(cdaAddress.StreetAddressLines),
+			City:       optionalString(cdaAddress.City),
+			State:      optionalString(cdaAddress.State),
+			PostalCode: optionalString(cdaAddress.PostalCode),
+			Country:    optionalString(cdaAddress.Country),
+		}
+		if len(fhirAddress.Line) > 0 || fhirAddress.City != nil || fhirAddress.State != nil || fhirAddress.PostalCode != nil {
+			addresses = append(addresses, fhirAddress)
+		}
+	}
+	if len(addresses) > 0 {
+		patient["address"] = addresses
+	}
+
+	telecoms := []map[string]string{}
+	for _, cdaTelecom := range cdaPatientRole.Telecoms {
+		system, value, found := strings.Cut(cdaTelecom.Value, ":")
+		if !found || len(strings.TrimSpace(value)) == 0 {
+			continue
+		}
+		switch system {
+		case "tel":
+			telecoms = append(telecoms, map[string]string{"system": "phone", "value": strings.TrimSpace(value)})
+		case "mailto":
+			telecoms = append(telecoms, map[string]string{"system": "email", "value": strings.TrimSpace(value)})
+		case "fax":
+			telecoms = append(telecoms, map[string]string{"system": "fax", "value": strings.TrimSpace(value)})
+		}
+	}
+	if len(telecoms) > 0 {
+		patient["telecom"] = telecoms
+	}
+
+	c.patientId = c.addResource("Patient", cdaPatientRole.IDs, "recordTarget", patient)
+}
+
+// convertDocument stores the original document as a Binary, and describes it with a DocumentReference
+func (c *converter) convertDocument(cdaDocument clinicalDocument, document []byte) {
+	binaryId := c.addResource("Binary", nil, "document", resource{
+		"contentType": "application/xml",
+		"data":        base64.StdEncoding.EncodeToString(document),
+	})
+
+	documentReference := resource{
+		"status":  "current",
+		"subject": c.patientReference(),
+		"content": []fhir401.DocumentReferenceContent{{
+			Attachment: fhir401.Attachment{
+				ContentType: lo.ToPtr("application/xml"),
+				Url:         lo.ToPtr("Binary/" + binaryId),
+				Size:        lo.ToPtr(len(document)),
+				Title:       optionalString(cdaDocument.Title),
+			},
+			Format: &fhir401.Coding{
+				System:  lo.ToPtr("http://ihe.net/fhir/ihe.formatcode.fhir/CodeSystem/formatcode"),
+				Code:    lo.ToPtr("urn:hl7-org:sdwg:ccda-structuredBody:2.1"),
+				Display: lo.ToPtr("Documents following C-CDA constraints using a structured body"),
+			},
+		}},
+	}
+	if documentType := codeableConcept(cdaDocument.Code, nil); documentType != nil {
+		documentReference["type"] = documentType
+	}
+	if title := strings.TrimSpace(cdaDocument.Title); len(title) > 0 {
+		documentReference["description"] = title
+	}
+	//DocumentReference.date is an instant, which requires a time & timezone
+	if date, ok := fhirDateTime(cdaDocument.EffectiveTime); ok && strings.Contains(date, "T") {
+		documentReference["date"] = date
+	}
+	var documentIds []instanceIdentifier
+	if cdaDocument.ID != nil {
+		documentIds = []instanceIdentifier{*cdaDocument.ID}
+	}
+	c.addResource("DocumentReference", documentIds, "document", documentReference)
+}
+
+// Datatype conversion
+
+// codeSystems maps the OIDs of common CDA code systems to their FHIR uri, other code systems are converted to `urn:oid:` uris
+var codeSystems = map[string]string{
+	"2.16.840.1.113883.6.1":      "http://loinc.org",
+	"2.16.840.1.113883.6.96":     "http://snomed.info/sct",
+	"2.16.840.1.113883.6.88":     "http://www.nlm.nih.gov/research/umls/rxnorm",
+	"2.16.840.1.113883.12.292":   "http://hl7.org/fhir/sid/cvx",
+	"2.16.840.1.113883.6.12":     "http://www.ama-assn.org/go/cpt",
+	"2.16.840.1.113883.6.90":     "http://hl7.org/fhir/sid/icd-10-cm",
+	"2.16.840.1.113883.6.103":    "http://hl7.org/fhir/sid/icd-9-cm",
+	"2.16.840.1.113883.6.69":     "http://hl7.org/fhir/sid/ndc",
+	"2.16.840.1.113883.4.9":      "http://fdasis.nlm.nih.gov",
+	"2.16.840.1.113883.3.26.1.1": "http://ncicb.nci.nih.gov/xml/owl/EVS/Thesaurus.owl",
+	"2.16.840.1.113883.6.8":      "http://unitsofmeasure.org",
+	"2.16.840.1.113883.5.4":      "http://terminology.hl7.org/CodeSystem/v3-ActCode",
+	"2.16.840.1.113883.5.83":     "http://terminology.hl7.org/CodeSystem/v3-ObservationInterpretation",
+	"2.16.840.1.113883.5.1":      "http://terminology.hl7.org/CodeSystem/v3-AdministrativeGender",
+}
+
+func codeSystemUri(oid string) string {
+	if uri, found := codeSystems[oid]; found {
+		return uri
+	}
+	return "urn:oid:" + oid
+}
+
+// codeableConcept converts a CDA coded value (and its translations) into a CodeableConcept. The text is the original text
+// (resolved from the section narrative if it's a reference) or the display name. Returns nil if there's no code or text.
+func codeableConcept(cdaCode *conceptDescriptor, narrative map[string]string) *fhir401.CodeableConcept {
+	if cdaCode == nil {
+		return nil
+	}
+	concept := fhir401.CodeableConcept{}
+	for _, cdaCoding := range append([]conceptDescriptor{*cdaCode}, cdaCode.Translations...) {
+		if len(cdaCoding.Code) == 0 || len(cdaCoding.NullFlavor) > 0 {
+			continue
+		}
+		coding := fhir401.Coding{Code: lo.ToPtr(cdaCoding.Code), Display: optionalString(cdaCoding.DisplayName)}
+		if len(cdaCoding.CodeSystem) > 0 {
+			coding.System = lo.ToPtr(codeSystemUri(cdaCoding.CodeSystem))
+		}
+		concept.Coding = append(concept.Coding, coding)
+	}
+
+	if cdaCode.OriginalText != nil {
+		concept.Text = optionalString(cdaCode.OriginalText.Text)
+		if concept.Text == nil && cdaCode.OriginalText.Reference != nil {
+			concept.Text = optionalString(narrative[strings.TrimPrefix(cdaCode.OriginalText.Reference.Value, "#")])
+		}
+	}
+	if concept.Text == nil {
+		concept.Text = optionalString(cdaCode.DisplayName)
+	}
+	if len(concept.Coding) == 0 && concept.Text == nil {
+		return nil
+	}
+	return &concept
+}
+
+// quantity converts a CDA physical quantity (PQ), the unit is a UCUM unit. Returns nil if the value is missing or not a number.
+func quantity(cdaValue *anyValue) *fhir401.Quantity {
+	if cdaValue == nil || len(cdaValue.NullFlavor) > 0 {
+		return nil
+	}
+	value := json.Number(strings.TrimSpace(cdaValue.Value))
+	if _, err := value.Float64(); err != nil {
+		return nil
+	}
+	fhirQuantity := fhir401.Quantity{Value: &value}
+	//`1` is the UCUM unit for unitless quantities
+	if unit := strings.TrimSpace(cdaValue.Unit); len(unit) > 0 && unit != "1" {
+		fhirQuantity.Unit = lo.ToPtr(unit)
+		fhirQuantity.System = lo.ToPtr("http://unitsofmeasure.org")
+		fhirQuantity.Code = lo.ToPtr(unit)
+	}
+	return &fhirQuantity
+}
+
+// cdaTimestampRegex matches a CDA timestamp (TS), eg. `20230115103000.000-0500`, every part after the year is optional
+var cdaTimestampRegex = regexp.MustCompile(`^(\d{4})(\d{2})?(\d{2})?(?:(\d{2})(\d{2})?(\d{2})?(\.\d+)?)?([+-]\d{4})?$`)
+
+// fhirDateTime converts a CDA timestamp into a FHIR dateTime, keeping the precision of the timestamp. FHIR requires a timezone
+// if the time is included, so the time of timestamps without a timezone is discarded.
+func fhirDateTime(cdaTimestamp *anyValue) (string, bool) {
+	if cdaTimestamp == nil || len(cdaTimestamp.NullFlavor) > 0 {
+		return "", false
+	}
+	parts := cdaTimestampRegex.FindStringSubmatch(strings.TrimSpace(cdaTimestamp.Value))
+	if parts == nil {
+		return "", false
+	}
+	year, month, day, hour, minute, second, fraction, timezone := parts[1], parts[2], parts[3], parts[4], parts[5], parts[6], parts[7], parts[8]
+
+	date := year
+	layout := "2006"
+	if len(month) > 0 {
+		date += "-" + month
+		layout += "-01"
+		if len(day) > 0 {
+			date += "-" + day
+			layout += "-02"
+		}
+	}
+	if _, err := time.Parse(layout, date); err != nil {
+		return "", false
+	}
+	if len(hour) == 0 || len(day) == 0 || len(timezone) == 0 {
+		return date, true
+	}
+
+	dateTime := fmt.Sprintf("%sT%s:%s:%s%s%s:%s", date, hour, lo.Ternary(len(minute) > 0, minute, "00"), lo.Ternary(len(second) > 0, second, "00"), fraction, timezone[:3], timezone[3:])
+	if _, err := time.Parse(time.RFC3339Nano, dateTime); err != nil {
+		return "", false
+	}
+	return dateTime, true
+}
+
+// fhirDate converts a CDA timestamp into a FHIR date (the time is discarded)
+func fhirDate(cdaTimestamp *anyValue) (string, bool) {
+	dateTime, ok := fhirDateTime(cdaTimestamp)
+	date, _, _ := strings.Cut(dateTime, "T")
+	return date, ok
+}
+
+// fhirIdentifiers converts CDA ids, ids with an extension are scoped by the root OID, otherwise the root is a globally unique
+// OID or UUID.
+func fhirIdentifiers(cdaIds []instanceIdentifier) []fhir401.Identifier {
+	identifiers := []fhir401.Identifier{}
+	for _, cdaId := range cdaIds {
+		if len(cdaId.Root) == 0 || len(cdaId.NullFlavor) > 0 {
+			continue
+		}
+		if len(cdaId.Extension) > 0 {
+			identifiers = append(identifiers, fhir401.Identifier{System: lo.ToPtr(codeSystemUri(cdaId.Root)), Value: lo.ToPtr(cdaId.Extension)})
+		} else if _, err := uuid.Parse(cdaId.Root); err == nil {
+			identifiers = append(identifiers, fhir401.Identifier{System: lo.ToPtr("urn:ietf:rfc:3986"), Value: lo.ToPtr("urn:uuid:" + strings.ToLower(cdaId.Root))})
+		} else {
+			identifiers = append(identifiers, fhir401.Identifier{System: lo.ToPtr("urn:ietf:rfc:3986"), Value: lo.ToPtr("urn:oid:" + cdaId.Root)})
+		}
+	}
+	return identifiers
+}
+
+// instanceIdentifierKey returns a string which uniquely identifies the CDA id, or an empty string for null ids
+func instanceIdentifierKey(cdaId *instanceIdentifier) string {
+	if cdaId == nil || len(cdaId.Root) == 0 || len(cdaId.NullFlavor) > 0 {
+		return ""
+	}
+	if len(cdaId.Extension) == 0 {
+		return cdaId.Root
+	}
+	return cdaId.Root + "^" + cdaId.Extension
+}
+
+// optionalString returns nil for blank strings, so that they're omitted from the resource
+func optionalString(value string) *string {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return nil
+	}
+	return &value
+}
+
+func trimmedStrings(values []string) []string {
+	return lo.FilterMap(values, func(value string, _ int) (string, bool) {
+		value = strings.TrimSpace(value)
+		return value, len(value) > 0
+	})
+}
+
+// narrativeText returns the text of every element with an ID in the section narrative, which is used to resolve the original
+// text references of coded values. Returns an empty map if the narrative cannot be parsed.
+func narrativeText(narrative narrativeBlock) map[string]string {
+	texts := map[string]string{}
+	decoder := xml.NewDecoder(strings.NewReader(narrative.InnerXML))
+	//the ids of the elements containing the current token
+	openIds := []string{}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return texts
+		}
+		switch typedToken := token.(type) {
+		case xml.StartElement:
+			elementId := ""
+			for _, attr := range typedToken.Attr {
+				if attr.Name.Local == "ID" {
+					elementId = attr.Value
+				}
+			}
+			openIds = append(openIds, elementId)
+		case xml.EndElement:
+			if len(openIds) > 0 {
+				if elementId := openIds[len(openIds)-1]; len(elementId) > 0 {
+					texts[elementId] = strings.Join(strings.Fields(texts[elementId]), " ")
+				}
+				openIds = openIds[:len(openIds)-1]
+			}
+		case xml.CharData:
+			for _, elementId := range openIds {
+				if len(elementId) > 0 {
+					texts[elementId] += string(typedToken) + " "
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package ccda
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/validation"
+	"github.com/stretchr/testify/require"
+)
+
+// bundleResources returns the resources of the bundle (as maps) grouped by resource type
+func bundleResources(t *testing.T, conversion *Conversion) map[string][]map[string]interface{} {
+	resources := map[string][]map[string]interface{}{}
+	for _, bundleEntry := range conversion.Bundle.Entry {
+		var resource map[string]interface{}
+		require.NoError(t, json.Unmarshal(bundleEntry.Resource, &resource))
+		resourceType := resource["resourceType"].(string)
+		resources[resourceType] = append(resources[resourceType], resource)
+	}
+	return resources
+}
+
+func TestIsDocument(t *testing.T) {
+	ccdFile, err := os.Open("testdata/ccd.xml")
+	require.NoError(t, err)
+	defer ccdFile.Close()
+	isDocument, err := IsDocument(ccdFile)
+	require.NoError(t, err)
+	require.True(t, isDocument)
+
+	var isDocumentTests = []struct {
+		document   string
+		isDocument bool
+	}{
+		{`{"resourceType":"Bundle","type":"collection"}`, false},
+		{`<?xml version="1.0"?><html xmlns="http://www.w3.org/1999/xhtml"></html>`, false},
+		{`<ClinicalDocument></ClinicalDocument>`, false},
+		{` <!-- comment --> <ClinicalDocument xmlns="urn:hl7-org:v3"></ClinicalDocument>`, true},
+		{``, false},
+	}
+	for ndx, tt := range isDocumentTests {
+		isDocument, err := IsDocument(strings.NewReader(tt.document))
+		require.NoError(t, err)
+		require.Equal(t, tt.isDocument, isDocument, "Expected isDocument to match for isDocumentTests[%d]", ndx)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	document, err := os.ReadFile("testdata/ccd.xml")
+	require.NoError(t, err)
+
+	conversion, err := Convert(document)
+	require.NoError(t, err)
+
+	//the converted bundle must be valid, since it's validated before it's imported
+	bundleJson, err := json.Marshal(conversion.Bundle)
+	require.NoError(t, err)
+	operationOutcome := validation.ValidateResource(bundleJson, validation.Options{})
+	require.False(t, validation.HasErrors(operationOutcome), "Expected the converted bundle to be valid: %v", operationOutcome)
+
+	resources := bundleResources(t, conversion)
+	resourceCounts := map[string]int{}
+	for resourceType, typedResources := range resources {
+		resourceCounts[resourceType] = len(typedResources)
+	}
+	require.Equal(t, map[string]int{
+		"Patient":             1,
+		"Binary":              1,
+		"DocumentReference":   1,
+		"Condition":           2,
+		"MedicationStatement": 1,
+		"AllergyIntolerance":  1,
+		"Observation":         5,
+		"Immunization":        1,
+		"Encounter":           1,
+		"Procedure":           1,
+	}, resourceCounts)
+
+	require.Equal(t, []string{
+		"Problems: section[0].entry[2].observation[0]: problem does not have a code, skipped",
+		"Results: section[3].entry[0].observation[2]: observation value (RTO_PQ_PQ) could not be converted",
+		"Immunizations: section[5].entry[1]: planned immunization skipped",
+		"Social History: section is not supported, 1 entries were skipped",
+	}, stringWarnings(conversion.Warnings))
+
+	//patient
+	patient := resources["Patient"][0]
+	require.Equal(t, conversion.PatientId, patient["id"])
+	require.Equal(t, "female", patient["gender"])
+	require.Equal(t, "1975-05-01", patient["birthDate"])
+	require.Equal(t, []interface{}{map[string]interface{}{"family": "Everywoman", "given": []interface{}{"Eve", "Marie"}}}, patient["name"])
+	require.Equal(t, []interface{}{map[string]interface{}{"system": "urn:oid:2.16.840.1.113883.19.5.99999.2", "value": "998991"}}, patient["identifier"])
+
+	//original document
+	binary := resources["Binary"][0]
+	documentReference := resources["DocumentReference"][0]
+	require.Equal(t, "application/xml", binary["contentType"])
+	require.Equal(t, "Binary/"+binary["id"].(string), documentReference["content"].([]interface{})[0].(map[string]interface{})["attachment"].(map[string]interface{})["url"])
+	require.Equal(t, "2023-03-15T10:45:00-05:00", documentReference["date"])
+	require.Equal(t, map[string]interface{}{"reference": "Patient/" + conversion.PatientId}, documentReference["subject"])
+
+	//problems, the text is resolved from the section narrative
+	pneumonia := resources["Condition"][0]
+	require.Equal(t, "Pneumonia", pneumonia["code"].(map[string]interface{})["text"])
+	require.Len(t, pneumonia["code"].(map[string]interface{})["coding"], 2)
+	require.Equal(t, "2012-08-06", pneumonia["onsetDateTime"])
+	require.Equal(t, "2012-08-15", pneumonia["abatementDateTime"])
+	require.Equal(t, "resolved", pneumonia["clinicalStatus"].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{})["code"])
+	hypertension := resources["Condition"][1]
+	require.Equal(t, "Essential hypertension", hypertension["code"].(map[string]interface{})["text"])
+	require.Equal(t, "active", hypertension["clinicalStatus"].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{})["code"])
+
+	//medications
+	medicationStatement := resources["MedicationStatement"][0]
+	require.Equal(t, "active", medicationStatement["status"])
+	require.Equal(t, "2012-08-06", medicationStatement["effectiveDateTime"])
+	dosage := medicationStatement["dosage"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{"frequency": float64(1), "period": float64(12), "periodUnit": "h"}, dosage["timing"].(map[string]interface{})["repeat"])
+	require.Equal(t, map[string]interface{}{"value": float64(2)}, dosage["doseAndRate"].([]interface{})[0].(map[string]interface{})["doseQuantity"])
+
+	//allergies
+	allergyIntolerance := resources["AllergyIntolerance"][0]
+	require.Equal(t, "allergy", allergyIntolerance["type"])
+	require.Equal(t, []interface{}{"medication"}, allergyIntolerance["category"])
+	require.Equal(t, "Penicillin G benzathine", allergyIntolerance["code"].(map[string]interface{})["text"])
+	reaction := allergyIntolerance["reaction"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, "moderate", reaction["severity"])
+	require.Equal(t, "Hives", reaction["manifestation"].([]interface{})[0].(map[string]interface{})["text"])
+
+	//results & vital signs
+	hemoglobin := resources["Observation"][0]
+	require.Equal(t, "final", hemoglobin["status"])
+	require.Equal(t, "laboratory", hemoglobin["category"].([]interface{})[0].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{})["code"])
+	require.Equal(t, "2012-08-10T08:00:00-05:00", hemoglobin["effectiveDateTime"])
+	require.Equal(t, map[string]interface{}{"value": 13.2, "unit": "g/dL", "system": "http://unitsofmeasure.org", "code": "g/dL"}, hemoglobin["valueQuantity"])
+	require.Len(t, hemoglobin["referenceRange"], 1)
+	require.Len(t, hemoglobin["interpretation"], 1)
+	leukocytes := resources["Observation"][1]
+	//the effective time is inherited from the organizer
+	require.Equal(t, map[string]interface{}{"start": "2012-08-10T08:00:00-05:00", "end": "2012-08-10T08:00:00-05:00"}, leukocytes["effectivePeriod"])
+	require.Equal(t, []interface{}{map[string]interface{}{"text": "4.3-10.8 10*3/uL"}}, leukocytes["referenceRange"])
+	height := resources["Observation"][3]
+	require.Equal(t, "vital-signs", height["category"].([]interface{})[0].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{})["code"])
+	require.Equal(t, "2012-08-06", height["effectiveDateTime"])
+
+	//immunizations
+	immunization := resources["Immunization"][0]
+	require.Equal(t, "completed", immunization["status"])
+	require.Equal(t, "2010-08-15", immunization["occurrenceDateTime"])
+	require.Equal(t, "1", immunization["lotNumber"])
+
+	//encounters
+	encounter := resources["Encounter"][0]
+	require.Equal(t, "finished", encounter["status"])
+	require.Equal(t, "AMB", encounter["class"].(map[string]interface{})["code"])
+	require.Equal(t, map[string]interface{}{"start": "2012-08-06T10:00:00-05:00", "end": "2012-08-06T10:30:00-05:00"}, encounter["period"])
+	require.Equal(t, "Pneumonia", encounter["reasonCode"].([]interface{})[0].(map[string]interface{})["text"])
+
+	//procedures
+	procedure := resources["Procedure"][0]
+	require.Equal(t, "completed", procedure["status"])
+	require.Equal(t, "2012-08-07", procedure["performedDateTime"])
+
+	//converting the document again generates the same resources
+	conversionAgain, err := Convert(document)
+	require.NoError(t, err)
+	require.Equal(t, conversion.Bundle, conversionAgain.Bundle)
+}
+
+func TestConvert_WithInvalidDocument(t *testing.T) {
+	_, err := Convert([]byte(`<ClinicalDocument xmlns="urn:hl7-org:v3"><title>No patient</title></ClinicalDocument>`))
+	require.EqualError(t, err, "C-CDA document does not contain a recordTarget (patient)")
+
+	_, err = Convert([]byte(`<ClinicalDocument><recordTarget/></ClinicalDocument>`))
+	require.Error(t, err)
+
+	_, err = Convert([]byte(`{"resourceType":"Bundle"}`))
+	require.Error(t, err)
+}
+
+func TestFhirDateTime(t *testing.T) {
+	var fhirDateTimeTests = []struct {
+		cdaTimestamp string
+		dateTime     string
+		ok           bool
+	}{
+		{"2023", "2023", true},
+		{"202303", "2023-03", true},
+		{"20230315", "2023-03-15", true},
+		{"20230315104500-0500", "2023-03-15T10:45:00-05:00", true},
+		{"202303151045+0130", "2023-03-15T10:45:00+01:30", true},
+		{"20230315104512.123+0000", "2023-03-15T10:45:12.123+00:00", true},
+		//the time is discarded when there's no timezone
+		{"20230315104500", "2023-03-15", true},
+		{"20231315", "", false},
+		{"2023-03-15", "", false},
+		{"", "", false},
+	}
+	for ndx, tt := range fhirDateTimeTests {
+		dateTime, ok := fhirDateTime(&anyValue{Value: tt.cdaTimestamp})
+		require.Equal(t, tt.ok, ok, "Expected ok to match for fhirDateTimeTests[%d]", ndx)
+		require.Equal(t, tt.dateTime, dateTime, "Expected dateTime to match for fhirDateTimeTests[%d]", ndx)
+	}
+}
+
+func stringWarnings(warnings []Warning) []string {
+	stringWarnings := []string{}
+	for _, warning := range warnings {
+		stringWarnings = append(stringWarnings, warning.String())
+	}
+	return stringWarnings
+}
@@ -0,0 +1,156 @@
+package ccda
+
+import "encoding/xml"
+
+// The structs below model the subset of the HL7 CDA R2 schema (urn:hl7-org:v3) used by C-CDA documents that is required to
+// convert the supported sections. Elements which are not modeled are ignored while the document is parsed.
+//
+// CDA entries share the same structure (Act, Observation, SubstanceAdministration, etc), so a single clinicalStatement
+// struct is used for every entry type.
+
+type clinicalDocument struct {
+	XMLName       xml.Name            `xml:"ClinicalDocument"`
+	ID            *instanceIdentifier `xml:"id"`
+	Code          *conceptDescriptor  `xml:"code"`
+	Title         string              `xml:"title"`
+	EffectiveTime *anyValue           `xml:"effectiveTime"`
+	RecordTargets []patientRole       `xml:"recordTarget>patientRole"`
+	Sections      []section           `xml:"component>structuredBody>component>section"`
+}
+
+type patientRole struct {
+	IDs       []instanceIdentifier `xml:"id"`
+	Addresses []address            `xml:"addr"`
+	Telecoms  []telecom            `xml:"telecom"`
+	Patient   struct {
+		Names     []personName       `xml:"name"`
+		Gender    *conceptDescriptor `xml:"administrativeGenderCode"`
+		BirthTime *anyValue          `xml:"birthTime"`
+	} `xml:"patient"`
+}
+
+type personName struct {
+	Prefix []string `xml:"prefix"`
+	Given  []string `xml:"given"`
+	Family string   `xml:"family"`
+	Suffix []string `xml:"suffix"`
+}
+
+type address struct {
+	StreetAddressLines []string `xml:"streetAddressLine"`
+	City               string   `xml:"city"`
+	State              string   `xml:"state"`
+	PostalCode         string   `xml:"postalCode"`
+	Country            string   `xml:"country"`
+}
+
+type telecom struct {
+	Value string `xml:"value,attr"` //eg. `tel:+1-555-555-2003` or `mailto:jane@example.com`
+}
+
+type section struct {
+	TemplateIDs []instanceIdentifier `xml:"templateId"`
+	Code        *conceptDescriptor   `xml:"code"`
+	Title       string               `xml:"title"`
+	Text        narrativeBlock       `xml:"text"`
+	Entries     []entry              `xml:"entry"`
+}
+
+// narrativeBlock is the human readable content of a section, entries may reference the text of a narrative element by its ID
+// (eg. `<originalText><reference value="#problem1"/></originalText>`)
+type narrativeBlock struct {
+	InnerXML string `xml:",innerxml"`
+}
+
+// clinicalStatements is the choice of entry types that may be included in an entry, component or entryRelationship
+type clinicalStatements struct {
+	Act                     *clinicalStatement `xml:"act"`
+	Observation             *clinicalStatement `xml:"observation"`
+	Organizer               *clinicalStatement `xml:"organizer"`
+	SubstanceAdministration *clinicalStatement `xml:"substanceAdministration"`
+	Encounter               *clinicalStatement `xml:"encounter"`
+	Procedure               *clinicalStatement `xml:"procedure"`
+}
+
+type entry struct {
+	clinicalStatements
+}
+
+type entryRelationship struct {
+	TypeCode string `xml:"typeCode,attr"`
+	clinicalStatements
+}
+
+type clinicalStatement struct {
+	MoodCode    string `xml:"moodCode,attr"`
+	NegationInd bool   `xml:"negationInd,attr"`
+
+	IDs                 []instanceIdentifier `xml:"id"`
+	Code                *conceptDescriptor   `xml:"code"`
+	StatusCode          *conceptDescriptor   `xml:"statusCode"`
+	EffectiveTimes      []anyValue           `xml:"effectiveTime"`
+	Values              []anyValue           `xml:"value"`
+	InterpretationCodes []conceptDescriptor  `xml:"interpretationCode"`
+	RouteCode           *conceptDescriptor   `xml:"routeCode"`
+	DoseQuantity        *anyValue            `xml:"doseQuantity"`
+	ReferenceRanges     []referenceRange     `xml:"referenceRange>observationRange"`
+
+	//SubstanceAdministration
+	ProductCode *conceptDescriptor `xml:"consumable>manufacturedProduct>manufacturedMaterial>code"`
+	LotNumber   string             `xml:"consumable>manufacturedProduct>manufacturedMaterial>lotNumberText"`
+	//Allergy observations identify the allergen as a consumable participant
+	Participants []participant `xml:"participant"`
+
+	//Organizer
+	Components         []entry             `xml:"component"`
+	EntryRelationships []entryRelationship `xml:"entryRelationship"`
+}
+
+type participant struct {
+	TypeCode string             `xml:"typeCode,attr"`
+	Code     *conceptDescriptor `xml:"participantRole>playingEntity>code"`
+}
+
+type referenceRange struct {
+	Text  string    `xml:"text"`
+	Value *anyValue `xml:"value"`
+}
+
+// instanceIdentifier is a CDA II, eg. `<id root="2.16.840.1.113883.19.5" extension="12345"/>`
+type instanceIdentifier struct {
+	Root       string `xml:"root,attr"`
+	Extension  string `xml:"extension,attr"`
+	NullFlavor string `xml:"nullFlavor,attr"`
+}
+
+// conceptDescriptor is a CDA CD (and its restrictions CE, CV, CS), eg. `<code code="8480-6" codeSystem="2.16.840.1.113883.6.1" displayName="Systolic blood pressure"/>`
+type conceptDescriptor struct {
+	Code         string              `xml:"code,attr"`
+	CodeSystem   string              `xml:"codeSystem,attr"`
+	DisplayName  string              `xml:"displayName,attr"`
+	NullFlavor   string              `xml:"nullFlavor,attr"`
+	OriginalText *originalText       `xml:"originalText"`
+	Translations []conceptDescriptor `xml:"translation"`
+}
+
+type originalText struct {
+	Text      string `xml:",chardata"`
+	Reference *struct {
+		Value string `xml:"value,attr"`
+	} `xml:"reference"`
+}
+
+// anyValue is a CDA value of any data type, the data type is identified by the `xsi:type` attribute when the element allows
+// multiple data types (eg. Observation.value). Depending on the data type, the value is stored in an attribute, the
+// character data or the low/high elements. Timestamps (TS & IVL_TS) are also parsed as an anyValue.
+type anyValue struct {
+	conceptDescriptor
+	Type  string    `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr"`
+	Value string    `xml:"value,attr"`
+	Unit  string    `xml:"unit,attr"`
+	Text  string    `xml:",chardata"`
+	Low   *anyValue `xml:"low"`
+	High  *anyValue `xml:"high"`
+	//PIVL_TS, the frequency of a medication
+	Period *anyValue `xml:"period"`
+}
@@ -0,0 +1,672 @@
+package ccda
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/samber/lo"
+)
+
+type supportedSection struct {
+	//the LOINC code of the section
+	code string
+	//the C-CDA template id of the section (without the `entries required` suffix), used when the section code is missing
+	templateId   string
+	convertEntry func(c *converter, entryKey string, cdaEntry entry)
+}
+
+var supportedSections = []supportedSection{
+	{"11450-4", "2.16.840.1.113883.10.20.22.2.5", (*converter).convertProblemEntry},
+	{"10160-0", "2.16.840.1.113883.10.20.22.2.1", (*converter).convertMedicationEntry},
+	{"48765-2", "2.16.840.1.113883.10.20.22.2.6", (*converter).convertAllergyEntry},
+	{"30954-2", "2.16.840.1.113883.10.20.22.2.3", (*converter).convertResultEntry},
+	{"8716-3", "2.16.840.1.113883.10.20.22.2.4", (*converter).convertVitalSignEntry},
+	{"11369-6", "2.16.840.1.113883.10.20.22.2.2", (*converter).convertImmunizationEntry},
+	{"46240-8", "2.16.840.1.113883.10.20.22.2.22", (*converter).convertEncounterEntry},
+	{"47519-4", "2.16.840.1.113883.10.20.22.2.7", (*converter).convertProcedureEntry},
+}
+
+func (c *converter) convertSection(sectionNdx int, cdaSection section) {
+	c.sectionTitle = strings.TrimSpace(cdaSection.Title)
+	if len(c.sectionTitle) == 0 && cdaSection.Code != nil {
+		c.sectionTitle = strings.TrimSpace(lo.Ternary(len(cdaSection.Code.DisplayName) > 0, cdaSection.Code.DisplayName, cdaSection.Code.Code))
+	}
+	if len(c.sectionTitle) == 0 {
+		c.sectionTitle = fmt.Sprintf("section[%d]", sectionNdx)
+	}
+	defer func() { c.sectionTitle = "" }()
+
+	sectionConverter, found := lo.Find(supportedSections, func(supported supportedSection) bool {
+		if cdaSection.Code != nil && cdaSection.Code.Code == supported.code {
+			return true
+		}
+		return lo.ContainsBy(cdaSection.TemplateIDs, func(templateId instanceIdentifier) bool {
+			return templateId.Root == supported.templateId || templateId.Root == supported.templateId+".1"
+		})
+	})
+	if !found {
+		if len(cdaSection.Entries) > 0 {
+			c.warn("section is not supported, %d entries were skipped", len(cdaSection.Entries))
+		}
+		return
+	}
+
+	c.narrative = narrativeText(cdaSection.Text)
+	for entryNdx, cdaEntry := range cdaSection.Entries {
+		sectionConverter.convertEntry(c, fmt.Sprintf("section[%d].entry[%d]", sectionNdx, entryNdx), cdaEntry)
+	}
+}
+
+// Problems
+
+func (c *converter) convertProblemEntry(entryKey string, cdaEntry entry) {
+	concern, ok := c.concernAct(entryKey, cdaEntry, "problem concern act")
+	if !ok {
+		return
+	}
+
+	for problemNdx, problem := range concern.relatedStatements("SUBJ") {
+		problemKey := fmt.Sprintf("%s.observation[%d]", entryKey, problemNdx)
+		code := codeableConcept(problem.codedValue(), c.narrative)
+		if code == nil {
+			c.warn("%s: problem does not have a code, skipped", problemKey)
+			continue
+		}
+
+		condition := resource{
+			"category": []fhir401.CodeableConcept{{Coding: []fhir401.Coding{{
+				System:  lo.ToPtr("http://terminology.hl7.org/CodeSystem/condition-category"),
+				Code:    lo.ToPtr("problem-list-item"),
+				Display: lo.ToPtr("Problem List Item"),
+			}}}},
+			"code":    code,
+			"subject": c.patientReference(),
+		}
+		onset, abatement := effectivePeriod(problem.effectiveTime())
+		if len(onset) > 0 {
+			condition["onsetDateTime"] = onset
+		}
+		if len(abatement) > 0 {
+			condition["abatementDateTime"] = abatement
+		}
+		if recorded, _ := effectivePeriod(concern.effectiveTime()); len(recorded) > 0 {
+			condition["recordedDate"] = recorded
+		}
+
+		//the status of the concern act tracks the status of the problem
+		clinicalStatus := lo.Ternary(len(abatement) > 0, "resolved", "active")
+		switch statusCode(concern) {
+		case "completed":
+			clinicalStatus = "resolved"
+		case "suspended", "aborted":
+			clinicalStatus = "inactive"
+		}
+		condition["clinicalStatus"] = codedConcept("http://terminology.hl7.org/CodeSystem/condition-clinical", clinicalStatus)
+		if problem.NegationInd {
+			condition["verificationStatus"] = codedConcept("http://terminology.hl7.org/CodeSystem/condition-ver-status", "refuted")
+		}
+
+		c.addResource("Condition", problem.IDs, problemKey, condition)
+	}
+}
+
+// Allergies
+
+// allergyType is the type & category of an AllergyIntolerance, an empty string if it's not known
+type allergyType struct {
+	intoleranceType string
+	category        string
+}
+
+// allergyTypes maps the SNOMED CT code of an allergy observation's value (the type of allergy/intolerance) to the AllergyIntolerance type & category
+var allergyTypes = map[string]allergyType{
+	"419199007": {"allergy", ""},               //allergy to substance
+	"416098002": {"allergy", "medication"},     //drug allergy
+	"414285001": {"allergy", "food"},           //food allergy
+	"426232007": {"allergy", "environment"},    //environmental allergy
+	"59037007":  {"intolerance", "medication"}, //drug intolerance
+	"235719002": {"intolerance", "food"},       //intolerance to food
+	"419511003": {"", "medication"},            //propensity to adverse reactions to drug
+	"418471000": {"", "food"},                  //propensity to adverse reactions to food
+}
+
+// allergySeverities maps the SNOMED CT code of a severity observation's value to the AllergyIntolerance reaction severity
+var allergySeverities = map[string]string{
+	"255604002": "mild",
+	"6736007":   "moderate",
+	"24484000":  "severe",
+}
+
+func (c *converter) convertAllergyEntry(entryKey string, cdaEntry entry) {
+	concern, ok := c.concernAct(entryKey, cdaEntry, "allergy concern act")
+	if !ok {
+		return
+	}
+
+	for allergyNdx, allergy := range concern.relatedStatements("SUBJ") {
+		allergyKey := fmt.Sprintf("%s.observation[%d]", entryKey, allergyNdx)
+		if allergy.NegationInd {
+			c.warn("%s: negated allergy (eg. no known allergies) skipped", allergyKey)
+			continue
+		}
+		var allergen *fhir401.CodeableConcept
+		for _, allergyParticipant := range allergy.Participants {
+			if allergyParticipant.TypeCode == "CSM" && allergen == nil {
+				allergen = codeableConcept(allergyParticipant.Code, c.narrative)
+			}
+		}
+		if allergen == nil {
+			c.warn("%s: allergy does not have an allergen code, skipped", allergyKey)
+			continue
+		}
+
+		allergyIntolerance := resource{
+			"code":    allergen,
+			"patient": c.patientReference(),
+		}
+		switch statusCode(concern) {
+		case "active":
+			allergyIntolerance["clinicalStatus"] = codedConcept("http://terminology.hl7.org/CodeSystem/allergyintolerance-clinical", "active")
+		case "completed":
+			allergyIntolerance["clinicalStatus"] = codedConcept("http://terminology.hl7.org/CodeSystem/allergyintolerance-clinical", "resolved")
+		}
+		if allergyValue := allergy.codedValue(); allergyValue != nil {
+			if typeAndCategory, found := allergyTypes[allergyValue.Code]; found {
+				if len(typeAndCategory.intoleranceType) > 0 {
+					allergyIntolerance["type"] = typeAndCategory.intoleranceType
+				}
+				if len(typeAndCategory.category) > 0 {
+					allergyIntolerance["category"] = []string{typeAndCategory.category}
+				}
+			}
+		}
+		if onset, _ := effectivePeriod(allergy.effectiveTime()); len(onset) > 0 {
+			allergyIntolerance["onsetDateTime"] = onset
+		}
+
+		reactions := []resource{}
+		for _, reaction := range allergy.relatedStatements("MFST") {
+			manifestation := codeableConcept(reaction.codedValue(), c.narrative)
+			if manifestation == nil {
+				continue
+			}
+			fhirReaction := resource{"manifestation": []fhir401.CodeableConcept{*manifestation}}
+			for _, severity := range reaction.relatedStatements("SUBJ") {
+				if severityValue := severity.codedValue(); severityValue != nil && len(allergySeverities[severityValue.Code]) > 0 {
+					fhirReaction["severity"] = allergySeverities[severityValue.Code]
+				}
+			}
+			reactions = append(reactions, fhirReaction)
+		}
+		if len(reactions) > 0 {
+			allergyIntolerance["reaction"] = reactions
+		}
+
+		c.addResource("AllergyIntolerance", allergy.IDs, allergyKey, allergyIntolerance)
+	}
+}
+
+// Medications
+
+// medicationStatuses maps the status of a medication activity to the MedicationStatement status
+var medicationStatuses = map[string]string{
+	"active":    "active",
+	"completed": "completed",
+	"aborted":   "stopped",
+	"suspended": "on-hold",
+	"held":      "on-hold",
+	"cancelled": "not-taken",
+	"new":       "intended",
+	"nullified": "entered-in-error",
+}
+
+// timingUnits are the UCUM units of a medication frequency (PIVL_TS) which are also FHIR units of time
+var timingUnits = []string{"s", "min", "h", "d", "wk", "mo", "a"}
+
+func (c *converter) convertMedicationEntry(entryKey string, cdaEntry entry) {
+	administration := cdaEntry.SubstanceAdministration
+	if administration == nil {
+		c.warn("%s: entry is not a medication activity, skipped", entryKey)
+		return
+	}
+	medication := codeableConcept(administration.ProductCode, c.narrative)
+	if medication == nil {
+		c.warn("%s: medication does not have a code, skipped", entryKey)
+		return
+	}
+
+	status := lo.Ternary(administration.MoodCode == "INT", "intended", "unknown")
+	if mappedStatus, found := medicationStatuses[statusCode(administration)]; found {
+		status = mappedStatus
+	}
+	if administration.NegationInd {
+		status = "not-taken"
+	}
+	medicationStatement := resource{
+		"status":                    status,
+		"medicationCodeableConcept": medication,
+		"subject":                   c.patientReference(),
+	}
+	setEffective(medicationStatement, "effective", administration.effectiveTime())
+
+	dosage := fhir401.Dosage{Route: codeableConcept(administration.RouteCode, c.narrative)}
+	if dose := quantity(administration.DoseQuantity); dose != nil {
+		dosage.DoseAndRate = []fhir401.DosageDoseAndRate{{DoseQuantity: dose}}
+	}
+	for _, effectiveTime := range administration.EffectiveTimes {
+		if strings.HasSuffix(effectiveTime.Type, "PIVL_TS") && effectiveTime.Period != nil && lo.Contains(timingUnits, effectiveTime.Period.Unit) {
+			if period := quantity(effectiveTime.Period); period != nil {
+				dosage.Timing = &fhir401.Timing{Repeat: &fhir401.TimingRepeat{
+					Frequency:  lo.ToPtr(1),
+					Period:     period.Value,
+					PeriodUnit: lo.ToPtr(effectiveTime.Period.Unit),
+				}}
+			}
+		}
+	}
+	if dosage.Route != nil || len(dosage.DoseAndRate) > 0 || dosage.Timing != nil {
+		medicationStatement["dosage"] = []fhir401.Dosage{dosage}
+	}
+
+	c.addResource("MedicationStatement", administration.IDs, entryKey, medicationStatement)
+}
+
+// Results & Vital Signs
+
+// observationStatuses maps the status of a result/vital sign observation to the Observation status
+var observationStatuses = map[string]string{
+	"completed": "final",
+	"active":    "preliminary",
+	"aborted":   "cancelled",
+	"cancelled": "cancelled",
+	"nullified": "entered-in-error",
+}
+
+func (c *converter) convertResultEntry(entryKey string, cdaEntry entry) {
+	c.convertObservationEntry(entryKey, cdaEntry, "laboratory", "Laboratory")
+}
+
+func (c *converter) convertVitalSignEntry(entryKey string, cdaEntry entry) {
+	c.convertObservationEntry(entryKey, cdaEntry, "vital-signs", "Vital Signs")
+}
+
+// convertObservationEntry converts the observations of a result (or vital sign) organizer, or a standalone observation
+func (c *converter) convertObservationEntry(entryKey string, cdaEntry entry, categoryCode string, categoryDisplay string) {
+	var observations []*clinicalStatement
+	var organizerEffectiveTime *anyValue
+	if organizer := cdaEntry.Organizer; organizer != nil {
+		organizerEffectiveTime = organizer.effectiveTime()
+		for _, component := range organizer.Components {
+			if component.Observation != nil {
+				observations = append(observations, component.Observation)
+			}
+		}
+	} else if cdaEntry.Observation != nil {
+		observations = append(observations, cdaEntry.Observation)
+	} else {
+		c.warn("%s: entry is not an organizer or observation, skipped", entryKey)
+		return
+	}
+
+	for observationNdx, cdaObservation := range observations {
+		observationKey := fmt.Sprintf("%s.observation[%d]", entryKey, observationNdx)
+		code := codeableConcept(cdaObservation.Code, c.narrative)
+		if code == nil {
+			c.warn("%s: observation does not have a code, skipped", observationKey)
+			continue
+		}
+
+		status := "unknown"
+		if mappedStatus, found := observationStatuses[statusCode(cdaObservation)]; found {
+			status = mappedStatus
+		}
+		observation := resource{
+			"status": status,
+			"category": []fhir401.CodeableConcept{{Coding: []fhir401.Coding{{
+				System:  lo.ToPtr("http://terminology.hl7.org/CodeSystem/observation-category"),
+				Code:    lo.ToPtr(categoryCode),
+				Display: lo.ToPtr(categoryDisplay),
+			}}}},
+			"code":    code,
+			"subject": c.patientReference(),
+		}
+		if !setEffective(observation, "effective", cdaObservation.effectiveTime()) {
+			setEffective(observation, "effective", organizerEffectiveTime)
+		}
+		if len(cdaObservation.Values) > 0 && !c.setObservationValue(observation, cdaObservation.Values[0]) {
+			c.warn("%s: observation value (%s) could not be converted", observationKey, cdaObservation.Values[0].Type)
+		}
+
+		interpretations := []fhir401.CodeableConcept{}
+		for ndx := range cdaObservation.InterpretationCodes {
+			if interpretation := codeableConcept(&cdaObservation.InterpretationCodes[ndx], c.narrative); interpretation != nil {
+				interpretations = append(interpretations, *interpretation)
+			}
+		}
+		if len(interpretations) > 0 {
+			observation["interpretation"] = interpretations
+		}
+
+		referenceRanges := []fhir401.ObservationReferenceRange{}
+		for _, cdaReferenceRange := range cdaObservation.ReferenceRanges {
+			referenceRange := fhir401.ObservationReferenceRange{Text: optionalString(cdaReferenceRange.Text)}
+			if cdaReferenceRange.Value != nil {
+				referenceRange.Low = quantity(cdaReferenceRange.Value.Low)
+				referenceRange.High = quantity(cdaReferenceRange.Value.High)
+			}
+			if referenceRange.Low != nil || referenceRange.High != nil || referenceRange.Text != nil {
+				referenceRanges = append(referenceRanges, referenceRange)
+			}
+		}
+		if len(referenceRanges) > 0 {
+			observation["referenceRange"] = referenceRanges
+		}
+
+		c.addResource("Observation", cdaObservation.IDs, observationKey, observation)
+	}
+}
+
+// setObservationValue converts the value of an observation based on its data type (`xsi:type`). Returns false if the data type
+// is not supported (or the value is invalid). Null values are ignored.
+func (c *converter) setObservationValue(observation resource, cdaValue anyValue) bool {
+	if len(cdaValue.NullFlavor) > 0 {
+		return true
+	}
+	//the data type may include a namespace prefix, eg. `xsi:type="v3:PQ"`
+	dataType := cdaValue.Type
+	if _, localType, found := strings.Cut(dataType, ":"); found {
+		dataType = localType
+	}
+
+	switch dataType {
+	case "PQ", "REAL":
+		if valueQuantity := quantity(&cdaValue); valueQuantity != nil {
+			observation["valueQuantity"] = valueQuantity
+			return true
+		}
+	case "INT":
+		if valueInteger, err := strconv.Atoi(strings.TrimSpace(cdaValue.Value)); err == nil {
+			observation["valueInteger"] = valueInteger
+			return true
+		}
+	case "CD", "CE", "CV", "CO", "CS":
+		if valueCodeableConcept := codeableConcept(&cdaValue.conceptDescriptor, c.narrative); valueCodeableConcept != nil {
+			observation["valueCodeableConcept"] = valueCodeableConcept
+			return true
+		}
+	case "ST", "ED":
+		if valueString := optionalString(cdaValue.Text); valueString != nil {
+			observation["valueString"] = valueString
+			return true
+		}
+	case "BL":
+		if valueBoolean, err := strconv.ParseBool(cdaValue.Value); err == nil {
+			observation["valueBoolean"] = valueBoolean
+			return true
+		}
+	case "IVL_PQ":
+		valueRange := fhir401.Range{Low: quantity(cdaValue.Low), High: quantity(cdaValue.High)}
+		if valueRange.Low != nil || valueRange.High != nil {
+			observation["valueRange"] = valueRange
+			return true
+		}
+	case "TS":
+		if valueDateTime, ok := fhirDateTime(&cdaValue); ok {
+			observation["valueDateTime"] = valueDateTime
+			return true
+		}
+	}
+	return false
+}
+
+// Immunizations
+
+func (c *converter) convertImmunizationEntry(entryKey string, cdaEntry entry) {
+	administration := cdaEntry.SubstanceAdministration
+	if administration == nil {
+		c.warn("%s: entry is not an immunization activity, skipped", entryKey)
+		return
+	}
+	if administration.MoodCode == "INT" {
+		c.warn("%s: planned immunization skipped", entryKey)
+		return
+	}
+	vaccine := codeableConcept(administration.ProductCode, c.narrative)
+	if vaccine == nil {
+		c.warn("%s: immunization does not have a vaccine code, skipped", entryKey)
+		return
+	}
+
+	status := "completed"
+	if administration.NegationInd {
+		status = "not-done"
+	} else if statusCode(administration) == "nullified" {
+		status = "entered-in-error"
+	}
+	immunization := resource{
+		"status":      status,
+		"vaccineCode": vaccine,
+		"patient":     c.patientReference(),
+	}
+	if occurrence, _ := effectivePeriod(administration.effectiveTime()); len(occurrence) > 0 {
+		immunization["occurrenceDateTime"] = occurrence
+	} else {
+		//the occurrence is required
+		immunization["occurrenceString"] = "unknown"
+		c.warn("%s: immunization does not have a date", entryKey)
+	}
+	if lotNumber := optionalString(administration.LotNumber); lotNumber != nil {
+		immunization["lotNumber"] = lotNumber
+	}
+	if route := codeableConcept(administration.RouteCode, c.narrative); route != nil {
+		immunization["route"] = route
+	}
+	if dose := quantity(administration.DoseQuantity); dose != nil {
+		immunization["doseQuantity"] = dose
+	}
+
+	c.addResource("Immunization", administration.IDs, entryKey, immunization)
+}
+
+// Encounters
+
+// encounterStatuses maps the status of an encounter activity to the Encounter status
+var encounterStatuses = map[string]string{
+	"completed": "finished",
+	"active":    "in-progress",
+	"aborted":   "cancelled",
+	"cancelled": "cancelled",
+	"nullified": "entered-in-error",
+}
+
+func (c *converter) convertEncounterEntry(entryKey string, cdaEntry entry) {
+	cdaEncounter := cdaEntry.Encounter
+	if cdaEncounter == nil {
+		c.warn("%s: entry is not an encounter activity, skipped", entryKey)
+		return
+	}
+
+	status := "unknown"
+	if mappedStatus, found := encounterStatuses[statusCode(cdaEncounter)]; found {
+		status = mappedStatus
+	}
+	encounter := resource{
+		"status":  status,
+		"class":   encounterClass(cdaEncounter.Code),
+		"subject": c.patientReference(),
+	}
+	if encounterType := codeableConcept(cdaEncounter.Code, c.narrative); encounterType != nil {
+		encounter["type"] = []fhir401.CodeableConcept{*encounterType}
+	}
+	if start, end := effectivePeriod(cdaEncounter.effectiveTime()); len(start) > 0 || len(end) > 0 {
+		encounter["period"] = fhir401.Period{Start: optionalString(start), End: optionalString(end)}
+	}
+
+	//the reasons for the encounter, and the encounter diagnoses (a Diagnosis act containing problem observations)
+	reasons := []fhir401.CodeableConcept{}
+	for _, relationship := range cdaEncounter.EntryRelationships {
+		reasonObservations := []*clinicalStatement{}
+		if relationship.TypeCode == "RSON" && relationship.Observation != nil {
+			reasonObservations = append(reasonObservations, relationship.Observation)
+		} else if relationship.Act != nil && relationship.Act.Code != nil && relationship.Act.Code.Code == "29308-4" {
+			reasonObservations = append(reasonObservations, relationship.Act.relatedStatements("SUBJ")...)
+		}
+		for _, reasonObservation := range reasonObservations {
+			if reason := codeableConcept(reasonObservation.codedValue(), c.narrative); reason != nil {
+				reasons = append(reasons, *reason)
+			}
+		}
+	}
+	if len(reasons) > 0 {
+		encounter["reasonCode"] = reasons
+	}
+
+	c.addResource("Encounter", cdaEncounter.IDs, entryKey, encounter)
+}
+
+// encounterClass returns the ActCode coding of the encounter (or its translations), encounters are ambulatory by default
+func encounterClass(cdaCode *conceptDescriptor) fhir401.Coding {
+	if cdaCode != nil {
+		for _, cdaCoding := range append([]conceptDescriptor{*cdaCode}, cdaCode.Translations...) {
+			if cdaCoding.CodeSystem == "2.16.840.1.113883.5.4" && len(cdaCoding.Code) > 0 {
+				return fhir401.Coding{System: lo.ToPtr(codeSystemUri(cdaCoding.CodeSystem)), Code: lo.ToPtr(cdaCoding.Code), Display: optionalString(cdaCoding.DisplayName)}
+			}
+		}
+	}
+	return fhir401.Coding{System: lo.ToPtr(codeSystemUri("2.16.840.1.113883.5.4")), Code: lo.ToPtr("AMB"), Display: lo.ToPtr("ambulatory")}
+}
+
+// Procedures
+
+// procedureStatuses maps the status of a procedure activity to the Procedure status
+var procedureStatuses = map[string]string{
+	"completed": "completed",
+	"active":    "in-progress",
+	"aborted":   "stopped",
+	"cancelled": "not-done",
+	"new":       "preparation",
+	"held":      "on-hold",
+	"suspended": "on-hold",
+	"nullified": "entered-in-error",
+}
+
+func (c *converter) convertProcedureEntry(entryKey string, cdaEntry entry) {
+	//procedure activities may be a procedure, observation or act
+	cdaProcedure, found := lo.Find([]*clinicalStatement{cdaEntry.Procedure, cdaEntry.Observation, cdaEntry.Act}, func(statement *clinicalStatement) bool {
+		return statement != nil
+	})
+	if !found {
+		c.warn("%s: entry is not a procedure activity, skipped", entryKey)
+		return
+	}
+	code := codeableConcept(cdaProcedure.Code, c.narrative)
+	if code == nil {
+		c.warn("%s: procedure does not have a code, skipped", entryKey)
+		return
+	}
+
+	status := "unknown"
+	if mappedStatus, found := procedureStatuses[statusCode(cdaProcedure)]; found {
+		status = mappedStatus
+	}
+	if cdaProcedure.NegationInd {
+		status = "not-done"
+	}
+	procedure := resource{
+		"status":  status,
+		"code":    code,
+		"subject": c.patientReference(),
+	}
+	setEffective(procedure, "performed", cdaProcedure.effectiveTime())
+
+	c.addResource("Procedure", cdaProcedure.IDs, entryKey, procedure)
+}
+
+// Helpers
+
+// concernAct returns the concern act of a problem/allergy entry, which tracks the status of the related observations. Observations
+// which are not wrapped in a concern act are treated as if they were.
+func (c *converter) concernAct(entryKey string, cdaEntry entry, description string) (*clinicalStatement, bool) {
+	if cdaEntry.Act != nil {
+		return cdaEntry.Act, true
+	} else if cdaEntry.Observation != nil {
+		return &clinicalStatement{EntryRelationships: []entryRelationship{{
+			TypeCode:           "SUBJ",
+			clinicalStatements: clinicalStatements{Observation: cdaEntry.Observation},
+		}}}, true
+	}
+	c.warn("%s: entry is not a %s, skipped", entryKey, description)
+	return nil, false
+}
+
+// relatedStatements returns the observations related to the statement by an entryRelationship with the type code
+func (s *clinicalStatement) relatedStatements(typeCode string) []*clinicalStatement {
+	related := []*clinicalStatement{}
+	for _, relationship := range s.EntryRelationships {
+		if relationship.TypeCode == typeCode && relationship.Observation != nil {
+			related = append(related, relationship.Observation)
+		}
+	}
+	return related
+}
+
+// codedValue returns the first value of the statement, which is a coded value (CD) for problem, allergy & reaction observations
+func (s *clinicalStatement) codedValue() *conceptDescriptor {
+	if len(s.Values) == 0 {
+		return nil
+	}
+	return &s.Values[0].conceptDescriptor
+}
+
+// effectiveTime returns the effective time (or interval) of the statement, medication frequencies (PIVL_TS & EIVL_TS) are ignored
+func (s *clinicalStatement) effectiveTime() *anyValue {
+	for ndx, effectiveTime := range s.EffectiveTimes {
+		if !strings.HasSuffix(effectiveTime.Type, "PIVL_TS") && !strings.HasSuffix(effectiveTime.Type, "EIVL_TS") {
+			return &s.EffectiveTimes[ndx]
+		}
+	}
+	return nil
+}
+
+// statusCode returns the status of the statement, eg. `completed`
+func statusCode(s *clinicalStatement) string {
+	if s.StatusCode == nil {
+		return ""
+	}
+	return strings.ToLower(s.StatusCode.Code)
+}
+
+// effectivePeriod returns the start & end of an effective time as FHIR dateTimes (or empty strings if they're missing), a point
+// in time is returned as the start
+func effectivePeriod(effectiveTime *anyValue) (string, string) {
+	if effectiveTime == nil {
+		return "", ""
+	}
+	if len(effectiveTime.Value) > 0 {
+		start, _ := fhirDateTime(effectiveTime)
+		return start, ""
+	}
+	start, _ := fhirDateTime(effectiveTime.Low)
+	end, _ := fhirDateTime(effectiveTime.High)
+	return start, end
+}
+
+// setEffective sets a dateTime/Period choice element (eg. `effective[x]`) of the resource, returns false if the effective time is missing
+func setEffective(fhirResource resource, element string, effectiveTime *anyValue) bool {
+	start, end := effectivePeriod(effectiveTime)
+	if len(end) > 0 {
+		fhirResource[element+"Period"] = fhir401.Period{Start: optionalString(start), End: &end}
+	} else if len(start) > 0 {
+		fhirResource[element+"DateTime"] = start
+	} else {
+		return false
+	}
+	return true
+}
+
+// codedConcept returns a CodeableConcept with a single coding
+func codedConcept(system string, code string) fhir401.CodeableConcept {
+	return fhir401.CodeableConcept{Coding: []fhir401.Coding{{System: lo.ToPtr(system), Code: lo.ToPtr(code)}}}
+}
@@ -35,6 +35,26 @@ func (c *configuration) Init() error {
 	//c.SetDefault("database.encryption.key", "") //encryption key must be set by the user.
 	c.SetDefault("cache.location", "/opt/fasten/cache/")
 
+	//prior versions of resources are stored when a resource is updated (eg. during a sync). 0 means unlimited.
+	c.SetDefault("history.retention.max_versions", 0)
+	c.SetDefault("history.retention.days", 0)
+
+	//background jobs (eg. source syncs) are processed by a pool of workers. Jobs are started as soon as they're queued, and the
+	//background_jobs table is also polled for ready jobs (in seconds)
+	c.SetDefault("jobs.workers", 2)
+	c.SetDefault("jobs.poll_interval", 30)
+	//jobs interrupted by a restart are resumed after an exponential backoff (in seconds), up to the max number of attempts
+	c.SetDefault("jobs.max_attempts", 3)
+	c.SetDefault("jobs.retry_backoff", 60)
+	//log entries captured while a job is processed are stored with the job, only the most recent entries of each job are kept
+	//(0 disables log capture), and entries are removed after the retention period (0 keeps them forever)
+	c.SetDefault("jobs.logs.max_entries", 500)
+	c.SetDefault("jobs.logs.retention_days", 30)
+
+	//bulk data export files contain the user's entire record, they're removed after the retention period (0 keeps them until
+	//the export is deleted)
+	c.SetDefault("export.retention_hours", 24)
+
 	c.SetDefault("jwt.issuer.key", "thisismysupersecuressessionsecretlength")
 
 	c.SetDefault("log.level", "INFO")
@@ -4,6 +4,7 @@ type ResourceGraphType string
 type BackgroundJobStatus string
 type BackgroundJobType string
 type BackgroundJobSchedule string
+type ResourceSearchMode string
 
 type DatabaseRepositoryType string
 
@@ -14,6 +15,7 @@ const (
 	ContextKeyTypeDatabase       string = "REPOSITORY"
 	ContextKeyTypeLogger         string = "LOGGER"
 	ContextKeyTypeEventBusServer string = "EVENT_BUS_SERVER"
+	ContextKeyTypeJobRunner      string = "JOB_RUNNER"
 
 	ContextKeyTypeAuthUsername    string = "AUTH_USERNAME"
 	ContextKeyTypeAuthToken       string = "AUTH_TOKEN"
@@ -30,15 +32,21 @@ const (
 	BackgroundJobStatusLocked BackgroundJobStatus = "STATUS_LOCKED"
 	BackgroundJobStatusFailed BackgroundJobStatus = "STATUS_FAILED"
 	BackgroundJobStatusDone   BackgroundJobStatus = "STATUS_DONE"
+	//cancelled by the user, see handler.CancelBackgroundJob
+	BackgroundJobStatusCancelled BackgroundJobStatus = "STATUS_CANCELLED"
 
 	BackgroundJobTypeSync          BackgroundJobType = "SYNC"
 	BackgroundJobTypeScheduledSync BackgroundJobType = "SCHEDULED_SYNC"
+	BackgroundJobTypeExport        BackgroundJobType = "EXPORT"
 
 	BackgroundJobScheduleDaily    BackgroundJobSchedule = "DAILY"
 	BackgroundJobScheduleWeekly   BackgroundJobSchedule = "WEEKLY"
 	BackgroundJobScheduleBiWeekly BackgroundJobSchedule = "BIWEEKLY"
 	BackgroundJobScheduleMonthly  BackgroundJobSchedule = "MONTHLY"
 
+	ResourceSearchModeMatch   ResourceSearchMode = "match"
+	ResourceSearchModeInclude ResourceSearchMode = "include"
+
 	DatabaseRepositoryTypeSqlite   DatabaseRepositoryType = "sqlite"
 	DatabaseRepositoryTypePostgres DatabaseRepositoryType = "postgres"
 )
@@ -0,0 +1,257 @@
+package csvimport
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/google/uuid"
+)
+
+// Resource is an Observation converted from a CSV cell
+type Resource struct {
+	ResourceType string
+	ResourceId   string
+	SortTitle    *string
+	SortDate     *time.Time
+	ResourceRaw  json.RawMessage
+}
+
+// Warning describes a row (or a cell) which could not be converted, and was skipped. Rows are numbered from 1 (the header row).
+type Warning struct {
+	Row     int    `json:"row"`
+	Column  string `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+func (w Warning) String() string {
+	if len(w.Column) == 0 {
+		return fmt.Sprintf("row %d: %s", w.Row, w.Message)
+	}
+	return fmt.Sprintf("row %d, column %s: %s", w.Row, w.Column, w.Message)
+}
+
+// Summary describes the content of the CSV file, once it has been read
+type Summary struct {
+	RowCount         int       `json:"row_count"`
+	ObservationCount int       `json:"observation_count"`
+	Warnings         []Warning `json:"warnings"`
+}
+
+// dateFormatReplacer converts the date format tokens of a mapping into a Go time layout. Longer tokens must be listed first.
+var dateFormatReplacer = strings.NewReplacer(
+	"YYYY", "2006",
+	"YY", "06",
+	"MM", "01",
+	"M", "1",
+	"DD", "02",
+	"D", "2",
+	"HH", "15",
+	"mm", "04",
+	"ss", "05",
+)
+
+// Read reads the CSV file (the first row must contain the column headers), and calls the resourceFn for the Observation converted from
+// each mapped cell with a value. Reading stops if the resourceFn returns an error. Rows and cells which cannot be converted are
+// skipped, and returned as warnings.
+//
+// Observation ids are generated from the code, the column and the date of the Observation, so importing the same file again (or a
+// file containing the same readings) updates the existing resources instead of creating duplicates. Cells which would generate the
+// same id as a previous cell in the file (eg. multiple readings on the same day, with a date format without a time) are skipped.
+func Read(csvReader io.Reader, mapping models.CsvImportMapping, resourceFn func(resource Resource) error) (*Summary, error) {
+	if err := mapping.Validate(); err != nil {
+		return nil, err
+	}
+	location := time.UTC
+	if len(mapping.Timezone) > 0 {
+		location, _ = time.LoadLocation(mapping.Timezone)
+	}
+	dateLayout := dateFormatReplacer.Replace(mapping.DateFormat)
+	dateOnly := !strings.Contains(dateLayout, "15")
+
+	reader := csv.NewReader(csvReader)
+	reader.FieldsPerRecord = -1 //spreadsheet exports often omit trailing empty cells
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("csv file is empty")
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read csv header: %w", err)
+	}
+	columnNdx := map[string]int{}
+	for ndx, columnName := range header {
+		//spreadsheet applications may prefix the file with a byte order mark
+		columnNdx[strings.TrimSpace(strings.TrimPrefix(columnName, "\ufeff"))] = ndx
+	}
+	dateNdx, ok := columnNdx[mapping.DateColumn]
+	if !ok {
+		return nil, fmt.Errorf("csv file does not contain the date column: %s", mapping.DateColumn)
+	}
+	for _, column := range mapping.Columns {
+		if _, ok := columnNdx[column.Column]; !ok {
+			return nil, fmt.Errorf("csv file does not contain the column: %s", column.Column)
+		}
+	}
+
+	summary := &Summary{Warnings: []Warning{}}
+	//row number of the cell each Observation id was generated from
+	observationRows := map[string]int{}
+	rowNumber := 1
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		rowNumber++
+		if err != nil {
+			return summary, fmt.Errorf("could not read csv row %d: %w", rowNumber, err)
+		}
+		summary.RowCount++
+
+		dateValue := strings.TrimSpace(cell(row, dateNdx))
+		if len(dateValue) == 0 {
+			summary.Warnings = append(summary.Warnings, Warning{Row: rowNumber, Message: "date is empty, row skipped"})
+			continue
+		}
+		effectiveDate, err := time.ParseInLocation(dateLayout, dateValue, location)
+		if err != nil {
+			summary.Warnings = append(summary.Warnings, Warning{Row: rowNumber, Message: fmt.Sprintf("date (%s) does not match the date format (%s), row skipped", dateValue, mapping.DateFormat)})
+			continue
+		}
+
+		for _, column := range mapping.Columns {
+			value := strings.TrimSpace(cell(row, columnNdx[column.Column]))
+			if len(value) == 0 {
+				continue
+			}
+			observation, err := convertObservation(column, effectiveDate, dateOnly, value)
+			if err != nil {
+				summary.Warnings = append(summary.Warnings, Warning{Row: rowNumber, Column: column.Column, Message: err.Error()})
+				continue
+			}
+			if previousRowNumber, found := observationRows[observation.ResourceId]; found {
+				summary.Warnings = append(summary.Warnings, Warning{Row: rowNumber, Column: column.Column, Message: fmt.Sprintf("a reading for the same column and date was already imported from row %d, cell skipped", previousRowNumber)})
+				continue
+			}
+			observationRows[observation.ResourceId] = rowNumber
+			if err := resourceFn(*observation); err != nil {
+				return summary, err
+			}
+			summary.ObservationCount++
+		}
+	}
+	return summary, nil
+}
+
+// convertObservation converts the value of a cell into an Observation. Numeric values are stored as a valueQuantity (with an
+// interpretation, if the column has a reference range), other values are stored as a valueString.
+func convertObservation(column models.CsvImportColumnMapping, effectiveDate time.Time, dateOnly bool, value string) (*Resource, error) {
+	display := column.Display
+	if len(display) == 0 {
+		display = column.Column
+	}
+	effectiveDateTime := effectiveDate.Format(time.RFC3339)
+	if dateOnly {
+		effectiveDateTime = effectiveDate.Format("2006-01-02")
+	}
+	//multiple columns may be mapped to the same code, so the column is included in the id
+	observationId := uuid.NewSHA1(uuid.NameSpaceOID, []byte(strings.Join([]string{"http://loinc.org", column.Code, column.Column, effectiveDate.Format(time.RFC3339Nano)}, "|"))).String()
+
+	observation := map[string]interface{}{
+		"resourceType": "Observation",
+		"id":           observationId,
+		"status":       "final",
+		"code": map[string]interface{}{
+			"coding": []interface{}{map[string]interface{}{
+				"system":  "http://loinc.org",
+				"code":    column.Code,
+				"display": display,
+			}},
+			"text": display,
+		},
+		"effectiveDateTime": effectiveDateTime,
+	}
+
+	//values may include a thousands separator, eg. `1,024`
+	if numericValue, err := strconv.ParseFloat(strings.ReplaceAll(value, ",", ""), 64); err == nil {
+		observation["valueQuantity"] = quantity(numericValue, column.Unit)
+		if column.ReferenceRange != nil {
+			if interpretation := interpretationCode(numericValue, column.ReferenceRange); len(interpretation) > 0 {
+				observation["interpretation"] = []interface{}{map[string]interface{}{
+					"coding": []interface{}{map[string]interface{}{
+						"system": "http://terminology.hl7.org/CodeSystem/v3-ObservationInterpretation",
+						"code":   interpretation,
+					}},
+				}}
+			}
+		}
+	} else if len(column.Unit) > 0 {
+		return nil, fmt.Errorf("value (%s) is not numeric, cell skipped", value)
+	} else {
+		observation["valueString"] = value
+	}
+
+	if column.ReferenceRange != nil {
+		referenceRange := map[string]interface{}{}
+		if column.ReferenceRange.Low != nil {
+			referenceRange["low"] = quantity(*column.ReferenceRange.Low, column.Unit)
+		}
+		if column.ReferenceRange.High != nil {
+			referenceRange["high"] = quantity(*column.ReferenceRange.High, column.Unit)
+		}
+		if len(column.ReferenceRange.Text) > 0 {
+			referenceRange["text"] = column.ReferenceRange.Text
+		}
+		if len(referenceRange) > 0 {
+			observation["referenceRange"] = []interface{}{referenceRange}
+		}
+	}
+
+	observationRaw, err := json.Marshal(observation)
+	if err != nil {
+		return nil, err
+	}
+	return &Resource{
+		ResourceType: "Observation",
+		ResourceId:   observationId,
+		SortTitle:    &display,
+		SortDate:     &effectiveDate,
+		ResourceRaw:  observationRaw,
+	}, nil
+}
+
+func quantity(value float64, unit string) map[string]interface{} {
+	quantity := map[string]interface{}{"value": value}
+	if len(unit) > 0 {
+		quantity["unit"] = unit
+		quantity["system"] = "http://unitsofmeasure.org"
+		quantity["code"] = unit
+	}
+	return quantity
+}
+
+// interpretationCode returns L (low), H (high) or N (normal) depending on the reference range
+func interpretationCode(value float64, referenceRange *models.CsvImportReferenceRange) string {
+	if referenceRange.Low == nil && referenceRange.High == nil {
+		return ""
+	} else if referenceRange.Low != nil && value < *referenceRange.Low {
+		return "L"
+	} else if referenceRange.High != nil && value > *referenceRange.High {
+		return "H"
+	}
+	return "N"
+}
+
+func cell(row []string, ndx int) string {
+	if ndx >= len(row) {
+		return ""
+	}
+	return row[ndx]
+}
@@ -0,0 +1,150 @@
+package csvimport
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/validation"
+	"github.com/stretchr/testify/require"
+)
+
+func readingsMapping() models.CsvImportMapping {
+	low, high := 70.0, 99.0
+	return models.CsvImportMapping{
+		Name:       "Daily readings",
+		DateColumn: "Date",
+		DateFormat: "MM/DD/YYYY HH:mm",
+		Timezone:   "America/New_York",
+		Columns: []models.CsvImportColumnMapping{
+			{Column: "Glucose (mg/dL)", Code: "2339-0", Display: "Glucose [Mass/volume] in Blood", Unit: "mg/dL", ReferenceRange: &models.CsvImportReferenceRange{Low: &low, High: &high}},
+			{Column: "Systolic", Code: "8480-6", Display: "Systolic blood pressure", Unit: "mm[Hg]"},
+			{Column: "Diastolic", Code: "8462-4", Display: "Diastolic blood pressure", Unit: "mm[Hg]"},
+		},
+	}
+}
+
+func TestRead(t *testing.T) {
+	csvFile, err := os.Open("testdata/readings.csv")
+	require.NoError(t, err)
+	defer csvFile.Close()
+
+	resources := []Resource{}
+	summary, err := Read(csvFile, readingsMapping(), func(resource Resource) error {
+		resources = append(resources, resource)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 6, summary.RowCount)
+	require.Equal(t, 9, summary.ObservationCount)
+	warnings := []string{}
+	for _, warning := range summary.Warnings {
+		warnings = append(warnings, warning.String())
+	}
+	require.Equal(t, []string{
+		"row 4, column Glucose (mg/dL): value (high) is not numeric, cell skipped",
+		"row 5: date is empty, row skipped",
+		"row 6: date (2023-03-18) does not match the date format (MM/DD/YYYY HH:mm), row skipped",
+	}, warnings)
+
+	require.Len(t, resources, 9)
+	for _, resource := range resources {
+		operationOutcome := validation.ValidateResource(resource.ResourceRaw, validation.Options{})
+		require.False(t, validation.HasErrors(operationOutcome), "Expected %s/%s to be valid: %v", resource.ResourceType, resource.ResourceId, operationOutcome)
+	}
+
+	var glucose map[string]interface{}
+	require.NoError(t, json.Unmarshal(resources[0].ResourceRaw, &glucose))
+	require.Equal(t, "2023-03-15T07:30:00-04:00", glucose["effectiveDateTime"])
+	require.Equal(t, map[string]interface{}{"value": float64(95), "unit": "mg/dL", "system": "http://unitsofmeasure.org", "code": "mg/dL"}, glucose["valueQuantity"])
+	require.Equal(t, "N", glucose["interpretation"].([]interface{})[0].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{})["code"])
+	require.Equal(t, []interface{}{map[string]interface{}{
+		"low":  map[string]interface{}{"value": float64(70), "unit": "mg/dL", "system": "http://unitsofmeasure.org", "code": "mg/dL"},
+		"high": map[string]interface{}{"value": float64(99), "unit": "mg/dL", "system": "http://unitsofmeasure.org", "code": "mg/dL"},
+	}}, glucose["referenceRange"])
+	require.Equal(t, "Glucose [Mass/volume] in Blood", *resources[0].SortTitle)
+
+	var highGlucose map[string]interface{}
+	require.NoError(t, json.Unmarshal(resources[3].ResourceRaw, &highGlucose))
+	require.Equal(t, "H", highGlucose["interpretation"].([]interface{})[0].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{})["code"])
+
+	var systolic map[string]interface{}
+	require.NoError(t, json.Unmarshal(resources[1].ResourceRaw, &systolic))
+	require.Equal(t, "8480-6", systolic["code"].(map[string]interface{})["coding"].([]interface{})[0].(map[string]interface{})["code"])
+	require.Nil(t, systolic["interpretation"])
+}
+
+func TestRead_GeneratesStableIds(t *testing.T) {
+	mapping := models.CsvImportMapping{
+		DateColumn: "date",
+		DateFormat: "YYYY-MM-DD",
+		Columns:    []models.CsvImportColumnMapping{{Column: "weight", Code: "29463-7", Unit: "kg"}},
+	}
+	readIds := func(csvContent string) []string {
+		ids := []string{}
+		_, err := Read(strings.NewReader(csvContent), mapping, func(resource Resource) error {
+			ids = append(ids, resource.ResourceId)
+			return nil
+		})
+		require.NoError(t, err)
+		return ids
+	}
+
+	//the same reading generates the same id, even if the value (or the other columns) changed
+	firstIds := readIds("date,weight\n2023-03-15,70.5\n2023-03-16,70.1\n")
+	secondIds := readIds("date,weight,notes\n2023-03-16,70.2,corrected\n2023-03-17,69.9,\n")
+	require.Len(t, firstIds, 2)
+	require.Equal(t, firstIds[1], secondIds[0])
+	require.NotEqual(t, firstIds[0], secondIds[1])
+}
+
+func TestRead_WithSharedCode(t *testing.T) {
+	mapping := models.CsvImportMapping{
+		DateColumn: "date",
+		DateFormat: "YYYY-MM-DD",
+		Columns: []models.CsvImportColumnMapping{
+			{Column: "Glucose fasting", Code: "2339-0", Unit: "mg/dL"},
+			{Column: "Glucose post-meal", Code: "2339-0", Unit: "mg/dL"},
+		},
+	}
+
+	resources := []Resource{}
+	summary, err := Read(strings.NewReader("date,Glucose fasting,Glucose post-meal\n2023-03-15,92,131\n2023-03-15,95,\n2023-03-16,90,128\n"), mapping, func(resource Resource) error {
+		resources = append(resources, resource)
+		return nil
+	})
+	require.NoError(t, err)
+
+	//columns which share a code generate different ids
+	require.Equal(t, 4, summary.ObservationCount)
+	ids := map[string]bool{}
+	for _, resource := range resources {
+		ids[resource.ResourceId] = true
+	}
+	require.Len(t, ids, 4)
+
+	//a second reading on the same day (without a time) is reported, rather than replacing the first
+	require.Equal(t, []Warning{{Row: 3, Column: "Glucose fasting", Message: "a reading for the same column and date was already imported from row 2, cell skipped"}}, summary.Warnings)
+}
+
+func TestRead_WithInvalidMapping(t *testing.T) {
+	var invalidMappingTests = []struct {
+		mapping models.CsvImportMapping
+		csv     string
+		err     string
+	}{
+		{models.CsvImportMapping{DateFormat: "YYYY", Columns: []models.CsvImportColumnMapping{{Column: "a", Code: "1"}}}, "date,a\n", "mapping must include a date_column"},
+		{models.CsvImportMapping{DateColumn: "date", DateFormat: "YYYY"}, "date,a\n", "mapping must include at least one column"},
+		{models.CsvImportMapping{DateColumn: "date", DateFormat: "YYYY", Timezone: "Mars/Olympus", Columns: []models.CsvImportColumnMapping{{Column: "a", Code: "1"}}}, "date,a\n", "mapping timezone is invalid: unknown time zone Mars/Olympus"},
+		{models.CsvImportMapping{DateColumn: "date", DateFormat: "YYYY", Columns: []models.CsvImportColumnMapping{{Column: "b", Code: "1"}}}, "date,a\n", "csv file does not contain the column: b"},
+		{models.CsvImportMapping{DateColumn: "day", DateFormat: "YYYY", Columns: []models.CsvImportColumnMapping{{Column: "a", Code: "1"}}}, "date,a\n", "csv file does not contain the date column: day"},
+		{models.CsvImportMapping{DateColumn: "date", DateFormat: "YYYY", Columns: []models.CsvImportColumnMapping{{Column: "a", Code: "1"}}}, "", "csv file is empty"},
+	}
+	for ndx, tt := range invalidMappingTests {
+		_, err := Read(strings.NewReader(tt.csv), tt.mapping, func(resource Resource) error { return nil })
+		require.EqualError(t, err, tt.err, "Expected error to match for invalidMappingTests[%d]", ndx)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	sourceModel "github.com/fastenhealth/fasten-sources/clients/models"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
@@ -360,6 +361,12 @@ func (gr *GormRepository) UpsertResource(ctx context.Context, wrappedResourceMod
 		//wrappedFhirResourceModel.SetResourceRaw(wrappedResourceModel.ResourceRaw)
 	}
 
+	//the search index document must be generated before FirstOrCreate, which replaces the model with the stored data (if found)
+	searchDocument, searchDocumentErr := newResourceSearchDocument(currentUser.ID, wrappedFhirResourceModel, wrappedResourceModel.SortDate, wrappedResourceModel.SortTitle, cachedResourceRaw)
+	if searchDocumentErr != nil {
+		gr.Logger.Warnf("ignoring: an error occurred while generating search index document (%s/%s): %v", wrappedResourceModel.SourceResourceType, wrappedResourceModel.SourceResourceID, searchDocumentErr)
+	}
+
 	eventSourceSync := models.NewEventSourceSync(
 		currentUser.ID.String(),
 		wrappedFhirResourceModel.GetSourceID().String(),
@@ -381,72 +388,113 @@ func (gr *GormRepository) UpsertResource(ctx context.Context, wrappedResourceMod
 	if createResult.Error != nil {
 		return false, createResult.Error
 	} else if createResult.RowsAffected == 0 {
-		//at this point, wrappedResourceModel contains the data found in the database.
+		//at this point, wrappedFhirResourceModel contains the data found in the database.
 		// check if the database resource matches the new resource.
-		if wrappedResourceModel.ResourceRaw.String() != string(cachedResourceRaw) {
-			updateResult := createResult.Omit("RelatedResource.*").Updates(wrappedResourceModel)
-			return updateResult.RowsAffected > 0, updateResult.Error
+		if !resourceRawEqual(wrappedFhirResourceModel.GetResourceRaw(), cachedResourceRaw) {
+			//the stored version is moved to the resource history before it's replaced
+			wasUpdated, err := gr.updateResourceVersion(ctx, wrappedFhirResourceModel, wrappedResourceModel)
+			if err == nil && searchDocumentErr == nil {
+				gr.updateResourceSearchIndex(ctx, searchDocument)
+			}
+			return wasUpdated, err
 		} else {
 			return false, nil
 		}
 
 	} else {
 		//resource was created
+		if searchDocumentErr == nil {
+			gr.updateResourceSearchIndex(ctx, searchDocument)
+		}
 		return createResult.RowsAffected > 0, createResult.Error
 	}
 }
 
-func (gr *GormRepository) ListResources(ctx context.Context, queryOptions models.ListResourceQueryOptions) ([]models.ResourceBase, error) {
-	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
-	if currentUserErr != nil {
-		return nil, currentUserErr
+// updateResourceSearchIndex updates the full-text search index for a resource. Errors are logged, since the resource has already been stored
+func (gr *GormRepository) updateResourceSearchIndex(ctx context.Context, searchDocument resourceSearchDocument) {
+	if err := upsertResourceSearchIndex(gr.GormClient.WithContext(ctx), searchDocument); err != nil {
+		gr.Logger.Warnf("ignoring: an error occurred while updating search index (%s/%s): %v", searchDocument.SourceResourceType, searchDocument.SourceResourceID, err)
 	}
+}
 
-	queryParam := models.OriginBase{
-		UserID: currentUser.ID,
+func (gr *GormRepository) ListResources(ctx context.Context, queryOptions models.ListResourceQueryOptions) ([]models.ResourceBase, models.Pagination, error) {
+	pagination := models.Pagination{}
+	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
+	if currentUserErr != nil {
+		return nil, pagination, currentUserErr
 	}
 
-	if len(queryOptions.SourceResourceType) > 0 {
-		queryParam.SourceResourceType = queryOptions.SourceResourceType
+	whereClauses := []string{"user_id = @user_id"}
+	whereNamedParameters := map[string]interface{}{
+		"user_id": currentUser.ID.String(),
 	}
-
 	if len(queryOptions.SourceID) > 0 {
 		sourceUUID, err := uuid.Parse(queryOptions.SourceID)
 		if err != nil {
-			return nil, err
+			return nil, pagination, err
 		}
-
-		queryParam.SourceID = sourceUUID
+		whereClauses = append(whereClauses, "source_id = @source_id")
+		whereNamedParameters["source_id"] = sourceUUID.String()
 	}
 	if len(queryOptions.SourceResourceID) > 0 {
-		queryParam.SourceResourceID = queryOptions.SourceResourceID
+		whereClauses = append(whereClauses, "source_resource_id = @source_resource_id")
+		whereNamedParameters["source_resource_id"] = queryOptions.SourceResourceID
 	}
 
-	manifestJson, _ := json.MarshalIndent(queryParam, "", "  ")
-	gr.Logger.Debugf("THE QUERY OBJECT===========> %v", string(manifestJson))
-
-	var wrappedResourceModels []models.ResourceBase
-	queryBuilder := gr.GormClient.WithContext(ctx)
+	//there is no FHIR Resource name specified, so we're querying across all FHIR resources
+	resourceTypes := databaseModel.GetAllowedResourceTypes()
 	if len(queryOptions.SourceResourceType) > 0 {
-		tableName, err := databaseModel.GetTableNameByResourceType(queryOptions.SourceResourceType)
+		resourceTypes = []string{queryOptions.SourceResourceType}
+	}
+	resourcesQuery, err := gr.resourcesFromTablesQuery(ctx, resourceTypes, whereClauses, whereNamedParameters)
+	if err != nil {
+		return nil, pagination, err
+	}
+
+	//resources are sorted by date (newest first) unless otherwise specified
+	sortColumn, sortDescending := "sort_date", true
+	if queryOptions.SortBy == "title" {
+		sortColumn, sortDescending = "sort_title", false
+	}
+
+	queryBuilder := resourcesQuery.Order(paginationOrderClause(sortColumn, "id", sortDescending))
+	if len(queryOptions.Cursor) > 0 {
+		cursor, err := decodePaginationCursor(queryOptions.Cursor)
 		if err != nil {
-			return nil, err
+			return nil, pagination, err
 		}
-		queryBuilder = queryBuilder.
-			Where(queryParam).
-			Table(tableName)
+		cursorClause, cursorParameters := paginationCursorClause(sortColumn, "id", sortDescending, cursor)
+		queryBuilder = queryBuilder.Where(cursorClause, cursorParameters...)
+	}
+	if queryOptions.Limit > 0 {
+		//an additional resource is requested to determine if there is a next page
+		queryBuilder = queryBuilder.Limit(queryOptions.Limit + 1).Offset(queryOptions.Offset)
+	}
 
-		if queryOptions.Limit > 0 {
-			queryBuilder = queryBuilder.Limit(queryOptions.Limit).Offset(queryOptions.Offset)
-		}
-		return wrappedResourceModels, queryBuilder.Find(&wrappedResourceModels).Error
-	} else {
-		if queryOptions.Limit > 0 {
-			queryBuilder = queryBuilder.Limit(queryOptions.Limit).Offset(queryOptions.Offset)
+	wrappedResourceModels := []models.ResourceBase{}
+	if err := queryBuilder.Find(&wrappedResourceModels).Error; err != nil {
+		return nil, pagination, err
+	}
+	if queryOptions.Limit == 0 {
+		pagination.Total = int64(len(wrappedResourceModels))
+		return wrappedResourceModels, pagination, nil
+	}
+
+	if err := resourcesQuery.Count(&pagination.Total).Error; err != nil {
+		return nil, pagination, err
+	}
+	if len(wrappedResourceModels) > queryOptions.Limit {
+		wrappedResourceModels = wrappedResourceModels[:queryOptions.Limit]
+		lastResource := wrappedResourceModels[len(wrappedResourceModels)-1]
+		cursor := paginationCursor{ID: lastResource.ID}
+		if sortColumn == "sort_title" {
+			cursor.SortTitle = lastResource.SortTitle
+		} else {
+			cursor.SortDate = lastResource.SortDate
 		}
-		//there is no FHIR Resource name specified, so we're querying across all FHIR resources
-		return gr.getResourcesFromAllTables(queryBuilder, queryParam)
+		pagination.Next = encodePaginationCursor(cursor)
 	}
+	return wrappedResourceModels, pagination, nil
 }
 
 // TODO: should this be deprecated? (replaced by ListResources)
@@ -488,21 +536,124 @@ func (gr *GormRepository) GetResourceBySourceId(ctx context.Context, sourceId st
 		return nil, err
 	}
 
-	queryParam := models.OriginBase{
-		UserID:           currentUser.ID,
-		SourceID:         sourceIdUUID,
-		SourceResourceID: sourceResourceId,
+	whereClauses := []string{"user_id = @user_id", "source_id = @source_id", "source_resource_id = @source_resource_id"}
+	whereNamedParameters := map[string]interface{}{
+		"user_id":            currentUser.ID.String(),
+		"source_id":          sourceIdUUID.String(),
+		"source_resource_id": sourceResourceId,
 	}
 
 	//there is no FHIR Resource name specified, so we're querying across all FHIR resources
-	wrappedResourceModels, err := gr.getResourcesFromAllTables(gr.GormClient.WithContext(ctx), queryParam)
+	resourcesQuery, err := gr.resourcesFromTablesQuery(ctx, databaseModel.GetAllowedResourceTypes(), whereClauses, whereNamedParameters)
+	if err != nil {
+		return nil, err
+	}
+	wrappedResourceModels := []models.ResourceBase{}
+	if err := resourcesQuery.Limit(1).Find(&wrappedResourceModels).Error; err != nil {
+		return nil, err
+	}
 	if len(wrappedResourceModels) > 0 {
-		return &wrappedResourceModels[0], err
+		return &wrappedResourceModels[0], nil
 	} else {
-		return nil, fmt.Errorf("no resource found with source id %s and source resource id %s", sourceId, sourceResourceId)
+		return nil, fmt.Errorf("no resource found with source id %s and source resource id %s: %w", sourceId, sourceResourceId, gorm.ErrRecordNotFound)
 	}
 }
 
+// RunInTransaction calls the transaction function with a copy of the repository which uses a single database transaction, so
+// that multiple changes (eg. storing a resource with the Fasten source client) are applied atomically. The transaction is
+// rolled back if the transaction function returns an error.
+// NOTE: the transaction repository must be used for every query within the function, the database may be locked until the
+// transaction is complete (SQLite)
+func (gr *GormRepository) RunInTransaction(ctx context.Context, transactionFn func(txRepo DatabaseRepository) error) error {
+	return gr.GormClient.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		txRepo := *gr
+		txRepo.GormClient = tx
+		return transactionFn(&txRepo)
+	})
+}
+
+// DeleteResource removes a single resource, along with its search index entry, its prior versions and every association
+// to or from the resource. Returns the number of resources deleted (0 if the resource does not exist)
+func (gr *GormRepository) DeleteResource(ctx context.Context, sourceId string, sourceResourceType string, sourceResourceId string) (int64, error) {
+	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
+	if currentUserErr != nil {
+		return 0, currentUserErr
+	}
+
+	sourceUUID, err := uuid.Parse(sourceId)
+	if err != nil {
+		return 0, err
+	}
+	tableName, err := databaseModel.GetTableNameByResourceType(sourceResourceType)
+	if err != nil {
+		return 0, err
+	}
+
+	rowsEffected := int64(0)
+	err = gr.GormClient.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		results := tx.
+			Where(models.OriginBase{
+				UserID:             currentUser.ID,
+				SourceID:           sourceUUID,
+				SourceResourceType: sourceResourceType,
+				SourceResourceID:   sourceResourceId,
+			}).
+			Table(tableName).
+			Delete(&models.ResourceBase{})
+		rowsEffected = results.RowsAffected
+		if results.Error != nil {
+			return results.Error
+		}
+
+		//delete search index entry
+		results = tx.Exec(
+			fmt.Sprintf("DELETE FROM %s WHERE user_id = ? AND source_id = ? AND source_resource_type = ? AND source_resource_id = ?", resourceSearchIndexTable),
+			currentUser.ID.String(), sourceUUID.String(), sourceResourceType, sourceResourceId,
+		)
+		if results.Error != nil {
+			return results.Error
+		}
+
+		//delete resource history entries
+		results = tx.
+			Where(models.ResourceHistory{
+				UserID:             currentUser.ID,
+				SourceID:           sourceUUID,
+				SourceResourceType: sourceResourceType,
+				SourceResourceID:   sourceResourceId,
+			}).
+			Delete(&models.ResourceHistory{})
+		if results.Error != nil {
+			return results.Error
+		}
+
+		//delete relatedResources entries (in both directions)
+		results = tx.
+			Where(models.RelatedResource{
+				ResourceBaseUserID:             currentUser.ID,
+				ResourceBaseSourceID:           sourceUUID,
+				ResourceBaseSourceResourceType: sourceResourceType,
+				ResourceBaseSourceResourceID:   sourceResourceId,
+			}).
+			Delete(&models.RelatedResource{})
+		if results.Error != nil {
+			return results.Error
+		}
+		return tx.
+			Where(models.RelatedResource{
+				RelatedResourceUserID:             currentUser.ID,
+				RelatedResourceSourceID:           sourceUUID,
+				RelatedResourceSourceResourceType: sourceResourceType,
+				RelatedResourceSourceResourceID:   sourceResourceId,
+			}).
+			Delete(&models.RelatedResource{}).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rowsEffected, nil
+}
+
 // Get the patient for each source (for the current user)
 func (gr *GormRepository) GetPatientForSources(ctx context.Context) ([]models.ResourceBase, error) {
 	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
@@ -610,6 +761,28 @@ func (gr *GormRepository) RemoveResourceAssociation(ctx context.Context, source
 	return nil
 }
 
+// RemoveResourceAssociations removes every association from the resource to other resources, associations from other resources
+// to the resource are kept. Used when the references of a resource are replaced (eg. when a user-authored resource is updated)
+func (gr *GormRepository) RemoveResourceAssociations(ctx context.Context, source *models.SourceCredential, resourceType string, resourceId string) error {
+	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
+	if currentUserErr != nil {
+		return currentUserErr
+	}
+
+	if source.UserID != currentUser.ID {
+		return fmt.Errorf("source credential must match the current user id")
+	}
+
+	return gr.GormClient.WithContext(ctx).
+		Where(models.RelatedResource{
+			ResourceBaseUserID:             currentUser.ID,
+			ResourceBaseSourceID:           source.ID,
+			ResourceBaseSourceResourceType: resourceType,
+			ResourceBaseSourceResourceID:   resourceId,
+		}).
+		Delete(&models.RelatedResource{}).Error
+}
+
 func (gr *GormRepository) FindResourceAssociationsByTypeAndId(ctx context.Context, source *models.SourceCredential, resourceType string, resourceId string) ([]models.RelatedResource, error) {
 	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
 	if currentUserErr != nil {
@@ -851,6 +1024,28 @@ func (gr *GormRepository) UpdateSource(ctx context.Context, sourceCreds *models.
 	}).Error
 }
 
+// ClearSourceLatestBackgroundJob removes the latest (in-progress) background job from a source, once the job is complete
+// (or cancelled), so that the source can be synced again
+func (gr *GormRepository) ClearSourceLatestBackgroundJob(ctx context.Context, sourceId string) error {
+	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
+	if currentUserErr != nil {
+		return currentUserErr
+	}
+
+	sourceUUID, err := uuid.Parse(sourceId)
+	if err != nil {
+		return err
+	}
+
+	return gr.GormClient.WithContext(ctx).
+		Model(&models.SourceCredential{}).
+		Where(models.SourceCredential{
+			ModelBase: models.ModelBase{ID: sourceUUID},
+			UserID:    currentUser.ID,
+		}).
+		Update("latest_background_job_id", nil).Error
+}
+
 func (gr *GormRepository) GetSource(ctx context.Context, sourceId string) (*models.SourceCredential, error) {
 	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
 	if currentUserErr != nil {
@@ -997,8 +1192,23 @@ func (gr *GormRepository) DeleteSource(ctx context.Context, sourceId string) (in
 		}
 	}
 
-	//delete relatedResources entries
+	//delete search index entries
 	results := gr.GormClient.WithContext(ctx).
+		Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id = ? AND source_id = ?", resourceSearchIndexTable), currentUser.ID.String(), sourceUUID.String())
+	if results.Error != nil {
+		return rowsEffected, results.Error
+	}
+
+	//delete resource history entries
+	results = gr.GormClient.WithContext(ctx).
+		Where(models.ResourceHistory{UserID: currentUser.ID, SourceID: sourceUUID}).
+		Delete(&models.ResourceHistory{})
+	if results.Error != nil {
+		return rowsEffected, results.Error
+	}
+
+	//delete relatedResources entries
+	results = gr.GormClient.WithContext(ctx).
 		Where(models.RelatedResource{ResourceBaseUserID: currentUser.ID, ResourceBaseSourceID: sourceUUID}).
 		Delete(&models.RelatedResource{})
 	if results.Error != nil {
@@ -1068,19 +1278,21 @@ func (gr *GormRepository) UpdateBackgroundJob(ctx context.Context, backgroundJob
 			ModelBase: models.ModelBase{ID: backgroundJob.ID},
 			UserID:    backgroundJob.UserID,
 		}).Updates(models.BackgroundJob{
-		JobStatus:  backgroundJob.JobStatus,
-		Data:       backgroundJob.Data,
-		LockedTime: backgroundJob.LockedTime,
-		DoneTime:   backgroundJob.DoneTime,
-		Retries:    backgroundJob.Retries,
-		Schedule:   backgroundJob.Schedule,
+		JobStatus:   backgroundJob.JobStatus,
+		Data:        backgroundJob.Data,
+		LockedTime:  backgroundJob.LockedTime,
+		DoneTime:    backgroundJob.DoneTime,
+		Retries:     backgroundJob.Retries,
+		Schedule:    backgroundJob.Schedule,
+		NextRunTime: backgroundJob.NextRunTime,
 	}).Error
 }
 
-func (gr *GormRepository) ListBackgroundJobs(ctx context.Context, queryOptions models.BackgroundJobQueryOptions) ([]models.BackgroundJob, error) {
+func (gr *GormRepository) ListBackgroundJobs(ctx context.Context, queryOptions models.BackgroundJobQueryOptions) ([]models.BackgroundJob, models.Pagination, error) {
+	pagination := models.Pagination{}
 	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
 	if currentUserErr != nil {
-		return nil, currentUserErr
+		return nil, pagination, currentUserErr
 	}
 
 	queryParam := models.BackgroundJob{
@@ -1094,19 +1306,47 @@ func (gr *GormRepository) ListBackgroundJobs(ctx context.Context, queryOptions m
 		queryParam.JobStatus = *queryOptions.Status
 	}
 
-	var backgroundJobs []models.BackgroundJob
-	query := gr.GormClient.WithContext(ctx).
+	backgroundJobsQuery := gr.GormClient.WithContext(ctx).
+		Model(&models.BackgroundJob{}).
 		//Group("source_id"). //broken in Postgres.
-		Where(queryParam).Order("locked_time DESC")
+		Where(queryParam).
+		Session(&gorm.Session{})
 
+	query := backgroundJobsQuery.Order(paginationOrderClause("locked_time", "id", true))
+	if len(queryOptions.Cursor) > 0 {
+		cursor, err := decodePaginationCursor(queryOptions.Cursor)
+		if err != nil {
+			return nil, pagination, err
+		}
+		cursorClause, cursorParameters := paginationCursorClause("locked_time", "id", true, cursor)
+		query = query.Where(cursorClause, cursorParameters...)
+	}
 	if queryOptions.Limit > 0 {
-		query = query.Limit(queryOptions.Limit)
+		//an additional job is requested to determine if there is a next page
+		query = query.Limit(queryOptions.Limit + 1)
 	}
 	if queryOptions.Offset > 0 {
 		query = query.Offset(queryOptions.Offset)
 	}
 
-	return backgroundJobs, query.Find(&backgroundJobs).Error
+	backgroundJobs := []models.BackgroundJob{}
+	if err := query.Find(&backgroundJobs).Error; err != nil {
+		return nil, pagination, err
+	}
+	if queryOptions.Limit == 0 {
+		pagination.Total = int64(len(backgroundJobs))
+		return backgroundJobs, pagination, nil
+	}
+
+	if err := backgroundJobsQuery.Count(&pagination.Total).Error; err != nil {
+		return nil, pagination, err
+	}
+	if len(backgroundJobs) > queryOptions.Limit {
+		backgroundJobs = backgroundJobs[:queryOptions.Limit]
+		lastBackgroundJob := backgroundJobs[len(backgroundJobs)-1]
+		pagination.Next = encodePaginationCursor(paginationCursor{SortDate: lastBackgroundJob.LockedTime, ID: lastBackgroundJob.ID})
+	}
+	return backgroundJobs, pagination, nil
 }
 
 func (gr *GormRepository) BackgroundJobCheckpoint(ctx context.Context, checkpointData map[string]interface{}, errorData map[string]interface{}) {
@@ -1140,6 +1380,7 @@ func (gr *GormRepository) BackgroundJobCheckpoint(ctx context.Context, checkpoin
 	//var backgroundJob models.BackgroundJob
 	//gr.GormClient.Clauses(clause.Locking{Strength: "UPDATE"}).Find(&backgroundJob)
 
+	var jobType pkg.BackgroundJobType
 	txErr := gr.GormClient.Transaction(func(tx *gorm.DB) error {
 		//retrieve the background job by id
 		var backgroundJob models.BackgroundJob
@@ -1152,11 +1393,13 @@ func (gr *GormRepository) BackgroundJobCheckpoint(ctx context.Context, checkpoin
 		if backgroundJobFindResults.Error != nil {
 			return backgroundJobFindResults.Error
 		}
+		jobType = backgroundJob.JobType
 
 		//deserialize the job data
-		var backgroundJobSyncData models.BackgroundJobSyncData
+		//the job data is deserialized generically, so that the job type specific fields (eg. BackgroundJobSyncData, BackgroundJobExportData) are preserved
+		backgroundJobData := map[string]interface{}{}
 		if backgroundJob.Data != nil {
-			err := json.Unmarshal(backgroundJob.Data, &backgroundJobSyncData)
+			err := json.Unmarshal(backgroundJob.Data, &backgroundJobData)
 			if err != nil {
 				return err
 			}
@@ -1165,11 +1408,11 @@ func (gr *GormRepository) BackgroundJobCheckpoint(ctx context.Context, checkpoin
 		//update the job data with new data provided by the calling functiion
 		changed := false
 		if len(checkpointData) > 0 {
-			backgroundJobSyncData.CheckpointData = checkpointData
+			backgroundJobData["checkpoint_data"] = checkpointData
 			changed = true
 		}
 		if len(errorData) > 0 {
-			backgroundJobSyncData.ErrorData = errorData
+			backgroundJobData["error_data"] = errorData
 			changed = true
 		}
 
@@ -1179,7 +1422,7 @@ func (gr *GormRepository) BackgroundJobCheckpoint(ctx context.Context, checkpoin
 			LockedTime: &now,
 		}
 		if changed {
-			serializedData, err := json.Marshal(backgroundJobSyncData)
+			serializedData, err := json.Marshal(backgroundJobData)
 			if err != nil {
 				return err
 			}
@@ -1196,21 +1439,177 @@ func (gr *GormRepository) BackgroundJobCheckpoint(ctx context.Context, checkpoin
 
 	if txErr != nil {
 		gr.Logger.Warning("could not find or update background job. Ignoring checkpoint", txErr)
+		return
+	}
+
+	if len(checkpointData) > 0 {
+		eventBackgroundJob := models.NewEventBackgroundJob(currentUser.ID.String(), backgroundJobId, jobType, pkg.BackgroundJobStatusLocked, checkpointData)
+		if err := gr.EventBus.PublishMessage(eventBackgroundJob); err != nil {
+			gr.Logger.Warnf("ignoring: an error occurred while publishing background job checkpoint event: %v", err)
+		}
+	}
+}
+
+// CancelBackgroundJob cancels a ready (queued) job, it returns false if the job is not ready (eg. it has been claimed by the job
+// runner, in which case the job must be cancelled using the job runner)
+func (gr *GormRepository) CancelBackgroundJob(ctx context.Context, backgroundJobId string) (bool, error) {
+	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
+	if currentUserErr != nil {
+		return false, currentUserErr
+	}
+	backgroundJobUUID, err := uuid.Parse(backgroundJobId)
+	if err != nil {
+		return false, err
 	}
 
+	cancelResult := gr.GormClient.WithContext(ctx).
+		Model(&models.BackgroundJob{}).
+		Where("id = ? AND user_id = ? AND job_status = ?", backgroundJobUUID, currentUser.ID, pkg.BackgroundJobStatusReady).
+		Updates(map[string]interface{}{
+			"job_status": pkg.BackgroundJobStatusCancelled,
+			"done_time":  time.Now(),
+		})
+	return cancelResult.RowsAffected == 1, cancelResult.Error
 }
 
-// when server restarts, we should unlock all locked jobs, and set their status to failed
+// ClaimBackgroundJob locks the oldest ready job (of the specified types), so that it can be processed by the job runner.
+// Scheduled jobs are only claimed once their next run time has passed.
+// The job is locked using a conditional update, which only succeeds if the job is still ready, so that a job is never
+// claimed by multiple workers (this works the same way in SQLite & Postgres, without requiring row level locks).
+// The job user is preloaded, nil is returned if there are no ready jobs.
 // SECURITY: this is global, and effects all users.
-func (gr *GormRepository) CancelAllLockedBackgroundJobsAndFail() error {
-	now := time.Now()
-	return gr.GormClient.
+func (gr *GormRepository) ClaimBackgroundJob(ctx context.Context, jobTypes []pkg.BackgroundJobType) (*models.BackgroundJob, error) {
+	for {
+		var backgroundJob models.BackgroundJob
+		findResult := gr.GormClient.WithContext(ctx).
+			Preload("User").
+			Where("job_status = ? AND job_type IN ?", pkg.BackgroundJobStatusReady, jobTypes).
+			Where("(next_run_time IS NULL OR next_run_time <= ?)", time.Now()).
+			Order("created_at ASC").
+			Order("id ASC").
+			Limit(1).
+			Find(&backgroundJob)
+		if findResult.Error != nil {
+			return nil, findResult.Error
+		} else if findResult.RowsAffected == 0 {
+			return nil, nil
+		}
+
+		now := time.Now()
+		claimResult := gr.GormClient.WithContext(ctx).
+			Model(&models.BackgroundJob{}).
+			Where("id = ? AND job_status = ?", backgroundJob.ID, pkg.BackgroundJobStatusReady).
+			Updates(map[string]interface{}{
+				"job_status":  pkg.BackgroundJobStatusLocked,
+				"locked_time": now,
+			})
+		if claimResult.Error != nil {
+			return nil, claimResult.Error
+		} else if claimResult.RowsAffected == 1 {
+			backgroundJob.JobStatus = pkg.BackgroundJobStatusLocked
+			backgroundJob.LockedTime = &now
+			return &backgroundJob, nil
+		}
+		//the job was claimed by another worker, try the next one
+	}
+}
+
+// ListDoneBackgroundJobs returns the jobs of a type which were completed successfully before the given time, oldest first. The
+// job owner is included, so that the jobs can be updated on behalf of the user (eg. when removing expired exports).
+//
+// SECURITY: this is global, and returns the jobs of all users.
+func (gr *GormRepository) ListDoneBackgroundJobs(ctx context.Context, jobType pkg.BackgroundJobType, doneBefore time.Time) ([]models.BackgroundJob, error) {
+	var backgroundJobs []models.BackgroundJob
+	err := gr.GormClient.WithContext(ctx).
+		Preload("User").
+		Where("job_type = ? AND job_status = ? AND done_time < ?", jobType, pkg.BackgroundJobStatusDone, doneBefore).
+		Order("done_time ASC").
+		Find(&backgroundJobs).Error
+	return backgroundJobs, err
+}
+
+// ResumeLockedBackgroundJobs is called when the server restarts, before the job runner starts processing jobs. Locked jobs were
+// interrupted (the process was stopped or killed), so they are unlocked:
+//   - scheduled jobs are recurring, so they are returned to the ready status, and run again at their next run time
+//   - resumable jobs (eg. syncs) are returned to the ready status, with their checkpoint data, and will be resumed by the job runner.
+//     Syncs of uploaded data (see models.BackgroundJobSyncData.IsRequestBound) cannot be resumed, since the data is not stored.
+//     The retry count is incremented, and the job is delayed using an exponential backoff (retryBackoff * 2^retries), so that a
+//     job which crashes the server is not retried immediately. Jobs which have been attempted maxAttempts times are failed.
+//   - all other jobs are failed
+//
+// SECURITY: this is global, and effects all users.
+func (gr *GormRepository) ResumeLockedBackgroundJobs(ctx context.Context, resumableJobTypes []pkg.BackgroundJobType, maxAttempts int, retryBackoff time.Duration) error {
+	var lockedBackgroundJobs []models.BackgroundJob
+	err := gr.GormClient.WithContext(ctx).
 		Where(models.BackgroundJob{JobStatus: pkg.BackgroundJobStatusLocked}).
-		Updates(models.BackgroundJob{
-			JobStatus: pkg.BackgroundJobStatusFailed,
-			DoneTime:  &now,
-		}).Error
+		Find(&lockedBackgroundJobs).Error
+	if err != nil {
+		return err
+	}
 
+	now := time.Now()
+	for _, lockedBackgroundJob := range lockedBackgroundJobs {
+		updates := map[string]interface{}{
+			"locked_time": nil,
+		}
+		attempt := lockedBackgroundJob.Retries + 1
+		failureReason := fmt.Sprintf("background job was interrupted by a server restart (attempt %d)", attempt)
+		isResumable := lo.Contains(resumableJobTypes, lockedBackgroundJob.JobType)
+		if isResumable && lockedBackgroundJob.JobType == pkg.BackgroundJobTypeSync {
+			var syncData models.BackgroundJobSyncData
+			if lockedBackgroundJob.Data != nil {
+				if err := json.Unmarshal(lockedBackgroundJob.Data, &syncData); err != nil {
+					return err
+				}
+			}
+			if syncData.IsRequestBound() {
+				isResumable = false
+				failureReason = "background job was interrupted by a server restart, the uploaded data is no longer available and must be uploaded again"
+			}
+		}
+
+		if lockedBackgroundJob.JobType == pkg.BackgroundJobTypeScheduledSync {
+			updates["job_status"] = pkg.BackgroundJobStatusReady
+		} else if isResumable && attempt < maxAttempts {
+			nextRunTime := now.Add(retryBackoff * time.Duration(1<<lo.Min([]int{lockedBackgroundJob.Retries, 16})))
+			updates["job_status"] = pkg.BackgroundJobStatusReady
+			updates["retries"] = attempt
+			updates["next_run_time"] = nextRunTime
+			gr.Logger.Infof("Resuming interrupted background job %s at %s (retry %d)", lockedBackgroundJob.ID, nextRunTime, attempt)
+		} else {
+			//the job data is deserialized generically, so that the job type specific fields are preserved
+			backgroundJobData := map[string]interface{}{}
+			if lockedBackgroundJob.Data != nil {
+				if err := json.Unmarshal(lockedBackgroundJob.Data, &backgroundJobData); err != nil {
+					return err
+				}
+			}
+			errorData, ok := backgroundJobData["error_data"].(map[string]interface{})
+			if !ok {
+				errorData = map[string]interface{}{}
+			}
+			errorData["final"] = failureReason
+			backgroundJobData["error_data"] = errorData
+			serializedData, err := json.Marshal(backgroundJobData)
+			if err != nil {
+				return err
+			}
+
+			updates["job_status"] = pkg.BackgroundJobStatusFailed
+			updates["done_time"] = now
+			updates["data"] = serializedData
+			gr.Logger.Warnf("Failing interrupted background job %s (attempt %d)", lockedBackgroundJob.ID, attempt)
+		}
+
+		err := gr.GormClient.WithContext(ctx).
+			Model(&models.BackgroundJob{}).
+			Where("id = ? AND job_status = ?", lockedBackgroundJob.ID, pkg.BackgroundJobStatusLocked).
+			Updates(updates).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 //</editor-fold>
@@ -1219,28 +1618,26 @@ func (gr *GormRepository) CancelAllLockedBackgroundJobsAndFail() error {
 // Utilities
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
+// resourceBaseColumns are the columns (see models.ResourceBase) which are present in every FHIR resource table
+var resourceBaseColumns = []string{"id", "created_at", "updated_at", "deleted_at", "user_id", "source_id", "source_resource_type", "source_resource_id", "sort_date", "sort_title", "source_uri", "resource_raw"}
+
 // Internal function
-// This function will return a list of resources from all FHIR tables in the database
-// The query allows us to set the  source id, source resource id, source resource type
-// SECURITY: this function assumes the user has already been authenticated
-// TODO: theres probably a more efficient way of doing this with GORM
-func (gr *GormRepository) getResourcesFromAllTables(queryBuilder *gorm.DB, queryParam models.OriginBase) ([]models.ResourceBase, error) {
-	wrappedResourceModels := []models.ResourceBase{}
-	resourceTypes := databaseModel.GetAllowedResourceTypes()
+// This function will return a (reusable) query for the resources stored in the FHIR tables of the specified resource types.
+// The tables are combined with UNION ALL, so that the resulting list can be filtered, sorted and paginated by the database.
+// The where clauses (using named parameters) are applied to each table, eg. source id, source resource id
+// SECURITY: this function assumes the user has already been authenticated, and that the where clauses filter by user_id
+func (gr *GormRepository) resourcesFromTablesQuery(ctx context.Context, resourceTypes []string, whereClauses []string, whereNamedParameters map[string]interface{}) (*gorm.DB, error) {
+	tableQueries := []string{}
 	for _, resourceType := range resourceTypes {
+		//SECURITY: the table name is validated against the allowed resource types
 		tableName, err := databaseModel.GetTableNameByResourceType(resourceType)
 		if err != nil {
 			return nil, err
 		}
-		var tempWrappedResourceModels []models.ResourceBase
-		results := queryBuilder.
-			Where(queryParam).
-			Table(tableName).
-			Find(&tempWrappedResourceModels)
-		if results.Error != nil {
-			return nil, results.Error
-		}
-		wrappedResourceModels = append(wrappedResourceModels, tempWrappedResourceModels...)
+		tableQueries = append(tableQueries, fmt.Sprintf("SELECT %s FROM %s WHERE %s", strings.Join(resourceBaseColumns, ", "), tableName, strings.Join(whereClauses, " AND ")))
 	}
-	return wrappedResourceModels, nil
+
+	return gr.GormClient.WithContext(ctx).
+		Table("(?) as resources", gr.GormClient.Raw(strings.Join(tableQueries, " UNION ALL "), whereNamedParameters)).
+		Session(&gorm.Session{}), nil
 }
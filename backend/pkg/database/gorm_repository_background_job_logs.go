@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+	"gorm.io/gorm"
+)
+
+// CreateBackgroundJobLogs stores the log entries captured while a background job was processed (see job_runner.Interface).
+// The entries which are no longer retained (see `jobs.logs` config) are removed afterwards.
+func (gr *GormRepository) CreateBackgroundJobLogs(ctx context.Context, backgroundJobLogs []models.BackgroundJobLog) error {
+	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
+	if currentUserErr != nil {
+		return currentUserErr
+	}
+	if len(backgroundJobLogs) == 0 {
+		return nil
+	}
+
+	for ndx := range backgroundJobLogs {
+		backgroundJobLogs[ndx].UserID = currentUser.ID
+	}
+	if err := gr.GormClient.WithContext(ctx).CreateInBatches(&backgroundJobLogs, 100).Error; err != nil {
+		return err
+	}
+
+	backgroundJobIds := lo.Uniq(lo.Map(backgroundJobLogs, func(backgroundJobLog models.BackgroundJobLog, _ int) uuid.UUID {
+		return backgroundJobLog.BackgroundJobID
+	}))
+	gr.pruneBackgroundJobLogs(ctx, currentUser.ID, backgroundJobIds)
+	return nil
+}
+
+// pruneBackgroundJobLogs removes the oldest log entries of each job, once there are more than `jobs.logs.max_entries`, and the
+// entries of the user which were logged more than `jobs.logs.retention_days` ago.
+// Errors are logged, since the log entries have already been stored
+func (gr *GormRepository) pruneBackgroundJobLogs(ctx context.Context, userId uuid.UUID, backgroundJobIds []uuid.UUID) {
+	maxEntries := gr.AppConfig.GetInt("jobs.logs.max_entries")
+	retentionDays := gr.AppConfig.GetInt("jobs.logs.retention_days")
+
+	if maxEntries > 0 {
+		for _, backgroundJobId := range backgroundJobIds {
+			backgroundJobLogsQuery := models.BackgroundJobLog{UserID: userId, BackgroundJobID: backgroundJobId}
+			retainedLogsQuery := gr.GormClient.WithContext(ctx).
+				Model(&models.BackgroundJobLog{}).
+				Select("id").
+				Where(backgroundJobLogsQuery).
+				Order(paginationOrderClause("logged_at", "id", true)).
+				Limit(maxEntries)
+			err := gr.GormClient.WithContext(ctx).
+				Where(backgroundJobLogsQuery).
+				Where("id NOT IN (?)", retainedLogsQuery).
+				Delete(&models.BackgroundJobLog{}).Error
+			if err != nil {
+				gr.Logger.Warnf("ignoring: an error occurred while pruning background job logs (%s): %v", backgroundJobId, err)
+			}
+		}
+	}
+
+	if retentionDays > 0 {
+		err := gr.GormClient.WithContext(ctx).
+			Where(models.BackgroundJobLog{UserID: userId}).
+			Where("logged_at < ?", time.Now().AddDate(0, 0, -retentionDays)).
+			Delete(&models.BackgroundJobLog{}).Error
+		if err != nil {
+			gr.Logger.Warnf("ignoring: an error occurred while removing expired background job logs: %v", err)
+		}
+	}
+}
+
+// ListBackgroundJobLogs returns a page of the log entries stored for a background job, oldest first
+func (gr *GormRepository) ListBackgroundJobLogs(ctx context.Context, backgroundJobId string, queryOptions models.BackgroundJobLogQueryOptions) ([]models.BackgroundJobLog, models.Pagination, error) {
+	pagination := models.Pagination{}
+	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
+	if currentUserErr != nil {
+		return nil, pagination, currentUserErr
+	}
+
+	backgroundJobUUID, err := uuid.Parse(backgroundJobId)
+	if err != nil {
+		return nil, pagination, err
+	}
+
+	backgroundJobLogsQuery := gr.GormClient.WithContext(ctx).
+		Model(&models.BackgroundJobLog{}).
+		Where(models.BackgroundJobLog{UserID: currentUser.ID, BackgroundJobID: backgroundJobUUID}).
+		Session(&gorm.Session{})
+
+	query := backgroundJobLogsQuery.Order(paginationOrderClause("logged_at", "id", false))
+	if len(queryOptions.Cursor) > 0 {
+		cursor, err := decodePaginationCursor(queryOptions.Cursor)
+		if err != nil {
+			return nil, pagination, err
+		}
+		cursorClause, cursorParameters := paginationCursorClause("logged_at", "id", false, cursor)
+		query = query.Where(cursorClause, cursorParameters...)
+	}
+	if queryOptions.Limit > 0 {
+		//an additional entry is requested to determine if there is a next page
+		query = query.Limit(queryOptions.Limit + 1)
+	}
+
+	backgroundJobLogs := []models.BackgroundJobLog{}
+	if err := query.Find(&backgroundJobLogs).Error; err != nil {
+		return nil, pagination, err
+	}
+	if queryOptions.Limit == 0 {
+		pagination.Total = int64(len(backgroundJobLogs))
+		return backgroundJobLogs, pagination, nil
+	}
+
+	if err := backgroundJobLogsQuery.Count(&pagination.Total).Error; err != nil {
+		return nil, pagination, err
+	}
+	if len(backgroundJobLogs) > queryOptions.Limit {
+		backgroundJobLogs = backgroundJobLogs[:queryOptions.Limit]
+		lastBackgroundJobLog := backgroundJobLogs[len(backgroundJobLogs)-1]
+		pagination.Next = encodePaginationCursor(paginationCursor{SortDate: &lastBackgroundJobLog.LoggedAt, ID: lastBackgroundJobLog.ID})
+	}
+	return backgroundJobLogs, pagination, nil
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	databaseModel "github.com/fastenhealth/fasten-onprem/backend/pkg/models/database"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slices"
+	"gorm.io/gorm"
+)
+
+// exportBatchSize is the number of resources retrieved from the database at a time by ExportResources
+const exportBatchSize = 500
+
+// ExportResources calls exportCallback with each of the user's resources, walking every source (see GetSources) and every
+// `fhir_*` table. Resources are retrieved in batches, so that the complete record never needs to be loaded into memory.
+// The resources are grouped by resource type, then by source.
+//
+// The related_resources links of each resource are populated in ResourceBase.RelatedResource (only the OriginBase of the
+// related resources is populated, they may not be exported if they are filtered out, or do not exist).
+// If exportCallback returns an error, the export is stopped and the error is returned.
+func (gr *GormRepository) ExportResources(ctx context.Context, exportOptions models.ExportResourceQueryOptions, exportCallback func(resource *models.ResourceBase) error) error {
+	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
+	if currentUserErr != nil {
+		return currentUserErr
+	}
+
+	//SECURITY: the resource types are used as table names, so they must be validated
+	resourceTypes := databaseModel.GetAllowedResourceTypes()
+	if len(exportOptions.SourceResourceTypes) > 0 {
+		for _, resourceType := range exportOptions.SourceResourceTypes {
+			if !slices.Contains(resourceTypes, resourceType) {
+				return fmt.Errorf("resource type %s is not supported", resourceType)
+			}
+		}
+		resourceTypes = exportOptions.SourceResourceTypes
+	}
+
+	sources, err := gr.GetSources(ctx)
+	if err != nil {
+		return err
+	}
+	if len(exportOptions.SourceID) > 0 {
+		sourceNdx := slices.IndexFunc(sources, func(source models.SourceCredential) bool {
+			return source.ID.String() == exportOptions.SourceID
+		})
+		if sourceNdx < 0 {
+			return fmt.Errorf("source %s does not exist", exportOptions.SourceID)
+		}
+		sources = sources[sourceNdx : sourceNdx+1]
+	}
+
+	relatedResourcesLookup, err := gr.exportRelatedResourcesLookup(ctx, currentUser.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, resourceType := range resourceTypes {
+		tableName, err := databaseModel.GetTableNameByResourceType(resourceType)
+		if err != nil {
+			return err
+		}
+
+		for _, source := range sources {
+			resourcesQuery := gr.GormClient.WithContext(ctx).
+				Table(tableName).
+				Select(resourceBaseColumns).
+				Where("user_id = ? AND source_id = ?", currentUser.ID.String(), source.ID.String())
+			if exportOptions.Since != nil {
+				resourcesQuery = resourcesQuery.Where("updated_at > ?", exportOptions.Since.UTC())
+			}
+			if exportOptions.Start != nil {
+				resourcesQuery = resourcesQuery.Where("(sort_date IS NULL OR sort_date >= ?)", exportOptions.Start.UTC())
+			}
+			if exportOptions.End != nil {
+				resourcesQuery = resourcesQuery.Where("(sort_date IS NULL OR sort_date < ?)", exportOptions.End.UTC())
+			}
+
+			resourcesBatch := []models.ResourceBase{}
+			batchResult := resourcesQuery.FindInBatches(&resourcesBatch, exportBatchSize, func(tx *gorm.DB, batch int) error {
+				for ndx := range resourcesBatch {
+					resource := &resourcesBatch[ndx]
+					resource.RelatedResource = relatedResourcesLookup[exportResourceKey(resource.SourceID, resource.SourceResourceType, resource.SourceResourceID)]
+					if err := exportCallback(resource); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if batchResult.Error != nil {
+				return batchResult.Error
+			}
+		}
+	}
+	return nil
+}
+
+// exportRelatedResourcesLookup returns all of the user's related_resources links, keyed by the resource (see exportResourceKey)
+func (gr *GormRepository) exportRelatedResourcesLookup(ctx context.Context, userID uuid.UUID) (map[string][]*models.ResourceBase, error) {
+	var relatedResources []models.RelatedResource
+	result := gr.GormClient.WithContext(ctx).
+		Where(models.RelatedResource{ResourceBaseUserID: userID}).
+		Find(&relatedResources)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	relatedResourcesLookup := map[string][]*models.ResourceBase{}
+	for _, relatedResource := range relatedResources {
+		resourceKey := exportResourceKey(relatedResource.ResourceBaseSourceID, relatedResource.ResourceBaseSourceResourceType, relatedResource.ResourceBaseSourceResourceID)
+		relatedResourcesLookup[resourceKey] = append(relatedResourcesLookup[resourceKey], &models.ResourceBase{
+			OriginBase: models.OriginBase{
+				UserID:             relatedResource.RelatedResourceUserID,
+				SourceID:           relatedResource.RelatedResourceSourceID,
+				SourceResourceType: relatedResource.RelatedResourceSourceResourceType,
+				SourceResourceID:   relatedResource.RelatedResourceSourceResourceID,
+			},
+		})
+	}
+	return relatedResourcesLookup, nil
+}
+
+func exportResourceKey(sourceID uuid.UUID, resourceType string, resourceID string) string {
+	return fmt.Sprintf("%s/%s/%s", sourceID.String(), resourceType, resourceID)
+}
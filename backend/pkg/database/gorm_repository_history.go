@@ -0,0 +1,175 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	databaseModel "github.com/fastenhealth/fasten-onprem/backend/pkg/models/database"
+	"github.com/google/uuid"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// updateResourceVersion replaces the stored version of a resource with the updated resource, the stored version is
+// added to the resource history (with the next version id) in the same transaction.
+// storedResourceModel must contain the resource found in the database.
+func (gr *GormRepository) updateResourceVersion(ctx context.Context, storedResourceModel databaseModel.IFhirResourceModel, wrappedResourceModel *models.ResourceBase) (bool, error) {
+	resourceHistory := models.ResourceHistory{
+		UserID:             wrappedResourceModel.UserID,
+		SourceID:           storedResourceModel.GetSourceID(),
+		SourceResourceType: storedResourceModel.GetSourceResourceType(),
+		SourceResourceID:   storedResourceModel.GetSourceResourceID(),
+		VersionTime:        storedResourceModel.GetUpdatedAt(),
+		SortDate:           storedResourceModel.GetSortDate(),
+		SortTitle:          storedResourceModel.GetSortTitle(),
+		ResourceRaw:        storedResourceModel.GetResourceRaw(),
+	}
+
+	storedResourceModel.SetSortTitle(wrappedResourceModel.SortTitle)
+	storedResourceModel.SetSortDate(wrappedResourceModel.SortDate)
+	storedResourceModel.SetSourceUri(wrappedResourceModel.SourceUri)
+	storedResourceModel.SetResourceRaw(wrappedResourceModel.ResourceRaw)
+	//the search parameters were replaced by the stored values, so they must be extracted again
+	err := storedResourceModel.PopulateAndExtractSearchParameters(json.RawMessage(wrappedResourceModel.ResourceRaw))
+	if err != nil {
+		gr.Logger.Warnf("ignoring: an error occurred while extracting SearchParameters using FHIRPath (%s/%s): %v", resourceHistory.SourceResourceType, resourceHistory.SourceResourceID, err)
+	}
+
+	var rowsAffected int64
+	txErr := gr.GormClient.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		latestVersionId, err := latestResourceHistoryVersionId(tx, resourceHistory)
+		if err != nil {
+			return err
+		}
+		resourceHistory.VersionID = latestVersionId + 1
+		if err := tx.Create(&resourceHistory).Error; err != nil {
+			return err
+		}
+
+		updateResult := tx.Omit("RelatedResource.*").Save(storedResourceModel)
+		rowsAffected = updateResult.RowsAffected
+		return updateResult.Error
+	})
+	if txErr != nil {
+		return false, txErr
+	}
+
+	gr.pruneResourceHistory(ctx, resourceHistory)
+	return rowsAffected > 0, nil
+}
+
+// pruneResourceHistory removes the prior versions of a resource which are no longer retained (see `history.retention` config).
+// The most recent prior version (latestResourceHistory) is always kept, so that version ids are never reused.
+// Errors are logged, since the resource has already been stored
+func (gr *GormRepository) pruneResourceHistory(ctx context.Context, latestResourceHistory models.ResourceHistory) {
+	maxVersions := gr.AppConfig.GetInt("history.retention.max_versions")
+	retentionDays := gr.AppConfig.GetInt("history.retention.days")
+	if maxVersions <= 0 && retentionDays <= 0 {
+		return
+	}
+
+	pruneQuery := gr.GormClient.WithContext(ctx).
+		Where(resourceHistoryQuery(latestResourceHistory)).
+		Where("version_id < ?", latestResourceHistory.VersionID)
+	if maxVersions > 0 && retentionDays > 0 {
+		pruneQuery = pruneQuery.Where("(version_id <= ? OR created_at < ?)", latestResourceHistory.VersionID-maxVersions, time.Now().AddDate(0, 0, -retentionDays))
+	} else if maxVersions > 0 {
+		pruneQuery = pruneQuery.Where("version_id <= ?", latestResourceHistory.VersionID-maxVersions)
+	} else {
+		pruneQuery = pruneQuery.Where("created_at < ?", time.Now().AddDate(0, 0, -retentionDays))
+	}
+	if err := pruneQuery.Delete(&models.ResourceHistory{}).Error; err != nil {
+		gr.Logger.Warnf("ignoring: an error occurred while pruning resource history (%s/%s): %v", latestResourceHistory.SourceResourceType, latestResourceHistory.SourceResourceID, err)
+	}
+}
+
+// ListResourceHistory returns every version of a resource, newest first. The first version is the current version of
+// the resource (stored in the resource table), followed by the prior versions stored in the resource history.
+func (gr *GormRepository) ListResourceHistory(ctx context.Context, sourceId string, sourceResourceType string, sourceResourceId string) ([]models.ResourceHistory, error) {
+	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
+	if currentUserErr != nil {
+		return nil, currentUserErr
+	}
+
+	sourceUUID, err := uuid.Parse(sourceId)
+	if err != nil {
+		return nil, err
+	}
+	tableName, err := databaseModel.GetTableNameByResourceType(sourceResourceType)
+	if err != nil {
+		return nil, err
+	}
+
+	var currentResource models.ResourceBase
+	results := gr.GormClient.WithContext(ctx).
+		Where(models.OriginBase{
+			UserID:             currentUser.ID,
+			SourceID:           sourceUUID,
+			SourceResourceType: sourceResourceType,
+			SourceResourceID:   sourceResourceId,
+		}).
+		Table(tableName).
+		First(&currentResource)
+	if results.Error != nil {
+		return nil, results.Error
+	}
+
+	currentVersion := models.ResourceHistory{
+		ModelBase:          currentResource.ModelBase,
+		UserID:             currentUser.ID,
+		SourceID:           sourceUUID,
+		SourceResourceType: sourceResourceType,
+		SourceResourceID:   sourceResourceId,
+		VersionTime:        currentResource.UpdatedAt,
+		SortDate:           currentResource.SortDate,
+		SortTitle:          currentResource.SortTitle,
+		ResourceRaw:        currentResource.ResourceRaw,
+	}
+
+	priorVersions := []models.ResourceHistory{}
+	results = gr.GormClient.WithContext(ctx).
+		Where(resourceHistoryQuery(currentVersion)).
+		Order("version_id DESC").
+		Find(&priorVersions)
+	if results.Error != nil {
+		return nil, results.Error
+	}
+
+	currentVersion.VersionID = 1
+	if len(priorVersions) > 0 {
+		currentVersion.VersionID = priorVersions[0].VersionID + 1
+	}
+	return append([]models.ResourceHistory{currentVersion}, priorVersions...), nil
+}
+
+func latestResourceHistoryVersionId(tx *gorm.DB, resourceHistory models.ResourceHistory) (int, error) {
+	var latestVersionId int
+	err := tx.Model(&models.ResourceHistory{}).
+		Where(resourceHistoryQuery(resourceHistory)).
+		Select("COALESCE(MAX(version_id), 0)").
+		Scan(&latestVersionId).Error
+	return latestVersionId, err
+}
+
+// resourceHistoryQuery returns the conditions matching every prior version of the same resource
+func resourceHistoryQuery(resourceHistory models.ResourceHistory) models.ResourceHistory {
+	return models.ResourceHistory{
+		UserID:             resourceHistory.UserID,
+		SourceID:           resourceHistory.SourceID,
+		SourceResourceType: resourceHistory.SourceResourceType,
+		SourceResourceID:   resourceHistory.SourceResourceID,
+	}
+}
+
+// resourceRawEqual checks if two versions of a resource have the same content. The stored json is compacted by the
+// serializer, so formatting differences (eg. indentation) are ignored
+func resourceRawEqual(resourceRaw datatypes.JSON, otherResourceRaw datatypes.JSON) bool {
+	var compactResourceRaw, compactOtherResourceRaw bytes.Buffer
+	if json.Compact(&compactResourceRaw, resourceRaw) != nil || json.Compact(&compactOtherResourceRaw, otherResourceRaw) != nil {
+		return bytes.Equal(resourceRaw, otherResourceRaw)
+	}
+	return bytes.Equal(compactResourceRaw.Bytes(), compactOtherResourceRaw.Bytes())
+}
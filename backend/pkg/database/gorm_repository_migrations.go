@@ -65,6 +65,64 @@ func (gr *GormRepository) Migrate() error {
 				return nil
 			},
 		},
+		{
+			ID: "20261018081500", // Adding full-text search index (and indexing existing resources)
+			Migrate: func(tx *gorm.DB) error {
+				return migrateResourceSearchIndex(tx)
+			},
+		},
+		{
+			ID: "20261018103000", // Adding resource history (prior versions of each resource)
+			Migrate: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(
+					&models.ResourceHistory{},
+				)
+			},
+		},
+		{
+			ID: "20261018120000", // Adding user settings with a json value (and the csv_import_templates setting for each user)
+			Migrate: func(tx *gorm.DB) error {
+				if err := tx.AutoMigrate(&models.UserSettingEntry{}); err != nil {
+					return err
+				}
+
+				users := []models.User{}
+				results := tx.Find(&users)
+				if results.Error != nil {
+					return results.Error
+				}
+				for _, user := range users {
+					csvImportTemplatesSetting := models.UserSettingEntry{
+						UserID:                user.ID,
+						SettingKeyName:        "csv_import_templates",
+						SettingKeyDescription: "saved column mappings for CSV imports",
+						SettingDataType:       "json",
+						SettingValueJson:      []byte("[]"),
+					}
+					if err := tx.Create(&csvImportTemplatesSetting).Error; err != nil {
+						tx.Logger.Error(context.Background(), fmt.Sprintf("An error occurred creating csv_import_templates setting for user: %s", user.ID))
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			ID: "20261018150000", // Adding background job logs (captured while a job is processed by the job runner)
+			Migrate: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(
+					&models.BackgroundJobLog{},
+				)
+			},
+		},
+		{
+			ID: "20261018170000", // Adding next run time to background jobs (used by scheduled syncs and retry backoff)
+			Migrate: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(
+					&models.BackgroundJob{},
+				)
+			},
+		},
 	})
 
 	if err := m.Migrate(); err != nil {
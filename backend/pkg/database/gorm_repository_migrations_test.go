@@ -0,0 +1,84 @@
+package database
+
+import (
+	"fmt"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/config"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	databaseModel "github.com/fastenhealth/fasten-onprem/backend/pkg/models/database"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"gorm.io/datatypes"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// baselineBackgroundJob is the background_jobs table, as created by the base migration (20231017112246) on existing installs
+type baselineBackgroundJob struct {
+	models.ModelBase
+	UserID     uuid.UUID
+	JobType    pkg.BackgroundJobType
+	Data       datatypes.JSON `gorm:"column:data;type:text;serializer:json"`
+	JobStatus  pkg.BackgroundJobStatus
+	LockedTime *time.Time
+	DoneTime   *time.Time
+	Retries    int
+	Schedule   *pkg.BackgroundJobSchedule
+}
+
+func (baselineBackgroundJob) TableName() string {
+	return "background_jobs"
+}
+
+func TestMigrate_FromBaselineSchema(t *testing.T) {
+	//setup
+	dbFile, err := ioutil.TempFile("", fmt.Sprintf("%s.*.db", t.Name()))
+	require.NoError(t, err)
+	defer os.Remove(dbFile.Name())
+
+	baselineDatabase, err := gorm.Open(sqlite.Open("file:"+dbFile.Name()), &gorm.Config{DisableForeignKeyConstraintWhenMigrating: true})
+	require.NoError(t, err)
+	require.NoError(t, baselineDatabase.AutoMigrate(
+		&baselineBackgroundJob{},
+		&models.Glossary{},
+		&models.SourceCredential{},
+		&models.UserSettingEntry{},
+		&models.User{},
+	))
+	require.NoError(t, databaseModel.Migrate(baselineDatabase))
+	require.NoError(t, baselineDatabase.Exec("CREATE TABLE migrations (id VARCHAR(255) PRIMARY KEY)").Error)
+	for _, migrationId := range []string{"20231017112246", "20231017113858", "20231201122541"} {
+		require.NoError(t, baselineDatabase.Exec("INSERT INTO migrations (id) VALUES (?)", migrationId).Error)
+	}
+	baselineJob := baselineBackgroundJob{JobType: pkg.BackgroundJobTypeSync, JobStatus: pkg.BackgroundJobStatusDone}
+	require.NoError(t, baselineDatabase.Create(&baselineJob).Error)
+	require.False(t, baselineDatabase.Migrator().HasColumn(&models.BackgroundJob{}, "NextRunTime"))
+	baselineSqlDatabase, err := baselineDatabase.DB()
+	require.NoError(t, err)
+	require.NoError(t, baselineSqlDatabase.Close())
+
+	testConfig, err := config.Create()
+	require.NoError(t, err)
+	testConfig.SetDefault("database.location", dbFile.Name())
+	testConfig.SetDefault("log.level", "INFO")
+
+	//test
+	dbRepo, err := NewRepository(testConfig, logrus.WithField("test", t.Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(t, err)
+
+	//assert
+	gormClient := dbRepo.(*GormRepository).GormClient
+	require.True(t, gormClient.Migrator().HasColumn(&models.BackgroundJob{}, "NextRunTime"))
+	require.True(t, gormClient.Migrator().HasTable(&models.BackgroundJobLog{}))
+
+	var migratedJob models.BackgroundJob
+	require.NoError(t, gormClient.First(&migratedJob, "id = ?", baselineJob.ID).Error)
+	require.Equal(t, pkg.BackgroundJobStatusDone, migratedJob.JobStatus)
+	require.Nil(t, migratedJob.NextRunTime)
+}
@@ -0,0 +1,253 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"gorm.io/gorm"
+)
+
+// The Observation `$lastn` and `$stats` operations summarize the Observations matching a search (see sqlQueryResources)
+// for each code. An Observation may have multiple codings (eg. a LOINC code and a code local to the source), each coding
+// is treated as a separate code, so that Observations from different sources are grouped together if they share a coding.
+// If the search filters by `code`, only the requested codings are used.
+//
+// The matching Observations are used as a subquery, and each (Observation, coding) row is ranked by date:
+//
+//	SELECT fhir.id as id, ROW_NUMBER() OVER (PARTITION BY codeJson.value ->> '$.system', codeJson.value ->> '$.code' ORDER BY fhir.date DESC NULLS LAST, fhir.id ASC) as observation_rank
+//	FROM (SELECT fhir.* FROM fhir_observation as fhir WHERE ... GROUP BY fhir.id) as fhir, json_each(fhir.code) as codeJson
+
+// QueryObservationLastN returns the most recent Observations (up to query.Max) for each code, across all sources. See
+// https://hl7.org/fhir/r4/observation-operation-lastn.html
+// The Observations are sorted by date (most recent first), Observations without a date are only returned if there are fewer than
+// query.Max Observations with a date.
+func (gr *GormRepository) QueryObservationLastN(ctx context.Context, query models.ObservationLastNQuery) ([]models.ResourceBase, error) {
+	if query.Max < 1 {
+		return nil, fmt.Errorf("max must be greater than zero")
+	}
+
+	dialect := gr.sqlDialect()
+	rankedQuery, err := gr.sqlQueryObservationCodings(ctx, query.Where)
+	if err != nil {
+		return nil, err
+	}
+	rankedQuery = rankedQuery.Select(fmt.Sprintf(
+		"%s.id as id, ROW_NUMBER() OVER (PARTITION BY %s ORDER BY %s) as observation_rank",
+		TABLE_ALIAS,
+		strings.Join(sqlObservationCodingColumns(dialect), ", "),
+		sqlObservationDateOrder(dialect),
+	))
+
+	lastNQuery := gr.GormClient.WithContext(ctx).
+		Table("(?) as ranked", rankedQuery).
+		Select("ranked.id").
+		Where("ranked.observation_rank <= ?", query.Max)
+
+	resources := []models.ResourceBase{}
+	result := gr.GormClient.WithContext(ctx).
+		Table("fhir_observation").
+		Select(resourceBaseColumns).
+		Where("id IN (?)", lastNQuery).
+		Order(paginationOrderClause("sort_date", "id", true)).
+		Find(&resources)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	for ndx := range resources {
+		resources[ndx].SearchMode = pkg.ResourceSearchModeMatch
+	}
+	return resources, nil
+}
+
+// QueryObservationStatistics calculates the count, minimum, maximum, mean and latest of the Quantity values of the Observations
+// with each code (and optionally in each date bucket). See https://hl7.org/fhir/r4/observation-operation-stats.html
+// Values recorded in different units are summarized separately, unless a unit is requested (see sqlQuantityValueInUnit).
+// Observations without a Quantity value are ignored.
+func (gr *GormRepository) QueryObservationStatistics(ctx context.Context, query models.ObservationStatisticsQuery) ([]models.ObservationStatistics, error) {
+	if len(query.Bucket) > 0 {
+		if _, bucketOk := models.QueryResourceAggregationBuckets[query.Bucket]; !bucketOk {
+			return nil, fmt.Errorf("unknown bucket '%s', must be one of year, quarter, month, week or day", query.Bucket)
+		}
+	}
+	if _, unitOk := ucumUnits[query.Unit]; len(query.Unit) > 0 && !unitOk {
+		return nil, fmt.Errorf("unit '%s' cannot be converted", query.Unit)
+	}
+
+	dialect := gr.sqlDialect()
+	quantityAlias := "valueQuantityJson"
+	valuesQuery, err := gr.sqlQueryObservationCodings(ctx, query.Where, sqlJsonEach(dialect, TABLE_ALIAS, "valueQuantity", quantityAlias))
+	if err != nil {
+		return nil, err
+	}
+
+	//SECURITY: the unit & bucket have been validated above
+	valueClause := sqlJsonExtractNumeric(dialect, quantityAlias, "value")
+	unitClause := sqlQuantityUnit(dialect, quantityAlias)
+	if len(query.Unit) > 0 {
+		valueClause = sqlQuantityValueInUnit(dialect, quantityAlias, query.Unit)
+		unitClause = fmt.Sprintf("'%s'", query.Unit)
+	}
+	periodClause := "''"
+	partitionClauses := append(sqlObservationCodingColumns(dialect), unitClause)
+	if len(query.Bucket) > 0 {
+		periodClause = sqlDateBucket(dialect, TABLE_ALIAS, "date", query.Bucket)
+		partitionClauses = append(partitionClauses, periodClause)
+	}
+
+	codingColumns := sqlObservationCodingColumns(dialect)
+	valuesQuery = valuesQuery.
+		Select(strings.Join([]string{
+			fmt.Sprintf("%s as code_system", codingColumns[0]),
+			fmt.Sprintf("%s as code", codingColumns[1]),
+			fmt.Sprintf("%s as code_display", sqlJsonExtract(dialect, "codeJson", "text")),
+			fmt.Sprintf("%s as period", periodClause),
+			fmt.Sprintf("%s as unit", unitClause),
+			fmt.Sprintf("%s as value", valueClause),
+			fmt.Sprintf("%s as date", sqlTableColumn(dialect, TABLE_ALIAS, "date")),
+			fmt.Sprintf("ROW_NUMBER() OVER (PARTITION BY %s ORDER BY %s) as observation_rank", strings.Join(partitionClauses, ", "), sqlObservationDateOrder(dialect)),
+		}, ", ")).
+		Where(fmt.Sprintf("(%s) IS NOT NULL", valueClause))
+
+	rows := []map[string]interface{}{}
+	result := gr.GormClient.WithContext(ctx).
+		Table("(?) as observation_values", valuesQuery).
+		Select(strings.Join([]string{
+			"code_system",
+			"code",
+			"max(code_display) as code_display",
+			"period",
+			"unit",
+			"count(*) as count",
+			"CAST(min(value) AS DOUBLE PRECISION) as minimum",
+			"CAST(max(value) AS DOUBLE PRECISION) as maximum",
+			"CAST(avg(value) AS DOUBLE PRECISION) as mean",
+			"CAST(max(CASE WHEN observation_rank = 1 THEN value END) AS DOUBLE PRECISION) as latest",
+			"min(date) as period_start",
+			"max(date) as period_end",
+		}, ", ")).
+		Group("code_system, code, period, unit").
+		Order("code_system, code, period, unit").
+		Find(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	statistics := []models.ObservationStatistics{}
+	for _, row := range rows {
+		statistics = append(statistics, models.ObservationStatistics{
+			CodeSystem:  selectColumnString(row["code_system"]),
+			Code:        selectColumnString(row["code"]),
+			CodeDisplay: selectColumnString(row["code_display"]),
+			Period:      selectColumnString(row["period"]),
+			Unit:        selectColumnString(row["unit"]),
+			Count:       int64(selectColumnFloat(row["count"])),
+			Minimum:     selectColumnFloat(row["minimum"]),
+			Maximum:     selectColumnFloat(row["maximum"]),
+			Mean:        selectColumnFloat(row["mean"]),
+			Latest:      selectColumnFloat(row["latest"]),
+			Start:       selectColumnTime(row["period_start"]),
+			End:         selectColumnTime(row["period_end"]),
+		})
+	}
+	return statistics, nil
+}
+
+// sqlQueryObservationCodings returns a query (without a select clause) for every coding of the Observations matching the search
+// parameters, the Observation columns are available as `fhir` and the coding as `codeJson`. Additional from clauses (eg. sqlJsonEach)
+// may reference the Observation columns.
+func (gr *GormRepository) sqlQueryObservationCodings(ctx context.Context, where map[string]interface{}, additionalFromClauses ...string) (*gorm.DB, error) {
+	matchesQuery, err := gr.sqlQueryResources(ctx, models.QueryResource{From: "Observation", Where: where})
+	if err != nil {
+		return nil, err
+	}
+
+	dialect := gr.sqlDialect()
+	fromClause := sqlJsonEach(dialect, TABLE_ALIAS, "code", "codeJson")
+	codingsQuery := gr.GormClient.WithContext(ctx).
+		Table(strings.Join(append([]string{fmt.Sprintf("(?) as %s", TABLE_ALIAS), fromClause}, additionalFromClauses...), ", "), matchesQuery)
+
+	//only the requested codings are used, so that Observations are not grouped by their other codings
+	if codeValue, hasCode := where["code"]; hasCode {
+		codeParameter := SearchParameter{Name: "code", Type: SearchParameterTypeToken}
+		//the where clauses reference the `codeJson` rows, so the from clause is already included
+		codeWhereClauses, _, codeNamedParameters, err := searchParameterToClauses(dialect, TABLE_ALIAS, codeParameter, codeValue, "coding_")
+		if err != nil {
+			return nil, err
+		}
+		codingsQuery = codingsQuery.Where(strings.Join(codeWhereClauses, " AND "), codeNamedParameters)
+	}
+	return codingsQuery, nil
+}
+
+// sqlObservationCodingColumns returns the system & code of the coding row (generated by sqlQueryObservationCodings)
+func sqlObservationCodingColumns(dialect pkg.DatabaseRepositoryType) []string {
+	return []string{sqlJsonExtract(dialect, "codeJson", "system"), sqlJsonExtract(dialect, "codeJson", "code")}
+}
+
+// sqlObservationDateOrder orders Observations by date (most recent first), the id ensures the order is stable
+func sqlObservationDateOrder(dialect pkg.DatabaseRepositoryType) string {
+	return fmt.Sprintf("%s DESC NULLS LAST, %s.id ASC", sqlTableColumn(dialect, TABLE_ALIAS, "date"), TABLE_ALIAS)
+}
+
+// selectColumnString returns the text value of a database column (returned by a query scanned into a map), NULL is an empty string
+func selectColumnString(columnValue interface{}) string {
+	switch value := selectColumnValue(columnValue).(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+// selectColumnFloat returns the numeric value of a database column (returned by a query scanned into a map), NULL is zero
+func selectColumnFloat(columnValue interface{}) float64 {
+	switch value := selectColumnValue(columnValue).(type) {
+	case float64:
+		return value
+	case float32:
+		return float64(value)
+	case int64:
+		return float64(value)
+	case int32:
+		return float64(value)
+	case int:
+		return float64(value)
+	case string:
+		parsedValue, _ := strconv.ParseFloat(value, 64)
+		return parsedValue
+	}
+	return 0
+}
+
+// sqliteTimestampFormats are the formats used by SQLite to store datetime columns, which are returned as text by aggregate functions
+var sqliteTimestampFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// selectColumnTime returns the (UTC) datetime value of a database column (returned by a query scanned into a map), NULL (or an invalid date) is nil
+func selectColumnTime(columnValue interface{}) *time.Time {
+	switch value := selectColumnValue(columnValue).(type) {
+	case time.Time:
+		value = value.UTC()
+		return &value
+	case string:
+		for _, timestampFormat := range append([]string{time.RFC3339Nano}, sqliteTimestampFormats...) {
+			if parsedValue, err := time.Parse(timestampFormat, value); err == nil {
+				parsedValue = parsedValue.UTC()
+				return &parsedValue
+			}
+		}
+	}
+	return nil
+}
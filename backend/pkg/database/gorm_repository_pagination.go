@@ -0,0 +1,86 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/errors"
+	"github.com/google/uuid"
+)
+
+// Lists of resources & background jobs use cursor (keyset) pagination, rather than offsets, so that pages are stable
+// when resources are added (or removed) between requests, and so that a list spanning multiple tables can be paged.
+//
+// Rows are always sorted by a (nullable) sort column, with the id as a tie-breaker, eg. `sort_date DESC NULLS LAST, id DESC`.
+// The cursor returned with each page (see models.Pagination) contains the sort value & id of the last row in the page,
+// and is converted into a where clause which only matches the rows after it:
+//
+//	(sort_date < @sort_date OR (sort_date = @sort_date AND id < @id) OR sort_date IS NULL)
+
+// paginationCursor is the (decoded) content of a models.Pagination.Next value.
+// Only one of SortDate or SortTitle is populated, depending on the sort column. Both are empty if the last row had a NULL sort value.
+type paginationCursor struct {
+	SortDate  *time.Time `json:"d,omitempty"`
+	SortTitle *string    `json:"t,omitempty"`
+	ID        uuid.UUID  `json:"id"`
+}
+
+func (c paginationCursor) sortValue() interface{} {
+	if c.SortDate != nil {
+		return *c.SortDate
+	} else if c.SortTitle != nil {
+		return *c.SortTitle
+	}
+	return nil
+}
+
+// encodePaginationCursor returns an opaque (url safe) cursor string
+func encodePaginationCursor(cursor paginationCursor) string {
+	cursorJson, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(cursorJson)
+}
+
+func decodePaginationCursor(encodedCursor string) (paginationCursor, error) {
+	var cursor paginationCursor
+	cursorJson, err := base64.RawURLEncoding.DecodeString(encodedCursor)
+	if err != nil {
+		return cursor, errors.QueryValidationErrorf("invalid cursor: %w", err)
+	}
+	if err := json.Unmarshal(cursorJson, &cursor); err != nil {
+		return cursor, errors.QueryValidationErrorf("invalid cursor: %w", err)
+	}
+	if cursor.ID == uuid.Nil {
+		return cursor, errors.QueryValidationErrorf("invalid cursor: missing id")
+	}
+	return cursor, nil
+}
+
+// paginationOrderClause returns the order clause which must be used with paginationCursorClause
+// SECURITY: the columns are not escaped, and must not be controlled by the user
+func paginationOrderClause(sortColumn string, idColumn string, descending bool) string {
+	direction := "ASC"
+	if descending {
+		direction = "DESC"
+	}
+	return fmt.Sprintf("%s %s NULLS LAST, %s %s", sortColumn, direction, idColumn, direction)
+}
+
+// paginationCursorClause returns a where clause (and its positional parameters) which only matches the rows after the cursor,
+// when the rows are ordered by paginationOrderClause
+// SECURITY: the columns are not escaped, and must not be controlled by the user
+func paginationCursorClause(sortColumn string, idColumn string, descending bool, cursor paginationCursor) (string, []interface{}) {
+	operator := ">"
+	if descending {
+		operator = "<"
+	}
+
+	sortValue := cursor.sortValue()
+	if sortValue == nil {
+		//NULLs are sorted last, so only the remaining NULL rows can follow the cursor
+		return fmt.Sprintf("(%s IS NULL AND %s %s ?)", sortColumn, idColumn, operator), []interface{}{cursor.ID.String()}
+	}
+	return fmt.Sprintf("(%s %s ? OR (%s = ? AND %s %s ?) OR %s IS NULL)", sortColumn, operator, sortColumn, idColumn, operator, sortColumn),
+		[]interface{}{sortValue, sortValue, cursor.ID.String()}
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaginationCursor_EncodeDecode(t *testing.T) {
+	t.Parallel()
+
+	sortDate := time.Date(2023, 1, 2, 3, 4, 5, 6, time.FixedZone("EST", -5*60*60))
+	cursor := paginationCursor{SortDate: &sortDate, ID: uuid.MustParse("1b2b3c4d-0000-0000-0000-000000000000")}
+
+	decodedCursor, err := decodePaginationCursor(encodePaginationCursor(cursor))
+	require.NoError(t, err)
+	require.Equal(t, cursor.ID, decodedCursor.ID)
+	require.Nil(t, decodedCursor.SortTitle)
+	//the offset must be preserved, sqlite compares dates as text
+	require.Equal(t, sortDate.Format(time.RFC3339Nano), decodedCursor.SortDate.Format(time.RFC3339Nano))
+
+	_, err = decodePaginationCursor("not a cursor")
+	require.EqualError(t, err, "invalid cursor: illegal base64 data at input byte 3")
+	_, err = decodePaginationCursor(encodePaginationCursor(paginationCursor{SortTitle: lo.ToPtr("title")}))
+	require.EqualError(t, err, "invalid cursor: missing id")
+}
+
+func TestPaginationCursorClause(t *testing.T) {
+	t.Parallel()
+
+	id := uuid.MustParse("1b2b3c4d-0000-0000-0000-000000000000")
+	sortDate := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var paginationCursorClauseTests = []struct {
+		sortColumn     string
+		descending     bool
+		cursor         paginationCursor
+		expectedClause string
+		expectedParams []interface{}
+	}{
+		{"sort_date", true, paginationCursor{SortDate: &sortDate, ID: id}, "(sort_date < ? OR (sort_date = ? AND id < ?) OR sort_date IS NULL)", []interface{}{sortDate, sortDate, id.String()}},
+		{"sort_date", true, paginationCursor{ID: id}, "(sort_date IS NULL AND id < ?)", []interface{}{id.String()}},
+		{"sort_title", false, paginationCursor{SortTitle: lo.ToPtr("Aspirin"), ID: id}, "(sort_title > ? OR (sort_title = ? AND id > ?) OR sort_title IS NULL)", []interface{}{"Aspirin", "Aspirin", id.String()}},
+		{"sort_title", false, paginationCursor{ID: id}, "(sort_title IS NULL AND id > ?)", []interface{}{id.String()}},
+	}
+
+	//test && assert
+	for ndx, tt := range paginationCursorClauseTests {
+		actualClause, actualParams := paginationCursorClause(tt.sortColumn, "id", tt.descending, tt.cursor)
+		require.Equal(t, tt.expectedClause, actualClause, "Expected clause to match for TestPaginationCursorClause[%d]", ndx)
+		require.Equal(t, tt.expectedParams, actualParams, "Expected params to match for TestPaginationCursorClause[%d]", ndx)
+	}
+
+	require.Equal(t, "sort_date DESC NULLS LAST, id DESC", paginationOrderClause("sort_date", "id", true))
+	require.Equal(t, "sort_title ASC NULLS LAST, id ASC", paginationOrderClause("sort_title", "id", false))
+}
@@ -3,13 +3,18 @@ package database
 import (
 	"context"
 	"fmt"
+	"math/big"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/errors"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
 	databaseModel "github.com/fastenhealth/fasten-onprem/backend/pkg/models/database"
+	sourcePkg "github.com/fastenhealth/fasten-sources/pkg"
+	"github.com/google/uuid"
 	"github.com/iancoleman/strcase"
 	"github.com/samber/lo"
 	"golang.org/x/exp/maps"
@@ -35,6 +40,9 @@ const (
 	SearchParameterTypeSpecial   SearchParameterType = "special"
 )
 
+// search parameters of these types are stored as json arrays, which must be expanded (see searchCodeToFromClause)
+var complexSearchParameterTypes = []SearchParameterType{SearchParameterTypeQuantity, SearchParameterTypeToken, SearchParameterTypeString, SearchParameterTypeReference}
+
 const TABLE_ALIAS = "fhir"
 
 // Allows users to use SearchParameters to query resources
@@ -54,34 +62,129 @@ const TABLE_ALIAS = "fhir"
 // )
 // AND (user_id = "6efcd7c5-3f29-4f0d-926d-a66ff68bbfc2")
 // GROUP BY `fhir`.`id`
-func (gr *GormRepository) QueryResources(ctx context.Context, query models.QueryResource) (interface{}, error) {
+func (gr *GormRepository) QueryResources(ctx context.Context, query models.QueryResource) (interface{}, models.Pagination, error) {
+	pagination := models.Pagination{}
 
-	sqlQuery, err := gr.sqlQueryResources(ctx, query)
+	//merge the named view (if present) into the query
+	query, err := query.ApplyView()
 	if err != nil {
-		return nil, err
+		return nil, pagination, err
+	}
+
+	//an additional row is requested to determine if there is a next page
+	pageQuery := query
+	if query.Limit != nil {
+		pageQuery.Limit = lo.ToPtr(*query.Limit + 1)
+	}
+	sqlQuery, err := gr.sqlQueryResources(ctx, pageQuery)
+	if err != nil {
+		return nil, pagination, err
 	}
 
+	var results interface{}
+	var resultCount int
+	var lastResultCursor paginationCursor
+	hasNextPage := false
 	if query.Aggregations != nil && (query.Aggregations.GroupBy != nil || query.Aggregations.CountBy != nil) {
-		results := []map[string]interface{}{}
-		clientResp := sqlQuery.Find(&results)
-		return results, clientResp.Error
+		aggregationResults := []map[string]interface{}{}
+		if err := sqlQuery.Find(&aggregationResults).Error; err != nil {
+			return nil, pagination, err
+		}
+		if query.Limit != nil && len(aggregationResults) > *query.Limit {
+			aggregationResults, hasNextPage = aggregationResults[:*query.Limit], true
+		}
+		results, resultCount = aggregationResults, len(aggregationResults)
+
+	} else if len(query.Select) > 0 {
+		//the query has already been validated by sqlQueryResources
+		queryModel, err := databaseModel.NewFhirResourceModelByType(query.From)
+		if err != nil {
+			return nil, pagination, err
+		}
+		selectParameters, err := ProcessSelectParameters(query.Select, queryModel.GetSearchParameters())
+		if err != nil {
+			return nil, pagination, err
+		}
+
+		rows := []map[string]interface{}{}
+		if err := sqlQuery.Find(&rows).Error; err != nil {
+			return nil, pagination, err
+		}
+		if query.Limit != nil && len(rows) > *query.Limit {
+			rows, hasNextPage = rows[:*query.Limit], true
+		}
+		if len(rows) > 0 {
+			lastResultCursor = selectRowPaginationCursor(rows[len(rows)-1])
+		}
+		selectResults, err := selectRowsToResults(selectParameters, rows)
+		if err != nil {
+			return nil, pagination, err
+		}
+		results, resultCount = selectResults, len(selectResults)
 
 	} else {
-		results := []models.ResourceBase{}
-		clientResp := sqlQuery.Find(&results)
-		return results, clientResp.Error
+		resourceResults := []models.ResourceBase{}
+		if err := sqlQuery.Find(&resourceResults).Error; err != nil {
+			return nil, pagination, err
+		}
+		if query.Limit != nil && len(resourceResults) > *query.Limit {
+			resourceResults, hasNextPage = resourceResults[:*query.Limit], true
+		}
+		for ndx := range resourceResults {
+			resourceResults[ndx].SearchMode = pkg.ResourceSearchModeMatch
+		}
+		if len(resourceResults) > 0 {
+			lastResource := resourceResults[len(resourceResults)-1]
+			lastResultCursor = paginationCursor{SortDate: lastResource.SortDate, ID: lastResource.ID}
+		}
+		resultCount = len(resourceResults)
+
+		//include (or revinclude) related resources in the results
+		if len(query.Include) > 0 || len(query.RevInclude) > 0 {
+			includedResults, err := gr.queryIncludedResources(ctx, query, resourceResults)
+			if err != nil {
+				return nil, pagination, err
+			}
+			resourceResults = append(resourceResults, includedResults...)
+		}
+		results = resourceResults
+	}
+
+	pagination.Total = int64(resultCount)
+	if query.Limit == nil {
+		return results, pagination, nil
+	}
+
+	//the total is the number of matching resources (or aggregated rows) across all pages, included resources are not counted
+	countQuery := query
+	countQuery.Limit, countQuery.Offset, countQuery.Cursor = nil, nil, ""
+	countSqlQuery, err := gr.sqlQueryResources(ctx, countQuery)
+	if err != nil {
+		return nil, pagination, err
+	}
+	if err := gr.GormClient.WithContext(ctx).Table("(?) as results", countSqlQuery).Count(&pagination.Total).Error; err != nil {
+		return nil, pagination, err
 	}
 
+	//aggregations (and sorted queries) are paginated using offsets, so there is no cursor
+	if hasNextPage && lastResultCursor.ID != uuid.Nil && len(query.Sort) == 0 {
+		pagination.Next = encodePaginationCursor(lastResultCursor)
+	}
+	return results, pagination, nil
 }
 
 // see QueryResources
 // this function has all the logic, but should only be called directly for testing
 func (gr *GormRepository) sqlQueryResources(ctx context.Context, query models.QueryResource) (*gorm.DB, error) {
-	//todo, until we actually parse the select statement, we will just return all resources based on "from"
+	//merge the named view (if present) into the query
+	query, err := query.ApplyView()
+	if err != nil {
+		return nil, err
+	}
 
 	//SECURITY: this is required to ensure that only valid resource types are queried (since it's controlled by the user)
 	if !slices.Contains(databaseModel.GetAllowedResourceTypes(), query.From) {
-		return nil, fmt.Errorf("invalid resource type %s", query.From)
+		return nil, errors.QueryValidationErrorf("invalid resource type %s", query.From)
 	}
 
 	if queryValidate := query.Validate(); queryValidate != nil {
@@ -99,37 +202,39 @@ func (gr *GormRepository) sqlQueryResources(ctx context.Context, query models.Qu
 	whereClauses := []string{}
 	whereNamedParameters := map[string]interface{}{}
 
+	//json functions & identifier quoting are database specific
+	dialect := gr.sqlDialect()
+
 	//find the FHIR search types associated with each where clause. Any unknown parameters will be ignored.
 	searchCodeToTypeLookup := queryModel.GetSearchParameters()
 	for searchParamCodeWithModifier, searchParamCodeValueOrValuesWithPrefix := range query.Where {
-		searchParameter, err := ProcessSearchParameter(searchParamCodeWithModifier, searchCodeToTypeLookup)
-		if err != nil {
-			return nil, err
+		if IsChainedSearchParameter(searchParamCodeWithModifier) {
+			//chained (`encounter.class`) and reverse chained (`_has:Condition:encounter:code`) search parameters are
+			// converted into a subquery against the referenced table, see chainedSearchParameterToWhereClause
+			chainedSearchParameter, err := ProcessChainedSearchParameter(searchParamCodeWithModifier, searchCodeToTypeLookup)
+			if err != nil {
+				return nil, err
+			}
+			whereClause, clauseNamedParameters, err := chainedSearchParameterToWhereClause(dialect, query.From, chainedSearchParameter, searchParamCodeValueOrValuesWithPrefix)
+			if err != nil {
+				return nil, err
+			}
+			whereClauses = append(whereClauses, whereClause)
+			maps.Copy(whereNamedParameters, clauseNamedParameters)
+			continue
 		}
 
-		searchParameterValueOperatorTree, err := ProcessSearchParameterValueIntoOperatorTree(searchParameter, searchParamCodeValueOrValuesWithPrefix)
+		searchParameter, err := ProcessSearchParameter(searchParamCodeWithModifier, searchCodeToTypeLookup)
 		if err != nil {
 			return nil, err
 		}
 
-		for ndxANDlevel, searchParameterValueOperatorAND := range searchParameterValueOperatorTree {
-			whereORClauses := []string{}
-			for ndxORlevel, searchParameterValueOperatorOR := range searchParameterValueOperatorAND {
-				whereORClause, clauseNamedParameters, err := SearchCodeToWhereClause(searchParameter, searchParameterValueOperatorOR, fmt.Sprintf("%d_%d", ndxANDlevel, ndxORlevel))
-				if err != nil {
-					return nil, err
-				}
-				//add generated where clause to the list, and add the named parameters to the map of existing named parameters
-				whereORClauses = append(whereORClauses, whereORClause)
-				maps.Copy(whereNamedParameters, clauseNamedParameters)
-			}
-			whereClauses = append(whereClauses, fmt.Sprintf("(%s)", strings.Join(whereORClauses, " OR ")))
-		}
-
-		fromClause, err := SearchCodeToFromClause(searchParameter)
+		searchParameterWhereClauses, fromClause, clauseNamedParameters, err := searchParameterToClauses(dialect, TABLE_ALIAS, searchParameter, searchParamCodeValueOrValuesWithPrefix, "")
 		if err != nil {
 			return nil, err
 		}
+		whereClauses = append(whereClauses, searchParameterWhereClauses...)
+		maps.Copy(whereNamedParameters, clauseNamedParameters)
 		if len(fromClause) > 0 {
 			fromClauses = append(fromClauses, fromClause)
 		}
@@ -146,7 +251,27 @@ func (gr *GormRepository) sqlQueryResources(ctx context.Context, query models.Qu
 	//defaults
 	selectClauses := []string{fmt.Sprintf("%s.*", TABLE_ALIAS)}
 	groupClause := fmt.Sprintf("%s.id", TABLE_ALIAS)
-	orderClause := fmt.Sprintf("%s.sort_date DESC", TABLE_ALIAS)
+	orderClause := paginationOrderClause(fmt.Sprintf("%s.sort_date", TABLE_ALIAS), fmt.Sprintf("%s.id", TABLE_ALIAS), true)
+	if len(query.Sort) > 0 {
+		//only simple search parameters are stored in a single (sortable) column
+		orderClauses := []string{}
+		for _, sortParam := range query.Sort {
+			sortParameter, err := ProcessSearchParameter(strings.TrimPrefix(sortParam, "-"), searchCodeToTypeLookup)
+			if err != nil {
+				return nil, err
+			}
+			if len(sortParameter.Modifier) > 0 || !slices.Contains([]SearchParameterType{SearchParameterTypeNumber, SearchParameterTypeDate, SearchParameterTypeUri, SearchParameterTypeKeyword}, sortParameter.Type) {
+				return nil, errors.QueryValidationErrorf("cannot sort by %s, only number, date, uri and keyword search parameters are supported", sortParam)
+			}
+			sortDirection := "ASC"
+			if strings.HasPrefix(sortParam, "-") {
+				sortDirection = "DESC"
+			}
+			orderClauses = append(orderClauses, fmt.Sprintf("%s %s NULLS LAST", sqlTableColumn(dialect, TABLE_ALIAS, sortParameter.Name), sortDirection))
+		}
+		//the id ensures the order is stable between pages
+		orderClause = strings.Join(append(orderClauses, fmt.Sprintf("%s.id ASC", TABLE_ALIAS)), ", ")
+	}
 	if query.Aggregations != nil {
 
 		//Handle Aggregations
@@ -174,7 +299,7 @@ func (gr *GormRepository) sqlQueryResources(ctx context.Context, query models.Qu
 				if err != nil {
 					return nil, err
 				}
-				orderAggregationFromClause, err := SearchCodeToFromClause(orderAggregationParam.SearchParameter)
+				orderAggregationFromClause, err := searchCodeToFromClause(dialect, TABLE_ALIAS, orderAggregationParam.SearchParameter)
 				if err != nil {
 					return nil, err
 				}
@@ -185,7 +310,7 @@ func (gr *GormRepository) sqlQueryResources(ctx context.Context, query models.Qu
 					orderAsc = false
 				}
 
-				orderClause = AggregationParameterToClause(orderAggregationParam)
+				orderClause = aggregationParameterToClause(dialect, orderAggregationParam)
 				if orderAsc {
 					orderClause = fmt.Sprintf("%s ASC", orderClause)
 				} else {
@@ -202,13 +327,13 @@ func (gr *GormRepository) sqlQueryResources(ctx context.Context, query models.Qu
 			if err != nil {
 				return nil, err
 			}
-			groupAggregationFromClause, err := SearchCodeToFromClause(groupAggregationParam.SearchParameter)
+			groupAggregationFromClause, err := searchCodeToFromClause(dialect, TABLE_ALIAS, groupAggregationParam.SearchParameter)
 			if err != nil {
 				return nil, err
 			}
 			fromClauses = append(fromClauses, groupAggregationFromClause)
 
-			groupClause = AggregationParameterToClause(groupAggregationParam)
+			groupClause = aggregationParameterToClause(dialect, groupAggregationParam)
 			selectClauses = []string{
 				fmt.Sprintf("%s as %s", groupClause, "label"),
 			}
@@ -223,11 +348,52 @@ func (gr *GormRepository) sqlQueryResources(ctx context.Context, query models.Qu
 					return nil, err
 				}
 
-				orderSelectClause := AggregationParameterToClause(orderAggregationParam)
+				orderSelectClause := aggregationParameterToClause(dialect, orderAggregationParam)
 				selectClauses = append(selectClauses, fmt.Sprintf("%s as %s", orderSelectClause, "value"))
+
+				//quantity values may be recorded in different units, so they're either converted to the requested unit or grouped by unit (see ucumUnits)
+				if isUnitAwareAggregationParameter(orderAggregationParam) {
+					if len(orderAggregationParam.Unit) > 0 {
+						//unit has been validated against the ucumUnits allow-list
+						selectClauses = append(selectClauses, fmt.Sprintf("'%s' as %s", orderAggregationParam.Unit, "unit"))
+					} else {
+						unitClause := sqlQuantityUnit(dialect, fmt.Sprintf("%sJson", orderAggregationParam.Name))
+						selectClauses = append(selectClauses, fmt.Sprintf("%s as %s", unitClause, "unit"))
+						groupClause = fmt.Sprintf("%s, %s", groupClause, unitClause)
+					}
+				}
 			}
 
+			//date buckets are a time series, so they are always returned in chronological order
+			if len(groupAggregationParam.Bucket) > 0 {
+				orderClause = fmt.Sprintf("%s ASC", groupClause)
+			}
+
+			//process series by clause, which is a secondary group by clause (eg. encounters per month by class)
+			if query.Aggregations.SeriesBy != nil {
+				seriesAggregationParam, err := ProcessAggregationParameter(*query.Aggregations.SeriesBy, searchCodeToTypeLookup)
+				if err != nil {
+					return nil, err
+				}
+				seriesAggregationFromClause, err := searchCodeToFromClause(dialect, TABLE_ALIAS, seriesAggregationParam.SearchParameter)
+				if err != nil {
+					return nil, err
+				}
+				fromClauses = append(fromClauses, seriesAggregationFromClause)
+
+				seriesClause := aggregationParameterToClause(dialect, seriesAggregationParam)
+				selectClauses = append(selectClauses, fmt.Sprintf("%s as %s", seriesClause, "series"))
+				groupClause = fmt.Sprintf("%s, %s", groupClause, seriesClause)
+				orderClause = fmt.Sprintf("%s, %s ASC", orderClause, seriesClause)
+			}
+		}
+	} else if len(query.Select) > 0 {
+		//project the requested search parameters (or the raw resource, if FHIRPath expressions are used), see selectRowsToResults
+		selectParameters, err := ProcessSelectParameters(query.Select, searchCodeToTypeLookup)
+		if err != nil {
+			return nil, err
 		}
+		selectClauses = selectParametersToClauses(dialect, selectParameters)
 	}
 
 	//ensure Where and From clauses are unique
@@ -246,6 +412,16 @@ func (gr *GormRepository) sqlQueryResources(ctx context.Context, query models.Qu
 		Order(orderClause).
 		Table(strings.Join(fromClauses, ", "))
 
+	//resources after the cursor (returned as `next` with the previous page), see paginationCursorClause
+	if len(query.Cursor) > 0 {
+		cursor, err := decodePaginationCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		cursorClause, cursorParameters := paginationCursorClause(fmt.Sprintf("%s.sort_date", TABLE_ALIAS), fmt.Sprintf("%s.id", TABLE_ALIAS), true, cursor)
+		sqlQuery = sqlQuery.Where(cursorClause, cursorParameters...)
+	}
+
 	//add limit and offset clauses if present
 	if query.Limit != nil {
 		sqlQuery = sqlQuery.Limit(*query.Limit)
@@ -257,6 +433,39 @@ func (gr *GormRepository) sqlQueryResources(ctx context.Context, query models.Qu
 	return sqlQuery, nil
 }
 
+// searchParameterToClauses generates the where clauses (which should be AND'd together) and the (optional) from clause
+// required to filter the resources in tableAlias by a search parameter and its value(s)
+// namedParameterPrefix is used to ensure named parameters are unique when the same search parameter is used in multiple (sub)queries
+func searchParameterToClauses(dialect pkg.DatabaseRepositoryType, tableAlias string, searchParameter SearchParameter, searchParamCodeValueOrValuesWithPrefix interface{}, namedParameterPrefix string) ([]string, string, map[string]interface{}, error) {
+	whereClauses := []string{}
+	whereNamedParameters := map[string]interface{}{}
+
+	searchParameterValueOperatorTree, err := ProcessSearchParameterValueIntoOperatorTree(searchParameter, searchParamCodeValueOrValuesWithPrefix)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	for ndxANDlevel, searchParameterValueOperatorAND := range searchParameterValueOperatorTree {
+		whereORClauses := []string{}
+		for ndxORlevel, searchParameterValueOperatorOR := range searchParameterValueOperatorAND {
+			whereORClause, clauseNamedParameters, err := searchCodeToWhereClause(dialect, tableAlias, searchParameter, searchParameterValueOperatorOR, fmt.Sprintf("%s%d_%d", namedParameterPrefix, ndxANDlevel, ndxORlevel))
+			if err != nil {
+				return nil, "", nil, err
+			}
+			//add generated where clause to the list, and add the named parameters to the map of existing named parameters
+			whereORClauses = append(whereORClauses, whereORClause)
+			maps.Copy(whereNamedParameters, clauseNamedParameters)
+		}
+		whereClauses = append(whereClauses, fmt.Sprintf("(%s)", strings.Join(whereORClauses, " OR ")))
+	}
+
+	fromClause, err := searchCodeToFromClause(dialect, tableAlias, searchParameter)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return whereClauses, fromClause, whereNamedParameters, nil
+}
+
 /// INTERNAL functionality. These functions are exported for testing, but are not available in the Interface
 //TODO: dont export these, instead use casting to convert the interface to the GormRepository struct, then call ehese functions directly
 
@@ -269,6 +478,8 @@ type SearchParameter struct {
 type AggregationParameter struct {
 	SearchParameter
 	Function string //count, sum, avg, min, max, etc
+	Bucket   string //year, quarter, month, week, day. Only used with date parameters
+	Unit     string //UCUM unit code, see ucumUnits. Only used with numeric aggregations of Quantity values
 }
 
 // Lists in the SearchParameterValueOperatorTree are AND'd together, and items within each SearchParameterValueOperatorTree list are OR'd together
@@ -288,6 +499,11 @@ type SearchParameterValue struct {
 	Prefix          string
 	Value           interface{}
 	SecondaryValues map[string]interface{}
+
+	//number, date and quantity values have an implicit range, based on the precision of the value (RangeHigh is exclusive)
+	//eg. `100` is [99.5, 100.5) and `2023` is [2023-01-01, 2024-01-01). See ProcessSearchParameterValue
+	RangeLow  interface{}
+	RangeHigh interface{}
 }
 
 // SearchParameters are made up of parameter names and modifiers. For example, "name" and "name:exact" are both valid search parameters
@@ -308,14 +524,24 @@ func ProcessSearchParameter(searchCodeWithModifier string, searchParamTypeLookup
 	//next, determine the searchCodeType for this Resource (or throw an error if it is unknown)
 	searchParamTypeStr, searchParamTypeOk := searchParamTypeLookup[searchParameter.Name]
 	if !searchParamTypeOk {
-		return searchParameter, fmt.Errorf("unknown search parameter: %s", searchParameter.Name)
+		return searchParameter, errors.QueryValidationErrorf("unknown search parameter: %s", searchParameter.Name)
 	} else {
 		searchParameter.Type = SearchParameterType(searchParamTypeStr)
 	}
 
-	//if this is a token search parameter with a modifier, we need to throw an error
-	if searchParameter.Type == SearchParameterTypeToken && len(searchParameter.Modifier) > 0 {
-		return searchParameter, fmt.Errorf("token search parameter %s cannot have a modifier", searchParameter.Name)
+	//the `:missing` modifier is supported by all search parameter types (eg. `code:missing=true`)
+	if searchParameter.Modifier == "missing" {
+		return searchParameter, nil
+	}
+
+	//token search parameters only support the `:text` and `:not` modifiers
+	if searchParameter.Type == SearchParameterTypeToken && len(searchParameter.Modifier) > 0 && searchParameter.Modifier != "text" && searchParameter.Modifier != "not" {
+		return searchParameter, errors.QueryValidationErrorf("token search parameter %s has an unsupported modifier: %s", searchParameter.Name, searchParameter.Modifier)
+	}
+
+	//reference search parameters only support a resource type modifier (eg. `subject:Patient`)
+	if searchParameter.Type == SearchParameterTypeReference && len(searchParameter.Modifier) > 0 && !slices.Contains(databaseModel.GetAllowedResourceTypes(), searchParameter.Modifier) {
+		return searchParameter, errors.QueryValidationErrorf("reference search parameter %s has an unknown resource type modifier: %s", searchParameter.Name, searchParameter.Modifier)
 	}
 
 	return searchParameter, nil
@@ -345,7 +571,7 @@ func ProcessSearchParameterValueIntoOperatorTree(searchParameter SearchParameter
 		searchParamCodeValuesWithPrefix = v
 		break
 	default:
-		return nil, fmt.Errorf("invalid search parameter value type %T, must be a string or a list of strings (%s=%v)", v, searchParameter.Name, searchParamCodeValueOrValuesWithPrefix)
+		return nil, errors.QueryValidationErrorf("invalid search parameter value type %T, must be a string or a list of strings (%s=%v)", v, searchParameter.Name, searchParamCodeValueOrValuesWithPrefix)
 	}
 
 	//generate a SearchParameterValueOperatorTree, because we may have multiple OR and AND operators for the same search parameter.
@@ -379,8 +605,18 @@ func ProcessSearchParameterValue(searchParameter SearchParameter, searchValueWit
 		SecondaryValues: map[string]interface{}{},
 		Value:           searchValueWithPrefix,
 	}
+
+	//the `:missing` modifier is always followed by a boolean, regardless of the search parameter type
+	if searchParameter.Modifier == "missing" {
+		if searchValueWithPrefix != "true" && searchValueWithPrefix != "false" {
+			return searchParameterValue, errors.QueryValidationErrorf("invalid search parameter value, :missing must be true or false: (%s=%s)", searchParameter.Name, searchValueWithPrefix)
+		}
+		searchParameterValue.Value = searchValueWithPrefix == "true"
+		return searchParameterValue, nil
+	}
+
 	if (searchParameter.Type == SearchParameterTypeString || searchParameter.Type == SearchParameterTypeUri || searchParameter.Type == SearchParameterTypeKeyword) && len(searchParameterValue.Value.(string)) == 0 {
-		return searchParameterValue, fmt.Errorf("invalid search parameter value: (%s=%s)", searchParameter.Name, searchParameterValue.Value)
+		return searchParameterValue, errors.QueryValidationErrorf("invalid search parameter value: (%s=%s)", searchParameter.Name, searchParameterValue.Value)
 	}
 
 	//certain types (like number,date and quanitty have a prefix that needs to be parsed)
@@ -414,54 +650,185 @@ func ProcessSearchParameterValue(searchParameter SearchParameter, searchValueWit
 				searchParameterValue.SecondaryValues[searchParameter.Name+"Code"] = searchParameterValueParts[2]
 			}
 		}
+	} else if searchParameter.Type == SearchParameterTypeToken && searchParameter.Modifier == "text" {
+		//`:text` searches the display text of the token, which may contain a "|"
+		if len(searchParameterValue.Value.(string)) == 0 {
+			return searchParameterValue, errors.QueryValidationErrorf("invalid search parameter value: (%s=%s)", searchParameter.Name, searchParameterValue.Value)
+		}
 	} else if searchParameter.Type == SearchParameterTypeToken {
 		if searchParameterValueParts := strings.SplitN(searchParameterValue.Value.(string), "|", 2); len(searchParameterValueParts) == 1 {
 			searchParameterValue.Value = searchParameterValueParts[0] //this is a code
 			if len(searchParameterValue.Value.(string)) == 0 {
-				return searchParameterValue, fmt.Errorf("invalid search parameter value: (%s=%s)", searchParameter.Name, searchParameterValue.Value)
+				return searchParameterValue, errors.QueryValidationErrorf("invalid search parameter value: (%s=%s)", searchParameter.Name, searchParameterValue.Value)
 			}
 		} else if len(searchParameterValueParts) == 2 {
 			//if theres 2 parts, first is always system, second is always the code. Either one may be emty. If both are emty this is invalid.
 			searchParameterValue.SecondaryValues[searchParameter.Name+"System"] = searchParameterValueParts[0]
 			searchParameterValue.Value = searchParameterValueParts[1]
 			if len(searchParameterValueParts[0]) == 0 && len(searchParameterValueParts[1]) == 0 {
-				return searchParameterValue, fmt.Errorf("invalid search parameter value: (%s=%s)", searchParameter.Name, searchParameterValue.Value)
+				return searchParameterValue, errors.QueryValidationErrorf("invalid search parameter value: (%s=%s)", searchParameter.Name, searchParameterValue.Value)
 			}
 		}
 	} else if searchParameter.Type == SearchParameterTypeReference {
-		//todo
-		return searchParameterValue, fmt.Errorf("search parameter type not yet implemented: %s", searchParameter.Type)
+		//references may be specified in multiple forms: https://hl7.org/fhir/r4/search.html#reference
+		// - "Encounter/123" - a relative reference
+		// - "123" - a resource id, with an optional resource type modifier (`encounter:Encounter=123`)
+		// - "http://example.com/fhir/Encounter/123" - an absolute reference (matched exactly)
+		// - "urn:fastenhealth-fhir:{sourceId}:Encounter/123" - a Fasten reference to a resource in a specific source
+		referenceValue := searchParameterValue.Value.(string)
+		if len(referenceValue) == 0 {
+			return searchParameterValue, errors.QueryValidationErrorf("invalid search parameter value: (%s=%s)", searchParameter.Name, searchParameterValue.Value)
+		}
+
+		if strings.HasPrefix(referenceValue, sourcePkg.FASTENHEALTH_URN_PREFIX) {
+			referenceSourceId, referenceResourceType, referenceResourceId, err := sourcePkg.ParseReferenceUri(&referenceValue)
+			if err != nil {
+				return searchParameterValue, errors.QueryValidationErrorf("invalid search parameter value (%s=%s): %w", searchParameter.Name, searchParameterValue.Value, err)
+			}
+			searchParameterValue.Value = fmt.Sprintf("%s/%s", referenceResourceType, referenceResourceId)
+			searchParameterValue.SecondaryValues[searchParameter.Name+"SourceId"] = referenceSourceId
+		} else if len(searchParameter.Modifier) > 0 && !strings.Contains(referenceValue, "/") {
+			//type modifier, convert the id into a relative reference
+			searchParameterValue.Value = fmt.Sprintf("%s/%s", searchParameter.Modifier, referenceValue)
+		}
+
+		//ensure the resource type modifier matches the reference
+		if len(searchParameter.Modifier) > 0 && !strings.HasPrefix(searchParameterValue.Value.(string), searchParameter.Modifier+"/") {
+			return searchParameterValue, errors.QueryValidationErrorf("invalid search parameter value, reference does not match type modifier %s: (%s=%s)", searchParameter.Modifier, searchParameter.Name, referenceValue)
+		}
 	}
 
 	//certain types (Quantity and Number) need to be converted to Float64
 	if searchParameter.Type == SearchParameterTypeQuantity || searchParameter.Type == SearchParameterTypeNumber {
-		if conv, err := strconv.ParseFloat(searchParameterValue.Value.(string), 64); err == nil {
+		numberStr := searchParameterValue.Value.(string)
+		if conv, err := strconv.ParseFloat(numberStr, 64); err == nil {
 			searchParameterValue.Value = conv
 		} else {
-			return searchParameterValue, fmt.Errorf("invalid search parameter value (NaN): (%s=%s)", searchParameter.Name, searchParameterValue.Value)
+			return searchParameterValue, errors.QueryValidationErrorf("invalid search parameter value (NaN): (%s=%s)", searchParameter.Name, numberStr)
+		}
+		rangeLow, rangeHigh, err := searchParameterNumberRange(numberStr, searchParameterValue.Prefix == "ap")
+		if err != nil {
+			return searchParameterValue, errors.QueryValidationErrorf("invalid search parameter value (NaN): (%s=%s)", searchParameter.Name, numberStr)
 		}
+		searchParameterValue.RangeLow = rangeLow
+		searchParameterValue.RangeHigh = rangeHigh
 	} else if searchParameter.Type == SearchParameterTypeDate {
 		//other types (like date) need to be converted to a time.Time
-		if conv, err := time.Parse(time.RFC3339, searchParameterValue.Value.(string)); err == nil {
-			searchParameterValue.Value = conv
-		} else {
-			// fallback to parsing just a date (without time)
-			if conv, err := time.Parse("2006-01-02", searchParameterValue.Value.(string)); err == nil {
-				searchParameterValue.Value = conv
-			} else {
-				return searchParameterValue, fmt.Errorf("invalid search parameter value (invalid date): (%s=%s)", searchParameter.Name, searchParameterValue.Value)
+		dateStr := searchParameterValue.Value.(string)
+		rangeLow, rangeHigh, err := SearchParameterDateRange(dateStr)
+		if err != nil {
+			return searchParameterValue, errors.QueryValidationErrorf("invalid search parameter value (invalid date): (%s=%s)", searchParameter.Name, dateStr)
+		}
+		searchParameterValue.Value = rangeLow
+
+		if searchParameterValue.Prefix == "ap" {
+			//approximately, widen the range by 10% of the gap between now and the date
+			gap := time.Since(rangeLow)
+			if gap < 0 {
+				gap = -gap
 			}
+			rangeLow, rangeHigh = rangeLow.Add(-gap/10), rangeHigh.Add(gap/10)
 		}
+		searchParameterValue.RangeLow = rangeLow
+		searchParameterValue.RangeHigh = rangeHigh
 	}
 	return searchParameterValue, nil
 }
 
+// searchParameterNumberRange returns the implicit range of a number search value, based on its precision
+// eg. `100` is [99.5, 100.5), `100.00` is [99.995, 100.005) and `1e2` is [50, 150)
+// approximately (`ap`) widens the range by 10% of the value
+//
+// see https://hl7.org/fhir/r4/search.html#number
+func searchParameterNumberRange(numberStr string, approximate bool) (float64, float64, error) {
+	value, ok := new(big.Rat).SetString(numberStr)
+	if !ok {
+		return 0, 0, errors.QueryValidationErrorf("invalid number: %s", numberStr)
+	}
+
+	//the precision is the last digit of the mantissa, shifted by the exponent
+	mantissa, exponentStr, hasExponent := strings.Cut(strings.ToLower(numberStr), "e")
+	exponent := 0
+	if hasExponent {
+		var err error
+		if exponent, err = strconv.Atoi(exponentStr); err != nil {
+			return 0, 0, errors.QueryValidationErrorf("invalid number: %s", numberStr)
+		}
+	}
+	if _, decimals, hasDecimals := strings.Cut(mantissa, "."); hasDecimals {
+		exponent -= len(decimals)
+	}
+
+	//half of the last digit, eg. 0.5 for `100` or 0.005 for `100.00`
+	halfPrecision := big.NewRat(1, 2)
+	if exponent >= 0 {
+		halfPrecision.Mul(halfPrecision, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil)))
+	} else {
+		halfPrecision.Quo(halfPrecision, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-exponent)), nil)))
+	}
+	if approximate {
+		halfPrecision.Add(halfPrecision, new(big.Rat).Quo(new(big.Rat).Abs(value), big.NewRat(10, 1)))
+	}
+
+	rangeLow, _ := new(big.Rat).Sub(value, halfPrecision).Float64()
+	rangeHigh, _ := new(big.Rat).Add(value, halfPrecision).Float64()
+	return rangeLow, rangeHigh, nil
+}
+
+// SearchParameterDateRange returns the implicit range of a date search value, based on its precision
+// eg. `2023` is [2023-01-01, 2024-01-01), `2023-02` is [2023-02-01, 2023-03-01) and `2023-02-03T10:00:00Z` is [10:00:00, 10:00:01)
+//
+// see https://hl7.org/fhir/r4/search.html#date
+func SearchParameterDateRange(dateStr string) (time.Time, time.Time, error) {
+	if conv, err := time.Parse(time.RFC3339, dateStr); err == nil {
+		//the most precise part of a dateTime is the (fractional) seconds
+		precision := time.Second
+		if _, fraction, hasFraction := strings.Cut(dateStr, "."); hasFraction {
+			fractionDigits := strings.IndexFunc(fraction, func(r rune) bool { return r < '0' || r > '9' })
+			if fractionDigits < 0 {
+				fractionDigits = len(fraction)
+			}
+			for i := 0; i < fractionDigits && precision > time.Nanosecond; i++ {
+				precision /= 10
+			}
+		}
+		return conv, conv.Add(precision), nil
+	} else if conv, err := time.Parse("2006-01-02", dateStr); err == nil {
+		return conv, conv.AddDate(0, 0, 1), nil
+	} else if conv, err := time.Parse("2006-01", dateStr); err == nil {
+		return conv, conv.AddDate(0, 1, 0), nil
+	} else if conv, err := time.Parse("2006", dateStr); err == nil {
+		return conv, conv.AddDate(1, 0, 0), nil
+	}
+	return time.Time{}, time.Time{}, errors.QueryValidationErrorf("invalid date: %s", dateStr)
+}
+
 func NamedParameterWithSuffix(parameterName string, suffix string) string {
 	return fmt.Sprintf("%s_%s", parameterName, suffix)
 }
 
 // SearchCodeToWhereClause converts a searchCode and searchCodeValue to a where clause and a map of named parameters
+// The generated clause uses the SQLite dialect, see searchCodeToWhereClause
 func SearchCodeToWhereClause(searchParam SearchParameter, searchParamValue SearchParameterValue, namedParameterSuffix string) (string, map[string]interface{}, error) {
+	return searchCodeToWhereClause(pkg.DatabaseRepositoryTypeSqlite, TABLE_ALIAS, searchParam, searchParamValue, namedParameterSuffix)
+}
+
+func searchCodeToWhereClause(dialect pkg.DatabaseRepositoryType, tableAlias string, searchParam SearchParameter, searchParamValue SearchParameterValue, namedParameterSuffix string) (string, map[string]interface{}, error) {
+
+	//`:missing` checks if the column is populated, complex search parameters store an empty json array (or null) when missing
+	if searchParam.Modifier == "missing" {
+		column := sqlTableColumn(dialect, tableAlias, searchParam.Name)
+		missing, _ := searchParamValue.Value.(bool)
+		if slices.Contains(complexSearchParameterTypes, searchParam.Type) {
+			if missing {
+				return fmt.Sprintf("(%s IS NULL OR %s IN ('null', '[]'))", column, column), map[string]interface{}{}, nil
+			}
+			return fmt.Sprintf("(%s IS NOT NULL AND %s NOT IN ('null', '[]'))", column, column), map[string]interface{}{}, nil
+		} else if missing {
+			return fmt.Sprintf("(%s IS NULL)", column), map[string]interface{}{}, nil
+		}
+		return fmt.Sprintf("(%s IS NOT NULL)", column), map[string]interface{}{}, nil
+	}
 
 	//add named parameters to the lookup map. Basically, this is a map of all the named parameters that will be used in the where clause we're generating
 	searchClauseNamedParams := map[string]interface{}{
@@ -471,37 +838,30 @@ func SearchCodeToWhereClause(searchParam SearchParameter, searchParamValue Searc
 		searchClauseNamedParams[NamedParameterWithSuffix(k, namedParameterSuffix)] = v
 	}
 
+	//the json alias generated by searchCodeToFromClause
+	searchParamJsonAlias := fmt.Sprintf("%sJson", searchParam.Name)
+
 	//parse the searchCode and searchCodeValue to determine the correct where clause
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	//SIMPLE SEARCH PARAMETERS
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	switch searchParam.Type {
 	case SearchParameterTypeNumber, SearchParameterTypeDate:
-
-		if searchParamValue.Prefix == "" || searchParamValue.Prefix == "eq" {
-			return fmt.Sprintf("(%s = @%s)", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
-		} else if searchParamValue.Prefix == "lt" || searchParamValue.Prefix == "eb" {
-			return fmt.Sprintf("(%s < @%s)", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
-		} else if searchParamValue.Prefix == "le" {
-			return fmt.Sprintf("(%s <= @%s)", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
-		} else if searchParamValue.Prefix == "gt" || searchParamValue.Prefix == "sa" {
-			return fmt.Sprintf("(%s > @%s)", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
-		} else if searchParamValue.Prefix == "ge" {
-			return fmt.Sprintf("(%s >= @%s)", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
-		} else if searchParamValue.Prefix == "ne" {
-			return fmt.Sprintf("(%s <> @%s)", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
-		} else if searchParam.Modifier == "ap" {
-			return "", nil, fmt.Errorf("search modifier 'ap' not supported for search parameter type %s (%s=%s)", searchParam.Type, searchParam.Name, searchParamValue.Value)
+		clause, err := rangeSearchParameterClause(sqlTableColumn(dialect, tableAlias, searchParam.Name), searchParam, searchParamValue, namedParameterSuffix, searchClauseNamedParams)
+		if err != nil {
+			return "", nil, err
 		}
+		return fmt.Sprintf("(%s)", clause), searchClauseNamedParams, nil
 
 	case SearchParameterTypeUri:
 		if searchParam.Modifier == "" {
-			return fmt.Sprintf("(%s = @%s)", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
+			return fmt.Sprintf("(%s = @%s)", sqlTableColumn(dialect, tableAlias, searchParam.Name), NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
 		} else if searchParam.Modifier == "below" {
 			searchClauseNamedParams[NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)] = searchParamValue.Value.(string) + "%" // column starts with "http://example.com"
-			return fmt.Sprintf("(%s LIKE @%s)", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
+			return fmt.Sprintf("(%s LIKE @%s)", sqlTableColumn(dialect, tableAlias, searchParam.Name), NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
 		} else if searchParam.Modifier == "above" {
-			return "", nil, fmt.Errorf("search modifier 'above' not supported for search parameter type %s (%s=%s)", searchParam.Type, searchParam.Name, searchParamValue.Value)
+			// "http://example.com/fhir/ValueSet/123" matches columns which it starts with, eg. "http://example.com/fhir/"
+			return fmt.Sprintf("(@%s LIKE %s || '%%')", NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix), sqlTableColumn(dialect, tableAlias, searchParam.Name)), searchClauseNamedParams, nil
 		}
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	//COMPLEX SEARCH PARAMETERS
@@ -509,33 +869,20 @@ func SearchCodeToWhereClause(searchParam SearchParameter, searchParamValue Searc
 	case SearchParameterTypeString:
 		if searchParam.Modifier == "" {
 			searchClauseNamedParams[NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)] = searchParamValue.Value.(string) + "%" // "eve" matches "Eve" and "Evelyn"
-			return fmt.Sprintf("(%sJson.value LIKE @%s)", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
+			return fmt.Sprintf("(%s LIKE @%s)", sqlJsonValue(dialect, searchParamJsonAlias), NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
 		} else if searchParam.Modifier == "exact" {
 			// "eve" matches "eve" (not "Eve" or "EVE")
-			return fmt.Sprintf("(%sJson.value = @%s)", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
+			return fmt.Sprintf("(%s = @%s)", sqlJsonValue(dialect, searchParamJsonAlias), NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
 		} else if searchParam.Modifier == "contains" {
 			searchClauseNamedParams[NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)] = "%" + searchParamValue.Value.(string) + "%" // "eve" matches "Eve", "Evelyn" and "Severine"
-			return fmt.Sprintf("(%sJson.value LIKE @%s)", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
+			return fmt.Sprintf("(%s LIKE @%s)", sqlJsonValue(dialect, searchParamJsonAlias), NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
 		}
 	case SearchParameterTypeQuantity:
 
 		//setup the clause
-		var clause string
-		if searchParamValue.Prefix == "" || searchParamValue.Prefix == "eq" {
-			//TODO: when no prefix is specified, we need to search using BETWEEN (+/- 0.05)
-			clause = fmt.Sprintf("%sJson.value ->> '$.value' = @%s", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix))
-		} else if searchParamValue.Prefix == "lt" || searchParamValue.Prefix == "eb" {
-			clause = fmt.Sprintf("%sJson.value ->> '$.value' < @%s", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix))
-		} else if searchParamValue.Prefix == "le" {
-			clause = fmt.Sprintf("%sJson.value ->> '$.value' <= @%s", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix))
-		} else if searchParamValue.Prefix == "gt" || searchParamValue.Prefix == "sa" {
-			clause = fmt.Sprintf("%sJson.value ->> '$.value' > @%s", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix))
-		} else if searchParamValue.Prefix == "ge" {
-			clause = fmt.Sprintf("%sJson.value ->> '$.value' >= @%s", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix))
-		} else if searchParamValue.Prefix == "ne" {
-			clause = fmt.Sprintf("%sJson.value ->> '$.value' <> @%s", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix))
-		} else if searchParamValue.Prefix == "ap" {
-			return "", nil, fmt.Errorf("search modifier 'ap' not supported for search parameter type %s (%s=%s)", searchParam.Type, searchParam.Name, searchParamValue.Value)
+		clause, err := rangeSearchParameterClause(sqlJsonExtractNumeric(dialect, searchParamJsonAlias, "value"), searchParam, searchParamValue, namedParameterSuffix, searchClauseNamedParams)
+		if err != nil {
+			return "", nil, err
 		}
 
 		//append the code and/or system clauses (if required)
@@ -545,7 +892,7 @@ func SearchCodeToWhereClause(searchParam SearchParameter, searchParamValue Searc
 		for _, k := range allowedSecondaryKeys {
 			namedParameterKey := fmt.Sprintf("%s%s", searchParam.Name, strings.Title(k))
 			if _, ok := searchParamValue.SecondaryValues[namedParameterKey]; ok {
-				clause += fmt.Sprintf(` AND %sJson.value ->> '$.%s' = @%s`, searchParam.Name, k, NamedParameterWithSuffix(namedParameterKey, namedParameterSuffix))
+				clause += fmt.Sprintf(` AND %s = @%s`, sqlJsonExtract(dialect, searchParamJsonAlias, k), NamedParameterWithSuffix(namedParameterKey, namedParameterSuffix))
 			}
 		}
 
@@ -569,12 +916,16 @@ func SearchCodeToWhereClause(searchParam SearchParameter, searchParamValue Searc
 		// - uri - https://hl7.org/fhir/r4/datatypes.html#uri
 		// - string - https://hl7.org/fhir/r4/datatypes.html#string
 
-		//TODO: support ":text" modifier
+		//`:text` searches the display text of the token, eg. `code:text=weight` matches "Body Weight"
+		if searchParam.Modifier == "text" {
+			searchClauseNamedParams[NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)] = "%" + searchParamValue.Value.(string) + "%"
+			return fmt.Sprintf("(%s LIKE @%s)", sqlJsonExtract(dialect, searchParamJsonAlias, "text"), NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
+		}
 
 		//setup the clause
 		clause := []string{}
 		if searchParamValue.Value.(string) != "" {
-			clause = append(clause, fmt.Sprintf("%sJson.value ->> '$.code' = @%s", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)))
+			clause = append(clause, fmt.Sprintf("%s = @%s", sqlJsonExtract(dialect, searchParamJsonAlias, "code"), NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)))
 		}
 
 		//append the code and/or system clauses (if required)
@@ -584,53 +935,169 @@ func SearchCodeToWhereClause(searchParam SearchParameter, searchParamValue Searc
 		for _, k := range allowedSecondaryKeys {
 			namedParameterKey := fmt.Sprintf("%s%s", searchParam.Name, strings.Title(k))
 			if _, ok := searchParamValue.SecondaryValues[namedParameterKey]; ok {
-				clause = append(clause, fmt.Sprintf(`%sJson.value ->> '$.%s' = @%s`, searchParam.Name, k, NamedParameterWithSuffix(namedParameterKey, namedParameterSuffix)))
+				clause = append(clause, fmt.Sprintf(`%s = @%s`, sqlJsonExtract(dialect, searchParamJsonAlias, k), NamedParameterWithSuffix(namedParameterKey, namedParameterSuffix)))
 			}
 		}
+
+		//`:not` matches resources without a matching token (including resources without any tokens), so the json array
+		//is expanded in a subquery rather than the FROM clause (see searchCodeToFromClause)
+		if searchParam.Modifier == "not" {
+			return fmt.Sprintf("(NOT EXISTS (SELECT 1 FROM %s WHERE %s))", sqlJsonEach(dialect, tableAlias, searchParam.Name, searchParamJsonAlias), strings.Join(clause, " AND ")), searchClauseNamedParams, nil
+		}
 		return fmt.Sprintf("(%s)", strings.Join(clause, " AND ")), searchClauseNamedParams, nil
 
 	case SearchParameterTypeKeyword:
 		//setup the clause
-		return fmt.Sprintf("(%s = @%s)", searchParam.Name, NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
+		if searchParam.Modifier == "not" {
+			return fmt.Sprintf("(%s <> @%s OR %s IS NULL)", sqlTableColumn(dialect, tableAlias, searchParam.Name), NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix), sqlTableColumn(dialect, tableAlias, searchParam.Name)), searchClauseNamedParams, nil
+		}
+		return fmt.Sprintf("(%s = @%s)", sqlTableColumn(dialect, tableAlias, searchParam.Name), NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)), searchClauseNamedParams, nil
 	case SearchParameterTypeReference:
-		return "", nil, fmt.Errorf("search parameter type %s not supported", searchParam.Type)
+		//references are extracted (by extractReferenceSearchParameters) as a list of Reference datatypes
+		// https://hl7.org/fhir/r4/references.html#Reference
+		// {
+		//   "reference": "Encounter/123",
+		//   "type": "Encounter",
+		//   "display": "example display"
+		// }
+		//
+		// the search value has already been normalized by ProcessSearchParameterValue
+		// - "Encounter/123" (or "123" with a ":Encounter" modifier) must match the reference exactly
+		// - "123" matches any reference to a resource with this id
+		// - "urn:fastenhealth-fhir:{sourceId}:Encounter/123" matches the urn reference, or a relative "Encounter/123" reference from the same source
+		referenceColumn := sqlJsonExtract(dialect, searchParamJsonAlias, "reference")
+		referenceParamName := NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)
+
+		referenceSourceIdKey := fmt.Sprintf("%sSourceId", searchParam.Name)
+		if _, ok := searchParamValue.SecondaryValues[referenceSourceIdKey]; ok {
+			referenceUrnParamName := NamedParameterWithSuffix(fmt.Sprintf("%sUrn", searchParam.Name), namedParameterSuffix)
+			searchClauseNamedParams[referenceUrnParamName] = fmt.Sprintf("%s%s:%s", sourcePkg.FASTENHEALTH_URN_PREFIX, searchParamValue.SecondaryValues[referenceSourceIdKey], searchParamValue.Value)
+
+			return fmt.Sprintf("(%s = @%s OR (%s = @%s AND %s = @%s))",
+				referenceColumn, referenceUrnParamName,
+				referenceColumn, referenceParamName,
+				sqlTableColumn(dialect, tableAlias, "source_id"), NamedParameterWithSuffix(referenceSourceIdKey, namedParameterSuffix),
+			), searchClauseNamedParams, nil
+		} else if !strings.Contains(searchParamValue.Value.(string), "/") {
+			//this is just a resource id, it should match any resource type
+			referenceIdParamName := NamedParameterWithSuffix(fmt.Sprintf("%sId", searchParam.Name), namedParameterSuffix)
+			searchClauseNamedParams[referenceIdParamName] = "%/" + searchParamValue.Value.(string)
+
+			return fmt.Sprintf("(%s = @%s OR %s LIKE @%s)", referenceColumn, referenceParamName, referenceColumn, referenceIdParamName), searchClauseNamedParams, nil
+		} else {
+			return fmt.Sprintf("(%s = @%s)", referenceColumn, referenceParamName), searchClauseNamedParams, nil
+		}
 	}
 	return "", searchClauseNamedParams, nil
 }
 
+// SearchCodeToFromClause generates the (SQLite dialect) FROM clause required by complex search parameters, see searchCodeToFromClause
 func SearchCodeToFromClause(searchParam SearchParameter) (string, error) {
+	return searchCodeToFromClause(pkg.DatabaseRepositoryTypeSqlite, TABLE_ALIAS, searchParam)
+}
+
+func searchCodeToFromClause(dialect pkg.DatabaseRepositoryType, tableAlias string, searchParam SearchParameter) (string, error) {
 	//complex search parameters (e.g. token, reference, quantities, special) require the use of `json_*` FROM clauses
 
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	//COMPLEX SEARCH PARAMETERS
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	switch searchParam.Type {
-	case SearchParameterTypeQuantity, SearchParameterTypeToken, SearchParameterTypeString:
+	//`:missing` and `:not` do not expand the json array, see searchCodeToWhereClause
+	if searchParam.Modifier == "missing" || (searchParam.Type == SearchParameterTypeToken && searchParam.Modifier == "not") {
+		return "", nil
+	}
+	if slices.Contains(complexSearchParameterTypes, searchParam.Type) {
 		//setup the clause
-		return fmt.Sprintf("json_each(%s.%s) as %sJson", TABLE_ALIAS, searchParam.Name, searchParam.Name), nil
+		return sqlJsonEach(dialect, tableAlias, searchParam.Name, fmt.Sprintf("%sJson", searchParam.Name)), nil
 	}
 	return "", nil
 }
 
+// rangeSearchParameterClause generates the comparison for a number, date or quantity search value.
+// `eq`, `ne` and `ap` compare against the implicit range of the value (see ProcessSearchParameterValue), as do the
+// remaining date prefixes, eg. `gt2023` matches dates on or after 2024-01-01
+// The named parameters required by the comparison are added to searchClauseNamedParams
+func rangeSearchParameterClause(column string, searchParam SearchParameter, searchParamValue SearchParameterValue, namedParameterSuffix string, searchClauseNamedParams map[string]interface{}) (string, error) {
+	valueParamName := NamedParameterWithSuffix(searchParam.Name, namedParameterSuffix)
+	rangeLowParamName := NamedParameterWithSuffix(fmt.Sprintf("%sLow", searchParam.Name), namedParameterSuffix)
+	rangeHighParamName := NamedParameterWithSuffix(fmt.Sprintf("%sHigh", searchParam.Name), namedParameterSuffix)
+
+	//replace the value with the range
+	useRange := func() {
+		delete(searchClauseNamedParams, valueParamName)
+		searchClauseNamedParams[rangeLowParamName] = searchParamValue.RangeLow
+		searchClauseNamedParams[rangeHighParamName] = searchParamValue.RangeHigh
+	}
+	//replace the value with the (exclusive) end of the range
+	useRangeHigh := func() {
+		delete(searchClauseNamedParams, valueParamName)
+		searchClauseNamedParams[rangeHighParamName] = searchParamValue.RangeHigh
+	}
+
+	switch searchParamValue.Prefix {
+	case "", "eq", "ap":
+		useRange()
+		return fmt.Sprintf("%s >= @%s AND %s < @%s", column, rangeLowParamName, column, rangeHighParamName), nil
+	case "ne":
+		useRange()
+		return fmt.Sprintf("(%s < @%s OR %s >= @%s)", column, rangeLowParamName, column, rangeHighParamName), nil
+	case "lt", "eb":
+		return fmt.Sprintf("%s < @%s", column, valueParamName), nil
+	case "ge":
+		return fmt.Sprintf("%s >= @%s", column, valueParamName), nil
+	case "gt", "sa":
+		if searchParam.Type == SearchParameterTypeDate {
+			useRangeHigh()
+			return fmt.Sprintf("%s >= @%s", column, rangeHighParamName), nil
+		}
+		return fmt.Sprintf("%s > @%s", column, valueParamName), nil
+	case "le":
+		if searchParam.Type == SearchParameterTypeDate {
+			useRangeHigh()
+			return fmt.Sprintf("%s < @%s", column, rangeHighParamName), nil
+		}
+		return fmt.Sprintf("%s <= @%s", column, valueParamName), nil
+	}
+	return "", errors.QueryValidationErrorf("search prefix '%s' not supported for search parameter type %s (%s=%v)", searchParamValue.Prefix, searchParam.Type, searchParam.Name, searchParamValue.Value)
+}
+
+// AggregationParameterToClause generates the (SQLite dialect) clause for an aggregation parameter, see aggregationParameterToClause
 func AggregationParameterToClause(aggParameter AggregationParameter) string {
+	return aggregationParameterToClause(pkg.DatabaseRepositoryTypeSqlite, aggParameter)
+}
+
+func aggregationParameterToClause(dialect pkg.DatabaseRepositoryType, aggParameter AggregationParameter) string {
 	var clause string
+	aggParameterJsonAlias := fmt.Sprintf("%sJson", aggParameter.Name)
 
 	switch aggParameter.Type {
-	case SearchParameterTypeQuantity, SearchParameterTypeString:
+	case SearchParameterTypeQuantity, SearchParameterTypeString, SearchParameterTypeReference:
 		//setup the clause
-		clause = fmt.Sprintf("(%sJson.value ->> '$.%s')", aggParameter.Name, aggParameter.Modifier)
+		if isUnitAwareAggregationParameter(aggParameter) && len(aggParameter.Unit) > 0 {
+			clause = fmt.Sprintf("(%s)", sqlQuantityValueInUnit(dialect, aggParameterJsonAlias, aggParameter.Unit))
+		} else if isUnitAwareAggregationParameter(aggParameter) {
+			clause = fmt.Sprintf("(%s)", sqlJsonExtractNumeric(dialect, aggParameterJsonAlias, aggParameter.Modifier))
+		} else {
+			clause = fmt.Sprintf("(%s)", sqlJsonExtract(dialect, aggParameterJsonAlias, aggParameter.Modifier))
+		}
 	case SearchParameterTypeToken:
 		//modifier is optional for token types.
 		if aggParameter.Modifier != "" {
-			clause = fmt.Sprintf("(%sJson.value ->> '$.%s')", aggParameter.Name, aggParameter.Modifier)
+			clause = fmt.Sprintf("(%s)", sqlJsonExtract(dialect, aggParameterJsonAlias, aggParameter.Modifier))
 		} else {
 			//if no modifier is specified, use the system and code to generate the clause
 			//((codeJson.value ->> '$.system') || '|' || (codeJson.value ->> '$.code'))
-			clause = fmt.Sprintf("((%sJson.value ->> '$.system') || '|' || (%sJson.value ->> '$.code'))", aggParameter.Name, aggParameter.Name)
+			clause = fmt.Sprintf("((%s) || '|' || (%s))", sqlJsonExtract(dialect, aggParameterJsonAlias, "system"), sqlJsonExtract(dialect, aggParameterJsonAlias, "code"))
 		}
 
+	case SearchParameterTypeDate:
+		if len(aggParameter.Bucket) > 0 {
+			clause = sqlDateBucket(dialect, TABLE_ALIAS, aggParameter.Name, aggParameter.Bucket)
+		} else {
+			clause = sqlTableColumn(dialect, TABLE_ALIAS, aggParameter.Name)
+		}
 	default:
-		clause = fmt.Sprintf("%s.%s", TABLE_ALIAS, aggParameter.Name)
+		clause = sqlTableColumn(dialect, TABLE_ALIAS, aggParameter.Name)
 	}
 
 	if len(aggParameter.Function) > 0 {
@@ -651,6 +1118,13 @@ func ProcessAggregationParameter(aggregationFieldWithFn models.QueryResourceAggr
 	aggregationParameter := AggregationParameter{
 		SearchParameter: SearchParameter{},
 		Function:        aggregationFieldWithFn.Function,
+		Bucket:          aggregationFieldWithFn.Bucket,
+		Unit:            aggregationFieldWithFn.Unit,
+	}
+
+	//SECURITY: the function is included in the SQL query, so it must be allow-listed
+	if len(aggregationParameter.Function) > 0 && !lo.Contains(models.QueryResourceAggregationFunctions, aggregationParameter.Function) {
+		return aggregationParameter, errors.QueryValidationErrorf("unknown aggregation function: %s", aggregationParameter.Function)
 	}
 
 	//determine the searchCode searchCodeModifier
@@ -666,22 +1140,49 @@ func ProcessAggregationParameter(aggregationFieldWithFn models.QueryResourceAggr
 	//next, determine the searchCodeType for this Resource (or throw an error if it is unknown)
 	searchParamTypeStr, searchParamTypeOk := searchParamTypeLookup[aggregationParameter.Name]
 	if !searchParamTypeOk {
-		return aggregationParameter, fmt.Errorf("unknown search parameter in aggregation: %s", aggregationParameter.Name)
+		return aggregationParameter, errors.QueryValidationErrorf("unknown search parameter in aggregation: %s", aggregationParameter.Name)
 	} else {
 		aggregationParameter.Type = SearchParameterType(searchParamTypeStr)
 	}
 
+	//only date types can be bucketed
+	if len(aggregationParameter.Bucket) > 0 {
+		if aggregationParameter.Type != SearchParameterTypeDate {
+			return aggregationParameter, errors.QueryValidationErrorf("aggregation parameter %s cannot be bucketed, only date parameters support buckets", aggregationParameter.Name)
+		}
+		if _, bucketOk := models.QueryResourceAggregationBuckets[aggregationParameter.Bucket]; !bucketOk {
+			return aggregationParameter, errors.QueryValidationErrorf("unknown bucket '%s' for aggregation parameter %s", aggregationParameter.Bucket, aggregationParameter.Name)
+		}
+	}
+
+	//sum & avg are only meaningful for numeric values, min & max may also be used with dates
+	if aggregationParameter.Function == "sum" || aggregationParameter.Function == "avg" {
+		if !(aggregationParameter.Type == SearchParameterTypeNumber || (aggregationParameter.Type == SearchParameterTypeQuantity && aggregationParameter.Modifier == "value")) {
+			return aggregationParameter, errors.QueryValidationErrorf("aggregation function %s requires a numeric parameter (number or quantity value), not %s", aggregationParameter.Function, aggregationParameter.Name)
+		}
+	}
+
+	//only quantity values can be converted to a unit
+	if len(aggregationParameter.Unit) > 0 {
+		if !isUnitAwareAggregationParameter(aggregationParameter) {
+			return aggregationParameter, errors.QueryValidationErrorf("aggregation parameter %s cannot be converted to a unit, only quantity values aggregated with sum, avg, min or max support units", aggregationParameter.Name)
+		}
+		if _, unitOk := ucumUnits[aggregationParameter.Unit]; !unitOk {
+			return aggregationParameter, errors.QueryValidationErrorf("unsupported unit '%s' for aggregation parameter %s", aggregationParameter.Unit, aggregationParameter.Name)
+		}
+	}
+
 	//primitive types should not have a modifier, we need to throw an error
 	if aggregationParameter.Type == SearchParameterTypeNumber || aggregationParameter.Type == SearchParameterTypeUri || aggregationParameter.Type == SearchParameterTypeKeyword || aggregationParameter.Type == SearchParameterTypeDate {
 		if len(aggregationParameter.Modifier) > 0 {
-			return aggregationParameter, fmt.Errorf("primitive aggregation parameter %s cannot have a property (%s)", aggregationParameter.Name, aggregationParameter.Modifier)
+			return aggregationParameter, errors.QueryValidationErrorf("primitive aggregation parameter %s cannot have a property (%s)", aggregationParameter.Name, aggregationParameter.Modifier)
 		}
 	} else if aggregationParameter.Type == SearchParameterTypeToken {
 		//modifier is optional for token types
 	} else {
 		//complex types must have a modifier
 		if len(aggregationParameter.Modifier) == 0 {
-			return aggregationParameter, fmt.Errorf("complex aggregation parameter %s must have a property", aggregationParameter.Name)
+			return aggregationParameter, errors.QueryValidationErrorf("complex aggregation parameter %s must have a property", aggregationParameter.Name)
 		}
 	}
 	return aggregationParameter, nil
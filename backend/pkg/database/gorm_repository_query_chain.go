@@ -0,0 +1,224 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/errors"
+	databaseModel "github.com/fastenhealth/fasten-onprem/backend/pkg/models/database"
+	sourcePkg "github.com/fastenhealth/fasten-sources/pkg"
+	"github.com/iancoleman/strcase"
+	"golang.org/x/exp/slices"
+)
+
+// Chained and reverse chained search parameters allow resources to be filtered by the properties of the resources they
+// reference (or that reference them): https://hl7.org/fhir/r4/search.html#chaining
+//
+// eg. Chained - Observations whose encounter is an inpatient encounter
+//
+//	"where": {"encounter.class": "IMP"}
+//
+//	SELECT fhir.*
+//	FROM fhir_observation as fhir
+//	WHERE (EXISTS (
+//		SELECT 1
+//		FROM fhir_encounter as encounterClass, json_each(fhir.encounter) as encounterClassReference, json_each(encounterClass.class) as classJson
+//		WHERE (encounterClass.user_id = @user_id)
+//		AND ((encounterClassReference.value ->> '$.reference' = ('Encounter/' || encounterClass.source_resource_id) AND encounterClass.source_id = fhir.source_id) OR ...)
+//		AND ((classJson.value ->> '$.code' = @class_encounterClass_0_0))
+//	))
+//	AND (user_id = @user_id)
+//
+// eg. Reverse Chained - Encounters that have a Condition coded E11
+//
+//	"where": {"_has:Condition:encounter:code": "E11"}
+//
+//	SELECT fhir.*
+//	FROM fhir_encounter as fhir
+//	WHERE (EXISTS (
+//		SELECT 1
+//		FROM fhir_condition as hasConditionEncounterCode, json_each(hasConditionEncounterCode.encounter) as hasConditionEncounterCodeReference, json_each(hasConditionEncounterCode.code) as codeJson
+//		WHERE (hasConditionEncounterCode.user_id = @user_id)
+//		AND ((hasConditionEncounterCodeReference.value ->> '$.reference' = ('Encounter/' || fhir.source_resource_id) AND fhir.source_id = hasConditionEncounterCode.source_id) OR ...)
+//		AND ((codeJson.value ->> '$.code' = @code_hasConditionEncounterCode_0_0))
+//	))
+//	AND (user_id = @user_id)
+//
+// The joined table is correlated with the queried table using an EXISTS subquery (a semi-join) rather than being added
+// to the top level FROM clause, so that resources are not duplicated when multiple joined resources match, and so that
+// aggregations continue to work as expected.
+// SECURITY: every joined table must have its own user_id guard.
+
+// references to these resource types are commonly ambiguous (eg. `subject` may reference a Patient or a Group),
+// however in Fasten they almost always reference the following resource type.
+// Any other resource type must be specified using a type modifier (eg. `subject:Group.name`)
+var chainedSearchParameterDefaultResourceTypes = map[string]string{
+	"subject": "Patient",
+}
+
+type ChainedSearchParameter struct {
+	//the resource type of the table joined by the subquery
+	JoinResourceType string
+	//the reference search parameter which links the two resources.
+	//for chained parameters this is a parameter of the queried resource, for reverse chained parameters (`_has`) its a parameter of the joined resource
+	ReferenceParameter SearchParameter
+	//the search parameter (of the joined resource) used to filter the joined resources
+	JoinSearchParameter SearchParameter
+	Reverse             bool
+
+	//unique alias for the joined table, also used to ensure the named parameters are unique
+	Alias string
+}
+
+// IsChainedSearchParameter returns true if the search code is a chained (`encounter.class`) or reverse chained (`_has:Condition:encounter:code`) search parameter
+func IsChainedSearchParameter(searchCodeWithModifier string) bool {
+	return strings.HasPrefix(searchCodeWithModifier, "_has:") || strings.Contains(searchCodeWithModifier, ".")
+}
+
+// ProcessChainedSearchParameter parses chained and reverse chained search parameters
+//
+// chained search parameters are in the form `{reference}[:{ResourceType}].{parameter}[:{modifier}]`
+// eg. `encounter.class`, `subject:Patient.name:exact`
+//
+// reverse chained search parameters are in the form `_has:{ResourceType}:{reference}:{parameter}[:{modifier}]`
+// eg. `_has:Condition:encounter:code`
+//
+// only a single level of chaining is supported.
+func ProcessChainedSearchParameter(searchCodeWithModifier string, searchParamTypeLookup map[string]string) (ChainedSearchParameter, error) {
+	chainedSearchParameter := ChainedSearchParameter{
+		Alias: chainedSearchParameterAlias(searchCodeWithModifier),
+	}
+
+	var joinSearchCodeWithModifier string
+	if strings.HasPrefix(searchCodeWithModifier, "_has:") {
+		searchCodeParts := strings.SplitN(searchCodeWithModifier, ":", 4)
+		if len(searchCodeParts) != 4 || len(searchCodeParts[1]) == 0 || len(searchCodeParts[2]) == 0 || len(searchCodeParts[3]) == 0 {
+			return chainedSearchParameter, errors.QueryValidationErrorf("invalid reverse chained search parameter %s, must be in the form _has:ResourceType:reference:parameter", searchCodeWithModifier)
+		}
+		chainedSearchParameter.Reverse = true
+		chainedSearchParameter.JoinResourceType = searchCodeParts[1]
+
+		//SECURITY: the join resource type is controlled by the user, and is used to generate the table name
+		if !slices.Contains(databaseModel.GetAllowedResourceTypes(), chainedSearchParameter.JoinResourceType) {
+			return chainedSearchParameter, errors.QueryValidationErrorf("invalid resource type %s in reverse chained search parameter %s", chainedSearchParameter.JoinResourceType, searchCodeWithModifier)
+		}
+		joinModel, err := databaseModel.NewFhirResourceModelByType(chainedSearchParameter.JoinResourceType)
+		if err != nil {
+			return chainedSearchParameter, err
+		}
+
+		referenceParameter, err := ProcessSearchParameter(searchCodeParts[2], joinModel.GetSearchParameters())
+		if err != nil {
+			return chainedSearchParameter, err
+		}
+		chainedSearchParameter.ReferenceParameter = referenceParameter
+		joinSearchCodeWithModifier = searchCodeParts[3]
+	} else {
+		searchCodeParts := strings.SplitN(searchCodeWithModifier, ".", 2)
+		if len(searchCodeParts[0]) == 0 || len(searchCodeParts[1]) == 0 {
+			return chainedSearchParameter, errors.QueryValidationErrorf("invalid chained search parameter %s, must be in the form reference.parameter", searchCodeWithModifier)
+		}
+
+		referenceParameter, err := ProcessSearchParameter(searchCodeParts[0], searchParamTypeLookup)
+		if err != nil {
+			return chainedSearchParameter, err
+		}
+		chainedSearchParameter.ReferenceParameter = referenceParameter
+		if referenceParameter.Modifier == "missing" {
+			return chainedSearchParameter, errors.QueryValidationErrorf("chained search parameter %s cannot use the :missing modifier", searchCodeWithModifier)
+		}
+
+		//determine the referenced resource type (the type modifier has already been validated by ProcessSearchParameter)
+		if len(referenceParameter.Modifier) > 0 {
+			chainedSearchParameter.JoinResourceType = referenceParameter.Modifier
+		} else if slices.Contains(databaseModel.GetAllowedResourceTypes(), strcase.ToCamel(referenceParameter.Name)) {
+			//eg. `encounter` references an Encounter
+			chainedSearchParameter.JoinResourceType = strcase.ToCamel(referenceParameter.Name)
+		} else if defaultResourceType, ok := chainedSearchParameterDefaultResourceTypes[referenceParameter.Name]; ok {
+			chainedSearchParameter.JoinResourceType = defaultResourceType
+		} else {
+			return chainedSearchParameter, errors.QueryValidationErrorf("chained search parameter %s must specify the referenced resource type (eg. %s:Patient.%s)", searchCodeWithModifier, referenceParameter.Name, searchCodeParts[1])
+		}
+		joinSearchCodeWithModifier = searchCodeParts[1]
+	}
+
+	if chainedSearchParameter.ReferenceParameter.Type != SearchParameterTypeReference {
+		return chainedSearchParameter, errors.QueryValidationErrorf("chained search parameter %s must use a reference search parameter (%s is a %s)", searchCodeWithModifier, chainedSearchParameter.ReferenceParameter.Name, chainedSearchParameter.ReferenceParameter.Type)
+	}
+	if IsChainedSearchParameter(joinSearchCodeWithModifier) {
+		return chainedSearchParameter, errors.QueryValidationErrorf("chained search parameter %s is invalid, only a single level of chaining is supported", searchCodeWithModifier)
+	}
+
+	joinModel, err := databaseModel.NewFhirResourceModelByType(chainedSearchParameter.JoinResourceType)
+	if err != nil {
+		return chainedSearchParameter, err
+	}
+	joinSearchParameter, err := ProcessSearchParameter(joinSearchCodeWithModifier, joinModel.GetSearchParameters())
+	if err != nil {
+		return chainedSearchParameter, err
+	}
+	chainedSearchParameter.JoinSearchParameter = joinSearchParameter
+
+	return chainedSearchParameter, nil
+}
+
+// chainedSearchParameterToWhereClause generates an EXISTS subquery which joins the queried table (TABLE_ALIAS) with the referenced (or referencing) table
+func chainedSearchParameterToWhereClause(dialect pkg.DatabaseRepositoryType, fromResourceType string, chainedSearchParameter ChainedSearchParameter, searchParamCodeValueOrValuesWithPrefix interface{}) (string, map[string]interface{}, error) {
+	joinTableAlias := chainedSearchParameter.Alias
+	referenceJsonAlias := fmt.Sprintf("%sReference", joinTableAlias)
+
+	//SECURITY: the join resource type has already been validated by ProcessChainedSearchParameter
+	fromClauses := []string{fmt.Sprintf("%s as %s", strcase.ToSnake("Fhir"+chainedSearchParameter.JoinResourceType), joinTableAlias)}
+
+	var referenceClause string
+	if chainedSearchParameter.Reverse {
+		//the joined resource references the queried resource
+		fromClauses = append(fromClauses, sqlJsonEach(dialect, joinTableAlias, chainedSearchParameter.ReferenceParameter.Name, referenceJsonAlias))
+		referenceClause = sqlReferenceMatchesResource(dialect, referenceJsonAlias, joinTableAlias, TABLE_ALIAS, fromResourceType)
+	} else {
+		//the queried resource references the joined resource
+		fromClauses = append(fromClauses, sqlJsonEach(dialect, TABLE_ALIAS, chainedSearchParameter.ReferenceParameter.Name, referenceJsonAlias))
+		referenceClause = sqlReferenceMatchesResource(dialect, referenceJsonAlias, TABLE_ALIAS, joinTableAlias, chainedSearchParameter.JoinResourceType)
+	}
+
+	joinWhereClauses, joinFromClause, whereNamedParameters, err := searchParameterToClauses(dialect, joinTableAlias, chainedSearchParameter.JoinSearchParameter, searchParamCodeValueOrValuesWithPrefix, joinTableAlias+"_")
+	if err != nil {
+		return "", nil, err
+	}
+	if len(joinFromClause) > 0 {
+		fromClauses = append(fromClauses, joinFromClause)
+	}
+
+	//SECURITY: the joined table must also be restricted to the current user. `@user_id` is populated by sqlQueryResources
+	whereClauses := append([]string{
+		fmt.Sprintf("(%s = @user_id)", sqlTableColumn(dialect, joinTableAlias, "user_id")),
+		referenceClause,
+	}, joinWhereClauses...)
+
+	return fmt.Sprintf("(EXISTS (SELECT 1 FROM %s WHERE %s))", strings.Join(fromClauses, ", "), strings.Join(whereClauses, " AND ")), whereNamedParameters, nil
+}
+
+// sqlReferenceMatchesResource generates a clause which checks if a reference (json row generated by sqlJsonEach) from a resource in
+// referencingTableAlias points to the resource in resourceTableAlias.
+// relative references (`Encounter/123`) must be from the same source, Fasten urn references (`urn:fastenhealth-fhir:{sourceId}:Encounter/123`) may be from any source.
+func sqlReferenceMatchesResource(dialect pkg.DatabaseRepositoryType, referenceJsonAlias string, referencingTableAlias string, resourceTableAlias string, resourceType string) string {
+	referenceColumn := sqlJsonExtract(dialect, referenceJsonAlias, "reference")
+	resourceIdColumn := sqlTableColumn(dialect, resourceTableAlias, "source_resource_id")
+	resourceSourceIdColumn := sqlTableColumn(dialect, resourceTableAlias, "source_id")
+
+	return fmt.Sprintf("((%s = ('%s/' || %s) AND %s = %s) OR %s = ('%s' || %s || ':%s/' || %s))",
+		referenceColumn, resourceType, resourceIdColumn, resourceSourceIdColumn, sqlTableColumn(dialect, referencingTableAlias, "source_id"),
+		referenceColumn, sourcePkg.FASTENHEALTH_URN_PREFIX, resourceSourceIdColumn, resourceType, resourceIdColumn,
+	)
+}
+
+// chainedSearchParameterAlias converts a chained search parameter into a (sql safe) alias
+// eg. `_has:Condition:encounter:code` -> `hasConditionEncounterCode`
+func chainedSearchParameterAlias(searchCodeWithModifier string) string {
+	aliasParts := strings.FieldsFunc(searchCodeWithModifier, func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsDigit(r))
+	})
+	return strcase.ToLowerCamel(strings.Join(aliasParts, "_"))
+}
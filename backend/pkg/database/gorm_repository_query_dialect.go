@@ -0,0 +1,132 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"gorm.io/gorm"
+)
+
+// The QueryResources engine generates raw SQL, which means that json functions & identifier quoting must match the
+// database we're talking to.
+//
+// SQLite:
+//
+//	SELECT fhir.* FROM fhir_observation as fhir, json_each(fhir.code) as codeJson WHERE codeJson.value ->> '$.code' = ?
+//
+// Postgres (search parameter columns are camelCase, so they must be quoted. JSON data is stored as text, so it must be cast):
+//
+//	SELECT fhir.* FROM fhir_observation as fhir, jsonb_array_elements(...fhir."code"::jsonb...) as codeJson WHERE codeJson.value ->> 'code' = ?
+//
+// These helpers are used to generate the dialect specific fragments.
+
+// sqlDialect returns the dialect of the database this repository is connected to.
+func (gr *GormRepository) sqlDialect() pkg.DatabaseRepositoryType {
+	return sqlDialectOf(gr.GormClient)
+}
+
+// sqlDialectOf returns the dialect of a gorm connection (or transaction), see sqlDialect
+func sqlDialectOf(db *gorm.DB) pkg.DatabaseRepositoryType {
+	if db != nil && db.Dialector != nil && db.Dialector.Name() == string(pkg.DatabaseRepositoryTypePostgres) {
+		return pkg.DatabaseRepositoryTypePostgres
+	}
+	return pkg.DatabaseRepositoryTypeSqlite
+}
+
+// sqlIdentifier returns a (bare) column identifier
+// eg. `probability` or `"activityCode"`
+func sqlIdentifier(dialect pkg.DatabaseRepositoryType, name string) string {
+	if dialect == pkg.DatabaseRepositoryTypePostgres {
+		return fmt.Sprintf(`"%s"`, name)
+	}
+	return name
+}
+
+// sqlTableColumn returns a column identifier qualified with the table alias
+// eg. `fhir.instantiatesUri` or `fhir."instantiatesUri"`
+func sqlTableColumn(dialect pkg.DatabaseRepositoryType, tableAlias string, name string) string {
+	return fmt.Sprintf("%s.%s", tableAlias, sqlIdentifier(dialect, name))
+}
+
+// sqlJsonEach returns a FROM clause that expands the json array stored in a column into rows, aliased as `{alias}`.
+// Each row exposes the array item as `{alias}.value`
+func sqlJsonEach(dialect pkg.DatabaseRepositoryType, tableAlias string, column string, alias string) string {
+	if dialect == pkg.DatabaseRepositoryTypePostgres {
+		//search parameter columns are stored as text, and may contain a json `null` (rather than a SQL NULL) which cannot be expanded
+		jsonbColumn := fmt.Sprintf("%s::jsonb", sqlTableColumn(dialect, tableAlias, column))
+		return fmt.Sprintf("jsonb_array_elements(CASE WHEN jsonb_typeof(%s) = 'array' THEN %s END) as %s", jsonbColumn, jsonbColumn, alias)
+	}
+	return fmt.Sprintf("json_each(%s) as %s", sqlTableColumn(dialect, tableAlias, column), alias)
+}
+
+// sqlJsonExtract returns the text value of a property of a json object row (generated by sqlJsonEach)
+// eg. `codeJson.value ->> '$.code'` or `codeJson.value ->> 'code'`
+func sqlJsonExtract(dialect pkg.DatabaseRepositoryType, alias string, property string) string {
+	if dialect == pkg.DatabaseRepositoryTypePostgres {
+		return fmt.Sprintf("%s.value ->> '%s'", alias, property)
+	}
+	return fmt.Sprintf("%s.value ->> '$.%s'", alias, property)
+}
+
+// sqlJsonExtractNumeric returns the numeric value of a property of a json object row (generated by sqlJsonEach)
+// SQLite will return a numeric type when the json property is a number, Postgres requires an explicit cast.
+func sqlJsonExtractNumeric(dialect pkg.DatabaseRepositoryType, alias string, property string) string {
+	if dialect == pkg.DatabaseRepositoryTypePostgres {
+		return fmt.Sprintf("(%s)::numeric", sqlJsonExtract(dialect, alias, property))
+	}
+	return sqlJsonExtract(dialect, alias, property)
+}
+
+// sqlJsonValue returns the text value of a primitive json array item row (generated by sqlJsonEach)
+// eg. `givenJson.value` or `(givenJson.value #>> '{}')`
+func sqlJsonValue(dialect pkg.DatabaseRepositoryType, alias string) string {
+	if dialect == pkg.DatabaseRepositoryTypePostgres {
+		return fmt.Sprintf("(%s.value #>> '{}')", alias)
+	}
+	return fmt.Sprintf("%s.value", alias)
+}
+
+// sqlJsonColumnFirstProperty returns the (json encoded) property of the first item in the json array stored in a column
+// eg. `fhir.valueQuantity -> '$[0].value'` or `fhir."valueQuantity"::jsonb -> 0 -> 'value'`
+// SECURITY: the property must be validated by the caller, as it is included in the SQL query
+func sqlJsonColumnFirstProperty(dialect pkg.DatabaseRepositoryType, tableAlias string, column string, property string) string {
+	if dialect == pkg.DatabaseRepositoryTypePostgres {
+		return fmt.Sprintf("(%s::jsonb -> 0 -> '%s')", sqlTableColumn(dialect, tableAlias, column), property)
+	}
+	return fmt.Sprintf("(%s -> '$[0].%s')", sqlTableColumn(dialect, tableAlias, column), property)
+}
+
+// sqlDateBucket returns the (text) label of the bucket containing a date column, see models.QueryResourceAggregationBuckets
+// eg. `strftime('%Y-%m', fhir.date)` or `to_char(fhir."date", 'YYYY-MM')`
+// bucket must already be validated, unknown buckets are treated as `day`
+func sqlDateBucket(dialect pkg.DatabaseRepositoryType, tableAlias string, column string, bucket string) string {
+	dateColumn := sqlTableColumn(dialect, tableAlias, column)
+	if dialect == pkg.DatabaseRepositoryTypePostgres {
+		switch bucket {
+		case "year":
+			return fmt.Sprintf("to_char(%s, 'YYYY')", dateColumn)
+		case "quarter":
+			return fmt.Sprintf(`to_char(%s, 'YYYY-"Q"Q')`, dateColumn)
+		case "month":
+			return fmt.Sprintf("to_char(%s, 'YYYY-MM')", dateColumn)
+		case "week":
+			return fmt.Sprintf("to_char(date_trunc('week', %s), 'YYYY-MM-DD')", dateColumn)
+		default:
+			return fmt.Sprintf("to_char(%s, 'YYYY-MM-DD')", dateColumn)
+		}
+	}
+
+	switch bucket {
+	case "year":
+		return fmt.Sprintf("strftime('%%Y', %s)", dateColumn)
+	case "quarter":
+		return fmt.Sprintf("(strftime('%%Y', %s) || '-Q' || ((CAST(strftime('%%m', %s) AS INTEGER) + 2) / 3))", dateColumn, dateColumn)
+	case "month":
+		return fmt.Sprintf("strftime('%%Y-%%m', %s)", dateColumn)
+	case "week":
+		//move forward to the next Sunday (unless the date is a Sunday), then back to the Monday
+		return fmt.Sprintf("date(%s, 'weekday 0', '-6 days')", dateColumn)
+	default:
+		return fmt.Sprintf("date(%s)", dateColumn)
+	}
+}
@@ -0,0 +1,384 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/errors"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	databaseModel "github.com/fastenhealth/fasten-onprem/backend/pkg/models/database"
+	sourcePkg "github.com/fastenhealth/fasten-sources/pkg"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+	"golang.org/x/exp/slices"
+)
+
+// Include and RevInclude allow QueryResources to return resources related to the matching resources in the same response
+// https://hl7.org/fhir/r4/search.html#include
+//
+// eg. Include - return the Practitioners referenced by the matching Observations
+//
+//	"from": "Observation", "include": ["Observation:performer:Practitioner"]
+//
+// eg. RevInclude - return the Provenance resources which reference the matching Observations
+//
+//	"from": "Observation", "revinclude": ["Provenance:target"]
+//
+// Named search parameters are resolved using the reference search parameter columns, while the `*` wildcard
+// (eg. `Observation:*`) is resolved using the related_resources table.
+// Included resources are marked with the "include" search mode, matching resources are marked with the "match" search mode.
+
+// the maximum number of resources used in a single `IN (...)` clause
+const includeQueryBatchSize = 500
+
+type IncludeParameter struct {
+	//the resource type containing the reference
+	SourceResourceType string
+	//reference search parameter, or `*` for all references
+	SearchParameter SearchParameter
+	//optional, the referenced resource type
+	TargetResourceType string
+	Reverse            bool
+}
+
+// ProcessIncludeParameter parses include & revinclude parameters, which are in the form `{SourceResourceType}:{searchParameter}[:{TargetResourceType}]`
+// include parameters must reference resources from the queried resource type, revinclude parameters must reference the queried resource type.
+func ProcessIncludeParameter(includeParameterStr string, fromResourceType string, reverse bool) (IncludeParameter, error) {
+	includeParameter := IncludeParameter{Reverse: reverse}
+
+	includeParts := strings.Split(includeParameterStr, ":")
+	if len(includeParts) < 2 || len(includeParts) > 3 || len(includeParts[0]) == 0 || len(includeParts[1]) == 0 {
+		return includeParameter, errors.QueryValidationErrorf("invalid include parameter %s, must be in the form ResourceType:parameter[:TargetResourceType]", includeParameterStr)
+	}
+	includeParameter.SourceResourceType = includeParts[0]
+	if len(includeParts) == 3 {
+		includeParameter.TargetResourceType = includeParts[2]
+	}
+
+	//SECURITY: the resource types are controlled by the user, and are used to generate table names
+	if !slices.Contains(databaseModel.GetAllowedResourceTypes(), includeParameter.SourceResourceType) {
+		return includeParameter, errors.QueryValidationErrorf("invalid resource type %s in include parameter %s", includeParameter.SourceResourceType, includeParameterStr)
+	}
+	if len(includeParameter.TargetResourceType) > 0 && !slices.Contains(databaseModel.GetAllowedResourceTypes(), includeParameter.TargetResourceType) {
+		return includeParameter, errors.QueryValidationErrorf("invalid resource type %s in include parameter %s", includeParameter.TargetResourceType, includeParameterStr)
+	}
+
+	if reverse {
+		if len(includeParameter.TargetResourceType) > 0 && includeParameter.TargetResourceType != fromResourceType {
+			return includeParameter, errors.QueryValidationErrorf("revinclude parameter %s must reference %s", includeParameterStr, fromResourceType)
+		}
+	} else if includeParameter.SourceResourceType != fromResourceType {
+		return includeParameter, errors.QueryValidationErrorf("include parameter %s must start with %s", includeParameterStr, fromResourceType)
+	}
+
+	if includeParts[1] == "*" {
+		includeParameter.SearchParameter = SearchParameter{Name: "*", Type: SearchParameterTypeReference}
+		return includeParameter, nil
+	}
+
+	sourceModel, err := databaseModel.NewFhirResourceModelByType(includeParameter.SourceResourceType)
+	if err != nil {
+		return includeParameter, err
+	}
+	searchParameter, err := ProcessSearchParameter(includeParts[1], sourceModel.GetSearchParameters())
+	if err != nil {
+		return includeParameter, err
+	}
+	if searchParameter.Type != SearchParameterTypeReference || len(searchParameter.Modifier) > 0 {
+		return includeParameter, errors.QueryValidationErrorf("include parameter %s must use a reference search parameter", includeParameterStr)
+	}
+	includeParameter.SearchParameter = searchParameter
+	return includeParameter, nil
+}
+
+// queryIncludedResources finds the resources referenced by (or referencing) the matching resources, for each include/revinclude parameter.
+// Resources are only returned once, and resources which are already in the matching resources are not included again.
+func (gr *GormRepository) queryIncludedResources(ctx context.Context, query models.QueryResource, matchedResources []models.ResourceBase) ([]models.ResourceBase, error) {
+	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
+	if currentUserErr != nil {
+		return nil, currentUserErr
+	}
+
+	includeParameters := []IncludeParameter{}
+	for _, includeParameterStr := range query.Include {
+		includeParameter, err := ProcessIncludeParameter(includeParameterStr, query.From, false)
+		if err != nil {
+			return nil, err
+		}
+		includeParameters = append(includeParameters, includeParameter)
+	}
+	for _, includeParameterStr := range query.RevInclude {
+		includeParameter, err := ProcessIncludeParameter(includeParameterStr, query.From, true)
+		if err != nil {
+			return nil, err
+		}
+		includeParameters = append(includeParameters, includeParameter)
+	}
+
+	//resources are identified by source id, type and id (the database id is not included in references)
+	resourceKey := func(resource models.OriginBase) string {
+		return fmt.Sprintf("%s:%s/%s", resource.SourceID.String(), resource.SourceResourceType, resource.SourceResourceID)
+	}
+	foundResources := map[string]bool{}
+	for _, matchedResource := range matchedResources {
+		foundResources[resourceKey(matchedResource.OriginBase)] = true
+	}
+
+	includedResources := []models.ResourceBase{}
+	for _, includeParameter := range includeParameters {
+		var includeResults []models.ResourceBase
+		var err error
+		if includeParameter.Reverse {
+			includeResults, err = gr.queryRevIncludedResources(ctx, currentUser, includeParameter, matchedResources)
+		} else {
+			var includeOrigins []models.OriginBase
+			includeOrigins, err = gr.queryIncludedResourceOrigins(ctx, currentUser, includeParameter, matchedResources)
+			if err == nil {
+				includeResults, err = gr.findResourcesByOrigin(ctx, currentUser, includeOrigins)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, includeResult := range includeResults {
+			if foundResources[resourceKey(includeResult.OriginBase)] {
+				continue
+			}
+			foundResources[resourceKey(includeResult.OriginBase)] = true
+			includeResult.SearchMode = pkg.ResourceSearchModeInclude
+			includedResources = append(includedResources, includeResult)
+		}
+	}
+	return includedResources, nil
+}
+
+// queryIncludedResourceOrigins returns the source id, type & id of resources referenced by the matching resources
+func (gr *GormRepository) queryIncludedResourceOrigins(ctx context.Context, currentUser *models.User, includeParameter IncludeParameter, matchedResources []models.ResourceBase) ([]models.OriginBase, error) {
+	includeOrigins := []models.OriginBase{}
+	for _, matchedResourcesBatch := range lo.Chunk(matchedResources, includeQueryBatchSize) {
+		if includeParameter.SearchParameter.Name == "*" {
+			//find all related resources using the related_resources table
+			matchedResourceIds := lo.Map(matchedResourcesBatch, func(resource models.ResourceBase, _ int) string {
+				return resource.SourceResourceID
+			})
+			var relatedResources []models.RelatedResource
+			err := gr.GormClient.WithContext(ctx).
+				Where(models.RelatedResource{
+					ResourceBaseUserID:             currentUser.ID,
+					ResourceBaseSourceResourceType: includeParameter.SourceResourceType,
+				}).
+				Where("resource_base_source_resource_id IN ?", matchedResourceIds).
+				Find(&relatedResources).Error
+			if err != nil {
+				return nil, err
+			}
+
+			for _, relatedResource := range relatedResources {
+				//the resource id is only unique within a source, so we need to ensure this is a matched resource
+				if !lo.ContainsBy(matchedResourcesBatch, func(resource models.ResourceBase) bool {
+					return resource.SourceID == relatedResource.ResourceBaseSourceID && resource.SourceResourceID == relatedResource.ResourceBaseSourceResourceID
+				}) {
+					continue
+				}
+				includeOrigins = append(includeOrigins, models.OriginBase{
+					SourceID:           relatedResource.RelatedResourceSourceID,
+					SourceResourceType: relatedResource.RelatedResourceSourceResourceType,
+					SourceResourceID:   relatedResource.RelatedResourceSourceResourceID,
+				})
+			}
+		} else {
+			//find all references stored in the reference search parameter column
+			dialect := gr.sqlDialect()
+			referenceJsonAlias := fmt.Sprintf("%sJson", includeParameter.SearchParameter.Name)
+			tableName, err := databaseModel.GetTableNameByResourceType(includeParameter.SourceResourceType)
+			if err != nil {
+				return nil, err
+			}
+
+			var references []struct {
+				SourceID  uuid.UUID
+				Reference string
+			}
+			err = gr.GormClient.WithContext(ctx).
+				Select(fmt.Sprintf("%s as source_id, %s as reference", sqlTableColumn(dialect, TABLE_ALIAS, "source_id"), sqlJsonExtract(dialect, referenceJsonAlias, "reference"))).
+				Table(strings.Join([]string{
+					fmt.Sprintf("%s as %s", tableName, TABLE_ALIAS),
+					sqlJsonEach(dialect, TABLE_ALIAS, includeParameter.SearchParameter.Name, referenceJsonAlias),
+				}, ", ")).
+				Where(fmt.Sprintf("%s = ?", sqlTableColumn(dialect, TABLE_ALIAS, "user_id")), currentUser.ID).
+				Where(fmt.Sprintf("%s IN ?", sqlTableColumn(dialect, TABLE_ALIAS, "id")), lo.Map(matchedResourcesBatch, func(resource models.ResourceBase, _ int) uuid.UUID {
+					return resource.ID
+				})).
+				Find(&references).Error
+			if err != nil {
+				return nil, err
+			}
+
+			for _, reference := range references {
+				if referenceOrigin, ok := parseIncludeReference(reference.SourceID, reference.Reference); ok {
+					includeOrigins = append(includeOrigins, referenceOrigin)
+				}
+			}
+		}
+	}
+
+	if len(includeParameter.TargetResourceType) > 0 {
+		includeOrigins = lo.Filter(includeOrigins, func(origin models.OriginBase, _ int) bool {
+			return origin.SourceResourceType == includeParameter.TargetResourceType
+		})
+	}
+	return includeOrigins, nil
+}
+
+// queryRevIncludedResources returns the resources (of type IncludeParameter.SourceResourceType) which reference the matching resources
+func (gr *GormRepository) queryRevIncludedResources(ctx context.Context, currentUser *models.User, includeParameter IncludeParameter, matchedResources []models.ResourceBase) ([]models.ResourceBase, error) {
+	revIncludedResources := []models.ResourceBase{}
+	tableName, err := databaseModel.GetTableNameByResourceType(includeParameter.SourceResourceType)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, matchedResourcesBatch := range lo.Chunk(matchedResources, includeQueryBatchSize) {
+		if includeParameter.SearchParameter.Name == "*" {
+			//find all resources which reference the matched resources using the related_resources table
+			revIncludeOrigins := []models.OriginBase{}
+			for sourceId, sourceMatchedResources := range lo.GroupBy(matchedResourcesBatch, func(resource models.ResourceBase) uuid.UUID { return resource.SourceID }) {
+				var relatedResources []models.RelatedResource
+				err := gr.GormClient.WithContext(ctx).
+					Where(models.RelatedResource{
+						ResourceBaseUserID:             currentUser.ID,
+						ResourceBaseSourceResourceType: includeParameter.SourceResourceType,
+						RelatedResourceUserID:          currentUser.ID,
+						RelatedResourceSourceID:        sourceId,
+					}).
+					Where("related_resource_source_resource_type = ? AND related_resource_source_resource_id IN ?",
+						sourceMatchedResources[0].SourceResourceType,
+						lo.Map(sourceMatchedResources, func(resource models.ResourceBase, _ int) string { return resource.SourceResourceID }),
+					).
+					Find(&relatedResources).Error
+				if err != nil {
+					return nil, err
+				}
+				for _, relatedResource := range relatedResources {
+					revIncludeOrigins = append(revIncludeOrigins, models.OriginBase{
+						SourceID:           relatedResource.ResourceBaseSourceID,
+						SourceResourceType: relatedResource.ResourceBaseSourceResourceType,
+						SourceResourceID:   relatedResource.ResourceBaseSourceResourceID,
+					})
+				}
+			}
+
+			revIncludeResults, err := gr.findResourcesByOrigin(ctx, currentUser, revIncludeOrigins)
+			if err != nil {
+				return nil, err
+			}
+			revIncludedResources = append(revIncludedResources, revIncludeResults...)
+		} else {
+			//find all resources with a matching reference stored in the reference search parameter column
+			// relative references (`Observation/123`) must be from the same source, Fasten urn references may be from any source
+			dialect := gr.sqlDialect()
+			referenceJsonAlias := fmt.Sprintf("%sJson", includeParameter.SearchParameter.Name)
+			referenceColumn := sqlJsonExtract(dialect, referenceJsonAlias, "reference")
+
+			referenceClauses := []string{}
+			referenceClauseParams := []interface{}{}
+			urnReferences := []string{}
+			for sourceId, sourceMatchedResources := range lo.GroupBy(matchedResourcesBatch, func(resource models.ResourceBase) uuid.UUID { return resource.SourceID }) {
+				relativeReferences := []string{}
+				for _, matchedResource := range sourceMatchedResources {
+					relativeReference := fmt.Sprintf("%s/%s", matchedResource.SourceResourceType, matchedResource.SourceResourceID)
+					relativeReferences = append(relativeReferences, relativeReference)
+					urnReferences = append(urnReferences, fmt.Sprintf("%s%s:%s", sourcePkg.FASTENHEALTH_URN_PREFIX, sourceId.String(), relativeReference))
+				}
+				referenceClauses = append(referenceClauses, fmt.Sprintf("(%s = ? AND %s IN ?)", sqlTableColumn(dialect, TABLE_ALIAS, "source_id"), referenceColumn))
+				referenceClauseParams = append(referenceClauseParams, sourceId, relativeReferences)
+			}
+			referenceClauses = append(referenceClauses, fmt.Sprintf("(%s IN ?)", referenceColumn))
+			referenceClauseParams = append(referenceClauseParams, urnReferences)
+
+			var revIncludeResults []models.ResourceBase
+			err = gr.GormClient.WithContext(ctx).
+				Select(fmt.Sprintf("%s.*", TABLE_ALIAS)).
+				Table(strings.Join([]string{
+					fmt.Sprintf("%s as %s", tableName, TABLE_ALIAS),
+					sqlJsonEach(dialect, TABLE_ALIAS, includeParameter.SearchParameter.Name, referenceJsonAlias),
+				}, ", ")).
+				Where(fmt.Sprintf("%s = ?", sqlTableColumn(dialect, TABLE_ALIAS, "user_id")), currentUser.ID).
+				Where(strings.Join(referenceClauses, " OR "), referenceClauseParams...).
+				Group(fmt.Sprintf("%s.id", TABLE_ALIAS)).
+				Find(&revIncludeResults).Error
+			if err != nil {
+				return nil, err
+			}
+			revIncludedResources = append(revIncludedResources, revIncludeResults...)
+		}
+	}
+	return revIncludedResources, nil
+}
+
+// findResourcesByOrigin retrieves resources (for the current user), grouped by resource type & source to minimize the number of queries.
+// unknown resource types are ignored.
+func (gr *GormRepository) findResourcesByOrigin(ctx context.Context, currentUser *models.User, origins []models.OriginBase) ([]models.ResourceBase, error) {
+	foundResources := []models.ResourceBase{}
+
+	for resourceType, resourceTypeOrigins := range lo.GroupBy(origins, func(origin models.OriginBase) string { return origin.SourceResourceType }) {
+		tableName, err := databaseModel.GetTableNameByResourceType(resourceType)
+		if err != nil {
+			gr.Logger.Warnf("ignoring included resources with unknown resource type: %s", resourceType)
+			continue
+		}
+
+		for sourceId, sourceOrigins := range lo.GroupBy(resourceTypeOrigins, func(origin models.OriginBase) uuid.UUID { return origin.SourceID }) {
+			sourceResourceIds := lo.Uniq(lo.Map(sourceOrigins, func(origin models.OriginBase, _ int) string { return origin.SourceResourceID }))
+			for _, sourceResourceIdsBatch := range lo.Chunk(sourceResourceIds, includeQueryBatchSize) {
+				var resources []models.ResourceBase
+				err = gr.GormClient.WithContext(ctx).
+					Where(models.OriginBase{
+						UserID:   currentUser.ID,
+						SourceID: sourceId,
+					}).
+					Where("source_resource_id IN ?", sourceResourceIdsBatch).
+					Table(tableName).
+					Find(&resources).Error
+				if err != nil {
+					return nil, err
+				}
+				foundResources = append(foundResources, resources...)
+			}
+		}
+	}
+	return foundResources, nil
+}
+
+// parseIncludeReference converts a reference (relative to the resource source, or a Fasten urn) into the source id, type and id of the referenced resource
+// absolute and contained references cannot be resolved, and are ignored.
+func parseIncludeReference(sourceId uuid.UUID, reference string) (models.OriginBase, bool) {
+	if strings.HasPrefix(reference, sourcePkg.FASTENHEALTH_URN_PREFIX) {
+		referenceSourceId, referenceResourceType, referenceResourceId, err := sourcePkg.ParseReferenceUri(&reference)
+		if err != nil {
+			return models.OriginBase{}, false
+		}
+		referenceSourceUUID, err := uuid.Parse(referenceSourceId)
+		if err != nil {
+			return models.OriginBase{}, false
+		}
+		return models.OriginBase{
+			SourceID:           referenceSourceUUID,
+			SourceResourceType: referenceResourceType,
+			SourceResourceID:   referenceResourceId,
+		}, true
+	}
+
+	referenceParts := strings.Split(reference, "/")
+	if len(referenceParts) != 2 || len(referenceParts[0]) == 0 || len(referenceParts[1]) == 0 {
+		return models.OriginBase{}, false
+	}
+	return models.OriginBase{
+		SourceID:           sourceId,
+		SourceResourceType: referenceParts[0],
+		SourceResourceID:   referenceParts[1],
+	}, true
+}
@@ -0,0 +1,121 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+)
+
+// Quantity search parameters may contain values recorded in different units (eg. `mg/dL` and `mmol/L`), so numeric
+// aggregations (sum, avg, min, max) over `valueQuantity:value` are unit aware:
+//
+// - by default the results are grouped by the UCUM unit code, and each result row contains a `unit` value
+// - if a `unit` is specified, values are converted to that unit before they are aggregated. Values with units that cannot
+//   be converted (eg. `mmol/L` to `mg/dL`, which depends on the molar mass of the analyte) are ignored.
+//
+// eg. {"group_by": {"field": "date", "bucket": "month"}, "order_by": {"field": "valueQuantity:value", "fn": "avg", "unit": "g/L"}}
+//
+//	avg(CASE COALESCE(valueQuantityJson.value ->> '$.code', valueQuantityJson.value ->> '$.unit') WHEN 'g/L' THEN (valueQuantityJson.value ->> '$.value') * 1 WHEN 'mg/dL' THEN ... END)
+
+// ucumUnit is a UCUM unit code which can be converted to the other units of the same dimension, by multiplying with the factor
+type ucumUnit struct {
+	Dimension string
+	Factor    float64 //relative to the base unit of the dimension
+}
+
+// ucumUnits are the UCUM unit codes (commonly used in lab results & vital signs) that can be converted.
+// temperatures are not included, since they cannot be converted by multiplication alone
+var ucumUnits = map[string]ucumUnit{
+	//mass concentration (g/L)
+	"g/L":   {"mass_concentration", 1},
+	"g/dL":  {"mass_concentration", 10},
+	"mg/mL": {"mass_concentration", 1},
+	"mg/dL": {"mass_concentration", 0.01},
+	"mg/L":  {"mass_concentration", 0.001},
+	"ug/mL": {"mass_concentration", 0.001},
+	"ug/dL": {"mass_concentration", 0.00001},
+	"ug/L":  {"mass_concentration", 0.000001},
+	"ng/mL": {"mass_concentration", 0.000001},
+	"ng/dL": {"mass_concentration", 0.00000001},
+	"ng/L":  {"mass_concentration", 0.000000001},
+	"pg/mL": {"mass_concentration", 0.000000001},
+
+	//substance concentration (mol/L)
+	"mol/L":  {"substance_concentration", 1},
+	"mmol/L": {"substance_concentration", 0.001},
+	"umol/L": {"substance_concentration", 0.000001},
+	"nmol/L": {"substance_concentration", 0.000000001},
+	"pmol/L": {"substance_concentration", 0.000000000001},
+
+	//mass (g)
+	"kg":      {"mass", 1000},
+	"g":       {"mass", 1},
+	"mg":      {"mass", 0.001},
+	"ug":      {"mass", 0.000001},
+	"[lb_av]": {"mass", 453.59237},
+	"[oz_av]": {"mass", 28.349523125},
+
+	//length (m)
+	"m":      {"length", 1},
+	"cm":     {"length", 0.01},
+	"mm":     {"length", 0.001},
+	"[in_i]": {"length", 0.0254},
+	"[ft_i]": {"length", 0.3048},
+
+	//volume (L)
+	"L":  {"volume", 1},
+	"dL": {"volume", 0.1},
+	"mL": {"volume", 0.001},
+	"uL": {"volume", 0.000001},
+
+	//pressure (Pa)
+	"Pa":     {"pressure", 1},
+	"kPa":    {"pressure", 1000},
+	"mm[Hg]": {"pressure", 133.322387415},
+}
+
+// isUnitAwareAggregationParameter returns true if the aggregation parameter is a numeric aggregation of a Quantity value
+func isUnitAwareAggregationParameter(aggParameter AggregationParameter) bool {
+	return aggParameter.Type == SearchParameterTypeQuantity && aggParameter.Modifier == "value" && isNumericAggregationFunction(aggParameter.Function)
+}
+
+func isNumericAggregationFunction(function string) bool {
+	return function == "sum" || function == "avg" || function == "min" || function == "max"
+}
+
+// sqlQuantityUnit returns the UCUM unit code of a Quantity json object row (generated by sqlJsonEach), falling back to the human readable unit
+// eg. `COALESCE(valueQuantityJson.value ->> '$.code', valueQuantityJson.value ->> '$.unit')`
+func sqlQuantityUnit(dialect pkg.DatabaseRepositoryType, alias string) string {
+	return fmt.Sprintf("COALESCE(%s, %s)", sqlJsonExtract(dialect, alias, "code"), sqlJsonExtract(dialect, alias, "unit"))
+}
+
+// sqlQuantityValueInUnit returns the numeric value of a Quantity json object row (generated by sqlJsonEach), converted to the target unit.
+// Values with units that cannot be converted to the target unit are NULL (and ignored by aggregate functions)
+// the target unit must already be validated (see ProcessAggregationParameter)
+func sqlQuantityValueInUnit(dialect pkg.DatabaseRepositoryType, alias string, targetUnitCode string) string {
+	targetUnit, targetUnitOk := ucumUnits[targetUnitCode]
+	if !targetUnitOk {
+		return "NULL"
+	}
+
+	//the unit codes are sorted so that the generated SQL is deterministic
+	unitCodes := []string{}
+	for unitCode, unit := range ucumUnits {
+		if unit.Dimension == targetUnit.Dimension {
+			unitCodes = append(unitCodes, unitCode)
+		}
+	}
+	sort.Strings(unitCodes)
+
+	valueClause := sqlJsonExtractNumeric(dialect, alias, "value")
+	whenClauses := []string{}
+	for _, unitCode := range unitCodes {
+		//unit codes are from the ucumUnits allow-list, so can be safely included in the query
+		factor := strconv.FormatFloat(ucumUnits[unitCode].Factor/targetUnit.Factor, 'g', 12, 64)
+		whenClauses = append(whenClauses, fmt.Sprintf("WHEN '%s' THEN (%s) * %s", unitCode, valueClause, factor))
+	}
+	return fmt.Sprintf("CASE %s %s END", sqlQuantityUnit(dialect, alias), strings.Join(whenClauses, " "))
+}
@@ -0,0 +1,279 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/errors"
+	databaseModel "github.com/fastenhealth/fasten-onprem/backend/pkg/models/database"
+	"github.com/google/uuid"
+)
+
+// The `select` field allows QueryResources to return a projection of the matching resources as flat rows, rather than
+// the full resources (including the raw resource json).
+//
+// Each select entry may be aliased using `as` (eg. `valueQuantity.value as data`), and may be:
+// - `*` - the raw resource json
+// - a search parameter (eg. `sort_date`), or a property of a complex search parameter (eg. `valueQuantity:value`, `code:code`).
+//   these are projected by the database, and only return the first value of the search parameter
+// - a FHIRPath expression (eg. `component.where(code.coding.code = '8462-4').valueQuantity.value`), which is evaluated
+//   against the raw resource (the same way the frontend does), and always returns a list of values. Top level elements
+//   that are not search parameters (eg. `component`) are also treated as FHIRPath expressions.
+//   Each expression is limited to databaseModel.FhirPathEvaluateTimeout per resource.
+//
+// eg. "select": ["valueQuantity:value as data", "sort_date as label"]
+//
+//	SELECT (fhir.valueQuantity -> '$[0].value') as select_0, fhir.sort_date as select_1, fhir.source_id as source_id, ...
+//
+//	[{"data": 98.6, "label": "2023-01-01T00:00:00Z", "id": "123", "resourceType": "Observation", "source_id": "..."}]
+//
+// every row also contains the `id`, `resourceType` and `source_id` of the resource.
+
+type SelectParameterType string
+
+const (
+	SelectParameterTypeResource        SelectParameterType = "resource"
+	SelectParameterTypeSearchParameter SelectParameterType = "search_parameter"
+	SelectParameterTypeFhirPath        SelectParameterType = "fhirpath"
+)
+
+// these keys are always populated in select rows
+var selectReservedAliases = []string{"id", "resourceType", "source_id"}
+
+// properties of complex search parameters are included in the SQL query, so must be simple identifiers
+var selectPropertyRegex = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// search parameter references (with an optional property), eg. `valueQuantity:value`
+var selectSearchParameterRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+(:[a-zA-Z0-9_]*)?$`)
+
+type SelectParameter struct {
+	Expression string
+	Alias      string
+	Type       SelectParameterType
+	//only populated for SelectParameterTypeSearchParameter, the property is stored as the modifier
+	SearchParameter SearchParameter
+}
+
+// ProcessSelectParameters parses the select entries, and determines if they are search parameters or FHIRPath expressions
+func ProcessSelectParameters(selectEntries []string, searchParamTypeLookup map[string]string) ([]SelectParameter, error) {
+	var fhirPathEvaluator *databaseModel.FhirPathEvaluator
+
+	selectParameters := []SelectParameter{}
+	aliases := map[string]bool{}
+	for _, selectEntry := range selectEntries {
+		selectParameter := SelectParameter{
+			Expression: strings.TrimSpace(selectEntry),
+		}
+		selectParameter.Alias = selectParameter.Expression
+
+		//the last ` as ` is used, since ` as ` is also a FHIRPath operator (eg. `value as Quantity as data`)
+		if aliasNdx := strings.LastIndex(strings.ToLower(selectParameter.Expression), " as "); aliasNdx > -1 {
+			selectParameter.Alias = strings.TrimSpace(selectParameter.Expression[aliasNdx+len(" as "):])
+			selectParameter.Expression = strings.TrimSpace(selectParameter.Expression[:aliasNdx])
+		}
+		if len(selectParameter.Expression) == 0 || len(selectParameter.Alias) == 0 {
+			return nil, errors.QueryValidationErrorf("invalid select entry: '%s'", selectEntry)
+		}
+		if aliases[selectParameter.Alias] {
+			return nil, errors.QueryValidationErrorf("duplicate select alias: %s", selectParameter.Alias)
+		}
+		for _, reservedAlias := range selectReservedAliases {
+			if selectParameter.Alias == reservedAlias {
+				return nil, errors.QueryValidationErrorf("select alias %s is reserved", selectParameter.Alias)
+			}
+		}
+		aliases[selectParameter.Alias] = true
+
+		if selectParameter.Expression == "*" {
+			selectParameter.Type = SelectParameterTypeResource
+		} else if searchParameter, ok := processSelectSearchParameter(selectParameter.Expression, searchParamTypeLookup); ok {
+			if searchParameter.Modifier != "" {
+				if searchParameter.Type == SearchParameterTypeNumber || searchParameter.Type == SearchParameterTypeUri || searchParameter.Type == SearchParameterTypeKeyword || searchParameter.Type == SearchParameterTypeDate {
+					return nil, errors.QueryValidationErrorf("primitive select parameter %s cannot have a property (%s)", searchParameter.Name, searchParameter.Modifier)
+				}
+				if !selectPropertyRegex.MatchString(searchParameter.Modifier) {
+					return nil, errors.QueryValidationErrorf("invalid select parameter property: %s", searchParameter.Modifier)
+				}
+			}
+			selectParameter.Type = SelectParameterTypeSearchParameter
+			selectParameter.SearchParameter = searchParameter
+		} else if strings.Contains(selectParameter.Expression, ":") && selectSearchParameterRegex.MatchString(selectParameter.Expression) {
+			//`name:property` is only valid for search parameters, so this is most likely a misspelled search parameter
+			return nil, errors.QueryValidationErrorf("unknown select search parameter: %s", strings.SplitN(selectParameter.Expression, ":", 2)[0])
+		} else {
+			//FHIRPath expressions are evaluated against every matching resource, so syntax errors are detected before querying
+			if fhirPathEvaluator == nil {
+				evaluator, err := databaseModel.NewFhirPathEvaluator()
+				if err != nil {
+					return nil, err
+				}
+				fhirPathEvaluator = evaluator
+			}
+			if err := fhirPathEvaluator.Compile(selectParameter.Expression); err != nil {
+				return nil, errors.QueryValidationErrorf("invalid select entry: '%s', %v", selectEntry, err)
+			}
+			selectParameter.Type = SelectParameterTypeFhirPath
+		}
+		selectParameters = append(selectParameters, selectParameter)
+	}
+	return selectParameters, nil
+}
+
+// processSelectSearchParameter returns the search parameter (and optional property) if the select expression references a known search parameter
+func processSelectSearchParameter(expression string, searchParamTypeLookup map[string]string) (SearchParameter, bool) {
+	searchParameter := SearchParameter{}
+	if expressionParts := strings.SplitN(expression, ":", 2); len(expressionParts) == 2 {
+		searchParameter.Name = expressionParts[0]
+		searchParameter.Modifier = expressionParts[1]
+	} else {
+		searchParameter.Name = expressionParts[0]
+	}
+
+	searchParamTypeStr, searchParamTypeOk := searchParamTypeLookup[searchParameter.Name]
+	if !searchParamTypeOk {
+		return searchParameter, false
+	}
+	searchParameter.Type = SearchParameterType(searchParamTypeStr)
+	return searchParameter, true
+}
+
+// selectParametersToClauses generates the SELECT clauses for the select parameters.
+// user provided aliases are not included in the query, instead each parameter is aliased by its index (eg. `select_0`)
+func selectParametersToClauses(dialect pkg.DatabaseRepositoryType, selectParameters []SelectParameter) []string {
+	selectClauses := []string{
+		//the id and sort_date are required to generate the pagination cursor, see selectRowPaginationCursor
+		fmt.Sprintf("%s as %s", sqlTableColumn(dialect, TABLE_ALIAS, "id"), "id"),
+		fmt.Sprintf("%s as %s", sqlTableColumn(dialect, TABLE_ALIAS, "sort_date"), "sort_date"),
+		fmt.Sprintf("%s as %s", sqlTableColumn(dialect, TABLE_ALIAS, "source_id"), "source_id"),
+		fmt.Sprintf("%s as %s", sqlTableColumn(dialect, TABLE_ALIAS, "source_resource_type"), "source_resource_type"),
+		fmt.Sprintf("%s as %s", sqlTableColumn(dialect, TABLE_ALIAS, "source_resource_id"), "source_resource_id"),
+	}
+
+	includeResourceRaw := false
+	for ndx, selectParameter := range selectParameters {
+		switch selectParameter.Type {
+		case SelectParameterTypeSearchParameter:
+			selectClauses = append(selectClauses, fmt.Sprintf("%s as %s", selectSearchParameterToClause(dialect, selectParameter.SearchParameter), selectParameterColumnAlias(ndx)))
+		default:
+			//the raw resource is required to evaluate FHIRPath expressions
+			includeResourceRaw = true
+		}
+	}
+	if includeResourceRaw {
+		selectClauses = append(selectClauses, fmt.Sprintf("%s as %s", sqlTableColumn(dialect, TABLE_ALIAS, "resource_raw"), "resource_raw"))
+	}
+	return selectClauses
+}
+
+func selectSearchParameterToClause(dialect pkg.DatabaseRepositoryType, searchParameter SearchParameter) string {
+	switch searchParameter.Type {
+	case SearchParameterTypeNumber, SearchParameterTypeUri, SearchParameterTypeKeyword, SearchParameterTypeDate:
+		return sqlTableColumn(dialect, TABLE_ALIAS, searchParameter.Name)
+	default:
+		//complex search parameters are stored as json arrays
+		if len(searchParameter.Modifier) > 0 {
+			return sqlJsonColumnFirstProperty(dialect, TABLE_ALIAS, searchParameter.Name, searchParameter.Modifier)
+		}
+		return sqlTableColumn(dialect, TABLE_ALIAS, searchParameter.Name)
+	}
+}
+
+func selectParameterColumnAlias(ndx int) string {
+	return fmt.Sprintf("select_%d", ndx)
+}
+
+// selectRowsToResults converts the database rows generated by a select query into flat rows keyed by the select aliases
+// FHIRPath expressions are evaluated here.
+func selectRowsToResults(selectParameters []SelectParameter, rows []map[string]interface{}) ([]map[string]interface{}, error) {
+	var fhirPathEvaluator *databaseModel.FhirPathEvaluator
+
+	results := []map[string]interface{}{}
+	for _, row := range rows {
+		result := map[string]interface{}{
+			"id":           selectColumnValue(row["source_resource_id"]),
+			"resourceType": selectColumnValue(row["source_resource_type"]),
+			"source_id":    selectColumnValue(row["source_id"]),
+		}
+
+		for ndx, selectParameter := range selectParameters {
+			switch selectParameter.Type {
+			case SelectParameterTypeResource:
+				result[selectParameter.Alias] = selectJsonColumnValue(row["resource_raw"])
+			case SelectParameterTypeSearchParameter:
+				columnValue := row[selectParameterColumnAlias(ndx)]
+				switch selectParameter.SearchParameter.Type {
+				case SearchParameterTypeNumber, SearchParameterTypeUri, SearchParameterTypeKeyword, SearchParameterTypeDate:
+					result[selectParameter.Alias] = selectColumnValue(columnValue)
+				default:
+					result[selectParameter.Alias] = selectJsonColumnValue(columnValue)
+				}
+			case SelectParameterTypeFhirPath:
+				if fhirPathEvaluator == nil {
+					evaluator, err := databaseModel.NewFhirPathEvaluator()
+					if err != nil {
+						return nil, err
+					}
+					fhirPathEvaluator = evaluator
+				}
+
+				resourceRaw, _ := selectColumnValue(row["resource_raw"]).(string)
+				fhirPathResult, err := fhirPathEvaluator.Evaluate(json.RawMessage(resourceRaw), selectParameter.Expression)
+				if err != nil {
+					//the expression is valid, but could not be evaluated against this resource (eg. a type error, or the timeout was exceeded)
+					return nil, errors.QueryValidationErrorf("select entry '%s' could not be evaluated: %v", selectParameter.Alias, err)
+				}
+				result[selectParameter.Alias] = fhirPathResult
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// text columns may be returned as bytes (depending on the database driver), and columns without a declared type (eg. json expressions) are returned as pointers
+func selectColumnValue(columnValue interface{}) interface{} {
+	if columnValuePtr, ok := columnValue.(*interface{}); ok && columnValuePtr != nil {
+		columnValue = *columnValuePtr
+	}
+	if columnValueBytes, ok := columnValue.([]byte); ok {
+		return string(columnValueBytes)
+	}
+	return columnValue
+}
+
+// selectRowPaginationCursor returns the pagination cursor for a database row generated by a select query
+func selectRowPaginationCursor(row map[string]interface{}) paginationCursor {
+	cursor := paginationCursor{}
+	switch id := selectColumnValue(row["id"]).(type) {
+	case string:
+		cursor.ID, _ = uuid.Parse(id)
+	case uuid.UUID:
+		cursor.ID = id
+	}
+	switch sortDate := selectColumnValue(row["sort_date"]).(type) {
+	case time.Time:
+		cursor.SortDate = &sortDate
+	case string:
+		if parsedSortDate, err := time.Parse(time.RFC3339Nano, sortDate); err == nil {
+			cursor.SortDate = &parsedSortDate
+		}
+	}
+	return cursor
+}
+
+// json columns are returned as text, and must be decoded. Invalid json is returned as text
+func selectJsonColumnValue(columnValue interface{}) interface{} {
+	columnValueStr, ok := selectColumnValue(columnValue).(string)
+	if !ok {
+		return columnValue
+	}
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(columnValueStr), &decoded); err != nil {
+		return columnValueStr
+	}
+	return decoded
+}
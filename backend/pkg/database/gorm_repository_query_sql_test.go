@@ -8,12 +8,15 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/fastenhealth/fasten-onprem/backend/pkg"
 	mock_config "github.com/fastenhealth/fasten-onprem/backend/pkg/config/mock"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
 	"github.com/golang/mock/gomock"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -103,7 +106,7 @@ func (suite *RepositorySqlTestSuite) TestQueryResources_SQL() {
 			"FROM fhir_observation as fhir, json_each(fhir.code) as codeJson",
 			"WHERE ((codeJson.value ->> '$.code' = ?)) AND (user_id = ?)",
 			"GROUP BY `fhir`.`id`",
-			"ORDER BY fhir.sort_date DESC",
+			"ORDER BY fhir.sort_date DESC NULLS LAST, fhir.id DESC",
 		}, " "),
 		sqlString)
 	require.Equal(suite.T(), sqlParams, []interface{}{
@@ -141,7 +144,7 @@ func (suite *RepositorySqlTestSuite) TestQueryResources_SQL_WithMultipleWhereCon
 			"FROM fhir_observation as fhir, json_each(fhir.category) as categoryJson, json_each(fhir.code) as codeJson",
 			"WHERE ((categoryJson.value ->> '$.code' = ?)) AND ((codeJson.value ->> '$.code' = ?)) AND (user_id = ?)",
 			"GROUP BY `fhir`.`id`",
-			"ORDER BY fhir.sort_date DESC",
+			"ORDER BY fhir.sort_date DESC NULLS LAST, fhir.id DESC",
 		}, " "),
 		sqlString)
 	require.Equal(suite.T(), sqlParams, []interface{}{
@@ -520,3 +523,398 @@ func (suite *RepositorySqlTestSuite) TestQueryResources_SQL_WithTokenGroupByNoMo
 		"00000000-0000-0000-0000-000000000000",
 	})
 }
+
+func (suite *RepositorySqlTestSuite) TestQueryResources_SQL_WithReferenceWhereCondition() {
+	//setup
+	sqliteRepo := suite.TestRepository.(*GormRepository)
+	sqliteRepo.GormClient = sqliteRepo.GormClient.Session(&gorm.Session{DryRun: true})
+
+	//test
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	sqlQuery, err := sqliteRepo.sqlQueryResources(authContext, models.QueryResource{
+		Select: []string{},
+		Where: map[string]interface{}{
+			"encounter:Encounter": "123",
+		},
+		From: "Observation",
+	})
+	require.NoError(suite.T(), err)
+	var results []map[string]interface{}
+	statement := sqlQuery.Find(&results).Statement
+	sqlString := statement.SQL.String()
+	sqlParams := statement.Vars
+
+	//assert
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(),
+		strings.Join([]string{
+			"SELECT fhir.*",
+			"FROM fhir_observation as fhir, json_each(fhir.encounter) as encounterJson",
+			"WHERE ((encounterJson.value ->> '$.reference' = ?)) AND (user_id = ?)",
+			"GROUP BY `fhir`.`id`",
+			"ORDER BY fhir.sort_date DESC NULLS LAST, fhir.id DESC",
+		}, " "), sqlString)
+	require.Equal(suite.T(), sqlParams, []interface{}{
+		"Encounter/123", "00000000-0000-0000-0000-000000000000",
+	})
+}
+
+func (suite *RepositorySqlTestSuite) TestQueryResources_SQL_WithChainedWhereCondition() {
+	//setup
+	sqliteRepo := suite.TestRepository.(*GormRepository)
+	sqliteRepo.GormClient = sqliteRepo.GormClient.Session(&gorm.Session{DryRun: true})
+
+	//test
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	sqlQuery, err := sqliteRepo.sqlQueryResources(authContext, models.QueryResource{
+		Select: []string{},
+		Where: map[string]interface{}{
+			"encounter.class": "IMP",
+		},
+		From: "Observation",
+	})
+	require.NoError(suite.T(), err)
+	var results []map[string]interface{}
+	statement := sqlQuery.Find(&results).Statement
+	sqlString := statement.SQL.String()
+	sqlParams := statement.Vars
+
+	//assert
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(),
+		strings.Join([]string{
+			"SELECT fhir.*",
+			"FROM fhir_observation as fhir",
+			"WHERE (EXISTS (SELECT 1 FROM fhir_encounter as encounterClass, json_each(fhir.encounter) as encounterClassReference, json_each(encounterClass.class) as classJson",
+			"WHERE (encounterClass.user_id = ?)",
+			"AND ((encounterClassReference.value ->> '$.reference' = ('Encounter/' || encounterClass.source_resource_id) AND encounterClass.source_id = fhir.source_id) OR encounterClassReference.value ->> '$.reference' = ('urn:fastenhealth-fhir:' || encounterClass.source_id || ':Encounter/' || encounterClass.source_resource_id))",
+			"AND ((classJson.value ->> '$.code' = ?)))) AND (user_id = ?)",
+			"GROUP BY `fhir`.`id`",
+			"ORDER BY fhir.sort_date DESC NULLS LAST, fhir.id DESC",
+		}, " "), sqlString)
+	require.Equal(suite.T(), sqlParams, []interface{}{
+		"00000000-0000-0000-0000-000000000000", "IMP", "00000000-0000-0000-0000-000000000000",
+	})
+}
+
+func (suite *RepositorySqlTestSuite) TestQueryResources_SQL_WithReverseChainedWhereCondition() {
+	//setup
+	sqliteRepo := suite.TestRepository.(*GormRepository)
+	sqliteRepo.GormClient = sqliteRepo.GormClient.Session(&gorm.Session{DryRun: true})
+
+	//test
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	sqlQuery, err := sqliteRepo.sqlQueryResources(authContext, models.QueryResource{
+		Select: []string{},
+		Where: map[string]interface{}{
+			"_has:Condition:encounter:code": "http://hl7.org/fhir/sid/icd-10-cm|E11",
+		},
+		From: "Encounter",
+	})
+	require.NoError(suite.T(), err)
+	var results []map[string]interface{}
+	statement := sqlQuery.Find(&results).Statement
+	sqlString := statement.SQL.String()
+	sqlParams := statement.Vars
+
+	//assert
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(),
+		strings.Join([]string{
+			"SELECT fhir.*",
+			"FROM fhir_encounter as fhir",
+			"WHERE (EXISTS (SELECT 1 FROM fhir_condition as hasConditionEncounterCode, json_each(hasConditionEncounterCode.encounter) as hasConditionEncounterCodeReference, json_each(hasConditionEncounterCode.code) as codeJson",
+			"WHERE (hasConditionEncounterCode.user_id = ?)",
+			"AND ((hasConditionEncounterCodeReference.value ->> '$.reference' = ('Encounter/' || fhir.source_resource_id) AND fhir.source_id = hasConditionEncounterCode.source_id) OR hasConditionEncounterCodeReference.value ->> '$.reference' = ('urn:fastenhealth-fhir:' || fhir.source_id || ':Encounter/' || fhir.source_resource_id))",
+			"AND ((codeJson.value ->> '$.code' = ? AND codeJson.value ->> '$.system' = ?)))) AND (user_id = ?)",
+			"GROUP BY `fhir`.`id`",
+			"ORDER BY fhir.sort_date DESC NULLS LAST, fhir.id DESC",
+		}, " "), sqlString)
+	require.Equal(suite.T(), sqlParams, []interface{}{
+		"00000000-0000-0000-0000-000000000000", "E11", "http://hl7.org/fhir/sid/icd-10-cm", "00000000-0000-0000-0000-000000000000",
+	})
+}
+
+func (suite *RepositorySqlTestSuite) TestQueryResources_SQL_WithSelect() {
+	//setup
+	sqliteRepo := suite.TestRepository.(*GormRepository)
+	sqliteRepo.GormClient = sqliteRepo.GormClient.Session(&gorm.Session{DryRun: true})
+
+	//test
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	sqlQuery, err := sqliteRepo.sqlQueryResources(authContext, models.QueryResource{
+		Select: []string{"valueQuantity:value as data", "sort_date as label", "component.valueQuantity.value as components"},
+		Use:    "vital-signs",
+	})
+	require.NoError(suite.T(), err)
+	var results []map[string]interface{}
+	statement := sqlQuery.Find(&results).Statement
+	sqlString := statement.SQL.String()
+	sqlParams := statement.Vars
+
+	//assert
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(),
+		strings.Join([]string{
+			"SELECT (fhir.valueQuantity -> '$[0].value') as select_0, fhir.id as id, fhir.resource_raw as resource_raw, fhir.sort_date as select_1, fhir.sort_date as sort_date, fhir.source_id as source_id, fhir.source_resource_id as source_resource_id, fhir.source_resource_type as source_resource_type",
+			"FROM fhir_observation as fhir, json_each(fhir.category) as categoryJson",
+			"WHERE ((categoryJson.value ->> '$.code' = ? AND categoryJson.value ->> '$.system' = ?)) AND (user_id = ?)",
+			"GROUP BY `fhir`.`id`",
+			"ORDER BY fhir.sort_date DESC NULLS LAST, fhir.id DESC",
+		}, " "), sqlString)
+	require.Equal(suite.T(), sqlParams, []interface{}{
+		"vital-signs", "http://terminology.hl7.org/CodeSystem/observation-category", "00000000-0000-0000-0000-000000000000",
+	})
+}
+
+func (suite *RepositorySqlTestSuite) TestQueryResources_SQL_WithCursor() {
+	//setup
+	sqliteRepo := suite.TestRepository.(*GormRepository)
+	sqliteRepo.GormClient = sqliteRepo.GormClient.Session(&gorm.Session{DryRun: true})
+
+	//test
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+	sortDate := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	sqlQuery, err := sqliteRepo.sqlQueryResources(authContext, models.QueryResource{
+		Select: []string{},
+		Where: map[string]interface{}{
+			"code": "test_code",
+		},
+		From:   "Observation",
+		Limit:  lo.ToPtr(10),
+		Cursor: encodePaginationCursor(paginationCursor{SortDate: &sortDate, ID: uuid.MustParse("1b2b3c4d-0000-0000-0000-000000000000")}),
+	})
+	require.NoError(suite.T(), err)
+	var results []map[string]interface{}
+	statement := sqlQuery.Find(&results).Statement
+	sqlString := statement.SQL.String()
+	sqlParams := statement.Vars
+
+	//assert
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(),
+		strings.Join([]string{
+			"SELECT fhir.*",
+			"FROM fhir_observation as fhir, json_each(fhir.code) as codeJson",
+			"WHERE (((codeJson.value ->> '$.code' = ?)) AND (user_id = ?)) AND ((fhir.sort_date < ? OR (fhir.sort_date = ? AND fhir.id < ?) OR fhir.sort_date IS NULL))",
+			"GROUP BY `fhir`.`id`",
+			"ORDER BY fhir.sort_date DESC NULLS LAST, fhir.id DESC",
+			"LIMIT 10",
+		}, " "), sqlString)
+	require.Equal(suite.T(), sqlParams, []interface{}{
+		"test_code", "00000000-0000-0000-0000-000000000000", sortDate, sortDate, "1b2b3c4d-0000-0000-0000-000000000000",
+	})
+}
+
+func (suite *RepositorySqlTestSuite) TestQueryResources_SQL_WithSort() {
+	//setup
+	sqliteRepo := suite.TestRepository.(*GormRepository)
+	sqliteRepo.GormClient = sqliteRepo.GormClient.Session(&gorm.Session{DryRun: true})
+
+	//test
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	sqlQuery, err := sqliteRepo.sqlQueryResources(authContext, models.QueryResource{
+		Select: []string{},
+		Where: map[string]interface{}{
+			"code": "test_code",
+		},
+		From:  "Observation",
+		Sort:  []string{"-date", "id"},
+		Limit: lo.ToPtr(10),
+	})
+	require.NoError(suite.T(), err)
+	var results []map[string]interface{}
+	statement := sqlQuery.Find(&results).Statement
+	sqlString := statement.SQL.String()
+	sqlParams := statement.Vars
+
+	//assert
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(),
+		strings.Join([]string{
+			"SELECT fhir.*",
+			"FROM fhir_observation as fhir, json_each(fhir.code) as codeJson",
+			"WHERE ((codeJson.value ->> '$.code' = ?)) AND (user_id = ?)",
+			"GROUP BY `fhir`.`id`",
+			"ORDER BY fhir.date DESC NULLS LAST, fhir.id ASC NULLS LAST, fhir.id ASC",
+			"LIMIT 10",
+		}, " "), sqlString)
+	require.Equal(suite.T(), sqlParams, []interface{}{
+		"test_code", "00000000-0000-0000-0000-000000000000",
+	})
+}
+
+func (suite *RepositorySqlTestSuite) TestQueryResources_SQL_WithSort_ComplexSearchParameter() {
+	//setup
+	sqliteRepo := suite.TestRepository.(*GormRepository)
+	sqliteRepo.GormClient = sqliteRepo.GormClient.Session(&gorm.Session{DryRun: true})
+
+	//test
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	_, err := sqliteRepo.sqlQueryResources(authContext, models.QueryResource{
+		From: "Observation",
+		Sort: []string{"-code"},
+	})
+
+	//assert
+	require.EqualError(suite.T(), err, "cannot sort by -code, only number, date, uri and keyword search parameters are supported")
+}
+
+func (suite *RepositorySqlTestSuite) TestQueryResources_SQL_WithDateBucketCountByAndSeriesBy() {
+	//setup
+	sqliteRepo := suite.TestRepository.(*GormRepository)
+	sqliteRepo.GormClient = sqliteRepo.GormClient.Session(&gorm.Session{DryRun: true})
+
+	//test
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	sqlQuery, err := sqliteRepo.sqlQueryResources(authContext, models.QueryResource{
+		Select: []string{},
+		Where:  map[string]interface{}{},
+		From:   "Encounter",
+		Aggregations: &models.QueryResourceAggregations{
+			CountBy:  &models.QueryResourceAggregation{Field: "date", Bucket: "month"},
+			SeriesBy: &models.QueryResourceAggregation{Field: "class:code"},
+		},
+	})
+	require.NoError(suite.T(), err)
+	var results []map[string]interface{}
+	statement := sqlQuery.Find(&results).Statement
+	sqlString := statement.SQL.String()
+	sqlParams := statement.Vars
+
+	//assert
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(),
+		strings.Join([]string{
+			"SELECT (classJson.value ->> '$.code') as series, count(*) as value, strftime('%Y-%m', fhir.date) as label",
+			"FROM fhir_encounter as fhir, json_each(fhir.class) as classJson",
+			"WHERE (user_id = ?)",
+			"GROUP BY strftime('%Y-%m', fhir.date), (classJson.value ->> '$.code')",
+			"ORDER BY strftime('%Y-%m', fhir.date) ASC, (classJson.value ->> '$.code') ASC",
+		}, " "), sqlString)
+	require.Equal(suite.T(), sqlParams, []interface{}{
+		"00000000-0000-0000-0000-000000000000",
+	})
+}
+
+func (suite *RepositorySqlTestSuite) TestQueryResources_SQL_WithDateBucketGroupByAndOrderByFn() {
+	//setup
+	sqliteRepo := suite.TestRepository.(*GormRepository)
+	sqliteRepo.GormClient = sqliteRepo.GormClient.Session(&gorm.Session{DryRun: true})
+
+	//test
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	sqlQuery, err := sqliteRepo.sqlQueryResources(authContext, models.QueryResource{
+		Select: []string{},
+		Where:  map[string]interface{}{"code": "http://loinc.org|4548-4"},
+		From:   "Observation",
+		Aggregations: &models.QueryResourceAggregations{
+			GroupBy: &models.QueryResourceAggregation{Field: "date", Bucket: "quarter"},
+			OrderBy: &models.QueryResourceAggregation{Field: "valueQuantity:value", Function: "avg"},
+		},
+	})
+	require.NoError(suite.T(), err)
+	var results []map[string]interface{}
+	statement := sqlQuery.Find(&results).Statement
+	sqlString := statement.SQL.String()
+	sqlParams := statement.Vars
+
+	//assert
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(),
+		strings.Join([]string{
+			"SELECT (strftime('%Y', fhir.date) || '-Q' || ((CAST(strftime('%m', fhir.date) AS INTEGER) + 2) / 3)) as label, COALESCE(valueQuantityJson.value ->> '$.code', valueQuantityJson.value ->> '$.unit') as unit, avg((valueQuantityJson.value ->> '$.value')) as value",
+			"FROM fhir_observation as fhir, json_each(fhir.code) as codeJson, json_each(fhir.valueQuantity) as valueQuantityJson",
+			"WHERE ((codeJson.value ->> '$.code' = ? AND codeJson.value ->> '$.system' = ?)) AND (user_id = ?)",
+			"GROUP BY (strftime('%Y', fhir.date) || '-Q' || ((CAST(strftime('%m', fhir.date) AS INTEGER) + 2) / 3)), COALESCE(valueQuantityJson.value ->> '$.code', valueQuantityJson.value ->> '$.unit')",
+			"ORDER BY (strftime('%Y', fhir.date) || '-Q' || ((CAST(strftime('%m', fhir.date) AS INTEGER) + 2) / 3)), COALESCE(valueQuantityJson.value ->> '$.code', valueQuantityJson.value ->> '$.unit') ASC",
+		}, " "), sqlString)
+	require.Equal(suite.T(), sqlParams, []interface{}{
+		"4548-4", "http://loinc.org", "00000000-0000-0000-0000-000000000000",
+	})
+}
+
+func (suite *RepositorySqlTestSuite) TestQueryResources_SQL_WithQuantityAggregationGroupedByUnit() {
+	//setup
+	sqliteRepo := suite.TestRepository.(*GormRepository)
+	sqliteRepo.GormClient = sqliteRepo.GormClient.Session(&gorm.Session{DryRun: true})
+
+	//test
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	sqlQuery, err := sqliteRepo.sqlQueryResources(authContext, models.QueryResource{
+		Select: []string{},
+		Where:  map[string]interface{}{},
+		From:   "Observation",
+		Aggregations: &models.QueryResourceAggregations{
+			GroupBy: &models.QueryResourceAggregation{Field: "code:code"},
+			OrderBy: &models.QueryResourceAggregation{Field: "valueQuantity:value", Function: "avg"},
+		},
+	})
+	require.NoError(suite.T(), err)
+	var results []map[string]interface{}
+	statement := sqlQuery.Find(&results).Statement
+	sqlString := statement.SQL.String()
+	sqlParams := statement.Vars
+
+	//assert
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(),
+		strings.Join([]string{
+			"SELECT (codeJson.value ->> '$.code') as label, COALESCE(valueQuantityJson.value ->> '$.code', valueQuantityJson.value ->> '$.unit') as unit, avg((valueQuantityJson.value ->> '$.value')) as value",
+			"FROM fhir_observation as fhir, json_each(fhir.code) as codeJson, json_each(fhir.valueQuantity) as valueQuantityJson",
+			"WHERE (user_id = ?)",
+			"GROUP BY (codeJson.value ->> '$.code'), COALESCE(valueQuantityJson.value ->> '$.code', valueQuantityJson.value ->> '$.unit')",
+			"ORDER BY avg((valueQuantityJson.value ->> '$.value')) ASC",
+		}, " "), sqlString)
+	require.Equal(suite.T(), sqlParams, []interface{}{
+		"00000000-0000-0000-0000-000000000000",
+	})
+}
+
+func (suite *RepositorySqlTestSuite) TestQueryResources_SQL_WithQuantityAggregationConvertedToUnit() {
+	//setup
+	sqliteRepo := suite.TestRepository.(*GormRepository)
+	sqliteRepo.GormClient = sqliteRepo.GormClient.Session(&gorm.Session{DryRun: true})
+
+	//test
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	sqlQuery, err := sqliteRepo.sqlQueryResources(authContext, models.QueryResource{
+		Select: []string{},
+		Where:  map[string]interface{}{},
+		From:   "Observation",
+		Aggregations: &models.QueryResourceAggregations{
+			GroupBy: &models.QueryResourceAggregation{Field: "date", Bucket: "year"},
+			OrderBy: &models.QueryResourceAggregation{Field: "valueQuantity:value", Function: "max", Unit: "m"},
+		},
+	})
+	require.NoError(suite.T(), err)
+	var results []map[string]interface{}
+	statement := sqlQuery.Find(&results).Statement
+	sqlString := statement.SQL.String()
+	sqlParams := statement.Vars
+
+	//assert
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(),
+		strings.Join([]string{
+			"SELECT 'm' as unit, max((CASE COALESCE(valueQuantityJson.value ->> '$.code', valueQuantityJson.value ->> '$.unit') WHEN '[ft_i]' THEN (valueQuantityJson.value ->> '$.value') * 0.3048 WHEN '[in_i]' THEN (valueQuantityJson.value ->> '$.value') * 0.0254 WHEN 'cm' THEN (valueQuantityJson.value ->> '$.value') * 0.01 WHEN 'm' THEN (valueQuantityJson.value ->> '$.value') * 1 WHEN 'mm' THEN (valueQuantityJson.value ->> '$.value') * 0.001 END)) as value, strftime('%Y', fhir.date) as label",
+			"FROM fhir_observation as fhir, json_each(fhir.valueQuantity) as valueQuantityJson",
+			"WHERE (user_id = ?)",
+			"GROUP BY strftime('%Y', fhir.date)",
+			"ORDER BY strftime('%Y', fhir.date) ASC",
+		}, " "), sqlString)
+	require.Equal(suite.T(), sqlParams, []interface{}{
+		"00000000-0000-0000-0000-000000000000",
+	})
+}
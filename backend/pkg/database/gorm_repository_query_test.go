@@ -8,6 +8,7 @@ import (
 
 	"github.com/fastenhealth/fasten-onprem/backend/pkg"
 	mock_config "github.com/fastenhealth/fasten-onprem/backend/pkg/config/mock"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/errors"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
 	"github.com/sirupsen/logrus"
@@ -38,7 +39,16 @@ func TestProcessSearchParameter(t *testing.T) {
 		{"url:below", map[string]string{"url": "string"}, SearchParameter{Type: "string", Name: "url", Modifier: "below"}, false},
 		{"url:above", map[string]string{"url": "string"}, SearchParameter{Type: "string", Name: "url", Modifier: "above"}, false},
 
-		{"display:text", map[string]string{"display": "token"}, SearchParameter{}, true},
+		{"display:text", map[string]string{"display": "token"}, SearchParameter{Type: "token", Name: "display", Modifier: "text"}, false},
+		{"code:not", map[string]string{"code": "token"}, SearchParameter{Type: "token", Name: "code", Modifier: "not"}, false},
+		{"code:in", map[string]string{"code": "token"}, SearchParameter{}, true}, //unsupported token modifier should throw an error
+		{"code:missing", map[string]string{"code": "token"}, SearchParameter{Type: "token", Name: "code", Modifier: "missing"}, false},
+		{"date:missing", map[string]string{"date": "date"}, SearchParameter{Type: "date", Name: "date", Modifier: "missing"}, false},
+
+		{"encounter", map[string]string{"encounter": "reference"}, SearchParameter{Type: "reference", Name: "encounter", Modifier: ""}, false},
+		{"subject:Patient", map[string]string{"subject": "reference"}, SearchParameter{Type: "reference", Name: "subject", Modifier: "Patient"}, false},
+		{"subject:Unknown", map[string]string{"subject": "reference"}, SearchParameter{}, true}, //unknown resource type modifier should throw an error
+		{"subject:missing", map[string]string{"subject": "reference"}, SearchParameter{Type: "reference", Name: "subject", Modifier: "missing"}, false},
 	}
 
 	//test && assert
@@ -53,6 +63,104 @@ func TestProcessSearchParameter(t *testing.T) {
 	}
 }
 
+// mimic tests from https://hl7.org/fhir/r4/search.html#chaining
+func TestProcessChainedSearchParameter(t *testing.T) {
+	//setup
+	t.Parallel()
+	observationSearchParameterLookup := map[string]string{"encounter": "reference", "subject": "reference", "performer": "reference", "code": "token"}
+	var processChainedSearchParameterTests = []struct {
+		searchParameterWithModifier string // input
+		expected                    ChainedSearchParameter
+		expectedError               bool // expected result
+	}{
+		{"encounter.class", ChainedSearchParameter{
+			JoinResourceType:    "Encounter",
+			ReferenceParameter:  SearchParameter{Type: "reference", Name: "encounter"},
+			JoinSearchParameter: SearchParameter{Type: "token", Name: "class"},
+			Alias:               "encounterClass",
+		}, false},
+		{"subject.name:exact", ChainedSearchParameter{
+			JoinResourceType:    "Patient",
+			ReferenceParameter:  SearchParameter{Type: "reference", Name: "subject"},
+			JoinSearchParameter: SearchParameter{Type: "string", Name: "name", Modifier: "exact"},
+			Alias:               "subjectNameExact",
+		}, false},
+		{"subject:Group.name", ChainedSearchParameter{}, true}, //Group does not have a name search parameter
+		{"performer:Practitioner.name", ChainedSearchParameter{
+			JoinResourceType:    "Practitioner",
+			ReferenceParameter:  SearchParameter{Type: "reference", Name: "performer", Modifier: "Practitioner"},
+			JoinSearchParameter: SearchParameter{Type: "string", Name: "name"},
+			Alias:               "performerPractitionerName",
+		}, false},
+		{"performer.name", ChainedSearchParameter{}, true},         //ambiguous resource type
+		{"code.name", ChainedSearchParameter{}, true},              //not a reference
+		{"encounter.unknown", ChainedSearchParameter{}, true},      //unknown search parameter on the joined resource
+		{"encounter.subject.name", ChainedSearchParameter{}, true}, //only a single level of chaining is supported
+		{"encounter.", ChainedSearchParameter{}, true},             //missing search parameter
+		{"_has:Condition:encounter:code", ChainedSearchParameter{
+			JoinResourceType:    "Condition",
+			ReferenceParameter:  SearchParameter{Type: "reference", Name: "encounter"},
+			JoinSearchParameter: SearchParameter{Type: "token", Name: "code"},
+			Reverse:             true,
+			Alias:               "hasConditionEncounterCode",
+		}, false},
+		{"_has:Condition:encounter", ChainedSearchParameter{}, true},                                 //missing search parameter
+		{"_has:Unknown:encounter:code", ChainedSearchParameter{}, true},                              //unknown resource type
+		{"_has:Condition:code:code", ChainedSearchParameter{}, true},                                 //not a reference
+		{"_has:Condition:encounter:_has:Observation:encounter:code", ChainedSearchParameter{}, true}, //only a single level of chaining is supported
+	}
+
+	//test && assert
+	for ndx, tt := range processChainedSearchParameterTests {
+		actual, actualErr := ProcessChainedSearchParameter(tt.searchParameterWithModifier, observationSearchParameterLookup)
+		if tt.expectedError {
+			require.Error(t, actualErr, "Expected error but got none for processChainedSearchParameterTests[%d] %s", ndx, tt.searchParameterWithModifier)
+		} else {
+			require.NoError(t, actualErr, "Expected no error but got one for processChainedSearchParameterTests[%d] %s", ndx, tt.searchParameterWithModifier)
+			require.Equal(t, tt.expected, actual)
+		}
+	}
+}
+
+// mimic tests from https://hl7.org/fhir/r4/search.html#include
+func TestProcessIncludeParameter(t *testing.T) {
+	//setup
+	t.Parallel()
+	var processIncludeParameterTests = []struct {
+		includeParameter string // input
+		reverse          bool   // input
+		expected         IncludeParameter
+		expectedError    bool // expected result
+	}{
+		{"Observation:encounter", false, IncludeParameter{SourceResourceType: "Observation", SearchParameter: SearchParameter{Type: "reference", Name: "encounter"}}, false},
+		{"Observation:performer:Practitioner", false, IncludeParameter{SourceResourceType: "Observation", SearchParameter: SearchParameter{Type: "reference", Name: "performer"}, TargetResourceType: "Practitioner"}, false},
+		{"Observation:*", false, IncludeParameter{SourceResourceType: "Observation", SearchParameter: SearchParameter{Type: "reference", Name: "*"}}, false},
+		{"Provenance:target", true, IncludeParameter{SourceResourceType: "Provenance", SearchParameter: SearchParameter{Type: "reference", Name: "target"}, Reverse: true}, false},
+		{"Provenance:target:Observation", true, IncludeParameter{SourceResourceType: "Provenance", SearchParameter: SearchParameter{Type: "reference", Name: "target"}, TargetResourceType: "Observation", Reverse: true}, false},
+		{"Provenance:*", true, IncludeParameter{SourceResourceType: "Provenance", SearchParameter: SearchParameter{Type: "reference", Name: "*"}, Reverse: true}, false},
+
+		{"Observation", false, IncludeParameter{}, true},                              //missing search parameter
+		{"Encounter:subject", false, IncludeParameter{}, true},                        //include must start with the queried resource type
+		{"Observation:code", false, IncludeParameter{}, true},                         //not a reference
+		{"Observation:unknown", false, IncludeParameter{}, true},                      //unknown search parameter
+		{"Observation:performer:Unknown", false, IncludeParameter{}, true},            //unknown resource type
+		{"Unknown:target", true, IncludeParameter{}, true},                            //unknown resource type
+		{"Provenance:target:Patient", true, IncludeParameter{}, true},                 //revinclude must reference the queried resource type
+		{"Observation:performer:Practitioner:extra", false, IncludeParameter{}, true}, //too many parts
+	}
+
+	//test && assert
+	for ndx, tt := range processIncludeParameterTests {
+		actual, actualErr := ProcessIncludeParameter(tt.includeParameter, "Observation", tt.reverse)
+		if tt.expectedError {
+			require.Error(t, actualErr, "Expected error but got none for processIncludeParameterTests[%d] %s", ndx, tt.includeParameter)
+		} else {
+			require.NoError(t, actualErr, "Expected no error but got one for processIncludeParameterTests[%d] %s", ndx, tt.includeParameter)
+			require.Equal(t, tt.expected, actual)
+		}
+	}
+}
+
 // mimic tests from https://hl7.org/fhir/r4/search.html#token
 func TestProcessSearchParameterValue(t *testing.T) {
 	//setup
@@ -63,25 +171,33 @@ func TestProcessSearchParameterValue(t *testing.T) {
 		expected              SearchParameterValue
 		expectedError         bool // expected result
 	}{
-		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "gt0.8", SearchParameterValue{Value: 0.8, Prefix: "gt", SecondaryValues: map[string]interface{}{}}, false},
-		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "100", SearchParameterValue{Value: float64(100), Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
-		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "100.00", SearchParameterValue{Value: float64(100), Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
-		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "1e2", SearchParameterValue{Value: float64(100), Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
-		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "lt100", SearchParameterValue{Value: float64(100), Prefix: "lt", SecondaryValues: map[string]interface{}{}}, false},
-		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "le100", SearchParameterValue{Value: float64(100), Prefix: "le", SecondaryValues: map[string]interface{}{}}, false},
-		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "gt100", SearchParameterValue{Value: float64(100), Prefix: "gt", SecondaryValues: map[string]interface{}{}}, false},
-		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "ge100", SearchParameterValue{Value: float64(100), Prefix: "ge", SecondaryValues: map[string]interface{}{}}, false},
-		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "ne100", SearchParameterValue{Value: float64(100), Prefix: "ne", SecondaryValues: map[string]interface{}{}}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "gt0.8", SearchParameterValue{Value: 0.8, Prefix: "gt", SecondaryValues: map[string]interface{}{}, RangeLow: 0.75, RangeHigh: 0.85}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "100", SearchParameterValue{Value: float64(100), Prefix: "", SecondaryValues: map[string]interface{}{}, RangeLow: 99.5, RangeHigh: 100.5}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "100.00", SearchParameterValue{Value: float64(100), Prefix: "", SecondaryValues: map[string]interface{}{}, RangeLow: 99.995, RangeHigh: 100.005}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "1e2", SearchParameterValue{Value: float64(100), Prefix: "", SecondaryValues: map[string]interface{}{}, RangeLow: float64(50), RangeHigh: float64(150)}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "lt100", SearchParameterValue{Value: float64(100), Prefix: "lt", SecondaryValues: map[string]interface{}{}, RangeLow: 99.5, RangeHigh: 100.5}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "le100", SearchParameterValue{Value: float64(100), Prefix: "le", SecondaryValues: map[string]interface{}{}, RangeLow: 99.5, RangeHigh: 100.5}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "gt100", SearchParameterValue{Value: float64(100), Prefix: "gt", SecondaryValues: map[string]interface{}{}, RangeLow: 99.5, RangeHigh: 100.5}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "ge100", SearchParameterValue{Value: float64(100), Prefix: "ge", SecondaryValues: map[string]interface{}{}, RangeLow: 99.5, RangeHigh: 100.5}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "ne100", SearchParameterValue{Value: float64(100), Prefix: "ne", SecondaryValues: map[string]interface{}{}, RangeLow: 99.5, RangeHigh: 100.5}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "ap100", SearchParameterValue{Value: float64(100), Prefix: "ap", SecondaryValues: map[string]interface{}{}, RangeLow: 89.5, RangeHigh: 110.5}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "5.40e-3", SearchParameterValue{Value: 0.0054, Prefix: "", SecondaryValues: map[string]interface{}{}, RangeLow: 0.005395, RangeHigh: 0.005405}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "NaN", SearchParameterValue{}, true},        //not a decimal, invalid number error
 		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "unknown100", SearchParameterValue{}, true}, //unknown prefix, invalid number error
 		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, "", SearchParameterValue{}, true},           //empty string, invalid number error
 
-		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "eq2013-01-14", SearchParameterValue{Value: time.Date(2013, time.January, 14, 0, 0, 0, 0, time.UTC), Prefix: "eq", SecondaryValues: map[string]interface{}{}}, false},
-		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "ne2013-01-14", SearchParameterValue{Value: time.Date(2013, time.January, 14, 0, 0, 0, 0, time.UTC), Prefix: "ne", SecondaryValues: map[string]interface{}{}}, false},
-		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "lt2013-01-14T10:00:00Z", SearchParameterValue{Value: time.Date(2013, time.January, 14, 10, 0, 0, 0, time.UTC), Prefix: "lt", SecondaryValues: map[string]interface{}{}}, false},
+		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "eq2013-01-14", SearchParameterValue{Value: time.Date(2013, time.January, 14, 0, 0, 0, 0, time.UTC), Prefix: "eq", SecondaryValues: map[string]interface{}{}, RangeLow: time.Date(2013, time.January, 14, 0, 0, 0, 0, time.UTC), RangeHigh: time.Date(2013, time.January, 15, 0, 0, 0, 0, time.UTC)}, false},
+		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "ne2013-01-14", SearchParameterValue{Value: time.Date(2013, time.January, 14, 0, 0, 0, 0, time.UTC), Prefix: "ne", SecondaryValues: map[string]interface{}{}, RangeLow: time.Date(2013, time.January, 14, 0, 0, 0, 0, time.UTC), RangeHigh: time.Date(2013, time.January, 15, 0, 0, 0, 0, time.UTC)}, false},
+		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "lt2013-01-14T10:00:00Z", SearchParameterValue{Value: time.Date(2013, time.January, 14, 10, 0, 0, 0, time.UTC), Prefix: "lt", SecondaryValues: map[string]interface{}{}, RangeLow: time.Date(2013, time.January, 14, 10, 0, 0, 0, time.UTC), RangeHigh: time.Date(2013, time.January, 14, 10, 0, 1, 0, time.UTC)}, false},
+		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "2013", SearchParameterValue{Value: time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC), Prefix: "", SecondaryValues: map[string]interface{}{}, RangeLow: time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC), RangeHigh: time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)}, false},
+		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "gt2013-12", SearchParameterValue{Value: time.Date(2013, time.December, 1, 0, 0, 0, 0, time.UTC), Prefix: "gt", SecondaryValues: map[string]interface{}{}, RangeLow: time.Date(2013, time.December, 1, 0, 0, 0, 0, time.UTC), RangeHigh: time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)}, false},
+		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "2013-01-14T10:00:00.25Z", SearchParameterValue{Value: time.Date(2013, time.January, 14, 10, 0, 0, 250000000, time.UTC), Prefix: "", SecondaryValues: map[string]interface{}{}, RangeLow: time.Date(2013, time.January, 14, 10, 0, 0, 250000000, time.UTC), RangeHigh: time.Date(2013, time.January, 14, 10, 0, 0, 260000000, time.UTC)}, false},
 		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "lt2013-01-14T10:00", SearchParameterValue{}, true},          //missing seconds
 		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "lt2013-01-14T10:00Z", SearchParameterValue{}, true},         //missing timezone
 		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "unknown2013-01-14T10:00:00Z", SearchParameterValue{}, true}, //unkown prefix, causes invalid date error
 		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "", SearchParameterValue{}, true},                            //empty date, invalid date error
+		{SearchParameter{Type: "date", Name: "issueDate", Modifier: "missing"}, "true", SearchParameterValue{Value: true, Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
+		{SearchParameter{Type: "date", Name: "issueDate", Modifier: "missing"}, "yes", SearchParameterValue{}, true}, //missing must be true or false
 
 		{SearchParameter{Type: "string", Name: "given", Modifier: ""}, "eve", SearchParameterValue{Value: "eve", Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
 		{SearchParameter{Type: "string", Name: "given", Modifier: "contains"}, "eve", SearchParameterValue{Value: "eve", Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
@@ -105,20 +221,32 @@ func TestProcessSearchParameterValue(t *testing.T) {
 		{SearchParameter{Type: "token", Name: "code", Modifier: ""}, "|", SearchParameterValue{}, true}, //empty value should throw an error
 		{SearchParameter{Type: "token", Name: "code", Modifier: ""}, "", SearchParameterValue{}, true},  //empty value should throw an error
 		{SearchParameter{Type: "token", Name: "code", Modifier: ""}, "http://acme.org/conditions/codes|", SearchParameterValue{Value: "", Prefix: "", SecondaryValues: map[string]interface{}{"codeSystem": "http://acme.org/conditions/codes"}}, false},
+		{SearchParameter{Type: "token", Name: "code", Modifier: "text"}, "Body|Weight", SearchParameterValue{Value: "Body|Weight", Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
+		{SearchParameter{Type: "token", Name: "code", Modifier: "missing"}, "false", SearchParameterValue{Value: false, Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
 		{SearchParameter{Type: "token", Name: "code", Modifier: ""}, "|807-1", SearchParameterValue{Value: "807-1", Prefix: "", SecondaryValues: map[string]interface{}{"codeSystem": ""}}, false},
 
-		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "5.4|http://unitsofmeasure.org|mg", SearchParameterValue{Value: float64(5.4), Prefix: "", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "mg"}}, false},
-		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "5.40e-3|http://unitsofmeasure.org|g", SearchParameterValue{Value: float64(0.0054), Prefix: "", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "g"}}, false},
-		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "5.4||mg", SearchParameterValue{Value: float64(5.4), Prefix: "", SecondaryValues: map[string]interface{}{"valueQuantityCode": "mg"}}, false},
-		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "5.4", SearchParameterValue{Value: float64(5.4), Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
-		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "le5.4|http://unitsofmeasure.org|mg", SearchParameterValue{Value: float64(5.4), Prefix: "le", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "mg"}}, false},
-		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "ap5.4|http://unitsofmeasure.org|mg", SearchParameterValue{Value: float64(5.4), Prefix: "ap", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "mg"}}, false},
+		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "5.4|http://unitsofmeasure.org|mg", SearchParameterValue{Value: float64(5.4), Prefix: "", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "mg"}, RangeLow: 5.35, RangeHigh: 5.45}, false},
+		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "5.40e-3|http://unitsofmeasure.org|g", SearchParameterValue{Value: float64(0.0054), Prefix: "", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "g"}, RangeLow: 0.005395, RangeHigh: 0.005405}, false},
+		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "5.4||mg", SearchParameterValue{Value: float64(5.4), Prefix: "", SecondaryValues: map[string]interface{}{"valueQuantityCode": "mg"}, RangeLow: 5.35, RangeHigh: 5.45}, false},
+		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "5.4", SearchParameterValue{Value: float64(5.4), Prefix: "", SecondaryValues: map[string]interface{}{}, RangeLow: 5.35, RangeHigh: 5.45}, false},
+		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "le5.4|http://unitsofmeasure.org|mg", SearchParameterValue{Value: float64(5.4), Prefix: "le", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "mg"}, RangeLow: 5.35, RangeHigh: 5.45}, false},
+		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "ap5.4|http://unitsofmeasure.org|mg", SearchParameterValue{Value: float64(5.4), Prefix: "ap", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "mg"}, RangeLow: 4.81, RangeHigh: 5.99}, false},
 		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "unknown5.4", SearchParameterValue{}, true}, //unknown prefix, causes invalid number
-		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "ap5.4|http://unitsofmeasure.org|mg|additional", SearchParameterValue{Value: float64(5.4), Prefix: "ap", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "mg|additional"}}, false},
-		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "5.4||", SearchParameterValue{Value: float64(5.4), Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
+		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "ap5.4|http://unitsofmeasure.org|mg|additional", SearchParameterValue{Value: float64(5.4), Prefix: "ap", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "mg|additional"}, RangeLow: 4.81, RangeHigh: 5.99}, false},
+		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "5.4||", SearchParameterValue{Value: float64(5.4), Prefix: "", SecondaryValues: map[string]interface{}{}, RangeLow: 5.35, RangeHigh: 5.45}, false},
 		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, "", SearchParameterValue{}, true},
 
 		{SearchParameter{Type: "keyword", Name: "id", Modifier: ""}, "1234", SearchParameterValue{Value: "1234", SecondaryValues: map[string]interface{}{}}, false},
+
+		{SearchParameter{Type: "reference", Name: "encounter", Modifier: ""}, "Encounter/123", SearchParameterValue{Value: "Encounter/123", Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
+		{SearchParameter{Type: "reference", Name: "encounter", Modifier: ""}, "123", SearchParameterValue{Value: "123", Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
+		{SearchParameter{Type: "reference", Name: "subject", Modifier: "Patient"}, "123", SearchParameterValue{Value: "Patient/123", Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
+		{SearchParameter{Type: "reference", Name: "subject", Modifier: "Patient"}, "Patient/123", SearchParameterValue{Value: "Patient/123", Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
+		{SearchParameter{Type: "reference", Name: "subject", Modifier: "Patient"}, "Group/123", SearchParameterValue{}, true}, //modifier does not match reference type
+		{SearchParameter{Type: "reference", Name: "subject", Modifier: ""}, "http://acme.org/fhir/Patient/123", SearchParameterValue{Value: "http://acme.org/fhir/Patient/123", Prefix: "", SecondaryValues: map[string]interface{}{}}, false},
+		{SearchParameter{Type: "reference", Name: "encounter", Modifier: ""}, "urn:fastenhealth-fhir:a9a7bd2c-4bd6-4a0a-a4e1-e4a1e9c9c6b5:Encounter/123", SearchParameterValue{Value: "Encounter/123", Prefix: "", SecondaryValues: map[string]interface{}{"encounterSourceId": "a9a7bd2c-4bd6-4a0a-a4e1-e4a1e9c9c6b5"}}, false},
+		{SearchParameter{Type: "reference", Name: "encounter", Modifier: ""}, "urn:fastenhealth-fhir:Encounter/123", SearchParameterValue{}, true}, //invalid urn, missing source id
+		{SearchParameter{Type: "reference", Name: "encounter", Modifier: ""}, "", SearchParameterValue{}, true},                                    //empty reference, invalid reference error
 	}
 
 	//test && assert
@@ -133,6 +261,18 @@ func TestProcessSearchParameterValue(t *testing.T) {
 	}
 }
 
+// the `ap` range depends on the current time, so it cannot be included in the table tests above
+func TestProcessSearchParameterValue_DateApproximately(t *testing.T) {
+	t.Parallel()
+
+	//10% of the gap between now and 2000-01-01 is more than 2 years
+	actual, err := ProcessSearchParameterValue(SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "ap2000")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC), actual.Value)
+	require.True(t, actual.RangeLow.(time.Time).Before(time.Date(1998, time.January, 1, 0, 0, 0, 0, time.UTC)))
+	require.True(t, actual.RangeHigh.(time.Time).After(time.Date(2003, time.January, 1, 0, 0, 0, 0, time.UTC)))
+}
+
 func TestSearchCodeToWhereClause(t *testing.T) {
 	//setup
 	var searchCodeToWhereClauseTests = []struct {
@@ -143,27 +283,45 @@ func TestSearchCodeToWhereClause(t *testing.T) {
 		expectedNamedParams map[string]interface{}
 		expectedError       bool
 	}{
-		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, SearchParameterValue{Value: float64(100), Prefix: "gt", SecondaryValues: map[string]interface{}{}}, "0_0", "(probability > @probability_0_0)", map[string]interface{}{"probability_0_0": float64(100)}, false},
-		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, SearchParameterValue{Value: time.Date(2013, time.January, 14, 10, 0, 0, 0, time.UTC), Prefix: "lt", SecondaryValues: map[string]interface{}{}}, "1_1", "(issueDate < @issueDate_1_1)", map[string]interface{}{"issueDate_1_1": time.Date(2013, time.January, 14, 10, 0, 0, 0, time.UTC)}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, SearchParameterValue{Value: float64(100), Prefix: "gt", SecondaryValues: map[string]interface{}{}}, "0_0", "(fhir.probability > @probability_0_0)", map[string]interface{}{"probability_0_0": float64(100)}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, SearchParameterValue{Value: float64(100), Prefix: "", SecondaryValues: map[string]interface{}{}, RangeLow: 99.5, RangeHigh: 100.5}, "0_0", "(fhir.probability >= @probabilityLow_0_0 AND fhir.probability < @probabilityHigh_0_0)", map[string]interface{}{"probabilityLow_0_0": 99.5, "probabilityHigh_0_0": 100.5}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, SearchParameterValue{Value: float64(100), Prefix: "ne", SecondaryValues: map[string]interface{}{}, RangeLow: 99.5, RangeHigh: 100.5}, "0_0", "((fhir.probability < @probabilityLow_0_0 OR fhir.probability >= @probabilityHigh_0_0))", map[string]interface{}{"probabilityLow_0_0": 99.5, "probabilityHigh_0_0": 100.5}, false},
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, SearchParameterValue{Value: float64(100), Prefix: "le", SecondaryValues: map[string]interface{}{}, RangeLow: 99.5, RangeHigh: 100.5}, "0_0", "(fhir.probability <= @probability_0_0)", map[string]interface{}{"probability_0_0": float64(100)}, false},
+		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, SearchParameterValue{Value: time.Date(2013, time.January, 14, 10, 0, 0, 0, time.UTC), Prefix: "lt", SecondaryValues: map[string]interface{}{}}, "1_1", "(fhir.issueDate < @issueDate_1_1)", map[string]interface{}{"issueDate_1_1": time.Date(2013, time.January, 14, 10, 0, 0, 0, time.UTC)}, false},
+		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, SearchParameterValue{Value: time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC), Prefix: "", SecondaryValues: map[string]interface{}{}, RangeLow: time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC), RangeHigh: time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)}, "0_0", "(fhir.issueDate >= @issueDateLow_0_0 AND fhir.issueDate < @issueDateHigh_0_0)", map[string]interface{}{"issueDateLow_0_0": time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC), "issueDateHigh_0_0": time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)}, false},
+		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, SearchParameterValue{Value: time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC), Prefix: "gt", SecondaryValues: map[string]interface{}{}, RangeLow: time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC), RangeHigh: time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)}, "0_0", "(fhir.issueDate >= @issueDateHigh_0_0)", map[string]interface{}{"issueDateHigh_0_0": time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)}, false},
+		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, SearchParameterValue{Value: time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC), Prefix: "le", SecondaryValues: map[string]interface{}{}, RangeLow: time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC), RangeHigh: time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)}, "0_0", "(fhir.issueDate < @issueDateHigh_0_0)", map[string]interface{}{"issueDateHigh_0_0": time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)}, false},
+		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, SearchParameterValue{Value: time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC), Prefix: "ge", SecondaryValues: map[string]interface{}{}, RangeLow: time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC), RangeHigh: time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)}, "0_0", "(fhir.issueDate >= @issueDate_0_0)", map[string]interface{}{"issueDate_0_0": time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC)}, false},
+		{SearchParameter{Type: "date", Name: "issueDate", Modifier: "missing"}, SearchParameterValue{Value: true, Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(fhir.issueDate IS NULL)", map[string]interface{}{}, false},
 
 		{SearchParameter{Type: "string", Name: "given", Modifier: ""}, SearchParameterValue{Value: "eve", Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(givenJson.value LIKE @given_0_0)", map[string]interface{}{"given_0_0": "eve%"}, false},
 		{SearchParameter{Type: "string", Name: "given", Modifier: "contains"}, SearchParameterValue{Value: "eve", Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(givenJson.value LIKE @given_0_0)", map[string]interface{}{"given_0_0": "%eve%"}, false},
 		{SearchParameter{Type: "string", Name: "given", Modifier: "exact"}, SearchParameterValue{Value: "eve", Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(givenJson.value = @given_0_0)", map[string]interface{}{"given_0_0": "eve"}, false},
 
-		{SearchParameter{Type: "uri", Name: "url", Modifier: "below"}, SearchParameterValue{Value: "http://acme.org/fhir/", Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(url LIKE @url_0_0)", map[string]interface{}{"url_0_0": "http://acme.org/fhir/%"}, false},
-		{SearchParameter{Type: "uri", Name: "url", Modifier: "above"}, SearchParameterValue{Value: "http://acme.org/fhir/", Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "", map[string]interface{}{}, true}, //above modifier not supported
+		{SearchParameter{Type: "uri", Name: "url", Modifier: "below"}, SearchParameterValue{Value: "http://acme.org/fhir/", Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(fhir.url LIKE @url_0_0)", map[string]interface{}{"url_0_0": "http://acme.org/fhir/%"}, false},
+		{SearchParameter{Type: "uri", Name: "url", Modifier: "above"}, SearchParameterValue{Value: "http://acme.org/fhir/", Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(@url_0_0 LIKE fhir.url || '%')", map[string]interface{}{"url_0_0": "http://acme.org/fhir/"}, false},
 
-		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, SearchParameterValue{Value: float64(5.4), Prefix: "", SecondaryValues: map[string]interface{}{"valueQuantityCode": "mg"}}, "0_0", "(valueQuantityJson.value ->> '$.value' = @valueQuantity_0_0 AND valueQuantityJson.value ->> '$.code' = @valueQuantityCode_0_0)", map[string]interface{}{"valueQuantity_0_0": float64(5.4), "valueQuantityCode_0_0": "mg"}, false},
-		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, SearchParameterValue{Value: float64(5.4), Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(valueQuantityJson.value ->> '$.value' = @valueQuantity_0_0)", map[string]interface{}{"valueQuantity_0_0": float64(5.4)}, false},
+		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, SearchParameterValue{Value: float64(5.4), Prefix: "", SecondaryValues: map[string]interface{}{"valueQuantityCode": "mg"}, RangeLow: 5.35, RangeHigh: 5.45}, "0_0", "(valueQuantityJson.value ->> '$.value' >= @valueQuantityLow_0_0 AND valueQuantityJson.value ->> '$.value' < @valueQuantityHigh_0_0 AND valueQuantityJson.value ->> '$.code' = @valueQuantityCode_0_0)", map[string]interface{}{"valueQuantityLow_0_0": 5.35, "valueQuantityHigh_0_0": 5.45, "valueQuantityCode_0_0": "mg"}, false},
+		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, SearchParameterValue{Value: float64(5.4), Prefix: "", SecondaryValues: map[string]interface{}{}, RangeLow: 5.35, RangeHigh: 5.45}, "0_0", "(valueQuantityJson.value ->> '$.value' >= @valueQuantityLow_0_0 AND valueQuantityJson.value ->> '$.value' < @valueQuantityHigh_0_0)", map[string]interface{}{"valueQuantityLow_0_0": 5.35, "valueQuantityHigh_0_0": 5.45}, false},
 		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, SearchParameterValue{Value: float64(5.4), Prefix: "le", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "mg"}}, "0_0", "(valueQuantityJson.value ->> '$.value' <= @valueQuantity_0_0 AND valueQuantityJson.value ->> '$.code' = @valueQuantityCode_0_0 AND valueQuantityJson.value ->> '$.system' = @valueQuantitySystem_0_0)", map[string]interface{}{"valueQuantity_0_0": float64(5.4), "valueQuantitySystem_0_0": "http://unitsofmeasure.org", "valueQuantityCode_0_0": "mg"}, false},
-		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, SearchParameterValue{Value: float64(5.4), Prefix: "ap", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "mg"}}, "0_0", "", map[string]interface{}{}, true}, //ap modifier not supported
-		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, SearchParameterValue{Value: float64(5.4), Prefix: "ne", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "mg"}}, "0_0", "(valueQuantityJson.value ->> '$.value' <> @valueQuantity_0_0 AND valueQuantityJson.value ->> '$.code' = @valueQuantityCode_0_0 AND valueQuantityJson.value ->> '$.system' = @valueQuantitySystem_0_0)", map[string]interface{}{"valueQuantity_0_0": float64(5.4), "valueQuantitySystem_0_0": "http://unitsofmeasure.org", "valueQuantityCode_0_0": "mg"}, false},
+		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, SearchParameterValue{Value: float64(5.4), Prefix: "ap", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "mg"}, RangeLow: 4.81, RangeHigh: 5.99}, "0_0", "(valueQuantityJson.value ->> '$.value' >= @valueQuantityLow_0_0 AND valueQuantityJson.value ->> '$.value' < @valueQuantityHigh_0_0 AND valueQuantityJson.value ->> '$.code' = @valueQuantityCode_0_0 AND valueQuantityJson.value ->> '$.system' = @valueQuantitySystem_0_0)", map[string]interface{}{"valueQuantityLow_0_0": 4.81, "valueQuantityHigh_0_0": 5.99, "valueQuantitySystem_0_0": "http://unitsofmeasure.org", "valueQuantityCode_0_0": "mg"}, false},
+		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, SearchParameterValue{Value: float64(5.4), Prefix: "ne", SecondaryValues: map[string]interface{}{"valueQuantitySystem": "http://unitsofmeasure.org", "valueQuantityCode": "mg"}, RangeLow: 5.35, RangeHigh: 5.45}, "0_0", "((valueQuantityJson.value ->> '$.value' < @valueQuantityLow_0_0 OR valueQuantityJson.value ->> '$.value' >= @valueQuantityHigh_0_0) AND valueQuantityJson.value ->> '$.code' = @valueQuantityCode_0_0 AND valueQuantityJson.value ->> '$.system' = @valueQuantitySystem_0_0)", map[string]interface{}{"valueQuantityLow_0_0": 5.35, "valueQuantityHigh_0_0": 5.45, "valueQuantitySystem_0_0": "http://unitsofmeasure.org", "valueQuantityCode_0_0": "mg"}, false},
+		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: "missing"}, SearchParameterValue{Value: false, Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(fhir.valueQuantity IS NOT NULL AND fhir.valueQuantity NOT IN ('null', '[]'))", map[string]interface{}{}, false},
 
 		{SearchParameter{Type: "token", Name: "code", Modifier: ""}, SearchParameterValue{Value: "ha125", Prefix: "", SecondaryValues: map[string]interface{}{"codeSystem": "http://acme.org/conditions/codes"}}, "0_0", "(codeJson.value ->> '$.code' = @code_0_0 AND codeJson.value ->> '$.system' = @codeSystem_0_0)", map[string]interface{}{"code_0_0": "ha125", "codeSystem_0_0": "http://acme.org/conditions/codes"}, false},
 		{SearchParameter{Type: "token", Name: "code", Modifier: ""}, SearchParameterValue{Value: "ha125", Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(codeJson.value ->> '$.code' = @code_0_0)", map[string]interface{}{"code_0_0": "ha125"}, false},
 		{SearchParameter{Type: "token", Name: "identifier", Modifier: "otype"}, SearchParameterValue{Value: "MR|446053", Prefix: "", SecondaryValues: map[string]interface{}{"identifierSystem": "http://terminology.hl7.org/CodeSystem/v2-0203"}}, "0_0", "(identifierJson.value ->> '$.code' = @identifier_0_0 AND identifierJson.value ->> '$.system' = @identifierSystem_0_0)", map[string]interface{}{"identifier_0_0": "MR|446053", "identifierSystem_0_0": "http://terminology.hl7.org/CodeSystem/v2-0203"}, false},
 
-		{SearchParameter{Type: "keyword", Name: "id", Modifier: ""}, SearchParameterValue{Value: "1234", Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(id = @id_0_0)", map[string]interface{}{"id_0_0": "1234"}, false},
+		{SearchParameter{Type: "token", Name: "code", Modifier: "text"}, SearchParameterValue{Value: "weight", Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(codeJson.value ->> '$.text' LIKE @code_0_0)", map[string]interface{}{"code_0_0": "%weight%"}, false},
+		{SearchParameter{Type: "token", Name: "code", Modifier: "not"}, SearchParameterValue{Value: "ha125", Prefix: "", SecondaryValues: map[string]interface{}{"codeSystem": "http://acme.org/conditions/codes"}}, "0_0", "(NOT EXISTS (SELECT 1 FROM json_each(fhir.code) as codeJson WHERE codeJson.value ->> '$.code' = @code_0_0 AND codeJson.value ->> '$.system' = @codeSystem_0_0))", map[string]interface{}{"code_0_0": "ha125", "codeSystem_0_0": "http://acme.org/conditions/codes"}, false},
+		{SearchParameter{Type: "token", Name: "code", Modifier: "missing"}, SearchParameterValue{Value: true, Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(fhir.code IS NULL OR fhir.code IN ('null', '[]'))", map[string]interface{}{}, false},
+
+		{SearchParameter{Type: "keyword", Name: "id", Modifier: ""}, SearchParameterValue{Value: "1234", Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(fhir.id = @id_0_0)", map[string]interface{}{"id_0_0": "1234"}, false},
+		{SearchParameter{Type: "keyword", Name: "id", Modifier: "not"}, SearchParameterValue{Value: "1234", Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(fhir.id <> @id_0_0 OR fhir.id IS NULL)", map[string]interface{}{"id_0_0": "1234"}, false},
+
+		{SearchParameter{Type: "reference", Name: "encounter", Modifier: ""}, SearchParameterValue{Value: "Encounter/123", Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(encounterJson.value ->> '$.reference' = @encounter_0_0)", map[string]interface{}{"encounter_0_0": "Encounter/123"}, false},
+		{SearchParameter{Type: "reference", Name: "encounter", Modifier: ""}, SearchParameterValue{Value: "123", Prefix: "", SecondaryValues: map[string]interface{}{}}, "0_0", "(encounterJson.value ->> '$.reference' = @encounter_0_0 OR encounterJson.value ->> '$.reference' LIKE @encounterId_0_0)", map[string]interface{}{"encounter_0_0": "123", "encounterId_0_0": "%/123"}, false},
+		{SearchParameter{Type: "reference", Name: "encounter", Modifier: ""}, SearchParameterValue{Value: "Encounter/123", Prefix: "", SecondaryValues: map[string]interface{}{"encounterSourceId": "a9a7bd2c-4bd6-4a0a-a4e1-e4a1e9c9c6b5"}}, "0_0", "(encounterJson.value ->> '$.reference' = @encounterUrn_0_0 OR (encounterJson.value ->> '$.reference' = @encounter_0_0 AND fhir.source_id = @encounterSourceId_0_0))", map[string]interface{}{"encounter_0_0": "Encounter/123", "encounterSourceId_0_0": "a9a7bd2c-4bd6-4a0a-a4e1-e4a1e9c9c6b5", "encounterUrn_0_0": "urn:fastenhealth-fhir:a9a7bd2c-4bd6-4a0a-a4e1-e4a1e9c9c6b5:Encounter/123"}, false},
 	}
 
 	//test && assert
@@ -192,6 +350,10 @@ func TestSearchCodeToFromClause(t *testing.T) {
 		{SearchParameter{Type: "date", Name: "issueDate", Modifier: ""}, "", false},
 		{SearchParameter{Type: "keyword", Name: "id", Modifier: ""}, "", false},
 		{SearchParameter{Type: "token", Name: "hello", Modifier: ""}, "json_each(fhir.hello) as helloJson", false},
+		{SearchParameter{Type: "reference", Name: "basedOn", Modifier: ""}, "json_each(fhir.basedOn) as basedOnJson", false},
+		{SearchParameter{Type: "token", Name: "hello", Modifier: "not"}, "", false},
+		{SearchParameter{Type: "token", Name: "hello", Modifier: "text"}, "json_each(fhir.hello) as helloJson", false},
+		{SearchParameter{Type: "reference", Name: "basedOn", Modifier: "missing"}, "", false},
 	}
 
 	//test && assert
@@ -207,6 +369,35 @@ func TestSearchCodeToFromClause(t *testing.T) {
 
 }
 
+func TestSearchCodeToWhereClause_Postgres(t *testing.T) {
+	//setup
+	var searchCodeToWhereClauseTests = []struct {
+		searchParameter     SearchParameter
+		searchValue         SearchParameterValue
+		expectedFromClause  string
+		expectedWhereClause string
+	}{
+		{SearchParameter{Type: "number", Name: "probability", Modifier: ""}, SearchParameterValue{Value: float64(100), Prefix: "gt", SecondaryValues: map[string]interface{}{}}, "", `(fhir."probability" > @probability_0_0)`},
+		{SearchParameter{Type: "keyword", Name: "id", Modifier: "not"}, SearchParameterValue{Value: "1234", Prefix: "", SecondaryValues: map[string]interface{}{}}, "", `(fhir."id" <> @id_0_0 OR fhir."id" IS NULL)`},
+		{SearchParameter{Type: "string", Name: "given", Modifier: ""}, SearchParameterValue{Value: "eve", Prefix: "", SecondaryValues: map[string]interface{}{}}, `jsonb_array_elements(CASE WHEN jsonb_typeof(fhir."given"::jsonb) = 'array' THEN fhir."given"::jsonb END) as givenJson`, "((givenJson.value #>> '{}') LIKE @given_0_0)"},
+		{SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: ""}, SearchParameterValue{Value: float64(5.4), Prefix: "le", SecondaryValues: map[string]interface{}{"valueQuantityCode": "mg"}}, `jsonb_array_elements(CASE WHEN jsonb_typeof(fhir."valueQuantity"::jsonb) = 'array' THEN fhir."valueQuantity"::jsonb END) as valueQuantityJson`, "((valueQuantityJson.value ->> 'value')::numeric <= @valueQuantity_0_0 AND valueQuantityJson.value ->> 'code' = @valueQuantityCode_0_0)"},
+		{SearchParameter{Type: "token", Name: "code", Modifier: "not"}, SearchParameterValue{Value: "ha125", Prefix: "", SecondaryValues: map[string]interface{}{}}, "", `(NOT EXISTS (SELECT 1 FROM jsonb_array_elements(CASE WHEN jsonb_typeof(fhir."code"::jsonb) = 'array' THEN fhir."code"::jsonb END) as codeJson WHERE codeJson.value ->> 'code' = @code_0_0))`},
+		{SearchParameter{Type: "token", Name: "code", Modifier: ""}, SearchParameterValue{Value: "ha125", Prefix: "", SecondaryValues: map[string]interface{}{"codeSystem": "http://acme.org/conditions/codes"}}, `jsonb_array_elements(CASE WHEN jsonb_typeof(fhir."code"::jsonb) = 'array' THEN fhir."code"::jsonb END) as codeJson`, "(codeJson.value ->> 'code' = @code_0_0 AND codeJson.value ->> 'system' = @codeSystem_0_0)"},
+		{SearchParameter{Type: "reference", Name: "encounter", Modifier: ""}, SearchParameterValue{Value: "Encounter/123", Prefix: "", SecondaryValues: map[string]interface{}{"encounterSourceId": "a9a7bd2c-4bd6-4a0a-a4e1-e4a1e9c9c6b5"}}, `jsonb_array_elements(CASE WHEN jsonb_typeof(fhir."encounter"::jsonb) = 'array' THEN fhir."encounter"::jsonb END) as encounterJson`, `(encounterJson.value ->> 'reference' = @encounterUrn_0_0 OR (encounterJson.value ->> 'reference' = @encounter_0_0 AND fhir."source_id" = @encounterSourceId_0_0))`},
+	}
+
+	//test && assert
+	for ndx, tt := range searchCodeToWhereClauseTests {
+		actualWhereClause, _, actualErr := searchCodeToWhereClause(pkg.DatabaseRepositoryTypePostgres, TABLE_ALIAS, tt.searchParameter, tt.searchValue, "0_0")
+		require.NoError(t, actualErr, "Expected no error but got one for searchCodeToWhereClausePostgresTests[%d] %s=%s", ndx, tt.searchParameter.Name, tt.searchValue.Value)
+		require.Equal(t, tt.expectedWhereClause, actualWhereClause)
+
+		actualFromClause, actualErr := searchCodeToFromClause(pkg.DatabaseRepositoryTypePostgres, TABLE_ALIAS, tt.searchParameter)
+		require.NoError(t, actualErr, "Expected no error but got one for searchCodeToWhereClausePostgresTests[%d] %s", ndx, tt.searchParameter.Name)
+		require.Equal(t, tt.expectedFromClause, actualFromClause)
+	}
+}
+
 //Aggregation tests
 
 // mimic tests from https://hl7.org/fhir/r4/search.html#token
@@ -242,6 +433,21 @@ func TestProcessAggregationParameter(t *testing.T) {
 		//token type
 		{models.QueryResourceAggregation{Field: "code"}, map[string]string{"code": "token"}, AggregationParameter{SearchParameter: SearchParameter{Type: "token", Name: "code", Modifier: ""}}, false},
 		{models.QueryResourceAggregation{Field: "code:code"}, map[string]string{"code": "token"}, AggregationParameter{SearchParameter: SearchParameter{Type: "token", Name: "code", Modifier: "code"}}, false},
+
+		//date buckets
+		{models.QueryResourceAggregation{Field: "date", Bucket: "month"}, map[string]string{"date": "date"}, AggregationParameter{SearchParameter: SearchParameter{Type: "date", Name: "date", Modifier: ""}, Bucket: "month"}, false},
+		{models.QueryResourceAggregation{Field: "date", Bucket: "decade"}, map[string]string{"date": "date"}, AggregationParameter{}, true},      //unknown bucket
+		{models.QueryResourceAggregation{Field: "code:code", Bucket: "month"}, map[string]string{"code": "token"}, AggregationParameter{}, true}, //only date types can be bucketed
+
+		//functions
+		{models.QueryResourceAggregation{Field: "valueQuantity:value", Function: "avg"}, map[string]string{"valueQuantity": "quantity"}, AggregationParameter{SearchParameter: SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: "value"}, Function: "avg"}, false},
+		{models.QueryResourceAggregation{Field: "valueQuantity:value", Function: "max", Unit: "mg/dL"}, map[string]string{"valueQuantity": "quantity"}, AggregationParameter{SearchParameter: SearchParameter{Type: "quantity", Name: "valueQuantity", Modifier: "value"}, Function: "max", Unit: "mg/dL"}, false},
+		{models.QueryResourceAggregation{Field: "sort_date", Function: "max"}, map[string]string{"sort_date": "date"}, AggregationParameter{SearchParameter: SearchParameter{Type: "date", Name: "sort_date"}, Function: "max"}, false},
+		{models.QueryResourceAggregation{Field: "valueQuantity:value", Function: "avg) FROM users; --"}, map[string]string{"valueQuantity": "quantity"}, AggregationParameter{}, true},  //unknown function
+		{models.QueryResourceAggregation{Field: "code:code", Function: "sum"}, map[string]string{"code": "token"}, AggregationParameter{}, true},                                        //sum requires a numeric parameter
+		{models.QueryResourceAggregation{Field: "valueQuantity:unit", Function: "avg"}, map[string]string{"valueQuantity": "quantity"}, AggregationParameter{}, true},                   //avg requires a numeric parameter
+		{models.QueryResourceAggregation{Field: "valueQuantity:value", Function: "avg", Unit: "furlong"}, map[string]string{"valueQuantity": "quantity"}, AggregationParameter{}, true}, //unsupported unit
+		{models.QueryResourceAggregation{Field: "valueQuantity:value", Function: "count", Unit: "mg/dL"}, map[string]string{"valueQuantity": "quantity"}, AggregationParameter{}, true}, //unit requires a numeric function
 	}
 
 	//test && assert
@@ -299,8 +505,107 @@ func (suite *RepositoryTestSuite) TestQueryResources_SQL() {
 			"SELECT fhir.*",
 			"FROM fhir_observation as fhir, json_each(fhir.code) as codeJson",
 			"WHERE ((codeJson.value ->> '$.code' = ?)) AND (user_id = ?) GROUP BY `fhir`.`id`",
-			"ORDER BY fhir.sort_date DESC"}, " "))
+			"ORDER BY fhir.sort_date DESC NULLS LAST, fhir.id DESC"}, " "))
 	require.Equal(suite.T(), sqlParams, []interface{}{
 		"test_code", "00000000-0000-0000-0000-000000000000",
 	})
 }
+
+func TestProcessSelectParameters(t *testing.T) {
+	//setup
+	t.Parallel()
+	searchParamLookup := map[string]string{
+		"sort_date":     "date",
+		"valueQuantity": "quantity",
+		"code":          "token",
+		"status":        "keyword",
+	}
+	var processSelectParametersTests = []struct {
+		selectEntries []string // input
+		expected      []SelectParameter
+		expectedError bool // expected result
+	}{
+		{[]string{"*"}, []SelectParameter{{Expression: "*", Alias: "*", Type: SelectParameterTypeResource}}, false},
+		{[]string{"sort_date as label"}, []SelectParameter{{Expression: "sort_date", Alias: "label", Type: SelectParameterTypeSearchParameter, SearchParameter: SearchParameter{Name: "sort_date", Type: SearchParameterTypeDate}}}, false},
+		{[]string{"valueQuantity:value AS data"}, []SelectParameter{{Expression: "valueQuantity:value", Alias: "data", Type: SelectParameterTypeSearchParameter, SearchParameter: SearchParameter{Name: "valueQuantity", Type: SearchParameterTypeQuantity, Modifier: "value"}}}, false},
+		{[]string{"code"}, []SelectParameter{{Expression: "code", Alias: "code", Type: SelectParameterTypeSearchParameter, SearchParameter: SearchParameter{Name: "code", Type: SearchParameterTypeToken}}}, false},
+		{[]string{"valueQuantity.value as data"}, []SelectParameter{{Expression: "valueQuantity.value", Alias: "data", Type: SelectParameterTypeFhirPath}}, false},
+		{[]string{"value as Quantity as data"}, []SelectParameter{{Expression: "value as Quantity", Alias: "data", Type: SelectParameterTypeFhirPath}}, false},
+		{[]string{"component"}, []SelectParameter{{Expression: "component", Alias: "component", Type: SelectParameterTypeFhirPath}}, false},
+
+		{[]string{"status:code"}, nil, true},                         //primitive search parameters do not have properties
+		{[]string{"code:code'); DROP TABLE users; --"}, nil, true},   //invalid property
+		{[]string{"sort_date as label", "code as label"}, nil, true}, //duplicate alias
+		{[]string{"code as id"}, nil, true},                          //reserved alias
+		{[]string{""}, nil, true},                                    //empty select entry
+		{[]string{"valueQuantty:value"}, nil, true},                  //unknown search parameter
+		{[]string{"component.where( as data"}, nil, true},            //invalid FHIRPath expression
+	}
+
+	//test && assert
+	for ndx, tt := range processSelectParametersTests {
+		actual, actualErr := ProcessSelectParameters(tt.selectEntries, searchParamLookup)
+		if tt.expectedError {
+			require.Error(t, actualErr, "Expected error but got none for processSelectParametersTests[%d] %v", ndx, tt.selectEntries)
+		} else {
+			require.NoError(t, actualErr, "Expected no error but got one for processSelectParametersTests[%d] %v", ndx, tt.selectEntries)
+			require.Equal(t, tt.expected, actual)
+		}
+	}
+}
+
+func TestSelectRowsToResults_FhirPathEvaluationError(t *testing.T) {
+	//setup
+	t.Parallel()
+	selectParameters, err := ProcessSelectParameters([]string{"name.given + 1 as data"}, map[string]string{})
+	require.NoError(t, err)
+	rows := []map[string]interface{}{
+		{"source_resource_id": "123", "source_resource_type": "Patient", "resource_raw": `{"resourceType":"Patient","name":[{"given":["a","b"]}]}`},
+	}
+
+	//test
+	_, err = selectRowsToResults(selectParameters, rows)
+
+	//assert
+	require.Error(t, err)
+	require.True(t, errors.IsQueryValidationError(err), "evaluation errors are caused by the request, and should be returned to the user")
+}
+
+func TestAggregationParameterToClause_DateBucket(t *testing.T) {
+	//setup
+	t.Parallel()
+	var aggregationParameterToClauseTests = []struct {
+		bucket           string
+		expectedSqlite   string
+		expectedPostgres string
+	}{
+		{"year", "strftime('%Y', fhir.date)", `to_char(fhir."date", 'YYYY')`},
+		{"quarter", "(strftime('%Y', fhir.date) || '-Q' || ((CAST(strftime('%m', fhir.date) AS INTEGER) + 2) / 3))", `to_char(fhir."date", 'YYYY-"Q"Q')`},
+		{"month", "strftime('%Y-%m', fhir.date)", `to_char(fhir."date", 'YYYY-MM')`},
+		{"week", "date(fhir.date, 'weekday 0', '-6 days')", `to_char(date_trunc('week', fhir."date"), 'YYYY-MM-DD')`},
+		{"day", "date(fhir.date)", `to_char(fhir."date", 'YYYY-MM-DD')`},
+	}
+
+	//test && assert
+	for _, tt := range aggregationParameterToClauseTests {
+		aggregationParameter := AggregationParameter{SearchParameter: SearchParameter{Type: "date", Name: "date"}, Bucket: tt.bucket}
+		require.Equal(t, tt.expectedSqlite, aggregationParameterToClause(pkg.DatabaseRepositoryTypeSqlite, aggregationParameter), tt.bucket)
+		require.Equal(t, tt.expectedPostgres, aggregationParameterToClause(pkg.DatabaseRepositoryTypePostgres, aggregationParameter), tt.bucket)
+	}
+}
+
+func TestSqlQuantityValueInUnit(t *testing.T) {
+	//setup
+	t.Parallel()
+
+	//test && assert
+	require.Equal(t,
+		"CASE COALESCE(valueQuantityJson.value ->> '$.code', valueQuantityJson.value ->> '$.unit') WHEN '[ft_i]' THEN (valueQuantityJson.value ->> '$.value') * 30.48 WHEN '[in_i]' THEN (valueQuantityJson.value ->> '$.value') * 2.54 WHEN 'cm' THEN (valueQuantityJson.value ->> '$.value') * 1 WHEN 'm' THEN (valueQuantityJson.value ->> '$.value') * 100 WHEN 'mm' THEN (valueQuantityJson.value ->> '$.value') * 0.1 END",
+		sqlQuantityValueInUnit(pkg.DatabaseRepositoryTypeSqlite, "valueQuantityJson", "cm"),
+	)
+	require.Equal(t,
+		"CASE COALESCE(valueQuantityJson.value ->> 'code', valueQuantityJson.value ->> 'unit') WHEN 'Pa' THEN ((valueQuantityJson.value ->> 'value')::numeric) * 0.00750061575846 WHEN 'kPa' THEN ((valueQuantityJson.value ->> 'value')::numeric) * 7.50061575846 WHEN 'mm[Hg]' THEN ((valueQuantityJson.value ->> 'value')::numeric) * 1 END",
+		sqlQuantityValueInUnit(pkg.DatabaseRepositoryTypePostgres, "valueQuantityJson", "mm[Hg]"),
+	)
+	require.Equal(t, "NULL", sqlQuantityValueInUnit(pkg.DatabaseRepositoryTypeSqlite, "valueQuantityJson", "furlong"))
+}
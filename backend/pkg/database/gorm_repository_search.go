@@ -0,0 +1,434 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/errors"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	databaseModel "github.com/fastenhealth/fasten-onprem/backend/pkg/models/database"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Full-text search across all resource types.
+//
+// Resources are indexed when they are created/updated by UpsertResource. A single index is used for all resource types
+// (rather than searching each `fhir_*` table), which contains the `sort_title` and the `content` of the resource:
+// - the narrative text (`text.div`, with html removed)
+// - the values of `string` search parameters (eg. names, addresses, descriptions)
+// - the display text of `token` search parameters (eg. `Metformin hydrochloride 500 MG Oral Tablet`)
+//
+// SQLite: `resource_search_index` is a regular table, with an external content FTS5 table (`resource_search_index_fts`) kept
+// in sync by triggers. FTS5 must be enabled when building (`-tags sqlite_fts5`), otherwise FTS4 is used, which does not rank results.
+// NOTE: a database indexed with FTS5 cannot be updated by a build without FTS5.
+// Postgres: `resource_search_index` has a weighted `tsvector` column with a GIN index.
+
+const resourceSearchIndexTable = "resource_search_index"
+const resourceSearchIndexFtsTable = "resource_search_index_fts"
+
+// limit the amount of text indexed for a single resource
+const resourceSearchContentMaxLength = 64 * 1024
+
+// limit the number of terms in a search query
+const resourceSearchQueryMaxTerms = 10
+
+const resourceSearchDefaultLimit = 50
+const resourceSearchMaxLimit = 500
+
+var resourceSearchTermRegex = regexp.MustCompile(`[\p{L}\p{N}]+`)
+var resourceSearchHtmlTagRegex = regexp.MustCompile(`<[^>]*>`)
+var resourceSearchWhitespaceRegex = regexp.MustCompile(`\s+`)
+
+type resourceSearchDocument struct {
+	UserID             string
+	SourceID           string
+	SourceResourceType string
+	SourceResourceID   string
+	SortDate           *time.Time
+	SortTitle          *string
+	Content            string
+}
+
+// SearchResources returns the resources (across all resource types) matching the free text query, most relevant first.
+func (gr *GormRepository) SearchResources(ctx context.Context, options models.ResourceSearchQueryOptions) ([]models.ResourceSearchResult, error) {
+	currentUser, currentUserErr := gr.GetCurrentUser(ctx)
+	if currentUserErr != nil {
+		return nil, currentUserErr
+	}
+
+	terms := resourceSearchTerms(options.Query)
+	if len(terms) == 0 {
+		return nil, errors.QueryValidationErrorf("search query must contain at least one word")
+	}
+	for _, resourceType := range options.SourceResourceTypes {
+		if _, err := databaseModel.GetTableNameByResourceType(resourceType); err != nil {
+			return nil, errors.QueryValidationErrorf("invalid sourceResourceType: %s", resourceType)
+		}
+	}
+	if options.Limit <= 0 {
+		options.Limit = resourceSearchDefaultLimit
+	} else if options.Limit > resourceSearchMaxLimit {
+		options.Limit = resourceSearchMaxLimit
+	}
+
+	var sqlQuery *gorm.DB
+	if gr.sqlDialect() == pkg.DatabaseRepositoryTypePostgres {
+		sqlQuery = gr.GormClient.WithContext(ctx).
+			Table(resourceSearchIndexTable).
+			Joins("CROSS JOIN to_tsquery('english', ?) as search_query", resourceSearchPostgresQuery(terms)).
+			Select(strings.Join([]string{
+				"source_id", "source_resource_type", "source_resource_id", "sort_date", "sort_title",
+				`ts_headline('english', COALESCE(content, ''), search_query, 'StartSel="", StopSel="", MaxWords=16, MinWords=6') as snippet`,
+				"ts_rank(search_vector, search_query) as rank",
+			}, ", ")).
+			Where("user_id = ? AND search_vector @@ search_query", currentUser.ID.String()).
+			Order("rank DESC, sort_date DESC")
+	} else {
+		fts5, err := gr.sqliteResourceSearchIndexIsFts5(ctx)
+		if err != nil {
+			return nil, err
+		}
+		selectClauses := []string{
+			"resource_search_index.source_id", "resource_search_index.source_resource_type", "resource_search_index.source_resource_id",
+			"resource_search_index.sort_date", "resource_search_index.sort_title",
+		}
+		orderClause := "rank DESC, resource_search_index.sort_date DESC"
+		if fts5 {
+			//bm25 is lower for more relevant results, matches in the title are weighted higher than matches in the content
+			selectClauses = append(selectClauses,
+				fmt.Sprintf("snippet(%s, 1, '', '', '...', 16) as snippet", resourceSearchIndexFtsTable),
+				fmt.Sprintf("-bm25(%s, 10.0, 1.0) as rank", resourceSearchIndexFtsTable),
+			)
+		} else {
+			//FTS4 does not have a ranking function
+			selectClauses = append(selectClauses,
+				fmt.Sprintf("snippet(%s, '', '', '...', 1, 16) as snippet", resourceSearchIndexFtsTable),
+				"0 as rank",
+			)
+			orderClause = "resource_search_index.sort_date DESC"
+		}
+		sqlQuery = gr.GormClient.WithContext(ctx).
+			Table(resourceSearchIndexFtsTable).
+			Joins(fmt.Sprintf("JOIN %s ON %s.id = %s.rowid", resourceSearchIndexTable, resourceSearchIndexTable, resourceSearchIndexFtsTable)).
+			Select(strings.Join(selectClauses, ", ")).
+			Where(fmt.Sprintf("%s MATCH @query AND resource_search_index.user_id = @user_id", resourceSearchIndexFtsTable), map[string]interface{}{
+				"query":   resourceSearchSqliteQuery(terms, fts5),
+				"user_id": currentUser.ID.String(),
+			}).
+			Order(orderClause)
+	}
+	if len(options.SourceResourceTypes) > 0 {
+		sqlQuery = sqlQuery.Where(fmt.Sprintf("%s.source_resource_type IN ?", resourceSearchIndexTable), options.SourceResourceTypes)
+	}
+
+	rows := []struct {
+		SourceID           string
+		SourceResourceType string
+		SourceResourceID   string
+		SortDate           *string
+		SortTitle          *string
+		Snippet            string
+		Rank               float64
+	}{}
+	if err := sqlQuery.Limit(options.Limit).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	results := []models.ResourceSearchResult{}
+	for _, row := range rows {
+		result := models.ResourceSearchResult{
+			SourceResourceType: row.SourceResourceType,
+			SourceResourceID:   row.SourceResourceID,
+			SortTitle:          row.SortTitle,
+			Snippet:            row.Snippet,
+			Rank:               row.Rank,
+		}
+		if sourceId, err := uuid.Parse(row.SourceID); err == nil {
+			result.SourceID = sourceId
+		}
+		if row.SortDate != nil {
+			if sortDate, err := time.Parse(time.RFC3339, *row.SortDate); err == nil {
+				result.SortDate = &sortDate
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// sqliteResourceSearchIndexIsFts5 returns true if the search index was created using FTS5 (rather than FTS4), see migrateResourceSearchIndex
+func (gr *GormRepository) sqliteResourceSearchIndexIsFts5(ctx context.Context) (bool, error) {
+	var tableSql string
+	err := gr.GormClient.WithContext(ctx).
+		Raw("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", resourceSearchIndexFtsTable).
+		Scan(&tableSql).Error
+	return strings.Contains(strings.ToLower(tableSql), "fts5"), err
+}
+
+// resourceSearchTerms splits the user's query into words. Punctuation is removed, so the terms are safe to use in a MATCH/tsquery expression
+func resourceSearchTerms(query string) []string {
+	terms := resourceSearchTermRegex.FindAllString(strings.ToLower(query), -1)
+	if len(terms) > resourceSearchQueryMaxTerms {
+		terms = terms[:resourceSearchQueryMaxTerms]
+	}
+	return terms
+}
+
+// resourceSearchSqliteQuery generates the FTS MATCH expression, all terms must match (as a prefix, so that partial words can be searched)
+// eg. `"metformin"* "500"*` (FTS5) or `"metformin*" "500*"` (FTS4)
+func resourceSearchSqliteQuery(terms []string, fts5 bool) string {
+	matchTerms := []string{}
+	for _, term := range terms {
+		if fts5 {
+			matchTerms = append(matchTerms, fmt.Sprintf(`"%s"*`, term))
+		} else {
+			matchTerms = append(matchTerms, fmt.Sprintf(`"%s*"`, term))
+		}
+	}
+	return strings.Join(matchTerms, " ")
+}
+
+// resourceSearchPostgresQuery generates the tsquery expression, all terms must match (as a prefix, so that partial words can be searched)
+// eg. `metformin:* & 500:*`
+func resourceSearchPostgresQuery(terms []string) string {
+	queryTerms := []string{}
+	for _, term := range terms {
+		queryTerms = append(queryTerms, fmt.Sprintf("%s:*", term))
+	}
+	return strings.Join(queryTerms, " & ")
+}
+
+// upsertResourceSearchIndex replaces the search index entry for a resource
+func upsertResourceSearchIndex(db *gorm.DB, document resourceSearchDocument) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(
+			fmt.Sprintf("DELETE FROM %s WHERE user_id = ? AND source_id = ? AND source_resource_type = ? AND source_resource_id = ?", resourceSearchIndexTable),
+			document.UserID, document.SourceID, document.SourceResourceType, document.SourceResourceID,
+		).Error
+		if err != nil {
+			return err
+		}
+
+		var sortDate *string
+		if document.SortDate != nil {
+			sortDateStr := document.SortDate.UTC().Format(time.RFC3339)
+			sortDate = &sortDateStr
+		}
+		columns := "user_id, source_id, source_resource_type, source_resource_id, sort_date, sort_title, content"
+		values := []interface{}{document.UserID, document.SourceID, document.SourceResourceType, document.SourceResourceID, sortDate, document.SortTitle, document.Content}
+
+		if sqlDialectOf(tx) == pkg.DatabaseRepositoryTypePostgres {
+			//matches in the title are weighted higher than matches in the content
+			return tx.Exec(
+				fmt.Sprintf("INSERT INTO %s (%s, search_vector) VALUES (?, ?, ?, ?, ?, ?, ?, setweight(to_tsvector('english', COALESCE(?, '')), 'A') || setweight(to_tsvector('english', ?), 'B'))", resourceSearchIndexTable, columns),
+				append(values, document.SortTitle, document.Content)...,
+			).Error
+		}
+		return tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?, ?, ?)", resourceSearchIndexTable, columns), values...).Error
+	})
+}
+
+// resourceSearchContent extracts the text which should be indexed for a resource.
+// searchParameterColumns contains the (json encoded) search parameter values, keyed by search parameter name
+func resourceSearchContent(searchParameters map[string]string, searchParameterColumns map[string]interface{}, resourceRaw []byte) string {
+	contentParts := []string{}
+	contentPartsLookup := map[string]bool{}
+	addContentPart := func(contentPart string) {
+		contentPart = strings.TrimSpace(resourceSearchWhitespaceRegex.ReplaceAllString(contentPart, " "))
+		if len(contentPart) == 0 || contentPartsLookup[contentPart] {
+			return
+		}
+		contentPartsLookup[contentPart] = true
+		contentParts = append(contentParts, contentPart)
+	}
+
+	//narrative text
+	var resourceNarrative struct {
+		Text struct {
+			Div string `json:"div"`
+		} `json:"text"`
+	}
+	if err := json.Unmarshal(resourceRaw, &resourceNarrative); err == nil && len(resourceNarrative.Text.Div) > 0 {
+		addContentPart(html.UnescapeString(resourceSearchHtmlTagRegex.ReplaceAllString(resourceNarrative.Text.Div, " ")))
+	}
+
+	//search parameters are sorted, so that the content is deterministic
+	searchParameterNames := []string{}
+	for searchParameterName := range searchParameters {
+		searchParameterNames = append(searchParameterNames, searchParameterName)
+	}
+	sort.Strings(searchParameterNames)
+
+	for _, searchParameterName := range searchParameterNames {
+		searchParameterColumn := resourceSearchColumnJson(searchParameterColumns[searchParameterName])
+		if len(searchParameterColumn) == 0 {
+			continue
+		}
+		switch SearchParameterType(searchParameters[searchParameterName]) {
+		case SearchParameterTypeString:
+			var stringValues databaseModel.SearchParameterStringType
+			if err := json.Unmarshal(searchParameterColumn, &stringValues); err == nil {
+				for _, stringValue := range stringValues {
+					addContentPart(stringValue)
+				}
+			}
+		case SearchParameterTypeToken:
+			var tokenValues databaseModel.SearchParameterTokenType
+			if err := json.Unmarshal(searchParameterColumn, &tokenValues); err == nil {
+				for _, tokenValue := range tokenValues {
+					addContentPart(tokenValue.Text)
+				}
+			}
+		}
+	}
+
+	content := strings.Join(contentParts, " | ")
+	if len(content) > resourceSearchContentMaxLength {
+		content = strings.ToValidUTF8(content[:resourceSearchContentMaxLength], "")
+	}
+	return content
+}
+
+// resourceSearchColumnJson returns the json encoded value of a search parameter column, which may be json text (when read from
+// the database) or a decoded value
+func resourceSearchColumnJson(columnValue interface{}) []byte {
+	switch v := columnValue.(type) {
+	case nil:
+		return nil
+	case string:
+		return []byte(v)
+	case []byte:
+		return v
+	case *interface{}:
+		if v == nil {
+			return nil
+		}
+		return resourceSearchColumnJson(*v)
+	default:
+		columnJson, err := json.Marshal(v)
+		if err != nil {
+			return nil
+		}
+		return columnJson
+	}
+}
+
+// newResourceSearchDocument generates the search index entry for a resource model (after the search parameters have been extracted)
+func newResourceSearchDocument(userID uuid.UUID, wrappedFhirResourceModel databaseModel.IFhirResourceModel, sortDate *time.Time, sortTitle *string, resourceRaw []byte) (resourceSearchDocument, error) {
+	//the search parameter fields are named by their json tags, so we convert the model to a map
+	wrappedFhirResourceModelJson, err := json.Marshal(wrappedFhirResourceModel)
+	if err != nil {
+		return resourceSearchDocument{}, err
+	}
+	searchParameterColumns := map[string]interface{}{}
+	if err := json.Unmarshal(wrappedFhirResourceModelJson, &searchParameterColumns); err != nil {
+		return resourceSearchDocument{}, err
+	}
+
+	return resourceSearchDocument{
+		UserID:             userID.String(),
+		SourceID:           wrappedFhirResourceModel.GetSourceID().String(),
+		SourceResourceType: wrappedFhirResourceModel.GetSourceResourceType(),
+		SourceResourceID:   wrappedFhirResourceModel.GetSourceResourceID(),
+		SortDate:           sortDate,
+		SortTitle:          sortTitle,
+		Content:            resourceSearchContent(wrappedFhirResourceModel.GetSearchParameters(), searchParameterColumns, resourceRaw),
+	}, nil
+}
+
+// migrateResourceSearchIndex creates the search index tables, see SearchResources
+func migrateResourceSearchIndex(tx *gorm.DB) error {
+	statements := []string{}
+	if sqlDialectOf(tx) == pkg.DatabaseRepositoryTypePostgres {
+		statements = append(statements,
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id bigserial PRIMARY KEY, user_id text NOT NULL, source_id text NOT NULL, source_resource_type text NOT NULL, source_resource_id text NOT NULL, sort_date text, sort_title text, content text, search_vector tsvector)`, resourceSearchIndexTable),
+			fmt.Sprintf(`CREATE UNIQUE INDEX IF NOT EXISTS idx_%s_origin ON %s (user_id, source_id, source_resource_type, source_resource_id)`, resourceSearchIndexTable, resourceSearchIndexTable),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_%s_search_vector ON %s USING GIN (search_vector)`, resourceSearchIndexTable, resourceSearchIndexTable),
+		)
+	} else {
+		statements = append(statements,
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id integer PRIMARY KEY AUTOINCREMENT, user_id text NOT NULL, source_id text NOT NULL, source_resource_type text NOT NULL, source_resource_id text NOT NULL, sort_date text, sort_title text, content text)`, resourceSearchIndexTable),
+			fmt.Sprintf(`CREATE UNIQUE INDEX IF NOT EXISTS idx_%s_origin ON %s (user_id, source_id, source_resource_type, source_resource_id)`, resourceSearchIndexTable, resourceSearchIndexTable),
+		)
+
+		//FTS5 is only available if the sqlite driver is built with the `sqlite_fts5` tag, otherwise fallback to FTS4
+		fts5Err := tx.Exec(fmt.Sprintf(`CREATE VIRTUAL TABLE IF NOT EXISTS %s USING fts5(sort_title, content, content='%s', content_rowid='id', tokenize='porter unicode61')`, resourceSearchIndexFtsTable, resourceSearchIndexTable)).Error
+		if fts5Err == nil {
+			statements = append(statements,
+				fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %s_ai AFTER INSERT ON %s BEGIN INSERT INTO %s(rowid, sort_title, content) VALUES (new.id, new.sort_title, new.content); END`, resourceSearchIndexTable, resourceSearchIndexTable, resourceSearchIndexFtsTable),
+				fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %s_ad AFTER DELETE ON %s BEGIN INSERT INTO %s(%s, rowid, sort_title, content) VALUES ('delete', old.id, old.sort_title, old.content); END`, resourceSearchIndexTable, resourceSearchIndexTable, resourceSearchIndexFtsTable, resourceSearchIndexFtsTable),
+			)
+		} else if strings.Contains(fts5Err.Error(), "no such module") {
+			tx.Logger.Warn(context.Background(), "sqlite FTS5 is not available (build with the `sqlite_fts5` tag), full-text search will use FTS4")
+			statements = append(statements,
+				fmt.Sprintf(`CREATE VIRTUAL TABLE IF NOT EXISTS %s USING fts4(sort_title, content, content="%s", tokenize=porter)`, resourceSearchIndexFtsTable, resourceSearchIndexTable),
+				fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %s_ai AFTER INSERT ON %s BEGIN INSERT INTO %s(docid, sort_title, content) VALUES (new.id, new.sort_title, new.content); END`, resourceSearchIndexTable, resourceSearchIndexTable, resourceSearchIndexFtsTable),
+				//FTS4 reads the deleted values from the content table, so the index must be updated before the row is deleted
+				fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %s_bd BEFORE DELETE ON %s BEGIN DELETE FROM %s WHERE docid = old.id; END`, resourceSearchIndexTable, resourceSearchIndexTable, resourceSearchIndexFtsTable),
+			)
+		} else {
+			return fts5Err
+		}
+	}
+
+	for _, statement := range statements {
+		if err := tx.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return backfillResourceSearchIndex(tx)
+}
+
+// backfillResourceSearchIndex indexes the resources which were stored before the search index was created.
+func backfillResourceSearchIndex(tx *gorm.DB) error {
+	const batchSize = 500
+
+	for _, resourceType := range databaseModel.GetAllowedResourceTypes() {
+		tableName, err := databaseModel.GetTableNameByResourceType(resourceType)
+		if err != nil {
+			return err
+		}
+		resourceModel, err := databaseModel.NewFhirResourceModelByType(resourceType)
+		if err != nil {
+			return err
+		}
+		searchParameters := resourceModel.GetSearchParameters()
+
+		for offset := 0; ; offset += batchSize {
+			rows := []map[string]interface{}{}
+			if err := tx.Table(tableName).Order("id").Limit(batchSize).Offset(offset).Find(&rows).Error; err != nil {
+				return err
+			}
+			for _, row := range rows {
+				document := resourceSearchDocument{
+					UserID:             fmt.Sprintf("%v", selectColumnValue(row["user_id"])),
+					SourceID:           fmt.Sprintf("%v", selectColumnValue(row["source_id"])),
+					SourceResourceType: fmt.Sprintf("%v", selectColumnValue(row["source_resource_type"])),
+					SourceResourceID:   fmt.Sprintf("%v", selectColumnValue(row["source_resource_id"])),
+					Content:            resourceSearchContent(searchParameters, row, resourceSearchColumnJson(row["resource_raw"])),
+				}
+				if sortDate, sortDateOk := row["sort_date"].(time.Time); sortDateOk {
+					document.SortDate = &sortDate
+				}
+				if sortTitle, sortTitleOk := selectColumnValue(row["sort_title"]).(string); sortTitleOk {
+					document.SortTitle = &sortTitle
+				}
+				if err := upsertResourceSearchIndex(tx, document); err != nil {
+					return err
+				}
+			}
+			if len(rows) < batchSize {
+				break
+			}
+		}
+	}
+	return nil
+}
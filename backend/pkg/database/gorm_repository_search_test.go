@@ -0,0 +1,46 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResourceSearchTerms(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, []string{"metformin", "500", "mg"}, resourceSearchTerms(`Metformin "500" (mg)*`))
+	require.Equal(t, []string{"and", "or", "not"}, resourceSearchTerms(`AND OR NOT`))
+	require.Equal(t, []string{"résumé"}, resourceSearchTerms(`Résumé`))
+	require.Empty(t, resourceSearchTerms(`*" -`))
+	require.Len(t, resourceSearchTerms("a b c d e f g h i j k l"), resourceSearchQueryMaxTerms)
+
+	require.Equal(t, `"metformin"* "500"*`, resourceSearchSqliteQuery([]string{"metformin", "500"}, true))
+	require.Equal(t, `"metformin*" "500*"`, resourceSearchSqliteQuery([]string{"metformin", "500"}, false))
+	require.Equal(t, `metformin:* & 500:*`, resourceSearchPostgresQuery([]string{"metformin", "500"}))
+}
+
+func TestResourceSearchContent(t *testing.T) {
+	t.Parallel()
+
+	//setup
+	searchParameters := map[string]string{
+		"code":   "token",
+		"name":   "string",
+		"status": "keyword",
+	}
+	searchParameterColumns := map[string]interface{}{
+		//json text (as stored in the database)
+		"code": `[{"code":"860975","system":"http://www.nlm.nih.gov/research/umls/rxnorm","text":"Metformin 500 MG Oral Tablet"}]`,
+		//decoded json (from the resource model)
+		"name":   []interface{}{"Metformin", "Metformin 500 MG Oral Tablet"},
+		"status": "active",
+	}
+	resourceRaw := []byte(`{"resourceType":"MedicationRequest","text":{"status":"generated","div":"<div xmlns=\"http://www.w3.org/1999/xhtml\"><p>Take &amp; swallow</p>\n<p>daily</p></div>"}}`)
+
+	//test
+	content := resourceSearchContent(searchParameters, searchParameterColumns, resourceRaw)
+
+	//assert
+	require.Equal(t, "Take & swallow daily | Metformin 500 MG Oral Tablet | Metformin", content)
+}
@@ -72,7 +72,7 @@ func (gr *GormRepository) SaveUserSettings(ctx context.Context, newSettings *mod
 			WithContext(ctx).
 			Model(&models.UserSettingEntry{}).
 			Where([]uuid.UUID{settingsEntry.ID}).
-			Select("setting_value_numeric", "setting_value_string", "setting_value_bool", "setting_value_array").
+			Select("setting_value_numeric", "setting_value_string", "setting_value_bool", "setting_value_array", "setting_value_json").
 			Updates(newSettingsEntries[ndx]).Error
 		if err != nil {
 			return err
@@ -92,6 +92,13 @@ func (gr *GormRepository) PopulateDefaultUserSettings(ctx context.Context, userI
 		SettingDataType:       "array",
 		SettingValueArray:     []string{},
 	})
+	settingsEntries = append(settingsEntries, models.UserSettingEntry{
+		UserID:                userId,
+		SettingKeyName:        "csv_import_templates",
+		SettingKeyDescription: "saved column mappings for CSV imports",
+		SettingDataType:       "json",
+		SettingValueJson:      []byte("[]"),
+	})
 
 	return gr.GormClient.WithContext(ctx).Create(settingsEntries).Error
 
@@ -80,6 +80,7 @@ func (suite *RepositorySettingsTestSuite) TestLoadUserSettings() {
 	//assert
 	require.Equal(suite.T(), userSettings, &models.UserSettings{
 		DashboardLocations: []string{},
+		CsvImportTemplates: []models.CsvImportMapping{},
 	})
 }
 
@@ -102,3 +103,35 @@ func (suite *RepositorySettingsTestSuite) TestSaveUserSettings() {
 		},
 	})
 }
+
+func (suite *RepositorySettingsTestSuite) TestSaveUserSettings_WithCsvImportTemplates() {
+	//setup
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+	glucoseHigh := 140.0
+	csvImportTemplates := []models.CsvImportMapping{{
+		Name:       "Glucose log",
+		DateColumn: "Date",
+		DateFormat: "MM/DD/YYYY",
+		Columns: []models.CsvImportColumnMapping{{
+			Column:         "Glucose",
+			Code:           "2339-0",
+			Unit:           "mg/dL",
+			ReferenceRange: &models.CsvImportReferenceRange{High: &glucoseHigh},
+		}},
+	}}
+
+	//test
+	err := suite.TestRepository.SaveUserSettings(authContext, &models.UserSettings{
+		DashboardLocations: []string{},
+		CsvImportTemplates: csvImportTemplates,
+	})
+	require.NoError(suite.T(), err)
+	userSettings, err := suite.TestRepository.LoadUserSettings(authContext)
+	require.NoError(suite.T(), err)
+
+	//assert
+	require.Equal(suite.T(), userSettings, &models.UserSettings{
+		DashboardLocations: []string{},
+		CsvImportTemplates: csvImportTemplates,
+	})
+}
@@ -7,11 +7,13 @@ import (
 	"log"
 	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/fastenhealth/fasten-onprem/backend/pkg"
 	mock_config "github.com/fastenhealth/fasten-onprem/backend/pkg/config/mock"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/errors"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
 	sourceModels "github.com/fastenhealth/fasten-sources/clients/models"
@@ -21,6 +23,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/golang/mock/gomock"
 	"github.com/google/uuid"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -383,7 +386,138 @@ func (suite *RepositoryTestSuite) TestUpsertRawResource() {
 	require.Equal(suite.T(), expectedPationData, actualPatientData)
 }
 
-//TODO create UPSERT test, where the resource already exists and we need to update it
+func (suite *RepositoryTestSuite) TestUpsertRawResource_WithUpdatedResource() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	fakeConfig.EXPECT().GetInt("history.retention.max_versions").Return(1).AnyTimes()
+	fakeConfig.EXPECT().GetInt("history.retention.days").Return(0).AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	testSourceCredential := models.SourceCredential{
+		ModelBase: models.ModelBase{
+			ID: uuid.New(),
+		},
+		UserID: userModel.ID,
+	}
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+	upsertPatient := func(resourceRaw string) bool {
+		wasUpdated, err := dbRepo.UpsertRawResource(authContext, &testSourceCredential, sourceModels.RawResourceFhir{
+			SourceResourceType: "Patient",
+			SourceResourceID:   "b426b062-8273-4b93-a907-de3176c0567d",
+			ResourceRaw:        []byte(resourceRaw),
+		})
+		require.NoError(suite.T(), err)
+		return wasUpdated
+	}
+
+	//test
+	require.True(suite.T(), upsertPatient(`{"resourceType":"Patient","id":"b426b062-8273-4b93-a907-de3176c0567d","gender":"male"}`))
+	//formatting changes are not a new version
+	require.False(suite.T(), upsertPatient(`{
+		"resourceType": "Patient",
+		"id": "b426b062-8273-4b93-a907-de3176c0567d",
+		"gender": "male"
+	}`))
+	require.True(suite.T(), upsertPatient(`{"resourceType":"Patient","id":"b426b062-8273-4b93-a907-de3176c0567d","gender":"female"}`))
+	resourceVersions, err := dbRepo.ListResourceHistory(authContext, testSourceCredential.ID.String(), "Patient", "b426b062-8273-4b93-a907-de3176c0567d")
+	require.NoError(suite.T(), err)
+	foundPatientResources, _, err := dbRepo.QueryResources(authContext, models.QueryResource{From: "Patient", Where: map[string]interface{}{"gender": "female"}})
+	require.NoError(suite.T(), err)
+
+	//assert
+	require.Equal(suite.T(), 2, len(resourceVersions))
+	require.Equal(suite.T(), 2, resourceVersions[0].VersionID)
+	require.JSONEq(suite.T(), `{"resourceType":"Patient","id":"b426b062-8273-4b93-a907-de3176c0567d","gender":"female"}`, string(resourceVersions[0].ResourceRaw))
+	require.Equal(suite.T(), 1, resourceVersions[1].VersionID)
+	require.JSONEq(suite.T(), `{"resourceType":"Patient","id":"b426b062-8273-4b93-a907-de3176c0567d","gender":"male"}`, string(resourceVersions[1].ResourceRaw))
+	require.Equal(suite.T(), 1, len(foundPatientResources.([]models.ResourceBase)), "search parameters must be updated")
+
+	//only 1 prior version is retained
+	require.True(suite.T(), upsertPatient(`{"resourceType":"Patient","id":"b426b062-8273-4b93-a907-de3176c0567d","gender":"other"}`))
+	resourceVersions, err = dbRepo.ListResourceHistory(authContext, testSourceCredential.ID.String(), "Patient", "b426b062-8273-4b93-a907-de3176c0567d")
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), []int{3, 2}, lo.Map(resourceVersions, func(resourceVersion models.ResourceHistory, _ int) int {
+		return resourceVersion.VersionID
+	}))
+}
+
+func (suite *RepositoryTestSuite) TestSearchResources() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	testSourceCredential := models.SourceCredential{
+		ModelBase: models.ModelBase{
+			ID: uuid.New(),
+		},
+		UserID: userModel.ID,
+	}
+	testPatientData, err := os.ReadFile("./testdata/Abraham100_Heller342_Patient.json")
+	require.NoError(suite.T(), err)
+
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+	sortTitle := "Abraham Heller"
+	_, err = dbRepo.UpsertRawResource(
+		authContext,
+		&testSourceCredential,
+		sourceModels.RawResourceFhir{
+			SourceResourceType: "Patient",
+			SourceResourceID:   "b426b062-8273-4b93-a907-de3176c0567d",
+			ResourceRaw:        testPatientData,
+			SortTitle:          &sortTitle,
+		},
+	)
+	require.NoError(suite.T(), err)
+
+	//test
+	foundResults, err := dbRepo.SearchResources(authContext, models.ResourceSearchQueryOptions{Query: "somerville, massa"})
+	require.NoError(suite.T(), err)
+	notFoundResults, err := dbRepo.SearchResources(authContext, models.ResourceSearchQueryOptions{Query: "somerville", SourceResourceTypes: []string{"Observation"}})
+	require.NoError(suite.T(), err)
+	_, invalidQueryErr := dbRepo.SearchResources(authContext, models.ResourceSearchQueryOptions{Query: "*\"\" -"})
+	_, invalidResourceTypeErr := dbRepo.SearchResources(authContext, models.ResourceSearchQueryOptions{Query: "somerville", SourceResourceTypes: []string{"NotAResource"}})
+
+	_, err = dbRepo.DeleteSource(authContext, testSourceCredential.ID.String())
+	require.NoError(suite.T(), err)
+	deletedResults, err := dbRepo.SearchResources(authContext, models.ResourceSearchQueryOptions{Query: "somerville"})
+	require.NoError(suite.T(), err)
+
+	//assert
+	require.Equal(suite.T(), 1, len(foundResults))
+	require.Equal(suite.T(), testSourceCredential.ID, foundResults[0].SourceID)
+	require.Equal(suite.T(), "Patient", foundResults[0].SourceResourceType)
+	require.Equal(suite.T(), "b426b062-8273-4b93-a907-de3176c0567d", foundResults[0].SourceResourceID)
+	require.Equal(suite.T(), &sortTitle, foundResults[0].SortTitle)
+	require.Contains(suite.T(), foundResults[0].Snippet, "Somerville")
+	require.Empty(suite.T(), notFoundResults)
+	require.True(suite.T(), errors.IsQueryValidationError(invalidQueryErr))
+	require.True(suite.T(), errors.IsQueryValidationError(invalidResourceTypeErr))
+	require.Empty(suite.T(), deletedResults)
+}
 
 func (suite *RepositoryTestSuite) TestUpsertRawResource_WithRelatedResourceAndDuplicateReference() {
 	//setup
@@ -434,6 +568,175 @@ func (suite *RepositoryTestSuite) TestUpsertRawResource_WithRelatedResourceAndDu
 
 }
 
+func (suite *RepositoryTestSuite) TestDeleteResource() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	fakeConfig.EXPECT().GetInt(gomock.Any()).Return(0).AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	testSourceCredential := models.SourceCredential{
+		ModelBase: models.ModelBase{
+			ID: uuid.New(),
+		},
+		UserID: userModel.ID,
+	}
+	for _, resourceRaw := range []string{
+		`{"resourceType":"Observation","id":"1","status":"preliminary","subject":{"reference":"Patient/b426b062-8273-4b93-a907-de3176c0567d"}}`,
+		`{"resourceType":"Observation","id":"1","status":"final","subject":{"reference":"Patient/b426b062-8273-4b93-a907-de3176c0567d"}}`,
+	} {
+		_, err = dbRepo.UpsertRawResource(authContext, &testSourceCredential, sourceModels.RawResourceFhir{
+			SourceResourceType:  "Observation",
+			SourceResourceID:    "1",
+			ResourceRaw:         []byte(resourceRaw),
+			ReferencedResources: []string{"Patient/b426b062-8273-4b93-a907-de3176c0567d"},
+		})
+		require.NoError(suite.T(), err)
+	}
+
+	//test
+	rowsAffected, err := dbRepo.DeleteResource(authContext, testSourceCredential.ID.String(), "Observation", "1")
+
+	//assert
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), int64(1), rowsAffected)
+	_, err = dbRepo.GetResourceBySourceId(authContext, testSourceCredential.ID.String(), "1")
+	require.Error(suite.T(), err)
+	relatedResource, err := dbRepo.FindResourceAssociationsByTypeAndId(authContext, &testSourceCredential, "Observation", "1")
+	require.NoError(suite.T(), err)
+	require.Empty(suite.T(), relatedResource)
+	var resourceHistoryCount, resourceSearchIndexCount int64
+	gormClient := dbRepo.(*GormRepository).GormClient
+	require.NoError(suite.T(), gormClient.Model(&models.ResourceHistory{}).Count(&resourceHistoryCount).Error)
+	require.Equal(suite.T(), int64(0), resourceHistoryCount)
+	require.NoError(suite.T(), gormClient.Table(resourceSearchIndexTable).Count(&resourceSearchIndexCount).Error)
+	require.Equal(suite.T(), int64(0), resourceSearchIndexCount)
+
+	rowsAffected, err = dbRepo.DeleteResource(authContext, testSourceCredential.ID.String(), "Observation", "1")
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), int64(0), rowsAffected)
+}
+
+func (suite *RepositoryTestSuite) TestQueryObservationLastNAndStatistics() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	fakeConfig.EXPECT().GetInt(gomock.Any()).Return(0).AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	//body weight from 2 sources (one using a local code as well as LOINC, the other recorded in pounds) and a blood pressure
+	testSourceCredentials := []models.SourceCredential{
+		{ModelBase: models.ModelBase{ID: uuid.New()}, UserID: userModel.ID},
+		{ModelBase: models.ModelBase{ID: uuid.New()}, UserID: userModel.ID},
+	}
+	for _, testObservation := range []struct {
+		sourceNdx int
+		id        string
+		date      string
+		raw       string
+	}{
+		{0, "a1", "2023-01-10T08:00:00Z", `{"resourceType":"Observation","id":"a1","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"29463-7","display":"Body Weight"},{"system":"urn:oid:1.2.840.114350","code":"W"}]},"effectiveDateTime":"2023-01-10T08:00:00Z","valueQuantity":{"value":80,"unit":"kg","system":"http://unitsofmeasure.org","code":"kg"}}`},
+		{0, "a2", "2023-02-10T08:00:00Z", `{"resourceType":"Observation","id":"a2","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"29463-7","display":"Body Weight"}]},"effectiveDateTime":"2023-02-10T08:00:00Z","valueQuantity":{"value":82,"unit":"kg","system":"http://unitsofmeasure.org","code":"kg"}}`},
+		{1, "b1", "2023-03-05T08:00:00Z", `{"resourceType":"Observation","id":"b1","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"29463-7"}]},"effectiveDateTime":"2023-03-05T08:00:00Z","valueQuantity":{"value":180,"unit":"lb","system":"http://unitsofmeasure.org","code":"[lb_av]"}}`},
+		{1, "b2", "2023-03-05T08:00:00Z", `{"resourceType":"Observation","id":"b2","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"8480-6"}]},"effectiveDateTime":"2023-03-05T08:00:00Z","valueQuantity":{"value":120,"unit":"mmHg","system":"http://unitsofmeasure.org","code":"mm[Hg]"}}`},
+	} {
+		sortDate, err := time.Parse(time.RFC3339, testObservation.date)
+		require.NoError(suite.T(), err)
+		_, err = dbRepo.UpsertRawResource(authContext, &testSourceCredentials[testObservation.sourceNdx], sourceModels.RawResourceFhir{
+			SourceResourceType: "Observation",
+			SourceResourceID:   testObservation.id,
+			ResourceRaw:        []byte(testObservation.raw),
+			SortDate:           &sortDate,
+		})
+		require.NoError(suite.T(), err)
+	}
+	resourceIds := func(resources []models.ResourceBase) []string {
+		return lo.Map(resources, func(resource models.ResourceBase, _ int) string { return resource.SourceResourceID })
+	}
+
+	//test && assert
+	//latest Observation for each coding
+	lastN, err := dbRepo.QueryObservationLastN(authContext, models.ObservationLastNQuery{Max: 1})
+	require.NoError(suite.T(), err)
+	require.ElementsMatch(suite.T(), []string{"a1", "b1", "b2"}, resourceIds(lastN))
+
+	//only the requested codings are used
+	lastN, err = dbRepo.QueryObservationLastN(authContext, models.ObservationLastNQuery{Where: map[string]interface{}{"code": "http://loinc.org|29463-7"}, Max: 2})
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), []string{"b1", "a2"}, resourceIds(lastN))
+
+	_, err = dbRepo.QueryObservationLastN(authContext, models.ObservationLastNQuery{Max: 0})
+	require.Error(suite.T(), err)
+
+	//statistics are grouped by unit
+	statistics, err := dbRepo.QueryObservationStatistics(authContext, models.ObservationStatisticsQuery{Where: map[string]interface{}{"code": "http://loinc.org|29463-7"}})
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), statistics, 2)
+	require.Equal(suite.T(), "[lb_av]", statistics[0].Unit)
+	require.Equal(suite.T(), int64(1), statistics[0].Count)
+	require.Equal(suite.T(), models.ObservationStatistics{
+		CodeSystem:  "http://loinc.org",
+		Code:        "29463-7",
+		CodeDisplay: "Body Weight",
+		Unit:        "kg",
+		Count:       2,
+		Minimum:     80,
+		Maximum:     82,
+		Mean:        81,
+		Latest:      82,
+		Start:       lo.ToPtr(time.Date(2023, 1, 10, 8, 0, 0, 0, time.UTC)),
+		End:         lo.ToPtr(time.Date(2023, 2, 10, 8, 0, 0, 0, time.UTC)),
+	}, statistics[1])
+
+	//values are converted to the requested unit
+	statistics, err = dbRepo.QueryObservationStatistics(authContext, models.ObservationStatisticsQuery{Where: map[string]interface{}{"code": "http://loinc.org|29463-7"}, Unit: "kg"})
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), statistics, 1)
+	require.Equal(suite.T(), int64(3), statistics[0].Count)
+	require.InDelta(suite.T(), 81.6466266, statistics[0].Latest, 0.0001)
+	require.Equal(suite.T(), float64(82), statistics[0].Maximum)
+
+	//statistics for each period
+	statistics, err = dbRepo.QueryObservationStatistics(authContext, models.ObservationStatisticsQuery{Bucket: "month", Unit: "kg"})
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), []string{"http://loinc.org|29463-7|2023-01", "http://loinc.org|29463-7|2023-02", "http://loinc.org|29463-7|2023-03", "urn:oid:1.2.840.114350|W|2023-01"},
+		lo.Map(statistics, func(statistic models.ObservationStatistics, _ int) string {
+			return fmt.Sprintf("%s|%s|%s", statistic.CodeSystem, statistic.Code, statistic.Period)
+		}),
+	)
+
+	_, err = dbRepo.QueryObservationStatistics(authContext, models.ObservationStatisticsQuery{Unit: "mg/dL"})
+	require.NoError(suite.T(), err)
+	_, err = dbRepo.QueryObservationStatistics(authContext, models.ObservationStatisticsQuery{Unit: "unknown"})
+	require.Error(suite.T(), err)
+}
+
 func (suite *RepositoryTestSuite) TestListResources() {
 	//setup
 	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
@@ -505,28 +808,28 @@ func (suite *RepositoryTestSuite) TestListResources() {
 	require.True(suite.T(), testResource2Created)
 
 	//test
-	foundPatientResources, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{
+	foundPatientResources, _, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{
 		SourceResourceType: "Patient",
 	})
 	require.NoError(suite.T(), err)
 
-	findAllResources, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{})
+	findAllResources, _, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{})
 	require.NoError(suite.T(), err)
 
-	findSourceResources, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{SourceID: testSource1Credential.ID.String()})
+	findSourceResources, _, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{SourceID: testSource1Credential.ID.String()})
 	require.NoError(suite.T(), err)
 
 	//find specific resource
-	findSpecificResource, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{SourceResourceID: "d3fbfb3a-7b8d-45c0-13b4-9666e4d36a3e", SourceResourceType: "Patient"})
+	findSpecificResource, _, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{SourceResourceID: "d3fbfb3a-7b8d-45c0-13b4-9666e4d36a3e", SourceResourceType: "Patient"})
 	require.NoError(suite.T(), err)
 
-	findInvalidResource, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{SourceResourceID: "11111111-7b8d-45c0-13b4-9666e4d36a3e", SourceResourceType: "Patient"})
+	findInvalidResource, _, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{SourceResourceID: "11111111-7b8d-45c0-13b4-9666e4d36a3e", SourceResourceType: "Patient"})
 	require.NoError(suite.T(), err)
 
-	findResourceWithOtherUserId, err := dbRepo.ListResources(context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_other_username"), models.ListResourceQueryOptions{SourceResourceID: "d3fbfb3a-7b8d-45c0-13b4-9666e4d36a3e", SourceResourceType: "Patient"})
+	findResourceWithOtherUserId, _, err := dbRepo.ListResources(context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_other_username"), models.ListResourceQueryOptions{SourceResourceID: "d3fbfb3a-7b8d-45c0-13b4-9666e4d36a3e", SourceResourceType: "Patient"})
 	require.NoError(suite.T(), err)
 
-	_, err = dbRepo.ListResources(context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "doesnt_exist"), models.ListResourceQueryOptions{SourceResourceID: "d3fbfb3a-7b8d-45c0-13b4-9666e4d36a3e", SourceResourceType: "Patient"})
+	_, _, err = dbRepo.ListResources(context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "doesnt_exist"), models.ListResourceQueryOptions{SourceResourceID: "d3fbfb3a-7b8d-45c0-13b4-9666e4d36a3e", SourceResourceType: "Patient"})
 	require.Error(suite.T(), err)
 
 	//assert
@@ -538,6 +841,215 @@ func (suite *RepositoryTestSuite) TestListResources() {
 	require.Equal(suite.T(), len(findResourceWithOtherUserId), 0)
 }
 
+func (suite *RepositoryTestSuite) TestListResources_WithCursorPagination() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	testSourceCredential := models.SourceCredential{
+		ModelBase: models.ModelBase{
+			ID: uuid.New(),
+		},
+		UserID: userModel.ID,
+	}
+	err = dbRepo.CreateSource(authContext, &testSourceCredential)
+	require.NoError(suite.T(), err)
+
+	testPatientData, err := os.ReadFile("./testdata/Abraham100_Heller342_262b819a-5193-404a-9787-b7f599358035.json")
+	require.NoError(suite.T(), err)
+
+	var testPatientBundle fhir401.Bundle
+	err = json.Unmarshal(testPatientData, &testPatientBundle)
+	require.NoError(suite.T(), err)
+
+	for _, resourceEntry := range testPatientBundle.Entry {
+		fhirResource, _ := fhirutils.MapToResource(resourceEntry.Resource, false)
+		resourceType, resourceId := fhirResource.(sourceModels.ResourceInterface).ResourceRef()
+		if resourceId == nil {
+			continue //skip resources missing an ID
+		}
+		_, err := dbRepo.UpsertRawResource(
+			authContext,
+			&testSourceCredential,
+			sourceModels.RawResourceFhir{
+				SourceResourceType: resourceType,
+				SourceResourceID:   *resourceId,
+				ResourceRaw:        resourceEntry.Resource,
+			},
+		)
+		require.NoError(suite.T(), err)
+	}
+
+	//test
+	allResources, allResourcesPagination, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{})
+	require.NoError(suite.T(), err)
+
+	pagedResources := []models.ResourceBase{}
+	pageCount := 0
+	cursor := ""
+	for {
+		resources, pagination, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{Limit: 50, Cursor: cursor})
+		require.NoError(suite.T(), err)
+		require.Equal(suite.T(), int64(198), pagination.Total)
+		pagedResources = append(pagedResources, resources...)
+		pageCount++
+		if len(pagination.Next) == 0 {
+			break
+		}
+		cursor = pagination.Next
+	}
+
+	observations, observationsPagination, err := dbRepo.QueryResources(authContext, models.QueryResource{
+		From:  "Observation",
+		Limit: lo.ToPtr(40),
+	})
+	require.NoError(suite.T(), err)
+	nextObservations, nextObservationsPagination, err := dbRepo.QueryResources(authContext, models.QueryResource{
+		From:   "Observation",
+		Limit:  lo.ToPtr(40),
+		Cursor: observationsPagination.Next,
+	})
+	require.NoError(suite.T(), err)
+
+	//assert
+	require.Equal(suite.T(), int64(198), allResourcesPagination.Total)
+	require.Empty(suite.T(), allResourcesPagination.Next)
+	require.Equal(suite.T(), 4, pageCount)
+	require.Equal(suite.T(), allResources, pagedResources)
+	for ndx := 1; ndx < len(pagedResources); ndx++ {
+		//newest first, resources without a date are last
+		if pagedResources[ndx].SortDate != nil {
+			require.NotNil(suite.T(), pagedResources[ndx-1].SortDate)
+			require.False(suite.T(), pagedResources[ndx].SortDate.After(*pagedResources[ndx-1].SortDate))
+		}
+	}
+
+	require.Len(suite.T(), observations, 40)
+	require.Equal(suite.T(), int64(93), observationsPagination.Total)
+	require.NotEmpty(suite.T(), observationsPagination.Next)
+	require.Len(suite.T(), nextObservations, 40)
+	require.Equal(suite.T(), int64(93), nextObservationsPagination.Total)
+	require.NotEqual(suite.T(), observations.([]models.ResourceBase)[0].ID, nextObservations.([]models.ResourceBase)[0].ID)
+}
+
+func (suite *RepositoryTestSuite) TestExportResources() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	testSource1Credential := models.SourceCredential{ModelBase: models.ModelBase{ID: uuid.New()}, UserID: userModel.ID, Patient: "b426b062-8273-4b93-a907-de3176c0567d"}
+	err = dbRepo.CreateSource(authContext, &testSource1Credential)
+	require.NoError(suite.T(), err)
+	testSource2Credential := models.SourceCredential{ModelBase: models.ModelBase{ID: uuid.New()}, UserID: userModel.ID, Patient: "d3fbfb3a-7b8d-45c0-13b4-9666e4d36a3e"}
+	err = dbRepo.CreateSource(authContext, &testSource2Credential)
+	require.NoError(suite.T(), err)
+
+	patientDataAbraham100, err := os.ReadFile("./testdata/Abraham100_Heller342_Patient.json")
+	require.NoError(suite.T(), err)
+	_, err = dbRepo.UpsertRawResource(authContext, &testSource1Credential, sourceModels.RawResourceFhir{
+		SourceResourceType:  "Patient",
+		SourceResourceID:    "b426b062-8273-4b93-a907-de3176c0567d",
+		ResourceRaw:         patientDataAbraham100,
+		SortDate:            lo.ToPtr(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)),
+		ReferencedResources: []string{"Observation/1", "Observation/2"},
+	})
+	require.NoError(suite.T(), err)
+
+	patientDataLillia547, err := os.ReadFile("./testdata/Lillia547_Schneider99_Patient.json")
+	require.NoError(suite.T(), err)
+	_, err = dbRepo.UpsertRawResource(authContext, &testSource2Credential, sourceModels.RawResourceFhir{
+		SourceResourceType: "Patient",
+		SourceResourceID:   "d3fbfb3a-7b8d-45c0-13b4-9666e4d36a3e",
+		ResourceRaw:        patientDataLillia547,
+	})
+	require.NoError(suite.T(), err)
+
+	exportResourceIds := func(exportOptions models.ExportResourceQueryOptions) ([]string, error) {
+		resourceIds := []string{}
+		err := dbRepo.ExportResources(authContext, exportOptions, func(resource *models.ResourceBase) error {
+			resourceIds = append(resourceIds, resource.SourceResourceID)
+			if resource.SourceResourceID == "b426b062-8273-4b93-a907-de3176c0567d" {
+				require.Len(suite.T(), resource.RelatedResource, 2)
+				require.Equal(suite.T(), "Observation", resource.RelatedResource[0].SourceResourceType)
+			} else {
+				require.Empty(suite.T(), resource.RelatedResource)
+			}
+			require.NotEmpty(suite.T(), resource.ResourceRaw)
+			return nil
+		})
+		return resourceIds, err
+	}
+
+	//test & assert
+	allResourceIds, err := exportResourceIds(models.ExportResourceQueryOptions{})
+	require.NoError(suite.T(), err)
+	require.ElementsMatch(suite.T(), []string{"b426b062-8273-4b93-a907-de3176c0567d", "d3fbfb3a-7b8d-45c0-13b4-9666e4d36a3e"}, allResourceIds)
+
+	sourceResourceIds, err := exportResourceIds(models.ExportResourceQueryOptions{SourceID: testSource2Credential.ID.String()})
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), []string{"d3fbfb3a-7b8d-45c0-13b4-9666e4d36a3e"}, sourceResourceIds)
+
+	typeResourceIds, err := exportResourceIds(models.ExportResourceQueryOptions{SourceResourceTypes: []string{"Observation"}})
+	require.NoError(suite.T(), err)
+	require.Empty(suite.T(), typeResourceIds)
+
+	//resources without a date are always exported
+	startResourceIds, err := exportResourceIds(models.ExportResourceQueryOptions{Start: lo.ToPtr(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))})
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), []string{"d3fbfb3a-7b8d-45c0-13b4-9666e4d36a3e"}, startResourceIds)
+
+	endResourceIds, err := exportResourceIds(models.ExportResourceQueryOptions{End: lo.ToPtr(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))})
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), endResourceIds, 2)
+
+	sinceResourceIds, err := exportResourceIds(models.ExportResourceQueryOptions{Since: lo.ToPtr(time.Now().Add(time.Hour))})
+	require.NoError(suite.T(), err)
+	require.Empty(suite.T(), sinceResourceIds)
+
+	_, err = exportResourceIds(models.ExportResourceQueryOptions{SourceResourceTypes: []string{"fhir_patient; DROP TABLE users"}})
+	require.Error(suite.T(), err)
+
+	_, err = exportResourceIds(models.ExportResourceQueryOptions{SourceID: uuid.New().String()})
+	require.Error(suite.T(), err)
+
+	//errors returned by the callback stop the export
+	exportCount := 0
+	err = dbRepo.ExportResources(authContext, models.ExportResourceQueryOptions{}, func(resource *models.ResourceBase) error {
+		exportCount++
+		return fmt.Errorf("stop")
+	})
+	require.EqualError(suite.T(), err, "stop")
+	require.Equal(suite.T(), 1, exportCount)
+}
+
 func (suite *RepositoryTestSuite) TestGetResourceByResourceTypeAndId() {
 	//setup
 	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
@@ -832,10 +1344,71 @@ func (suite *RepositoryTestSuite) TestRemoveResourceAssociation() {
 		&testSourceCredential, "Observation", "11111111-8273-4b93-a907-de3176c0567d")
 	require.Errorf(suite.T(), errWhenNotExists, "association should not exist, so deletion should fail")
 
-	err = dbRepo.RemoveResourceAssociation(authContext,
-		&testSourceCredential, "Patient", "b426b062-8273-4b93-a907-de3176c0567d",
-		&testSourceCredential, "Observation", "11111111-8273-4b93-a907-de3176c0567d")
+	err = dbRepo.RemoveResourceAssociation(authContext,
+		&testSourceCredential, "Patient", "b426b062-8273-4b93-a907-de3176c0567d",
+		&testSourceCredential, "Observation", "11111111-8273-4b93-a907-de3176c0567d")
+	require.NoError(suite.T(), err)
+}
+
+func (suite *RepositoryTestSuite) TestRemoveResourceAssociations_InTransaction() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	testSourceCredential := models.SourceCredential{
+		ModelBase: models.ModelBase{
+			ID: uuid.New(),
+		},
+		UserID: userModel.ID,
+	}
+	for _, relatedResourceId := range []string{"11111111-8273-4b93-a907-de3176c0567d", "22222222-8273-4b93-a907-de3176c0567d"} {
+		err = dbRepo.AddResourceAssociation(authContext,
+			&testSourceCredential, "Patient", "b426b062-8273-4b93-a907-de3176c0567d",
+			&testSourceCredential, "Observation", relatedResourceId)
+		require.NoError(suite.T(), err)
+	}
+	//associations to the resource are kept
+	err = dbRepo.AddResourceAssociation(authContext,
+		&testSourceCredential, "Observation", "11111111-8273-4b93-a907-de3176c0567d",
+		&testSourceCredential, "Patient", "b426b062-8273-4b93-a907-de3176c0567d")
+	require.NoError(suite.T(), err)
+
+	//test
+	rollbackErr := dbRepo.RunInTransaction(authContext, func(txRepo DatabaseRepository) error {
+		require.NoError(suite.T(), txRepo.RemoveResourceAssociations(authContext, &testSourceCredential, "Patient", "b426b062-8273-4b93-a907-de3176c0567d"))
+		return fmt.Errorf("rollback")
+	})
+	rolledBackAssociations, err := dbRepo.FindResourceAssociationsByTypeAndId(authContext, &testSourceCredential, "Patient", "b426b062-8273-4b93-a907-de3176c0567d")
+	require.NoError(suite.T(), err)
+
+	err = dbRepo.RunInTransaction(authContext, func(txRepo DatabaseRepository) error {
+		return txRepo.RemoveResourceAssociations(authContext, &testSourceCredential, "Patient", "b426b062-8273-4b93-a907-de3176c0567d")
+	})
 	require.NoError(suite.T(), err)
+	removedAssociations, err := dbRepo.FindResourceAssociationsByTypeAndId(authContext, &testSourceCredential, "Patient", "b426b062-8273-4b93-a907-de3176c0567d")
+	require.NoError(suite.T(), err)
+	keptAssociations, err := dbRepo.FindResourceAssociationsByTypeAndId(authContext, &testSourceCredential, "Observation", "11111111-8273-4b93-a907-de3176c0567d")
+	require.NoError(suite.T(), err)
+
+	//assert
+	require.EqualError(suite.T(), rollbackErr, "rollback")
+	require.Len(suite.T(), rolledBackAssociations, 2)
+	require.Empty(suite.T(), removedAssociations)
+	require.Len(suite.T(), keptAssociations, 1)
 }
 
 func (suite *RepositoryTestSuite) TestGetSourceSummary() {
@@ -1075,7 +1648,7 @@ func (suite *RepositoryTestSuite) TestAddResourceComposition() {
 
 	//assert
 	//check that composition was created
-	compositions, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{
+	compositions, _, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{
 		SourceID:           "00000000-0000-0000-0000-000000000000",
 		SourceResourceType: "Composition",
 	})
@@ -1119,6 +1692,8 @@ func (suite *RepositoryTestSuite) TestAddResourceComposition_WithExistingComposi
 	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
 	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
 	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	fakeConfig.EXPECT().GetInt("history.retention.max_versions").Return(0).AnyTimes()
+	fakeConfig.EXPECT().GetInt("history.retention.days").Return(0).AnyTimes()
 	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
 	require.NoError(suite.T(), err)
 
@@ -1174,7 +1749,7 @@ func (suite *RepositoryTestSuite) TestAddResourceComposition_WithExistingComposi
 	require.NoError(suite.T(), err)
 
 	//find existing composition
-	existingCompositions, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{
+	existingCompositions, _, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{
 		SourceID:           "00000000-0000-0000-0000-000000000000",
 		SourceResourceType: "Composition",
 	})
@@ -1206,7 +1781,7 @@ func (suite *RepositoryTestSuite) TestAddResourceComposition_WithExistingComposi
 
 	//assert
 	//check that composition was created
-	compositions, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{
+	compositions, _, err := dbRepo.ListResources(authContext, models.ListResourceQueryOptions{
 		SourceID:           "00000000-0000-0000-0000-000000000000",
 		SourceResourceType: "Composition",
 	})
@@ -1310,6 +1885,49 @@ func (suite *RepositoryTestSuite) TestCreateBackgroundJob_Sync() {
 	require.Equal(suite.T(), userModel.ID, backgroundJob.UserID)
 }
 
+func (suite *RepositoryTestSuite) TestBackgroundJobCheckpoint_Export() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	backgroundJob := models.NewExportBackgroundJob(models.BackgroundJobExportData{
+		Request:       "http://localhost:9090/api/fhir/r4/$export?_type=Patient",
+		ResourceTypes: []string{"Patient"},
+	})
+	err = dbRepo.CreateBackgroundJob(authContext, backgroundJob)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), pkg.BackgroundJobTypeExport, backgroundJob.JobType)
+
+	//test
+	dbRepo.BackgroundJobCheckpoint(
+		context.WithValue(authContext, pkg.ContextKeyTypeBackgroundJobID, backgroundJob.ID.String()),
+		map[string]interface{}{"resource_type": "Patient", "resource_count": 1},
+		nil,
+	)
+
+	//assert
+	foundBackgroundJob, err := dbRepo.GetBackgroundJob(authContext, backgroundJob.ID.String())
+	require.NoError(suite.T(), err)
+	var exportData models.BackgroundJobExportData
+	require.NoError(suite.T(), json.Unmarshal(foundBackgroundJob.Data, &exportData))
+	require.Equal(suite.T(), "http://localhost:9090/api/fhir/r4/$export?_type=Patient", exportData.Request, "job type specific data must be preserved")
+	require.Equal(suite.T(), []string{"Patient"}, exportData.ResourceTypes)
+	require.Equal(suite.T(), map[string]interface{}{"resource_type": "Patient", "resource_count": float64(1)}, exportData.CheckpointData)
+}
+
 func (suite *RepositoryTestSuite) TestListBackgroundJobs() {
 	//setup
 	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
@@ -1368,25 +1986,42 @@ func (suite *RepositoryTestSuite) TestListBackgroundJobs() {
 	require.NoError(suite.T(), err)
 
 	//test
-	foundAllBackgroundJobs, err := dbRepo.ListBackgroundJobs(authContext, models.BackgroundJobQueryOptions{})
+	foundAllBackgroundJobs, _, err := dbRepo.ListBackgroundJobs(authContext, models.BackgroundJobQueryOptions{})
 	require.NoError(suite.T(), err)
 
 	syncJobType := pkg.BackgroundJobTypeSync
-	foundBackgroundJobsByType, err := dbRepo.ListBackgroundJobs(authContext, models.BackgroundJobQueryOptions{
+	foundBackgroundJobsByType, _, err := dbRepo.ListBackgroundJobs(authContext, models.BackgroundJobQueryOptions{
 		JobType: &syncJobType,
 	})
 	require.NoError(suite.T(), err)
 
 	syncFailedStatus := pkg.BackgroundJobStatusFailed
-	foundBackgroundJobsByStatus, err := dbRepo.ListBackgroundJobs(authContext, models.BackgroundJobQueryOptions{
+	foundBackgroundJobsByStatus, _, err := dbRepo.ListBackgroundJobs(authContext, models.BackgroundJobQueryOptions{
 		Status: &syncFailedStatus,
 	})
 	require.NoError(suite.T(), err)
 
+	firstPageBackgroundJobs, firstPagePagination, err := dbRepo.ListBackgroundJobs(authContext, models.BackgroundJobQueryOptions{
+		Limit: 2,
+	})
+	require.NoError(suite.T(), err)
+	secondPageBackgroundJobs, secondPagePagination, err := dbRepo.ListBackgroundJobs(authContext, models.BackgroundJobQueryOptions{
+		Limit:  2,
+		Cursor: firstPagePagination.Next,
+	})
+	require.NoError(suite.T(), err)
+
 	//assert
 	require.Equal(suite.T(), 3, len(foundAllBackgroundJobs))
 	require.Equal(suite.T(), 2, len(foundBackgroundJobsByType))
 	require.Equal(suite.T(), 1, len(foundBackgroundJobsByStatus))
+
+	require.Equal(suite.T(), foundAllBackgroundJobs[:2], firstPageBackgroundJobs)
+	require.Equal(suite.T(), int64(3), firstPagePagination.Total)
+	require.NotEmpty(suite.T(), firstPagePagination.Next)
+	require.Equal(suite.T(), foundAllBackgroundJobs[2:], secondPageBackgroundJobs)
+	require.Equal(suite.T(), int64(3), secondPagePagination.Total)
+	require.Empty(suite.T(), secondPagePagination.Next)
 }
 
 func (suite *RepositoryTestSuite) TestUpdateBackgroundJob() {
@@ -1427,7 +2062,7 @@ func (suite *RepositoryTestSuite) TestUpdateBackgroundJob() {
 	require.NoError(suite.T(), err)
 
 	//list all records and ensure that the updated record is the same
-	foundAllBackgroundJobs, err := dbRepo.ListBackgroundJobs(authContext, models.BackgroundJobQueryOptions{})
+	foundAllBackgroundJobs, _, err := dbRepo.ListBackgroundJobs(authContext, models.BackgroundJobQueryOptions{})
 	require.NoError(suite.T(), err)
 
 	//assert
@@ -1436,3 +2071,383 @@ func (suite *RepositoryTestSuite) TestUpdateBackgroundJob() {
 	require.Equal(suite.T(), pkg.BackgroundJobStatusFailed, foundAllBackgroundJobs[0].JobStatus)
 	require.NotNil(suite.T(), foundAllBackgroundJobs[0].DoneTime)
 }
+
+func (suite *RepositoryTestSuite) TestClaimBackgroundJob() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	sourceCredential := models.SourceCredential{ModelBase: models.ModelBase{ID: uuid.New()}, SourceType: sourcePkg.SourceType("bluebutton")}
+	lockedBackgroundJob := models.NewSyncBackgroundJob(sourceCredential)
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, lockedBackgroundJob))
+	scheduledBackgroundJob, err := models.NewScheduledSyncBackgroundJob(pkg.BackgroundJobScheduleDaily, nil, time.Now())
+	require.NoError(suite.T(), err)
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, scheduledBackgroundJob))
+	queuedBackgroundJob := models.NewQueuedSyncBackgroundJob(sourceCredential)
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, queuedBackgroundJob))
+
+	//test
+	claimedBackgroundJob, err := dbRepo.ClaimBackgroundJob(context.Background(), []pkg.BackgroundJobType{pkg.BackgroundJobTypeSync})
+	require.NoError(suite.T(), err)
+	nextClaimedBackgroundJob, err := dbRepo.ClaimBackgroundJob(context.Background(), []pkg.BackgroundJobType{pkg.BackgroundJobTypeSync})
+	require.NoError(suite.T(), err)
+
+	//assert
+	require.NotNil(suite.T(), claimedBackgroundJob)
+	require.Equal(suite.T(), queuedBackgroundJob.ID, claimedBackgroundJob.ID)
+	require.Equal(suite.T(), pkg.BackgroundJobStatusLocked, claimedBackgroundJob.JobStatus)
+	require.NotNil(suite.T(), claimedBackgroundJob.LockedTime)
+	require.Equal(suite.T(), "test_username", claimedBackgroundJob.User.Username, "the job user must be preloaded")
+	require.Nil(suite.T(), nextClaimedBackgroundJob, "the scheduled job must not be claimed, since it's not a sync job")
+
+	foundBackgroundJob, err := dbRepo.GetBackgroundJob(authContext, queuedBackgroundJob.ID.String())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), pkg.BackgroundJobStatusLocked, foundBackgroundJob.JobStatus)
+}
+
+func (suite *RepositoryTestSuite) TestClearSourceLatestBackgroundJob() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	sourceCredential := models.SourceCredential{UserID: userModel.ID, SourceType: sourcePkg.SourceType("bluebutton")}
+	require.NoError(suite.T(), dbRepo.CreateSource(authContext, &sourceCredential))
+	backgroundJob := models.NewSyncBackgroundJob(sourceCredential)
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, backgroundJob))
+	sourceCredential.LatestBackgroundJobID = &backgroundJob.ID
+	require.NoError(suite.T(), dbRepo.UpdateSource(authContext, &sourceCredential))
+
+	//updating the source credentials (eg. when the source is reconnected) must not clear the in-progress background job
+	require.NoError(suite.T(), dbRepo.UpdateSource(authContext, &models.SourceCredential{
+		ModelBase:   models.ModelBase{ID: sourceCredential.ID},
+		SourceType:  sourceCredential.SourceType,
+		AccessToken: "updated-access-token",
+	}))
+	foundSourceCredential, err := dbRepo.GetSource(authContext, sourceCredential.ID.String())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), "updated-access-token", foundSourceCredential.AccessToken)
+	require.Equal(suite.T(), backgroundJob.ID, *foundSourceCredential.LatestBackgroundJobID)
+
+	//test
+	require.NoError(suite.T(), dbRepo.ClearSourceLatestBackgroundJob(authContext, sourceCredential.ID.String()))
+
+	//assert
+	foundSourceCredential, err = dbRepo.GetSource(authContext, sourceCredential.ID.String())
+	require.NoError(suite.T(), err)
+	require.Nil(suite.T(), foundSourceCredential.LatestBackgroundJobID)
+	require.Equal(suite.T(), "updated-access-token", foundSourceCredential.AccessToken)
+}
+
+func (suite *RepositoryTestSuite) TestCancelBackgroundJob() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	sourceCredential := models.SourceCredential{UserID: userModel.ID, SourceType: sourcePkg.SourceType("bluebutton")}
+	require.NoError(suite.T(), dbRepo.CreateSource(authContext, &sourceCredential))
+	lockedBackgroundJob := models.NewSyncBackgroundJob(sourceCredential)
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, lockedBackgroundJob))
+	queuedBackgroundJob := models.NewQueuedSyncBackgroundJob(sourceCredential)
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, queuedBackgroundJob))
+	sourceCredential.LatestBackgroundJobID = &queuedBackgroundJob.ID
+	require.NoError(suite.T(), dbRepo.UpdateSource(authContext, &sourceCredential))
+
+	//test
+	cancelledLocked, err := dbRepo.CancelBackgroundJob(authContext, lockedBackgroundJob.ID.String())
+	require.NoError(suite.T(), err)
+	cancelledQueued, err := dbRepo.CancelBackgroundJob(authContext, queuedBackgroundJob.ID.String())
+	require.NoError(suite.T(), err)
+	require.NoError(suite.T(), dbRepo.ClearSourceLatestBackgroundJob(authContext, sourceCredential.ID.String()))
+
+	//assert
+	require.False(suite.T(), cancelledLocked, "locked jobs must be cancelled by the job runner")
+	require.True(suite.T(), cancelledQueued)
+
+	foundBackgroundJob, err := dbRepo.GetBackgroundJob(authContext, queuedBackgroundJob.ID.String())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), pkg.BackgroundJobStatusCancelled, foundBackgroundJob.JobStatus)
+	require.NotNil(suite.T(), foundBackgroundJob.DoneTime)
+	claimedBackgroundJob, err := dbRepo.ClaimBackgroundJob(context.Background(), []pkg.BackgroundJobType{pkg.BackgroundJobTypeSync})
+	require.NoError(suite.T(), err)
+	require.Nil(suite.T(), claimedBackgroundJob, "cancelled jobs must not be claimed")
+
+	foundSourceCredential, err := dbRepo.GetSource(authContext, sourceCredential.ID.String())
+	require.NoError(suite.T(), err)
+	require.Nil(suite.T(), foundSourceCredential.LatestBackgroundJobID, "the latest background job id must be cleared")
+}
+
+func (suite *RepositoryTestSuite) TestClaimBackgroundJob_Concurrent() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	queuedBackgroundJobIds := []uuid.UUID{}
+	for i := 0; i < 10; i++ {
+		queuedBackgroundJob := models.NewQueuedSyncBackgroundJob(models.SourceCredential{ModelBase: models.ModelBase{ID: uuid.New()}})
+		require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, queuedBackgroundJob))
+		queuedBackgroundJobIds = append(queuedBackgroundJobIds, queuedBackgroundJob.ID)
+	}
+
+	//test
+	var claimedBackgroundJobIdsMutex sync.Mutex
+	claimedBackgroundJobIds := []uuid.UUID{}
+	var workers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				claimedBackgroundJob, err := dbRepo.ClaimBackgroundJob(context.Background(), []pkg.BackgroundJobType{pkg.BackgroundJobTypeSync})
+				if err != nil || claimedBackgroundJob == nil {
+					return
+				}
+				claimedBackgroundJobIdsMutex.Lock()
+				claimedBackgroundJobIds = append(claimedBackgroundJobIds, claimedBackgroundJob.ID)
+				claimedBackgroundJobIdsMutex.Unlock()
+			}
+		}()
+	}
+	workers.Wait()
+
+	//assert
+	require.ElementsMatch(suite.T(), queuedBackgroundJobIds, claimedBackgroundJobIds, "each job must be claimed exactly once")
+}
+
+func (suite *RepositoryTestSuite) TestClaimBackgroundJob_Scheduled() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	upcomingBackgroundJob, err := models.NewScheduledSyncBackgroundJob(pkg.BackgroundJobScheduleDaily, nil, time.Now())
+	require.NoError(suite.T(), err)
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, upcomingBackgroundJob))
+	dueBackgroundJob, err := models.NewScheduledSyncBackgroundJob(pkg.BackgroundJobScheduleWeekly, nil, time.Now().AddDate(0, 0, -8))
+	require.NoError(suite.T(), err)
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, dueBackgroundJob))
+
+	//test
+	claimedBackgroundJob, err := dbRepo.ClaimBackgroundJob(context.Background(), []pkg.BackgroundJobType{pkg.BackgroundJobTypeScheduledSync})
+	require.NoError(suite.T(), err)
+	nextClaimedBackgroundJob, err := dbRepo.ClaimBackgroundJob(context.Background(), []pkg.BackgroundJobType{pkg.BackgroundJobTypeScheduledSync})
+	require.NoError(suite.T(), err)
+	err = dbRepo.ResumeLockedBackgroundJobs(context.Background(), nil, 3, time.Minute)
+	require.NoError(suite.T(), err)
+
+	//assert
+	require.NotNil(suite.T(), claimedBackgroundJob)
+	require.Equal(suite.T(), dueBackgroundJob.ID, claimedBackgroundJob.ID)
+	require.Nil(suite.T(), nextClaimedBackgroundJob, "the upcoming scheduled job must not be claimed before its next run time")
+
+	foundBackgroundJob, err := dbRepo.GetBackgroundJob(authContext, dueBackgroundJob.ID.String())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), pkg.BackgroundJobStatusReady, foundBackgroundJob.JobStatus, "locked scheduled jobs must be unlocked (rather than failed) on restart")
+	require.Nil(suite.T(), foundBackgroundJob.LockedTime)
+}
+
+func (suite *RepositoryTestSuite) TestResumeLockedBackgroundJobs() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	sourceCredential := models.SourceCredential{ModelBase: models.ModelBase{ID: uuid.New()}, SourceType: sourcePkg.SourceType("bluebutton")}
+	interruptedBackgroundJob := models.NewSyncBackgroundJob(sourceCredential)
+	interruptedBackgroundJob.Retries = 1
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, interruptedBackgroundJob))
+	dbRepo.BackgroundJobCheckpoint(
+		context.WithValue(authContext, pkg.ContextKeyTypeBackgroundJobID, interruptedBackgroundJob.ID.String()),
+		map[string]interface{}{"stage": "Encounter", "stage_progress": 100},
+		nil,
+	)
+	exhaustedBackgroundJob := models.NewSyncBackgroundJob(sourceCredential)
+	exhaustedBackgroundJob.Retries = 2
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, exhaustedBackgroundJob))
+	exportBackgroundJob := models.NewExportBackgroundJob(models.BackgroundJobExportData{TransactionTime: time.Now()})
+	exportBackgroundJob.JobStatus = pkg.BackgroundJobStatusLocked
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, exportBackgroundJob))
+	//manual uploads are synced from the request, so they cannot be resumed
+	manualBackgroundJob := models.NewSyncBackgroundJob(models.SourceCredential{ModelBase: models.ModelBase{ID: uuid.New()}, SourceType: sourcePkg.SourceTypeManual})
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, manualBackgroundJob))
+
+	//test
+	err = dbRepo.ResumeLockedBackgroundJobs(context.Background(), []pkg.BackgroundJobType{pkg.BackgroundJobTypeSync}, 3, time.Minute)
+	require.NoError(suite.T(), err)
+
+	//assert
+	//the interrupted sync is queued with its checkpoint, after an exponential backoff (2 minutes for the 2nd retry)
+	resumedBackgroundJob, err := dbRepo.GetBackgroundJob(authContext, interruptedBackgroundJob.ID.String())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), pkg.BackgroundJobStatusReady, resumedBackgroundJob.JobStatus)
+	require.Equal(suite.T(), 2, resumedBackgroundJob.Retries)
+	require.Nil(suite.T(), resumedBackgroundJob.LockedTime)
+	require.NotNil(suite.T(), resumedBackgroundJob.NextRunTime)
+	require.WithinDuration(suite.T(), time.Now().Add(2*time.Minute), *resumedBackgroundJob.NextRunTime, 10*time.Second)
+	var resumedBackgroundJobData models.BackgroundJobSyncData
+	require.NoError(suite.T(), json.Unmarshal(resumedBackgroundJob.Data, &resumedBackgroundJobData))
+	require.Equal(suite.T(), sourceCredential.ID, resumedBackgroundJobData.SourceID)
+	require.Equal(suite.T(), "Encounter", resumedBackgroundJobData.CheckpointData["stage"])
+
+	//the resumed sync is not claimed until the backoff has elapsed
+	claimedBackgroundJob, err := dbRepo.ClaimBackgroundJob(context.Background(), []pkg.BackgroundJobType{pkg.BackgroundJobTypeSync})
+	require.NoError(suite.T(), err)
+	require.Nil(suite.T(), claimedBackgroundJob)
+
+	//jobs which have reached the max attempts, and jobs which cannot be resumed are failed
+	for _, failedBackgroundJobId := range []string{exhaustedBackgroundJob.ID.String(), exportBackgroundJob.ID.String(), manualBackgroundJob.ID.String()} {
+		failedBackgroundJob, err := dbRepo.GetBackgroundJob(authContext, failedBackgroundJobId)
+		require.NoError(suite.T(), err)
+		require.Equal(suite.T(), pkg.BackgroundJobStatusFailed, failedBackgroundJob.JobStatus)
+		require.NotNil(suite.T(), failedBackgroundJob.DoneTime)
+		var failedBackgroundJobData map[string]interface{}
+		require.NoError(suite.T(), json.Unmarshal(failedBackgroundJob.Data, &failedBackgroundJobData))
+		require.Contains(suite.T(), failedBackgroundJobData["error_data"], "final")
+	}
+	failedManualBackgroundJob, err := dbRepo.GetBackgroundJob(authContext, manualBackgroundJob.ID.String())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), 0, failedManualBackgroundJob.Retries)
+	require.Contains(suite.T(), string(failedManualBackgroundJob.Data), "must be uploaded again")
+}
+
+func (suite *RepositoryTestSuite) TestCreateListBackgroundJobLogs() {
+	//setup
+	fakeConfig := mock_config.NewMockInterface(suite.MockCtrl)
+	fakeConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	fakeConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
+	fakeConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
+	fakeConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	fakeConfig.EXPECT().GetInt("jobs.logs.max_entries").Return(3).AnyTimes()
+	fakeConfig.EXPECT().GetInt("jobs.logs.retention_days").Return(30).AnyTimes()
+	dbRepo, err := NewRepository(fakeConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
+	require.NoError(suite.T(), err)
+
+	userModel := &models.User{
+		Username: "test_username",
+		Password: "testpassword",
+		Email:    "test@test.com",
+	}
+	err = dbRepo.CreateUser(context.Background(), userModel)
+	require.NoError(suite.T(), err)
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	sourceCredential := models.SourceCredential{ModelBase: models.ModelBase{ID: uuid.New()}, SourceType: sourcePkg.SourceType("bluebutton")}
+	expiredBackgroundJob := models.NewSyncBackgroundJob(sourceCredential)
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, expiredBackgroundJob))
+	backgroundJob := models.NewSyncBackgroundJob(sourceCredential)
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJob(authContext, backgroundJob))
+
+	now := time.Now()
+	require.NoError(suite.T(), dbRepo.CreateBackgroundJobLogs(authContext, []models.BackgroundJobLog{
+		{BackgroundJobID: expiredBackgroundJob.ID, Level: "error", Message: "expired entry", LoggedAt: now.AddDate(0, 0, -31)},
+	}))
+
+	//test
+	err = dbRepo.CreateBackgroundJobLogs(authContext, []models.BackgroundJobLog{
+		{BackgroundJobID: backgroundJob.ID, Level: "info", Message: "entry 1", LoggedAt: now.Add(-4 * time.Minute)},
+		{BackgroundJobID: backgroundJob.ID, Level: "info", Message: "entry 2", LoggedAt: now.Add(-3 * time.Minute)},
+		{BackgroundJobID: backgroundJob.ID, Level: "warning", Message: "entry 3", ResourceType: "Observation", ResourceID: "obs-1", LoggedAt: now.Add(-2 * time.Minute)},
+		{BackgroundJobID: backgroundJob.ID, Level: "error", Message: "entry 4", LoggedAt: now.Add(-1 * time.Minute)},
+	})
+	require.NoError(suite.T(), err)
+	firstPage, firstPagination, err := dbRepo.ListBackgroundJobLogs(authContext, backgroundJob.ID.String(), models.BackgroundJobLogQueryOptions{Limit: 2})
+	require.NoError(suite.T(), err)
+	secondPage, secondPagination, err := dbRepo.ListBackgroundJobLogs(authContext, backgroundJob.ID.String(), models.BackgroundJobLogQueryOptions{Limit: 2, Cursor: firstPagination.Next})
+	require.NoError(suite.T(), err)
+	expiredLogs, _, err := dbRepo.ListBackgroundJobLogs(authContext, expiredBackgroundJob.ID.String(), models.BackgroundJobLogQueryOptions{})
+	require.NoError(suite.T(), err)
+
+	//assert
+	require.Equal(suite.T(), int64(3), firstPagination.Total, "only the most recent entries of the job must be kept")
+	require.Equal(suite.T(), []string{"entry 2", "entry 3"}, lo.Map(firstPage, func(backgroundJobLog models.BackgroundJobLog, _ int) string { return backgroundJobLog.Message }))
+	require.NotEmpty(suite.T(), firstPagination.Next)
+	require.Equal(suite.T(), "Observation", firstPage[1].ResourceType)
+	require.Equal(suite.T(), "obs-1", firstPage[1].ResourceID)
+	require.Equal(suite.T(), userModel.ID, firstPage[1].UserID)
+
+	require.Equal(suite.T(), []string{"entry 4"}, lo.Map(secondPage, func(backgroundJobLog models.BackgroundJobLog, _ int) string { return backgroundJobLog.Message }))
+	require.Empty(suite.T(), secondPagination.Next)
+
+	require.Empty(suite.T(), expiredLogs, "entries logged before the retention period must be removed")
+}
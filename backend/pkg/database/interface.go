@@ -6,6 +6,7 @@ import (
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
 	sourcePkg "github.com/fastenhealth/fasten-sources/clients/models"
 	"github.com/google/uuid"
+	"time"
 )
 
 //go:generate mockgen -source=interface.go -destination=mock/mock_database.go
@@ -22,11 +23,19 @@ type DatabaseRepository interface {
 
 	GetResourceByResourceTypeAndId(context.Context, string, string) (*models.ResourceBase, error)
 	GetResourceBySourceId(context.Context, string, string) (*models.ResourceBase, error)
-	QueryResources(ctx context.Context, query models.QueryResource) (interface{}, error)
-	ListResources(context.Context, models.ListResourceQueryOptions) ([]models.ResourceBase, error)
+	DeleteResource(ctx context.Context, sourceId string, sourceResourceType string, sourceResourceId string) (int64, error)
+	RunInTransaction(ctx context.Context, transactionFn func(txRepo DatabaseRepository) error) error
+	QueryResources(ctx context.Context, query models.QueryResource) (interface{}, models.Pagination, error)
+	ListResources(context.Context, models.ListResourceQueryOptions) ([]models.ResourceBase, models.Pagination, error)
+	SearchResources(ctx context.Context, options models.ResourceSearchQueryOptions) ([]models.ResourceSearchResult, error)
+	QueryObservationLastN(ctx context.Context, query models.ObservationLastNQuery) ([]models.ResourceBase, error)
+	QueryObservationStatistics(ctx context.Context, query models.ObservationStatisticsQuery) ([]models.ObservationStatistics, error)
+	ExportResources(ctx context.Context, options models.ExportResourceQueryOptions, exportCallback func(resource *models.ResourceBase) error) error
+	ListResourceHistory(ctx context.Context, sourceId string, sourceResourceType string, sourceResourceId string) ([]models.ResourceHistory, error)
 	GetPatientForSources(ctx context.Context) ([]models.ResourceBase, error)
 	AddResourceAssociation(ctx context.Context, source *models.SourceCredential, resourceType string, resourceId string, relatedSource *models.SourceCredential, relatedResourceType string, relatedResourceId string) error
 	RemoveResourceAssociation(ctx context.Context, source *models.SourceCredential, resourceType string, resourceId string, relatedSource *models.SourceCredential, relatedResourceType string, relatedResourceId string) error
+	RemoveResourceAssociations(ctx context.Context, source *models.SourceCredential, resourceType string, resourceId string) error
 	FindResourceAssociationsByTypeAndId(ctx context.Context, source *models.SourceCredential, resourceType string, resourceId string) ([]models.RelatedResource, error)
 	GetFlattenedResourceGraph(ctx context.Context, graphType pkg.ResourceGraphType, options models.ResourceGraphOptions) (map[string][]*models.ResourceBase, error)
 
@@ -40,6 +49,7 @@ type DatabaseRepository interface {
 	GetSourceSummary(context.Context, string) (*models.SourceSummary, error)
 	GetSources(context.Context) ([]models.SourceCredential, error)
 	UpdateSource(ctx context.Context, sourceCreds *models.SourceCredential) error
+	ClearSourceLatestBackgroundJob(ctx context.Context, sourceId string) error
 	DeleteSource(ctx context.Context, sourceId string) (int64, error)
 
 	CreateGlossaryEntry(ctx context.Context, glossaryEntry *models.Glossary) error
@@ -49,7 +59,13 @@ type DatabaseRepository interface {
 	CreateBackgroundJob(ctx context.Context, backgroundJob *models.BackgroundJob) error
 	GetBackgroundJob(ctx context.Context, backgroundJobId string) (*models.BackgroundJob, error)
 	UpdateBackgroundJob(ctx context.Context, backgroundJob *models.BackgroundJob) error
-	ListBackgroundJobs(ctx context.Context, queryOptions models.BackgroundJobQueryOptions) ([]models.BackgroundJob, error)
+	ListBackgroundJobs(ctx context.Context, queryOptions models.BackgroundJobQueryOptions) ([]models.BackgroundJob, models.Pagination, error)
+	CancelBackgroundJob(ctx context.Context, backgroundJobId string) (bool, error)
+	ClaimBackgroundJob(ctx context.Context, jobTypes []pkg.BackgroundJobType) (*models.BackgroundJob, error)
+	ResumeLockedBackgroundJobs(ctx context.Context, resumableJobTypes []pkg.BackgroundJobType, maxAttempts int, retryBackoff time.Duration) error
+	ListDoneBackgroundJobs(ctx context.Context, jobType pkg.BackgroundJobType, doneBefore time.Time) ([]models.BackgroundJob, error)
+	CreateBackgroundJobLogs(ctx context.Context, backgroundJobLogs []models.BackgroundJobLog) error
+	ListBackgroundJobLogs(ctx context.Context, backgroundJobId string, queryOptions models.BackgroundJobLogQueryOptions) ([]models.BackgroundJobLog, models.Pagination, error)
 
 	//settings
 	LoadUserSettings(ctx context.Context) (*models.UserSettings, error)
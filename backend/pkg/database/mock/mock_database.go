@@ -7,8 +7,10 @@ package mock_database
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	pkg "github.com/fastenhealth/fasten-onprem/backend/pkg"
+	database "github.com/fastenhealth/fasten-onprem/backend/pkg/database"
 	models "github.com/fastenhealth/fasten-onprem/backend/pkg/models"
 	models0 "github.com/fastenhealth/fasten-sources/clients/models"
 	gomock "github.com/golang/mock/gomock"
@@ -78,6 +80,50 @@ func (mr *MockDatabaseRepositoryMockRecorder) BackgroundJobCheckpoint(ctx, check
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BackgroundJobCheckpoint", reflect.TypeOf((*MockDatabaseRepository)(nil).BackgroundJobCheckpoint), ctx, checkpointData, errorData)
 }
 
+// CancelBackgroundJob mocks base method.
+func (m *MockDatabaseRepository) CancelBackgroundJob(ctx context.Context, backgroundJobId string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CancelBackgroundJob", ctx, backgroundJobId)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CancelBackgroundJob indicates an expected call of CancelBackgroundJob.
+func (mr *MockDatabaseRepositoryMockRecorder) CancelBackgroundJob(ctx, backgroundJobId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CancelBackgroundJob", reflect.TypeOf((*MockDatabaseRepository)(nil).CancelBackgroundJob), ctx, backgroundJobId)
+}
+
+// ClaimBackgroundJob mocks base method.
+func (m *MockDatabaseRepository) ClaimBackgroundJob(ctx context.Context, jobTypes []pkg.BackgroundJobType) (*models.BackgroundJob, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimBackgroundJob", ctx, jobTypes)
+	ret0, _ := ret[0].(*models.BackgroundJob)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimBackgroundJob indicates an expected call of ClaimBackgroundJob.
+func (mr *MockDatabaseRepositoryMockRecorder) ClaimBackgroundJob(ctx, jobTypes interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimBackgroundJob", reflect.TypeOf((*MockDatabaseRepository)(nil).ClaimBackgroundJob), ctx, jobTypes)
+}
+
+// ClearSourceLatestBackgroundJob mocks base method.
+func (m *MockDatabaseRepository) ClearSourceLatestBackgroundJob(ctx context.Context, sourceId string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClearSourceLatestBackgroundJob", ctx, sourceId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ClearSourceLatestBackgroundJob indicates an expected call of ClearSourceLatestBackgroundJob.
+func (mr *MockDatabaseRepositoryMockRecorder) ClearSourceLatestBackgroundJob(ctx, sourceId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClearSourceLatestBackgroundJob", reflect.TypeOf((*MockDatabaseRepository)(nil).ClearSourceLatestBackgroundJob), ctx, sourceId)
+}
+
 // Close mocks base method.
 func (m *MockDatabaseRepository) Close() error {
 	m.ctrl.T.Helper()
@@ -106,6 +152,20 @@ func (mr *MockDatabaseRepositoryMockRecorder) CreateBackgroundJob(ctx, backgroun
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateBackgroundJob", reflect.TypeOf((*MockDatabaseRepository)(nil).CreateBackgroundJob), ctx, backgroundJob)
 }
 
+// CreateBackgroundJobLogs mocks base method.
+func (m *MockDatabaseRepository) CreateBackgroundJobLogs(ctx context.Context, backgroundJobLogs []models.BackgroundJobLog) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateBackgroundJobLogs", ctx, backgroundJobLogs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateBackgroundJobLogs indicates an expected call of CreateBackgroundJobLogs.
+func (mr *MockDatabaseRepositoryMockRecorder) CreateBackgroundJobLogs(ctx, backgroundJobLogs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateBackgroundJobLogs", reflect.TypeOf((*MockDatabaseRepository)(nil).CreateBackgroundJobLogs), ctx, backgroundJobLogs)
+}
+
 // CreateGlossaryEntry mocks base method.
 func (m *MockDatabaseRepository) CreateGlossaryEntry(ctx context.Context, glossaryEntry *models.Glossary) error {
 	m.ctrl.T.Helper()
@@ -148,6 +208,21 @@ func (mr *MockDatabaseRepositoryMockRecorder) CreateUser(arg0, arg1 interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockDatabaseRepository)(nil).CreateUser), arg0, arg1)
 }
 
+// DeleteResource mocks base method.
+func (m *MockDatabaseRepository) DeleteResource(ctx context.Context, sourceId, sourceResourceType, sourceResourceId string) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteResource", ctx, sourceId, sourceResourceType, sourceResourceId)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteResource indicates an expected call of DeleteResource.
+func (mr *MockDatabaseRepositoryMockRecorder) DeleteResource(ctx, sourceId, sourceResourceType, sourceResourceId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteResource", reflect.TypeOf((*MockDatabaseRepository)(nil).DeleteResource), ctx, sourceId, sourceResourceType, sourceResourceId)
+}
+
 // DeleteSource mocks base method.
 func (m *MockDatabaseRepository) DeleteSource(ctx context.Context, sourceId string) (int64, error) {
 	m.ctrl.T.Helper()
@@ -163,6 +238,20 @@ func (mr *MockDatabaseRepositoryMockRecorder) DeleteSource(ctx, sourceId interfa
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteSource", reflect.TypeOf((*MockDatabaseRepository)(nil).DeleteSource), ctx, sourceId)
 }
 
+// ExportResources mocks base method.
+func (m *MockDatabaseRepository) ExportResources(ctx context.Context, options models.ExportResourceQueryOptions, exportCallback func(*models.ResourceBase) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExportResources", ctx, options, exportCallback)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ExportResources indicates an expected call of ExportResources.
+func (mr *MockDatabaseRepositoryMockRecorder) ExportResources(ctx, options, exportCallback interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExportResources", reflect.TypeOf((*MockDatabaseRepository)(nil).ExportResources), ctx, options, exportCallback)
+}
+
 // FindResourceAssociationsByTypeAndId mocks base method.
 func (m *MockDatabaseRepository) FindResourceAssociationsByTypeAndId(ctx context.Context, source *models.SourceCredential, resourceType, resourceId string) ([]models.RelatedResource, error) {
 	m.ctrl.T.Helper()
@@ -209,13 +298,12 @@ func (mr *MockDatabaseRepositoryMockRecorder) GetCurrentUser(ctx interface{}) *g
 }
 
 // GetFlattenedResourceGraph mocks base method.
-func (m *MockDatabaseRepository) GetFlattenedResourceGraph(ctx context.Context, graphType pkg.ResourceGraphType, options models.ResourceGraphOptions) (map[string][]*models.ResourceBase, *models.ResourceGraphMetadata, error) {
+func (m *MockDatabaseRepository) GetFlattenedResourceGraph(ctx context.Context, graphType pkg.ResourceGraphType, options models.ResourceGraphOptions) (map[string][]*models.ResourceBase, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "GetFlattenedResourceGraph", ctx, graphType, options)
 	ret0, _ := ret[0].(map[string][]*models.ResourceBase)
-	ret1, _ := ret[1].(*models.ResourceGraphMetadata)
-	ret2, _ := ret[2].(error)
-	return ret0, ret1, ret2
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // GetFlattenedResourceGraph indicates an expected call of GetFlattenedResourceGraph.
@@ -359,13 +447,30 @@ func (mr *MockDatabaseRepositoryMockRecorder) GetUserByUsername(arg0, arg1 inter
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByUsername", reflect.TypeOf((*MockDatabaseRepository)(nil).GetUserByUsername), arg0, arg1)
 }
 
+// ListBackgroundJobLogs mocks base method.
+func (m *MockDatabaseRepository) ListBackgroundJobLogs(ctx context.Context, backgroundJobId string, queryOptions models.BackgroundJobLogQueryOptions) ([]models.BackgroundJobLog, models.Pagination, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListBackgroundJobLogs", ctx, backgroundJobId, queryOptions)
+	ret0, _ := ret[0].([]models.BackgroundJobLog)
+	ret1, _ := ret[1].(models.Pagination)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ListBackgroundJobLogs indicates an expected call of ListBackgroundJobLogs.
+func (mr *MockDatabaseRepositoryMockRecorder) ListBackgroundJobLogs(ctx, backgroundJobId, queryOptions interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListBackgroundJobLogs", reflect.TypeOf((*MockDatabaseRepository)(nil).ListBackgroundJobLogs), ctx, backgroundJobId, queryOptions)
+}
+
 // ListBackgroundJobs mocks base method.
-func (m *MockDatabaseRepository) ListBackgroundJobs(ctx context.Context, queryOptions models.BackgroundJobQueryOptions) ([]models.BackgroundJob, error) {
+func (m *MockDatabaseRepository) ListBackgroundJobs(ctx context.Context, queryOptions models.BackgroundJobQueryOptions) ([]models.BackgroundJob, models.Pagination, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "ListBackgroundJobs", ctx, queryOptions)
 	ret0, _ := ret[0].([]models.BackgroundJob)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
+	ret1, _ := ret[1].(models.Pagination)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
 }
 
 // ListBackgroundJobs indicates an expected call of ListBackgroundJobs.
@@ -374,13 +479,44 @@ func (mr *MockDatabaseRepositoryMockRecorder) ListBackgroundJobs(ctx, queryOptio
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListBackgroundJobs", reflect.TypeOf((*MockDatabaseRepository)(nil).ListBackgroundJobs), ctx, queryOptions)
 }
 
+// ListDoneBackgroundJobs mocks base method.
+func (m *MockDatabaseRepository) ListDoneBackgroundJobs(ctx context.Context, jobType pkg.BackgroundJobType, doneBefore time.Time) ([]models.BackgroundJob, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListDoneBackgroundJobs", ctx, jobType, doneBefore)
+	ret0, _ := ret[0].([]models.BackgroundJob)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListDoneBackgroundJobs indicates an expected call of ListDoneBackgroundJobs.
+func (mr *MockDatabaseRepositoryMockRecorder) ListDoneBackgroundJobs(ctx, jobType, doneBefore interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListDoneBackgroundJobs", reflect.TypeOf((*MockDatabaseRepository)(nil).ListDoneBackgroundJobs), ctx, jobType, doneBefore)
+}
+
+// ListResourceHistory mocks base method.
+func (m *MockDatabaseRepository) ListResourceHistory(ctx context.Context, sourceId, sourceResourceType, sourceResourceId string) ([]models.ResourceHistory, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListResourceHistory", ctx, sourceId, sourceResourceType, sourceResourceId)
+	ret0, _ := ret[0].([]models.ResourceHistory)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListResourceHistory indicates an expected call of ListResourceHistory.
+func (mr *MockDatabaseRepositoryMockRecorder) ListResourceHistory(ctx, sourceId, sourceResourceType, sourceResourceId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListResourceHistory", reflect.TypeOf((*MockDatabaseRepository)(nil).ListResourceHistory), ctx, sourceId, sourceResourceType, sourceResourceId)
+}
+
 // ListResources mocks base method.
-func (m *MockDatabaseRepository) ListResources(arg0 context.Context, arg1 models.ListResourceQueryOptions) ([]models.ResourceBase, error) {
+func (m *MockDatabaseRepository) ListResources(arg0 context.Context, arg1 models.ListResourceQueryOptions) ([]models.ResourceBase, models.Pagination, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "ListResources", arg0, arg1)
 	ret0, _ := ret[0].([]models.ResourceBase)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
+	ret1, _ := ret[1].(models.Pagination)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
 }
 
 // ListResources indicates an expected call of ListResources.
@@ -432,13 +568,44 @@ func (mr *MockDatabaseRepositoryMockRecorder) PopulateDefaultUserSettings(ctx, u
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PopulateDefaultUserSettings", reflect.TypeOf((*MockDatabaseRepository)(nil).PopulateDefaultUserSettings), ctx, userId)
 }
 
+// QueryObservationLastN mocks base method.
+func (m *MockDatabaseRepository) QueryObservationLastN(ctx context.Context, query models.ObservationLastNQuery) ([]models.ResourceBase, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "QueryObservationLastN", ctx, query)
+	ret0, _ := ret[0].([]models.ResourceBase)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// QueryObservationLastN indicates an expected call of QueryObservationLastN.
+func (mr *MockDatabaseRepositoryMockRecorder) QueryObservationLastN(ctx, query interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "QueryObservationLastN", reflect.TypeOf((*MockDatabaseRepository)(nil).QueryObservationLastN), ctx, query)
+}
+
+// QueryObservationStatistics mocks base method.
+func (m *MockDatabaseRepository) QueryObservationStatistics(ctx context.Context, query models.ObservationStatisticsQuery) ([]models.ObservationStatistics, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "QueryObservationStatistics", ctx, query)
+	ret0, _ := ret[0].([]models.ObservationStatistics)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// QueryObservationStatistics indicates an expected call of QueryObservationStatistics.
+func (mr *MockDatabaseRepositoryMockRecorder) QueryObservationStatistics(ctx, query interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "QueryObservationStatistics", reflect.TypeOf((*MockDatabaseRepository)(nil).QueryObservationStatistics), ctx, query)
+}
+
 // QueryResources mocks base method.
-func (m *MockDatabaseRepository) QueryResources(ctx context.Context, query models.QueryResource) (interface{}, error) {
+func (m *MockDatabaseRepository) QueryResources(ctx context.Context, query models.QueryResource) (interface{}, models.Pagination, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "QueryResources", ctx, query)
 	ret0, _ := ret[0].(interface{})
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
+	ret1, _ := ret[1].(models.Pagination)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
 }
 
 // QueryResources indicates an expected call of QueryResources.
@@ -461,6 +628,48 @@ func (mr *MockDatabaseRepositoryMockRecorder) RemoveResourceAssociation(ctx, sou
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveResourceAssociation", reflect.TypeOf((*MockDatabaseRepository)(nil).RemoveResourceAssociation), ctx, source, resourceType, resourceId, relatedSource, relatedResourceType, relatedResourceId)
 }
 
+// RemoveResourceAssociations mocks base method.
+func (m *MockDatabaseRepository) RemoveResourceAssociations(ctx context.Context, source *models.SourceCredential, resourceType, resourceId string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveResourceAssociations", ctx, source, resourceType, resourceId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveResourceAssociations indicates an expected call of RemoveResourceAssociations.
+func (mr *MockDatabaseRepositoryMockRecorder) RemoveResourceAssociations(ctx, source, resourceType, resourceId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveResourceAssociations", reflect.TypeOf((*MockDatabaseRepository)(nil).RemoveResourceAssociations), ctx, source, resourceType, resourceId)
+}
+
+// ResumeLockedBackgroundJobs mocks base method.
+func (m *MockDatabaseRepository) ResumeLockedBackgroundJobs(ctx context.Context, resumableJobTypes []pkg.BackgroundJobType, maxAttempts int, retryBackoff time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResumeLockedBackgroundJobs", ctx, resumableJobTypes, maxAttempts, retryBackoff)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ResumeLockedBackgroundJobs indicates an expected call of ResumeLockedBackgroundJobs.
+func (mr *MockDatabaseRepositoryMockRecorder) ResumeLockedBackgroundJobs(ctx, resumableJobTypes, maxAttempts, retryBackoff interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResumeLockedBackgroundJobs", reflect.TypeOf((*MockDatabaseRepository)(nil).ResumeLockedBackgroundJobs), ctx, resumableJobTypes, maxAttempts, retryBackoff)
+}
+
+// RunInTransaction mocks base method.
+func (m *MockDatabaseRepository) RunInTransaction(ctx context.Context, transactionFn func(database.DatabaseRepository) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RunInTransaction", ctx, transactionFn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RunInTransaction indicates an expected call of RunInTransaction.
+func (mr *MockDatabaseRepositoryMockRecorder) RunInTransaction(ctx, transactionFn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RunInTransaction", reflect.TypeOf((*MockDatabaseRepository)(nil).RunInTransaction), ctx, transactionFn)
+}
+
 // SaveUserSettings mocks base method.
 func (m *MockDatabaseRepository) SaveUserSettings(arg0 context.Context, arg1 *models.UserSettings) error {
 	m.ctrl.T.Helper()
@@ -475,6 +684,21 @@ func (mr *MockDatabaseRepositoryMockRecorder) SaveUserSettings(arg0, arg1 interf
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveUserSettings", reflect.TypeOf((*MockDatabaseRepository)(nil).SaveUserSettings), arg0, arg1)
 }
 
+// SearchResources mocks base method.
+func (m *MockDatabaseRepository) SearchResources(ctx context.Context, options models.ResourceSearchQueryOptions) ([]models.ResourceSearchResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SearchResources", ctx, options)
+	ret0, _ := ret[0].([]models.ResourceSearchResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SearchResources indicates an expected call of SearchResources.
+func (mr *MockDatabaseRepositoryMockRecorder) SearchResources(ctx, options interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SearchResources", reflect.TypeOf((*MockDatabaseRepository)(nil).SearchResources), ctx, options)
+}
+
 // UpdateBackgroundJob mocks base method.
 func (m *MockDatabaseRepository) UpdateBackgroundJob(ctx context.Context, backgroundJob *models.BackgroundJob) error {
 	m.ctrl.T.Helper()
@@ -517,3 +741,17 @@ func (mr *MockDatabaseRepositoryMockRecorder) UpsertRawResource(ctx, sourceCrede
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpsertRawResource", reflect.TypeOf((*MockDatabaseRepository)(nil).UpsertRawResource), ctx, sourceCredentials, rawResource)
 }
+
+// UpsertRawResourceAssociation mocks base method.
+func (m *MockDatabaseRepository) UpsertRawResourceAssociation(ctx context.Context, sourceId, sourceResourceType, sourceResourceId, targetSourceId, targetResourceType, targetResourceId string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpsertRawResourceAssociation", ctx, sourceId, sourceResourceType, sourceResourceId, targetSourceId, targetResourceType, targetResourceId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpsertRawResourceAssociation indicates an expected call of UpsertRawResourceAssociation.
+func (mr *MockDatabaseRepositoryMockRecorder) UpsertRawResourceAssociation(ctx, sourceId, sourceResourceType, sourceResourceId, targetSourceId, targetResourceType, targetResourceId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpsertRawResourceAssociation", reflect.TypeOf((*MockDatabaseRepository)(nil).UpsertRawResourceAssociation), ctx, sourceId, sourceResourceType, sourceResourceId, targetSourceId, targetResourceType, targetResourceId)
+}
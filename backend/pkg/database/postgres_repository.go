@@ -58,11 +58,7 @@ func newPostgresRepository(appConfig config.Interface, globalLogger logrus.Field
 		return nil, fmt.Errorf("Failed to create admin user! - %v", err)
 	}
 
-	//fail any Locked jobs. This is necessary because the job may have been locked by a process that was killed.
-	err = fastenRepo.CancelAllLockedBackgroundJobsAndFail()
-	if err != nil {
-		return nil, err
-	}
+	//locked jobs (which may have been locked by a process that was killed) are resumed or failed by the job runner, see ResumeLockedBackgroundJobs
 
 	return &fastenRepo, nil
 }
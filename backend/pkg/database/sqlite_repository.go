@@ -113,11 +113,7 @@ func newSqliteRepository(appConfig config.Interface, globalLogger logrus.FieldLo
 		return nil, fmt.Errorf("Failed to create admin user! - %v", err)
 	}
 
-	//fail any Locked jobs. This is necessary because the job may have been locked by a process that was killed.
-	err = fastenRepo.CancelAllLockedBackgroundJobsAndFail()
-	if err != nil {
-		return nil, err
-	}
+	//locked jobs (which may have been locked by a process that was killed) are resumed or failed by the job runner, see ResumeLockedBackgroundJobs
 
 	return &fastenRepo, nil
 }
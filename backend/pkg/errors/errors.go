@@ -1,6 +1,7 @@
 package errors
 
 import (
+	"errors"
 	"fmt"
 )
 
@@ -24,3 +25,27 @@ type DatabaseTypeNotSupportedError string
 func (str DatabaseTypeNotSupportedError) Error() string {
 	return fmt.Sprintf("DatabaseTypeNotSupportedError: %q", string(str))
 }
+
+// Raised when a query (eg. a QueryResource, or FHIR search parameters) is invalid, the error is caused by the request rather
+// than the server, so it can be returned to the user
+type QueryValidationError struct {
+	err error
+}
+
+func QueryValidationErrorf(format string, a ...interface{}) error {
+	return QueryValidationError{err: fmt.Errorf(format, a...)}
+}
+
+func (e QueryValidationError) Error() string {
+	return e.err.Error()
+}
+
+func (e QueryValidationError) Unwrap() error {
+	return e.err
+}
+
+// IsQueryValidationError returns true if the error (or an error it wraps) is a QueryValidationError
+func IsQueryValidationError(err error) bool {
+	var queryValidationError QueryValidationError
+	return errors.As(err, &queryValidationError)
+}
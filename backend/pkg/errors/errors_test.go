@@ -1,6 +1,7 @@
 package errors_test
 
 import (
+	"fmt"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/errors"
 	"github.com/stretchr/testify/require"
 	"testing"
@@ -12,4 +13,15 @@ func TestErrors(t *testing.T) {
 	//assert
 	require.Implements(t, (*error)(nil), errors.ConfigFileMissingError("test"), "should implement the error interface")
 	require.Implements(t, (*error)(nil), errors.ConfigValidationError("test"), "should implement the error interface")
+	require.Implements(t, (*error)(nil), errors.QueryValidationErrorf("test"), "should implement the error interface")
+}
+
+func TestIsQueryValidationError(t *testing.T) {
+	t.Parallel()
+
+	//assert
+	require.True(t, errors.IsQueryValidationError(errors.QueryValidationErrorf("unknown search parameter: %s", "test")))
+	require.True(t, errors.IsQueryValidationError(fmt.Errorf("wrapped: %w", errors.QueryValidationErrorf("test"))))
+	require.False(t, errors.IsQueryValidationError(fmt.Errorf("database is locked")))
+	require.False(t, errors.IsQueryValidationError(nil))
 }
@@ -0,0 +1,44 @@
+package job_runner
+
+import (
+	"context"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/config"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus"
+	"github.com/sirupsen/logrus"
+)
+
+func NewJobRunner(appConfig config.Interface, logger logrus.FieldLogger, databaseRepo database.DatabaseRepository, eventBus event_bus.Interface) Interface {
+	workers := appConfig.GetInt("jobs.workers")
+	if workers < 1 {
+		workers = 1
+	}
+	pollInterval := time.Duration(appConfig.GetInt("jobs.poll_interval")) * time.Second
+	if pollInterval <= 0 {
+		pollInterval = 30 * time.Second
+	}
+
+	maxAttempts := appConfig.GetInt("jobs.max_attempts")
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	retryBackoff := time.Duration(appConfig.GetInt("jobs.retry_backoff")) * time.Second
+	logMaxEntries := appConfig.GetInt("jobs.logs.max_entries")
+
+	return &jobRunner{
+		logger:        logger,
+		databaseRepo:  databaseRepo,
+		eventBus:      eventBus,
+		workers:       workers,
+		pollInterval:  pollInterval,
+		maxAttempts:   maxAttempts,
+		retryBackoff:  retryBackoff,
+		logMaxEntries: logMaxEntries,
+		jobHandlers:   map[pkg.BackgroundJobType]JobHandler{},
+		runningJobs:   map[string]context.CancelFunc{},
+		wakeup:        make(chan struct{}, 1),
+	}
+}
@@ -0,0 +1,40 @@
+package job_runner
+
+import (
+	"context"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Interface is a pool of workers which claim ready background jobs (see DatabaseRepository.ClaimBackgroundJob), and process
+// them using the handler registered for the job type.
+//
+//go:generate mockgen -source=interface.go -destination=mock/mock_job_runner.go
+type Interface interface {
+	RegisterJobHandler(jobType pkg.BackgroundJobType, jobHandler JobHandler)
+	// Start resumes the jobs interrupted by a restart, and starts the workers, which stop once the context is cancelled.
+	// Job handlers must be registered before the runner is started.
+	Start(ctx context.Context)
+	// Notify wakes up an idle worker, it should be called after a ready job is created
+	Notify()
+	// Cancel cancels the context of a job which is being processed by a worker, it returns false if the job is not running.
+	// The job handler should stop, and the job status is set to cancelled.
+	Cancel(backgroundJobId string) bool
+}
+
+// JobHandler processes a claimed (locked) background job. The handler is responsible for updating the job status once the job
+// is done (or has failed). The backgroundJobContext contains the username of the job owner and the job id, so that it can be
+// used with the DatabaseRepository (eg. BackgroundJobCheckpoint).
+// Jobs interrupted by a restart are claimed again, with an incremented retry count, so the handler can resume from the checkpoint
+// data stored in the job.
+type JobHandler func(
+	backgroundJobContext context.Context,
+	logger *logrus.Entry,
+	databaseRepo database.DatabaseRepository,
+	eventBus event_bus.Interface,
+	backgroundJob *models.BackgroundJob,
+) error
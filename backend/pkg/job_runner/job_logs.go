@@ -0,0 +1,114 @@
+package job_runner
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// log entries can contain a list of errors (eg. every resource which failed to sync), so long messages are truncated
+const backgroundJobLogMaxMessageLength = 4096
+
+// the source clients don't log structured fields, so the resource is extracted from references in the message, eg. "skipping resource (Observation/123)"
+var backgroundJobLogResourceReference = regexp.MustCompile(`\b([A-Z][A-Za-z]+)/([A-Za-z0-9\-.]{1,64})\b`)
+
+// backgroundJobLogCapture is a logrus hook which keeps the most recent log entries (info and above) logged while a job is
+// processed, so that they can be stored with the job once it completes. At most maxEntries entries are kept in memory.
+type backgroundJobLogCapture struct {
+	backgroundJobId uuid.UUID
+	maxEntries      int
+
+	mutex          sync.Mutex
+	entries        []models.BackgroundJobLog
+	droppedEntries int
+}
+
+func newBackgroundJobLogCapture(backgroundJobId uuid.UUID, maxEntries int) *backgroundJobLogCapture {
+	return &backgroundJobLogCapture{
+		backgroundJobId: backgroundJobId,
+		maxEntries:      maxEntries,
+	}
+}
+
+// captureLogger returns a copy of the logger (with the same output, formatter and hooks), whose entries are also captured
+func (c *backgroundJobLogCapture) captureLogger(logger *logrus.Entry) *logrus.Entry {
+	capturingLogger := logrus.New()
+	capturingLogger.SetOutput(logger.Logger.Out)
+	capturingLogger.SetFormatter(logger.Logger.Formatter)
+	capturingLogger.SetLevel(logger.Logger.GetLevel())
+	capturingLogger.SetReportCaller(logger.Logger.ReportCaller)
+	capturingLogger.ExitFunc = logger.Logger.ExitFunc
+	levelHooks := logrus.LevelHooks{}
+	for level, hooks := range logger.Logger.Hooks {
+		levelHooks[level] = append([]logrus.Hook{}, hooks...)
+	}
+	capturingLogger.ReplaceHooks(levelHooks)
+	capturingLogger.AddHook(c)
+	return capturingLogger.WithFields(logger.Data).WithContext(logger.Context)
+}
+
+func (c *backgroundJobLogCapture) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel}
+}
+
+func (c *backgroundJobLogCapture) Fire(entry *logrus.Entry) error {
+	backgroundJobLog := models.BackgroundJobLog{
+		BackgroundJobID: c.backgroundJobId,
+		Level:           entry.Level.String(),
+		Message:         entry.Message,
+		LoggedAt:        entry.Time,
+	}
+	if entryErr, ok := entry.Data[logrus.ErrorKey]; ok {
+		backgroundJobLog.Message = fmt.Sprintf("%s: %v", backgroundJobLog.Message, entryErr)
+	}
+	if len(backgroundJobLog.Message) > backgroundJobLogMaxMessageLength {
+		truncatedLength := backgroundJobLogMaxMessageLength
+		for truncatedLength > 0 && !utf8.RuneStart(backgroundJobLog.Message[truncatedLength]) {
+			truncatedLength--
+		}
+		backgroundJobLog.Message = backgroundJobLog.Message[:truncatedLength] + "..."
+	}
+
+	//the resource fields are set by the job handlers, when known
+	if resourceType, ok := entry.Data["resource_type"]; ok {
+		backgroundJobLog.ResourceType = fmt.Sprintf("%v", resourceType)
+		if resourceId, ok := entry.Data["resource_id"]; ok {
+			backgroundJobLog.ResourceID = fmt.Sprintf("%v", resourceId)
+		}
+	} else if resourceReference := backgroundJobLogResourceReference.FindStringSubmatch(entry.Message); resourceReference != nil {
+		backgroundJobLog.ResourceType = resourceReference[1]
+		backgroundJobLog.ResourceID = resourceReference[2]
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = append(c.entries, backgroundJobLog)
+	if len(c.entries) > c.maxEntries {
+		c.entries = c.entries[len(c.entries)-c.maxEntries:]
+		c.droppedEntries++
+	}
+	return nil
+}
+
+// backgroundJobLogs returns the captured entries, oldest first. If older entries were dropped, the first entry is replaced
+// with a warning, so that the user knows the log is incomplete.
+func (c *backgroundJobLogCapture) backgroundJobLogs() []models.BackgroundJobLog {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	backgroundJobLogs := make([]models.BackgroundJobLog, len(c.entries))
+	copy(backgroundJobLogs, c.entries)
+	if c.droppedEntries > 0 && len(backgroundJobLogs) > 0 {
+		backgroundJobLogs[0] = models.BackgroundJobLog{
+			BackgroundJobID: c.backgroundJobId,
+			Level:           logrus.WarnLevel.String(),
+			Message:         fmt.Sprintf("%d earlier log entries were not kept (see jobs.logs.max_entries)", c.droppedEntries+1),
+			LoggedAt:        backgroundJobLogs[0].LoggedAt,
+		}
+	}
+	return backgroundJobLogs
+}
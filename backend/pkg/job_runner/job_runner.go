@@ -0,0 +1,259 @@
+package job_runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+type jobRunner struct {
+	logger       logrus.FieldLogger
+	databaseRepo database.DatabaseRepository
+	eventBus     event_bus.Interface
+
+	workers      int
+	pollInterval time.Duration
+
+	//jobs interrupted by a restart are resumed (see DatabaseRepository.ResumeLockedBackgroundJobs)
+	maxAttempts  int
+	retryBackoff time.Duration
+
+	//the most recent entries logged while a job is processed are stored with the job, 0 disables log capture
+	logMaxEntries int
+
+	jobHandlersMutex sync.RWMutex
+	jobHandlers      map[pkg.BackgroundJobType]JobHandler
+
+	//cancel functions for the jobs currently being processed by the workers, by job id
+	runningJobsMutex sync.Mutex
+	runningJobs      map[string]context.CancelFunc
+
+	// buffered, so that Notify never blocks. Workers also poll the background_jobs table, so a missed notification only delays the job
+	wakeup chan struct{}
+}
+
+func (jr *jobRunner) RegisterJobHandler(jobType pkg.BackgroundJobType, jobHandler JobHandler) {
+	jr.jobHandlersMutex.Lock()
+	defer jr.jobHandlersMutex.Unlock()
+	jr.jobHandlers[jobType] = jobHandler
+}
+
+func (jr *jobRunner) Start(ctx context.Context) {
+	//jobs which were locked when the server stopped are resumed (if they have a registered job handler) or failed
+	err := jr.databaseRepo.ResumeLockedBackgroundJobs(ctx, jr.registeredJobTypes(), jr.maxAttempts, jr.retryBackoff)
+	if err != nil {
+		jr.logger.Errorln("An error occurred while resuming interrupted background jobs, ignoring", err)
+	}
+
+	jr.logger.Infof("Starting job runner with %d workers", jr.workers)
+	for workerId := 0; workerId < jr.workers; workerId++ {
+		go jr.work(ctx, jr.logger.WithField("job_worker", workerId))
+	}
+}
+
+func (jr *jobRunner) Notify() {
+	select {
+	case jr.wakeup <- struct{}{}:
+	default:
+		//a notification is already pending
+	}
+}
+
+func (jr *jobRunner) Cancel(backgroundJobId string) bool {
+	jr.runningJobsMutex.Lock()
+	defer jr.runningJobsMutex.Unlock()
+	cancelJob, running := jr.runningJobs[backgroundJobId]
+	if running {
+		cancelJob()
+	}
+	return running
+}
+
+// work processes jobs until there are none ready, then waits for a notification (or the next poll)
+func (jr *jobRunner) work(ctx context.Context, logger *logrus.Entry) {
+	pollTicker := time.NewTicker(jr.pollInterval)
+	defer pollTicker.Stop()
+
+	for {
+		for ctx.Err() == nil && jr.runNextJob(ctx, logger) {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-jr.wakeup:
+		case <-pollTicker.C:
+		}
+	}
+}
+
+// runNextJob claims and processes the next ready job, it returns false if there are no ready jobs
+func (jr *jobRunner) runNextJob(ctx context.Context, logger *logrus.Entry) bool {
+	jobTypes := jr.registeredJobTypes()
+	if len(jobTypes) == 0 {
+		return false
+	}
+
+	backgroundJob, err := jr.databaseRepo.ClaimBackgroundJob(ctx, jobTypes)
+	if err != nil {
+		logger.Errorln("An error occurred while claiming background job", err)
+		return false
+	} else if backgroundJob == nil {
+		return false
+	}
+
+	jr.runJob(ctx, logger.WithFields(logrus.Fields{
+		"job_id":   backgroundJob.ID.String(),
+		"job_type": backgroundJob.JobType,
+	}), backgroundJob)
+	return true
+}
+
+func (jr *jobRunner) registeredJobTypes() []pkg.BackgroundJobType {
+	jr.jobHandlersMutex.RLock()
+	defer jr.jobHandlersMutex.RUnlock()
+	jobTypes := make([]pkg.BackgroundJobType, 0, len(jr.jobHandlers))
+	for jobType := range jr.jobHandlers {
+		jobTypes = append(jobTypes, jobType)
+	}
+	return jobTypes
+}
+
+func (jr *jobRunner) runJob(ctx context.Context, logger *logrus.Entry, backgroundJob *models.BackgroundJob) {
+	//jobs are processed on behalf of the user who created them
+	jobOwnerContext := context.WithValue(ctx, pkg.ContextKeyTypeAuthUsername, backgroundJob.User.Username)
+	jobOwnerContext = context.WithValue(jobOwnerContext, pkg.ContextKeyTypeBackgroundJobID, backgroundJob.ID.String())
+
+	//the job handler context is cancelled when the job is cancelled (see Cancel), the job owner context is used to update the job afterwards
+	backgroundJobContext, cancelJob := context.WithCancel(jobOwnerContext)
+	jr.runningJobsMutex.Lock()
+	jr.runningJobs[backgroundJob.ID.String()] = cancelJob
+	jr.runningJobsMutex.Unlock()
+	defer func() {
+		jr.runningJobsMutex.Lock()
+		delete(jr.runningJobs, backgroundJob.ID.String())
+		jr.runningJobsMutex.Unlock()
+		cancelJob()
+	}()
+
+	//the entries logged while the job is processed (including by the source client) are captured, and stored with the job
+	var logCapture *backgroundJobLogCapture
+	if jr.logMaxEntries > 0 {
+		logCapture = newBackgroundJobLogCapture(backgroundJob.ID, jr.logMaxEntries)
+		logger = logCapture.captureLogger(logger)
+	}
+
+	jr.publishBackgroundJobEvent(logger, backgroundJob)
+
+	jr.jobHandlersMutex.RLock()
+	jobHandler := jr.jobHandlers[backgroundJob.JobType]
+	jr.jobHandlersMutex.RUnlock()
+
+	logger.Infof("Running background job")
+	jobErr := jr.callJobHandler(backgroundJobContext, logger, jobHandler, backgroundJob)
+	if jobErr != nil {
+		logger.Errorln("An error occurred while running background job", jobErr)
+	}
+
+	updatedBackgroundJob, err := jr.databaseRepo.GetBackgroundJob(jobOwnerContext, backgroundJob.ID.String())
+	if err != nil {
+		logger.Errorln("An error occurred while retrieving completed background job, ignoring", err)
+		jr.storeBackgroundJobLogs(jobOwnerContext, logger, logCapture)
+		return
+	}
+
+	//the job handler should complete the job, but if it didn't (eg. it panicked), the job is failed so that it's not locked forever
+	if updatedBackgroundJob.JobStatus == pkg.BackgroundJobStatusLocked {
+		jobStatus := pkg.BackgroundJobStatusFailed
+		if backgroundJobContext.Err() != nil && ctx.Err() == nil {
+			jobStatus = pkg.BackgroundJobStatusCancelled
+			jobErr = fmt.Errorf("background job was cancelled")
+		} else if jobErr == nil {
+			jobErr = fmt.Errorf("background job was not completed by the job handler")
+		}
+		if err := jr.completeBackgroundJob(jobOwnerContext, updatedBackgroundJob, jobStatus, jobErr); err != nil {
+			logger.Errorln("An error occurred while completing background job, ignoring", err)
+		}
+	}
+	//the logs are stored before the final event is published, so that they're available once the user is notified
+	jr.storeBackgroundJobLogs(jobOwnerContext, logger, logCapture)
+	jr.publishBackgroundJobEvent(logger, updatedBackgroundJob)
+}
+
+func (jr *jobRunner) callJobHandler(backgroundJobContext context.Context, logger *logrus.Entry, jobHandler JobHandler, backgroundJob *models.BackgroundJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("background job handler panicked: %v", r)
+		}
+	}()
+	return jobHandler(backgroundJobContext, logger, jr.databaseRepo, jr.eventBus, backgroundJob)
+}
+
+// completeBackgroundJob sets the final status of the job, and stores the error
+func (jr *jobRunner) completeBackgroundJob(jobOwnerContext context.Context, backgroundJob *models.BackgroundJob, jobStatus pkg.BackgroundJobStatus, jobErr error) error {
+	//the job data is deserialized generically, so that the job type specific fields are preserved
+	backgroundJobData := map[string]interface{}{}
+	if backgroundJob.Data != nil {
+		if err := json.Unmarshal(backgroundJob.Data, &backgroundJobData); err != nil {
+			return err
+		}
+	}
+	errorData, ok := backgroundJobData["error_data"].(map[string]interface{})
+	if !ok {
+		errorData = map[string]interface{}{}
+	}
+	errorData["final"] = jobErr.Error()
+	backgroundJobData["error_data"] = errorData
+
+	serializedData, err := json.Marshal(backgroundJobData)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	backgroundJob.Data = serializedData
+	backgroundJob.JobStatus = jobStatus
+	backgroundJob.DoneTime = &now
+	backgroundJob.LockedTime = nil
+	return jr.databaseRepo.UpdateBackgroundJob(jobOwnerContext, backgroundJob)
+}
+
+func (jr *jobRunner) storeBackgroundJobLogs(jobOwnerContext context.Context, logger *logrus.Entry, logCapture *backgroundJobLogCapture) {
+	if logCapture == nil {
+		return
+	}
+	backgroundJobLogs := logCapture.backgroundJobLogs()
+	if len(backgroundJobLogs) == 0 {
+		return
+	}
+	if err := jr.databaseRepo.CreateBackgroundJobLogs(jobOwnerContext, backgroundJobLogs); err != nil {
+		logger.Warnln("An error occurred while storing background job logs, ignoring", err)
+	}
+}
+
+func (jr *jobRunner) publishBackgroundJobEvent(logger *logrus.Entry, backgroundJob *models.BackgroundJob) {
+	var backgroundJobData struct {
+		CheckpointData map[string]interface{} `json:"checkpoint_data,omitempty"`
+	}
+	if backgroundJob.Data != nil {
+		_ = json.Unmarshal(backgroundJob.Data, &backgroundJobData)
+	}
+
+	err := jr.eventBus.PublishMessage(models.NewEventBackgroundJob(
+		backgroundJob.UserID.String(),
+		backgroundJob.ID.String(),
+		backgroundJob.JobType,
+		backgroundJob.JobStatus,
+		backgroundJobData.CheckpointData,
+	))
+	if err != nil {
+		logger.Warnf("ignoring: an error occurred while publishing background job event: %v", err)
+	}
+}
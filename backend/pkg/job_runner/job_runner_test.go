@@ -0,0 +1,285 @@
+package job_runner
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	mock_config "github.com/fastenhealth/fasten-onprem/backend/pkg/config/mock"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	mock_database "github.com/fastenhealth/fasten-onprem/backend/pkg/database/mock"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus"
+	mock_event_bus "github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus/mock"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/golang/mock/gomock"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobRunnerInterface(t *testing.T) {
+	t.Parallel()
+
+	jobRunnerInstance := new(jobRunner)
+
+	//assert
+	require.Implements(t, (*Interface)(nil), jobRunnerInstance, "should implement the job runner interface")
+}
+
+func newTestJobRunner(t *testing.T, mockCtrl *gomock.Controller, databaseRepo database.DatabaseRepository, eventBus event_bus.Interface) *jobRunner {
+	fakeConfig := mock_config.NewMockInterface(mockCtrl)
+	fakeConfig.EXPECT().GetInt("jobs.workers").Return(2)
+	fakeConfig.EXPECT().GetInt("jobs.poll_interval").Return(0)
+	fakeConfig.EXPECT().GetInt("jobs.max_attempts").Return(3)
+	fakeConfig.EXPECT().GetInt("jobs.retry_backoff").Return(60)
+	//log capture is disabled, see TestJobRunner_RunNextJob_WithLogCapture
+	fakeConfig.EXPECT().GetInt("jobs.logs.max_entries").Return(0)
+	jobRunnerInstance := NewJobRunner(fakeConfig, logrus.WithField("test", t.Name()), databaseRepo, eventBus).(*jobRunner)
+	require.Equal(t, 2, jobRunnerInstance.workers)
+	return jobRunnerInstance
+}
+
+func TestJobRunner_RunNextJob(t *testing.T) {
+	t.Parallel()
+
+	//setup
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	fakeDatabase := mock_database.NewMockDatabaseRepository(mockCtrl)
+	fakeEventBus := mock_event_bus.NewMockInterface(mockCtrl)
+	jobRunnerInstance := newTestJobRunner(t, mockCtrl, fakeDatabase, fakeEventBus)
+
+	backgroundJob := &models.BackgroundJob{
+		ModelBase: models.ModelBase{ID: uuid.New()},
+		User:      models.User{Username: "test_username"},
+		UserID:    uuid.New(),
+		JobType:   pkg.BackgroundJobTypeSync,
+		JobStatus: pkg.BackgroundJobStatusLocked,
+	}
+	completedBackgroundJob := *backgroundJob
+	completedBackgroundJob.JobStatus = pkg.BackgroundJobStatusDone
+
+	gomock.InOrder(
+		fakeDatabase.EXPECT().ClaimBackgroundJob(gomock.Any(), []pkg.BackgroundJobType{pkg.BackgroundJobTypeSync}).Return(backgroundJob, nil),
+		fakeDatabase.EXPECT().GetBackgroundJob(gomock.Any(), backgroundJob.ID.String()).Return(&completedBackgroundJob, nil),
+		fakeDatabase.EXPECT().ClaimBackgroundJob(gomock.Any(), []pkg.BackgroundJobType{pkg.BackgroundJobTypeSync}).Return(nil, nil),
+	)
+	publishedEvents := []*models.EventBackgroundJob{}
+	fakeEventBus.EXPECT().PublishMessage(gomock.Any()).Times(2).DoAndReturn(func(eventMsg models.EventInterface) error {
+		publishedEvents = append(publishedEvents, eventMsg.(*models.EventBackgroundJob))
+		return nil
+	})
+
+	var handledContext context.Context
+	jobRunnerInstance.RegisterJobHandler(pkg.BackgroundJobTypeSync, func(backgroundJobContext context.Context, logger *logrus.Entry, databaseRepo database.DatabaseRepository, eventBus event_bus.Interface, handledBackgroundJob *models.BackgroundJob) error {
+		handledContext = backgroundJobContext
+		require.Equal(t, backgroundJob, handledBackgroundJob)
+		return nil
+	})
+
+	//test
+	ran := jobRunnerInstance.runNextJob(context.Background(), logrus.WithField("test", t.Name()))
+	ranAgain := jobRunnerInstance.runNextJob(context.Background(), logrus.WithField("test", t.Name()))
+
+	//assert
+	require.True(t, ran)
+	require.False(t, ranAgain)
+	require.Equal(t, "test_username", handledContext.Value(pkg.ContextKeyTypeAuthUsername))
+	require.Equal(t, backgroundJob.ID.String(), handledContext.Value(pkg.ContextKeyTypeBackgroundJobID))
+	require.Len(t, publishedEvents, 2)
+	require.Equal(t, backgroundJob.UserID.String(), publishedEvents[0].GetUserID())
+	require.Equal(t, pkg.BackgroundJobStatusLocked, publishedEvents[0].JobStatus)
+	require.Equal(t, pkg.BackgroundJobStatusDone, publishedEvents[1].JobStatus)
+}
+
+func TestJobRunner_RunNextJob_WithPanic(t *testing.T) {
+	t.Parallel()
+
+	//setup
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	fakeDatabase := mock_database.NewMockDatabaseRepository(mockCtrl)
+	jobRunnerInstance := newTestJobRunner(t, mockCtrl, fakeDatabase, event_bus.NewNoopEventBusServer())
+
+	backgroundJob := &models.BackgroundJob{
+		ModelBase: models.ModelBase{ID: uuid.New()},
+		User:      models.User{Username: "test_username"},
+		JobType:   pkg.BackgroundJobTypeSync,
+		JobStatus: pkg.BackgroundJobStatusLocked,
+		Data:      []byte(`{"source_id":"8f9b4f1e-7c1a-4b6a-9a4e-3c2d1e0f9a8b","checkpoint_data":{"resource_count":10}}`),
+	}
+	lockedBackgroundJob := *backgroundJob
+	fakeDatabase.EXPECT().ClaimBackgroundJob(gomock.Any(), gomock.Any()).Return(backgroundJob, nil)
+	fakeDatabase.EXPECT().GetBackgroundJob(gomock.Any(), backgroundJob.ID.String()).Return(&lockedBackgroundJob, nil)
+
+	var failedBackgroundJob *models.BackgroundJob
+	fakeDatabase.EXPECT().UpdateBackgroundJob(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, updatedBackgroundJob *models.BackgroundJob) error {
+		failedBackgroundJob = updatedBackgroundJob
+		return nil
+	})
+
+	jobRunnerInstance.RegisterJobHandler(pkg.BackgroundJobTypeSync, func(backgroundJobContext context.Context, logger *logrus.Entry, databaseRepo database.DatabaseRepository, eventBus event_bus.Interface, handledBackgroundJob *models.BackgroundJob) error {
+		panic("unexpected error")
+	})
+
+	//test
+	ran := jobRunnerInstance.runNextJob(context.Background(), logrus.WithField("test", t.Name()))
+
+	//assert
+	require.True(t, ran)
+	require.NotNil(t, failedBackgroundJob)
+	require.Equal(t, pkg.BackgroundJobStatusFailed, failedBackgroundJob.JobStatus)
+	require.NotNil(t, failedBackgroundJob.DoneTime)
+	require.Nil(t, failedBackgroundJob.LockedTime)
+	var failedBackgroundJobData map[string]interface{}
+	require.NoError(t, json.Unmarshal(failedBackgroundJob.Data, &failedBackgroundJobData))
+	require.Equal(t, "8f9b4f1e-7c1a-4b6a-9a4e-3c2d1e0f9a8b", failedBackgroundJobData["source_id"], "job type specific data must be preserved")
+	require.Equal(t, map[string]interface{}{"final": "background job handler panicked: unexpected error"}, failedBackgroundJobData["error_data"])
+}
+
+func TestJobRunner_RunNextJob_WithLogCapture(t *testing.T) {
+	t.Parallel()
+
+	//setup
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	fakeDatabase := mock_database.NewMockDatabaseRepository(mockCtrl)
+	jobRunnerInstance := newTestJobRunner(t, mockCtrl, fakeDatabase, event_bus.NewNoopEventBusServer())
+	jobRunnerInstance.logMaxEntries = 3
+
+	backgroundJob := &models.BackgroundJob{
+		ModelBase: models.ModelBase{ID: uuid.New()},
+		User:      models.User{Username: "test_username"},
+		JobType:   pkg.BackgroundJobTypeSync,
+		JobStatus: pkg.BackgroundJobStatusLocked,
+	}
+	completedBackgroundJob := *backgroundJob
+	completedBackgroundJob.JobStatus = pkg.BackgroundJobStatusDone
+	fakeDatabase.EXPECT().ClaimBackgroundJob(gomock.Any(), gomock.Any()).Return(backgroundJob, nil)
+	fakeDatabase.EXPECT().GetBackgroundJob(gomock.Any(), backgroundJob.ID.String()).Return(&completedBackgroundJob, nil)
+
+	var storedBackgroundJobLogs []models.BackgroundJobLog
+	fakeDatabase.EXPECT().CreateBackgroundJobLogs(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, backgroundJobLogs []models.BackgroundJobLog) error {
+		require.Equal(t, "test_username", ctx.Value(pkg.ContextKeyTypeAuthUsername))
+		storedBackgroundJobLogs = backgroundJobLogs
+		return nil
+	})
+
+	jobRunnerInstance.RegisterJobHandler(pkg.BackgroundJobTypeSync, func(backgroundJobContext context.Context, logger *logrus.Entry, databaseRepo database.DatabaseRepository, eventBus event_bus.Interface, handledBackgroundJob *models.BackgroundJob) error {
+		logger.Infof("first entry")
+		logger.Debugf("debug entries are not captured")
+		logger.Infof("second entry")
+		logger.WithFields(logrus.Fields{"resource_type": "Patient", "resource_id": "example"}).Infof("patient entry")
+		logger.Warnf("skipping resource (Observation/obs-1), request failed: %v", "not found")
+		return nil
+	})
+
+	//test
+	ran := jobRunnerInstance.runNextJob(context.Background(), logrus.WithField("test", t.Name()))
+
+	//assert
+	require.True(t, ran)
+	require.Len(t, storedBackgroundJobLogs, 3)
+	require.Equal(t, "warning", storedBackgroundJobLogs[0].Level)
+	require.Equal(t, "3 earlier log entries were not kept (see jobs.logs.max_entries)", storedBackgroundJobLogs[0].Message)
+
+	require.Equal(t, backgroundJob.ID, storedBackgroundJobLogs[1].BackgroundJobID)
+	require.Equal(t, "info", storedBackgroundJobLogs[1].Level)
+	require.Equal(t, "patient entry", storedBackgroundJobLogs[1].Message)
+	require.Equal(t, "Patient", storedBackgroundJobLogs[1].ResourceType)
+	require.Equal(t, "example", storedBackgroundJobLogs[1].ResourceID)
+
+	require.Equal(t, "warning", storedBackgroundJobLogs[2].Level)
+	require.Equal(t, "Observation", storedBackgroundJobLogs[2].ResourceType)
+	require.Equal(t, "obs-1", storedBackgroundJobLogs[2].ResourceID)
+	require.False(t, storedBackgroundJobLogs[2].LoggedAt.IsZero())
+}
+
+func TestJobRunner_Cancel(t *testing.T) {
+	t.Parallel()
+
+	//setup
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	fakeDatabase := mock_database.NewMockDatabaseRepository(mockCtrl)
+	jobRunnerInstance := newTestJobRunner(t, mockCtrl, fakeDatabase, event_bus.NewNoopEventBusServer())
+
+	backgroundJob := &models.BackgroundJob{
+		ModelBase: models.ModelBase{ID: uuid.New()},
+		User:      models.User{Username: "test_username"},
+		JobType:   pkg.BackgroundJobTypeSync,
+		JobStatus: pkg.BackgroundJobStatusLocked,
+	}
+	lockedBackgroundJob := *backgroundJob
+	fakeDatabase.EXPECT().ClaimBackgroundJob(gomock.Any(), gomock.Any()).Return(backgroundJob, nil)
+	fakeDatabase.EXPECT().GetBackgroundJob(gomock.Any(), backgroundJob.ID.String()).DoAndReturn(func(ctx context.Context, backgroundJobId string) (*models.BackgroundJob, error) {
+		require.NoError(t, ctx.Err(), "the job must be updated using a context which is not cancelled")
+		return &lockedBackgroundJob, nil
+	})
+
+	var cancelledBackgroundJob *models.BackgroundJob
+	fakeDatabase.EXPECT().UpdateBackgroundJob(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, updatedBackgroundJob *models.BackgroundJob) error {
+		require.Equal(t, "test_username", ctx.Value(pkg.ContextKeyTypeAuthUsername))
+		cancelledBackgroundJob = updatedBackgroundJob
+		return nil
+	})
+
+	jobRunnerInstance.RegisterJobHandler(pkg.BackgroundJobTypeSync, func(backgroundJobContext context.Context, logger *logrus.Entry, databaseRepo database.DatabaseRepository, eventBus event_bus.Interface, handledBackgroundJob *models.BackgroundJob) error {
+		require.True(t, jobRunnerInstance.Cancel(handledBackgroundJob.ID.String()))
+		<-backgroundJobContext.Done()
+		return backgroundJobContext.Err()
+	})
+
+	//test
+	ran := jobRunnerInstance.runNextJob(context.Background(), logrus.WithField("test", t.Name()))
+
+	//assert
+	require.True(t, ran)
+	require.False(t, jobRunnerInstance.Cancel(backgroundJob.ID.String()), "the job must not be cancellable once it's done")
+	require.False(t, jobRunnerInstance.Cancel(uuid.New().String()))
+	require.NotNil(t, cancelledBackgroundJob)
+	require.Equal(t, pkg.BackgroundJobStatusCancelled, cancelledBackgroundJob.JobStatus)
+	require.NotNil(t, cancelledBackgroundJob.DoneTime)
+	var cancelledBackgroundJobData map[string]interface{}
+	require.NoError(t, json.Unmarshal(cancelledBackgroundJob.Data, &cancelledBackgroundJobData))
+	require.Equal(t, map[string]interface{}{"final": "background job was cancelled"}, cancelledBackgroundJobData["error_data"])
+}
+
+func TestJobRunner_Start(t *testing.T) {
+	t.Parallel()
+
+	//setup
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	fakeDatabase := mock_database.NewMockDatabaseRepository(mockCtrl)
+	jobRunnerInstance := newTestJobRunner(t, mockCtrl, fakeDatabase, event_bus.NewNoopEventBusServer())
+	jobRunnerInstance.RegisterJobHandler(pkg.BackgroundJobTypeSync, func(backgroundJobContext context.Context, logger *logrus.Entry, databaseRepo database.DatabaseRepository, eventBus event_bus.Interface, backgroundJob *models.BackgroundJob) error {
+		return nil
+	})
+
+	//interrupted jobs of the registered job types are resumed before the workers are started
+	fakeDatabase.EXPECT().ResumeLockedBackgroundJobs(gomock.Any(), []pkg.BackgroundJobType{pkg.BackgroundJobTypeSync}, 3, time.Minute).Return(nil)
+
+	//test
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() //the workers stop immediately
+	jobRunnerInstance.Start(ctx)
+}
+
+func TestJobRunner_Notify(t *testing.T) {
+	t.Parallel()
+
+	//setup
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	jobRunnerInstance := newTestJobRunner(t, mockCtrl, mock_database.NewMockDatabaseRepository(mockCtrl), event_bus.NewNoopEventBusServer())
+
+	//test
+	jobRunnerInstance.Notify()
+	jobRunnerInstance.Notify() //must not block when a notification is already pending
+
+	//assert
+	require.Len(t, jobRunnerInstance.wakeup, 1)
+}
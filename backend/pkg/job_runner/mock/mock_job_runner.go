@@ -0,0 +1,87 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: interface.go
+
+// Package mock_job_runner is a generated GoMock package.
+package mock_job_runner
+
+import (
+	context "context"
+	reflect "reflect"
+
+	pkg "github.com/fastenhealth/fasten-onprem/backend/pkg"
+	job_runner "github.com/fastenhealth/fasten-onprem/backend/pkg/job_runner"
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockInterface is a mock of Interface interface.
+type MockInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockInterfaceMockRecorder
+}
+
+// MockInterfaceMockRecorder is the mock recorder for MockInterface.
+type MockInterfaceMockRecorder struct {
+	mock *MockInterface
+}
+
+// NewMockInterface creates a new mock instance.
+func NewMockInterface(ctrl *gomock.Controller) *MockInterface {
+	mock := &MockInterface{ctrl: ctrl}
+	mock.recorder = &MockInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockInterface) EXPECT() *MockInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Cancel mocks base method.
+func (m *MockInterface) Cancel(backgroundJobId string) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Cancel", backgroundJobId)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// Cancel indicates an expected call of Cancel.
+func (mr *MockInterfaceMockRecorder) Cancel(backgroundJobId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Cancel", reflect.TypeOf((*MockInterface)(nil).Cancel), backgroundJobId)
+}
+
+// Notify mocks base method.
+func (m *MockInterface) Notify() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Notify")
+}
+
+// Notify indicates an expected call of Notify.
+func (mr *MockInterfaceMockRecorder) Notify() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Notify", reflect.TypeOf((*MockInterface)(nil).Notify))
+}
+
+// RegisterJobHandler mocks base method.
+func (m *MockInterface) RegisterJobHandler(jobType pkg.BackgroundJobType, jobHandler job_runner.JobHandler) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "RegisterJobHandler", jobType, jobHandler)
+}
+
+// RegisterJobHandler indicates an expected call of RegisterJobHandler.
+func (mr *MockInterfaceMockRecorder) RegisterJobHandler(jobType, jobHandler interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RegisterJobHandler", reflect.TypeOf((*MockInterface)(nil).RegisterJobHandler), jobType, jobHandler)
+}
+
+// Start mocks base method.
+func (m *MockInterface) Start(ctx context.Context) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Start", ctx)
+}
+
+// Start indicates an expected call of Start.
+func (mr *MockInterfaceMockRecorder) Start(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Start", reflect.TypeOf((*MockInterface)(nil).Start), ctx)
+}
@@ -20,6 +20,9 @@ type BackgroundJob struct {
 	DoneTime   *time.Time                 `json:"done_time"`
 	Retries    int                        `json:"retries"`
 	Schedule   *pkg.BackgroundJobSchedule `json:"schedule,omitempty"`
+
+	//scheduled jobs are not claimed by the job runner until their next run time
+	NextRunTime *time.Time `json:"next_run_time,omitempty"`
 }
 
 func (b *BackgroundJob) BeforeCreate(tx *gorm.DB) (err error) {
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+)
+
+// NewExportBackgroundJob creates an export job which will be claimed and processed by the job runner (see job_runner.Interface)
+func NewExportBackgroundJob(exportData BackgroundJobExportData) *BackgroundJob {
+	dataJson, _ := json.Marshal(exportData)
+
+	return &BackgroundJob{
+		JobType:   pkg.BackgroundJobTypeExport,
+		JobStatus: pkg.BackgroundJobStatusReady,
+		Data:      dataJson,
+	}
+}
+
+// BackgroundJobExportData stores the parameters of a bulk data export (see https://hl7.org/fhir/uv/bulkdata/export.html)
+// and the NDJSON files written once the export is complete
+type BackgroundJobExportData struct {
+	//the kick-off request url and base url used for (rewritten) references, see the export manifest
+	Request string `json:"request"`
+	BaseUrl string `json:"base_url"`
+
+	//`_type` and `_since` parameters
+	ResourceTypes []string   `json:"resource_types,omitempty"`
+	Since         *time.Time `json:"since,omitempty"`
+
+	TransactionTime time.Time                   `json:"transaction_time"`
+	Output          []BackgroundJobExportOutput `json:"output,omitempty"`
+	//the files are removed once the export is deleted by the client (expired files are removed without updating the job)
+	DeletedTime *time.Time `json:"deleted_time,omitempty"`
+
+	CheckpointData map[string]interface{} `json:"checkpoint_data,omitempty"`
+	ErrorData      map[string]interface{} `json:"error_data,omitempty"`
+}
+
+// BackgroundJobExportOutput is a single NDJSON file, containing all exported resources of the same type
+type BackgroundJobExportOutput struct {
+	Type     string `json:"type"`
+	FileName string `json:"file_name"`
+	Count    int    `json:"count"`
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BackgroundJobLog is a log entry captured while a background job was processed by the job runner, so that users can
+// diagnose their own failed syncs. The entries are stored once the job completes, and are removed according to the
+// `jobs.logs` retention config.
+type BackgroundJobLog struct {
+	ModelBase
+	UserID          uuid.UUID `json:"user_id" gorm:"not null"`
+	BackgroundJobID uuid.UUID `json:"background_job_id" gorm:"not null;index:idx_background_job_log_job,priority:1"`
+
+	//logrus level name, eg. info, warning, error
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	//the resource being processed when the entry was logged, if known
+	ResourceType string    `json:"resource_type,omitempty"`
+	ResourceID   string    `json:"resource_id,omitempty"`
+	LoggedAt     time.Time `json:"logged_at" gorm:"not null;index:idx_background_job_log_job,priority:2"`
+}
+
+type BackgroundJobLogQueryOptions struct {
+	//pagination, using a cursor (see Pagination.Next)
+	Limit  int
+	Cursor string
+}
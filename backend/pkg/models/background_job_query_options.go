@@ -6,7 +6,8 @@ type BackgroundJobQueryOptions struct {
 	JobType *pkg.BackgroundJobType
 	Status  *pkg.BackgroundJobStatus
 
-	//pagination
+	//pagination, either a cursor (see Pagination.Next) or an offset can be used
 	Limit  int
 	Offset int
+	Cursor string
 }
@@ -1,12 +1,84 @@
 package models
 
-import "github.com/fastenhealth/fasten-onprem/backend/pkg"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/google/uuid"
+)
+
+// NewScheduledSyncBackgroundJob creates a recurring job, which queues a sync job for the source (or all sources, if sourceId is nil)
+// each time it's run by the job runner. The job is returned to the READY status (with the next run time) after each run.
+func NewScheduledSyncBackgroundJob(schedule pkg.BackgroundJobSchedule, sourceId *uuid.UUID, now time.Time) (*BackgroundJob, error) {
+	data := BackgroundJobScheduledSyncData{
+		SourceID: sourceId,
+	}
+	if schedule == pkg.BackgroundJobScheduleMonthly {
+		data.AnchorDay = now.Day()
+	}
+	nextRunTime, err := BackgroundJobScheduleNextRunTime(schedule, now, data.AnchorDay, now)
+	if err != nil {
+		return nil, err
+	}
+	dataJson, _ := json.Marshal(data)
 
-// TODO: this is a WIP.
-func NewScheduledSyncBackgroundJob(schedule pkg.BackgroundJobSchedule) *BackgroundJob {
 	return &BackgroundJob{
-		JobType:   pkg.BackgroundJobTypeScheduledSync,
-		JobStatus: pkg.BackgroundJobStatusReady, //scheduled jobs will not be processed immediately, so their status is set to READY
-		Schedule:  &schedule,
+		JobType:     pkg.BackgroundJobTypeScheduledSync,
+		JobStatus:   pkg.BackgroundJobStatusReady, //scheduled jobs will not be processed until their next run time, so their status is set to READY
+		Schedule:    &schedule,
+		NextRunTime: &nextRunTime,
+		Data:        dataJson,
+	}, nil
+}
+
+type BackgroundJobScheduledSyncData struct {
+	//nil if this is a global schedule, for all sources
+	SourceID    *uuid.UUID `json:"source_id,omitempty"`
+	LastRunTime *time.Time `json:"last_run_time,omitempty"`
+	//day of the month that MONTHLY schedules run on (clamped to the last day of shorter months)
+	AnchorDay int `json:"anchor_day,omitempty"`
+
+	CheckpointData map[string]interface{} `json:"checkpoint_data,omitempty"`
+	ErrorData      map[string]interface{} `json:"error_data,omitempty"`
+}
+
+// BackgroundJobScheduleNextRunTime returns the first run time (after now) in the cadence of the schedule, starting from the
+// previous run time. Runs missed while the server was stopped are skipped, rather than run back-to-back.
+// MONTHLY schedules run on the anchor day of each month (or the last day of the month, if it's shorter), the day of the
+// previous run time is used if anchorDay is 0.
+func BackgroundJobScheduleNextRunTime(schedule pkg.BackgroundJobSchedule, previousRunTime time.Time, anchorDay int, now time.Time) (time.Time, error) {
+	var addCadence func(runTime time.Time, count int) time.Time
+	switch schedule {
+	case pkg.BackgroundJobScheduleDaily:
+		addCadence = func(runTime time.Time, count int) time.Time { return runTime.AddDate(0, 0, count) }
+	case pkg.BackgroundJobScheduleWeekly:
+		addCadence = func(runTime time.Time, count int) time.Time { return runTime.AddDate(0, 0, 7*count) }
+	case pkg.BackgroundJobScheduleBiWeekly:
+		addCadence = func(runTime time.Time, count int) time.Time { return runTime.AddDate(0, 0, 14*count) }
+	case pkg.BackgroundJobScheduleMonthly:
+		if anchorDay == 0 {
+			anchorDay = previousRunTime.Day()
+		}
+		//AddDate normalizes overflowing days into the following month (eg. Jan 31 + 1 month is Mar 3), so the day is clamped instead
+		addCadence = func(runTime time.Time, count int) time.Time {
+			month := time.Date(runTime.Year(), runTime.Month()+time.Month(count), 1, runTime.Hour(), runTime.Minute(), runTime.Second(), runTime.Nanosecond(), runTime.Location())
+			lastDay := month.AddDate(0, 1, -1).Day()
+			if anchorDay < lastDay {
+				return month.AddDate(0, 0, anchorDay-1)
+			}
+			return month.AddDate(0, 0, lastDay-1)
+		}
+	default:
+		return time.Time{}, fmt.Errorf("unknown background job schedule: %s", schedule)
+	}
+
+	//the cadence is added to the previous run time (rather than now), so that the runs stay at the same time of day
+	for count := 1; ; count++ {
+		nextRunTime := addCadence(previousRunTime, count)
+		if nextRunTime.After(now) {
+			return nextRunTime, nil
+		}
 	}
 }
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackgroundJobScheduleNextRunTime(t *testing.T) {
+	t.Parallel()
+
+	previousRunTime := time.Date(2023, time.January, 15, 2, 30, 0, 0, time.UTC)
+	var testCases = []struct {
+		schedule pkg.BackgroundJobSchedule
+		now      time.Time
+		expected time.Time
+	}{
+		{pkg.BackgroundJobScheduleDaily, previousRunTime, time.Date(2023, time.January, 16, 2, 30, 0, 0, time.UTC)},
+		{pkg.BackgroundJobScheduleWeekly, previousRunTime, time.Date(2023, time.January, 22, 2, 30, 0, 0, time.UTC)},
+		{pkg.BackgroundJobScheduleBiWeekly, previousRunTime, time.Date(2023, time.January, 29, 2, 30, 0, 0, time.UTC)},
+		{pkg.BackgroundJobScheduleMonthly, previousRunTime, time.Date(2023, time.February, 15, 2, 30, 0, 0, time.UTC)},
+		//missed runs are skipped
+		{pkg.BackgroundJobScheduleWeekly, time.Date(2023, time.February, 6, 0, 0, 0, 0, time.UTC), time.Date(2023, time.February, 12, 2, 30, 0, 0, time.UTC)},
+		{pkg.BackgroundJobScheduleMonthly, time.Date(2023, time.April, 15, 2, 30, 0, 0, time.UTC), time.Date(2023, time.May, 15, 2, 30, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range testCases {
+		//test
+		nextRunTime, err := BackgroundJobScheduleNextRunTime(tc.schedule, previousRunTime, 0, tc.now)
+
+		//assert
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, nextRunTime, "%s schedule from %s", tc.schedule, tc.now)
+	}
+}
+
+func TestBackgroundJobScheduleNextRunTime_MonthlyEndOfMonth(t *testing.T) {
+	t.Parallel()
+
+	//the schedule was created on Jan 31, runs in shorter months are on the last day of the month, without drifting
+	createdTime := time.Date(2023, time.January, 31, 2, 30, 0, 0, time.UTC)
+	expectedRunTimes := []time.Time{
+		time.Date(2023, time.February, 28, 2, 30, 0, 0, time.UTC),
+		time.Date(2023, time.March, 31, 2, 30, 0, 0, time.UTC),
+		time.Date(2023, time.April, 30, 2, 30, 0, 0, time.UTC),
+		time.Date(2023, time.May, 31, 2, 30, 0, 0, time.UTC),
+	}
+
+	//test
+	backgroundJob, err := NewScheduledSyncBackgroundJob(pkg.BackgroundJobScheduleMonthly, nil, createdTime)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"anchor_day":31}`, string(backgroundJob.Data))
+	require.Equal(t, expectedRunTimes[0], *backgroundJob.NextRunTime)
+
+	//assert
+	previousRunTime := *backgroundJob.NextRunTime
+	for _, expectedRunTime := range expectedRunTimes[1:] {
+		nextRunTime, err := BackgroundJobScheduleNextRunTime(pkg.BackgroundJobScheduleMonthly, previousRunTime, 31, previousRunTime)
+		require.NoError(t, err)
+		require.Equal(t, expectedRunTime, nextRunTime)
+		previousRunTime = nextRunTime
+	}
+
+	//leap years
+	nextRunTime, err := BackgroundJobScheduleNextRunTime(pkg.BackgroundJobScheduleMonthly, time.Date(2024, time.January, 31, 2, 30, 0, 0, time.UTC), 31, time.Date(2024, time.January, 31, 2, 30, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2024, time.February, 29, 2, 30, 0, 0, time.UTC), nextRunTime)
+}
+
+func TestBackgroundJobScheduleNextRunTime_InvalidSchedule(t *testing.T) {
+	t.Parallel()
+
+	//test
+	_, err := BackgroundJobScheduleNextRunTime(pkg.BackgroundJobSchedule("HOURLY"), time.Now(), 0, time.Now())
+
+	//assert
+	require.Error(t, err)
+}
+
+func TestNewScheduledSyncBackgroundJob(t *testing.T) {
+	t.Parallel()
+
+	//setup
+	now := time.Date(2023, time.January, 15, 2, 30, 0, 0, time.UTC)
+
+	//test
+	backgroundJob, err := NewScheduledSyncBackgroundJob(pkg.BackgroundJobScheduleDaily, nil, now)
+
+	//assert
+	require.NoError(t, err)
+	require.Equal(t, pkg.BackgroundJobTypeScheduledSync, backgroundJob.JobType)
+	require.Equal(t, pkg.BackgroundJobStatusReady, backgroundJob.JobStatus)
+	require.Equal(t, time.Date(2023, time.January, 16, 2, 30, 0, 0, time.UTC), *backgroundJob.NextRunTime)
+	require.JSONEq(t, `{}`, string(backgroundJob.Data))
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"encoding/json"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	sourcePkg "github.com/fastenhealth/fasten-sources/pkg"
 	"github.com/google/uuid"
 	"time"
 )
@@ -31,4 +32,24 @@ type BackgroundJobSyncData struct {
 	SourceType     string                 `json:"source_type"`
 	CheckpointData map[string]interface{} `json:"checkpoint_data,omitempty"`
 	ErrorData      map[string]interface{} `json:"error_data,omitempty"`
+	//the uploaded Apple Health export, which is stored until it's imported by the job runner (see CreateAppleHealthSource)
+	AppleHealthExportFile string `json:"apple_health_export_file,omitempty"`
+}
+
+// IsRequestBound returns true if the sync processes data which was submitted with the request (eg. manual and C-CDA uploads,
+// or resources created by the user in the Fasten source). This data is not stored, so the sync cannot be resumed or retried.
+// Apple Health exports are stored until they're imported, so the import can be resumed.
+func (d BackgroundJobSyncData) IsRequestBound() bool {
+	if len(d.AppleHealthExportFile) > 0 {
+		return false
+	}
+	return d.SourceType == string(sourcePkg.SourceTypeManual) || d.SourceType == string(sourcePkg.SourceTypeFasten)
+}
+
+// NewQueuedSyncBackgroundJob creates a sync job which will be claimed and processed by the job runner (see job_runner.Interface)
+func NewQueuedSyncBackgroundJob(source SourceCredential) *BackgroundJob {
+	backgroundJob := NewSyncBackgroundJob(source)
+	backgroundJob.JobStatus = pkg.BackgroundJobStatusReady
+	backgroundJob.LockedTime = nil
+	return backgroundJob
 }
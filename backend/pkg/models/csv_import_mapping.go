@@ -0,0 +1,67 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CsvImportMapping describes how the rows of a CSV file (eg. a spreadsheet of glucose or blood pressure readings) are converted
+// into Observations. Each mapped column with a value generates an Observation, effective at the date of the row.
+// Mappings can be saved as templates in the user settings (see UserSettings.CsvImportTemplates).
+type CsvImportMapping struct {
+	//the name of the template, required when the mapping is saved
+	Name string `json:"name,omitempty"`
+
+	//the header of the column containing the date (and optionally the time) of each row
+	DateColumn string `json:"date_column"`
+	//the format of the date column, using the YYYY, YY, MM, M, DD, D, HH, mm & ss tokens, eg. `MM/DD/YYYY HH:mm`
+	DateFormat string `json:"date_format"`
+	//IANA timezone of the dates, defaults to UTC. Only used if the date format includes a time
+	Timezone string `json:"timezone,omitempty"`
+
+	Columns []CsvImportColumnMapping `json:"columns"`
+}
+
+// CsvImportColumnMapping maps a column to the LOINC code & unit of the Observations
+type CsvImportColumnMapping struct {
+	Column  string `json:"column"` //the header of the column
+	Code    string `json:"code"`   //LOINC code, eg. `2339-0`
+	Display string `json:"display,omitempty"`
+	Unit    string `json:"unit,omitempty"` //UCUM unit, eg. `mg/dL`
+
+	ReferenceRange *CsvImportReferenceRange `json:"reference_range,omitempty"`
+}
+
+type CsvImportReferenceRange struct {
+	Low  *float64 `json:"low,omitempty"`
+	High *float64 `json:"high,omitempty"`
+	Text string   `json:"text,omitempty"`
+}
+
+// Validate returns an error if the mapping is incomplete
+func (m *CsvImportMapping) Validate() error {
+	if len(m.DateColumn) == 0 {
+		return errors.New("mapping must include a date_column")
+	}
+	if len(m.DateFormat) == 0 {
+		return errors.New("mapping must include a date_format")
+	}
+	if len(m.Timezone) > 0 {
+		if _, err := time.LoadLocation(m.Timezone); err != nil {
+			return fmt.Errorf("mapping timezone is invalid: %w", err)
+		}
+	}
+	if len(m.Columns) == 0 {
+		return errors.New("mapping must include at least one column")
+	}
+	for ndx, column := range m.Columns {
+		if len(column.Column) == 0 || len(column.Code) == 0 {
+			return fmt.Errorf("columns[%d] must include a column and a code", ndx)
+		}
+		if column.ReferenceRange != nil && column.ReferenceRange.Low != nil && column.ReferenceRange.High != nil && *column.ReferenceRange.Low > *column.ReferenceRange.High {
+			return fmt.Errorf("columns[%d] reference_range low must be less than high", ndx)
+		}
+	}
+	return nil
+}
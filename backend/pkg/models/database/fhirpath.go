@@ -0,0 +1,90 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// FhirPathEvaluateTimeout limits how long a single (user provided) FHIRPath expression may run against a resource
+const FhirPathEvaluateTimeout = 5 * time.Second
+
+// FhirPathEvaluator evaluates FHIRPath expressions against raw FHIR resources, using the same fhirpath.js library that is
+// used to extract search parameters (and by the frontend).
+// The fhirpath.js library is only compiled once per evaluator, however goja vm's are not thread safe, so an evaluator must not
+// be shared between goroutines.
+type FhirPathEvaluator struct {
+	vm *goja.Runtime
+}
+
+func NewFhirPathEvaluator() (*FhirPathEvaluator, error) {
+	if len(fhirPathJs) == 0 {
+		return nil, fmt.Errorf("fhirPathJs script is empty")
+	}
+	vm := goja.New()
+	// setup the global window object
+	vm.Set("window", vm.NewObject())
+	// compile the fhirpath library
+	fhirPathJsProgram, err := goja.Compile("fhirpath.min.js", fhirPathJs, true)
+	if err != nil {
+		return nil, err
+	}
+	// compile the searchParametersExtractor library
+	searchParametersExtractorJsProgram, err := goja.Compile("searchParameterExtractor.js", searchParameterExtractorJs, true)
+	if err != nil {
+		return nil, err
+	}
+	// add the fhirpath library in the goja vm
+	_, err = vm.RunProgram(fhirPathJsProgram)
+	if err != nil {
+		return nil, err
+	}
+	// add the searchParametersExtractor library in the goja vm
+	_, err = vm.RunProgram(searchParametersExtractorJsProgram)
+	if err != nil {
+		return nil, err
+	}
+	return &FhirPathEvaluator{vm: vm}, nil
+}
+
+// Compile parses the FHIRPath expression without evaluating it, so that invalid expressions can be rejected before any
+// resources are queried
+func (e *FhirPathEvaluator) Compile(expression string) error {
+	e.vm.Set("fhirPathExpression", expression)
+	if _, err := e.vm.RunString("window.fhirpath.compile(fhirPathExpression)"); err != nil {
+		return fmt.Errorf("invalid FHIRPath expression (%s): %w", expression, err)
+	}
+	return nil
+}
+
+// Evaluate returns the result of the FHIRPath expression, which is always a list (possibly empty) of values
+// eg. `valueQuantity.value` => [98.6]
+func (e *FhirPathEvaluator) Evaluate(resourceRaw json.RawMessage, expression string) ([]interface{}, error) {
+	var resourceRawMap map[string]interface{}
+	if err := json.Unmarshal(resourceRaw, &resourceRawMap); err != nil {
+		return nil, err
+	}
+
+	// the resource & expression are passed as variables, so that the expression cannot be used to inject javascript
+	e.vm.Set("fhirResource", resourceRawMap)
+	e.vm.Set("fhirPathExpression", expression)
+
+	// expressions may be expensive (eg. deeply nested `repeat()` calls), so the vm is interrupted if the timeout is exceeded
+	timer := time.AfterFunc(FhirPathEvaluateTimeout, func() {
+		e.vm.Interrupt(fmt.Sprintf("exceeded timeout of %s", FhirPathEvaluateTimeout))
+	})
+	result, err := e.vm.RunString("JSON.stringify(fhirpathEvaluate(fhirResource, fhirPathExpression))")
+	timer.Stop()
+	e.vm.ClearInterrupt()
+	if err != nil {
+		return nil, fmt.Errorf("invalid FHIRPath expression (%s): %w", expression, err)
+	}
+
+	results := []interface{}{}
+	if err := json.Unmarshal([]byte(result.String()), &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
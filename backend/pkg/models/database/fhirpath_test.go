@@ -0,0 +1,40 @@
+package database
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFhirPathEvaluator_Evaluate(t *testing.T) {
+	//setup
+	resourceRaw, err := os.ReadFile("../../../../frontend/src/lib/fixtures/r4/resources/observation/example1.json")
+	require.NoError(t, err)
+	evaluator, err := NewFhirPathEvaluator()
+	require.NoError(t, err)
+
+	//test & assert
+	status, err := evaluator.Evaluate(resourceRaw, "Observation.status")
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"final"}, status)
+
+	missing, err := evaluator.Evaluate(resourceRaw, "Observation.doesNotExist")
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{}, missing)
+
+	_, err = evaluator.Evaluate(resourceRaw, "Observation.where(")
+	require.Error(t, err)
+}
+
+func TestFhirPathEvaluator_Compile(t *testing.T) {
+	//setup
+	evaluator, err := NewFhirPathEvaluator()
+	require.NoError(t, err)
+
+	//test & assert
+	require.NoError(t, evaluator.Compile("component.where(code.coding.code = '8462-4').valueQuantity.value"))
+	require.NoError(t, evaluator.Compile("(effectiveDateTime | issued).first()"))
+	require.Error(t, evaluator.Compile("Observation.where("))
+	require.Error(t, evaluator.Compile("valueQuantity:value"))
+}
@@ -14,6 +14,10 @@ type IFhirResourceModel interface {
 	SetSortTitle(sortTitle *string)
 	SetSortDate(sortDate *time.Time)
 	SetSourceUri(sourceUri *string)
+	GetResourceRaw() datatypes.JSON
+	GetSortTitle() *string
+	GetSortDate() *time.Time
+	GetUpdatedAt() time.Time
 	GetSearchParameters() map[string]string
 	PopulateAndExtractSearchParameters(rawResource json.RawMessage) error
 }
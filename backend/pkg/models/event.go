@@ -6,6 +6,7 @@ const (
 	EventTypeKeepAlive      EventSourceSyncStatus = "keep_alive"
 	EventTypeSourceSync     EventSourceSyncStatus = "source_sync"
 	EventTypeSourceComplete EventSourceSyncStatus = "source_complete"
+	EventTypeBackgroundJob  EventSourceSyncStatus = "background_job"
 )
 
 type EventInterface interface {
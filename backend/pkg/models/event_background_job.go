@@ -0,0 +1,26 @@
+package models
+
+import "github.com/fastenhealth/fasten-onprem/backend/pkg"
+
+// EventBackgroundJob reports the progress of a background job, it's published when the job is started by the job runner,
+// on each checkpoint, and when the job is done (or has failed)
+type EventBackgroundJob struct {
+	*Event          `json:",inline"`
+	BackgroundJobID string                  `json:"background_job_id"`
+	JobType         pkg.BackgroundJobType   `json:"job_type"`
+	JobStatus       pkg.BackgroundJobStatus `json:"job_status"`
+	CheckpointData  map[string]interface{}  `json:"checkpoint_data,omitempty"`
+}
+
+func NewEventBackgroundJob(userID string, backgroundJobID string, jobType pkg.BackgroundJobType, jobStatus pkg.BackgroundJobStatus, checkpointData map[string]interface{}) *EventBackgroundJob {
+	return &EventBackgroundJob{
+		Event: &Event{
+			UserID:    userID,
+			EventType: EventTypeBackgroundJob,
+		},
+		BackgroundJobID: backgroundJobID,
+		JobType:         jobType,
+		JobStatus:       jobStatus,
+		CheckpointData:  checkpointData,
+	}
+}
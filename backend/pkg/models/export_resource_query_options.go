@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// ExportResourceQueryOptions filters the resources returned by DatabaseRepository.ExportResources
+type ExportResourceQueryOptions struct {
+	//optional, only export resources from this source, otherwise every source is exported
+	SourceID string
+	//optional, only export these resource types (eg. `_type=Observation,Condition`)
+	SourceResourceTypes []string
+
+	//optional, only export resources which were created or updated after this instant (eg. `_since`)
+	Since *time.Time
+	//optional, only export resources with a (sort) date in the range [Start, End), resources without a date (eg. Patient) are always exported
+	Start *time.Time
+	End   *time.Time
+}
@@ -18,7 +18,11 @@ type ListResourceQueryOptions struct {
 	SourceResourceType string
 	SourceResourceID   string
 
-	//pagination
+	//sorting, either `date` (newest first, the default) or `title` (alphabetical)
+	SortBy string
+
+	//pagination, either a cursor (see Pagination.Next) or an offset can be used
 	Limit  int
 	Offset int
+	Cursor string
 }
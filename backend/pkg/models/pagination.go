@@ -0,0 +1,9 @@
+package models
+
+// Pagination is returned alongside a page of results (see DatabaseRepository.ListResources, QueryResources and ListBackgroundJobs)
+type Pagination struct {
+	//total number of results matching the query, across all pages
+	Total int64 `json:"total"`
+	//opaque cursor which should be provided to retrieve the next page of results, empty if this is the last page
+	Next string `json:"next,omitempty"`
+}
@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// ObservationLastNQuery selects the most recent Observations for each code, see DatabaseRepository.QueryObservationLastN
+type ObservationLastNQuery struct {
+	//Observation search parameters (see QueryResource.Where), eg. `{"category": "vital-signs"}`
+	Where map[string]interface{}
+	//the number of Observations returned for each code
+	Max int
+}
+
+// ObservationStatisticsQuery summarizes the Quantity values of Observations, see DatabaseRepository.QueryObservationStatistics
+type ObservationStatisticsQuery struct {
+	//Observation search parameters (see QueryResource.Where), eg. `{"code": "http://loinc.org|29463-7"}`
+	Where map[string]interface{}
+	//optional, calculate the statistics for each date bucket (see QueryResourceAggregationBuckets), rather than all Observations
+	Bucket string
+	//optional, convert the values to this UCUM unit (eg. `kg`) before they are summarized, otherwise the statistics are grouped by unit
+	Unit string
+}
+
+// ObservationStatistics are the statistics calculated for the Observations with the same code (and unit) in a period
+type ObservationStatistics struct {
+	CodeSystem  string `json:"code_system"`
+	Code        string `json:"code"`
+	CodeDisplay string `json:"code_display,omitempty"`
+	Period      string `json:"period,omitempty"` //date bucket label (eg. `2023-01`), empty unless ObservationStatisticsQuery.Bucket is set
+	Unit        string `json:"unit"`
+
+	Count   int64   `json:"count"`
+	Minimum float64 `json:"minimum"`
+	Maximum float64 `json:"maximum"`
+	Mean    float64 `json:"mean"`
+	Latest  float64 `json:"latest"` //the value of the most recent Observation
+
+	//the date of the first and most recent Observations
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+}
@@ -1,18 +1,26 @@
 package models
 
 import (
-	"fmt"
 	"strings"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/errors"
+	"github.com/samber/lo"
 )
 
 // maps to frontend/src/app/models/widget/dashboard-widget-query.ts
 type QueryResource struct {
-	Use    string                 `json:"use"`
-	Select []string               `json:"select"`
+	Use    string                 `json:"use"`    //name of a view (see QueryResourceViews) which provides the 'from' and default 'where' values
+	Select []string               `json:"select"` //search parameters (eg. `code:code`) or FHIRPath expressions (eg. `valueQuantity.value as data`), returned as flat rows
 	From   string                 `json:"from"`
-	Where  map[string]interface{} `json:"where"`
+	Where  map[string]interface{} `json:"where"`          //search parameters, may also be chained (`encounter.class`) or reverse chained (`_has:Condition:encounter:code`)
+	Sort   []string               `json:"sort,omitempty"` //search parameters to order the results by, prefixed with `-` for descending (eg. `-date`). Defaults to `-sort_date`
 	Limit  *int                   `json:"limit,omitempty"`
 	Offset *int                   `json:"offset,omitempty"`
+	Cursor string                 `json:"cursor,omitempty"` //returned as `next` by the previous page, cannot be used with 'offset', 'sort' or 'aggregations'
+
+	//related resources which should be returned with the matching resources
+	Include    []string `json:"include,omitempty"`    //eg. `MedicationRequest:medication`, `Observation:performer:Practitioner` or `Encounter:*`
+	RevInclude []string `json:"revinclude,omitempty"` //eg. `Provenance:target` or `Provenance:*`
 
 	//aggregation fields
 	Aggregations *QueryResourceAggregations `json:"aggregations"`
@@ -23,71 +31,141 @@ type QueryResourceAggregations struct {
 
 	GroupBy *QueryResourceAggregation `json:"group_by,omitempty"`
 	OrderBy *QueryResourceAggregation `json:"order_by,omitempty"`
+
+	SeriesBy *QueryResourceAggregation `json:"series_by,omitempty"` //secondary grouping (eg. `class:code`), requires 'count_by' or 'group_by'. Returned as `series`
 }
 
 type QueryResourceAggregation struct {
 	Field    string `json:"field"`
 	Function string `json:"fn"`
+	Bucket   string `json:"bucket,omitempty"` //only for date fields, truncates the date to the start of the bucket (eg. `month`)
+	Unit     string `json:"unit,omitempty"`   //only for Quantity `value` fields, converts values to this UCUM unit (eg. `mg/dL`) before aggregating
+}
+
+// QueryResourceAggregationFunctions are the supported aggregate functions (`fn`).
+// `sum` and `avg` require a numeric field, `min` and `max` may also be used with date fields
+var QueryResourceAggregationFunctions = []string{"count", "sum", "avg", "min", "max"}
+
+// QueryResourceAggregationBuckets are the supported date buckets, and an example of the generated labels
+var QueryResourceAggregationBuckets = map[string]string{
+	"year":    "2023",
+	"quarter": "2023-Q1",
+	"month":   "2023-01",
+	"week":    "2023-01-02", //start (Monday) of the ISO 8601 week
+	"day":     "2023-01-02",
 }
 
 func (q *QueryResource) Validate() error {
 	if len(q.Use) > 0 {
-		return fmt.Errorf("'use' is not supported yet")
+		//the view will provide the 'from' value, see ApplyView
+		if _, viewOk := QueryResourceViews[q.Use]; !viewOk {
+			return errors.QueryValidationErrorf("unknown view '%s' in 'use'", q.Use)
+		}
+	} else if len(q.From) == 0 {
+		return errors.QueryValidationErrorf("'from' is required")
 	}
 
-	if len(q.From) == 0 {
-		return fmt.Errorf("'from' is required")
+	if len(q.Select) > 0 && (len(q.Include) > 0 || len(q.RevInclude) > 0) {
+		return errors.QueryValidationErrorf("cannot use 'select' and 'include' or 'revinclude' together")
+	}
+
+	if len(q.Cursor) > 0 && q.Offset != nil {
+		return errors.QueryValidationErrorf("cannot use 'cursor' and 'offset' together")
+	}
+	if len(q.Cursor) > 0 && len(q.Sort) > 0 {
+		return errors.QueryValidationErrorf("cannot use 'cursor' and 'sort' together, use 'offset' instead")
 	}
 
 	if q.Aggregations != nil {
+		if len(q.Cursor) > 0 {
+			return errors.QueryValidationErrorf("cannot use 'cursor' and 'aggregations' together, use 'offset' instead")
+		}
 		if len(q.Select) > 0 {
-			return fmt.Errorf("cannot use 'select' and 'aggregations' together")
+			return errors.QueryValidationErrorf("cannot use 'select' and 'aggregations' together")
+		}
+		if len(q.Sort) > 0 {
+			return errors.QueryValidationErrorf("cannot use 'sort' and 'aggregations' together, use 'order_by' instead")
 		}
 
 		if q.Aggregations.CountBy != nil {
 			if len(q.Aggregations.CountBy.Field) == 0 {
-				return fmt.Errorf("if 'count_by' is present, field must be populated")
+				return errors.QueryValidationErrorf("if 'count_by' is present, field must be populated")
 			}
 			if strings.Contains(q.Aggregations.CountBy.Field, " ") {
-				return fmt.Errorf("count_by cannot have spaces (or aliases)")
+				return errors.QueryValidationErrorf("count_by cannot have spaces (or aliases)")
 			}
 		}
 		if q.Aggregations.GroupBy != nil {
 			if len(q.Aggregations.GroupBy.Field) == 0 {
-				return fmt.Errorf("if 'group_by' is present, field must be populated")
+				return errors.QueryValidationErrorf("if 'group_by' is present, field must be populated")
 			}
 			if strings.Contains(q.Aggregations.GroupBy.Field, " ") {
-				return fmt.Errorf("group_by cannot have spaces (or aliases)")
+				return errors.QueryValidationErrorf("group_by cannot have spaces (or aliases)")
 			}
 		}
 		if q.Aggregations.OrderBy != nil {
 			if len(q.Aggregations.OrderBy.Field) == 0 {
-				return fmt.Errorf("if 'order_by' is present, field must be populated")
+				return errors.QueryValidationErrorf("if 'order_by' is present, field must be populated")
 			}
 			if strings.Contains(q.Aggregations.OrderBy.Field, " ") {
-				return fmt.Errorf("order_by cannot have spaces (or aliases)")
+				return errors.QueryValidationErrorf("order_by cannot have spaces (or aliases)")
 			}
 		}
 
+		if q.Aggregations.SeriesBy != nil {
+			if len(q.Aggregations.SeriesBy.Field) == 0 {
+				return errors.QueryValidationErrorf("if 'series_by' is present, field must be populated")
+			}
+			if strings.Contains(q.Aggregations.SeriesBy.Field, " ") {
+				return errors.QueryValidationErrorf("series_by cannot have spaces (or aliases)")
+			}
+			if q.Aggregations.CountBy == nil && q.Aggregations.GroupBy == nil {
+				return errors.QueryValidationErrorf("'series_by' requires 'count_by' or 'group_by'")
+			}
+		}
+		for _, aggregation := range []*QueryResourceAggregation{q.Aggregations.CountBy, q.Aggregations.GroupBy, q.Aggregations.OrderBy, q.Aggregations.SeriesBy} {
+			if aggregation == nil {
+				continue
+			}
+			if len(aggregation.Function) > 0 && !lo.Contains(QueryResourceAggregationFunctions, aggregation.Function) {
+				return errors.QueryValidationErrorf("unknown aggregation function '%s', must be one of %s", aggregation.Function, strings.Join(QueryResourceAggregationFunctions, ", "))
+			}
+			if len(aggregation.Bucket) > 0 {
+				if _, bucketOk := QueryResourceAggregationBuckets[aggregation.Bucket]; !bucketOk {
+					return errors.QueryValidationErrorf("unknown bucket '%s', must be one of year, quarter, month, week or day", aggregation.Bucket)
+				}
+			}
+			if len(aggregation.Unit) > 0 && (aggregation.Function == "" || aggregation.Function == "count") {
+				return errors.QueryValidationErrorf("'unit' can only be used with the sum, avg, min or max aggregation functions")
+			}
+		}
+		if q.Aggregations.OrderBy != nil && q.Aggregations.OrderBy.Field == "*" && len(q.Aggregations.OrderBy.Function) > 0 && q.Aggregations.OrderBy.Function != "count" {
+			return errors.QueryValidationErrorf("order_by '*' can only be used with the count aggregation function")
+		}
+
 		if q.Aggregations.CountBy != nil {
 			if q.Aggregations.GroupBy != nil {
-				return fmt.Errorf("cannot use 'count_by' and 'group_by' together")
+				return errors.QueryValidationErrorf("cannot use 'count_by' and 'group_by' together")
 			}
 			if q.Aggregations.OrderBy != nil {
-				return fmt.Errorf("cannot use 'count_by' and 'order_by' together")
+				return errors.QueryValidationErrorf("cannot use 'count_by' and 'order_by' together")
 			}
 		}
 		if q.Aggregations.CountBy == nil && q.Aggregations.OrderBy == nil && q.Aggregations.GroupBy == nil {
-			return fmt.Errorf("aggregations must have at least one of 'count_by', 'group_by', or 'order_by'")
+			return errors.QueryValidationErrorf("aggregations must have at least one of 'count_by', 'group_by', or 'order_by'")
+		}
+
+		if len(q.Include) > 0 || len(q.RevInclude) > 0 {
+			return errors.QueryValidationErrorf("cannot use 'include' or 'revinclude' and 'aggregations' together")
 		}
 
 	}
 
 	if q.Limit != nil && *q.Limit < 0 {
-		return fmt.Errorf("'limit' must be greater than or equal to zero")
+		return errors.QueryValidationErrorf("'limit' must be greater than or equal to zero")
 	}
 	if q.Offset != nil && *q.Offset < 0 {
-		return fmt.Errorf("'offset' must be greater than or equal to zero")
+		return errors.QueryValidationErrorf("'offset' must be greater than or equal to zero")
 	}
 
 	return nil
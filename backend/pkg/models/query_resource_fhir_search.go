@@ -0,0 +1,150 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/iancoleman/strcase"
+	"github.com/samber/lo"
+)
+
+// ParseFhirSearchQuery converts a FHIR search query string into a QueryResource, so that search URLs can be used
+// without hand-translating them into the QueryResource json format.
+// https://hl7.org/fhir/r4/search.html
+//
+// eg. `Observation?code=http://loinc.org|4548-4&date=ge2022-01-01&_sort=-date&_count=10`
+// is equivalent to {"from": "Observation", "where": {"code": "http://loinc.org|4548-4", "date": "ge2022-01-01"}, "sort": ["-date"], "limit": 10}
+//
+// - the resource type is the last segment of the path (`Observation`, `/fhir/Observation` or `https://example.com/fhir/Observation`)
+// - comma separated values are OR'd together, repeated parameters are AND'd together (see QueryResource.Where)
+// - kebab-case search parameters are converted to the camelCase search parameter names (eg. `value-quantity` is `valueQuantity`)
+// - `_sort`, `_count`, `_offset`, `_include` and `_revinclude` are supported, `_cursor` is the `next` value returned by the previous page
+func ParseFhirSearchQuery(searchQuery string) (QueryResource, error) {
+	query := QueryResource{
+		Where: map[string]interface{}{},
+	}
+
+	searchPath, searchRawQuery, hasQuery := strings.Cut(searchQuery, "?")
+	if !hasQuery && strings.Contains(searchPath, "=") {
+		//only search parameters, the resource type must be provided separately
+		searchPath, searchRawQuery = "", searchPath
+	}
+	searchPath = strings.TrimRight(searchPath, "/")
+	query.From = searchPath[strings.LastIndex(searchPath, "/")+1:]
+
+	searchParams, err := url.ParseQuery(searchRawQuery)
+	if err != nil {
+		return query, fmt.Errorf("invalid search query: %w", err)
+	}
+
+	for searchParamName, searchParamValues := range searchParams {
+		switch searchParamName {
+		case "_sort":
+			for _, searchParamValue := range searchParamValues {
+				for _, sortParam := range strings.Split(searchParamValue, ",") {
+					if len(sortParam) == 0 {
+						continue
+					}
+					if strings.HasPrefix(sortParam, "-") {
+						query.Sort = append(query.Sort, "-"+fhirSearchParameterName(strings.TrimPrefix(sortParam, "-")))
+					} else {
+						query.Sort = append(query.Sort, fhirSearchParameterName(sortParam))
+					}
+				}
+			}
+		case "_count":
+			limit, err := strconv.Atoi(searchParamValues[len(searchParamValues)-1])
+			if err != nil || limit < 0 {
+				return query, fmt.Errorf("invalid search query: _count must be a positive integer")
+			}
+			query.Limit = &limit
+		case "_offset":
+			offset, err := strconv.Atoi(searchParamValues[len(searchParamValues)-1])
+			if err != nil || offset < 0 {
+				return query, fmt.Errorf("invalid search query: _offset must be a positive integer")
+			}
+			query.Offset = &offset
+		case "_cursor":
+			query.Cursor = searchParamValues[len(searchParamValues)-1]
+		case "_include":
+			query.Include = append(query.Include, searchParamValues...)
+		case "_revinclude":
+			query.RevInclude = append(query.RevInclude, searchParamValues...)
+		case "_format", "_pretty":
+			//the response is always json
+			continue
+		default:
+			if strings.HasPrefix(searchParamName, "_") && !strings.HasPrefix(searchParamName, "_has:") && !lo.Contains([]string{"_id", "_lastUpdated", "_tag", "_profile"}, searchParamName) {
+				return query, fmt.Errorf("invalid search query: %s is not supported", searchParamName)
+			}
+
+			searchParamName = fhirSearchParameterName(searchParamName)
+			if len(searchParamValues) == 1 {
+				query.Where[searchParamName] = searchParamValues[0]
+			} else {
+				query.Where[searchParamName] = searchParamValues
+			}
+		}
+	}
+	return query, nil
+}
+
+// fhirSearchParameterName converts a FHIR search parameter (which may be chained, or have a modifier) into the search
+// parameter names used by QueryResource.Where, eg. `subject:Patient.general-practitioner` is `subject:Patient.generalPractitioner`
+func fhirSearchParameterName(searchParamName string) string {
+	if strings.HasPrefix(searchParamName, "_has:") {
+		//_has:ResourceType:reference:parameter[:modifier], only the reference and parameter are search parameter names
+		searchParamParts := strings.SplitN(searchParamName, ":", 5)
+		for ndx := 2; ndx < len(searchParamParts) && ndx < 4; ndx++ {
+			searchParamParts[ndx] = fhirSearchParameterCode(searchParamParts[ndx])
+		}
+		return strings.Join(searchParamParts, ":")
+	}
+
+	chainedSearchParams := strings.Split(searchParamName, ".")
+	for ndx, chainedSearchParam := range chainedSearchParams {
+		if searchParamCode, searchParamModifier, hasModifier := strings.Cut(chainedSearchParam, ":"); hasModifier {
+			chainedSearchParams[ndx] = fhirSearchParameterCode(searchParamCode) + ":" + searchParamModifier
+		} else {
+			chainedSearchParams[ndx] = fhirSearchParameterCode(searchParamCode)
+		}
+	}
+	return strings.Join(chainedSearchParams, ".")
+}
+
+// fhirSearchParameterCode converts a single FHIR search parameter code into the (camelCase) search parameter name
+func fhirSearchParameterCode(searchParamCode string) string {
+	switch searchParamCode {
+	case "_id":
+		//the FHIR resource id is the id assigned by the source, the `id` column is the internal (fasten) id
+		return "source_resource_id"
+	case "_lastUpdated":
+		return "metaLastUpdated"
+	case "_tag":
+		return "metaTag"
+	case "_profile":
+		return "metaProfile"
+	}
+	if strings.Contains(searchParamCode, "-") {
+		return strcase.ToLowerCamel(searchParamCode)
+	}
+	return searchParamCode
+}
+
+// SearchParameterFhirCode converts a (camelCase) search parameter name into its FHIR search parameter code, this is the
+// inverse of fhirSearchParameterCode, eg. `valueQuantity` is `value-quantity` and `metaLastUpdated` is `_lastUpdated`
+func SearchParameterFhirCode(searchParamName string) string {
+	switch searchParamName {
+	case "source_resource_id":
+		return "_id"
+	case "metaLastUpdated":
+		return "_lastUpdated"
+	case "metaTag":
+		return "_tag"
+	case "metaProfile":
+		return "_profile"
+	}
+	return strcase.ToKebab(searchParamName)
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFhirSearchQuery(t *testing.T) {
+	t.Parallel()
+
+	var parseFhirSearchQueryTests = []struct {
+		searchQuery         string
+		expected            QueryResource
+		expectedErrorString string
+	}{
+		{
+			"Observation?code=http://loinc.org|4548-4&date=ge2022-01-01&_sort=-date&_count=10",
+			QueryResource{From: "Observation", Where: map[string]interface{}{"code": "http://loinc.org|4548-4", "date": "ge2022-01-01"}, Sort: []string{"-date"}, Limit: lo.ToPtr(10)},
+			"",
+		},
+		{
+			"https://example.com/fhir/r4/Observation/?code=8302-2,29463-7&date=ge2022-01-01&date=lt2023-01-01&_offset=20",
+			QueryResource{From: "Observation", Where: map[string]interface{}{"code": "8302-2,29463-7", "date": []string{"ge2022-01-01", "lt2023-01-01"}}, Offset: lo.ToPtr(20)},
+			"",
+		},
+		{
+			"Patient?general-practitioner:Practitioner.family=Smith&_id=123&_lastUpdated=gt2023&_has:Observation:patient:value-quantity=gt5&_sort=family,-birthdate",
+			QueryResource{From: "Patient", Where: map[string]interface{}{"generalPractitioner:Practitioner.family": "Smith", "source_resource_id": "123", "metaLastUpdated": "gt2023", "_has:Observation:patient:valueQuantity": "gt5"}, Sort: []string{"family", "-birthdate"}},
+			"",
+		},
+		{
+			"MedicationRequest?_include=MedicationRequest:medication&_revinclude=Provenance:target&_cursor=abc&_format=json",
+			QueryResource{From: "MedicationRequest", Where: map[string]interface{}{}, Include: []string{"MedicationRequest:medication"}, RevInclude: []string{"Provenance:target"}, Cursor: "abc"},
+			"",
+		},
+		{
+			"Condition?_tag=http://example.com|abc&_profile=http://hl7.org/fhir/us/core/StructureDefinition/us-core-condition",
+			QueryResource{From: "Condition", Where: map[string]interface{}{"metaTag": "http://example.com|abc", "metaProfile": "http://hl7.org/fhir/us/core/StructureDefinition/us-core-condition"}},
+			"",
+		},
+		{"code=8302-2", QueryResource{From: "", Where: map[string]interface{}{"code": "8302-2"}}, ""},
+		{"Observation", QueryResource{From: "Observation", Where: map[string]interface{}{}}, ""},
+		{"Observation?_count=-1", QueryResource{}, "invalid search query: _count must be a positive integer"},
+		{"Observation?_offset=abc", QueryResource{}, "invalid search query: _offset must be a positive integer"},
+		{"Observation?_summary=true", QueryResource{}, "invalid search query: _summary is not supported"},
+		{"Observation?code=%zz", QueryResource{}, `invalid search query: invalid URL escape "%zz"`},
+	}
+
+	//test && assert
+	for ndx, tt := range parseFhirSearchQueryTests {
+		actual, actualErr := ParseFhirSearchQuery(tt.searchQuery)
+		if len(tt.expectedErrorString) > 0 {
+			require.EqualError(t, actualErr, tt.expectedErrorString, "Expected error for parseFhirSearchQueryTests[%d] %s", ndx, tt.searchQuery)
+		} else {
+			require.NoError(t, actualErr, "Expected no error for parseFhirSearchQueryTests[%d] %s", ndx, tt.searchQuery)
+			require.Equal(t, tt.expected, actual, "Expected query to match for parseFhirSearchQueryTests[%d] %s", ndx, tt.searchQuery)
+		}
+	}
+}
+
+func TestSearchParameterFhirCode(t *testing.T) {
+	t.Parallel()
+
+	var searchParameterFhirCodeTests = map[string]string{
+		"source_resource_id":    "_id",
+		"metaLastUpdated":       "_lastUpdated",
+		"metaTag":               "_tag",
+		"code":                  "code",
+		"valueQuantity":         "value-quantity",
+		"generalPractitioner":   "general-practitioner",
+		"componentValueConcept": "component-value-concept",
+	}
+
+	//test && assert
+	for searchParamName, expected := range searchParameterFhirCodeTests {
+		actual := SearchParameterFhirCode(searchParamName)
+		require.Equal(t, expected, actual, "Expected FHIR code to match for %s", searchParamName)
+		require.Equal(t, searchParamName, fhirSearchParameterCode(actual), "Expected search parameter name to round trip for %s", searchParamName)
+	}
+}
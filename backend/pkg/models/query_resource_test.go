@@ -1,6 +1,7 @@
 package models
 
 import (
+	"github.com/samber/lo"
 	"github.com/stretchr/testify/require"
 	"testing"
 )
@@ -11,7 +12,9 @@ func TestQueryResource_Validate(t *testing.T) {
 		expectedErrorString string
 		expectedError       bool
 	}{
-		{QueryResource{Use: "test"}, "'use' is not supported yet", true},
+		{QueryResource{Use: "test"}, "unknown view 'test' in 'use'", true},
+		{QueryResource{Use: "vital-signs"}, "", false},
+		{QueryResource{From: "test", Select: []string{"test"}, Include: []string{"test:property"}}, "cannot use 'select' and 'include' or 'revinclude' together", true},
 		{QueryResource{}, "'from' is required", true},
 		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{CountBy: &QueryResourceAggregation{Field: ""}}}, "if 'count_by' is present, field must be populated", true},
 		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{GroupBy: &QueryResourceAggregation{Field: ""}}}, "if 'group_by' is present, field must be populated", true},
@@ -24,7 +27,25 @@ func TestQueryResource_Validate(t *testing.T) {
 		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{CountBy: &QueryResourceAggregation{Field: "test:property"}}}, "", false},
 		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{CountBy: &QueryResourceAggregation{Field: "test:property as HELLO"}}}, "count_by cannot have spaces (or aliases)", true},
 		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{GroupBy: &QueryResourceAggregation{Field: "test:property as HELLO"}}}, "group_by cannot have spaces (or aliases)", true},
+		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{GroupBy: &QueryResourceAggregation{Field: "date", Bucket: "month"}, SeriesBy: &QueryResourceAggregation{Field: "class:code"}}}, "", false},
+		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{CountBy: &QueryResourceAggregation{Field: "date", Bucket: "quarter"}}}, "", false},
+		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{GroupBy: &QueryResourceAggregation{Field: "date", Bucket: "decade"}}}, "unknown bucket 'decade', must be one of year, quarter, month, week or day", true},
+		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{OrderBy: &QueryResourceAggregation{Field: "date"}, SeriesBy: &QueryResourceAggregation{Field: "class:code"}}}, "'series_by' requires 'count_by' or 'group_by'", true},
+		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{GroupBy: &QueryResourceAggregation{Field: "date"}, SeriesBy: &QueryResourceAggregation{Field: "class:code as HELLO"}}}, "series_by cannot have spaces (or aliases)", true},
+		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{GroupBy: &QueryResourceAggregation{Field: "date", Bucket: "month"}, OrderBy: &QueryResourceAggregation{Field: "valueQuantity:value", Function: "avg", Unit: "mg/dL"}}}, "", false},
+		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{GroupBy: &QueryResourceAggregation{Field: "code"}, OrderBy: &QueryResourceAggregation{Field: "valueQuantity:value", Function: "avg) FROM users; --"}}}, "unknown aggregation function 'avg) FROM users; --', must be one of count, sum, avg, min, max", true},
+		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{GroupBy: &QueryResourceAggregation{Field: "code"}, OrderBy: &QueryResourceAggregation{Field: "valueQuantity:value", Unit: "mg/dL"}}}, "'unit' can only be used with the sum, avg, min or max aggregation functions", true},
+		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{GroupBy: &QueryResourceAggregation{Field: "code"}, OrderBy: &QueryResourceAggregation{Field: "*", Function: "sum"}}}, "order_by '*' can only be used with the count aggregation function", true},
 		{QueryResource{From: "test", Aggregations: &QueryResourceAggregations{OrderBy: &QueryResourceAggregation{Field: "test:property as HELLO"}}}, "order_by cannot have spaces (or aliases)", true},
+		{QueryResource{From: "test", Include: []string{"test:property"}, Aggregations: &QueryResourceAggregations{CountBy: &QueryResourceAggregation{Field: "test"}}}, "cannot use 'include' or 'revinclude' and 'aggregations' together", true},
+		{QueryResource{From: "test", RevInclude: []string{"test:property"}, Aggregations: &QueryResourceAggregations{CountBy: &QueryResourceAggregation{Field: "test"}}}, "cannot use 'include' or 'revinclude' and 'aggregations' together", true},
+		{QueryResource{From: "test", Include: []string{"test:property"}, RevInclude: []string{"test:property"}}, "", false},
+		{QueryResource{From: "test", Cursor: "abc"}, "", false},
+		{QueryResource{From: "test", Cursor: "abc", Offset: lo.ToPtr(10)}, "cannot use 'cursor' and 'offset' together", true},
+		{QueryResource{From: "test", Cursor: "abc", Aggregations: &QueryResourceAggregations{CountBy: &QueryResourceAggregation{Field: "test"}}}, "cannot use 'cursor' and 'aggregations' together, use 'offset' instead", true},
+		{QueryResource{From: "test", Cursor: "abc", Sort: []string{"-date"}}, "cannot use 'cursor' and 'sort' together, use 'offset' instead", true},
+		{QueryResource{From: "test", Sort: []string{"-date"}, Aggregations: &QueryResourceAggregations{CountBy: &QueryResourceAggregation{Field: "test"}}}, "cannot use 'sort' and 'aggregations' together, use 'order_by' instead", true},
+		{QueryResource{From: "test", Sort: []string{"-date"}, Offset: lo.ToPtr(10)}, "", false},
 	}
 
 	//test && assert
@@ -37,3 +58,29 @@ func TestQueryResource_Validate(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryResource_ApplyView(t *testing.T) {
+	//test
+	query, err := QueryResource{Use: "vital-signs", Where: map[string]interface{}{"code": "http://loinc.org|8302-2", "category": []interface{}{"http://terminology.hl7.org/CodeSystem/observation-category|exam"}}}.ApplyView()
+
+	//assert
+	require.NoError(t, err)
+	require.Equal(t, QueryResource{
+		From: "Observation",
+		Where: map[string]interface{}{
+			"code":     "http://loinc.org|8302-2",
+			"category": []string{"http://terminology.hl7.org/CodeSystem/observation-category|vital-signs", "http://terminology.hl7.org/CodeSystem/observation-category|exam"},
+		},
+	}, query)
+	require.Equal(t, "http://terminology.hl7.org/CodeSystem/observation-category|vital-signs", QueryResourceViews["vital-signs"].Where["category"], "view should not be modified")
+
+	_, err = QueryResource{Use: "vital-signs", From: "Condition"}.ApplyView()
+	require.EqualError(t, err, "'from' (Condition) does not match the resource type of view 'vital-signs' (Observation)")
+
+	_, err = QueryResource{Use: "unknown"}.ApplyView()
+	require.EqualError(t, err, "unknown view 'unknown' in 'use'")
+
+	unchanged, err := QueryResource{From: "Observation"}.ApplyView()
+	require.NoError(t, err)
+	require.Equal(t, QueryResource{From: "Observation"}, unchanged)
+}
@@ -0,0 +1,103 @@
+package models
+
+import "github.com/fastenhealth/fasten-onprem/backend/pkg/errors"
+
+// QueryResourceViews are named queries which can be referenced by the QueryResource.Use field, so that common
+// filters don't need to be repeated in every dashboard widget.
+//
+// eg. {"use": "vital-signs", "where": {"code": "http://loinc.org|8302-2"}}
+// is equivalent to {"from": "Observation", "where": {"category": "...|vital-signs", "code": "http://loinc.org|8302-2"}}
+var QueryResourceViews = map[string]QueryResource{
+	"vital-signs": {
+		From:  "Observation",
+		Where: map[string]interface{}{"category": "http://terminology.hl7.org/CodeSystem/observation-category|vital-signs"},
+	},
+	"laboratory": {
+		From:  "Observation",
+		Where: map[string]interface{}{"category": "http://terminology.hl7.org/CodeSystem/observation-category|laboratory"},
+	},
+	"active-conditions": {
+		From:  "Condition",
+		Where: map[string]interface{}{"clinicalStatus": "http://terminology.hl7.org/CodeSystem/condition-clinical|active"},
+	},
+	"active-allergies": {
+		From:  "AllergyIntolerance",
+		Where: map[string]interface{}{"clinicalStatus": "http://terminology.hl7.org/CodeSystem/allergyintolerance-clinical|active"},
+	},
+	"active-medications": {
+		From:  "MedicationRequest",
+		Where: map[string]interface{}{"status": "active"},
+	},
+	"completed-immunizations": {
+		From:  "Immunization",
+		Where: map[string]interface{}{"status": "completed"},
+	},
+}
+
+// ApplyView merges the view referenced by `use` into a copy of the query:
+// - the view's `from` is used (if the query specifies `from`, it must match the view)
+// - the view's `where` conditions are AND'd with the query's `where` conditions
+//
+// queries without `use` are returned unchanged. The returned query does not have `use` set, so ApplyView may be called multiple times.
+func (q QueryResource) ApplyView() (QueryResource, error) {
+	if len(q.Use) == 0 {
+		return q, nil
+	}
+
+	view, viewOk := QueryResourceViews[q.Use]
+	if !viewOk {
+		return q, errors.QueryValidationErrorf("unknown view '%s' in 'use'", q.Use)
+	}
+	if len(q.From) > 0 && q.From != view.From {
+		return q, errors.QueryValidationErrorf("'from' (%s) does not match the resource type of view '%s' (%s)", q.From, q.Use, view.From)
+	}
+
+	where := map[string]interface{}{}
+	for searchCode, searchValue := range view.Where {
+		where[searchCode] = searchValue
+	}
+	for searchCode, searchValue := range q.Where {
+		existingSearchValue, existingOk := where[searchCode]
+		if !existingOk {
+			where[searchCode] = searchValue
+			continue
+		}
+		//the same search parameter is used by both the view and query, the values must be AND'd together
+		existingSearchValues, err := queryResourceWhereValues(existingSearchValue)
+		if err != nil {
+			return q, err
+		}
+		searchValues, err := queryResourceWhereValues(searchValue)
+		if err != nil {
+			return q, err
+		}
+		where[searchCode] = append(existingSearchValues, searchValues...)
+	}
+
+	q.Use = ""
+	q.From = view.From
+	q.Where = where
+	return q, nil
+}
+
+// queryResourceWhereValues converts a where value (a string, or a list of strings) into a list of strings
+func queryResourceWhereValues(whereValue interface{}) ([]string, error) {
+	switch v := whereValue.(type) {
+	case string:
+		return []string{v}, nil
+	case []string:
+		return append([]string{}, v...), nil
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			itemStr, itemOk := item.(string)
+			if !itemOk {
+				return nil, errors.QueryValidationErrorf("invalid where value type %T, must be a string or a list of strings", item)
+			}
+			values = append(values, itemStr)
+		}
+		return values, nil
+	default:
+		return nil, errors.QueryValidationErrorf("invalid where value type %T, must be a string or a list of strings", v)
+	}
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
 	"gorm.io/datatypes"
 	"time"
 )
@@ -15,6 +16,9 @@ type ResourceBase struct {
 	// The raw resource content in JSON format
 	ResourceRaw datatypes.JSON `gorm:"column:resource_raw;type:text;serializer:json" json:"resource_raw,omitempty"`
 
+	//only populated by QueryResources, "match" for resources matching the query, or "include" for resources included via include/revinclude
+	SearchMode pkg.ResourceSearchMode `json:"search_mode,omitempty" gorm:"-"`
+
 	//relationships
 	RelatedResource []*ResourceBase `json:"related_resources" gorm:"many2many:related_resources;ForeignKey:user_id,source_id,source_resource_type,source_resource_id;references:user_id,source_id,source_resource_type,source_resource_id;"`
 }
@@ -37,3 +41,19 @@ func (s *ResourceBase) SetResourceRaw(resourceRaw datatypes.JSON) {
 func (s *ResourceBase) SetSourceUri(sourceUri *string) {
 	s.SourceUri = sourceUri
 }
+
+func (s *ResourceBase) GetResourceRaw() datatypes.JSON {
+	return s.ResourceRaw
+}
+
+func (s *ResourceBase) GetSortTitle() *string {
+	return s.SortTitle
+}
+
+func (s *ResourceBase) GetSortDate() *time.Time {
+	return s.SortDate
+}
+
+func (s *ResourceBase) GetUpdatedAt() time.Time {
+	return s.UpdatedAt
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/datatypes"
+)
+
+// ResourceHistory is a version of a FHIR resource. When a resource is updated with different content (eg. during a sync)
+// the replaced version is stored in the resource_history table, the current version is always stored in the resource table.
+// Version ids start at 1 and are incremented each time the resource changes.
+type ResourceHistory struct {
+	ModelBase
+	UserID             uuid.UUID `json:"user_id" gorm:"not null;index:idx_resource_history_resource,priority:1"`
+	SourceID           uuid.UUID `json:"source_id" gorm:"not null;index:idx_resource_history_resource,priority:2"`
+	SourceResourceType string    `json:"source_resource_type" gorm:"not null;index:idx_resource_history_resource,priority:3"`
+	SourceResourceID   string    `json:"source_resource_id" gorm:"not null;index:idx_resource_history_resource,priority:4"`
+
+	VersionID int `json:"version_id" gorm:"not null"`
+	//when this version was stored (CreatedAt is when it was replaced by the next version)
+	VersionTime time.Time `json:"version_time"`
+
+	SortDate  *time.Time `json:"sort_date"`
+	SortTitle *string    `json:"sort_title"`
+
+	// The raw resource content in JSON format
+	ResourceRaw datatypes.JSON `gorm:"column:resource_raw;type:text;serializer:json" json:"resource_raw,omitempty"`
+}
+
+func (ResourceHistory) TableName() string {
+	return "resource_history"
+}
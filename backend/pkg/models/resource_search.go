@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ResourceSearchQueryOptions struct {
+	//free text entered by the user, eg. `metformin`
+	Query string
+	//optional, only return hits for these resource types
+	SourceResourceTypes []string
+
+	Limit int
+}
+
+// ResourceSearchResult is a single (ranked) full-text search hit, see DatabaseRepository.SearchResources
+type ResourceSearchResult struct {
+	SourceID           uuid.UUID  `json:"source_id"`
+	SourceResourceType string     `json:"source_resource_type"`
+	SourceResourceID   string     `json:"source_resource_id"`
+	SortDate           *time.Time `json:"sort_date"`
+	SortTitle          *string    `json:"sort_title"`
+
+	//excerpt of the indexed content containing the matching terms
+	Snippet string `json:"snippet"`
+	//higher is more relevant
+	Rank float64 `json:"rank"`
+}
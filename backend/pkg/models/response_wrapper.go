@@ -4,4 +4,8 @@ type ResponseWrapper struct {
 	Success bool        `json:"success"`
 	Error   string      `json:"error"`
 	Data    interface{} `json:"data"`
+
+	//pagination, only returned by list & query endpoints
+	Total *int64 `json:"total,omitempty"`
+	Next  string `json:"next,omitempty"`
 }
@@ -138,6 +138,24 @@ func (s *SourceCredential) IsDynamicClient() bool {
 	return len(s.DynamicClientRegistrationMode) > 0
 }
 
+// CredentialsExpired returns true if the source can no longer be synced without the user reconnecting it, ie. the access token
+// has expired, and it cannot be refreshed (because there's no refresh token, or the refresh token has expired).
+// Refresh tokens are usually opaque, their expiration is only known if they are JWTs with an `exp` claim.
+func (s *SourceCredential) CredentialsExpired(now time.Time) bool {
+	if s.IsDynamicClient() {
+		//dynamic clients can always request a new access token
+		return false
+	}
+	if len(s.RefreshToken) > 0 {
+		refreshToken, err := jwt.ParseInsecure([]byte(s.RefreshToken))
+		if err != nil || refreshToken.Expiration().IsZero() {
+			return false
+		}
+		return refreshToken.Expiration().Before(now)
+	}
+	return s.ExpiresAt > 0 && time.Unix(s.ExpiresAt, 0).Before(now)
+}
+
 // This method will generate a new keypair, register a new dynamic client with the provider
 // it will set the following fields:
 // - DynamicClientJWKS
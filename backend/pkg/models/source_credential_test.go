@@ -2,8 +2,11 @@ package models
 
 import (
 	sourceModels "github.com/fastenhealth/fasten-sources/clients/models"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func TestSourceCredentialInterface(t *testing.T) {
@@ -14,3 +17,37 @@ func TestSourceCredentialInterface(t *testing.T) {
 	//assert
 	require.Implements(t, (*sourceModels.SourceCredential)(nil), sourceCred, "should implement the SourceCredential interface from fasten-sources")
 }
+
+func TestSourceCredential_CredentialsExpired(t *testing.T) {
+	t.Parallel()
+
+	//setup
+	now := time.Now()
+	signedRefreshToken := func(expiration time.Time) string {
+		token := jwt.New()
+		token.Set(jwt.ExpirationKey, expiration.Unix())
+		signed, err := jwt.Sign(token, jwt.WithKey(jwa.HS256, []byte("test-secret")))
+		require.NoError(t, err)
+		return string(signed)
+	}
+	var testCases = []struct {
+		name       string
+		sourceCred SourceCredential
+		expected   bool
+	}{
+		{"valid access token", SourceCredential{AccessToken: "access", ExpiresAt: now.Add(time.Hour).Unix()}, false},
+		{"expired access token, without refresh token", SourceCredential{AccessToken: "access", ExpiresAt: now.Add(-time.Hour).Unix()}, true},
+		{"expired access token, with opaque refresh token", SourceCredential{AccessToken: "access", RefreshToken: "refresh", ExpiresAt: now.Add(-time.Hour).Unix()}, false},
+		{"expired access token, with valid refresh token", SourceCredential{AccessToken: "access", RefreshToken: signedRefreshToken(now.Add(time.Hour)), ExpiresAt: now.Add(-time.Hour).Unix()}, false},
+		{"expired refresh token", SourceCredential{AccessToken: "access", RefreshToken: signedRefreshToken(now.Add(-time.Hour)), ExpiresAt: now.Add(-time.Hour).Unix()}, true},
+		{"expired access token, dynamic client", SourceCredential{AccessToken: "access", DynamicClientRegistrationMode: "user-authenticated", ExpiresAt: now.Add(-time.Hour).Unix()}, false},
+	}
+
+	for _, tc := range testCases {
+		//test
+		expired := tc.sourceCred.CredentialsExpired(now)
+
+		//assert
+		require.Equal(t, tc.expected, expired, tc.name)
+	}
+}
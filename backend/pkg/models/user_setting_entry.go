@@ -2,6 +2,7 @@ package models
 
 import (
 	"github.com/google/uuid"
+	"gorm.io/datatypes"
 )
 
 // SettingEntry matches a setting row in the database
@@ -15,10 +16,11 @@ type UserSettingEntry struct {
 	SettingKeyDescription string `json:"setting_key_description"`
 	SettingDataType       string `json:"setting_data_type"`
 
-	SettingValueNumeric int      `json:"setting_value_numeric"`
-	SettingValueString  string   `json:"setting_value_string"`
-	SettingValueBool    bool     `json:"setting_value_bool"`
-	SettingValueArray   []string `json:"setting_value_array" gorm:"column:setting_value_array;type:text;serializer:json"`
+	SettingValueNumeric int            `json:"setting_value_numeric"`
+	SettingValueString  string         `json:"setting_value_string"`
+	SettingValueBool    bool           `json:"setting_value_bool"`
+	SettingValueArray   []string       `json:"setting_value_array" gorm:"column:setting_value_array;type:text;serializer:json"`
+	SettingValueJson    datatypes.JSON `json:"setting_value_json,omitempty" gorm:"column:setting_value_json;type:text"` //settings with a complex structure, eg. csv_import_templates
 }
 
 func (s UserSettingEntry) TableName() string {
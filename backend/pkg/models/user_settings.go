@@ -1,11 +1,13 @@
 package models
 
 import (
+	"encoding/json"
 	"reflect"
 )
 
 type UserSettings struct {
-	DashboardLocations []string `json:"dashboard_locations"`
+	DashboardLocations []string           `json:"dashboard_locations"`
+	CsvImportTemplates []CsvImportMapping `json:"csv_import_templates"`
 }
 
 // see https://gist.github.com/lelandbatey/a5c957b537bed39d1d6fb202c3b8de06
@@ -26,6 +28,10 @@ func (s *UserSettings) FromUserSettingsEntry(entry *UserSettingEntry) error {
 				structType.Field(i).SetBool(entry.SettingValueBool)
 			} else if entry.SettingDataType == "array" {
 				structType.Field(i).Set(reflect.ValueOf(entry.SettingValueArray))
+			} else if entry.SettingDataType == "json" && len(entry.SettingValueJson) > 0 {
+				if err := json.Unmarshal(entry.SettingValueJson, structType.Field(i).Addr().Interface()); err != nil {
+					return err
+				}
 			}
 			break
 		}
@@ -62,6 +68,12 @@ func (s *UserSettings) ToUserSettingsEntry(entries []UserSettingEntry) ([]UserSe
 			sliceVal := structType.Field(fieldId).Slice(0, structType.Field(fieldId).Len())
 
 			entries[ndx].SettingValueArray = sliceVal.Interface().([]string)
+		} else if entry.SettingDataType == "json" {
+			jsonVal, err := json.Marshal(structType.Field(fieldId).Interface())
+			if err != nil {
+				return nil, err
+			}
+			entries[ndx].SettingValueJson = jsonVal
 		}
 	}
 
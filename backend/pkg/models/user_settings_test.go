@@ -54,3 +54,52 @@ func TestToUserSettingsEntry(t *testing.T) {
 		SettingValueArray: []string{"d", "e", "f"},
 	}}, updatedUserSettingsEntries)
 }
+
+func TestFromUserSettingsEntry_WithJson(t *testing.T) {
+	t.Parallel()
+
+	//setup
+	userSettings := new(UserSettings)
+	userSettingsEntry := UserSettingEntry{
+		SettingKeyName:   "csv_import_templates",
+		SettingDataType:  "json",
+		SettingValueJson: []byte(`[{"name":"Glucose log","date_column":"Date","date_format":"YYYY-MM-DD","columns":[{"column":"Glucose","code":"2339-0","unit":"mg/dL"}]}]`),
+	}
+
+	//test
+	err := userSettings.FromUserSettingsEntry(&userSettingsEntry)
+
+	//assert
+	require.NoError(t, err)
+	require.Equal(t, []CsvImportMapping{{
+		Name:       "Glucose log",
+		DateColumn: "Date",
+		DateFormat: "YYYY-MM-DD",
+		Columns:    []CsvImportColumnMapping{{Column: "Glucose", Code: "2339-0", Unit: "mg/dL"}},
+	}}, userSettings.CsvImportTemplates)
+}
+
+func TestToUserSettingsEntry_WithJson(t *testing.T) {
+	t.Parallel()
+
+	//setup
+	userSettings := new(UserSettings)
+	previousUserSettingsEntries := []UserSettingEntry{{
+		SettingKeyName:   "csv_import_templates",
+		SettingDataType:  "json",
+		SettingValueJson: []byte(`[]`),
+	}}
+
+	//test
+	userSettings.CsvImportTemplates = []CsvImportMapping{{
+		Name:       "Glucose log",
+		DateColumn: "Date",
+		DateFormat: "YYYY-MM-DD",
+		Columns:    []CsvImportColumnMapping{{Column: "Glucose", Code: "2339-0"}},
+	}}
+	updatedUserSettingsEntries, err := userSettings.ToUserSettingsEntry(previousUserSettingsEntries)
+
+	//assert
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"name":"Glucose log","date_column":"Date","date_format":"YYYY-MM-DD","columns":[{"column":"Glucose","code":"2339-0"}]}]`, string(updatedUserSettingsEntries[0].SettingValueJson))
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// JsonPatchOperation is a single operation of a JSON Patch document (https://datatracker.ietf.org/doc/html/rfc6902)
+type JsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// JsonDiff returns the JSON Patch operations which transform the `from` json document into the `to` json document.
+// Objects are compared key by key (in sorted order), arrays are compared element by element.
+func JsonDiff(from []byte, to []byte) ([]JsonPatchOperation, error) {
+	fromValue, err := jsonDiffDecode(from)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse from document: %w", err)
+	}
+	toValue, err := jsonDiffDecode(to)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse to document: %w", err)
+	}
+	return jsonDiffValues("", fromValue, toValue, []JsonPatchOperation{}), nil
+}
+
+func jsonDiffDecode(document []byte) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	//numbers must not lose precision (eg. decimal values)
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	return value, err
+}
+
+func jsonDiffValues(path string, fromValue interface{}, toValue interface{}, operations []JsonPatchOperation) []JsonPatchOperation {
+	switch typedFromValue := fromValue.(type) {
+	case map[string]interface{}:
+		if typedToValue, ok := toValue.(map[string]interface{}); ok {
+			return jsonDiffObjects(path, typedFromValue, typedToValue, operations)
+		}
+	case []interface{}:
+		if typedToValue, ok := toValue.([]interface{}); ok {
+			return jsonDiffArrays(path, typedFromValue, typedToValue, operations)
+		}
+	}
+	if !reflect.DeepEqual(fromValue, toValue) {
+		operations = append(operations, JsonPatchOperation{Op: "replace", Path: path, Value: toValue})
+	}
+	return operations
+}
+
+func jsonDiffObjects(path string, fromObject map[string]interface{}, toObject map[string]interface{}, operations []JsonPatchOperation) []JsonPatchOperation {
+	keys := []string{}
+	for key := range fromObject {
+		keys = append(keys, key)
+	}
+	for key := range toObject {
+		if _, found := fromObject[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		keyPath := path + "/" + jsonPointerEscape(key)
+		fromValue, fromFound := fromObject[key]
+		toValue, toFound := toObject[key]
+		if !toFound {
+			operations = append(operations, JsonPatchOperation{Op: "remove", Path: keyPath})
+		} else if !fromFound {
+			operations = append(operations, JsonPatchOperation{Op: "add", Path: keyPath, Value: toValue})
+		} else {
+			operations = jsonDiffValues(keyPath, fromValue, toValue, operations)
+		}
+	}
+	return operations
+}
+
+func jsonDiffArrays(path string, fromArray []interface{}, toArray []interface{}, operations []JsonPatchOperation) []JsonPatchOperation {
+	ndx := 0
+	for ; ndx < len(fromArray) && ndx < len(toArray); ndx++ {
+		operations = jsonDiffValues(fmt.Sprintf("%s/%d", path, ndx), fromArray[ndx], toArray[ndx], operations)
+	}
+	for ; ndx < len(toArray); ndx++ {
+		operations = append(operations, JsonPatchOperation{Op: "add", Path: fmt.Sprintf("%s/%d", path, ndx), Value: toArray[ndx]})
+	}
+	//elements are removed from the end of the array, so that the remaining indexes are still valid when the operations are applied in order
+	for removeNdx := len(fromArray) - 1; removeNdx >= len(toArray); removeNdx-- {
+		operations = append(operations, JsonPatchOperation{Op: "remove", Path: fmt.Sprintf("%s/%d", path, removeNdx)})
+	}
+	return operations
+}
+
+// jsonPointerEscape escapes a key for use in a JSON Pointer (https://datatracker.ietf.org/doc/html/rfc6901)
+func jsonPointerEscape(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
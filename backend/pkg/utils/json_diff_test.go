@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJsonDiff(t *testing.T) {
+	//setup
+	from := []byte(`{"resourceType":"Observation","id":"1","status":"preliminary","valueQuantity":{"value":1.10,"unit":"mmol/L"},"note":[{"text":"a"},{"text":"b"}],"a/b":1}`)
+	to := []byte(`{"resourceType":"Observation","id":"1","status":"final","valueQuantity":{"value":1.20,"unit":"mmol/L"},"note":[{"text":"a"}],"interpretation":[{"text":"high"}],"a/b":1}`)
+
+	//test
+	operations, err := JsonDiff(from, to)
+
+	//assert
+	require.NoError(t, err)
+	require.Equal(t, []JsonPatchOperation{
+		{Op: "add", Path: "/interpretation", Value: []interface{}{map[string]interface{}{"text": "high"}}},
+		{Op: "remove", Path: "/note/1"},
+		{Op: "replace", Path: "/status", Value: "final"},
+		{Op: "replace", Path: "/valueQuantity/value", Value: json.Number("1.20")},
+	}, operations)
+}
+
+func TestJsonDiff_WithIdenticalDocuments(t *testing.T) {
+	operations, err := JsonDiff([]byte(`{"id":"1","note":[1,2]}`), []byte(`{"note":[1,2],"id":"1"}`))
+	require.NoError(t, err)
+	require.Empty(t, operations)
+}
+
+func TestJsonDiff_WithArrays(t *testing.T) {
+	operations, err := JsonDiff([]byte(`{"a~b":[1,2,3,4]}`), []byte(`{"a~b":[1,5]}`))
+	require.NoError(t, err)
+	require.Equal(t, []JsonPatchOperation{
+		{Op: "replace", Path: "/a~0b/1", Value: json.Number("5")},
+		{Op: "remove", Path: "/a~0b/3"},
+		{Op: "remove", Path: "/a~0b/2"},
+	}, operations)
+}
+
+func TestJsonDiff_WithInvalidDocument(t *testing.T) {
+	_, err := JsonDiff([]byte(`{"id":"1"}`), []byte(`{"id":`))
+	require.Error(t, err)
+}
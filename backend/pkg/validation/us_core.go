@@ -0,0 +1,115 @@
+package validation
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/samber/lo"
+)
+
+const usCoreProfilePrefix = "http://hl7.org/fhir/us/core/StructureDefinition/"
+
+type profileDefinition struct {
+	ResourceType string
+	//mandatory (min cardinality of 1) top level elements, choice elements use the `[x]` suffix, eg. `effective[x]`
+	RequiredElements []string
+}
+
+// usCoreProfiles contains the mandatory elements of the US Core (v3.1.1) profiles, see https://hl7.org/fhir/us/core/STU3.1.1/profiles.html
+// Must Support elements, terminology bindings & invariants are not checked.
+var usCoreProfiles = map[string]profileDefinition{
+	usCoreProfilePrefix + "us-core-allergyintolerance":                      {"AllergyIntolerance", []string{"code", "patient"}},
+	usCoreProfilePrefix + "us-core-careplan":                                {"CarePlan", []string{"text", "status", "intent", "category", "subject"}},
+	usCoreProfilePrefix + "us-core-careteam":                                {"CareTeam", []string{"subject", "participant"}},
+	usCoreProfilePrefix + "us-core-condition":                               {"Condition", []string{"category", "code", "subject"}},
+	usCoreProfilePrefix + "us-core-diagnosticreport-lab":                    {"DiagnosticReport", []string{"status", "category", "code", "subject", "effective[x]", "issued"}},
+	usCoreProfilePrefix + "us-core-diagnosticreport-note":                   {"DiagnosticReport", []string{"status", "category", "code", "subject"}},
+	usCoreProfilePrefix + "us-core-documentreference":                       {"DocumentReference", []string{"status", "type", "category", "subject", "content"}},
+	usCoreProfilePrefix + "us-core-encounter":                               {"Encounter", []string{"status", "class", "type", "subject"}},
+	usCoreProfilePrefix + "us-core-goal":                                    {"Goal", []string{"lifecycleStatus", "description", "subject"}},
+	usCoreProfilePrefix + "us-core-immunization":                            {"Immunization", []string{"status", "vaccineCode", "patient", "occurrence[x]", "primarySource"}},
+	usCoreProfilePrefix + "us-core-implantable-device":                      {"Device", []string{"type", "patient"}},
+	usCoreProfilePrefix + "us-core-location":                                {"Location", []string{"name"}},
+	usCoreProfilePrefix + "us-core-medicationrequest":                       {"MedicationRequest", []string{"status", "intent", "medication[x]", "subject", "authoredOn", "requester"}},
+	usCoreProfilePrefix + "us-core-observation-lab":                         {"Observation", []string{"status", "category", "code", "subject"}},
+	usCoreProfilePrefix + "us-core-organization":                            {"Organization", []string{"active", "name"}},
+	usCoreProfilePrefix + "us-core-patient":                                 {"Patient", []string{"identifier", "name", "gender"}},
+	usCoreProfilePrefix + "us-core-practitioner":                            {"Practitioner", []string{"identifier", "name"}},
+	usCoreProfilePrefix + "us-core-practitionerrole":                        {"PractitionerRole", []string{"practitioner", "organization"}},
+	usCoreProfilePrefix + "us-core-procedure":                               {"Procedure", []string{"status", "code", "subject", "performed[x]"}},
+	usCoreProfilePrefix + "us-core-smokingstatus":                           {"Observation", []string{"status", "code", "subject", "issued", "valueCodeableConcept"}},
+	usCoreProfilePrefix + "us-core-pulse-oximetry":                          {"Observation", []string{"status", "category", "code", "subject", "effective[x]"}},
+	usCoreProfilePrefix + "pediatric-bmi-for-age":                           {"Observation", []string{"status", "category", "code", "subject", "effective[x]"}},
+	usCoreProfilePrefix + "pediatric-weight-for-height":                     {"Observation", []string{"status", "category", "code", "subject", "effective[x]"}},
+	usCoreProfilePrefix + "head-occipital-frontal-circumference-percentile": {"Observation", []string{"status", "category", "code", "subject", "effective[x]"}},
+}
+
+// IsSupportedProfile returns true if the profile (canonical url, optionally with a `|version` suffix) can be validated
+func IsSupportedProfile(profile string) bool {
+	_, isSupported := usCoreProfiles[strings.Split(profile, "|")[0]]
+	return isSupported
+}
+
+// validateProfiles checks the resource against the requested profiles (see Options.Profiles) which apply to this resource
+// type, and against every profile the resource claims to conform to (`meta.profile`)
+func (v *resourceValidator) validateProfiles(path string, resourceType string, resource map[string]interface{}) {
+	profiles := lo.Filter(v.options.Profiles, func(profile string, _ int) bool {
+		profileDefinition, isSupported := usCoreProfiles[strings.Split(profile, "|")[0]]
+		return isSupported && profileDefinition.ResourceType == resourceType
+	})
+	if meta, hasMeta := resource["meta"].(map[string]interface{}); hasMeta {
+		metaProfiles, _ := meta["profile"].([]interface{})
+		for _, metaProfile := range metaProfiles {
+			if profile, isString := metaProfile.(string); isString {
+				if !IsSupportedProfile(profile) {
+					v.addIssue(fhir401.IssueSeverityInformation, fhir401.IssueTypeNotSupported, path+".meta.profile", fmt.Sprintf("profile is not supported, only the base R4 structure was validated: %s", profile))
+					continue
+				}
+				profiles = append(profiles, profile)
+			}
+		}
+	}
+
+	for _, profile := range lo.Uniq(profiles) {
+		profileDefinition := usCoreProfiles[strings.Split(profile, "|")[0]]
+		if profileDefinition.ResourceType != resourceType {
+			v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeInvalid, path, fmt.Sprintf("profile %s does not apply to %s resources", profile, resourceType))
+			continue
+		}
+		for _, requiredElement := range profileDefinition.RequiredElements {
+			if !hasProfileElement(resource, requiredElement) {
+				v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeRequired, path+"."+requiredElement, fmt.Sprintf("missing element required by profile %s: %s", profile, requiredElement))
+			}
+		}
+	}
+}
+
+// hasProfileElement checks if a (non empty) element is present, choice elements (eg. `effective[x]`) match any type (eg. `effectiveDateTime`)
+func hasProfileElement(resource map[string]interface{}, element string) bool {
+	if choicePrefix := strings.TrimSuffix(element, "[x]"); choicePrefix != element {
+		for key, value := range resource {
+			if strings.HasPrefix(key, choicePrefix) && len(key) > len(choicePrefix) && unicode.IsUpper(rune(key[len(choicePrefix)])) && !isEmptyElement(value) {
+				return true
+			}
+		}
+		return false
+	}
+	value, found := resource[element]
+	return found && !isEmptyElement(value)
+}
+
+func isEmptyElement(value interface{}) bool {
+	switch typedValue := value.(type) {
+	case nil:
+		return true
+	case []interface{}:
+		return len(typedValue) == 0
+	case map[string]interface{}:
+		return len(typedValue) == 0
+	case string:
+		return len(typedValue) == 0
+	}
+	return false
+}
@@ -0,0 +1,463 @@
+package validation
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	fhirutils "github.com/fastenhealth/gofhir-models/fhir401/utils"
+	"github.com/samber/lo"
+)
+
+// Options configures the checks which are applied in addition to the base R4 structure & cardinality
+type Options struct {
+	//canonical urls of the profiles every resource (of the matching type) must conform to, eg. `http://hl7.org/fhir/us/core/StructureDefinition/us-core-patient`
+	//profiles listed in a resource's `meta.profile` are always checked.
+	Profiles []string
+	//optional, the (root) resource must be of this type, eg. when validating `POST /Observation/$validate`
+	ResourceType string
+}
+
+// ValidateResource checks a FHIR R4 resource (or a Bundle, including every entry resource) against the structure & cardinality
+// defined by the gofhir-models structs, and returns an OperationOutcome listing every issue found.
+// Issue locations are FHIRPath expressions, eg. `Bundle.entry[2].resource.status`
+func ValidateResource(resourceRaw []byte, options Options) fhir401.OperationOutcome {
+	validator := newResourceValidator(options)
+	validator.validateJson(resourceRaw)
+	return NewOperationOutcome(validator.issues)
+}
+
+// ValidateDocument checks a file uploaded for a manual import, which may contain a single resource/Bundle or NDJSON (1 resource per line).
+// Issues found in NDJSON documents have a location identifying the line, eg. `Line[3]`.
+// Other documents (eg. C-CDA) are not validated.
+// The document is streamed, Bundle entries and NDJSON lines are validated one at a time, so that large documents never need
+// to be loaded into memory.
+func ValidateDocument(document io.Reader, options Options) (fhir401.OperationOutcome, error) {
+	documentReader := bufio.NewReaderSize(document, ndjsonDetectionSize)
+
+	validator := newResourceValidator(options)
+	firstByte, err := skipWhitespace(documentReader)
+	if err == io.EOF {
+		validator.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeRequired, "", "document is empty")
+	} else if err != nil {
+		return fhir401.OperationOutcome{}, err
+	} else if firstByte != '{' {
+		validator.addIssue(fhir401.IssueSeverityInformation, fhir401.IssueTypeNotSupported, "", "document is not a FHIR json document, validation skipped")
+	} else if isNdjson, err := detectNdjson(documentReader); err != nil {
+		return fhir401.OperationOutcome{}, err
+	} else if isNdjson {
+		if err := validator.validateNdjsonStream(documentReader); err != nil {
+			return fhir401.OperationOutcome{}, err
+		}
+	} else if err := validator.validateJsonStream(documentReader); err != nil {
+		return fhir401.OperationOutcome{}, err
+	}
+	return NewOperationOutcome(validator.issues), nil
+}
+
+// ndjsonDetectionSize is the maximum length of the first line of a document, when detecting whether it is NDJSON
+const ndjsonDetectionSize = 1024 * 1024
+
+// ndjsonMaxLineSize is the maximum length of each line (resource) in an NDJSON document
+const ndjsonMaxLineSize = 64 * 1024 * 1024
+
+// skipWhitespace discards leading whitespace, and returns the first non-whitespace byte (without consuming it)
+func skipWhitespace(documentReader *bufio.Reader) (byte, error) {
+	for {
+		nextBytes, err := documentReader.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(nextBytes[0])) {
+			return nextBytes[0], nil
+		}
+		documentReader.Discard(1)
+	}
+}
+
+// detectNdjson peeks at the start of the document, which is NDJSON if the first line is a complete json value followed by
+// more content. Documents with a first line longer than ndjsonDetectionSize are never NDJSON.
+func detectNdjson(documentReader *bufio.Reader) (bool, error) {
+	peekedBytes, err := documentReader.Peek(ndjsonDetectionSize)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	lineEnd := bytes.IndexByte(peekedBytes, '\n')
+	if lineEnd == -1 {
+		return false, nil
+	}
+	return json.Valid(peekedBytes[:lineEnd]) && len(bytes.TrimSpace(peekedBytes[lineEnd:])) > 0, nil
+}
+
+// validateNdjsonStream validates each (non-empty) line of an NDJSON document as a resource
+func (v *resourceValidator) validateNdjsonStream(documentReader io.Reader) error {
+	scanner := bufio.NewScanner(documentReader)
+	scanner.Buffer(make([]byte, 64*1024), ndjsonMaxLineSize)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		v.location = fmt.Sprintf("Line[%d]", lineNumber)
+		v.validateJson(scanner.Bytes())
+	}
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		v.location = fmt.Sprintf("Line[%d]", lineNumber+1)
+		v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeTooLong, "", fmt.Sprintf("line is longer than the maximum of %d bytes", ndjsonMaxLineSize))
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateJsonStream validates a single resource, the entries of a Bundle are decoded and validated one at a time.
+// Issues are reported in the same order as ValidateResource, the Bundle itself first, followed by its entries.
+func (v *resourceValidator) validateJsonStream(documentReader io.Reader) error {
+	decoder := json.NewDecoder(documentReader)
+	//numbers must be kept as json.Number, so that integers & decimals can be distinguished
+	decoder.UseNumber()
+
+	if _, err := decoder.Token(); err != nil {
+		return v.addJsonStreamIssue(err)
+	}
+	resource := map[string]interface{}{}
+	firstEntryIssue := len(v.issues)
+	for decoder.More() {
+		keyToken, err := decoder.Token()
+		if err != nil {
+			return v.addJsonStreamIssue(err)
+		}
+		key, _ := keyToken.(string)
+		if key != "entry" || resource["resourceType"] != "Bundle" {
+			var value interface{}
+			if err := decoder.Decode(&value); err != nil {
+				return v.addJsonStreamIssue(err)
+			}
+			resource[key] = value
+			continue
+		}
+
+		if arrayToken, err := decoder.Token(); err != nil {
+			return v.addJsonStreamIssue(err)
+		} else if arrayToken != json.Delim('[') {
+			//not an array, the invalid value is reported when the Bundle is validated
+			resource[key] = arrayToken
+			if arrayToken == json.Delim('{') {
+				resource[key] = map[string]interface{}{}
+				if err := skipJsonObject(decoder); err != nil {
+					return v.addJsonStreamIssue(err)
+				}
+			}
+			continue
+		}
+		for entryNdx := 0; decoder.More(); entryNdx++ {
+			var entry interface{}
+			if err := decoder.Decode(&entry); err != nil {
+				return v.addJsonStreamIssue(err)
+			}
+			v.validateValue(fmt.Sprintf("Bundle.entry[%d]", entryNdx), entry, bundleEntryType)
+		}
+		if _, err := decoder.Token(); err != nil {
+			return v.addJsonStreamIssue(err)
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return v.addJsonStreamIssue(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeStructure, "", "invalid json: unexpected content after the resource")
+		return nil
+	}
+
+	entryIssues := append([]fhir401.OperationOutcomeIssue{}, v.issues[firstEntryIssue:]...)
+	v.issues = v.issues[:firstEntryIssue]
+	v.validateResource("", resource)
+	v.issues = append(v.issues, entryIssues...)
+	return nil
+}
+
+var bundleEntryType = reflect.TypeOf(fhir401.BundleEntry{})
+
+// addJsonStreamIssue reports an invalid json document, errors while reading the document are returned
+func (v *resourceValidator) addJsonStreamIssue(err error) error {
+	var syntaxError *json.SyntaxError
+	if errors.As(err, &syntaxError) || err == io.EOF || err == io.ErrUnexpectedEOF {
+		v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeStructure, "", fmt.Sprintf("invalid json: %v", err))
+		return nil
+	}
+	return err
+}
+
+// skipJsonObject discards the remaining tokens of a json object, after its opening `{` has been read
+func skipJsonObject(decoder *json.Decoder) error {
+	for depth := 1; depth > 0; {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+	return nil
+}
+
+// NewOperationOutcome wraps a list of issues, an OperationOutcome must contain at least 1 issue, so an informational issue
+// is added when the list is empty
+func NewOperationOutcome(issues []fhir401.OperationOutcomeIssue) fhir401.OperationOutcome {
+	if len(issues) == 0 {
+		diagnostics := "validation successful, no issues found"
+		issues = append(issues, fhir401.OperationOutcomeIssue{
+			Severity:    fhir401.IssueSeverityInformation,
+			Code:        fhir401.IssueTypeInformational,
+			Diagnostics: &diagnostics,
+		})
+	}
+	return fhir401.OperationOutcome{Issue: issues}
+}
+
+// HasErrors returns true if the OperationOutcome contains a fatal or error issue (warnings and information are ignored)
+func HasErrors(operationOutcome fhir401.OperationOutcome) bool {
+	for _, issue := range operationOutcome.Issue {
+		if issue.Severity == fhir401.IssueSeverityFatal || issue.Severity == fhir401.IssueSeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+type resourceValidator struct {
+	options Options
+	issues  []fhir401.OperationOutcomeIssue
+	//optional, location of the document being validated (eg. NDJSON line)
+	location string
+}
+
+func newResourceValidator(options Options) *resourceValidator {
+	validator := &resourceValidator{options: options, issues: []fhir401.OperationOutcomeIssue{}}
+	for _, profile := range options.Profiles {
+		if !IsSupportedProfile(profile) {
+			validator.addIssue(fhir401.IssueSeverityWarning, fhir401.IssueTypeNotSupported, "", fmt.Sprintf("profile is not supported, only the base R4 structure was validated: %s", profile))
+		}
+	}
+	return validator
+}
+
+func (v *resourceValidator) validateJson(resourceRaw []byte) {
+	resource, err := decodeJson(resourceRaw)
+	if err != nil {
+		v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeStructure, "", fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	v.validateResource("", resource)
+}
+
+func (v *resourceValidator) addIssue(severity fhir401.IssueSeverity, issueType fhir401.IssueType, expression string, diagnostics string) {
+	issue := fhir401.OperationOutcomeIssue{
+		Severity:    severity,
+		Code:        issueType,
+		Diagnostics: &diagnostics,
+	}
+	if len(expression) > 0 {
+		issue.Expression = []string{expression}
+	}
+	if len(v.location) > 0 {
+		issue.Location = []string{v.location}
+	}
+	v.issues = append(v.issues, issue)
+}
+
+// validateResource validates a (possibly nested) resource, `path` is the location of the resource, and is empty for the root resource
+func (v *resourceValidator) validateResource(path string, value interface{}) {
+	resource, isObject := value.(map[string]interface{})
+	if !isObject {
+		v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeStructure, path, "resource must be a json object")
+		return
+	}
+	resourceType, isString := resource["resourceType"].(string)
+	if !isString || len(resourceType) == 0 {
+		v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeRequired, path, "resource is missing resourceType")
+		return
+	}
+
+	//an empty resource of the correct type is used to determine the expected structure
+	emptyResource, err := fhirutils.MapToResource(json.RawMessage(fmt.Sprintf(`{"resourceType":%q}`, resourceType)), false)
+	if err != nil {
+		v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeNotSupported, path, fmt.Sprintf("unknown resourceType: %s", resourceType))
+		return
+	}
+	if len(path) == 0 {
+		if len(v.options.ResourceType) > 0 && v.options.ResourceType != resourceType {
+			v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeInvalid, resourceType, fmt.Sprintf("resourceType (%s) does not match the expected resource type (%s)", resourceType, v.options.ResourceType))
+		}
+		path = resourceType
+	}
+	//nested resources (Bundle entries & contained resources) are validated as the structure is traversed
+	v.validateObject(path, resource, reflect.TypeOf(emptyResource), true)
+	v.validateProfiles(path, resourceType, resource)
+}
+
+// validateObject checks the elements of a json object against the fields of a gofhir-models struct:
+// - every field without `omitempty` is required (min cardinality of 1)
+// - slices must be json arrays, every other field must not be an array (max cardinality of 1)
+// - unknown elements are reported as warnings, since they are ignored when the resource is stored
+func (v *resourceValidator) validateObject(path string, object map[string]interface{}, structType reflect.Type, isResource bool) {
+	fields := map[string]reflect.StructField{}
+	//required elements, grouped by element name (without the type suffix of choice elements)
+	requiredElements := map[string][]string{}
+	requiredElementNames := []string{}
+	for ndx := 0; ndx < structType.NumField(); ndx++ {
+		field := structType.Field(ndx)
+		jsonTagParts := strings.Split(field.Tag.Get("json"), ",")
+		if len(jsonTagParts[0]) == 0 || jsonTagParts[0] == "-" {
+			continue
+		}
+		fields[jsonTagParts[0]] = field
+
+		if !lo.Contains(jsonTagParts[1:], "omitempty") {
+			elementName := choiceElementName(jsonTagParts[0])
+			if _, found := requiredElements[elementName]; !found {
+				requiredElementNames = append(requiredElementNames, elementName)
+			}
+			requiredElements[elementName] = append(requiredElements[elementName], jsonTagParts[0])
+		}
+	}
+
+	for _, elementName := range requiredElementNames {
+		jsonNames := requiredElements[elementName]
+		found := lo.ContainsBy(jsonNames, func(jsonName string) bool {
+			_, found := object[jsonName]
+			_, foundPrimitiveExtension := object["_"+jsonName]
+			return found || foundPrimitiveExtension
+		})
+		if found {
+			continue
+		}
+		if len(jsonNames) > 1 {
+			//required choice elements are generated as multiple required fields, only 1 of the types must be present
+			v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeRequired, path+"."+elementName, fmt.Sprintf("missing required element: %s[x]", elementName))
+		} else {
+			v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeRequired, path+"."+jsonNames[0], fmt.Sprintf("missing required element: %s", jsonNames[0]))
+		}
+	}
+
+	keys := lo.Keys(object)
+	sort.Strings(keys)
+	for _, key := range keys {
+		if isResource && key == "resourceType" {
+			continue
+		}
+		field, isKnown := fields[key]
+		if !isKnown {
+			//primitive extensions (eg. `_birthDate`) are allowed for every known element
+			if _, isKnownPrimitive := fields[strings.TrimPrefix(key, "_")]; strings.HasPrefix(key, "_") && isKnownPrimitive {
+				continue
+			}
+			v.addIssue(fhir401.IssueSeverityWarning, fhir401.IssueTypeStructure, path+"."+key, fmt.Sprintf("unknown element: %s", key))
+			continue
+		}
+		v.validateValue(path+"."+key, object[key], field.Type)
+	}
+}
+
+var (
+	jsonRawMessageType = reflect.TypeOf(json.RawMessage{})
+	jsonNumberType     = reflect.TypeOf(json.Number(""))
+	jsonUnmarshalType  = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+func (v *resourceValidator) validateValue(path string, value interface{}, valueType reflect.Type) {
+	if value == nil {
+		v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeStructure, path, "null values are not allowed")
+		return
+	}
+	if valueType.Kind() == reflect.Pointer {
+		valueType = valueType.Elem()
+	}
+
+	switch {
+	case valueType == jsonRawMessageType:
+		//contained resources
+		v.validateResource(path, value)
+	case valueType.Kind() == reflect.Slice:
+		values, isArray := value.([]interface{})
+		if !isArray {
+			v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeStructure, path, "element must be an array")
+			return
+		}
+		for ndx, itemValue := range values {
+			if itemValue == nil && valueType.Elem().Kind() != reflect.Struct {
+				//primitive arrays may contain nulls, when the matching primitive extension array (eg. `_given`) has a value
+				continue
+			}
+			v.validateValue(fmt.Sprintf("%s[%d]", path, ndx), itemValue, valueType.Elem())
+		}
+	case valueType.Kind() == reflect.Struct:
+		object, isObject := value.(map[string]interface{})
+		if !isObject {
+			v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeStructure, path, "element must be a json object")
+			return
+		}
+		v.validateObject(path, object, valueType, false)
+	case reflect.PointerTo(valueType).Implements(jsonUnmarshalType):
+		//coded values, the generated UnmarshalJSON rejects codes which are not part of the (required) value set
+		code, isString := value.(string)
+		if !isString {
+			v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeStructure, path, "code must be a string")
+			return
+		}
+		codeJson, _ := json.Marshal(code)
+		if err := reflect.New(valueType).Interface().(json.Unmarshaler).UnmarshalJSON(codeJson); err != nil {
+			v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeCodeInvalid, path, err.Error())
+		}
+	case valueType == jsonNumberType:
+		if _, isNumber := value.(json.Number); !isNumber {
+			v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeStructure, path, "element must be a number")
+		}
+	case valueType.Kind() == reflect.String:
+		if _, isString := value.(string); !isString {
+			v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeStructure, path, "element must be a string")
+		}
+	case valueType.Kind() == reflect.Bool:
+		if _, isBool := value.(bool); !isBool {
+			v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeStructure, path, "element must be a boolean")
+		}
+	case valueType.Kind() >= reflect.Int && valueType.Kind() <= reflect.Uint64:
+		number, isNumber := value.(json.Number)
+		if _, err := number.Int64(); !isNumber || err != nil {
+			v.addIssue(fhir401.IssueSeverityError, fhir401.IssueTypeStructure, path, "element must be an integer")
+		}
+	}
+}
+
+// choiceElementName returns the element name of a choice element, eg. `occurrence` for `occurrenceDateTime`.
+// Other elements are returned unchanged.
+func choiceElementName(jsonName string) string {
+	for ndx, char := range jsonName {
+		if unicode.IsUpper(char) {
+			return jsonName[:ndx]
+		}
+	}
+	return jsonName
+}
+
+func decodeJson(document []byte) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	//numbers must be kept as json.Number, so that integers & decimals can be distinguished
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	return value, err
+}
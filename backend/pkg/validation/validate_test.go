@@ -0,0 +1,173 @@
+package validation
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/stretchr/testify/require"
+)
+
+// issueSummaries returns a `<severity> <expression>` string for every issue, so that test assertions are readable
+func issueSummaries(operationOutcome fhir401.OperationOutcome) []string {
+	summaries := []string{}
+	for _, issue := range operationOutcome.Issue {
+		summary := issue.Severity.Code() + " " + strings.Join(issue.Expression, ",")
+		if len(issue.Location) > 0 {
+			summary += " @" + strings.Join(issue.Location, ",")
+		}
+		summaries = append(summaries, strings.TrimSpace(summary))
+	}
+	return summaries
+}
+
+func TestValidateResource(t *testing.T) {
+	operationOutcome := ValidateResource([]byte(`{
+		"resourceType": "Observation",
+		"id": "1",
+		"status": "final",
+		"code": {"coding": [{"system": "http://loinc.org", "code": "8480-6"}]},
+		"effectiveDateTime": "2023-02-01",
+		"_effectiveDateTime": {"extension": [{"url": "http://example.com/precision", "valueCode": "day"}]},
+		"valueQuantity": {"value": 120.5, "unit": "mmHg"}
+	}`), Options{})
+
+	require.False(t, HasErrors(operationOutcome))
+	require.Equal(t, []string{"information"}, issueSummaries(operationOutcome))
+}
+
+func TestValidateResource_WithInvalidResource(t *testing.T) {
+	operationOutcome := ValidateResource([]byte(`{
+		"resourceType": "Observation",
+		"status": "invalid-status",
+		"category": {"text": "not an array"},
+		"valueQuantity": {"value": "120", "unit": "mmHg"},
+		"unknownElement": true
+	}`), Options{})
+
+	require.True(t, HasErrors(operationOutcome))
+	require.Equal(t, []string{
+		"error Observation.code",
+		"error Observation.category",
+		"error Observation.status",
+		"warning Observation.unknownElement",
+		"error Observation.valueQuantity.value",
+	}, issueSummaries(operationOutcome))
+}
+
+func TestValidateResource_WithRequiredChoiceElement(t *testing.T) {
+	operationOutcome := ValidateResource([]byte(`{"resourceType":"Immunization","status":"completed","vaccineCode":{"text":"flu"},"patient":{"reference":"Patient/1"}}`), Options{})
+	require.Equal(t, []string{"error Immunization.occurrence"}, issueSummaries(operationOutcome))
+
+	operationOutcome = ValidateResource([]byte(`{"resourceType":"Immunization","status":"completed","vaccineCode":{"text":"flu"},"patient":{"reference":"Patient/1"},"occurrenceString":"2020"}`), Options{})
+	require.False(t, HasErrors(operationOutcome))
+}
+
+func TestValidateResource_WithBundle(t *testing.T) {
+	operationOutcome := ValidateResource([]byte(`{
+		"resourceType": "Bundle",
+		"type": "collection",
+		"entry": [
+			{"resource": {"resourceType": "Patient", "id": "1", "name": [{"given": ["John", null], "_given": [null, {"extension": [{"url": "http://example.com", "valueString": "J"}]}]}]}},
+			{"resource": {"resourceType": "Condition", "id": "2", "contained": [{"resourceType": "Unknown"}]}},
+			{"resource": {"resourceType": "Encounter", "id": "3", "status": "finished"}}
+		]
+	}`), Options{ResourceType: "Bundle"})
+
+	require.Equal(t, []string{
+		"error Bundle.entry[1].resource.subject",
+		"error Bundle.entry[1].resource.contained[0]",
+		"error Bundle.entry[2].resource.class",
+	}, issueSummaries(operationOutcome))
+}
+
+func TestValidateResource_WithInvalidJson(t *testing.T) {
+	require.Equal(t, []string{"error"}, issueSummaries(ValidateResource([]byte(`{"resourceType":`), Options{})))
+	require.Equal(t, []string{"error"}, issueSummaries(ValidateResource([]byte(`{"id":"1"}`), Options{})))
+	require.Equal(t, []string{"error Patient"}, issueSummaries(ValidateResource([]byte(`{"resourceType":"Patient"}`), Options{ResourceType: "Observation"})))
+}
+
+func TestValidateResource_WithProfiles(t *testing.T) {
+	//requested profile
+	operationOutcome := ValidateResource([]byte(`{"resourceType":"Patient","gender":"female"}`), Options{
+		Profiles: []string{"http://hl7.org/fhir/us/core/StructureDefinition/us-core-patient|3.1.1", "http://hl7.org/fhir/us/core/StructureDefinition/us-core-condition"},
+	})
+	require.Equal(t, []string{"error Patient.identifier", "error Patient.name"}, issueSummaries(operationOutcome))
+
+	//profile claimed by the resource (meta.profile)
+	operationOutcome = ValidateResource([]byte(`{
+		"resourceType": "Observation",
+		"meta": {"profile": ["http://hl7.org/fhir/us/core/StructureDefinition/us-core-observation-lab", "http://example.com/unknown-profile"]},
+		"status": "final",
+		"code": {"text": "glucose"},
+		"subject": {"reference": "Patient/1"}
+	}`), Options{})
+	require.Equal(t, []string{"information Observation.meta.profile", "error Observation.category"}, issueSummaries(operationOutcome))
+
+	//unsupported requested profile
+	operationOutcome = ValidateResource([]byte(`{"resourceType":"Patient"}`), Options{Profiles: []string{"http://example.com/unknown-profile"}})
+	require.Equal(t, []string{"warning"}, issueSummaries(operationOutcome))
+}
+
+func TestValidateDocument_WithNDJSON(t *testing.T) {
+	operationOutcome, err := ValidateDocument(strings.NewReader(`{"resourceType":"Patient","id":"1"}
+{"resourceType":"Observation","id":"2","status":"final"}
+
+{"resourceType":"Observation","id":"3","status":"final","code":{"text":"glucose"}}
+`), Options{})
+
+	require.NoError(t, err)
+	require.Equal(t, []string{"error Observation.code @Line[2]"}, issueSummaries(operationOutcome))
+}
+
+func TestValidateDocument_WithBundle(t *testing.T) {
+	operationOutcome, err := ValidateDocument(strings.NewReader(`
+	{
+		"resourceType": "Bundle",
+		"entry": [
+			{"resource": {"resourceType": "Patient", "id": "1"}},
+			{"resource": {"resourceType": "Encounter", "id": "3", "status": "finished"}},
+			{"resource": {"resourceType": "Observation", "id": "2", "status": "final", "code": {"text": "glucose"}}},
+			null
+		],
+		"unknownElement": true
+	}`), Options{})
+
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"error Bundle.type",
+		"warning Bundle.unknownElement",
+		"error Bundle.entry[1].resource.class",
+		"error Bundle.entry[3]",
+	}, issueSummaries(operationOutcome))
+}
+
+func TestValidateDocument_WithInvalidJson(t *testing.T) {
+	for _, document := range []string{
+		`{"resourceType":"Bundle","type":"collection","entry":[{"resource":{"resourceType":"Patient"}}`,
+		`{"resourceType":"Patient","id":"1"} {"resourceType":"Patient","id":"2"}`,
+		"{\"resourceType\":\"Patient\",\n\"id\":\"1\"}\n}",
+	} {
+		operationOutcome, err := ValidateDocument(strings.NewReader(document), Options{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"error"}, issueSummaries(operationOutcome), "Expected an invalid json issue for %s", document)
+	}
+}
+
+func TestValidateDocument_WithReadError(t *testing.T) {
+	_, err := ValidateDocument(io.MultiReader(strings.NewReader(`{"resourceType":"Bundle","entry":[`), iotest.ErrReader(errors.New("read error"))), Options{})
+	require.EqualError(t, err, "read error")
+}
+
+func TestValidateDocument_WithUnsupportedDocument(t *testing.T) {
+	operationOutcome, err := ValidateDocument(strings.NewReader(`<ClinicalDocument xmlns="urn:hl7-org:v3"></ClinicalDocument>`), Options{})
+	require.NoError(t, err)
+	require.False(t, HasErrors(operationOutcome))
+
+	operationOutcome, err = ValidateDocument(strings.NewReader("  \n"), Options{})
+	require.NoError(t, err)
+	require.True(t, HasErrors(operationOutcome))
+}
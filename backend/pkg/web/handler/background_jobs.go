@@ -6,100 +6,252 @@ import (
 	"fmt"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/job_runner"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
 	"github.com/fastenhealth/fasten-sources/clients/factory"
 	sourceModels "github.com/fastenhealth/fasten-sources/clients/models"
 	sourcePkg "github.com/fastenhealth/fasten-sources/pkg"
 	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"time"
 )
 
-// This function is used to sync resources from a source (via a callback function). The BackgroundJobSyncResourcesWrapper contains the logic for registering the background job tracking the sync.
-func BackgroundJobSyncResources(
-	parentContext context.Context,
+// BackgroundJobQueueSyncResources queues a sync job for the source, and returns immediately.
+// The job is claimed and processed by the job runner (see BackgroundJobSyncResourcesJobHandler), its progress can be tracked
+// using the job id (and the background job events published on the event bus).
+func BackgroundJobQueueSyncResources(
+	ctx context.Context,
 	logger *logrus.Entry,
 	databaseRepo database.DatabaseRepository,
 	sourceCred *models.SourceCredential,
-) (sourceModels.UpsertSummary, error) {
-	return BackgroundJobSyncResourcesWrapper(
-		parentContext,
-		logger,
-		databaseRepo,
-		sourceCred,
-		func(
-			_backgroundJobContext context.Context,
-			_logger *logrus.Entry,
-			_databaseRepo database.DatabaseRepository,
-			_sourceCred *models.SourceCredential,
-		) (sourceModels.SourceClient, sourceModels.UpsertSummary, error) {
-			// after creating the client, we should do a bulk import
-			sourceClient, err := factory.GetSourceClient(sourcePkg.GetFastenLighthouseEnv(), _sourceCred.SourceType, _backgroundJobContext, _logger, _sourceCred)
-			if err != nil {
-				resultErr := fmt.Errorf("an error occurred while initializing hub client using source credential: %w", err)
-				_logger.Errorln(resultErr)
-				return nil, sourceModels.UpsertSummary{}, resultErr
-			}
+) (*models.BackgroundJob, error) {
+	return backgroundJobQueueSyncResources(ctx, logger, databaseRepo, sourceCred, models.NewQueuedSyncBackgroundJob(*sourceCred))
+}
 
-			summary, err := sourceClient.SyncAll(_databaseRepo)
-			if err != nil {
-				resultErr := fmt.Errorf("an error occurred while bulk importing resources from source: %w", err)
-				_logger.Errorln(resultErr)
-				return sourceClient, summary, resultErr
-			}
-			return sourceClient, summary, nil
-		})
+// backgroundJobQueueSyncResources creates the queued sync job, and associates it with the source
+func backgroundJobQueueSyncResources(
+	ctx context.Context,
+	logger *logrus.Entry,
+	databaseRepo database.DatabaseRepository,
+	sourceCred *models.SourceCredential,
+	backgroundJob *models.BackgroundJob,
+) (*models.BackgroundJob, error) {
+	if backgroundJobSyncInProgress(sourceCred) {
+		logger.Errorln("Sync operation already in progress, cannot continue.")
+		return nil, fmt.Errorf("sync operation already in progress, cannot continue")
+	}
+
+	err := databaseRepo.CreateBackgroundJob(ctx, backgroundJob)
+	if err != nil {
+		resultErr := fmt.Errorf("an error occurred while creating background job: %w", err)
+		logger.Errorln(resultErr)
+		return nil, resultErr
+	}
+
+	//the source is associated with the queued job, so that it's not synced twice
+	sourceCred.LatestBackgroundJobID = &backgroundJob.ID
+	err = databaseRepo.UpdateSource(ctx, sourceCred)
+	if err != nil {
+		logger.Warn("An error occurred while registering background job id with source, ignoring", err)
+	}
+	return backgroundJob, nil
+}
+
+// BackgroundJobSyncResourcesJobHandler syncs all FHIR resources for the source of a queued sync job (see job_runner.JobHandler)
+// A source complete event is published once the sync has completed successfully.
+func BackgroundJobSyncResourcesJobHandler(
+	backgroundJobContext context.Context,
+	logger *logrus.Entry,
+	databaseRepo database.DatabaseRepository,
+	eventBus event_bus.Interface,
+	backgroundJob *models.BackgroundJob,
+) error {
+	var backgroundJobSyncData models.BackgroundJobSyncData
+	if err := json.Unmarshal(backgroundJob.Data, &backgroundJobSyncData); err != nil {
+		return fmt.Errorf("an error occurred while parsing background job data: %w", err)
+	}
+	sourceCred, err := databaseRepo.GetSource(backgroundJobContext, backgroundJobSyncData.SourceID.String())
+	if err != nil {
+		return fmt.Errorf("an error occurred while retrieving source credential: %w", err)
+	}
+
+	//jobs interrupted by a restart are resumed from their checkpoint (see DatabaseRepository.ResumeLockedBackgroundJobs)
+	callbackFn := syncAllResources
+	if len(backgroundJobSyncData.AppleHealthExportFile) > 0 {
+		//the uploaded export is kept until the import is done, interrupted imports are run again from the start
+		defer os.Remove(backgroundJobSyncData.AppleHealthExportFile)
+		callbackFn = importAppleHealthExportFile(backgroundJobSyncData.AppleHealthExportFile)
+	} else if backgroundJob.Retries > 0 && len(backgroundJobSyncData.CheckpointData) > 0 {
+		logger.Infof("Resuming interrupted sync from checkpoint (retry %d)", backgroundJob.Retries)
+		callbackFn = resumeSyncResources(backgroundJobSyncData.CheckpointData)
+	}
+
+	_, err = backgroundJobSyncResources(backgroundJobContext, logger, databaseRepo, backgroundJob, sourceCred, callbackFn)
+	if err != nil {
+		return err
+	}
+
+	err = eventBus.PublishMessage(
+		models.NewEventSourceComplete(
+			backgroundJob.UserID.String(),
+			sourceCred.ID.String(),
+		),
+	)
+	if err != nil {
+		logger.Warnf("ignoring: an error occurred while publishing sync complete event: %v", err)
+	}
+	return nil
+}
+
+// syncAllResources is the sync callback used for regular sources, it does a bulk import of all resources
+func syncAllResources(
+	_backgroundJobContext context.Context,
+	_logger *logrus.Entry,
+	_databaseRepo database.DatabaseRepository,
+	_sourceCred *models.SourceCredential,
+) (sourceModels.SourceClient, sourceModels.UpsertSummary, error) {
+	// after creating the client, we should do a bulk import
+	sourceClient, err := factory.GetSourceClient(sourcePkg.GetFastenLighthouseEnv(), _sourceCred.SourceType, _backgroundJobContext, _logger, _sourceCred)
+	if err != nil {
+		resultErr := fmt.Errorf("an error occurred while initializing hub client using source credential: %w", err)
+		_logger.Errorln(resultErr)
+		return nil, sourceModels.UpsertSummary{}, resultErr
+	}
+
+	summary, err := sourceClient.SyncAll(_databaseRepo)
+	if err != nil {
+		resultErr := fmt.Errorf("an error occurred while bulk importing resources from source: %w", err)
+		_logger.Errorln(resultErr)
+		return sourceClient, summary, resultErr
+	}
+	return sourceClient, summary, nil
+}
+
+// resumeSyncResources returns the sync callback used to resume an interrupted sync, using the checkpoint stored by the source
+// client (see DatabaseRepository.BackgroundJobCheckpoint).
+// When resources are synced by resource type, the checkpoint stage is the resource type that was being synced (resource types
+// are synced in alphabetical order, see SourceClient.SyncAllByResourceName), so the sync is resumed from that resource type.
+// Otherwise (eg. the Patient $everything bundle, or the pending resources referenced by the synced resources) there's nothing
+// to skip, and all resources are synced again.
+// NOTE: only the US Core resource types are resumed, additional resource types synced by some source clients are synced again
+// by the next sync.
+func resumeSyncResources(checkpointData map[string]interface{}) backgroundJobSyncCallback {
+	return func(
+		_backgroundJobContext context.Context,
+		_logger *logrus.Entry,
+		_databaseRepo database.DatabaseRepository,
+		_sourceCred *models.SourceCredential,
+	) (sourceModels.SourceClient, sourceModels.UpsertSummary, error) {
+		sourceClient, err := factory.GetSourceClient(sourcePkg.GetFastenLighthouseEnv(), _sourceCred.SourceType, _backgroundJobContext, _logger, _sourceCred)
+		if err != nil {
+			resultErr := fmt.Errorf("an error occurred while initializing hub client using source credential: %w", err)
+			_logger.Errorln(resultErr)
+			return nil, sourceModels.UpsertSummary{}, resultErr
+		}
+
+		var summary sourceModels.UpsertSummary
+		remainingResourceNames, resumable := resumeSyncResourceNames(sourceClient.GetUsCoreResources(), checkpointData)
+		if resumable {
+			_logger.Infof("Resuming sync from checkpoint stage %v, %d resource types remaining", checkpointData["stage"], len(remainingResourceNames))
+			summary, err = sourceClient.SyncAllByResourceName(_databaseRepo, remainingResourceNames)
+		} else {
+			_logger.Infof("Checkpoint stage %v cannot be resumed, syncing all resources", checkpointData["stage"])
+			summary, err = sourceClient.SyncAll(_databaseRepo)
+		}
+		if err != nil {
+			resultErr := fmt.Errorf("an error occurred while bulk importing resources from source: %w", err)
+			_logger.Errorln(resultErr)
+			return sourceClient, summary, resultErr
+		}
+		return sourceClient, summary, nil
+	}
+}
+
+// resumeSyncResourceNames returns the resource types (in sync order) starting with the checkpoint stage, false is returned if the
+// checkpoint stage is not one of the resource types.
+func resumeSyncResourceNames(resourceNames []string, checkpointData map[string]interface{}) ([]string, bool) {
+	stage, _ := checkpointData["stage"].(string)
+	resourceNames = lo.Uniq(resourceNames)
+	sort.Strings(resourceNames)
+	if !lo.Contains(resourceNames, stage) {
+		return nil, false
+	}
+	return lo.Filter(resourceNames, func(resourceName string, _ int) bool {
+		return resourceName >= stage
+	}), true
 }
 
 // BackgroundJobSyncResourcesWrapper is a background job that syncs all FHIR resource for a given source
-// It is a blocking function that will return only when the sync is complete or has failed
+// It is a blocking function that will return only when the sync is complete or has failed, it's used when the sync depends on
+// the request (eg. an uploaded file), other syncs should be queued using BackgroundJobQueueSyncResources.
 // It will create a background job and associate it with the source
 // It will also update the access token and refresh token if they have been updated
 // It will return the sync summary and error if any
 //
 // It's a wrapper function that takes a callback function as an argument.
 // The callback function is the actual sync operation that will be run in the background (regular source or manual source)
-//
-// TODO: run in background thread, or use https://gobyexample.com/tickers
-// TODO: use goroutine to truely run in the background (how will that work with DatabaseRepository, is that thread safe?) Mutex needed?
 func BackgroundJobSyncResourcesWrapper(
 	parentContext context.Context,
 	logger *logrus.Entry,
 	databaseRepo database.DatabaseRepository,
 	sourceCred *models.SourceCredential,
-	callbackFn func(
-		_backgroundJobContext context.Context,
-		_logger *logrus.Entry,
-		_databaseRepo database.DatabaseRepository,
-		_sourceCred *models.SourceCredential,
-	) (sourceModels.SourceClient, sourceModels.UpsertSummary, error),
+	callbackFn backgroundJobSyncCallback,
 ) (sourceModels.UpsertSummary, error) {
-	var resultErr error
-	var backgroundJob *models.BackgroundJob
-
 	//Begin Sync JobStatus update process
 	//1. Check if the source is already syncing
-	if sourceCred.LatestBackgroundJob != nil && sourceCred.LatestBackgroundJob.JobStatus == pkg.BackgroundJobStatusLocked {
+	if backgroundJobSyncInProgress(sourceCred) {
 		logger.Errorln("Sync operation already in progress, cannot continue.")
 		return sourceModels.UpsertSummary{}, fmt.Errorf("sync operation already in progress, cannot continue")
 	}
 
 	//since there's no sync in progress, lets create a new background job
 	//2. Create a new background job
-	backgroundJob = models.NewSyncBackgroundJob(*sourceCred)
+	backgroundJob := models.NewSyncBackgroundJob(*sourceCred)
 	err := databaseRepo.CreateBackgroundJob(parentContext, backgroundJob)
 	if err != nil {
-		resultErr = fmt.Errorf("an error occurred while creating background job: %w", err)
+		resultErr := fmt.Errorf("an error occurred while creating background job: %w", err)
 		logger.Errorln(resultErr)
 		return sourceModels.UpsertSummary{}, resultErr
 	}
 	backgroundJobContext := CreateBackgroundJobContext(parentContext, backgroundJob.ID.String())
 
+	return backgroundJobSyncResources(backgroundJobContext, logger, databaseRepo, backgroundJob, sourceCred, callbackFn)
+}
+
+type backgroundJobSyncCallback func(
+	_backgroundJobContext context.Context,
+	_logger *logrus.Entry,
+	_databaseRepo database.DatabaseRepository,
+	_sourceCred *models.SourceCredential,
+) (sourceModels.SourceClient, sourceModels.UpsertSummary, error)
+
+// backgroundJobSyncInProgress returns true if the source is associated with a queued or running sync job
+func backgroundJobSyncInProgress(sourceCred *models.SourceCredential) bool {
+	return sourceCred.LatestBackgroundJob != nil &&
+		(sourceCred.LatestBackgroundJob.JobStatus == pkg.BackgroundJobStatusLocked || sourceCred.LatestBackgroundJob.JobStatus == pkg.BackgroundJobStatusReady)
+}
+
+// backgroundJobSyncResources runs the sync callback for a locked sync job, and updates the job status once the sync is complete
+// (or has failed)
+func backgroundJobSyncResources(
+	backgroundJobContext context.Context,
+	logger *logrus.Entry,
+	databaseRepo database.DatabaseRepository,
+	backgroundJob *models.BackgroundJob,
+	sourceCred *models.SourceCredential,
+	callbackFn backgroundJobSyncCallback,
+) (sourceModels.UpsertSummary, error) {
+	var resultErr error
+
 	//3. Update the source with the background job id
 	sourceCred.LatestBackgroundJobID = &backgroundJob.ID
-	err = databaseRepo.UpdateSource(backgroundJobContext, sourceCred)
+	err := databaseRepo.UpdateSource(backgroundJobContext, sourceCred)
 	if err != nil {
 		logger.Warn("An error occurred while registering background job id with source, ignoring", err)
 		//we can safely ignore this error, because we'll be updating the status of the background job again later
@@ -108,18 +260,26 @@ func BackgroundJobSyncResourcesWrapper(
 	// BEGIN FINALIZER
 	defer func() {
 		//finalizer function - update the sync status to completed (or failed depending on the error status)
+		//the job context may have been cancelled (see CancelBackgroundJob), so the updates are made using a detached context
+		jobCancelled := backgroundJobContext.Err() != nil
+		backgroundJobContext := DetachBackgroundJobContext(backgroundJobContext)
+
 		if sourceCred == nil {
 			logger.Errorln("sync status finalizer unable to complete, SourceCredential is null, ignoring", err)
 			return
 		} else {
-			//since we're finished with the sync (no matter the final status), we can clear the active background job id
-			sourceCred.LatestBackgroundJobID = nil
-
-			//this will also update the AccessToken & RefreshToken if they have been updated
+			//this will update the AccessToken & RefreshToken if they have been updated
 			err := databaseRepo.UpdateSource(backgroundJobContext, sourceCred)
 			if err != nil {
 				logger.Errorln("sync status finalizer failed updating source, ignoring", err)
 			}
+
+			//since we're finished with the sync (no matter the final status), we can clear the active background job id
+			sourceCred.LatestBackgroundJobID = nil
+			err = databaseRepo.ClearSourceLatestBackgroundJob(backgroundJobContext, sourceCred.ID.String())
+			if err != nil {
+				logger.Errorln("sync status finalizer failed clearing background job id from source, ignoring", err)
+			}
 		}
 
 		//update the backgroundJob status to completed or failed
@@ -135,6 +295,10 @@ func BackgroundJobSyncResourcesWrapper(
 				backgroundJob = updatedBackgroundJob
 			}
 
+			if jobCancelled {
+				resultErr = fmt.Errorf("background job was cancelled")
+			}
+
 			if resultErr == nil {
 				backgroundJob.JobStatus = pkg.BackgroundJobStatusDone
 			} else {
@@ -152,7 +316,11 @@ func BackgroundJobSyncResourcesWrapper(
 
 				//marshal the new background job data
 				backgroundJob.Data, err = json.Marshal(backgroundJobSyncData)
-				backgroundJob.JobStatus = pkg.BackgroundJobStatusFailed
+				if jobCancelled {
+					backgroundJob.JobStatus = pkg.BackgroundJobStatusCancelled
+				} else {
+					backgroundJob.JobStatus = pkg.BackgroundJobStatusFailed
+				}
 			}
 			now := time.Now()
 			backgroundJob.DoneTime = &now
@@ -220,7 +388,10 @@ func ListBackgroundJobs(c *gin.Context) {
 		backgroundJobQueryOptions.Status = &status
 	}
 
-	if len(c.Query("page")) > 0 {
+	if len(c.Query("cursor")) > 0 {
+		//cursor returned as `next` by the previous page
+		backgroundJobQueryOptions.Cursor = c.Query("cursor")
+	} else if len(c.Query("page")) > 0 {
 		pageNumb, err := strconv.Atoi(c.Query("page"))
 		if err != nil {
 			logger.Errorln("An error occurred while calculating page number", err)
@@ -229,7 +400,7 @@ func ListBackgroundJobs(c *gin.Context) {
 		}
 		backgroundJobQueryOptions.Offset = pageNumb * backgroundJobQueryOptions.Limit
 	}
-	backgroundJobs, err := databaseRepo.ListBackgroundJobs(c, backgroundJobQueryOptions)
+	backgroundJobs, pagination, err := databaseRepo.ListBackgroundJobs(c, backgroundJobQueryOptions)
 
 	if err != nil {
 		logger.Errorln("An error occurred while retrieving resources", err)
@@ -237,11 +408,202 @@ func ListBackgroundJobs(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"success": true, "data": backgroundJobs})
+	//the upcoming scheduled syncs (see SetBackgroundJobSchedule) are always included, ordered by their next run time
+	upcomingBackgroundJobs, err := listScheduledSyncBackgroundJobs(c, databaseRepo)
+	if err != nil {
+		logger.Errorln("An error occurred while retrieving scheduled sync jobs", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": backgroundJobs, "total": pagination.Total, "next": pagination.Next, "upcoming": upcomingBackgroundJobs})
+}
+
+// GetBackgroundJob returns the details of a background job, including its checkpoint and error data
+func GetBackgroundJob(c *gin.Context) {
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	backgroundJob, err := databaseRepo.GetBackgroundJob(c, c.Param("jobId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": fmt.Sprintf("background job (%s) does not exist", c.Param("jobId"))})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": backgroundJob})
+}
+
+// CancelBackgroundJob cancels a queued or running background job.
+// Queued jobs are cancelled immediately. Running jobs are cancelled by the job runner, the job handler stops once the source
+// client returns, so the job may still be LOCKED when the response is returned (202 Accepted).
+func CancelBackgroundJob(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+	jobRunner := c.MustGet(pkg.ContextKeyTypeJobRunner).(job_runner.Interface)
+
+	backgroundJob, err := databaseRepo.GetBackgroundJob(c, c.Param("jobId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": fmt.Sprintf("background job (%s) does not exist", c.Param("jobId"))})
+		return
+	}
+	if backgroundJob.JobType == pkg.BackgroundJobTypeScheduledSync {
+		c.JSON(http.StatusConflict, gin.H{"success": false, "error": "scheduled sync jobs cannot be cancelled, the sync schedule should be removed instead"})
+		return
+	}
+
+	if backgroundJob.JobStatus == pkg.BackgroundJobStatusReady {
+		cancelled, err := databaseRepo.CancelBackgroundJob(c, backgroundJob.ID.String())
+		if err != nil {
+			logger.Errorln("An error occurred while cancelling background job", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+		if cancelled {
+			if backgroundJob.JobType == pkg.BackgroundJobTypeSync {
+				backgroundJobSyncClearSource(c, logger, databaseRepo, backgroundJob)
+			}
+			backgroundJob, err = databaseRepo.GetBackgroundJob(c, backgroundJob.ID.String())
+			if err != nil {
+				logger.Errorln("An error occurred while retrieving cancelled background job", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"success": true, "data": backgroundJob})
+			return
+		}
+		//the job was claimed by the job runner while it was being cancelled, so it's cancelled as a running job instead
+		backgroundJob.JobStatus = pkg.BackgroundJobStatusLocked
+	}
+
+	//jobs which are locked but not run by the job runner (eg. manual source uploads) cannot be cancelled
+	if backgroundJob.JobStatus != pkg.BackgroundJobStatusLocked || !jobRunner.Cancel(backgroundJob.ID.String()) {
+		c.JSON(http.StatusConflict, gin.H{"success": false, "error": fmt.Sprintf("background job (%s) cannot be cancelled, it is not queued or running", backgroundJob.ID)})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "data": backgroundJob})
+}
+
+// RetryBackgroundJob queues a new sync job for the source of a failed (or cancelled) sync job. The new job resumes from the
+// checkpoint of the failed job, if there is one (see BackgroundJobSyncResourcesJobHandler).
+func RetryBackgroundJob(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+	jobRunner := c.MustGet(pkg.ContextKeyTypeJobRunner).(job_runner.Interface)
+
+	backgroundJob, err := databaseRepo.GetBackgroundJob(c, c.Param("jobId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": fmt.Sprintf("background job (%s) does not exist", c.Param("jobId"))})
+		return
+	}
+	if backgroundJob.JobType != pkg.BackgroundJobTypeSync ||
+		(backgroundJob.JobStatus != pkg.BackgroundJobStatusFailed && backgroundJob.JobStatus != pkg.BackgroundJobStatusCancelled) {
+		c.JSON(http.StatusConflict, gin.H{"success": false, "error": "only failed or cancelled sync jobs can be retried"})
+		return
+	}
+
+	var backgroundJobSyncData models.BackgroundJobSyncData
+	if err := json.Unmarshal(backgroundJob.Data, &backgroundJobSyncData); err != nil {
+		logger.Errorln("An error occurred while parsing background job data", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	sourceCred, err := databaseRepo.GetSource(c, backgroundJobSyncData.SourceID.String())
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": fmt.Sprintf("source (%s) does not exist", backgroundJobSyncData.SourceID)})
+		return
+	}
+	if sourceCred.SourceType == sourcePkg.SourceTypeManual {
+		c.JSON(http.StatusConflict, gin.H{"success": false, "error": "manual source syncs cannot be retried, the file must be uploaded again"})
+		return
+	}
+
+	//the retried job keeps the checkpoint data, and is counted as a retry so that it resumes from the checkpoint
+	retryBackgroundJob := models.NewQueuedSyncBackgroundJob(*sourceCred)
+	retryBackgroundJob.Retries = backgroundJob.Retries + 1
+	if len(backgroundJobSyncData.CheckpointData) > 0 {
+		retryBackgroundJob.Data, err = json.Marshal(models.BackgroundJobSyncData{
+			SourceID:       sourceCred.ID,
+			SourceType:     string(sourceCred.SourceType),
+			CheckpointData: backgroundJobSyncData.CheckpointData,
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+	}
+
+	retryBackgroundJob, err = backgroundJobQueueSyncResources(c, logger, databaseRepo, sourceCred, retryBackgroundJob)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	jobRunner.Notify()
+
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "source": sourceCred, "data": retryBackgroundJob})
+}
+
+// ListBackgroundJobLogs returns a page of the log entries captured while a background job was processed, oldest first.
+// Use the `next` cursor to retrieve the following page.
+func ListBackgroundJobLogs(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	//ensure the job exists, and belongs to the current user
+	backgroundJob, err := databaseRepo.GetBackgroundJob(c, c.Param("jobId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": fmt.Sprintf("background job (%s) does not exist", c.Param("jobId"))})
+		return
+	}
+
+	backgroundJobLogQueryOptions := models.BackgroundJobLogQueryOptions{
+		Limit:  pkg.ResourceListPageSize,
+		Cursor: c.Query("cursor"),
+	}
+	if len(c.Query("limit")) > 0 {
+		limit, err := strconv.Atoi(c.Query("limit"))
+		if err != nil || limit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "limit must be a positive number"})
+			return
+		} else if limit > 0 {
+			backgroundJobLogQueryOptions.Limit = limit
+		}
+	}
+
+	backgroundJobLogs, pagination, err := databaseRepo.ListBackgroundJobLogs(c, backgroundJob.ID.String(), backgroundJobLogQueryOptions)
+	if err != nil {
+		logger.Errorln("An error occurred while retrieving background job logs", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": backgroundJobLogs, "total": pagination.Total, "next": pagination.Next})
 }
 
 // Utilities
 
+// backgroundJobSyncClearSource clears the latest background job of the source, if it's the (cancelled) sync job, so that the
+// source can be synced again. Uploaded files which were waiting to be imported by the job are removed.
+func backgroundJobSyncClearSource(ctx context.Context, logger *logrus.Entry, databaseRepo database.DatabaseRepository, backgroundJob *models.BackgroundJob) {
+	var backgroundJobSyncData models.BackgroundJobSyncData
+	if err := json.Unmarshal(backgroundJob.Data, &backgroundJobSyncData); err != nil {
+		logger.Warn("An error occurred while parsing background job data, ignoring", err)
+		return
+	}
+	if len(backgroundJobSyncData.AppleHealthExportFile) > 0 {
+		if err := os.Remove(backgroundJobSyncData.AppleHealthExportFile); err != nil {
+			logger.Warn("An error occurred while removing uploaded Apple Health export, ignoring", err)
+		}
+	}
+	sourceCred, err := databaseRepo.GetSource(ctx, backgroundJobSyncData.SourceID.String())
+	if err != nil {
+		logger.Warn("An error occurred while retrieving source for cancelled background job, ignoring", err)
+		return
+	}
+	if sourceCred.LatestBackgroundJobID == nil || *sourceCred.LatestBackgroundJobID != backgroundJob.ID {
+		return
+	}
+	if err := databaseRepo.ClearSourceLatestBackgroundJob(ctx, sourceCred.ID.String()); err != nil {
+		logger.Warn("An error occurred while clearing background job id from source, ignoring", err)
+	}
+}
+
 func GetBackgroundContext(ginContext *gin.Context) context.Context {
 	return context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, ginContext.Value(pkg.ContextKeyTypeAuthUsername).(string))
 }
@@ -249,3 +611,16 @@ func GetBackgroundContext(ginContext *gin.Context) context.Context {
 func CreateBackgroundJobContext(parentContext context.Context, backgroundJobId string) context.Context {
 	return context.WithValue(parentContext, pkg.ContextKeyTypeBackgroundJobID, backgroundJobId)
 }
+
+// DetachBackgroundJobContext returns a context with the same username and job id as the background job context, which is not
+// cancelled with it. It's used to update the job once it has been cancelled.
+func DetachBackgroundJobContext(backgroundJobContext context.Context) context.Context {
+	detachedContext := context.Background()
+	if username, ok := backgroundJobContext.Value(pkg.ContextKeyTypeAuthUsername).(string); ok {
+		detachedContext = context.WithValue(detachedContext, pkg.ContextKeyTypeAuthUsername, username)
+	}
+	if backgroundJobId, ok := backgroundJobContext.Value(pkg.ContextKeyTypeBackgroundJobID).(string); ok {
+		detachedContext = CreateBackgroundJobContext(detachedContext, backgroundJobId)
+	}
+	return detachedContext
+}
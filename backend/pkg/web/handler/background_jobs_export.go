@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/config"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/job_runner"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+// exportCheckpointInterval is the number of resources written between background job checkpoints
+const exportCheckpointInterval = 500
+
+// NewBackgroundJobExportResourcesJobHandler returns the handler for queued export jobs (see job_runner.JobHandler), which writes
+// the files to the export directory in the cache location.
+func NewBackgroundJobExportResourcesJobHandler(appConfig config.Interface) job_runner.JobHandler {
+	return func(
+		backgroundJobContext context.Context,
+		logger *logrus.Entry,
+		databaseRepo database.DatabaseRepository,
+		eventBus event_bus.Interface,
+		backgroundJob *models.BackgroundJob,
+	) error {
+		var backgroundJobExportData models.BackgroundJobExportData
+		if err := json.Unmarshal(backgroundJob.Data, &backgroundJobExportData); err != nil {
+			return fmt.Errorf("an error occurred while parsing background job data: %w", err)
+		}
+		exportOptions := models.ExportResourceQueryOptions{
+			SourceResourceTypes: backgroundJobExportData.ResourceTypes,
+			Since:               backgroundJobExportData.Since,
+		}
+		exportDir := getExportDir(appConfig, backgroundJob.UserID.String(), backgroundJob.ID.String())
+		return backgroundJobExportResources(backgroundJobContext, logger, databaseRepo, backgroundJob, exportDir, exportOptions)
+	}
+}
+
+// backgroundJobExportResources writes the user's resources to NDJSON files (one file per resource type) in the export directory.
+// Progress is stored using BackgroundJobCheckpoint, and the written files are stored in the job data (BackgroundJobExportData.Output)
+// by the finalizer, once the export is complete.
+// Exports interrupted by a restart are run again from the start, since the files are overwritten.
+func backgroundJobExportResources(
+	backgroundJobContext context.Context,
+	logger *logrus.Entry,
+	databaseRepo database.DatabaseRepository,
+	backgroundJob *models.BackgroundJob,
+	exportDir string,
+	exportOptions models.ExportResourceQueryOptions,
+) error {
+	var resultErr error
+	var output []models.BackgroundJobExportOutput
+
+	// BEGIN FINALIZER
+	defer func() {
+		//the job context may have been cancelled (see CancelBackgroundJob), so the updates are made using a detached context
+		jobCancelled := backgroundJobContext.Err() != nil
+		backgroundJobContext := DetachBackgroundJobContext(backgroundJobContext)
+		if jobCancelled {
+			resultErr = fmt.Errorf("background job was cancelled")
+		}
+
+		//first, try to update the background job with the latest data (checkpoints)
+		updatedBackgroundJob, err := databaseRepo.GetBackgroundJob(backgroundJobContext, backgroundJob.ID.String())
+		if err == nil {
+			backgroundJob = updatedBackgroundJob
+		}
+
+		var backgroundJobExportData models.BackgroundJobExportData
+		if backgroundJob.Data != nil {
+			err = json.Unmarshal(backgroundJob.Data, &backgroundJobExportData)
+		}
+
+		if resultErr == nil {
+			backgroundJobExportData.Output = output
+			backgroundJob.JobStatus = pkg.BackgroundJobStatusDone
+		} else {
+			//ensure there's a map to store the error data
+			if backgroundJobExportData.ErrorData == nil {
+				backgroundJobExportData.ErrorData = map[string]interface{}{}
+			}
+			backgroundJobExportData.ErrorData["final"] = resultErr.Error()
+			if jobCancelled {
+				backgroundJob.JobStatus = pkg.BackgroundJobStatusCancelled
+			} else {
+				backgroundJob.JobStatus = pkg.BackgroundJobStatusFailed
+			}
+
+			//partially written files are never served, so they can be removed
+			if err := os.RemoveAll(exportDir); err != nil {
+				logger.Warnln("export finalizer failed removing export directory, ignoring", err)
+			}
+		}
+		backgroundJob.Data, err = json.Marshal(backgroundJobExportData)
+		if err != nil {
+			logger.Errorln("export finalizer failed serializing background job data, ignoring", err)
+		}
+		now := time.Now()
+		backgroundJob.DoneTime = &now
+		backgroundJob.LockedTime = nil
+
+		err = databaseRepo.UpdateBackgroundJob(backgroundJobContext, backgroundJob)
+		if err != nil {
+			logger.Errorln("export finalizer failed updating background job, ignoring", err)
+		}
+	}()
+	// END FINALIZER
+
+	var baseUrl string
+	var backgroundJobExportData models.BackgroundJobExportData
+	if err := json.Unmarshal(backgroundJob.Data, &backgroundJobExportData); err == nil {
+		baseUrl = backgroundJobExportData.BaseUrl
+	}
+
+	//exports contain the user's entire record, so the files are only readable by the server
+	if resultErr = os.MkdirAll(exportDir, 0700); resultErr != nil {
+		resultErr = fmt.Errorf("an error occurred while creating export directory: %w", resultErr)
+		logger.Errorln(resultErr)
+		return resultErr
+	}
+
+	//ExportResources returns all resources of a type before moving to the next type, so only one file is open at a time
+	var exportFile *os.File
+	var exportWriter *bufio.Writer
+	closeExportFile := func() error {
+		if exportFile == nil {
+			return nil
+		}
+		defer func() { exportFile = nil }()
+		if err := exportWriter.Flush(); err != nil {
+			exportFile.Close()
+			return err
+		}
+		return exportFile.Close()
+	}
+
+	resourceCount := 0
+	resultErr = databaseRepo.ExportResources(backgroundJobContext, exportOptions, func(resource *models.ResourceBase) error {
+		if len(output) == 0 || output[len(output)-1].Type != resource.SourceResourceType {
+			if err := closeExportFile(); err != nil {
+				return err
+			}
+			fileName := fmt.Sprintf("%s.ndjson", resource.SourceResourceType)
+			file, err := os.OpenFile(filepath.Join(exportDir, fileName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			exportFile = file
+			exportWriter = bufio.NewWriter(file)
+			output = append(output, models.BackgroundJobExportOutput{Type: resource.SourceResourceType, FileName: fileName})
+		}
+
+		resourceRaw, err := fhirR4RewriteReferences(resource.ResourceRaw, fhirR4AbsoluteReference(baseUrl))
+		if err != nil {
+			return fmt.Errorf("could not rewrite references in %s/%s: %w", resource.SourceResourceType, resource.SourceResourceID, err)
+		}
+		//each resource must be written on a single line
+		var resourceLine bytes.Buffer
+		if err := json.Compact(&resourceLine, resourceRaw); err != nil {
+			return fmt.Errorf("could not compact %s/%s: %w", resource.SourceResourceType, resource.SourceResourceID, err)
+		}
+		resourceLine.WriteByte('\n')
+		if _, err := exportWriter.Write(resourceLine.Bytes()); err != nil {
+			return err
+		}
+		output[len(output)-1].Count++
+
+		resourceCount++
+		if resourceCount%exportCheckpointInterval == 0 {
+			databaseRepo.BackgroundJobCheckpoint(backgroundJobContext, map[string]interface{}{
+				"resource_type":  resource.SourceResourceType,
+				"resource_count": resourceCount,
+			}, nil)
+		}
+		return nil
+	})
+	if closeErr := closeExportFile(); resultErr == nil {
+		resultErr = closeErr
+	}
+	if resultErr != nil {
+		resultErr = fmt.Errorf("an error occurred while exporting resources: %w", resultErr)
+		logger.Errorln(resultErr)
+		return resultErr
+	}
+	logger.Infof("exported %d resources to %s", resourceCount, exportDir)
+	return nil
+}
+
+// RemoveExpiredExports removes the files of exports which have expired (see `export.retention_hours`, and fhirR4ExportExpired)
+// for every user, once per interval. It's a blocking function that should be run in a goroutine, it stops once the context is
+// cancelled.
+func RemoveExpiredExports(ctx context.Context, appConfig config.Interface, logger logrus.FieldLogger, databaseRepo database.DatabaseRepository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		removeExpiredExports(ctx, appConfig, logger, databaseRepo, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// removeExpiredExports removes the export directories of the export jobs which were completed before the retention period, and
+// marks the jobs as deleted, so that the status endpoint matches the files on disk
+func removeExpiredExports(ctx context.Context, appConfig config.Interface, logger logrus.FieldLogger, databaseRepo database.DatabaseRepository, now time.Time) {
+	retentionHours := appConfig.GetInt("export.retention_hours")
+	if retentionHours <= 0 {
+		return
+	}
+	expiredBackgroundJobs, err := databaseRepo.ListDoneBackgroundJobs(ctx, pkg.BackgroundJobTypeExport, now.Add(-time.Duration(retentionHours)*time.Hour))
+	if err != nil {
+		logger.Errorln("An error occurred while listing completed export background jobs", err)
+		return
+	}
+	for ndx := range expiredBackgroundJobs {
+		backgroundJob := &expiredBackgroundJobs[ndx]
+		var exportData models.BackgroundJobExportData
+		if err := json.Unmarshal(backgroundJob.Data, &exportData); err != nil {
+			logger.Errorf("An error occurred while parsing export background job %s data: %v", backgroundJob.ID, err)
+			continue
+		} else if exportData.DeletedTime != nil {
+			continue
+		}
+
+		exportDir := getExportDir(appConfig, backgroundJob.UserID.String(), backgroundJob.ID.String())
+		logger.Infof("Removing expired export: %s", exportDir)
+		if err := os.RemoveAll(exportDir); err != nil {
+			logger.Errorf("An error occurred while removing expired export %s: %v", exportDir, err)
+			continue
+		}
+
+		exportData.DeletedTime = &now
+		backgroundJob.Data, err = json.Marshal(exportData)
+		if err != nil {
+			logger.Errorf("An error occurred while serializing export background job %s data: %v", backgroundJob.ID, err)
+			continue
+		}
+		//background jobs are updated on behalf of the user who created them
+		jobOwnerContext := context.WithValue(ctx, pkg.ContextKeyTypeAuthUsername, backgroundJob.User.Username)
+		if err := databaseRepo.UpdateBackgroundJob(jobOwnerContext, backgroundJob); err != nil {
+			logger.Errorf("An error occurred while updating expired export background job %s: %v", backgroundJob.ID, err)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	sourcePkg "github.com/fastenhealth/fasten-sources/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// BackgroundJobScheduledSyncJobHandler queues a sync job for the source of a scheduled sync job (or every source, if it's a
+// global schedule), see job_runner.JobHandler. Sources which cannot be synced without the user (manual sources, and sources
+// with expired credentials) are skipped.
+// Once the sync jobs are queued, the scheduled job is returned to the READY status with its next run time. If the source has
+// been deleted, an error is returned and the schedule is failed.
+func BackgroundJobScheduledSyncJobHandler(
+	backgroundJobContext context.Context,
+	logger *logrus.Entry,
+	databaseRepo database.DatabaseRepository,
+	eventBus event_bus.Interface,
+	backgroundJob *models.BackgroundJob,
+) error {
+	if backgroundJob.Schedule == nil || backgroundJob.NextRunTime == nil {
+		return fmt.Errorf("scheduled sync job is missing a schedule")
+	}
+	var backgroundJobScheduledSyncData models.BackgroundJobScheduledSyncData
+	if err := json.Unmarshal(backgroundJob.Data, &backgroundJobScheduledSyncData); err != nil {
+		return fmt.Errorf("an error occurred while parsing background job data: %w", err)
+	}
+
+	var sourceCreds []models.SourceCredential
+	if backgroundJobScheduledSyncData.SourceID != nil {
+		sourceCred, err := databaseRepo.GetSource(backgroundJobContext, backgroundJobScheduledSyncData.SourceID.String())
+		if err != nil {
+			return fmt.Errorf("an error occurred while retrieving source credential: %w", err)
+		}
+		sourceCreds = append(sourceCreds, *sourceCred)
+	} else {
+		var err error
+		sourceCreds, err = databaseRepo.GetSources(backgroundJobContext)
+		if err != nil {
+			return fmt.Errorf("an error occurred while retrieving source credentials: %w", err)
+		}
+	}
+
+	now := time.Now()
+	queuedSources := []string{}
+	skippedSources := map[string]interface{}{}
+	for ndx := range sourceCreds {
+		sourceCred := &sourceCreds[ndx]
+		if sourceCred.SourceType == sourcePkg.SourceTypeManual || sourceCred.SourceType == sourcePkg.SourceTypeFasten {
+			continue
+		}
+		if sourceCred.CredentialsExpired(now) {
+			logger.Infof("Skipping scheduled sync for source %s, credentials have expired", sourceCred.ID)
+			skippedSources[sourceCred.ID.String()] = "credentials have expired, the source must be reconnected"
+			continue
+		}
+		if _, err := BackgroundJobQueueSyncResources(backgroundJobContext, logger, databaseRepo, sourceCred); err != nil {
+			skippedSources[sourceCred.ID.String()] = err.Error()
+			continue
+		}
+		queuedSources = append(queuedSources, sourceCred.ID.String())
+	}
+
+	//the schedule may have been removed while the sync jobs were queued
+	updatedBackgroundJob, err := databaseRepo.GetBackgroundJob(backgroundJobContext, backgroundJob.ID.String())
+	if err != nil {
+		return fmt.Errorf("an error occurred while retrieving scheduled sync job: %w", err)
+	} else if updatedBackgroundJob.JobStatus != pkg.BackgroundJobStatusLocked {
+		return nil
+	}
+
+	nextRunTime, err := models.BackgroundJobScheduleNextRunTime(*backgroundJob.Schedule, *backgroundJob.NextRunTime, backgroundJobScheduledSyncData.AnchorDay, now)
+	if err != nil {
+		return err
+	}
+	backgroundJobScheduledSyncData.LastRunTime = &now
+	backgroundJobScheduledSyncData.CheckpointData = map[string]interface{}{"queued_sources": queuedSources}
+	backgroundJobScheduledSyncData.ErrorData = skippedSources
+	updatedBackgroundJob.Data, err = json.Marshal(backgroundJobScheduledSyncData)
+	if err != nil {
+		return err
+	}
+	updatedBackgroundJob.JobStatus = pkg.BackgroundJobStatusReady
+	updatedBackgroundJob.NextRunTime = &nextRunTime
+	updatedBackgroundJob.LockedTime = nil
+	return databaseRepo.UpdateBackgroundJob(backgroundJobContext, updatedBackgroundJob)
+}
+
+// Handlers
+
+type backgroundJobScheduleRequest struct {
+	Schedule pkg.BackgroundJobSchedule `json:"schedule"`
+	//optional, the schedule applies to all sources if it's not set
+	SourceID *uuid.UUID `json:"source_id"`
+}
+
+// SetBackgroundJobSchedule creates (or replaces) the sync schedule for a source, or the global sync schedule for all sources.
+// The first sync is run once the schedule has elapsed, eg. a week from now for a WEEKLY schedule.
+func SetBackgroundJobSchedule(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	var scheduleRequest backgroundJobScheduleRequest
+	if err := c.ShouldBindJSON(&scheduleRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "request body is not a valid schedule"})
+		return
+	}
+	if scheduleRequest.SourceID != nil {
+		//ensure the source exists, and belongs to the current user
+		if _, err := databaseRepo.GetSource(c, scheduleRequest.SourceID.String()); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": fmt.Sprintf("source (%s) does not exist", scheduleRequest.SourceID)})
+			return
+		}
+	}
+
+	scheduledSyncBackgroundJob, err := models.NewScheduledSyncBackgroundJob(scheduleRequest.Schedule, scheduleRequest.SourceID, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	existingBackgroundJob, err := findScheduledSyncBackgroundJob(c, databaseRepo, scheduleRequest.SourceID)
+	if err != nil {
+		logger.Errorln("An error occurred while retrieving scheduled sync jobs", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if existingBackgroundJob != nil {
+		//the schedule data is replaced (so that the anchor day of MONTHLY schedules is recalculated), the last run time is kept
+		var existingScheduledSyncData models.BackgroundJobScheduledSyncData
+		if err := json.Unmarshal(existingBackgroundJob.Data, &existingScheduledSyncData); err == nil && existingScheduledSyncData.LastRunTime != nil {
+			var scheduledSyncData models.BackgroundJobScheduledSyncData
+			if err := json.Unmarshal(scheduledSyncBackgroundJob.Data, &scheduledSyncData); err != nil {
+				logger.Errorln("An error occurred while decoding scheduled sync job data", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+				return
+			}
+			scheduledSyncData.LastRunTime = existingScheduledSyncData.LastRunTime
+			scheduledSyncBackgroundJob.Data, _ = json.Marshal(scheduledSyncData)
+		}
+		existingBackgroundJob.Schedule = scheduledSyncBackgroundJob.Schedule
+		existingBackgroundJob.NextRunTime = scheduledSyncBackgroundJob.NextRunTime
+		existingBackgroundJob.Data = scheduledSyncBackgroundJob.Data
+		err = databaseRepo.UpdateBackgroundJob(c, existingBackgroundJob)
+		scheduledSyncBackgroundJob = existingBackgroundJob
+	} else {
+		err = databaseRepo.CreateBackgroundJob(c, scheduledSyncBackgroundJob)
+	}
+	if err != nil {
+		logger.Errorln("An error occurred while saving scheduled sync job", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": scheduledSyncBackgroundJob})
+}
+
+// DeleteBackgroundJobSchedule removes the sync schedule for a source (`source_id` query parameter), or the global sync schedule.
+// The scheduled sync job is marked as done, so that it's kept in the job history.
+func DeleteBackgroundJobSchedule(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	var sourceId *uuid.UUID
+	if len(c.Query("source_id")) > 0 {
+		parsedSourceId, err := uuid.Parse(c.Query("source_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "source_id must be a valid id"})
+			return
+		}
+		sourceId = &parsedSourceId
+	}
+
+	existingBackgroundJob, err := findScheduledSyncBackgroundJob(c, databaseRepo, sourceId)
+	if err != nil {
+		logger.Errorln("An error occurred while retrieving scheduled sync jobs", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	} else if existingBackgroundJob == nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": "sync schedule does not exist"})
+		return
+	}
+
+	now := time.Now()
+	existingBackgroundJob.JobStatus = pkg.BackgroundJobStatusDone
+	existingBackgroundJob.DoneTime = &now
+	if err := databaseRepo.UpdateBackgroundJob(c, existingBackgroundJob); err != nil {
+		logger.Errorln("An error occurred while removing scheduled sync job", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": existingBackgroundJob})
+}
+
+// Utilities
+
+// listScheduledSyncBackgroundJobs returns the active (ready or running) scheduled sync jobs for the current user, ordered by
+// their next run time
+func listScheduledSyncBackgroundJobs(ctx context.Context, databaseRepo database.DatabaseRepository) ([]models.BackgroundJob, error) {
+	jobType := pkg.BackgroundJobTypeScheduledSync
+	backgroundJobs, _, err := databaseRepo.ListBackgroundJobs(ctx, models.BackgroundJobQueryOptions{JobType: &jobType})
+	if err != nil {
+		return nil, err
+	}
+
+	scheduledBackgroundJobs := []models.BackgroundJob{}
+	for _, backgroundJob := range backgroundJobs {
+		if backgroundJob.JobStatus == pkg.BackgroundJobStatusReady || backgroundJob.JobStatus == pkg.BackgroundJobStatusLocked {
+			scheduledBackgroundJobs = append(scheduledBackgroundJobs, backgroundJob)
+		}
+	}
+	sort.SliceStable(scheduledBackgroundJobs, func(i, j int) bool {
+		return lo.FromPtr(scheduledBackgroundJobs[i].NextRunTime).Before(lo.FromPtr(scheduledBackgroundJobs[j].NextRunTime))
+	})
+	return scheduledBackgroundJobs, nil
+}
+
+// findScheduledSyncBackgroundJob returns the active scheduled sync job for the source (or the global schedule, if sourceId is nil),
+// nil is returned if there's no schedule
+func findScheduledSyncBackgroundJob(ctx context.Context, databaseRepo database.DatabaseRepository, sourceId *uuid.UUID) (*models.BackgroundJob, error) {
+	scheduledBackgroundJobs, err := listScheduledSyncBackgroundJobs(ctx, databaseRepo)
+	if err != nil {
+		return nil, err
+	}
+	for ndx := range scheduledBackgroundJobs {
+		var backgroundJobScheduledSyncData models.BackgroundJobScheduledSyncData
+		if err := json.Unmarshal(scheduledBackgroundJobs[ndx].Data, &backgroundJobScheduledSyncData); err != nil {
+			return nil, err
+		}
+		if (sourceId == nil && backgroundJobScheduledSyncData.SourceID == nil) ||
+			(sourceId != nil && backgroundJobScheduledSyncData.SourceID != nil && *sourceId == *backgroundJobScheduledSyncData.SourceID) {
+			return &scheduledBackgroundJobs[ndx], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	sourcePkg "github.com/fastenhealth/fasten-sources/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// setBackgroundJobSchedule calls the SetBackgroundJobSchedule handler with the (json) request body
+func setBackgroundJobSchedule(suite *ResourceFhirHandlerTestSuite, requestBody string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	req, err := http.NewRequest(http.MethodPut, "/api/secure/jobs/schedule", bytes.NewBufferString(requestBody))
+	require.NoError(suite.T(), err)
+	req.Header.Add("Content-Type", "application/json")
+	ctx.Request = req
+
+	SetBackgroundJobSchedule(ctx)
+	return w
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestSetBackgroundJobScheduleHandler() {
+	var respWrapper struct {
+		Success bool                 `json:"success"`
+		Data    models.BackgroundJob `json:"data"`
+	}
+
+	//create the global schedule
+	w := setBackgroundJobSchedule(suite, `{"schedule":"WEEKLY"}`)
+	require.Equal(suite.T(), http.StatusOK, w.Code, w.Body.String())
+	require.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &respWrapper))
+	scheduledBackgroundJobId := respWrapper.Data.ID
+	require.Equal(suite.T(), pkg.BackgroundJobTypeScheduledSync, respWrapper.Data.JobType)
+
+	//replace the global schedule
+	w = setBackgroundJobSchedule(suite, `{"schedule":"DAILY"}`)
+	require.Equal(suite.T(), http.StatusOK, w.Code, w.Body.String())
+	require.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &respWrapper))
+	require.Equal(suite.T(), scheduledBackgroundJobId, respWrapper.Data.ID)
+
+	//invalid schedules, and unknown sources are rejected
+	w = setBackgroundJobSchedule(suite, `{"schedule":"HOURLY"}`)
+	require.Equal(suite.T(), http.StatusBadRequest, w.Code, w.Body.String())
+	w = setBackgroundJobSchedule(suite, `{"schedule":"DAILY","source_id":"8f9b4f1e-7c1a-4b6a-9a4e-3c2d1e0f9a8b"}`)
+	require.Equal(suite.T(), http.StatusNotFound, w.Code, w.Body.String())
+
+	//the schedule is listed as an upcoming run
+	w = httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	ctx.Request, _ = http.NewRequest(http.MethodGet, "/api/secure/jobs", nil)
+	ListBackgroundJobs(ctx)
+	require.Equal(suite.T(), http.StatusOK, w.Code, w.Body.String())
+	var listRespWrapper struct {
+		Success  bool                   `json:"success"`
+		Upcoming []models.BackgroundJob `json:"upcoming"`
+	}
+	require.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &listRespWrapper))
+	require.Len(suite.T(), listRespWrapper.Upcoming, 1)
+	require.Equal(suite.T(), scheduledBackgroundJobId, listRespWrapper.Upcoming[0].ID)
+	require.Equal(suite.T(), pkg.BackgroundJobScheduleDaily, *listRespWrapper.Upcoming[0].Schedule)
+	require.WithinDuration(suite.T(), time.Now().AddDate(0, 0, 1), *listRespWrapper.Upcoming[0].NextRunTime, time.Minute)
+
+	//remove the global schedule
+	w = httptest.NewRecorder()
+	ctx, _ = gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	ctx.Request, _ = http.NewRequest(http.MethodDelete, "/api/secure/jobs/schedule", nil)
+	DeleteBackgroundJobSchedule(ctx)
+	require.Equal(suite.T(), http.StatusOK, w.Code, w.Body.String())
+
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+	upcomingBackgroundJobs, err := listScheduledSyncBackgroundJobs(authContext, suite.AppRepository)
+	require.NoError(suite.T(), err)
+	require.Empty(suite.T(), upcomingBackgroundJobs)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestSetBackgroundJobScheduleHandler_FromDailyToMonthly() {
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+	sourceCred := &models.SourceCredential{SourceType: sourcePkg.SourceType("bluebutton"), Patient: "monthly", AccessToken: "access"}
+	require.NoError(suite.T(), suite.AppRepository.CreateSource(authContext, sourceCred))
+	var respWrapper struct {
+		Success bool                 `json:"success"`
+		Data    models.BackgroundJob `json:"data"`
+	}
+
+	w := setBackgroundJobSchedule(suite, `{"schedule":"DAILY","source_id":"`+sourceCred.ID.String()+`"}`)
+	require.Equal(suite.T(), http.StatusOK, w.Code, w.Body.String())
+	require.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &respWrapper))
+
+	//the daily schedule has run
+	scheduledBackgroundJob, err := suite.AppRepository.GetBackgroundJob(authContext, respWrapper.Data.ID.String())
+	require.NoError(suite.T(), err)
+	lastRunTime := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	scheduledBackgroundJob.Data, err = json.Marshal(models.BackgroundJobScheduledSyncData{SourceID: &sourceCred.ID, LastRunTime: &lastRunTime})
+	require.NoError(suite.T(), err)
+	require.NoError(suite.T(), suite.AppRepository.UpdateBackgroundJob(authContext, scheduledBackgroundJob))
+
+	//test
+	now := time.Now()
+	w = setBackgroundJobSchedule(suite, `{"schedule":"MONTHLY","source_id":"`+sourceCred.ID.String()+`"}`)
+
+	//assert
+	require.Equal(suite.T(), http.StatusOK, w.Code, w.Body.String())
+	scheduledBackgroundJob, err = suite.AppRepository.GetBackgroundJob(authContext, respWrapper.Data.ID.String())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), pkg.BackgroundJobScheduleMonthly, *scheduledBackgroundJob.Schedule)
+	var scheduledSyncData models.BackgroundJobScheduledSyncData
+	require.NoError(suite.T(), json.Unmarshal(scheduledBackgroundJob.Data, &scheduledSyncData))
+	require.Equal(suite.T(), now.Day(), scheduledSyncData.AnchorDay)
+	require.Equal(suite.T(), sourceCred.ID, *scheduledSyncData.SourceID)
+	require.True(suite.T(), lastRunTime.Equal(*scheduledSyncData.LastRunTime))
+
+	//remove the schedule, so that it's not run by other tests
+	scheduledBackgroundJob.JobStatus = pkg.BackgroundJobStatusDone
+	require.NoError(suite.T(), suite.AppRepository.UpdateBackgroundJob(authContext, scheduledBackgroundJob))
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestBackgroundJobScheduledSyncJobHandler() {
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+
+	//setup
+	validSourceCred := &models.SourceCredential{SourceType: sourcePkg.SourceType("bluebutton"), Patient: "valid", AccessToken: "access", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	require.NoError(suite.T(), suite.AppRepository.CreateSource(authContext, validSourceCred))
+	expiredSourceCred := &models.SourceCredential{SourceType: sourcePkg.SourceType("bluebutton"), Patient: "expired", AccessToken: "access", ExpiresAt: time.Now().Add(-time.Hour).Unix()}
+	require.NoError(suite.T(), suite.AppRepository.CreateSource(authContext, expiredSourceCred))
+	manualSourceCred := &models.SourceCredential{SourceType: sourcePkg.SourceTypeManual, Patient: "manual"}
+	require.NoError(suite.T(), suite.AppRepository.CreateSource(authContext, manualSourceCred))
+
+	//the global schedule is due
+	scheduledBackgroundJob, err := models.NewScheduledSyncBackgroundJob(pkg.BackgroundJobScheduleWeekly, nil, time.Now().AddDate(0, 0, -7))
+	require.NoError(suite.T(), err)
+	require.NoError(suite.T(), suite.AppRepository.CreateBackgroundJob(authContext, scheduledBackgroundJob))
+	claimedBackgroundJob, err := suite.AppRepository.ClaimBackgroundJob(authContext, []pkg.BackgroundJobType{pkg.BackgroundJobTypeScheduledSync})
+	require.NoError(suite.T(), err)
+	require.NotNil(suite.T(), claimedBackgroundJob)
+
+	//test
+	err = BackgroundJobScheduledSyncJobHandler(
+		CreateBackgroundJobContext(authContext, claimedBackgroundJob.ID.String()),
+		logrus.WithField("test", suite.T().Name()),
+		suite.AppRepository,
+		suite.AppEventBus,
+		claimedBackgroundJob,
+	)
+
+	//assert
+	require.NoError(suite.T(), err)
+
+	//a sync job is queued for the valid source only
+	syncJobType := pkg.BackgroundJobTypeSync
+	syncJobStatus := pkg.BackgroundJobStatusReady
+	syncBackgroundJobs, _, err := suite.AppRepository.ListBackgroundJobs(authContext, models.BackgroundJobQueryOptions{JobType: &syncJobType, Status: &syncJobStatus})
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), syncBackgroundJobs, 1)
+	var syncData models.BackgroundJobSyncData
+	require.NoError(suite.T(), json.Unmarshal(syncBackgroundJobs[0].Data, &syncData))
+	require.Equal(suite.T(), validSourceCred.ID, syncData.SourceID)
+
+	//the schedule is ready for its next run, and the expired source is recorded as skipped
+	updatedBackgroundJob, err := suite.AppRepository.GetBackgroundJob(authContext, scheduledBackgroundJob.ID.String())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), pkg.BackgroundJobStatusReady, updatedBackgroundJob.JobStatus)
+	require.True(suite.T(), updatedBackgroundJob.NextRunTime.After(time.Now()))
+	var scheduledSyncData models.BackgroundJobScheduledSyncData
+	require.NoError(suite.T(), json.Unmarshal(updatedBackgroundJob.Data, &scheduledSyncData))
+	require.NotNil(suite.T(), scheduledSyncData.LastRunTime)
+	require.Equal(suite.T(), []interface{}{validSourceCred.ID.String()}, scheduledSyncData.CheckpointData["queued_sources"])
+	require.Contains(suite.T(), scheduledSyncData.ErrorData, expiredSourceCred.ID.String())
+	require.Len(suite.T(), scheduledSyncData.ErrorData, 1)
+}
@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	mock_job_runner "github.com/fastenhealth/fasten-onprem/backend/pkg/job_runner/mock"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	sourcePkg "github.com/fastenhealth/fasten-sources/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumeSyncResourceNames(t *testing.T) {
+	t.Parallel()
+
+	resourceNames := []string{"Patient", "Condition", "Observation", "AllergyIntolerance", "Encounter", "Condition"}
+	var testCases = []struct {
+		checkpointData map[string]interface{}
+		expected       []string
+		resumable      bool
+	}{
+		{map[string]interface{}{"stage": "Encounter", "stage_progress": 200}, []string{"Encounter", "Observation", "Patient"}, true},
+		{map[string]interface{}{"stage": "AllergyIntolerance"}, []string{"AllergyIntolerance", "Condition", "Encounter", "Observation", "Patient"}, true},
+		{map[string]interface{}{"stage": "EverythingBundle", "stage_progress": 100}, nil, false},
+		{map[string]interface{}{"stage": "PendingResources"}, nil, false},
+		{map[string]interface{}{}, nil, false},
+	}
+
+	for _, tc := range testCases {
+		//test
+		remainingResourceNames, resumable := resumeSyncResourceNames(resourceNames, tc.checkpointData)
+
+		//assert
+		require.Equal(t, tc.resumable, resumable, "checkpoint %v", tc.checkpointData)
+		require.Equal(t, tc.expected, remainingResourceNames, "checkpoint %v", tc.checkpointData)
+	}
+}
+
+// callBackgroundJobHandler calls a background job handler (GetBackgroundJob, CancelBackgroundJob or RetryBackgroundJob) for the job
+func callBackgroundJobHandler(suite *ResourceFhirHandlerTestSuite, jobRunner *mock_job_runner.MockInterface, handlerFn gin.HandlerFunc, method string, backgroundJobId string) (*httptest.ResponseRecorder, models.BackgroundJob) {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	ctx.Set(pkg.ContextKeyTypeJobRunner, jobRunner)
+	ctx.Params = gin.Params{{Key: "jobId", Value: backgroundJobId}}
+	ctx.Request, _ = http.NewRequest(method, "/api/secure/jobs/"+backgroundJobId, nil)
+	handlerFn(ctx)
+
+	var respWrapper struct {
+		Success bool                 `json:"success"`
+		Data    models.BackgroundJob `json:"data"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &respWrapper)
+	return w, respWrapper.Data
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestCancelRetryBackgroundJobHandler() {
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+	fakeJobRunner := mock_job_runner.NewMockInterface(suite.MockCtrl)
+
+	//setup
+	sourceCred := &models.SourceCredential{SourceType: sourcePkg.SourceType("bluebutton"), Patient: "cancel", AccessToken: "access"}
+	require.NoError(suite.T(), suite.AppRepository.CreateSource(authContext, sourceCred))
+	queuedBackgroundJob, err := BackgroundJobQueueSyncResources(authContext, logrus.WithField("test", suite.T().Name()), suite.AppRepository, sourceCred)
+	require.NoError(suite.T(), err)
+
+	//unknown jobs are not found
+	w, _ := callBackgroundJobHandler(suite, fakeJobRunner, GetBackgroundJob, http.MethodGet, "8f9b4f1e-7c1a-4b6a-9a4e-3c2d1e0f9a8b")
+	require.Equal(suite.T(), http.StatusNotFound, w.Code, w.Body.String())
+	w, foundBackgroundJob := callBackgroundJobHandler(suite, fakeJobRunner, GetBackgroundJob, http.MethodGet, queuedBackgroundJob.ID.String())
+	require.Equal(suite.T(), http.StatusOK, w.Code, w.Body.String())
+	require.Equal(suite.T(), pkg.BackgroundJobStatusReady, foundBackgroundJob.JobStatus)
+
+	//queued jobs can't be retried, and are cancelled immediately
+	w, _ = callBackgroundJobHandler(suite, fakeJobRunner, RetryBackgroundJob, http.MethodPost, queuedBackgroundJob.ID.String())
+	require.Equal(suite.T(), http.StatusConflict, w.Code, w.Body.String())
+	w, cancelledBackgroundJob := callBackgroundJobHandler(suite, fakeJobRunner, CancelBackgroundJob, http.MethodPost, queuedBackgroundJob.ID.String())
+	require.Equal(suite.T(), http.StatusOK, w.Code, w.Body.String())
+	require.Equal(suite.T(), pkg.BackgroundJobStatusCancelled, cancelledBackgroundJob.JobStatus)
+	w, _ = callBackgroundJobHandler(suite, fakeJobRunner, CancelBackgroundJob, http.MethodPost, queuedBackgroundJob.ID.String())
+	require.Equal(suite.T(), http.StatusConflict, w.Code, w.Body.String())
+
+	updatedSourceCred, err := suite.AppRepository.GetSource(authContext, sourceCred.ID.String())
+	require.NoError(suite.T(), err)
+	require.Nil(suite.T(), updatedSourceCred.LatestBackgroundJobID, "the source must be released, so that it can be synced again")
+
+	//the cancelled job is retried as a new queued job
+	fakeJobRunner.EXPECT().Notify()
+	w, retriedBackgroundJob := callBackgroundJobHandler(suite, fakeJobRunner, RetryBackgroundJob, http.MethodPost, queuedBackgroundJob.ID.String())
+	require.Equal(suite.T(), http.StatusAccepted, w.Code, w.Body.String())
+	require.NotEqual(suite.T(), queuedBackgroundJob.ID, retriedBackgroundJob.ID)
+	require.Equal(suite.T(), pkg.BackgroundJobStatusReady, retriedBackgroundJob.JobStatus)
+	require.Equal(suite.T(), 1, retriedBackgroundJob.Retries)
+
+	//running jobs are cancelled by the job runner
+	retriedBackgroundJob.JobStatus = pkg.BackgroundJobStatusLocked
+	require.NoError(suite.T(), suite.AppRepository.UpdateBackgroundJob(authContext, &retriedBackgroundJob))
+	fakeJobRunner.EXPECT().Cancel(retriedBackgroundJob.ID.String()).Return(true)
+	w, _ = callBackgroundJobHandler(suite, fakeJobRunner, CancelBackgroundJob, http.MethodPost, retriedBackgroundJob.ID.String())
+	require.Equal(suite.T(), http.StatusAccepted, w.Code, w.Body.String())
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestListBackgroundJobLogsHandler() {
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+
+	//setup
+	sourceCred := models.SourceCredential{SourceType: sourcePkg.SourceType("bluebutton")}
+	backgroundJob := models.NewSyncBackgroundJob(sourceCred)
+	require.NoError(suite.T(), suite.AppRepository.CreateBackgroundJob(authContext, backgroundJob))
+	now := time.Now()
+	require.NoError(suite.T(), suite.AppRepository.CreateBackgroundJobLogs(authContext, []models.BackgroundJobLog{
+		{BackgroundJobID: backgroundJob.ID, Level: "info", Message: "Running background job", LoggedAt: now.Add(-2 * time.Second)},
+		{BackgroundJobID: backgroundJob.ID, Level: "warning", Message: "skipping resource (Observation/obs-1)", ResourceType: "Observation", ResourceID: "obs-1", LoggedAt: now.Add(-1 * time.Second)},
+		{BackgroundJobID: backgroundJob.ID, Level: "error", Message: "An error occurred while syncing resources", LoggedAt: now},
+	}))
+
+	listBackgroundJobLogs := func(backgroundJobId string, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		setupGinContext(ctx, suite)
+		ctx.Params = gin.Params{{Key: "jobId", Value: backgroundJobId}}
+		ctx.Request, _ = http.NewRequest(http.MethodGet, "/api/secure/jobs/"+backgroundJobId+"/logs?"+query, nil)
+		ListBackgroundJobLogs(ctx)
+		return w
+	}
+	var respWrapper struct {
+		Success bool                      `json:"success"`
+		Data    []models.BackgroundJobLog `json:"data"`
+		Total   int64                     `json:"total"`
+		Next    string                    `json:"next"`
+	}
+
+	//test
+	w := listBackgroundJobLogs(backgroundJob.ID.String(), "limit=2")
+	require.Equal(suite.T(), http.StatusOK, w.Code, w.Body.String())
+	require.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &respWrapper))
+	require.Equal(suite.T(), int64(3), respWrapper.Total)
+	require.Len(suite.T(), respWrapper.Data, 2)
+	require.Equal(suite.T(), "Running background job", respWrapper.Data[0].Message)
+	require.Equal(suite.T(), "Observation", respWrapper.Data[1].ResourceType)
+	require.NotEmpty(suite.T(), respWrapper.Next)
+
+	w = listBackgroundJobLogs(backgroundJob.ID.String(), "limit=2&cursor="+respWrapper.Next)
+	require.Equal(suite.T(), http.StatusOK, w.Code, w.Body.String())
+	respWrapper.Next = ""
+	require.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &respWrapper))
+	require.Len(suite.T(), respWrapper.Data, 1)
+	require.Equal(suite.T(), "error", respWrapper.Data[0].Level)
+	require.Empty(suite.T(), respWrapper.Next)
+
+	//unknown jobs, and invalid limits are rejected
+	w = listBackgroundJobLogs("8f9b4f1e-7c1a-4b6a-9a4e-3c2d1e0f9a8b", "")
+	require.Equal(suite.T(), http.StatusNotFound, w.Code, w.Body.String())
+	w = listBackgroundJobLogs(backgroundJob.ID.String(), "limit=abc")
+	require.Equal(suite.T(), http.StatusBadRequest, w.Code, w.Body.String())
+}
@@ -0,0 +1,302 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/errors"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	databaseModel "github.com/fastenhealth/fasten-onprem/backend/pkg/models/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/version"
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// The FHIR R4 facade exposes the user's resources using the standard FHIR REST api (https://hl7.org/fhir/r4/http.html)
+// rather than the `{success, data}` envelope used by the rest of the api, so that FHIR clients can be used with Fasten.
+// Only the `read` and `search-type` interactions are supported, and responses are always json.
+
+const (
+	fhirR4ContentTypeFhirJson = "application/fhir+json"
+	fhirR4ContentTypeJson     = "application/json"
+)
+
+// FhirR4Metadata returns the CapabilityStatement describing the resource types and search parameters supported by the
+// FHIR R4 facade, it's generated from the search parameters of each resource model
+func FhirR4Metadata(c *gin.Context) {
+	capabilityStatementRest := fhir401.CapabilityStatementRest{
+		Mode: fhir401.RestfulCapabilityModeServer,
+	}
+	for _, resourceType := range databaseModel.GetAllowedResourceTypes() {
+		capabilityStatementResource, err := fhirR4CapabilityStatementResource(resourceType)
+		if err != nil {
+			//the resource type is not part of FHIR R4, so it can't be included in the CapabilityStatement
+			continue
+		}
+		capabilityStatementRest.Resource = append(capabilityStatementRest.Resource, capabilityStatementResource)
+	}
+
+	capabilityStatement := fhir401.CapabilityStatement{
+		Status:      fhir401.PublicationStatusActive,
+		Date:        time.Now().Format(time.RFC3339),
+		Kind:        fhir401.CapabilityStatementKindInstance,
+		Software:    &fhir401.CapabilityStatementSoftware{Name: "Fasten", Version: lo.ToPtr(version.VERSION)},
+		FhirVersion: fhir401.FHIRVersion4_0_1,
+		Format:      []string{"json", fhirR4ContentTypeFhirJson},
+		Rest:        []fhir401.CapabilityStatementRest{capabilityStatementRest},
+	}
+	fhirR4Render(c, http.StatusOK, capabilityStatement)
+}
+
+// FhirR4SearchResources searches for resources of a single type, eg. `GET /fhir/r4/Observation?code=http://loinc.org|4548-4`
+// and returns a `searchset` Bundle. Search parameters are parsed by models.ParseFhirSearchQuery, and the `next` link
+// contains the cursor (or offset, for sorted searches) of the following page.
+func FhirR4SearchResources(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	resourceType := c.Param("resourceType")
+	if !lo.Contains(databaseModel.GetAllowedResourceTypes(), resourceType) {
+		fhirR4RenderOperationOutcome(c, http.StatusNotFound, fhir401.IssueTypeNotSupported, fmt.Sprintf("resource type %s is not supported", resourceType))
+		return
+	}
+
+	query, err := models.ParseFhirSearchQuery(resourceType + "?" + c.Request.URL.RawQuery)
+	if err != nil {
+		fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeInvalid, err.Error())
+		return
+	}
+	if query.Limit == nil {
+		query.Limit = lo.ToPtr(pkg.ResourceListPageSize)
+	}
+
+	queryResults, pagination, err := databaseRepo.QueryResources(c, query)
+	if errors.IsQueryValidationError(err) {
+		//the search parameters are validated while generating the query
+		fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeInvalid, err.Error())
+		return
+	} else if err != nil {
+		logger.Errorln("An error occurred while searching resources", err)
+		fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, "an error occurred while searching resources")
+		return
+	}
+	resourceResults, ok := queryResults.([]models.ResourceBase)
+	if !ok {
+		fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, "search did not return resources")
+		return
+	}
+
+	bundle := fhir401.Bundle{
+		Type:  fhir401.BundleTypeSearchset,
+		Total: lo.ToPtr(int(pagination.Total)),
+		Link:  []fhir401.BundleLink{{Relation: "self", Url: fhirR4SearchUrl(c, nil)}},
+		Entry: []fhir401.BundleEntry{},
+	}
+
+	matchCount := 0
+	for _, resourceResult := range resourceResults {
+		searchMode := fhir401.SearchEntryModeMatch
+		if resourceResult.SearchMode == pkg.ResourceSearchModeInclude {
+			searchMode = fhir401.SearchEntryModeInclude
+		} else {
+			matchCount++
+		}
+		bundle.Entry = append(bundle.Entry, fhir401.BundleEntry{
+			FullUrl:  lo.ToPtr(fmt.Sprintf("%s/%s/%s", fhirR4BaseUrl(c), resourceResult.SourceResourceType, resourceResult.SourceResourceID)),
+			Resource: json.RawMessage(resourceResult.ResourceRaw),
+			Search:   &fhir401.BundleEntrySearch{Mode: &searchMode},
+		})
+	}
+
+	if len(pagination.Next) > 0 {
+		bundle.Link = append(bundle.Link, fhir401.BundleLink{Relation: "next", Url: fhirR4SearchUrl(c, map[string]string{"_cursor": pagination.Next})})
+	} else if len(query.Sort) > 0 {
+		//sorted searches are paginated using offsets
+		nextOffset := lo.FromPtr(query.Offset) + matchCount
+		if matchCount > 0 && int64(nextOffset) < pagination.Total {
+			bundle.Link = append(bundle.Link, fhir401.BundleLink{Relation: "next", Url: fhirR4SearchUrl(c, map[string]string{"_offset": strconv.Itoa(nextOffset)})})
+		}
+	}
+
+	fhirR4Render(c, http.StatusOK, bundle)
+}
+
+// FhirR4ReadResource retrieves a single resource by its (source) id, eg. `GET /fhir/r4/Observation/123`
+// the id is the one assigned by the source, which is also the id used by references between resources.
+func FhirR4ReadResource(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	wrappedResourceModel, found := fhirR4FindResource(c, logger, databaseRepo)
+	if !found {
+		return
+	}
+
+	fhirR4Render(c, http.StatusOK, json.RawMessage(wrappedResourceModel.ResourceRaw))
+}
+
+// fhirR4FindResource retrieves the resource identified by the `resourceType` and `resourceId` parameters, and renders an
+// OperationOutcome if it cannot be found
+func fhirR4FindResource(c *gin.Context, logger *logrus.Entry, databaseRepo database.DatabaseRepository) (*models.ResourceBase, bool) {
+	resourceType := c.Param("resourceType")
+	resourceId := strings.Trim(c.Param("resourceId"), "/")
+	if !lo.Contains(databaseModel.GetAllowedResourceTypes(), resourceType) {
+		fhirR4RenderOperationOutcome(c, http.StatusNotFound, fhir401.IssueTypeNotSupported, fmt.Sprintf("resource type %s is not supported", resourceType))
+		return nil, false
+	}
+
+	//resource ids are only unique within a source, if the same resource was imported from multiple sources the most recent is returned
+	wrappedResourceModels, _, err := databaseRepo.ListResources(c, models.ListResourceQueryOptions{
+		SourceResourceType: resourceType,
+		SourceResourceID:   resourceId,
+		Limit:              1,
+	})
+	if err != nil {
+		logger.Errorln("An error occurred while retrieving resource", err)
+		fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, "an error occurred while retrieving resource")
+		return nil, false
+	} else if len(wrappedResourceModels) == 0 {
+		fhirR4RenderOperationOutcome(c, http.StatusNotFound, fhir401.IssueTypeNotFound, fmt.Sprintf("resource %s/%s is not known", resourceType, resourceId))
+		return nil, false
+	}
+	return &wrappedResourceModels[0], true
+}
+
+func fhirR4CapabilityStatementResource(resourceType string) (fhir401.CapabilityStatementRestResource, error) {
+	capabilityStatementResource := fhir401.CapabilityStatementRestResource{
+		Interaction: []fhir401.CapabilityStatementRestResourceInteraction{
+			{Code: fhir401.TypeRestfulInteractionRead},
+			{Code: fhir401.TypeRestfulInteractionSearchType},
+		},
+	}
+	if err := capabilityStatementResource.Type.UnmarshalJSON([]byte(strconv.Quote(resourceType))); err != nil {
+		return capabilityStatementResource, err
+	}
+
+	resourceModel, err := databaseModel.NewFhirResourceModelByType(resourceType)
+	if err != nil {
+		return capabilityStatementResource, err
+	}
+	searchParameters := resourceModel.GetSearchParameters()
+	searchParameterNames := lo.Keys(searchParameters)
+	sort.Strings(searchParameterNames)
+
+	for _, searchParameterName := range searchParameterNames {
+		searchParameterType := searchParameters[searchParameterName]
+		isInternalColumn := searchParameterName == "id" || strings.Contains(searchParameterName, "_")
+		if (isInternalColumn && searchParameterName != "source_resource_id") || searchParameterType == "special" {
+			//internal columns (eg. id, source_id, sort_date) are not FHIR search parameters, except for source_resource_id (`_id`)
+			continue
+		} else if searchParameterType == "keyword" {
+			searchParameterType = "token"
+		}
+
+		capabilityStatementSearchParam := fhir401.CapabilityStatementRestResourceSearchParam{
+			Name: models.SearchParameterFhirCode(searchParameterName),
+		}
+		if err := capabilityStatementSearchParam.Type.UnmarshalJSON([]byte(strconv.Quote(searchParameterType))); err != nil {
+			continue
+		}
+		capabilityStatementResource.SearchParam = append(capabilityStatementResource.SearchParam, capabilityStatementSearchParam)
+	}
+	return capabilityStatementResource, nil
+}
+
+// fhirR4BaseUrl returns the absolute url of the FHIR R4 facade (including the configured base path), which is used to
+// generate the `fullUrl` of each entry and the paging links of search Bundles
+func fhirR4BaseUrl(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	basePath := c.Request.URL.Path
+	if ndx := strings.Index(basePath, "/fhir/r4"); ndx >= 0 {
+		basePath = basePath[:ndx+len("/fhir/r4")]
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, c.Request.Host, basePath)
+}
+
+// fhirR4SearchUrl returns the absolute url of the current search, with the paging parameters replaced by pageParams
+func fhirR4SearchUrl(c *gin.Context, pageParams map[string]string) string {
+	searchParams := c.Request.URL.Query()
+	if pageParams != nil {
+		searchParams.Del("_cursor")
+		searchParams.Del("_offset")
+		for pageParamName, pageParamValue := range pageParams {
+			searchParams.Set(pageParamName, pageParamValue)
+		}
+	}
+	searchUrl := fmt.Sprintf("%s/%s", fhirR4BaseUrl(c), url.PathEscape(c.Param("resourceType")))
+	if len(searchParams) > 0 {
+		searchUrl += "?" + searchParams.Encode()
+	}
+	return searchUrl
+}
+
+// fhirR4ContentType negotiates the response content type using the `_format` parameter (which overrides the Accept header)
+// https://hl7.org/fhir/r4/http.html#mime-type
+// only json is supported, `application/json` is returned if requested, otherwise `application/fhir+json` is used
+func fhirR4ContentType(c *gin.Context) (string, bool) {
+	acceptedMediaTypes := c.GetHeader("Accept")
+	if format := c.Query("_format"); len(format) > 0 {
+		acceptedMediaTypes = format
+	}
+	if len(strings.TrimSpace(acceptedMediaTypes)) == 0 {
+		return fhirR4ContentTypeFhirJson, true
+	}
+
+	for _, acceptedMediaType := range strings.Split(acceptedMediaTypes, ",") {
+		//ignore media type parameters (eg. `;q=0.9` or `;fhirVersion=4.0`)
+		acceptedMediaType, _, _ = strings.Cut(acceptedMediaType, ";")
+		switch strings.ToLower(strings.TrimSpace(acceptedMediaType)) {
+		case fhirR4ContentTypeFhirJson, "application/json+fhir", "json", "*/*", "application/*":
+			return fhirR4ContentTypeFhirJson, true
+		case fhirR4ContentTypeJson, "text/json":
+			return fhirR4ContentTypeJson, true
+		}
+	}
+	return fhirR4ContentTypeFhirJson, false
+}
+
+// fhirR4Render serializes the FHIR resource using the negotiated content type, or returns a `406 Not Acceptable`
+// OperationOutcome if the client only accepts unsupported formats (eg. xml or turtle)
+func fhirR4Render(c *gin.Context, status int, resource interface{}) {
+	contentType, acceptable := fhirR4ContentType(c)
+	if !acceptable {
+		status = http.StatusNotAcceptable
+		resource = fhirR4OperationOutcome(fhir401.IssueTypeNotSupported, "only json is supported, use application/fhir+json")
+	}
+
+	resourceJson, err := json.Marshal(resource)
+	if err != nil {
+		status = http.StatusInternalServerError
+		resourceJson, _ = json.Marshal(fhirR4OperationOutcome(fhir401.IssueTypeException, err.Error()))
+	}
+	c.Data(status, contentType+"; charset=utf-8", resourceJson)
+}
+
+func fhirR4RenderOperationOutcome(c *gin.Context, status int, issueType fhir401.IssueType, diagnostics string) {
+	fhirR4Render(c, status, fhirR4OperationOutcome(issueType, diagnostics))
+}
+
+func fhirR4OperationOutcome(issueType fhir401.IssueType, diagnostics string) fhir401.OperationOutcome {
+	return fhir401.OperationOutcome{
+		Issue: []fhir401.OperationOutcomeIssue{
+			{
+				Severity:    fhir401.IssueSeverityError,
+				Code:        issueType,
+				Diagnostics: &diagnostics,
+			},
+		},
+	}
+}
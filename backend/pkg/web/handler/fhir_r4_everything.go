@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	databaseModel "github.com/fastenhealth/fasten-onprem/backend/pkg/models/database"
+	sourcePkg "github.com/fastenhealth/fasten-sources/pkg"
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// FhirR4PatientEverything implements the Patient `$everything` operation (https://hl7.org/fhir/r4/patient-operation-everything.html)
+// every resource in the user's record (across all of their sources) is returned in a `collection` Bundle, which is streamed
+// so that large records never need to be loaded into memory.
+// All of the user's resources belong to the same patient, so the instance operation (`Patient/{id}/$everything`) only
+// checks that the Patient exists, the same resources are returned by the type operation (`Patient/$everything`).
+//
+// - `_type` comma separated list of resource types to include
+// - `_since` only include resources which were created or updated after this instant
+// - `start` and `end` only include resources with a clinical date in this range, resources without a date (eg. Patient) are always included
+func FhirR4PatientEverything(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	contentType, acceptable := fhirR4ContentType(c)
+	if !acceptable {
+		fhirR4Render(c, http.StatusNotAcceptable, nil)
+		return
+	}
+
+	if resourceType := c.Param("resourceType"); len(resourceType) > 0 && resourceType != "Patient" {
+		fhirR4RenderOperationOutcome(c, http.StatusNotFound, fhir401.IssueTypeNotSupported, fmt.Sprintf("$everything is not supported for %s", resourceType))
+		return
+	} else if resourceId := c.Param("resourceId"); len(resourceId) > 0 {
+		patientResources, _, err := databaseRepo.ListResources(c, models.ListResourceQueryOptions{SourceResourceType: "Patient", SourceResourceID: resourceId, Limit: 1})
+		if err != nil {
+			logger.Errorln("An error occurred while retrieving patient", err)
+			fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, "an error occurred while retrieving patient")
+			return
+		} else if len(patientResources) == 0 {
+			fhirR4RenderOperationOutcome(c, http.StatusNotFound, fhir401.IssueTypeNotFound, fmt.Sprintf("resource Patient/%s is not known", resourceId))
+			return
+		}
+	}
+
+	exportOptions, err := fhirR4ExportResourceQueryOptions(c)
+	if err != nil {
+		fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeInvalid, err.Error())
+		return
+	}
+
+	//the Bundle is written once the first resource has been exported, so that errors before then can still be returned as an OperationOutcome
+	bundleStarted := false
+	startBundle := func() {
+		bundleStarted = true
+		c.Header("Content-Type", contentType+"; charset=utf-8")
+		c.Status(http.StatusOK)
+		timestamp, _ := json.Marshal(time.Now().Format(time.RFC3339))
+		fmt.Fprintf(c.Writer, `{"resourceType":"Bundle","type":"collection","timestamp":%s,"entry":[`, timestamp)
+	}
+
+	entryCount := 0
+	err = databaseRepo.ExportResources(c, exportOptions, func(resource *models.ResourceBase) error {
+		resourceRaw, err := fhirR4RewriteReferences(resource.ResourceRaw, fhirR4BundleReference(resource.SourceID))
+		if err != nil {
+			return fmt.Errorf("could not rewrite references in %s/%s: %w", resource.SourceResourceType, resource.SourceResourceID, err)
+		}
+		bundleEntry := fhir401.BundleEntry{
+			FullUrl:  lo.ToPtr(fhirR4BundleEntryFullUrl(resource.SourceID, resource.SourceResourceType, resource.SourceResourceID)),
+			Resource: resourceRaw,
+		}
+		//Fasten associations (see related_resources) are included as entry links
+		for _, relatedResource := range resource.RelatedResource {
+			bundleEntry.Link = append(bundleEntry.Link, fhir401.BundleLink{
+				Relation: "related",
+				Url:      fhirR4BundleEntryFullUrl(relatedResource.SourceID, relatedResource.SourceResourceType, relatedResource.SourceResourceID),
+			})
+		}
+		bundleEntryJson, err := json.Marshal(bundleEntry)
+		if err != nil {
+			return err
+		}
+
+		if !bundleStarted {
+			startBundle()
+		} else {
+			c.Writer.WriteString(",")
+		}
+		if _, err := c.Writer.Write(bundleEntryJson); err != nil {
+			return err
+		}
+		entryCount++
+		if entryCount%exportFlushInterval == 0 {
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorln("An error occurred while exporting resources", err)
+		if !bundleStarted {
+			fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, "an error occurred while exporting resources")
+		}
+		//the Bundle is left incomplete (invalid json) so that the client cannot mistake it for the complete record
+		return
+	}
+
+	if !bundleStarted {
+		startBundle()
+	}
+	c.Writer.WriteString("]}")
+}
+
+// exportFlushInterval is the number of Bundle entries written before the response is flushed to the client
+const exportFlushInterval = 100
+
+// fhirR4ExportResourceQueryOptions parses the `_type`, `_since`, `start` and `end` parameters shared by the export operations
+// `start` and `end` are dates, which include their entire period (eg. `end=2023` includes all of 2023)
+func fhirR4ExportResourceQueryOptions(c *gin.Context) (models.ExportResourceQueryOptions, error) {
+	exportOptions := models.ExportResourceQueryOptions{}
+	if len(c.Query("_type")) > 0 {
+		for _, resourceType := range strings.Split(c.Query("_type"), ",") {
+			resourceType = strings.TrimSpace(resourceType)
+			if len(resourceType) == 0 {
+				continue
+			} else if !lo.Contains(databaseModel.GetAllowedResourceTypes(), resourceType) {
+				return exportOptions, fmt.Errorf("_type %s is not supported", resourceType)
+			}
+			exportOptions.SourceResourceTypes = append(exportOptions.SourceResourceTypes, resourceType)
+		}
+	}
+	if len(c.Query("_since")) > 0 {
+		since, err := time.Parse(time.RFC3339, c.Query("_since"))
+		if err != nil {
+			return exportOptions, fmt.Errorf("_since must be an instant, eg. 2023-01-02T15:04:05Z")
+		}
+		exportOptions.Since = &since
+	}
+	if len(c.Query("start")) > 0 {
+		start, _, err := database.SearchParameterDateRange(c.Query("start"))
+		if err != nil {
+			return exportOptions, fmt.Errorf("start must be a date, eg. 2023-01-02")
+		}
+		exportOptions.Start = &start
+	}
+	if len(c.Query("end")) > 0 {
+		_, end, err := database.SearchParameterDateRange(c.Query("end"))
+		if err != nil {
+			return exportOptions, fmt.Errorf("end must be a date, eg. 2023-01-02")
+		}
+		exportOptions.End = &end
+	}
+	return exportOptions, nil
+}
+
+// fhirR4BundleEntryFullUrl returns the `fullUrl` of a resource in a Bundle which contains resources from multiple sources.
+// Resource ids are only unique within a source, so the fullUrl is a name-based uuid (namespaced by the source id), which is
+// the same every time the resource is exported.
+func fhirR4BundleEntryFullUrl(sourceId uuid.UUID, resourceType string, resourceId string) string {
+	return "urn:uuid:" + uuid.NewSHA1(sourceId, []byte(resourceType+"/"+resourceId)).String()
+}
+
+// fhirR4BundleReference rewrites the references in a resource from the given source into the `fullUrl` of the referenced
+// resource (see fhirR4BundleEntryFullUrl), so that references can be resolved within the Bundle.
+// Fasten-internal references (`urn:fastenhealth-fhir:<sourceId>:<resourceType>/<resourceId>`) reference resources in other
+// sources, relative references (`<resourceType>/<resourceId>`) reference resources in the same source.
+func fhirR4BundleReference(sourceId uuid.UUID) func(reference string) string {
+	return func(reference string) string {
+		if strings.HasPrefix(reference, sourcePkg.FASTENHEALTH_URN_PREFIX) {
+			referenceSourceId, resourceType, resourceId, err := sourcePkg.ParseReferenceUri(&reference)
+			if err != nil {
+				return reference
+			}
+			referenceSourceUUID, err := uuid.Parse(referenceSourceId)
+			if err != nil {
+				return reference
+			}
+			return fhirR4BundleEntryFullUrl(referenceSourceUUID, resourceType, resourceId)
+		}
+
+		//absolute urls, contained (`#id`) and versioned references are left unchanged
+		referenceParts := strings.Split(reference, "/")
+		if len(referenceParts) != 2 || len(referenceParts[1]) == 0 || !lo.Contains(databaseModel.GetAllowedResourceTypes(), referenceParts[0]) {
+			return reference
+		}
+		return fhirR4BundleEntryFullUrl(sourceId, referenceParts[0], referenceParts[1])
+	}
+}
+
+// fhirR4AbsoluteReference rewrites the Fasten-internal references in a resource (`urn:fastenhealth-fhir:<sourceId>:<resourceType>/<resourceId>`,
+// used to reference resources in other sources) into the absolute url of the referenced resource
+func fhirR4AbsoluteReference(baseUrl string) func(reference string) string {
+	return func(reference string) string {
+		if !strings.HasPrefix(reference, sourcePkg.FASTENHEALTH_URN_PREFIX) {
+			return reference
+		}
+		_, resourceType, resourceId, err := sourcePkg.ParseReferenceUri(&reference)
+		if err != nil {
+			return reference
+		}
+		return fmt.Sprintf("%s/%s/%s", baseUrl, resourceType, resourceId)
+	}
+}
+
+// fhirR4RewriteReferences rewrites every `reference` in a resource using rewriteReference, resources without references are
+// returned unchanged
+func fhirR4RewriteReferences(resourceRaw []byte, rewriteReference func(reference string) string) (json.RawMessage, error) {
+	if !bytes.Contains(resourceRaw, []byte(`"reference"`)) {
+		return resourceRaw, nil
+	}
+
+	var resource interface{}
+	decoder := json.NewDecoder(bytes.NewReader(resourceRaw))
+	//numbers must not lose precision (eg. decimal values)
+	decoder.UseNumber()
+	if err := decoder.Decode(&resource); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fhirR4RewriteReferenceValues(resource, rewriteReference))
+}
+
+func fhirR4RewriteReferenceValues(value interface{}, rewriteReference func(reference string) string) interface{} {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		for key, childValue := range typedValue {
+			if reference, isString := childValue.(string); isString && key == "reference" {
+				typedValue[key] = rewriteReference(reference)
+			} else {
+				typedValue[key] = fhirR4RewriteReferenceValues(childValue, rewriteReference)
+			}
+		}
+	case []interface{}:
+		for ndx, childValue := range typedValue {
+			typedValue[ndx] = fhirR4RewriteReferenceValues(childValue, rewriteReference)
+		}
+	}
+	return value
+}
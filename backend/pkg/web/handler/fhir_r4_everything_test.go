@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	sourceModels "github.com/fastenhealth/fasten-sources/clients/models"
+	sourcePkg "github.com/fastenhealth/fasten-sources/pkg"
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFhirR4RewriteReferences_WithAbsoluteReference(t *testing.T) {
+	//setup
+	resourceRaw := []byte(`{"resourceType":"Observation","id":"1","valueQuantity":{"value":1.10},"subject":{"reference":"urn:fastenhealth-fhir:3508f8cf-6eb9-4e4b-8174-dd69a493a2b4:Patient/123"},"performer":[{"reference":"Practitioner/456"}]}`)
+
+	//test
+	rewrittenResourceRaw, err := fhirR4RewriteReferences(resourceRaw, fhirR4AbsoluteReference("http://localhost:9090/api/fhir/r4"))
+
+	//assert
+	require.NoError(t, err)
+	require.JSONEq(t, `{"resourceType":"Observation","id":"1","valueQuantity":{"value":1.10},"subject":{"reference":"http://localhost:9090/api/fhir/r4/Patient/123"},"performer":[{"reference":"Practitioner/456"}]}`, string(rewrittenResourceRaw))
+	require.Contains(t, string(rewrittenResourceRaw), `"value":1.10`, "decimal precision must be preserved")
+
+	//resources without references are unchanged
+	unchangedResourceRaw, err := fhirR4RewriteReferences([]byte(`{"resourceType":"Patient","id":"123"}`), fhirR4AbsoluteReference("http://localhost:9090/api/fhir/r4"))
+	require.NoError(t, err)
+	require.Equal(t, `{"resourceType":"Patient","id":"123"}`, string(unchangedResourceRaw))
+}
+
+func TestFhirR4RewriteReferences_WithBundleReference(t *testing.T) {
+	//setup
+	sourceId := uuid.MustParse("4aa5e2b4-1e0c-4b1a-8a8d-7d3d0c1b2f3e")
+	otherSourceId := uuid.MustParse("3508f8cf-6eb9-4e4b-8174-dd69a493a2b4")
+	resourceRaw := []byte(`{"resourceType":"Observation","id":"1","subject":{"reference":"urn:fastenhealth-fhir:3508f8cf-6eb9-4e4b-8174-dd69a493a2b4:Patient/123"},"performer":[{"reference":"Practitioner/456"},{"reference":"#contained"},{"reference":"https://example.com/fhir/Practitioner/789"}]}`)
+
+	//test
+	rewrittenResourceRaw, err := fhirR4RewriteReferences(resourceRaw, fhirR4BundleReference(sourceId))
+
+	//assert
+	require.NoError(t, err)
+	require.JSONEq(t, `{"resourceType":"Observation","id":"1","subject":{"reference":"`+fhirR4BundleEntryFullUrl(otherSourceId, "Patient", "123")+`"},"performer":[{"reference":"`+fhirR4BundleEntryFullUrl(sourceId, "Practitioner", "456")+`"},{"reference":"#contained"},{"reference":"https://example.com/fhir/Practitioner/789"}]}`, string(rewrittenResourceRaw))
+	require.NotEqual(t, fhirR4BundleEntryFullUrl(sourceId, "Patient", "123"), fhirR4BundleEntryFullUrl(otherSourceId, "Patient", "123"))
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4PatientEverythingHandler() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "http://localhost:9090/api/fhir/r4/Patient/57959813-8cd2-4e3c-8970-e4364b74980a/$everything?_type=Patient,Encounter", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+	ctx.Params = []gin.Param{{Key: "resourceType", Value: "Patient"}, {Key: "resourceId", Value: "57959813-8cd2-4e3c-8970-e4364b74980a"}}
+
+	FhirR4PatientEverything(ctx)
+
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	require.Equal(suite.T(), "application/fhir+json; charset=utf-8", w.Header().Get("Content-Type"))
+	require.True(suite.T(), json.Valid(w.Body.Bytes()))
+	bundle, err := fhir401.UnmarshalBundle(w.Body.Bytes())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), fhir401.BundleTypeCollection, bundle.Type)
+
+	//every Patient and Encounter must be included
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+	patientResources, _, err := suite.AppRepository.ListResources(authContext, models.ListResourceQueryOptions{SourceResourceType: "Patient"})
+	require.NoError(suite.T(), err)
+	encounterResources, encounterPagination, err := suite.AppRepository.ListResources(authContext, models.ListResourceQueryOptions{SourceResourceType: "Encounter", Limit: 1})
+	require.NoError(suite.T(), err)
+	require.NotEmpty(suite.T(), encounterResources)
+	require.Len(suite.T(), bundle.Entry, len(patientResources)+int(encounterPagination.Total))
+
+	for _, entry := range bundle.Entry {
+		var resource map[string]interface{}
+		require.NoError(suite.T(), json.Unmarshal(entry.Resource, &resource))
+		require.Contains(suite.T(), []string{"Patient", "Encounter"}, resource["resourceType"])
+		require.Equal(suite.T(), fhirR4BundleEntryFullUrl(suite.SourceId, resource["resourceType"].(string), resource["id"].(string)), lo.FromPtr(entry.FullUrl))
+	}
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4PatientEverythingHandler_WithSameIdInMultipleSources() {
+	//setup
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+	sourceCredential, err := suite.AppRepository.GetSource(authContext, suite.SourceId.String())
+	require.NoError(suite.T(), err)
+	otherSourceCredential := &models.SourceCredential{SourceType: sourcePkg.SourceTypeManual, Patient: "everything"}
+	require.NoError(suite.T(), suite.AppRepository.CreateSource(authContext, otherSourceCredential))
+
+	for _, rawResource := range []struct {
+		source      *models.SourceCredential
+		resourceId  string
+		resourceRaw string
+	}{
+		{sourceCredential, "everything-device", `{"resourceType":"Device","id":"everything-device","status":"active"}`},
+		{sourceCredential, "everything-linked-device", `{"resourceType":"Device","id":"everything-linked-device","parent":{"reference":"urn:fastenhealth-fhir:` + otherSourceCredential.ID.String() + `:Device/everything-device"}}`},
+		{otherSourceCredential, "everything-device", `{"resourceType":"Device","id":"everything-device","status":"inactive"}`},
+		{otherSourceCredential, "everything-child-device", `{"resourceType":"Device","id":"everything-child-device","parent":{"reference":"Device/everything-device"}}`},
+	} {
+		_, err := suite.AppRepository.UpsertRawResource(authContext, rawResource.source, sourceModels.RawResourceFhir{
+			SourceResourceType: "Device",
+			SourceResourceID:   rawResource.resourceId,
+			ResourceRaw:        []byte(rawResource.resourceRaw),
+		})
+		require.NoError(suite.T(), err)
+	}
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	req, err := http.NewRequest("GET", "http://localhost:9090/api/fhir/r4/Patient/$everything?_type=Device", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+
+	//test
+	FhirR4PatientEverything(ctx)
+
+	//assert
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	bundle, err := fhir401.UnmarshalBundle(w.Body.Bytes())
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), bundle.Entry, 4)
+
+	devices := map[string]fhir401.Device{}
+	for _, entry := range bundle.Entry {
+		device, err := fhir401.UnmarshalDevice(entry.Resource)
+		require.NoError(suite.T(), err)
+		require.NotContains(suite.T(), devices, lo.FromPtr(entry.FullUrl), "fullUrl must be unique")
+		devices[lo.FromPtr(entry.FullUrl)] = device
+	}
+	deviceFullUrl := fhirR4BundleEntryFullUrl(suite.SourceId, "Device", "everything-device")
+	otherDeviceFullUrl := fhirR4BundleEntryFullUrl(otherSourceCredential.ID, "Device", "everything-device")
+	require.Equal(suite.T(), fhir401.FHIRDeviceStatusActive, *devices[deviceFullUrl].Status)
+	require.Equal(suite.T(), fhir401.FHIRDeviceStatusInactive, *devices[otherDeviceFullUrl].Status)
+
+	//references resolve to the entry from the referenced source
+	linkedDevice := devices[fhirR4BundleEntryFullUrl(suite.SourceId, "Device", "everything-linked-device")]
+	require.Equal(suite.T(), otherDeviceFullUrl, *linkedDevice.Parent.Reference)
+	childDevice := devices[fhirR4BundleEntryFullUrl(otherSourceCredential.ID, "Device", "everything-child-device")]
+	require.Equal(suite.T(), otherDeviceFullUrl, *childDevice.Parent.Reference)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4PatientEverythingHandler_WithStart() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	//none of the Encounters are in the future
+	req, err := http.NewRequest("GET", "http://localhost:9090/api/fhir/r4/Patient/$everything?_type=Encounter&start=2200", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+
+	FhirR4PatientEverything(ctx)
+
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	bundle, err := fhir401.UnmarshalBundle(w.Body.Bytes())
+	require.NoError(suite.T(), err)
+	require.Empty(suite.T(), bundle.Entry)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4PatientEverythingHandler_WithInvalidParameters() {
+	var everythingTests = []struct {
+		path           string
+		params         []gin.Param
+		expectedStatus int
+		expectedIssue  fhir401.IssueType
+	}{
+		{"/api/fhir/r4/Patient/$everything?_type=Unknown", nil, http.StatusBadRequest, fhir401.IssueTypeInvalid},
+		{"/api/fhir/r4/Patient/$everything?_since=2023", nil, http.StatusBadRequest, fhir401.IssueTypeInvalid},
+		{"/api/fhir/r4/Patient/$everything?end=abc", nil, http.StatusBadRequest, fhir401.IssueTypeInvalid},
+		{"/api/fhir/r4/Patient/does-not-exist/$everything", []gin.Param{{Key: "resourceType", Value: "Patient"}, {Key: "resourceId", Value: "does-not-exist"}}, http.StatusNotFound, fhir401.IssueTypeNotFound},
+		{"/api/fhir/r4/Observation/123/$everything", []gin.Param{{Key: "resourceType", Value: "Observation"}, {Key: "resourceId", Value: "123"}}, http.StatusNotFound, fhir401.IssueTypeNotSupported},
+	}
+
+	for ndx, tt := range everythingTests {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		setupGinContext(ctx, suite)
+		req, err := http.NewRequest("GET", tt.path, nil)
+		require.NoError(suite.T(), err)
+		ctx.Request = req
+		ctx.Params = tt.params
+
+		FhirR4PatientEverything(ctx)
+
+		require.Equal(suite.T(), tt.expectedStatus, w.Code, "Expected status to match for everythingTests[%d]", ndx)
+		operationOutcome, err := fhir401.UnmarshalOperationOutcome(w.Body.Bytes())
+		require.NoError(suite.T(), err)
+		require.Equal(suite.T(), tt.expectedIssue, operationOutcome.Issue[0].Code, "Expected issue to match for everythingTests[%d]", ndx)
+	}
+}
@@ -0,0 +1,284 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/config"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/job_runner"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// The Bulk Data export (https://hl7.org/fhir/uv/bulkdata/export.html) writes every resource in the user's record to NDJSON files
+// using a background job (processed by the job runner). The kick-off request returns the url of the status endpoint, which returns a manifest listing the
+// files once the export is complete. Files can only be downloaded by the user who requested the export, and are removed once the
+// export is deleted, or has expired (see `export.retention_hours`).
+
+const fhirR4ContentTypeNdjson = "application/fhir+ndjson"
+
+// FhirR4ExportKickoff starts a system (`$export`) or patient (`Patient/$export`) level export, since all of the user's
+// resources belong to the same patient, both export the same resources.
+//
+// - `_outputFormat` only NDJSON is supported
+// - `_type` comma separated list of resource types to include
+// - `_since` only include resources which were created or updated after this instant
+func FhirR4ExportKickoff(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+	jobRunner := c.MustGet(pkg.ContextKeyTypeJobRunner).(job_runner.Interface)
+
+	if _, acceptable := fhirR4ContentType(c); !acceptable {
+		fhirR4Render(c, http.StatusNotAcceptable, nil)
+		return
+	}
+	if outputFormat := c.Query("_outputFormat"); len(outputFormat) > 0 && !lo.Contains([]string{fhirR4ContentTypeNdjson, "application/ndjson", "ndjson"}, outputFormat) {
+		fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeNotSupported, fmt.Sprintf("_outputFormat %s is not supported", outputFormat))
+		return
+	}
+
+	exportOptions, err := fhirR4ExportResourceQueryOptions(c)
+	if err != nil {
+		fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeInvalid, err.Error())
+		return
+	}
+
+	baseUrl := fhirR4BaseUrl(c)
+	backgroundJob := models.NewExportBackgroundJob(models.BackgroundJobExportData{
+		Request:         fhirR4RequestUrl(c),
+		BaseUrl:         baseUrl,
+		ResourceTypes:   exportOptions.SourceResourceTypes,
+		Since:           exportOptions.Since,
+		TransactionTime: time.Now(),
+	})
+	err = databaseRepo.CreateBackgroundJob(c, backgroundJob)
+	if err != nil {
+		logger.Errorln("An error occurred while creating background job", err)
+		fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, "an error occurred while creating background job")
+		return
+	}
+
+	//the export is processed by the job runner (see NewBackgroundJobExportResourcesJobHandler)
+	jobRunner.Notify()
+
+	c.Header("Content-Location", fmt.Sprintf("%s/$export-status/%s", baseUrl, backgroundJob.ID.String()))
+	c.Status(http.StatusAccepted)
+	c.Writer.WriteHeaderNow()
+}
+
+// FhirR4ExportStatus returns the progress of an export while it's running, and the manifest once it's complete
+func FhirR4ExportStatus(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+	appConfig := c.MustGet(pkg.ContextKeyTypeConfig).(config.Interface)
+
+	backgroundJob, exportData, found := fhirR4ExportBackgroundJob(c, logger, databaseRepo)
+	if !found {
+		return
+	}
+
+	switch backgroundJob.JobStatus {
+	case pkg.BackgroundJobStatusDone:
+		if fhirR4ExportExpired(appConfig, backgroundJob) {
+			fhirR4RenderOperationOutcome(c, http.StatusNotFound, fhir401.IssueTypeNotFound, fmt.Sprintf("export %s has expired", backgroundJob.ID.String()))
+			return
+		}
+		manifest := fhirR4ExportManifest{
+			TransactionTime:     exportData.TransactionTime.Format(time.RFC3339),
+			Request:             exportData.Request,
+			RequiresAccessToken: true,
+			Output:              []fhirR4ExportManifestOutput{},
+			Error:               []fhirR4ExportManifestOutput{},
+		}
+		baseUrl := fhirR4BaseUrl(c)
+		for _, output := range exportData.Output {
+			manifest.Output = append(manifest.Output, fhirR4ExportManifestOutput{
+				Type:  output.Type,
+				Url:   fmt.Sprintf("%s/$export-file/%s/%s", baseUrl, backgroundJob.ID.String(), output.FileName),
+				Count: output.Count,
+			})
+		}
+		c.JSON(http.StatusOK, manifest)
+	case pkg.BackgroundJobStatusFailed:
+		diagnostics := "export failed"
+		if finalErr, ok := exportData.ErrorData["final"].(string); ok {
+			diagnostics = finalErr
+		}
+		fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, diagnostics)
+	case pkg.BackgroundJobStatusCancelled:
+		fhirR4RenderOperationOutcome(c, http.StatusNotFound, fhir401.IssueTypeNotFound, fmt.Sprintf("export %s was cancelled", backgroundJob.ID.String()))
+	default:
+		progress := "in progress"
+		if resourceCount, ok := exportData.CheckpointData["resource_count"]; ok {
+			progress = fmt.Sprintf("exported %v resources (%v)", resourceCount, exportData.CheckpointData["resource_type"])
+		}
+		c.Header("X-Progress", progress)
+		c.Header("Retry-After", "5")
+		c.Status(http.StatusAccepted)
+		c.Writer.WriteHeaderNow()
+	}
+}
+
+// FhirR4ExportFile downloads one of the NDJSON files listed in the manifest of a completed export
+func FhirR4ExportFile(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+	appConfig := c.MustGet(pkg.ContextKeyTypeConfig).(config.Interface)
+
+	backgroundJob, exportData, found := fhirR4ExportBackgroundJob(c, logger, databaseRepo)
+	if !found {
+		return
+	}
+
+	//only files listed in the manifest can be downloaded, the file name is never used to build a path otherwise
+	output, found := lo.Find(exportData.Output, func(output models.BackgroundJobExportOutput) bool {
+		return output.FileName == c.Param("fileName")
+	})
+	if backgroundJob.JobStatus != pkg.BackgroundJobStatusDone || !found || fhirR4ExportExpired(appConfig, backgroundJob) {
+		fhirR4RenderOperationOutcome(c, http.StatusNotFound, fhir401.IssueTypeNotFound, fmt.Sprintf("export file %s is not known", c.Param("fileName")))
+		return
+	}
+
+	exportDir := getExportDir(appConfig, backgroundJob.UserID.String(), backgroundJob.ID.String())
+	c.Header("Content-Type", fhirR4ContentTypeNdjson)
+	c.File(filepath.Join(exportDir, output.FileName))
+}
+
+// FhirR4ExportDelete cancels an export which is queued or running, or removes the files of a completed export
+// (https://hl7.org/fhir/uv/bulkdata/export.html#bulk-data-delete-request). The status endpoint returns 404 afterwards.
+func FhirR4ExportDelete(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+	appConfig := c.MustGet(pkg.ContextKeyTypeConfig).(config.Interface)
+	jobRunner := c.MustGet(pkg.ContextKeyTypeJobRunner).(job_runner.Interface)
+
+	backgroundJob, exportData, found := fhirR4ExportBackgroundJob(c, logger, databaseRepo)
+	if !found {
+		return
+	}
+
+	jobStatus := backgroundJob.JobStatus
+	if jobStatus == pkg.BackgroundJobStatusReady {
+		cancelled, err := databaseRepo.CancelBackgroundJob(c, backgroundJob.ID.String())
+		if err != nil {
+			logger.Errorln("An error occurred while cancelling export background job", err)
+			fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, "an error occurred while cancelling export")
+			return
+		}
+		if !cancelled {
+			//the job was claimed by the job runner while it was being cancelled, so it's cancelled as a running job instead
+			jobStatus = pkg.BackgroundJobStatusLocked
+		}
+	}
+
+	switch jobStatus {
+	case pkg.BackgroundJobStatusReady:
+		//the queued export was cancelled
+	case pkg.BackgroundJobStatusLocked:
+		//the export files are removed by the job handler once it stops
+		if !jobRunner.Cancel(backgroundJob.ID.String()) {
+			fhirR4RenderOperationOutcome(c, http.StatusConflict, fhir401.IssueTypeConflict, fmt.Sprintf("export %s cannot be cancelled, it is not running", backgroundJob.ID.String()))
+			return
+		}
+	case pkg.BackgroundJobStatusCancelled:
+		fhirR4RenderOperationOutcome(c, http.StatusNotFound, fhir401.IssueTypeNotFound, fmt.Sprintf("export %s was cancelled", backgroundJob.ID.String()))
+		return
+	default:
+		exportDir := getExportDir(appConfig, backgroundJob.UserID.String(), backgroundJob.ID.String())
+		if err := os.RemoveAll(exportDir); err != nil {
+			logger.Errorln("An error occurred while removing export directory", err)
+			fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, "an error occurred while removing export files")
+			return
+		}
+
+		now := time.Now()
+		exportData.DeletedTime = &now
+		exportDataJson, err := json.Marshal(exportData)
+		if err != nil {
+			logger.Errorln("An error occurred while serializing export background job data", err)
+			fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, "an error occurred while deleting export")
+			return
+		}
+		backgroundJob.Data = exportDataJson
+		if err := databaseRepo.UpdateBackgroundJob(c, backgroundJob); err != nil {
+			logger.Errorln("An error occurred while updating export background job", err)
+			fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, "an error occurred while deleting export")
+			return
+		}
+	}
+
+	c.Status(http.StatusAccepted)
+	c.Writer.WriteHeaderNow()
+}
+
+// fhirR4ExportBackgroundJob retrieves the export background job identified by the `jobId` parameter, and renders an
+// OperationOutcome if it cannot be found (background jobs are only visible to the user who created them)
+func fhirR4ExportBackgroundJob(c *gin.Context, logger *logrus.Entry, databaseRepo database.DatabaseRepository) (*models.BackgroundJob, models.BackgroundJobExportData, bool) {
+	var exportData models.BackgroundJobExportData
+	backgroundJob, err := databaseRepo.GetBackgroundJob(c, c.Param("jobId"))
+	if err != nil || backgroundJob.JobType != pkg.BackgroundJobTypeExport {
+		logger.Warnln("An error occurred while retrieving export background job", err)
+		fhirR4RenderOperationOutcome(c, http.StatusNotFound, fhir401.IssueTypeNotFound, fmt.Sprintf("export %s is not known", c.Param("jobId")))
+		return nil, exportData, false
+	}
+	if backgroundJob.Data != nil {
+		if err := json.Unmarshal(backgroundJob.Data, &exportData); err != nil {
+			logger.Errorln("An error occurred while parsing export background job data", err)
+			fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, "an error occurred while parsing export")
+			return nil, exportData, false
+		}
+	}
+	if exportData.DeletedTime != nil {
+		fhirR4RenderOperationOutcome(c, http.StatusNotFound, fhir401.IssueTypeNotFound, fmt.Sprintf("export %s was deleted", c.Param("jobId")))
+		return nil, exportData, false
+	}
+	return backgroundJob, exportData, true
+}
+
+// fhirR4ExportExpired returns true if the files of a completed export have expired, and have been (or will be) removed by
+// RemoveExpiredExports
+func fhirR4ExportExpired(appConfig config.Interface, backgroundJob *models.BackgroundJob) bool {
+	retentionHours := appConfig.GetInt("export.retention_hours")
+	if retentionHours <= 0 || backgroundJob.DoneTime == nil {
+		return false
+	}
+	return backgroundJob.DoneTime.Add(time.Duration(retentionHours) * time.Hour).Before(time.Now())
+}
+
+// fhirR4ExportManifest is the response of a completed export (https://hl7.org/fhir/uv/bulkdata/export.html#response---complete-status)
+type fhirR4ExportManifest struct {
+	TransactionTime     string                       `json:"transactionTime"`
+	Request             string                       `json:"request"`
+	RequiresAccessToken bool                         `json:"requiresAccessToken"`
+	Output              []fhirR4ExportManifestOutput `json:"output"`
+	Error               []fhirR4ExportManifestOutput `json:"error"`
+}
+
+type fhirR4ExportManifestOutput struct {
+	Type  string `json:"type"`
+	Url   string `json:"url"`
+	Count int    `json:"count,omitempty"`
+}
+
+// fhirR4RequestUrl returns the absolute url of the current request (including the query string)
+func fhirR4RequestUrl(c *gin.Context) string {
+	requestUri := c.Request.URL.RequestURI()
+	if ndx := strings.Index(requestUri, "/fhir/r4"); ndx >= 0 {
+		requestUri = requestUri[ndx+len("/fhir/r4"):]
+	}
+	return fhirR4BaseUrl(c) + requestUri
+}
+
+func getExportDir(appConfig config.Interface, currentUserId string, backgroundJobId string) string {
+	return filepath.Join(appConfig.GetString("cache.location"), currentUserId, "export", backgroundJobId)
+}
@@ -0,0 +1,296 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	mock_job_runner "github.com/fastenhealth/fasten-onprem/backend/pkg/job_runner/mock"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// kickoffFhirR4Export starts an export, and returns the url of the status endpoint and the id of the queued export job
+func kickoffFhirR4Export(suite *ResourceFhirHandlerTestSuite, exportUrl string) (string, string) {
+	fakeJobRunner := mock_job_runner.NewMockInterface(suite.MockCtrl)
+	fakeJobRunner.EXPECT().Notify()
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	ctx.Set(pkg.ContextKeyTypeJobRunner, fakeJobRunner)
+	req, err := http.NewRequest("GET", exportUrl, nil)
+	require.NoError(suite.T(), err)
+	req.Header.Set("Prefer", "respond-async")
+	ctx.Request = req
+
+	FhirR4ExportKickoff(ctx)
+
+	require.Equal(suite.T(), http.StatusAccepted, w.Code)
+	contentLocation := w.Header().Get("Content-Location")
+	require.True(suite.T(), strings.HasPrefix(contentLocation, "http://localhost:9090/api/fhir/r4/$export-status/"))
+	return contentLocation, strings.TrimPrefix(contentLocation, "http://localhost:9090/api/fhir/r4/$export-status/")
+}
+
+// runFhirR4ExportJob processes the queued export job, as it would be by the job runner. The job is locked directly, since
+// claiming a job could return a job queued by another test.
+func runFhirR4ExportJob(suite *ResourceFhirHandlerTestSuite, ctx context.Context, jobId string) error {
+	backgroundJobContext := CreateBackgroundJobContext(context.WithValue(ctx, pkg.ContextKeyTypeAuthUsername, "test_user"), jobId)
+	backgroundJob, err := suite.AppRepository.GetBackgroundJob(DetachBackgroundJobContext(backgroundJobContext), jobId)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), pkg.BackgroundJobStatusReady, backgroundJob.JobStatus)
+	now := time.Now()
+	backgroundJob.JobStatus = pkg.BackgroundJobStatusLocked
+	backgroundJob.LockedTime = &now
+	require.NoError(suite.T(), suite.AppRepository.UpdateBackgroundJob(DetachBackgroundJobContext(backgroundJobContext), backgroundJob))
+
+	jobHandler := NewBackgroundJobExportResourcesJobHandler(suite.AppConfig)
+	return jobHandler(backgroundJobContext, logrus.WithField("test", suite.T().Name()), suite.AppRepository, suite.AppEventBus, backgroundJob)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4ExportHandler() {
+	//kick-off
+	contentLocation, jobId := kickoffFhirR4Export(suite, "http://localhost:9090/api/fhir/r4/$export?_type=Patient,Encounter&_outputFormat=application/fhir%2Bndjson")
+
+	//the export is in progress until the job is processed
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	ctx.Request, _ = http.NewRequest("GET", contentLocation, nil)
+	ctx.Params = []gin.Param{{Key: "jobId", Value: jobId}}
+	FhirR4ExportStatus(ctx)
+	require.Equal(suite.T(), http.StatusAccepted, w.Code)
+
+	require.NoError(suite.T(), runFhirR4ExportJob(suite, context.Background(), jobId))
+
+	//the manifest is returned once the export is complete
+	w = httptest.NewRecorder()
+	ctx, _ = gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	ctx.Request, _ = http.NewRequest("GET", contentLocation, nil)
+	ctx.Params = []gin.Param{{Key: "jobId", Value: jobId}}
+	FhirR4ExportStatus(ctx)
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	var manifest fhirR4ExportManifest
+	require.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &manifest))
+
+	require.True(suite.T(), manifest.RequiresAccessToken)
+	require.Equal(suite.T(), "http://localhost:9090/api/fhir/r4/$export?_type=Patient,Encounter&_outputFormat=application/fhir%2Bndjson", manifest.Request)
+	require.Len(suite.T(), manifest.Output, 2)
+	require.Equal(suite.T(), "Patient", manifest.Output[0].Type)
+	require.Equal(suite.T(), "http://localhost:9090/api/fhir/r4/$export-file/"+jobId+"/Patient.ndjson", manifest.Output[0].Url)
+	require.Equal(suite.T(), "Encounter", manifest.Output[1].Type)
+	require.Empty(suite.T(), manifest.Error)
+
+	//the export contains the user's record, so it's only readable by the server
+	backgroundJob, err := suite.AppRepository.GetBackgroundJob(context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user"), jobId)
+	require.NoError(suite.T(), err)
+	exportDir := filepath.Join(suite.TestCacheDir, backgroundJob.UserID.String(), "export", jobId)
+	exportDirInfo, err := os.Stat(exportDir)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), os.FileMode(0700), exportDirInfo.Mode().Perm())
+	exportFileInfo, err := os.Stat(filepath.Join(exportDir, "Patient.ndjson"))
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), os.FileMode(0600), exportFileInfo.Mode().Perm())
+
+	//download each file, every line is a single resource
+	for _, output := range manifest.Output {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		setupGinContext(ctx, suite)
+		ctx.Request, _ = http.NewRequest("GET", output.Url, nil)
+		ctx.Params = []gin.Param{{Key: "jobId", Value: jobId}, {Key: "fileName", Value: output.Type + ".ndjson"}}
+
+		FhirR4ExportFile(ctx)
+
+		require.Equal(suite.T(), http.StatusOK, w.Code)
+		require.Equal(suite.T(), "application/fhir+ndjson", w.Header().Get("Content-Type"))
+		lineCount := 0
+		scanner := bufio.NewScanner(bytes.NewReader(w.Body.Bytes()))
+		scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024)
+		for scanner.Scan() {
+			var resource map[string]interface{}
+			require.NoError(suite.T(), json.Unmarshal(scanner.Bytes(), &resource))
+			require.Equal(suite.T(), output.Type, resource["resourceType"])
+			lineCount++
+		}
+		require.NoError(suite.T(), scanner.Err())
+		require.Equal(suite.T(), output.Count, lineCount)
+	}
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4ExportHandler_WithInvalidParameters() {
+	var exportTests = []struct {
+		path           string
+		expectedStatus int
+		expectedIssue  fhir401.IssueType
+	}{
+		{"/api/fhir/r4/$export?_type=Unknown", http.StatusBadRequest, fhir401.IssueTypeInvalid},
+		{"/api/fhir/r4/$export?_since=2023", http.StatusBadRequest, fhir401.IssueTypeInvalid},
+		{"/api/fhir/r4/$export?_outputFormat=text/csv", http.StatusBadRequest, fhir401.IssueTypeNotSupported},
+	}
+
+	for ndx, tt := range exportTests {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		setupGinContext(ctx, suite)
+		ctx.Set(pkg.ContextKeyTypeJobRunner, mock_job_runner.NewMockInterface(suite.MockCtrl))
+		req, err := http.NewRequest("GET", tt.path, nil)
+		require.NoError(suite.T(), err)
+		ctx.Request = req
+
+		FhirR4ExportKickoff(ctx)
+
+		require.Equal(suite.T(), tt.expectedStatus, w.Code, "Expected status to match for exportTests[%d]", ndx)
+		operationOutcome, err := fhir401.UnmarshalOperationOutcome(w.Body.Bytes())
+		require.NoError(suite.T(), err)
+		require.Equal(suite.T(), tt.expectedIssue, operationOutcome.Issue[0].Code, "Expected issue to match for exportTests[%d]", ndx)
+	}
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4ExportHandler_WithCancelledJob() {
+	contentLocation, jobId := kickoffFhirR4Export(suite, "http://localhost:9090/api/fhir/r4/$export?_type=Patient")
+
+	//the job context is cancelled when the job is cancelled (see job_runner.Interface.Cancel)
+	cancelledContext, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(suite.T(), runFhirR4ExportJob(suite, cancelledContext, jobId))
+
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+	cancelledBackgroundJob, err := suite.AppRepository.GetBackgroundJob(authContext, jobId)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), pkg.BackgroundJobStatusCancelled, cancelledBackgroundJob.JobStatus)
+	require.NoDirExists(suite.T(), filepath.Join(suite.TestCacheDir, cancelledBackgroundJob.UserID.String(), "export", jobId))
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	ctx.Request, _ = http.NewRequest("GET", contentLocation, nil)
+	ctx.Params = []gin.Param{{Key: "jobId", Value: jobId}}
+	FhirR4ExportStatus(ctx)
+	require.Equal(suite.T(), http.StatusNotFound, w.Code)
+}
+
+// callFhirR4ExportStatusHandler calls the status endpoint handler (GET or DELETE) for the export job
+func callFhirR4ExportStatusHandler(suite *ResourceFhirHandlerTestSuite, jobRunner *mock_job_runner.MockInterface, handlerFn gin.HandlerFunc, method string, jobId string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	ctx.Set(pkg.ContextKeyTypeJobRunner, jobRunner)
+	ctx.Request, _ = http.NewRequest(method, "http://localhost:9090/api/fhir/r4/$export-status/"+jobId, nil)
+	ctx.Params = []gin.Param{{Key: "jobId", Value: jobId}}
+	handlerFn(ctx)
+	return w
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4ExportDeleteHandler() {
+	fakeJobRunner := mock_job_runner.NewMockInterface(suite.MockCtrl)
+
+	//a queued export is cancelled
+	_, queuedJobId := kickoffFhirR4Export(suite, "http://localhost:9090/api/fhir/r4/$export?_type=Patient")
+	w := callFhirR4ExportStatusHandler(suite, fakeJobRunner, FhirR4ExportDelete, http.MethodDelete, queuedJobId)
+	require.Equal(suite.T(), http.StatusAccepted, w.Code)
+	w = callFhirR4ExportStatusHandler(suite, fakeJobRunner, FhirR4ExportStatus, http.MethodGet, queuedJobId)
+	require.Equal(suite.T(), http.StatusNotFound, w.Code)
+
+	//a running export is cancelled by the job runner
+	_, runningJobId := kickoffFhirR4Export(suite, "http://localhost:9090/api/fhir/r4/$export?_type=Patient")
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+	runningBackgroundJob, err := suite.AppRepository.GetBackgroundJob(authContext, runningJobId)
+	require.NoError(suite.T(), err)
+	runningBackgroundJob.JobStatus = pkg.BackgroundJobStatusLocked
+	require.NoError(suite.T(), suite.AppRepository.UpdateBackgroundJob(authContext, runningBackgroundJob))
+	fakeJobRunner.EXPECT().Cancel(runningJobId).Return(true)
+	w = callFhirR4ExportStatusHandler(suite, fakeJobRunner, FhirR4ExportDelete, http.MethodDelete, runningJobId)
+	require.Equal(suite.T(), http.StatusAccepted, w.Code)
+
+	//the files of a completed export are removed
+	_, completedJobId := kickoffFhirR4Export(suite, "http://localhost:9090/api/fhir/r4/$export?_type=Patient")
+	require.NoError(suite.T(), runFhirR4ExportJob(suite, context.Background(), completedJobId))
+	completedBackgroundJob, err := suite.AppRepository.GetBackgroundJob(authContext, completedJobId)
+	require.NoError(suite.T(), err)
+	exportDir := filepath.Join(suite.TestCacheDir, completedBackgroundJob.UserID.String(), "export", completedJobId)
+	require.DirExists(suite.T(), exportDir)
+
+	w = callFhirR4ExportStatusHandler(suite, fakeJobRunner, FhirR4ExportDelete, http.MethodDelete, completedJobId)
+	require.Equal(suite.T(), http.StatusAccepted, w.Code)
+	require.NoDirExists(suite.T(), exportDir)
+	w = callFhirR4ExportStatusHandler(suite, fakeJobRunner, FhirR4ExportStatus, http.MethodGet, completedJobId)
+	require.Equal(suite.T(), http.StatusNotFound, w.Code)
+	w = callFhirR4ExportStatusHandler(suite, fakeJobRunner, FhirR4ExportDelete, http.MethodDelete, completedJobId)
+	require.Equal(suite.T(), http.StatusNotFound, w.Code)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestRemoveExpiredExports() {
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+
+	//setup
+	now := time.Now()
+	createCompletedExport := func(doneTime time.Time) (*models.BackgroundJob, string) {
+		backgroundJob := models.NewExportBackgroundJob(models.BackgroundJobExportData{})
+		require.NoError(suite.T(), suite.AppRepository.CreateBackgroundJob(authContext, backgroundJob))
+		backgroundJob.JobStatus = pkg.BackgroundJobStatusDone
+		backgroundJob.DoneTime = &doneTime
+		require.NoError(suite.T(), suite.AppRepository.UpdateBackgroundJob(authContext, backgroundJob))
+		exportDir := getExportDir(suite.AppConfig, backgroundJob.UserID.String(), backgroundJob.ID.String())
+		require.NoError(suite.T(), os.MkdirAll(exportDir, 0700))
+		//the directory modification time is not used, only the job completion time
+		require.NoError(suite.T(), os.Chtimes(exportDir, now, now))
+		return backgroundJob, exportDir
+	}
+	expiredBackgroundJob, expiredExportDir := createCompletedExport(now.Add(-25 * time.Hour))
+	currentBackgroundJob, currentExportDir := createCompletedExport(now.Add(-1 * time.Hour))
+	dashboardDir := filepath.Join(suite.TestCacheDir, expiredBackgroundJob.UserID.String(), "dashboard", "gist")
+	require.NoError(suite.T(), os.MkdirAll(dashboardDir, 0700))
+	expiredTime := now.Add(-25 * time.Hour)
+	require.NoError(suite.T(), os.Chtimes(dashboardDir, expiredTime, expiredTime))
+
+	//test
+	removeExpiredExports(context.Background(), suite.AppConfig, logrus.WithField("test", suite.T().Name()), suite.AppRepository, now)
+
+	//assert
+	require.NoDirExists(suite.T(), expiredExportDir)
+	require.DirExists(suite.T(), currentExportDir)
+	require.DirExists(suite.T(), dashboardDir)
+
+	updatedBackgroundJob, err := suite.AppRepository.GetBackgroundJob(authContext, expiredBackgroundJob.ID.String())
+	require.NoError(suite.T(), err)
+	var exportData models.BackgroundJobExportData
+	require.NoError(suite.T(), json.Unmarshal(updatedBackgroundJob.Data, &exportData))
+	require.NotNil(suite.T(), exportData.DeletedTime)
+	updatedBackgroundJob, err = suite.AppRepository.GetBackgroundJob(authContext, currentBackgroundJob.ID.String())
+	require.NoError(suite.T(), err)
+	exportData = models.BackgroundJobExportData{}
+	require.NoError(suite.T(), json.Unmarshal(updatedBackgroundJob.Data, &exportData))
+	require.Nil(suite.T(), exportData.DeletedTime)
+
+	fakeJobRunner := mock_job_runner.NewMockInterface(suite.MockCtrl)
+	w := callFhirR4ExportStatusHandler(suite, fakeJobRunner, FhirR4ExportStatus, http.MethodGet, expiredBackgroundJob.ID.String())
+	require.Equal(suite.T(), http.StatusNotFound, w.Code)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4ExportStatusHandler_WithUnknownJob() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	ctx.Request, _ = http.NewRequest("GET", "/api/fhir/r4/$export-status/does-not-exist", nil)
+	ctx.Params = []gin.Param{{Key: "jobId", Value: "does-not-exist"}}
+
+	FhirR4ExportStatus(ctx)
+
+	require.Equal(suite.T(), http.StatusNotFound, w.Code)
+	operationOutcome, err := fhir401.UnmarshalOperationOutcome(w.Body.Bytes())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), fhir401.IssueTypeNotFound, operationOutcome.Issue[0].Code)
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// FhirR4ResourceHistory implements the instance `history` interaction (https://hl7.org/fhir/r4/http.html#history), eg. `GET /fhir/r4/Observation/123/_history`
+// every version of the resource is returned in a `history` Bundle, newest first. Prior versions are stored when a resource is
+// updated by a sync, and are removed according to the `history.retention` config.
+func FhirR4ResourceHistory(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	resourceVersions, found := fhirR4FindResourceHistory(c, logger, databaseRepo)
+	if !found {
+		return
+	}
+
+	baseUrl := fhirR4BaseUrl(c)
+	bundle := fhir401.Bundle{
+		Type:  fhir401.BundleTypeHistory,
+		Total: lo.ToPtr(len(resourceVersions)),
+		Link: []fhir401.BundleLink{
+			{Relation: "self", Url: fmt.Sprintf("%s/%s/%s/_history", baseUrl, c.Param("resourceType"), c.Param("resourceId"))},
+		},
+	}
+	for _, resourceVersion := range resourceVersions {
+		resourceRaw, err := fhirR4VersionedResource(resourceVersion)
+		if err != nil {
+			logger.Errorln("An error occurred while generating resource version", err)
+			fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, "an error occurred while generating resource version")
+			return
+		}
+		//the first version was created, every subsequent version replaced the previous one
+		requestMethod := fhir401.HTTPVerbPUT
+		if resourceVersion.VersionID == 1 {
+			requestMethod = fhir401.HTTPVerbPOST
+		}
+		bundle.Entry = append(bundle.Entry, fhir401.BundleEntry{
+			FullUrl:  lo.ToPtr(fmt.Sprintf("%s/%s/%s", baseUrl, resourceVersion.SourceResourceType, resourceVersion.SourceResourceID)),
+			Resource: resourceRaw,
+			Request: &fhir401.BundleEntryRequest{
+				Method: requestMethod,
+				Url:    fmt.Sprintf("%s/%s", resourceVersion.SourceResourceType, resourceVersion.SourceResourceID),
+			},
+		})
+	}
+
+	fhirR4Render(c, http.StatusOK, bundle)
+}
+
+// FhirR4ReadResourceVersion implements the `vread` interaction, eg. `GET /fhir/r4/Observation/123/_history/2`
+func FhirR4ReadResourceVersion(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	resourceVersions, found := fhirR4FindResourceHistory(c, logger, databaseRepo)
+	if !found {
+		return
+	}
+
+	versionId, err := strconv.Atoi(c.Param("versionId"))
+	resourceVersion, found := lo.Find(resourceVersions, func(resourceVersion models.ResourceHistory) bool {
+		return resourceVersion.VersionID == versionId
+	})
+	if err != nil || !found {
+		fhirR4RenderOperationOutcome(c, http.StatusNotFound, fhir401.IssueTypeNotFound, fmt.Sprintf("version %s of resource %s/%s is not known", c.Param("versionId"), c.Param("resourceType"), c.Param("resourceId")))
+		return
+	}
+
+	resourceRaw, err := fhirR4VersionedResource(resourceVersion)
+	if err != nil {
+		logger.Errorln("An error occurred while generating resource version", err)
+		fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, "an error occurred while generating resource version")
+		return
+	}
+	c.Header("ETag", fmt.Sprintf(`W/"%d"`, resourceVersion.VersionID))
+	c.Header("Last-Modified", resourceVersion.VersionTime.UTC().Format(http.TimeFormat))
+	fhirR4Render(c, http.StatusOK, resourceRaw)
+}
+
+// fhirR4FindResourceHistory retrieves every version of the resource identified by the `resourceType` and `resourceId` parameters
+// (newest first), and renders an OperationOutcome if the resource cannot be found
+func fhirR4FindResourceHistory(c *gin.Context, logger *logrus.Entry, databaseRepo database.DatabaseRepository) ([]models.ResourceHistory, bool) {
+	wrappedResourceModel, found := fhirR4FindResource(c, logger, databaseRepo)
+	if !found {
+		return nil, false
+	}
+
+	resourceVersions, err := databaseRepo.ListResourceHistory(c, wrappedResourceModel.SourceID.String(), wrappedResourceModel.SourceResourceType, wrappedResourceModel.SourceResourceID)
+	if err != nil {
+		logger.Errorln("An error occurred while retrieving resource history", err)
+		fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, "an error occurred while retrieving resource history")
+		return nil, false
+	}
+	return resourceVersions, true
+}
+
+// fhirR4VersionedResource returns the resource content of a version, with `meta.versionId` and `meta.lastUpdated` populated
+func fhirR4VersionedResource(resourceVersion models.ResourceHistory) (json.RawMessage, error) {
+	var resource map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(resourceVersion.ResourceRaw))
+	//numbers must not lose precision (eg. decimal values)
+	decoder.UseNumber()
+	if err := decoder.Decode(&resource); err != nil {
+		return nil, err
+	}
+
+	meta, ok := resource["meta"].(map[string]interface{})
+	if !ok {
+		meta = map[string]interface{}{}
+	}
+	meta["versionId"] = strconv.Itoa(resourceVersion.VersionID)
+	meta["lastUpdated"] = resourceVersion.VersionTime.UTC().Format(time.RFC3339)
+	resource["meta"] = meta
+	return json.Marshal(resource)
+}
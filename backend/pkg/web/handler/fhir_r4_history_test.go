@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	sourceModels "github.com/fastenhealth/fasten-sources/clients/models"
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+// setupResourceHistory creates a Slot with 2 versions (busy, then free), which is not used by any other test
+func setupResourceHistory(suite *ResourceFhirHandlerTestSuite, resourceId string) {
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+	sourceCredential, err := suite.AppRepository.GetSource(authContext, suite.SourceId.String())
+	require.NoError(suite.T(), err)
+
+	for _, resourceRaw := range []string{
+		`{"resourceType":"Slot","id":"` + resourceId + `","status":"busy","start":"2023-01-02T09:00:00Z","end":"2023-01-02T09:30:00Z"}`,
+		`{"resourceType":"Slot","id":"` + resourceId + `","status":"free","start":"2023-01-02T09:00:00Z","end":"2023-01-02T09:30:00Z"}`,
+	} {
+		_, err := suite.AppRepository.UpsertRawResource(authContext, sourceCredential, sourceModels.RawResourceFhir{
+			SourceResourceType: "Slot",
+			SourceResourceID:   resourceId,
+			ResourceRaw:        []byte(resourceRaw),
+		})
+		require.NoError(suite.T(), err)
+	}
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4ResourceHistoryHandler() {
+	setupResourceHistory(suite, "history-slot")
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	req, err := http.NewRequest("GET", "http://localhost:9090/api/fhir/r4/Slot/history-slot/_history", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+	ctx.Params = []gin.Param{{Key: "resourceType", Value: "Slot"}, {Key: "resourceId", Value: "history-slot"}}
+
+	FhirR4ResourceHistory(ctx)
+
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	bundle, err := fhir401.UnmarshalBundle(w.Body.Bytes())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), fhir401.BundleTypeHistory, bundle.Type)
+	require.Len(suite.T(), bundle.Entry, 2)
+
+	//newest version first
+	slot, err := fhir401.UnmarshalSlot(bundle.Entry[0].Resource)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), fhir401.SlotStatusFree, slot.Status)
+	require.Equal(suite.T(), "2", *slot.Meta.VersionId)
+	require.Equal(suite.T(), fhir401.HTTPVerbPUT, bundle.Entry[0].Request.Method)
+	slot, err = fhir401.UnmarshalSlot(bundle.Entry[1].Resource)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), fhir401.SlotStatusBusy, slot.Status)
+	require.Equal(suite.T(), "1", *slot.Meta.VersionId)
+	require.Equal(suite.T(), fhir401.HTTPVerbPOST, bundle.Entry[1].Request.Method)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4ReadResourceVersionHandler() {
+	setupResourceHistory(suite, "vread-slot")
+
+	var vreadTests = []struct {
+		versionId          string
+		expectedStatus     int
+		expectedSlotStatus string
+	}{
+		{"1", http.StatusOK, "busy"},
+		{"2", http.StatusOK, "free"},
+		{"99", http.StatusNotFound, ""},
+		{"abc", http.StatusNotFound, ""},
+	}
+
+	for ndx, tt := range vreadTests {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		setupGinContext(ctx, suite)
+		req, err := http.NewRequest("GET", "http://localhost:9090/api/fhir/r4/Slot/vread-slot/_history/"+tt.versionId, nil)
+		require.NoError(suite.T(), err)
+		ctx.Request = req
+		ctx.Params = []gin.Param{{Key: "resourceType", Value: "Slot"}, {Key: "resourceId", Value: "vread-slot"}, {Key: "versionId", Value: tt.versionId}}
+
+		FhirR4ReadResourceVersion(ctx)
+
+		require.Equal(suite.T(), tt.expectedStatus, w.Code, "Expected status to match for vreadTests[%d]", ndx)
+		if tt.expectedStatus == http.StatusOK {
+			slot, err := fhir401.UnmarshalSlot(w.Body.Bytes())
+			require.NoError(suite.T(), err)
+			require.Equal(suite.T(), tt.expectedSlotStatus, slot.Status.Code(), "Expected resource to match for vreadTests[%d]", ndx)
+			require.Equal(suite.T(), `W/"`+tt.versionId+`"`, w.Header().Get("ETag"))
+		}
+	}
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestGetResourceFhirDiffHandler() {
+	setupResourceHistory(suite, "diff-slot")
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	req, err := http.NewRequest("GET", "/api/secure/resource/fhir/"+suite.SourceId.String()+"/diff-slot/diff", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+	ctx.Params = []gin.Param{{Key: "sourceId", Value: suite.SourceId.String()}, {Key: "resourceId", Value: "diff-slot"}}
+
+	GetResourceFhirDiff(ctx)
+
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	var respWrapper struct {
+		Success bool `json:"success"`
+		Data    struct {
+			From       int                      `json:"from"`
+			To         int                      `json:"to"`
+			Operations []map[string]interface{} `json:"operations"`
+		} `json:"data"`
+	}
+	require.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &respWrapper))
+	require.True(suite.T(), respWrapper.Success)
+	require.Equal(suite.T(), 1, respWrapper.Data.From)
+	require.Equal(suite.T(), 2, respWrapper.Data.To)
+	require.Equal(suite.T(), []map[string]interface{}{{"op": "replace", "path": "/status", "value": "free"}}, respWrapper.Data.Operations)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestGetResourceFhirHistoryAndDiffHandler_WithUnknownResource() {
+	for ndx, handler := range []gin.HandlerFunc{GetResourceFhirHistory, GetResourceFhirDiff} {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		setupGinContext(ctx, suite)
+		req, err := http.NewRequest("GET", "/api/secure/resource/fhir/"+suite.SourceId.String()+"/does-not-exist/history", nil)
+		require.NoError(suite.T(), err)
+		ctx.Request = req
+		ctx.Params = []gin.Param{{Key: "sourceId", Value: suite.SourceId.String()}, {Key: "resourceId", Value: "does-not-exist"}}
+
+		handler(ctx)
+
+		require.Equal(suite.T(), http.StatusNotFound, w.Code, "Expected status to match for handler[%d]", ndx)
+	}
+}
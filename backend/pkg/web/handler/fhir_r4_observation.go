@@ -0,0 +1,227 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// fhirR4ObservationStatisticsSystem is the code system of the statistics returned by `$stats`, the `latest` statistic is
+// not part of the code system, so it only has a text code
+const fhirR4ObservationStatisticsSystem = "http://terminology.hl7.org/CodeSystem/observation-statistics"
+
+// fhirR4ObservationStatistics are the statistics supported by the `statistic` parameter of `$stats`
+var fhirR4ObservationStatistics = []string{"count", "minimum", "maximum", "average", "latest"}
+
+// FhirR4ObservationLastN implements the Observation `$lastn` operation (https://hl7.org/fhir/r4/observation-operation-lastn.html)
+// eg. `GET /fhir/r4/Observation/$lastn?category=vital-signs&max=3` returns the 3 most recent vital signs for each code, across
+// all of the user's sources, as a `searchset` Bundle.
+//
+// - `max` the number of Observations returned for each code, defaults to 1
+// - any Observation search parameter can be used to filter the Observations, if `code` is used only the requested codes are returned
+func FhirR4ObservationLastN(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	lastNQuery := models.ObservationLastNQuery{Max: 1}
+	if len(c.Query("max")) > 0 {
+		max, err := strconv.Atoi(c.Query("max"))
+		if err != nil || max < 1 {
+			fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeInvalid, "max must be a positive integer")
+			return
+		}
+		lastNQuery.Max = max
+	}
+	where, err := fhirR4ObservationSearchParameters(c, "max")
+	if err != nil {
+		fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeInvalid, err.Error())
+		return
+	}
+	lastNQuery.Where = where
+
+	resources, err := databaseRepo.QueryObservationLastN(c, lastNQuery)
+	if err != nil {
+		//the search parameters are validated while generating the query, so most errors are caused by the request
+		logger.Errorln("An error occurred while retrieving the most recent observations", err)
+		fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeInvalid, err.Error())
+		return
+	}
+
+	bundle := fhir401.Bundle{
+		Type:  fhir401.BundleTypeSearchset,
+		Total: lo.ToPtr(len(resources)),
+		Link:  []fhir401.BundleLink{{Relation: "self", Url: fhirR4SearchUrl(c, nil)}},
+		Entry: []fhir401.BundleEntry{},
+	}
+	for _, resource := range resources {
+		bundle.Entry = append(bundle.Entry, fhir401.BundleEntry{
+			FullUrl:  lo.ToPtr(fmt.Sprintf("%s/%s/%s", fhirR4BaseUrl(c), resource.SourceResourceType, resource.SourceResourceID)),
+			Resource: json.RawMessage(resource.ResourceRaw),
+			Search:   &fhir401.BundleEntrySearch{Mode: lo.ToPtr(fhir401.SearchEntryModeMatch)},
+		})
+	}
+	fhirR4Render(c, http.StatusOK, bundle)
+}
+
+// FhirR4ObservationStats implements the Observation `$stats` operation (https://hl7.org/fhir/r4/observation-operation-stats.html)
+// eg. `GET /fhir/r4/Observation/$stats?code=http://loinc.org|29463-7&bucket=month&unit=kg`
+// The statistics of the Quantity values are calculated for each code (and unit), and returned as a Parameters resource with a
+// `statistics` Observation for each code. The statistics are included as components, and the effectivePeriod is the date range
+// of the summarized Observations.
+//
+// - `code` is required, any other Observation search parameter can be used to filter the Observations
+// - `duration` only include Observations from the last number of hours
+// - `statistic` comma separated list of statistics to calculate (count, minimum, maximum, average and latest), defaults to all
+// - `bucket` calculate the statistics for each year, quarter, month, week or day (a Fasten extension)
+// - `unit` convert the values to this UCUM unit before calculating the statistics, otherwise the statistics are calculated for each unit (a Fasten extension)
+func FhirR4ObservationStats(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	if len(c.Query("code")) == 0 {
+		fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeRequired, "code is required")
+		return
+	}
+	statistics := fhirR4ObservationStatistics
+	if len(c.Query("statistic")) > 0 {
+		statistics = []string{}
+		for _, statistic := range strings.Split(c.Query("statistic"), ",") {
+			if !lo.Contains(fhirR4ObservationStatistics, strings.TrimSpace(statistic)) {
+				fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeNotSupported, fmt.Sprintf("statistic %s is not supported, must be one of %s", statistic, strings.Join(fhirR4ObservationStatistics, ", ")))
+				return
+			}
+			statistics = append(statistics, strings.TrimSpace(statistic))
+		}
+	}
+
+	where, err := fhirR4ObservationSearchParameters(c, "duration", "statistic", "bucket", "unit")
+	if err != nil {
+		fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeInvalid, err.Error())
+		return
+	}
+	if len(c.Query("duration")) > 0 {
+		duration, err := strconv.ParseFloat(c.Query("duration"), 64)
+		if err != nil || duration <= 0 {
+			fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeInvalid, "duration must be a positive number of hours")
+			return
+		}
+		since := time.Now().Add(-time.Duration(duration * float64(time.Hour))).UTC().Format(time.RFC3339)
+		//repeated search parameters are AND'd together
+		where["date"] = append(fhirR4WhereValues(where["date"]), "ge"+since)
+	}
+
+	observationStatistics, err := databaseRepo.QueryObservationStatistics(c, models.ObservationStatisticsQuery{
+		Where:  where,
+		Bucket: c.Query("bucket"),
+		Unit:   c.Query("unit"),
+	})
+	if err != nil {
+		logger.Errorln("An error occurred while calculating observation statistics", err)
+		fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeInvalid, err.Error())
+		return
+	}
+
+	parameters := fhir401.Parameters{Parameter: []fhir401.ParametersParameter{}}
+	for _, observationStatistic := range observationStatistics {
+		statisticsObservation, err := json.Marshal(fhirR4StatisticsObservation(observationStatistic, statistics))
+		if err != nil {
+			fhirR4RenderOperationOutcome(c, http.StatusInternalServerError, fhir401.IssueTypeException, err.Error())
+			return
+		}
+		parameters.Parameter = append(parameters.Parameter, fhir401.ParametersParameter{Name: "statistics", Resource: statisticsObservation})
+	}
+	fhirR4Render(c, http.StatusOK, parameters)
+}
+
+// fhirR4ObservationSearchParameters parses the Observation search parameters of an operation request, operation parameters are
+// excluded. Paging & sorting parameters are not supported.
+func fhirR4ObservationSearchParameters(c *gin.Context, operationParameters ...string) (map[string]interface{}, error) {
+	searchParams := url.Values{}
+	for searchParamName, searchParamValues := range c.Request.URL.Query() {
+		if !lo.Contains(operationParameters, searchParamName) {
+			searchParams[searchParamName] = searchParamValues
+		}
+	}
+
+	query, err := models.ParseFhirSearchQuery("Observation?" + searchParams.Encode())
+	if err != nil {
+		return nil, err
+	} else if query.Limit != nil || query.Offset != nil || len(query.Cursor) > 0 || len(query.Sort) > 0 || len(query.Include) > 0 || len(query.RevInclude) > 0 {
+		return nil, fmt.Errorf("_count, _offset, _cursor, _sort, _include and _revinclude are not supported")
+	}
+	return query.Where, nil
+}
+
+// fhirR4WhereValues returns the value(s) of a search parameter parsed by models.ParseFhirSearchQuery
+func fhirR4WhereValues(whereValue interface{}) []string {
+	switch typedValue := whereValue.(type) {
+	case string:
+		return []string{typedValue}
+	case []string:
+		return typedValue
+	}
+	return []string{}
+}
+
+// fhirR4StatisticsObservation converts the statistics for a code into an Observation, each statistic is a component
+func fhirR4StatisticsObservation(observationStatistic models.ObservationStatistics, statistics []string) fhir401.Observation {
+	observation := fhir401.Observation{
+		Status: fhir401.ObservationStatusFinal,
+		Code: fhir401.CodeableConcept{
+			Coding: []fhir401.Coding{{
+				System:  fhirR4OptionalString(observationStatistic.CodeSystem),
+				Code:    fhirR4OptionalString(observationStatistic.Code),
+				Display: fhirR4OptionalString(observationStatistic.CodeDisplay),
+			}},
+		},
+		EffectivePeriod: &fhir401.Period{},
+	}
+	if observationStatistic.Start != nil {
+		observation.EffectivePeriod.Start = lo.ToPtr(observationStatistic.Start.Format(time.RFC3339))
+	}
+	if observationStatistic.End != nil {
+		observation.EffectivePeriod.End = lo.ToPtr(observationStatistic.End.Format(time.RFC3339))
+	}
+
+	statisticValues := map[string]float64{
+		"count":   float64(observationStatistic.Count),
+		"minimum": observationStatistic.Minimum,
+		"maximum": observationStatistic.Maximum,
+		"average": observationStatistic.Mean,
+		"latest":  observationStatistic.Latest,
+	}
+	for _, statistic := range statistics {
+		component := fhir401.ObservationComponent{
+			Code:          fhir401.CodeableConcept{Text: lo.ToPtr(statistic)},
+			ValueQuantity: &fhir401.Quantity{Value: lo.ToPtr(json.Number(strconv.FormatFloat(statisticValues[statistic], 'f', -1, 64)))},
+		}
+		if statistic != "latest" {
+			component.Code.Coding = []fhir401.Coding{{System: lo.ToPtr(fhirR4ObservationStatisticsSystem), Code: lo.ToPtr(statistic)}}
+		}
+		if statistic != "count" {
+			component.ValueQuantity.Unit = fhirR4OptionalString(observationStatistic.Unit)
+		}
+		observation.Component = append(observation.Component, component)
+	}
+	return observation
+}
+
+// fhirR4OptionalString returns nil for empty strings, so that they're omitted from the resource
+func fhirR4OptionalString(value string) *string {
+	if len(value) == 0 {
+		return nil
+	}
+	return &value
+}
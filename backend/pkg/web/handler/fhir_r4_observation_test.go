@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFhirR4StatisticsObservation(t *testing.T) {
+	//setup
+	observationStatistic := models.ObservationStatistics{
+		CodeSystem: "http://loinc.org",
+		Code:       "29463-7",
+		Unit:       "kg",
+		Count:      2,
+		Minimum:    80,
+		Maximum:    82.5,
+		Mean:       81.25,
+		Latest:     82.5,
+		Start:      lo.ToPtr(time.Date(2023, 1, 10, 8, 0, 0, 0, time.UTC)),
+		End:        lo.ToPtr(time.Date(2023, 2, 10, 8, 0, 0, 0, time.UTC)),
+	}
+
+	//test
+	observation := fhirR4StatisticsObservation(observationStatistic, []string{"count", "average", "latest"})
+
+	//assert
+	require.Equal(t, "http://loinc.org", lo.FromPtr(observation.Code.Coding[0].System))
+	require.Nil(t, observation.Code.Coding[0].Display)
+	require.Equal(t, &fhir401.Period{Start: lo.ToPtr("2023-01-10T08:00:00Z"), End: lo.ToPtr("2023-02-10T08:00:00Z")}, observation.EffectivePeriod)
+	require.Len(t, observation.Component, 3)
+	require.Equal(t, "count", lo.FromPtr(observation.Component[0].Code.Coding[0].Code))
+	require.Equal(t, "2", lo.FromPtr(observation.Component[0].ValueQuantity.Value).String())
+	require.Nil(t, observation.Component[0].ValueQuantity.Unit)
+	require.Equal(t, fhirR4ObservationStatisticsSystem, lo.FromPtr(observation.Component[1].Code.Coding[0].System))
+	require.Equal(t, "81.25", lo.FromPtr(observation.Component[1].ValueQuantity.Value).String())
+	require.Equal(t, "kg", lo.FromPtr(observation.Component[1].ValueQuantity.Unit))
+	require.Empty(t, observation.Component[2].Code.Coding)
+	require.Equal(t, "latest", lo.FromPtr(observation.Component[2].Code.Text))
+	require.Equal(t, "82.5", lo.FromPtr(observation.Component[2].ValueQuantity.Value).String())
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4ObservationLastNHandler() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "http://localhost:9090/api/fhir/r4/Observation/$lastn?max=2&code="+url.QueryEscape("http://loinc.org|29463-7"), nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+
+	FhirR4ObservationLastN(ctx)
+
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	bundle, err := fhir401.UnmarshalBundle(w.Body.Bytes())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), fhir401.BundleTypeSearchset, bundle.Type)
+	require.Len(suite.T(), bundle.Entry, 2)
+
+	//the most recent body weights are returned
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+	queryResults, _, err := suite.AppRepository.QueryResources(authContext, models.QueryResource{
+		From:  "Observation",
+		Where: map[string]interface{}{"code": "http://loinc.org|29463-7"},
+		Sort:  []string{"-date"},
+		Limit: lo.ToPtr(2),
+	})
+	require.NoError(suite.T(), err)
+	expectedIds := lo.Map(queryResults.([]models.ResourceBase), func(resource models.ResourceBase, _ int) string {
+		return resource.SourceResourceID
+	})
+	actualIds := lo.Map(bundle.Entry, func(entry fhir401.BundleEntry, _ int) string {
+		observation, err := fhir401.UnmarshalObservation(entry.Resource)
+		require.NoError(suite.T(), err)
+		return lo.FromPtr(observation.Id)
+	})
+	require.ElementsMatch(suite.T(), expectedIds, actualIds)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4ObservationStatsHandler() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "http://localhost:9090/api/fhir/r4/Observation/$stats?statistic=count,maximum&code="+url.QueryEscape("http://loinc.org|29463-7"), nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+
+	FhirR4ObservationStats(ctx)
+
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	parameters, err := fhir401.UnmarshalParameters(w.Body.Bytes())
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), parameters.Parameter, 1)
+	require.Equal(suite.T(), "statistics", parameters.Parameter[0].Name)
+	observation, err := fhir401.UnmarshalObservation(parameters.Parameter[0].Resource)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), "29463-7", lo.FromPtr(observation.Code.Coding[0].Code))
+	require.Len(suite.T(), observation.Component, 2)
+
+	//every body weight is counted
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+	_, pagination, err := suite.AppRepository.QueryResources(authContext, models.QueryResource{
+		From:  "Observation",
+		Where: map[string]interface{}{"code": "http://loinc.org|29463-7"},
+		Limit: lo.ToPtr(1),
+	})
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), "count", lo.FromPtr(observation.Component[0].Code.Coding[0].Code))
+	require.Equal(suite.T(), pagination.Total, lo.Must(observation.Component[0].ValueQuantity.Value.Int64()))
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4ObservationOperationHandlers_Invalid() {
+	var observationOperationTests = []struct {
+		handler gin.HandlerFunc
+		query   string
+	}{
+		{FhirR4ObservationLastN, "max=0"},
+		{FhirR4ObservationLastN, "unknown=1"},
+		{FhirR4ObservationLastN, "_count=10"},
+		{FhirR4ObservationStats, ""},
+		{FhirR4ObservationStats, "code=29463-7&statistic=median"},
+		{FhirR4ObservationStats, "code=29463-7&duration=-1"},
+		{FhirR4ObservationStats, "code=29463-7&bucket=hour"},
+		{FhirR4ObservationStats, "code=29463-7&unit=unknown"},
+	}
+
+	for ndx, tt := range observationOperationTests {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		setupGinContext(ctx, suite)
+		req, err := http.NewRequest("GET", "http://localhost:9090/api/fhir/r4/Observation/$operation?"+tt.query, nil)
+		require.NoError(suite.T(), err)
+		ctx.Request = req
+
+		tt.handler(ctx)
+
+		require.Equal(suite.T(), http.StatusBadRequest, w.Code, "Expected status to match for observationOperationTests[%d]", ndx)
+		_, err = fhir401.UnmarshalOperationOutcome(w.Body.Bytes())
+		require.NoError(suite.T(), err, "Expected OperationOutcome for observationOperationTests[%d]", ndx)
+	}
+}
@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	mock_database "github.com/fastenhealth/fasten-onprem/backend/pkg/database/mock"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFhirR4Metadata(t *testing.T) {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	req, err := http.NewRequest("GET", "/api/fhir/r4/metadata", nil)
+	require.NoError(t, err)
+	ctx.Request = req
+
+	FhirR4Metadata(ctx)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/fhir+json; charset=utf-8", w.Header().Get("Content-Type"))
+
+	capabilityStatement, err := fhir401.UnmarshalCapabilityStatement(w.Body.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, fhir401.FHIRVersion4_0_1, capabilityStatement.FhirVersion)
+	require.Len(t, capabilityStatement.Rest, 1)
+
+	observationResource, found := lo.Find(capabilityStatement.Rest[0].Resource, func(resource fhir401.CapabilityStatementRestResource) bool {
+		return resource.Type == fhir401.ResourceTypeObservation
+	})
+	require.True(t, found)
+	searchParamTypes := lo.SliceToMap(observationResource.SearchParam, func(searchParam fhir401.CapabilityStatementRestResourceSearchParam) (string, fhir401.SearchParamType) {
+		return searchParam.Name, searchParam.Type
+	})
+	require.Equal(t, fhir401.SearchParamTypeToken, searchParamTypes["_id"])
+	require.Equal(t, fhir401.SearchParamTypeDate, searchParamTypes["_lastUpdated"])
+	require.Equal(t, fhir401.SearchParamTypeToken, searchParamTypes["code"])
+	require.Equal(t, fhir401.SearchParamTypeQuantity, searchParamTypes["value-quantity"])
+	require.NotContains(t, searchParamTypes, "source_id")
+	require.NotContains(t, searchParamTypes, "type")
+}
+
+func TestFhirR4Metadata_WithUnsupportedFormat(t *testing.T) {
+	var fhirR4ContentTypeTests = []struct {
+		format              string
+		accept              string
+		expectedStatus      int
+		expectedContentType string
+	}{
+		{"", "", http.StatusOK, "application/fhir+json; charset=utf-8"},
+		{"", "application/json", http.StatusOK, "application/json; charset=utf-8"},
+		{"", "application/fhir+xml;q=1.0, application/fhir+json;q=0.9", http.StatusOK, "application/fhir+json; charset=utf-8"},
+		{"json", "application/fhir+xml", http.StatusOK, "application/fhir+json; charset=utf-8"},
+		{"", "application/fhir+xml", http.StatusNotAcceptable, "application/fhir+json; charset=utf-8"},
+		{"xml", "", http.StatusNotAcceptable, "application/fhir+json; charset=utf-8"},
+	}
+
+	for ndx, tt := range fhirR4ContentTypeTests {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		req, err := http.NewRequest("GET", "/api/fhir/r4/metadata?_format="+url.QueryEscape(tt.format), nil)
+		require.NoError(t, err)
+		if len(tt.accept) > 0 {
+			req.Header.Set("Accept", tt.accept)
+		}
+		ctx.Request = req
+
+		FhirR4Metadata(ctx)
+
+		require.Equal(t, tt.expectedStatus, w.Code, "Expected status to match for fhirR4ContentTypeTests[%d]", ndx)
+		require.Equal(t, tt.expectedContentType, w.Header().Get("Content-Type"), "Expected content type to match for fhirR4ContentTypeTests[%d]", ndx)
+	}
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4ReadResourceHandler() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "/api/fhir/r4/Patient/57959813-8cd2-4e3c-8970-e4364b74980a", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+	ctx.Params = []gin.Param{{Key: "resourceType", Value: "Patient"}, {Key: "resourceId", Value: "57959813-8cd2-4e3c-8970-e4364b74980a"}}
+
+	FhirR4ReadResource(ctx)
+
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	require.Equal(suite.T(), "application/fhir+json; charset=utf-8", w.Header().Get("Content-Type"))
+	patient, err := fhir401.UnmarshalPatient(w.Body.Bytes())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), "57959813-8cd2-4e3c-8970-e4364b74980a", lo.FromPtr(patient.Id))
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4ReadResourceHandler_WithUnknownId() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "/api/fhir/r4/Patient/does-not-exist", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+	ctx.Params = []gin.Param{{Key: "resourceType", Value: "Patient"}, {Key: "resourceId", Value: "does-not-exist"}}
+
+	FhirR4ReadResource(ctx)
+
+	require.Equal(suite.T(), http.StatusNotFound, w.Code)
+	operationOutcome, err := fhir401.UnmarshalOperationOutcome(w.Body.Bytes())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), fhir401.IssueTypeNotFound, operationOutcome.Issue[0].Code)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4SearchResourcesHandler() {
+	searchUrl := "http://localhost:9090/api/fhir/r4/Observation?category=vital-signs&_count=5"
+
+	seenResourceIds := map[string]bool{}
+	var total int
+	for page := 0; page < 2; page++ {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		setupGinContext(ctx, suite)
+
+		req, err := http.NewRequest("GET", searchUrl, nil)
+		require.NoError(suite.T(), err)
+		ctx.Request = req
+		ctx.Params = []gin.Param{{Key: "resourceType", Value: "Observation"}}
+
+		FhirR4SearchResources(ctx)
+
+		require.Equal(suite.T(), http.StatusOK, w.Code)
+		bundle, err := fhir401.UnmarshalBundle(w.Body.Bytes())
+		require.NoError(suite.T(), err)
+		require.Equal(suite.T(), fhir401.BundleTypeSearchset, bundle.Type)
+		require.Len(suite.T(), bundle.Entry, 5)
+		require.Greater(suite.T(), lo.FromPtr(bundle.Total), 10)
+		if page > 0 {
+			require.Equal(suite.T(), total, lo.FromPtr(bundle.Total))
+		}
+		total = lo.FromPtr(bundle.Total)
+
+		for _, entry := range bundle.Entry {
+			observation, err := fhir401.UnmarshalObservation(entry.Resource)
+			require.NoError(suite.T(), err)
+			require.Equal(suite.T(), "http://localhost:9090/api/fhir/r4/Observation/"+lo.FromPtr(observation.Id), lo.FromPtr(entry.FullUrl))
+			require.Equal(suite.T(), fhir401.SearchEntryModeMatch, lo.FromPtr(entry.Search.Mode))
+			require.False(suite.T(), seenResourceIds[lo.FromPtr(observation.Id)], "resources must not be repeated across pages")
+			seenResourceIds[lo.FromPtr(observation.Id)] = true
+		}
+
+		nextLink, found := lo.Find(bundle.Link, func(link fhir401.BundleLink) bool { return link.Relation == "next" })
+		require.True(suite.T(), found)
+		require.Contains(suite.T(), nextLink.Url, "_cursor=")
+		searchUrl = nextLink.Url
+	}
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4SearchResourcesHandler_WithSort() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "http://localhost:9090/api/fhir/r4/Observation?_sort=-date&_count=5", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+	ctx.Params = []gin.Param{{Key: "resourceType", Value: "Observation"}}
+
+	FhirR4SearchResources(ctx)
+
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	bundle, err := fhir401.UnmarshalBundle(w.Body.Bytes())
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), bundle.Entry, 5)
+
+	nextLink, found := lo.Find(bundle.Link, func(link fhir401.BundleLink) bool { return link.Relation == "next" })
+	require.True(suite.T(), found)
+	nextUrl, err := url.Parse(nextLink.Url)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), "5", nextUrl.Query().Get("_offset"))
+	require.Equal(suite.T(), "-date", nextUrl.Query().Get("_sort"))
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4SearchResourcesHandler_WithInvalidSearchParameter() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "/api/fhir/r4/Observation?_summary=true", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+	ctx.Params = []gin.Param{{Key: "resourceType", Value: "Observation"}}
+
+	FhirR4SearchResources(ctx)
+
+	require.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	operationOutcome, err := fhir401.UnmarshalOperationOutcome(w.Body.Bytes())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), fhir401.IssueTypeInvalid, operationOutcome.Issue[0].Code)
+	require.Contains(suite.T(), lo.FromPtr(operationOutcome.Issue[0].Diagnostics), "_summary is not supported")
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestFhirR4SearchResourcesHandler_WithInvalidSearchParameterValue() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "/api/fhir/r4/Observation?value-quantity=abc", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+	ctx.Params = []gin.Param{{Key: "resourceType", Value: "Observation"}}
+
+	FhirR4SearchResources(ctx)
+
+	require.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	operationOutcome, err := fhir401.UnmarshalOperationOutcome(w.Body.Bytes())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), fhir401.IssueTypeInvalid, operationOutcome.Issue[0].Code)
+	require.Contains(suite.T(), lo.FromPtr(operationOutcome.Issue[0].Diagnostics), "valueQuantity")
+}
+
+func TestFhirR4SearchResources_WithDatabaseError(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	fakeDatabase := mock_database.NewMockDatabaseRepository(mockCtrl)
+	fakeDatabase.EXPECT().QueryResources(gomock.Any(), gomock.Any()).Return(nil, models.Pagination{}, fmt.Errorf("database is locked"))
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Set(pkg.ContextKeyTypeLogger, logrus.WithField("test", t.Name()))
+	ctx.Set(pkg.ContextKeyTypeDatabase, fakeDatabase)
+	req, err := http.NewRequest("GET", "/api/fhir/r4/Observation?code=1234", nil)
+	require.NoError(t, err)
+	ctx.Request = req
+	ctx.Params = []gin.Param{{Key: "resourceType", Value: "Observation"}}
+
+	FhirR4SearchResources(ctx)
+
+	//errors which are not caused by the request are not returned to the client
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	operationOutcome, err := fhir401.UnmarshalOperationOutcome(w.Body.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, fhir401.IssueTypeException, operationOutcome.Issue[0].Code)
+	require.NotContains(t, lo.FromPtr(operationOutcome.Issue[0].Diagnostics), "database is locked")
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/validation"
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/gin-gonic/gin"
+)
+
+// FhirR4Validate implements the `$validate` operation (https://hl7.org/fhir/r4/resource-operation-validate.html), eg.
+// `POST /fhir/r4/Observation/$validate`. Nothing is stored, the OperationOutcome lists every issue found in the resource
+// (or every entry of a Bundle).
+// The resource can be posted directly, or as the `resource` parameter of a Parameters resource. Profiles to validate against
+// can be provided using the `profile` query/Parameters parameter.
+func FhirR4Validate(c *gin.Context) {
+	requestBody, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeInvalid, "could not read request body")
+		return
+	}
+
+	resourceRaw, profiles, err := fhirR4ValidateParameters(requestBody)
+	if err != nil {
+		fhirR4RenderOperationOutcome(c, http.StatusBadRequest, fhir401.IssueTypeInvalid, err.Error())
+		return
+	}
+	profiles = append(profiles, c.QueryArray("profile")...)
+
+	operationOutcome := validation.ValidateResource(resourceRaw, validation.Options{
+		Profiles:     profiles,
+		ResourceType: c.Param("resourceType"),
+	})
+
+	//the operation succeeded, even if the resource is not valid
+	fhirR4Render(c, http.StatusOK, operationOutcome)
+}
+
+// fhirR4ValidateParameters extracts the resource & profiles from a Parameters resource, any other resource is returned unchanged
+func fhirR4ValidateParameters(requestBody []byte) ([]byte, []string, error) {
+	var resource struct {
+		ResourceType string `json:"resourceType"`
+	}
+	if json.Unmarshal(requestBody, &resource) != nil || resource.ResourceType != "Parameters" {
+		return requestBody, []string{}, nil
+	}
+
+	parameters, err := fhir401.UnmarshalParameters(requestBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid Parameters resource: %w", err)
+	}
+	var resourceRaw []byte
+	profiles := []string{}
+	for _, parameter := range parameters.Parameter {
+		switch parameter.Name {
+		case "resource":
+			resourceRaw = parameter.Resource
+		case "profile":
+			if parameter.ValueUri != nil {
+				profiles = append(profiles, *parameter.ValueUri)
+			} else if parameter.ValueCanonical != nil {
+				profiles = append(profiles, *parameter.ValueCanonical)
+			}
+		}
+	}
+	if len(resourceRaw) == 0 {
+		return nil, nil, fmt.Errorf("Parameters resource must contain a resource parameter")
+	}
+	return resourceRaw, profiles, nil
+}
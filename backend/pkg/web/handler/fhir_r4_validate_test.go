@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fastenhealth/gofhir-models/fhir401"
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFhirR4Validate(t *testing.T) {
+	var fhirR4ValidateTests = []struct {
+		resourceType        string
+		query               string
+		body                string
+		expectedStatus      int
+		expectedSeverities  []fhir401.IssueSeverity
+		expectedExpressions []string
+	}{
+		//valid resource
+		{"Observation", "", `{"resourceType":"Observation","status":"final","code":{"text":"glucose"}}`, http.StatusOK, []fhir401.IssueSeverity{fhir401.IssueSeverityInformation}, []string{}},
+		//invalid resource, the operation still succeeds
+		{"Observation", "", `{"resourceType":"Observation","status":"invalid-status"}`, http.StatusOK, []fhir401.IssueSeverity{fhir401.IssueSeverityError, fhir401.IssueSeverityError}, []string{"Observation.code", "Observation.status"}},
+		//resourceType does not match the url
+		{"Observation", "", `{"resourceType":"Condition","subject":{"reference":"Patient/1"}}`, http.StatusOK, []fhir401.IssueSeverity{fhir401.IssueSeverityError}, []string{"Condition"}},
+		//profile provided as a query parameter
+		{"", "?profile=http://hl7.org/fhir/us/core/StructureDefinition/us-core-condition", `{"resourceType":"Condition","subject":{"reference":"Patient/1"}}`, http.StatusOK, []fhir401.IssueSeverity{fhir401.IssueSeverityError, fhir401.IssueSeverityError}, []string{"Condition.category", "Condition.code"}},
+		//resource & profile provided as Parameters
+		{"Patient", "", `{"resourceType":"Parameters","parameter":[{"name":"resource","resource":{"resourceType":"Patient","gender":"female"}},{"name":"profile","valueUri":"http://hl7.org/fhir/us/core/StructureDefinition/us-core-patient"}]}`, http.StatusOK, []fhir401.IssueSeverity{fhir401.IssueSeverityError, fhir401.IssueSeverityError}, []string{"Patient.identifier", "Patient.name"}},
+		//Parameters without a resource
+		{"", "", `{"resourceType":"Parameters","parameter":[{"name":"mode","valueString":"create"}]}`, http.StatusBadRequest, []fhir401.IssueSeverity{fhir401.IssueSeverityError}, []string{}},
+	}
+
+	for ndx, tt := range fhirR4ValidateTests {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		req, err := http.NewRequest("POST", "/api/fhir/r4/$validate"+tt.query, strings.NewReader(tt.body))
+		require.NoError(t, err)
+		ctx.Request = req
+		if len(tt.resourceType) > 0 {
+			ctx.Params = []gin.Param{{Key: "resourceType", Value: tt.resourceType}}
+		}
+
+		FhirR4Validate(ctx)
+
+		require.Equal(t, tt.expectedStatus, w.Code, "Expected status to match for fhirR4ValidateTests[%d]", ndx)
+		operationOutcome, err := fhir401.UnmarshalOperationOutcome(w.Body.Bytes())
+		require.NoError(t, err)
+		require.Equal(t, tt.expectedSeverities, lo.Map(operationOutcome.Issue, func(issue fhir401.OperationOutcomeIssue, _ int) fhir401.IssueSeverity {
+			return issue.Severity
+		}), "Expected severities to match for fhirR4ValidateTests[%d]", ndx)
+		require.Equal(t, tt.expectedExpressions, lo.FlatMap(operationOutcome.Issue, func(issue fhir401.OperationOutcomeIssue, _ int) []string {
+			return issue.Expression
+		}), "Expected expressions to match for fhirR4ValidateTests[%d]", ndx)
+	}
+}
@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/csvimport"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	sourceModels "github.com/fastenhealth/fasten-sources/clients/models"
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// ImportCsvResources converts the rows of an uploaded CSV file into Observations, owned by the Fasten source for this user
+// (see CreateResourceFhir). The columns are mapped using the `mapping` form field (a models.CsvImportMapping), or the name of
+// a saved template (`template` form field). The mapping is saved as a template when the `save_template` form field is `true`.
+//
+// Observation ids are generated from the code & date of each reading (see csvimport.Read), so importing a file again does not
+// create duplicates.
+func ImportCsvResources(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	userSettings, err := databaseRepo.LoadUserSettings(c)
+	if err != nil {
+		logger.Errorln("An error occurred while loading user settings", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	var mapping models.CsvImportMapping
+	if templateName := c.PostForm("template"); len(templateName) > 0 {
+		template, found := lo.Find(userSettings.CsvImportTemplates, func(template models.CsvImportMapping) bool {
+			return template.Name == templateName
+		})
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "error": fmt.Sprintf("csv import template (%s) does not exist", templateName)})
+			return
+		}
+		mapping = template
+	} else if err := json.Unmarshal([]byte(c.PostForm("mapping")), &mapping); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "a valid `mapping` or `template` is required"})
+		return
+	}
+	if err := mapping.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	saveTemplate := c.PostForm("save_template") == "true"
+	if saveTemplate && len(mapping.Name) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "mapping must include a name to be saved as a template"})
+		return
+	}
+
+	csvFile, err := storeFileLocally(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	defer os.Remove(csvFile.Name())
+	defer csvFile.Close()
+
+	fastenSourceCredential, err := getFastenSourceCredential(c, databaseRepo)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	upsertSummary := sourceModels.UpsertSummary{UpdatedResources: []string{}}
+	csvSummary, err := csvimport.Read(csvFile, mapping, func(resource csvimport.Resource) error {
+		updated, err := databaseRepo.UpsertRawResource(c, fastenSourceCredential, sourceModels.RawResourceFhir{
+			SourceResourceType: resource.ResourceType,
+			SourceResourceID:   resource.ResourceId,
+			ResourceRaw:        resource.ResourceRaw,
+			SortTitle:          resource.SortTitle,
+			SortDate:           resource.SortDate,
+		})
+		if err != nil {
+			return fmt.Errorf("could not store %s/%s: %w", resource.ResourceType, resource.ResourceId, err)
+		}
+		upsertSummary.TotalResources++
+		if updated {
+			upsertSummary.UpdatedResources = append(upsertSummary.UpdatedResources, fmt.Sprintf("%s/%s", resource.ResourceType, resource.ResourceId))
+		}
+		return nil
+	})
+	if err != nil {
+		//resources stored before the error are kept, importing the file again will update them
+		logger.Errorln("An error occurred while importing csv file", err)
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error(), "data": upsertSummary})
+		return
+	}
+
+	if saveTemplate {
+		if err := saveCsvImportTemplate(c, databaseRepo, userSettings, mapping); err != nil {
+			logger.Errorln("An error occurred while saving csv import template", err)
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error(), "data": upsertSummary})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": upsertSummary, "summary": csvSummary})
+}
+
+// ListCsvImportTemplates returns the mappings saved in the user settings
+func ListCsvImportTemplates(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	userSettings, err := databaseRepo.LoadUserSettings(c)
+	if err != nil {
+		logger.Errorln("An error occurred while loading user settings", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": userSettings.CsvImportTemplates})
+}
+
+// SaveCsvImportTemplate saves a mapping in the user settings, replacing the template with the same name (if any)
+func SaveCsvImportTemplate(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	var mapping models.CsvImportMapping
+	if err := c.ShouldBindJSON(&mapping); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "request body is not a valid csv import mapping"})
+		return
+	}
+	if err := mapping.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	userSettings, err := databaseRepo.LoadUserSettings(c)
+	if err != nil {
+		logger.Errorln("An error occurred while loading user settings", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if err := saveCsvImportTemplate(c, databaseRepo, userSettings, mapping); err != nil {
+		logger.Errorln("An error occurred while saving csv import template", err)
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": userSettings.CsvImportTemplates})
+}
+
+// DeleteCsvImportTemplate removes a mapping from the user settings
+func DeleteCsvImportTemplate(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	userSettings, err := databaseRepo.LoadUserSettings(c)
+	if err != nil {
+		logger.Errorln("An error occurred while loading user settings", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	templates := lo.Reject(userSettings.CsvImportTemplates, func(template models.CsvImportMapping, _ int) bool {
+		return template.Name == c.Param("templateName")
+	})
+	if len(templates) == len(userSettings.CsvImportTemplates) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": fmt.Sprintf("csv import template (%s) does not exist", c.Param("templateName"))})
+		return
+	}
+	userSettings.CsvImportTemplates = templates
+	if err := databaseRepo.SaveUserSettings(c, userSettings); err != nil {
+		logger.Errorln("An error occurred while saving user settings", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": userSettings.CsvImportTemplates})
+}
+
+// saveCsvImportTemplate adds (or replaces) the template in the user settings, and saves them. The mapping must have a name.
+func saveCsvImportTemplate(c *gin.Context, databaseRepo database.DatabaseRepository, userSettings *models.UserSettings, mapping models.CsvImportMapping) error {
+	if len(mapping.Name) == 0 {
+		return fmt.Errorf("mapping must include a name to be saved as a template")
+	}
+	_, templateNdx, found := lo.FindIndexOf(userSettings.CsvImportTemplates, func(template models.CsvImportMapping) bool {
+		return template.Name == mapping.Name
+	})
+	if found {
+		userSettings.CsvImportTemplates[templateNdx] = mapping
+	} else {
+		userSettings.CsvImportTemplates = append(userSettings.CsvImportTemplates, mapping)
+	}
+	return databaseRepo.SaveUserSettings(c, userSettings)
+}
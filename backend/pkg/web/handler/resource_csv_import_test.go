@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/csvimport"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	sourceModels "github.com/fastenhealth/fasten-sources/clients/models"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+const glucoseCsvImportMapping = `{"name":"Glucose log","date_column":"Date","date_format":"MM/DD/YYYY HH:mm","timezone":"America/New_York","columns":[{"column":"Glucose (mg/dL)","code":"2339-0","display":"Glucose","unit":"mg/dL","reference_range":{"low":70,"high":140}}]}`
+
+// importCsvResources calls the ImportCsvResources handler with testdata/glucose_readings.csv and the form fields
+func importCsvResources(suite *ResourceFhirHandlerTestSuite, fields map[string]string) *httptest.ResponseRecorder {
+	csvFile, err := os.ReadFile("testdata/glucose_readings.csv")
+	require.NoError(suite.T(), err)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "glucose_readings.csv")
+	require.NoError(suite.T(), err)
+	_, err = part.Write(csvFile)
+	require.NoError(suite.T(), err)
+	for key, value := range fields {
+		require.NoError(suite.T(), writer.WriteField(key, value))
+	}
+	require.NoError(suite.T(), writer.Close())
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	req, err := http.NewRequest(http.MethodPost, "/api/secure/resource/import/csv", body)
+	require.NoError(suite.T(), err)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	ctx.Request = req
+
+	ImportCsvResources(ctx)
+	return w
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestImportCsvResourcesHandler() {
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+
+	//import, and save the mapping as a template
+	w := importCsvResources(suite, map[string]string{"mapping": glucoseCsvImportMapping, "save_template": "true"})
+	require.Equal(suite.T(), http.StatusOK, w.Code, w.Body.String())
+	var respWrapper struct {
+		Success bool                       `json:"success"`
+		Data    sourceModels.UpsertSummary `json:"data"`
+		Summary csvimport.Summary          `json:"summary"`
+	}
+	require.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &respWrapper))
+	require.True(suite.T(), respWrapper.Success)
+	require.Equal(suite.T(), 2, respWrapper.Data.TotalResources)
+	require.Len(suite.T(), respWrapper.Data.UpdatedResources, 2)
+	require.Equal(suite.T(), 3, respWrapper.Summary.RowCount)
+	require.Equal(suite.T(), []csvimport.Warning{{Row: 4, Column: "Glucose (mg/dL)", Message: "value (high) is not numeric, cell skipped"}}, respWrapper.Summary.Warnings)
+
+	//observations are stored in the Fasten source, and indexed
+	observations, _, err := suite.AppRepository.QueryResources(authContext, models.QueryResource{
+		From:  "Observation",
+		Where: map[string]interface{}{"code": "http://loinc.org|2339-0"},
+	})
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), observations, 2)
+
+	//importing the file again (using the saved template) does not create duplicates
+	w = importCsvResources(suite, map[string]string{"template": "Glucose log"})
+	require.Equal(suite.T(), http.StatusOK, w.Code, w.Body.String())
+	require.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &respWrapper))
+	require.Equal(suite.T(), 2, respWrapper.Data.TotalResources)
+	require.Empty(suite.T(), respWrapper.Data.UpdatedResources)
+
+	observations, _, err = suite.AppRepository.QueryResources(authContext, models.QueryResource{
+		From:  "Observation",
+		Where: map[string]interface{}{"code": "http://loinc.org|2339-0"},
+	})
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), observations, 2)
+
+	userSettings, err := suite.AppRepository.LoadUserSettings(authContext)
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), userSettings.CsvImportTemplates, 1)
+	require.Equal(suite.T(), "Glucose log", userSettings.CsvImportTemplates[0].Name)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestImportCsvResourcesHandler_Invalid() {
+	var importTests = []struct {
+		fields         map[string]string
+		expectedStatus int
+	}{
+		//mapping is required
+		{map[string]string{}, http.StatusBadRequest},
+		//mapping is incomplete
+		{map[string]string{"mapping": `{"date_column":"Date","date_format":"YYYY-MM-DD"}`}, http.StatusBadRequest},
+		//template does not exist
+		{map[string]string{"template": "Unknown"}, http.StatusNotFound},
+		//column does not exist in the file
+		{map[string]string{"mapping": `{"date_column":"Date","date_format":"YYYY-MM-DD","columns":[{"column":"Systolic","code":"8480-6"}]}`}, http.StatusBadRequest},
+		//templates must have a name
+		{map[string]string{"mapping": `{"date_column":"Date","date_format":"MM/DD/YYYY HH:mm","columns":[{"column":"Notes","code":"8251-1"}]}`, "save_template": "true"}, http.StatusBadRequest},
+	}
+
+	for ndx, tt := range importTests {
+		w := importCsvResources(suite, tt.fields)
+		require.Equal(suite.T(), tt.expectedStatus, w.Code, "Expected status to match for importTests[%d]", ndx)
+	}
+}
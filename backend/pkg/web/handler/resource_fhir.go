@@ -1,12 +1,17 @@
 package handler
 
 import (
+	stderrors "errors"
+	"fmt"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/errors"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/utils"
 	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 	"net/http"
 	"strconv"
 	"strings"
@@ -14,7 +19,6 @@ import (
 
 func QueryResourceFhir(c *gin.Context) {
 	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
-	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
 
 	var query models.QueryResource
 	if err := c.ShouldBindJSON(&query); err != nil {
@@ -23,16 +27,39 @@ func QueryResourceFhir(c *gin.Context) {
 		return
 	}
 
-	queryResults, err := databaseRepo.QueryResources(c, query)
+	queryResources(c, query)
+}
+
+// QueryResourceFhirSearch accepts a FHIR search query string (eg. `/query/Observation?code=http://loinc.org|4548-4&_sort=-date`)
+// instead of the QueryResource json accepted by QueryResourceFhir, see models.ParseFhirSearchQuery
+func QueryResourceFhirSearch(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+
+	query, err := models.ParseFhirSearchQuery(c.Param("resourceType") + "?" + c.Request.URL.RawQuery)
 	if err != nil {
+		logger.Errorln("An error occurred while parsing search query", err)
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	queryResources(c, query)
+}
+
+func queryResources(c *gin.Context, query models.QueryResource) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	queryResults, pagination, err := databaseRepo.QueryResources(c, query)
+	if errors.IsQueryValidationError(err) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	} else if err != nil {
 		logger.Errorln("An error occurred while querying resources", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false})
 		return
 	}
-	//sort by date
-	//queryResults = utils.SortResourceListByDate(queryResults)
 
-	c.JSON(http.StatusOK, gin.H{"success": true, "data": queryResults})
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": queryResults, "total": pagination.Total, "next": pagination.Next})
 }
 
 func ListResourceFhir(c *gin.Context) {
@@ -49,8 +76,28 @@ func ListResourceFhir(c *gin.Context) {
 	if len(c.Query("sourceResourceID")) > 0 {
 		listResourceQueryOptions.SourceResourceID = c.Query("sourceResourceID")
 	}
-	if len(c.Query("page")) > 0 {
-		listResourceQueryOptions.Limit = pkg.ResourceListPageSize //hardcoded number of resources per page
+	if c.Query("sortBy") == "title" {
+		listResourceQueryOptions.SortBy = "title"
+	}
+	if len(c.Query("limit")) > 0 {
+		limit, err := strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 {
+			logger.Errorln("An error occurred while calculating limit", err)
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "limit must be a positive integer"})
+			return
+		}
+		listResourceQueryOptions.Limit = limit
+	}
+	if len(c.Query("cursor")) > 0 {
+		//cursor returned as `next` by the previous page
+		if listResourceQueryOptions.Limit == 0 {
+			listResourceQueryOptions.Limit = pkg.ResourceListPageSize
+		}
+		listResourceQueryOptions.Cursor = c.Query("cursor")
+	} else if len(c.Query("page")) > 0 {
+		if listResourceQueryOptions.Limit == 0 {
+			listResourceQueryOptions.Limit = pkg.ResourceListPageSize //hardcoded number of resources per page
+		}
 		pageNumb, err := strconv.Atoi(c.Query("page"))
 		if err != nil {
 			logger.Errorln("An error occurred while calculating page number", err)
@@ -59,21 +106,54 @@ func ListResourceFhir(c *gin.Context) {
 		}
 		listResourceQueryOptions.Offset = pageNumb * listResourceQueryOptions.Limit
 	}
-	wrappedResourceModels, err := databaseRepo.ListResources(c, listResourceQueryOptions)
-
-	if c.Query("sortBy") == "title" {
-		wrappedResourceModels = utils.SortResourceListByTitle(wrappedResourceModels)
-	} else {
-		wrappedResourceModels = utils.SortResourceListByDate(wrappedResourceModels)
-	}
 
+	//resources are sorted (and paginated) by the database
+	wrappedResourceModels, pagination, err := databaseRepo.ListResources(c, listResourceQueryOptions)
 	if err != nil {
 		logger.Errorln("An error occurred while retrieving resources", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"success": true, "data": wrappedResourceModels})
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": wrappedResourceModels, "total": pagination.Total, "next": pagination.Next})
+}
+
+// SearchResourceFhir is a full-text search across all of the user's resources, results are ranked by relevance
+// eg. /api/secure/resource/search?q=metformin&sourceResourceType=MedicationRequest,Condition&limit=20
+func SearchResourceFhir(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	searchOptions := models.ResourceSearchQueryOptions{
+		Query: c.Query("q"),
+	}
+	if len(strings.TrimSpace(searchOptions.Query)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "q is required"})
+		return
+	}
+	if len(c.Query("sourceResourceType")) > 0 {
+		searchOptions.SourceResourceTypes = strings.Split(c.Query("sourceResourceType"), ",")
+	}
+	if len(c.Query("limit")) > 0 {
+		limit, err := strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "limit must be a positive number"})
+			return
+		}
+		searchOptions.Limit = limit
+	}
+
+	searchResults, err := databaseRepo.SearchResources(c, searchOptions)
+	if errors.IsQueryValidationError(err) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	} else if err != nil {
+		logger.Errorln("An error occurred while searching resources", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": searchResults})
 }
 
 // this endpoint retrieves a specific resource by its ID
@@ -94,6 +174,94 @@ func GetResourceFhir(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"success": true, "data": wrappedResourceModel})
 }
 
+// GetResourceFhirHistory returns every version of a resource, newest first. The first version is the current version,
+// prior versions are stored when a resource is updated by a sync.
+func GetResourceFhirHistory(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	resourceVersions, err := listResourceFhirHistory(c, databaseRepo)
+	if stderrors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": fmt.Sprintf("resource %s does not exist", strings.Trim(c.Param("resourceId"), "/"))})
+		return
+	} else if err != nil {
+		logger.Errorln("An error occurred while retrieving resource history", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": resourceVersions})
+}
+
+// GetResourceFhirDiff returns the changes between two versions of a resource, as JSON Patch operations (https://datatracker.ietf.org/doc/html/rfc6902)
+// - `to` version id, defaults to the current version
+// - `from` version id, defaults to the version before `to`
+func GetResourceFhirDiff(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	resourceVersions, err := listResourceFhirHistory(c, databaseRepo)
+	if stderrors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": fmt.Sprintf("resource %s does not exist", strings.Trim(c.Param("resourceId"), "/"))})
+		return
+	} else if err != nil {
+		logger.Errorln("An error occurred while retrieving resource history", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false})
+		return
+	}
+
+	toVersionId := resourceVersions[0].VersionID
+	if len(c.Query("to")) > 0 {
+		toVersionId, err = strconv.Atoi(c.Query("to"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "to must be a version id"})
+			return
+		}
+	}
+	fromVersionId := toVersionId - 1
+	if len(c.Query("from")) > 0 {
+		fromVersionId, err = strconv.Atoi(c.Query("from"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "from must be a version id"})
+			return
+		}
+	}
+
+	fromVersion, fromFound := lo.Find(resourceVersions, func(resourceVersion models.ResourceHistory) bool {
+		return resourceVersion.VersionID == fromVersionId
+	})
+	toVersion, toFound := lo.Find(resourceVersions, func(resourceVersion models.ResourceHistory) bool {
+		return resourceVersion.VersionID == toVersionId
+	})
+	if !fromFound || !toFound {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": fmt.Sprintf("version %d or %d does not exist", fromVersionId, toVersionId)})
+		return
+	}
+
+	operations, err := utils.JsonDiff(fromVersion.ResourceRaw, toVersion.ResourceRaw)
+	if err != nil {
+		logger.Errorln("An error occurred while comparing resource versions", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": map[string]interface{}{
+		"from":       fromVersion.VersionID,
+		"to":         toVersion.VersionID,
+		"operations": operations,
+	}})
+}
+
+func listResourceFhirHistory(c *gin.Context, databaseRepo database.DatabaseRepository) ([]models.ResourceHistory, error) {
+	resourceId := strings.Trim(c.Param("resourceId"), "/")
+	sourceId := strings.Trim(c.Param("sourceId"), "/")
+	wrappedResourceModel, err := databaseRepo.GetResourceBySourceId(c, sourceId, resourceId)
+	if err != nil {
+		return nil, err
+	}
+	return databaseRepo.ListResourceHistory(c, sourceId, wrappedResourceModel.SourceResourceType, wrappedResourceModel.SourceResourceID)
+}
+
 // deprecated - using Manual Resource Wizard instead
 func CreateResourceComposition(c *gin.Context) {
 
@@ -9,6 +9,7 @@ import (
 
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"testing"
 
@@ -32,6 +33,7 @@ type ResourceFhirHandlerTestSuite struct {
 	suite.Suite
 	MockCtrl     *gomock.Controller
 	TestDatabase *os.File
+	TestCacheDir string
 
 	AppConfig     *mock_config.MockInterface
 	AppRepository database.DatabaseRepository
@@ -76,11 +78,23 @@ func (suite *ResourceFhirHandlerTestSuite) SetupSuite() {
 	}
 	suite.TestDatabase = dbFile
 
+	cacheDir, err := os.MkdirTemp("", fmt.Sprintf("%s.cache.*", suiteName))
+	if err != nil {
+		log.Fatal(err)
+	}
+	suite.TestCacheDir = cacheDir
+
 	appConfig := mock_config.NewMockInterface(suite.MockCtrl)
 	appConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
 	appConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
 	appConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
 	appConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
+	appConfig.EXPECT().GetString("cache.location").Return(suite.TestCacheDir).AnyTimes()
+	appConfig.EXPECT().GetInt("history.retention.max_versions").Return(0).AnyTimes()
+	appConfig.EXPECT().GetInt("history.retention.days").Return(0).AnyTimes()
+	appConfig.EXPECT().GetInt("jobs.logs.max_entries").Return(500).AnyTimes()
+	appConfig.EXPECT().GetInt("jobs.logs.retention_days").Return(30).AnyTimes()
+	appConfig.EXPECT().GetInt("export.retention_hours").Return(24).AnyTimes()
 	suite.AppConfig = appConfig
 
 	appRepo, err := database.NewRepository(suite.AppConfig, logrus.WithField("test", suite.T().Name()), event_bus.NewNoopEventBusServer())
@@ -123,6 +137,7 @@ func (suite *ResourceFhirHandlerTestSuite) SetupSuite() {
 func (suite *ResourceFhirHandlerTestSuite) TearDownSuite() {
 	suite.MockCtrl.Finish()
 	os.Remove(suite.TestDatabase.Name())
+	os.RemoveAll(suite.TestCacheDir)
 }
 
 func TestResourceHandlerTestSuite(t *testing.T) {
@@ -340,6 +355,78 @@ func (suite *ResourceFhirHandlerTestSuite) TestListResourceFhirHandler_SortingBy
 
 }
 
+func (suite *ResourceFhirHandlerTestSuite) TestListResourceFhirHandler_WithCursor() {
+	type ResponseWrapper struct {
+		Data    []models.ResourceBase `json:"data"`
+		Success bool                  `json:"success"`
+		Total   int64                 `json:"total"`
+		Next    string                `json:"next"`
+	}
+
+	//first page
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	err := addParamsToGinContext(ctx, []gin.Param{
+		{Key: "sourceID", Value: suite.SourceId.String()},
+		{Key: "limit", Value: "10"},
+	})
+	suite.NoError(err)
+
+	ListResourceFhir(ctx)
+
+	var firstPage ResponseWrapper
+	err = json.Unmarshal(w.Body.Bytes(), &firstPage)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), true, firstPage.Success)
+	require.Equal(suite.T(), 10, len(firstPage.Data))
+	require.Greater(suite.T(), firstPage.Total, int64(10))
+	require.NotEmpty(suite.T(), firstPage.Next)
+
+	//second page
+	w = httptest.NewRecorder()
+	ctx, _ = gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	err = addParamsToGinContext(ctx, []gin.Param{
+		{Key: "sourceID", Value: suite.SourceId.String()},
+		{Key: "limit", Value: "10"},
+		{Key: "cursor", Value: firstPage.Next},
+	})
+	suite.NoError(err)
+
+	ListResourceFhir(ctx)
+
+	var secondPage ResponseWrapper
+	err = json.Unmarshal(w.Body.Bytes(), &secondPage)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), true, secondPage.Success)
+	require.Equal(suite.T(), 10, len(secondPage.Data))
+	require.Equal(suite.T(), firstPage.Total, secondPage.Total)
+
+	//pages are sorted by date (newest first), and must not overlap
+	lastOfFirstPage := firstPage.Data[len(firstPage.Data)-1]
+	for _, data := range secondPage.Data {
+		require.NotEqual(suite.T(), lastOfFirstPage.ID, data.ID)
+		if lastOfFirstPage.SortDate != nil && data.SortDate != nil {
+			require.False(suite.T(), data.SortDate.After(*lastOfFirstPage.SortDate))
+		}
+	}
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestListResourceFhirHandler_WithInvalidLimit() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	err := addParamsToGinContext(ctx, []gin.Param{
+		{Key: "limit", Value: "-1"},
+	})
+	suite.NoError(err)
+
+	ListResourceFhir(ctx)
+
+	require.Equal(suite.T(), http.StatusBadRequest, w.Code)
+}
+
 func (suite *ResourceFhirHandlerTestSuite) TestListResourceFhirHandler_WithInvalidSourceResourceId() {
 	w := httptest.NewRecorder()
 	ctx, _ := gin.CreateTestContext(w)
@@ -399,3 +486,187 @@ func (suite *ResourceFhirHandlerTestSuite) TestListResourceFhirHandler_WithInval
 	require.Empty(suite.T(), respWrapper.Data)
 
 }
+
+func (suite *ResourceFhirHandlerTestSuite) TestSearchResourceFhirHandler() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "/resource/search?q=acetaminophen%20325", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+
+	SearchResourceFhir(ctx)
+
+	type ResponseWrapper struct {
+		Data    []models.ResourceSearchResult `json:"data"`
+		Success bool                          `json:"success"`
+	}
+	var respWrapper ResponseWrapper
+	err = json.Unmarshal(w.Body.Bytes(), &respWrapper)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	require.Equal(suite.T(), true, respWrapper.Success)
+	require.Equal(suite.T(), 1, len(respWrapper.Data))
+	require.Equal(suite.T(), suite.SourceId, respWrapper.Data[0].SourceID)
+	require.Equal(suite.T(), "MedicationRequest", respWrapper.Data[0].SourceResourceType)
+	require.Equal(suite.T(), "395d20f9-8b5c-4808-8554-a04979abd7b8", respWrapper.Data[0].SourceResourceID)
+	require.Contains(suite.T(), respWrapper.Data[0].Snippet, "Acetaminophen")
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestSearchResourceFhirHandler_WithSourceResourceType() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "/resource/search?q=acetaminophen&sourceResourceType=Condition,Observation", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+
+	SearchResourceFhir(ctx)
+
+	type ResponseWrapper struct {
+		Data    []models.ResourceSearchResult `json:"data"`
+		Success bool                          `json:"success"`
+	}
+	var respWrapper ResponseWrapper
+	err = json.Unmarshal(w.Body.Bytes(), &respWrapper)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	require.Equal(suite.T(), true, respWrapper.Success)
+	require.Equal(suite.T(), 0, len(respWrapper.Data))
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestSearchResourceFhirHandler_WithMissingQuery() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "/resource/search?q=%20", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+
+	SearchResourceFhir(ctx)
+
+	require.Equal(suite.T(), http.StatusBadRequest, w.Code)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestSearchResourceFhirHandler_WithPunctuationQuery() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "/resource/search?q=!!!", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+
+	SearchResourceFhir(ctx)
+
+	require.Equal(suite.T(), http.StatusBadRequest, w.Code)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestSearchResourceFhirHandler_WithInvalidSourceResourceType() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "/resource/search?q=acetaminophen&sourceResourceType=NotAResource", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+
+	SearchResourceFhir(ctx)
+
+	require.Equal(suite.T(), http.StatusBadRequest, w.Code)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestQueryResourceFhirSearchHandler() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "/query/Observation?category=vital-signs,laboratory&date=ge2000&_sort=-date&_count=5", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+	ctx.Params = []gin.Param{{Key: "resourceType", Value: "Observation"}}
+
+	QueryResourceFhirSearch(ctx)
+
+	type ResponseWrapper struct {
+		Data    []models.ResourceBase `json:"data"`
+		Success bool                  `json:"success"`
+		Total   int64                 `json:"total"`
+	}
+	var respWrapper ResponseWrapper
+	err = json.Unmarshal(w.Body.Bytes(), &respWrapper)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	require.Equal(suite.T(), true, respWrapper.Success)
+	require.Equal(suite.T(), 5, len(respWrapper.Data))
+
+	//the results must match the equivalent QueryResource
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+	limit := 5
+	expectedResults, expectedPagination, err := suite.AppRepository.QueryResources(authContext, models.QueryResource{
+		From:  "Observation",
+		Where: map[string]interface{}{"category": "vital-signs,laboratory", "date": "ge2000"},
+		Sort:  []string{"-date"},
+		Limit: &limit,
+	})
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), expectedPagination.Total, respWrapper.Total)
+	for ndx, expectedResult := range expectedResults.([]models.ResourceBase) {
+		require.Equal(suite.T(), expectedResult.ID, respWrapper.Data[ndx].ID)
+	}
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestQueryResourceFhirSearchHandler_WithInvalidCount() {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "/query/Observation?_count=abc", nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+	ctx.Params = []gin.Param{{Key: "resourceType", Value: "Observation"}}
+
+	QueryResourceFhirSearch(ctx)
+
+	require.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	require.Contains(suite.T(), w.Body.String(), "_count must be a positive integer")
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestQueryResourceFhirSearchHandler_WithId() {
+	//_id is the FHIR resource id (assigned by the source), not the internal id
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+	limit := 1
+	existingResults, _, err := suite.AppRepository.QueryResources(authContext, models.QueryResource{
+		From:  "Observation",
+		Limit: &limit,
+	})
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), existingResults.([]models.ResourceBase), 1)
+	existingResource := existingResults.([]models.ResourceBase)[0]
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+
+	req, err := http.NewRequest("GET", "/query/Observation?_id="+url.QueryEscape(existingResource.SourceResourceID), nil)
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+	ctx.Params = []gin.Param{{Key: "resourceType", Value: "Observation"}}
+
+	QueryResourceFhirSearch(ctx)
+
+	type ResponseWrapper struct {
+		Data    []models.ResourceBase `json:"data"`
+		Success bool                  `json:"success"`
+	}
+	var respWrapper ResponseWrapper
+	err = json.Unmarshal(w.Body.Bytes(), &respWrapper)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	require.Len(suite.T(), respWrapper.Data, 1)
+	require.Equal(suite.T(), existingResource.ID, respWrapper.Data[0].ID)
+	require.Equal(suite.T(), existingResource.SourceResourceID, respWrapper.Data[0].SourceResourceID)
+}
@@ -0,0 +1,251 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	databaseModel "github.com/fastenhealth/fasten-onprem/backend/pkg/models/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/validation"
+	"github.com/fastenhealth/fasten-sources/clients/factory"
+	sourceModels "github.com/fastenhealth/fasten-sources/clients/models"
+	sourcePkg "github.com/fastenhealth/fasten-sources/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// CreateResourceFhir creates a user-authored resource (eg. a home blood pressure reading), owned by the Fasten source for this user.
+// The resource id is always generated by Fasten.
+func CreateResourceFhir(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	resource, isValid := parseResourceFhirWrite(c, c.Param("resourceType"))
+	if !isValid {
+		return
+	}
+	resource["id"] = uuid.New().String()
+
+	fastenSourceCredential, err := getFastenSourceCredential(c, databaseRepo)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	storedResource, err := storeResourceFhirWrite(c, logger, databaseRepo, fastenSourceCredential, resource, false)
+	if err != nil {
+		logger.Errorln("An error occurred while storing resource", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": storedResource})
+}
+
+// UpdateResourceFhir replaces an existing user-authored resource. Resources from other sources cannot be updated, since
+// they would be overwritten by the next sync.
+func UpdateResourceFhir(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	resourceType := c.Param("resourceType")
+	resourceId := strings.Trim(c.Param("resourceId"), "/")
+
+	resource, isValid := parseResourceFhirWrite(c, resourceType)
+	if !isValid {
+		return
+	}
+	if bodyResourceId, hasResourceId := resource["id"]; hasResourceId && bodyResourceId != resourceId {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": fmt.Sprintf("resource id (%v) does not match the request url (%s)", bodyResourceId, resourceId)})
+		return
+	}
+	resource["id"] = resourceId
+
+	fastenSourceCredential, err := getFastenSourceCredential(c, databaseRepo)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	existingResource, err := findResourceFhirWrite(c, databaseRepo, fastenSourceCredential, resourceType, resourceId)
+	if err != nil {
+		logger.Errorln("An error occurred while retrieving resource", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false})
+		return
+	} else if existingResource == nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": fmt.Sprintf("user-authored resource %s/%s does not exist", resourceType, resourceId)})
+		return
+	}
+
+	storedResource, err := storeResourceFhirWrite(c, logger, databaseRepo, fastenSourceCredential, resource, true)
+	if err != nil {
+		logger.Errorln("An error occurred while storing resource", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": storedResource})
+}
+
+// DeleteResourceFhir removes a user-authored resource, along with its associations
+func DeleteResourceFhir(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+
+	resourceType := c.Param("resourceType")
+	resourceId := strings.Trim(c.Param("resourceId"), "/")
+	if !lo.Contains(databaseModel.GetAllowedResourceTypes(), resourceType) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": fmt.Sprintf("unsupported resource type: %s", resourceType)})
+		return
+	}
+
+	fastenSourceCredential, err := getFastenSourceCredential(c, databaseRepo)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	rowsAffected, err := databaseRepo.DeleteResource(c, fastenSourceCredential.ID.String(), resourceType, resourceId)
+	if err != nil {
+		logger.Errorln("An error occurred while deleting resource", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false})
+		return
+	} else if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "error": fmt.Sprintf("user-authored resource %s/%s does not exist", resourceType, resourceId)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "data": rowsAffected})
+}
+
+// getFastenSourceCredential finds the Fasten source for the current user, which owns every user-authored resource
+func getFastenSourceCredential(c *gin.Context, databaseRepo database.DatabaseRepository) (*models.SourceCredential, error) {
+	sourceCredentials, err := databaseRepo.GetSources(c)
+	if err != nil {
+		return nil, err
+	}
+	for ndx := range sourceCredentials {
+		if sourceCredentials[ndx].SourceType == sourcePkg.SourceTypeFasten {
+			return &sourceCredentials[ndx], nil
+		}
+	}
+	return nil, fmt.Errorf("could not find Fasten source for this user")
+}
+
+// parseResourceFhirWrite parses the request body, and validates it against the FHIR R4 structure for the resource type.
+// Responds with the validation OperationOutcome and returns false if the resource is invalid.
+func parseResourceFhirWrite(c *gin.Context, resourceType string) (map[string]interface{}, bool) {
+	if !lo.Contains(databaseModel.GetAllowedResourceTypes(), resourceType) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": fmt.Sprintf("unsupported resource type: %s", resourceType)})
+		return nil, false
+	}
+
+	resourceRaw, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "could not read request body"})
+		return nil, false
+	}
+	operationOutcome := validation.ValidateResource(resourceRaw, validation.Options{ResourceType: resourceType})
+	if validation.HasErrors(operationOutcome) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": fmt.Sprintf("invalid %s resource", resourceType), "data": operationOutcome})
+		return nil, false
+	}
+
+	var resource map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(resourceRaw))
+	//numbers must not lose precision (eg. decimal values)
+	decoder.UseNumber()
+	if err := decoder.Decode(&resource); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "request body is not a valid json object"})
+		return nil, false
+	}
+	return resource, true
+}
+
+// findResourceFhirWrite returns the user-authored resource, or nil if it does not exist
+func findResourceFhirWrite(c *gin.Context, databaseRepo database.DatabaseRepository, fastenSourceCredential *models.SourceCredential, resourceType string, resourceId string) (*models.ResourceBase, error) {
+	foundResources, _, err := databaseRepo.ListResources(c, models.ListResourceQueryOptions{
+		SourceID:           fastenSourceCredential.ID.String(),
+		SourceResourceType: resourceType,
+		SourceResourceID:   resourceId,
+		Limit:              1,
+	})
+	if err != nil || len(foundResources) == 0 {
+		return nil, err
+	}
+	return &foundResources[0], nil
+}
+
+// storeResourceFhirWrite stores a user-authored resource using the Fasten source client (see CreateRelatedResources), so that
+// sort fields & references are extracted the same way as every other resource.
+// The source client only logs storage errors, so they are captured by the resourceFhirWriteRepository.
+// The resource is stored in a single transaction, when an existing resource is replaced (replaceAssociations), its associations
+// to other resources are removed first, so that the associations match the references of the stored resource.
+func storeResourceFhirWrite(c *gin.Context, logger *logrus.Entry, databaseRepo database.DatabaseRepository, fastenSourceCredential *models.SourceCredential, resource map[string]interface{}, replaceAssociations bool) (*models.ResourceBase, error) {
+	bundleFile, err := os.CreateTemp("", "resource-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("could not create temp file")
+	}
+	defer os.Remove(bundleFile.Name())
+	defer bundleFile.Close()
+
+	err = json.NewEncoder(bundleFile).Encode(map[string]interface{}{
+		"resourceType": "Bundle",
+		"type":         "collection",
+		"entry":        []map[string]interface{}{{"resource": resource}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not save temp file")
+	}
+
+	fastenSourceClient, err := factory.GetSourceClient(sourcePkg.GetFastenLighthouseEnv(), sourcePkg.SourceTypeFasten, c, logger, fastenSourceCredential)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Fasten source client")
+	}
+	resourceType, resourceId := resource["resourceType"].(string), resource["id"].(string)
+	err = databaseRepo.RunInTransaction(c, func(txRepo database.DatabaseRepository) error {
+		if replaceAssociations {
+			if err := txRepo.RemoveResourceAssociations(c, fastenSourceCredential, resourceType, resourceId); err != nil {
+				return err
+			}
+		}
+		writeRepo := &resourceFhirWriteRepository{DatabaseRepository: txRepo}
+		_, err := fastenSourceClient.SyncAllBundle(writeRepo, bundleFile, sourcePkg.FhirVersion401)
+		if err == nil {
+			err = writeRepo.upsertErr
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("an error occurred while storing resource: %w", err)
+	}
+
+	storedResource, err := findResourceFhirWrite(c, databaseRepo, fastenSourceCredential, resourceType, resourceId)
+	if err != nil {
+		return nil, err
+	} else if storedResource == nil {
+		return nil, fmt.Errorf("resource %s/%s was not stored", resourceType, resourceId)
+	}
+	return storedResource, nil
+}
+
+// resourceFhirWriteRepository records the first error returned while storing resources
+type resourceFhirWriteRepository struct {
+	database.DatabaseRepository
+	upsertErr error
+}
+
+func (r *resourceFhirWriteRepository) UpsertRawResource(ctx context.Context, sourceCredential sourceModels.SourceCredential, rawResource sourceModels.RawResourceFhir) (bool, error) {
+	isUpdated, err := r.DatabaseRepository.UpsertRawResource(ctx, sourceCredential, rawResource)
+	if err != nil && r.upsertErr == nil {
+		r.upsertErr = err
+	}
+	return isUpdated, err
+}
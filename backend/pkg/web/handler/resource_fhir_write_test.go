@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	sourcePkg "github.com/fastenhealth/fasten-sources/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+// writeResourceFhir calls a resource write handler, and returns the response status & the stored resource (if any)
+func writeResourceFhir(suite *ResourceFhirHandlerTestSuite, handler gin.HandlerFunc, method string, params []gin.Param, body string) (int, models.ResourceBase) {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	setupGinContext(ctx, suite)
+	req, err := http.NewRequest(method, "/api/secure/resource/fhir", strings.NewReader(body))
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+	ctx.Params = params
+
+	handler(ctx)
+
+	var respWrapper struct {
+		Success bool                `json:"success"`
+		Data    models.ResourceBase `json:"data"`
+	}
+	if w.Code == http.StatusOK && method != http.MethodDelete {
+		require.NoError(suite.T(), json.Unmarshal(w.Body.Bytes(), &respWrapper))
+		require.True(suite.T(), respWrapper.Success)
+	}
+	return w.Code, respWrapper.Data
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestCreateUpdateDeleteResourceFhirHandler() {
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+
+	//create
+	status, createdResource := writeResourceFhir(suite, CreateResourceFhir, http.MethodPost,
+		[]gin.Param{{Key: "resourceType", Value: "Observation"}},
+		`{"resourceType":"Observation","id":"ignored","status":"preliminary","code":{"text":"Blood pressure"},"effectiveDateTime":"2023-02-01T08:00:00Z","valueQuantity":{"value":120.5,"unit":"mmHg"}}`,
+	)
+	require.Equal(suite.T(), http.StatusOK, status)
+	require.Equal(suite.T(), "Observation", createdResource.SourceResourceType)
+	require.NotEqual(suite.T(), "ignored", createdResource.SourceResourceID)
+	require.NotNil(suite.T(), createdResource.SortDate)
+	require.Contains(suite.T(), string(createdResource.ResourceRaw), `"value":120.5`)
+	resourceId := createdResource.SourceResourceID
+
+	fastenSourceCredential, err := suite.AppRepository.GetSource(authContext, createdResource.SourceID.String())
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), sourcePkg.SourceTypeFasten, fastenSourceCredential.SourceType)
+
+	//update
+	status, updatedResource := writeResourceFhir(suite, UpdateResourceFhir, http.MethodPut,
+		[]gin.Param{{Key: "resourceType", Value: "Observation"}, {Key: "resourceId", Value: resourceId}},
+		`{"resourceType":"Observation","status":"final","code":{"text":"Blood pressure"},"effectiveDateTime":"2023-02-01T08:00:00Z","valueQuantity":{"value":120.5,"unit":"mmHg"}}`,
+	)
+	require.Equal(suite.T(), http.StatusOK, status)
+	require.Equal(suite.T(), resourceId, updatedResource.SourceResourceID)
+	require.Contains(suite.T(), string(updatedResource.ResourceRaw), `"status":"final"`)
+	resourceVersions, err := suite.AppRepository.ListResourceHistory(authContext, fastenSourceCredential.ID.String(), "Observation", resourceId)
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), resourceVersions, 2)
+
+	//delete
+	deleteParams := []gin.Param{{Key: "resourceType", Value: "Observation"}, {Key: "resourceId", Value: resourceId}}
+	status, _ = writeResourceFhir(suite, DeleteResourceFhir, http.MethodDelete, deleteParams, "")
+	require.Equal(suite.T(), http.StatusOK, status)
+	status, _ = writeResourceFhir(suite, DeleteResourceFhir, http.MethodDelete, deleteParams, "")
+	require.Equal(suite.T(), http.StatusNotFound, status)
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestWriteResourceFhirHandler_Invalid() {
+	var writeTests = []struct {
+		handler        gin.HandlerFunc
+		method         string
+		params         []gin.Param
+		body           string
+		expectedStatus int
+	}{
+		//resourceType does not match the url
+		{CreateResourceFhir, http.MethodPost, []gin.Param{{Key: "resourceType", Value: "Observation"}}, `{"resourceType":"Condition"}`, http.StatusBadRequest},
+		//unsupported resource type
+		{CreateResourceFhir, http.MethodPost, []gin.Param{{Key: "resourceType", Value: "Unknown"}}, `{"resourceType":"Unknown"}`, http.StatusBadRequest},
+		//invalid status code
+		{CreateResourceFhir, http.MethodPost, []gin.Param{{Key: "resourceType", Value: "Observation"}}, `{"resourceType":"Observation","status":"invalid-status"}`, http.StatusBadRequest},
+		//invalid json
+		{CreateResourceFhir, http.MethodPost, []gin.Param{{Key: "resourceType", Value: "Observation"}}, `{"resourceType":`, http.StatusBadRequest},
+		//resource id does not match the url
+		{UpdateResourceFhir, http.MethodPut, []gin.Param{{Key: "resourceType", Value: "Observation"}, {Key: "resourceId", Value: "1"}}, `{"resourceType":"Observation","id":"2","status":"final"}`, http.StatusBadRequest},
+		//resources from other sources cannot be updated
+		{UpdateResourceFhir, http.MethodPut, []gin.Param{{Key: "resourceType", Value: "Patient"}, {Key: "resourceId", Value: "b426b062-8273-4b93-a907-de3176c0567d"}}, `{"resourceType":"Patient","gender":"female"}`, http.StatusNotFound},
+		{DeleteResourceFhir, http.MethodDelete, []gin.Param{{Key: "resourceType", Value: "Patient"}, {Key: "resourceId", Value: "b426b062-8273-4b93-a907-de3176c0567d"}}, ``, http.StatusNotFound},
+	}
+
+	for ndx, tt := range writeTests {
+		status, _ := writeResourceFhir(suite, tt.handler, tt.method, tt.params, tt.body)
+		require.Equal(suite.T(), tt.expectedStatus, status, "Expected status to match for writeTests[%d]", ndx)
+	}
+}
+
+func (suite *ResourceFhirHandlerTestSuite) TestUpdateResourceFhirHandler_RemovesReference() {
+	authContext := context.WithValue(context.Background(), pkg.ContextKeyTypeAuthUsername, "test_user")
+
+	//setup
+	status, createdResource := writeResourceFhir(suite, CreateResourceFhir, http.MethodPost,
+		[]gin.Param{{Key: "resourceType", Value: "Observation"}},
+		`{"resourceType":"Observation","status":"final","code":{"text":"Heart rate"},"subject":{"reference":"Patient/write-test-patient"},"encounter":{"reference":"Encounter/write-test-encounter"}}`,
+	)
+	require.Equal(suite.T(), http.StatusOK, status)
+	resourceId := createdResource.SourceResourceID
+	fastenSourceCredential, err := suite.AppRepository.GetSource(authContext, createdResource.SourceID.String())
+	require.NoError(suite.T(), err)
+	associations, err := suite.AppRepository.FindResourceAssociationsByTypeAndId(authContext, fastenSourceCredential, "Observation", resourceId)
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), associations, 2)
+
+	//test
+	status, _ = writeResourceFhir(suite, UpdateResourceFhir, http.MethodPut,
+		[]gin.Param{{Key: "resourceType", Value: "Observation"}, {Key: "resourceId", Value: resourceId}},
+		`{"resourceType":"Observation","status":"final","code":{"text":"Heart rate"},"subject":{"reference":"Patient/write-test-patient"}}`,
+	)
+
+	//assert
+	require.Equal(suite.T(), http.StatusOK, status)
+	associations, err = suite.AppRepository.FindResourceAssociationsByTypeAndId(authContext, fastenSourceCredential, "Observation", resourceId)
+	require.NoError(suite.T(), err)
+	require.Len(suite.T(), associations, 1)
+	require.Equal(suite.T(), "Patient", associations[0].RelatedResourceSourceResourceType)
+	require.Equal(suite.T(), "write-test-patient", associations[0].RelatedResourceSourceResourceID)
+}
@@ -27,18 +27,14 @@ func CreateRelatedResources(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
 		return
 	}
+	if !preflightValidateFile(c, logger, bundleFile) {
+		return
+	}
 
 	//step 2: find a reference to the Fasten source for this user
-	sourceCredentials, err := databaseRepo.GetSources(c)
-	var fastenSourceCredential *models.SourceCredential
-	for _, sourceCredential := range sourceCredentials {
-		if sourceCredential.SourceType == sourcePkg.SourceTypeFasten {
-			fastenSourceCredential = &sourceCredential
-			break
-		}
-	}
-	if fastenSourceCredential == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "could not find Fasten source for this user"})
+	fastenSourceCredential, err := getFastenSourceCredential(c, databaseRepo)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
 		return
 	}
 
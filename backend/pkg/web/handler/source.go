@@ -2,17 +2,22 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/ccda"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/job_runner"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/validation"
 	"github.com/fastenhealth/fasten-sources/clients/factory"
 	sourceModels "github.com/fastenhealth/fasten-sources/clients/models"
 	sourcePkg "github.com/fastenhealth/fasten-sources/pkg"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -21,6 +26,7 @@ import (
 func CreateReconnectSource(c *gin.Context) {
 	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
 	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+	jobRunner := c.MustGet(pkg.ContextKeyTypeJobRunner).(job_runner.Interface)
 
 	sourceCred := models.SourceCredential{}
 	if err := c.ShouldBindJSON(&sourceCred); err != nil {
@@ -79,20 +85,20 @@ func CreateReconnectSource(c *gin.Context) {
 	}
 
 	// after creating the source, we should do a bulk import (in the background)
-
-	summary, err := BackgroundJobSyncResources(GetBackgroundContext(c), logger, databaseRepo, &sourceCred)
+	backgroundJob, err := BackgroundJobQueueSyncResources(c, logger, databaseRepo, &sourceCred)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false})
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
 		return
 	}
+	jobRunner.Notify()
 
-	c.JSON(http.StatusOK, gin.H{"success": true, "source": sourceCred, "data": summary})
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "source": sourceCred, "data": backgroundJob})
 }
 
 func SourceSync(c *gin.Context) {
 	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
 	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
-	eventBus := c.MustGet(pkg.ContextKeyTypeEventBusServer).(event_bus.Interface)
+	jobRunner := c.MustGet(pkg.ContextKeyTypeJobRunner).(job_runner.Interface)
 
 	logger.Infof("Get SourceCredential Credentials: %v", c.Param("sourceId"))
 
@@ -103,26 +109,15 @@ func SourceSync(c *gin.Context) {
 		return
 	}
 
-	// after creating the source, we should do a bulk import (in the background)
-	summary, err := BackgroundJobSyncResources(GetBackgroundContext(c), logger, databaseRepo, sourceCred)
+	// the sync is processed by the job runner, which publishes a source complete event once it's done
+	backgroundJob, err := BackgroundJobQueueSyncResources(c, logger, databaseRepo, sourceCred)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false})
+		c.JSON(http.StatusConflict, gin.H{"success": false, "error": err.Error()})
 		return
 	}
+	jobRunner.Notify()
 
-	//publish event
-	currentUser, _ := databaseRepo.GetCurrentUser(c)
-	err = eventBus.PublishMessage(
-		models.NewEventSourceComplete(
-			currentUser.ID.String(),
-			sourceCred.ID.String(),
-		),
-	)
-	if err != nil {
-		logger.Warnf("ignoring: an error occurred while publishing sync complete event: %v", err)
-	}
-
-	c.JSON(http.StatusOK, gin.H{"success": true, "source": sourceCred, "data": summary})
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "source": sourceCred, "data": backgroundJob})
 }
 
 // mimics functionality in CreateRelatedResources
@@ -132,12 +127,28 @@ func CreateManualSource(c *gin.Context) {
 	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
 	eventBus := c.MustGet(pkg.ContextKeyTypeEventBusServer).(event_bus.Interface)
 
-	// store the bundle file locally
-	bundleFile, err := storeFileLocally(c)
+	// store the uploaded file locally
+	uploadedFile, err := storeFileLocally(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
 		return
 	}
+	defer os.Remove(uploadedFile.Name())
+	defer uploadedFile.Close()
+
+	// C-CDA documents are converted to a FHIR bundle, which is validated & imported instead of the original file
+	bundleFile, conversion, ok := convertCCDAFile(c, logger, uploadedFile)
+	if !ok {
+		return
+	} else if conversion != nil {
+		defer os.Remove(bundleFile.Name())
+		defer bundleFile.Close()
+	}
+
+	// validate the bundle file before any resources are stored
+	if !preflightValidateFile(c, logger, bundleFile) {
+		return
+	}
 
 	// We cannot save the "SourceCredential" object yet, as we do not know the patientID
 
@@ -158,6 +169,10 @@ func CreateManualSource(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
 		return
 	}
+	if conversion != nil {
+		// the manual client trims the "Patient/" prefix character by character, which may mangle the generated patient id
+		patientId = conversion.PatientId
+	}
 	manualSourceCredential.Patient = patientId
 
 	//store the manualSourceCredential
@@ -186,6 +201,11 @@ func CreateManualSource(c *gin.Context) {
 				return manualSourceClient, sourceModels.UpsertSummary{}, resultErr
 			}
 
+			if conversion != nil && len(conversion.Warnings) > 0 {
+				//record the data which could not be converted, so it's visible in the background job
+				_databaseRepo.BackgroundJobCheckpoint(_backgroundJobContext, nil, map[string]interface{}{"conversion_warnings": conversion.Warnings})
+			}
+
 			summary, err := manualSourceClient.SyncAllBundle(_databaseRepo, bundleFile, bundleType)
 			if err != nil {
 				resultErr := fmt.Errorf("an error occurred while processing bundle: %w", err)
@@ -216,6 +236,36 @@ func CreateManualSource(c *gin.Context) {
 
 }
 
+// ValidateManualSource is a dry-run of CreateManualSource, the uploaded file is validated (see validation.ValidateDocument)
+// but nothing is stored. The `profile` query parameter can be used to validate against US Core profiles.
+func ValidateManualSource(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+
+	bundleFile, err := storeFileLocally(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	defer os.Remove(bundleFile.Name())
+	defer bundleFile.Close()
+
+	convertedFile, conversion, ok := convertCCDAFile(c, logger, bundleFile)
+	if !ok {
+		return
+	} else if conversion != nil {
+		defer os.Remove(convertedFile.Name())
+		defer convertedFile.Close()
+	}
+
+	operationOutcome, err := validation.ValidateDocument(convertedFile, validation.Options{Profiles: c.QueryArray("profile")})
+	if err != nil {
+		logger.Errorln("An error occurred while validating file", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": !validation.HasErrors(operationOutcome), "data": operationOutcome})
+}
+
 func GetSource(c *gin.Context) {
 	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
 	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
@@ -269,6 +319,74 @@ func DeleteSource(c *gin.Context) {
 }
 
 // Helpers
+// preflightValidateFile validates an uploaded file before it is imported, and responds with the OperationOutcome if the
+// file contains errors. Returns false if the import must not continue.
+func preflightValidateFile(c *gin.Context, logger *logrus.Entry, file *os.File) bool {
+	operationOutcome, err := validation.ValidateDocument(file, validation.Options{Profiles: c.QueryArray("profile")})
+	if err == nil {
+		//the file is read again during the import
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		logger.Errorln("An error occurred while validating file", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return false
+	} else if validation.HasErrors(operationOutcome) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "file contains invalid FHIR resources", "data": operationOutcome})
+		return false
+	}
+	return true
+}
+
+// convertCCDAFile converts an uploaded C-CDA document to a FHIR bundle (see ccda.Convert), which is stored in a new temp
+// file. Other files are returned unchanged, with a nil conversion. Returns false if the upload must not continue.
+func convertCCDAFile(c *gin.Context, logger *logrus.Entry, file *os.File) (*os.File, *ccda.Conversion, bool) {
+	isDocument, err := ccda.IsDocument(file)
+	if err != nil {
+		logger.Errorln("An error occurred while detecting file type", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return nil, nil, false
+	} else if !isDocument {
+		return file, nil, true
+	}
+
+	document, err := io.ReadAll(file)
+	if err != nil {
+		logger.Errorln("An error occurred while reading C-CDA document", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return nil, nil, false
+	}
+	conversion, err := ccda.Convert(document)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": fmt.Sprintf("could not convert C-CDA document: %v", err)})
+		return nil, nil, false
+	}
+
+	bundleJson, err := json.Marshal(conversion.Bundle)
+	if err != nil {
+		logger.Errorln("An error occurred while serializing converted C-CDA document", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return nil, nil, false
+	}
+	bundleFile, err := ioutil.TempFile("", "ccda_bundle.*.json")
+	if err == nil {
+		_, err = bundleFile.Write(bundleJson)
+	}
+	if err == nil {
+		_, err = bundleFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		if bundleFile != nil {
+			bundleFile.Close()
+			os.Remove(bundleFile.Name())
+		}
+		logger.Errorln("An error occurred while storing converted C-CDA document", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "could not store converted C-CDA document"})
+		return nil, nil, false
+	}
+	return bundleFile, conversion, true
+}
+
 func storeFileLocally(c *gin.Context) (*os.File, error) {
 	// single file
 	file, err := c.FormFile("file")
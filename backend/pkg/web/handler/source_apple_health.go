@@ -0,0 +1,256 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/applehealth"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/config"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/job_runner"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
+	"github.com/fastenhealth/fasten-sources/clients/factory"
+	sourceModels "github.com/fastenhealth/fasten-sources/clients/models"
+	sourcePkg "github.com/fastenhealth/fasten-sources/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// appleHealthCheckpointInterval is the number of records stored between background job checkpoints
+const appleHealthCheckpointInterval = 1000
+
+// CreateAppleHealthSource creates a new manual source, and queues the import of an Apple Health `export.zip` (see applehealth.Export).
+// HealthKit records are converted to Observations and stored as they are read from export.xml, then the FHIR R4 clinical records
+// are imported using the manual source client (see CreateManualSource).
+// The export is stored in the cache location until it's imported by the job runner (see importAppleHealthExportFile), since large
+// exports can take several minutes to import. The import is tracked by a SYNC background job, the progress is stored using
+// BackgroundJobCheckpoint, and the skipped records are stored in the job error data.
+func CreateAppleHealthSource(c *gin.Context) {
+	logger := c.MustGet(pkg.ContextKeyTypeLogger).(*logrus.Entry)
+	databaseRepo := c.MustGet(pkg.ContextKeyTypeDatabase).(database.DatabaseRepository)
+	appConfig := c.MustGet(pkg.ContextKeyTypeConfig).(config.Interface)
+	jobRunner := c.MustGet(pkg.ContextKeyTypeJobRunner).(job_runner.Interface)
+
+	currentUser, err := databaseRepo.GetCurrentUser(c)
+	if err != nil {
+		logger.Errorln("An error occurred while retrieving current user", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	uploadedFile, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "could not extract file from form"})
+		return
+	}
+	exportFilePath := getAppleHealthExportFile(appConfig, currentUser.ID.String(), uuid.New().String())
+	//the export is removed if the import could not be queued, otherwise it's removed by the job once the import is done
+	importQueued := false
+	defer func() {
+		if !importQueued {
+			os.Remove(exportFilePath)
+		}
+	}()
+	if err := os.MkdirAll(filepath.Dir(exportFilePath), 0700); err != nil {
+		logger.Errorln("An error occurred while creating Apple Health import directory", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if err := c.SaveUploadedFile(uploadedFile, exportFilePath); err != nil {
+		logger.Errorln("An error occurred while storing Apple Health export", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": "could not save uploaded file"})
+		return
+	}
+
+	//the export is validated before the source is created, so that invalid uploads are rejected immediately
+	if err := validateAppleHealthExportFile(exportFilePath); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	//the export does not identify the patient, so the Patient id is generated
+	manualSourceCredential := models.SourceCredential{
+		SourceType: sourcePkg.SourceTypeManual,
+		Patient:    uuid.New().String(),
+	}
+	err = databaseRepo.CreateSource(c, &manualSourceCredential)
+	if err != nil {
+		logger.Errorln("An error occurred while creating manual source", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	backgroundJob := models.NewQueuedSyncBackgroundJob(manualSourceCredential)
+	backgroundJob.Data, err = json.Marshal(models.BackgroundJobSyncData{
+		SourceID:              manualSourceCredential.ID,
+		SourceType:            string(manualSourceCredential.SourceType),
+		AppleHealthExportFile: exportFilePath,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	backgroundJob, err = backgroundJobQueueSyncResources(c, logger, databaseRepo, &manualSourceCredential, backgroundJob)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	importQueued = true
+	jobRunner.Notify()
+
+	c.JSON(http.StatusAccepted, gin.H{"success": true, "source": manualSourceCredential, "data": backgroundJob})
+}
+
+// getAppleHealthExportFile returns the location of an uploaded Apple Health export, while it's waiting to be imported
+func getAppleHealthExportFile(appConfig config.Interface, currentUserId string, importId string) string {
+	return filepath.Join(appConfig.GetString("cache.location"), currentUserId, "import", fmt.Sprintf("apple_health_%s.zip", importId))
+}
+
+func validateAppleHealthExportFile(exportFilePath string) error {
+	exportFile, err := os.Open(exportFilePath)
+	if err != nil {
+		return err
+	}
+	defer exportFile.Close()
+	exportFileInfo, err := exportFile.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = applehealth.NewExport(exportFile, exportFileInfo.Size())
+	return err
+}
+
+// importAppleHealthExportFile is the sync callback used for queued Apple Health imports (see BackgroundJobSyncResourcesJobHandler)
+func importAppleHealthExportFile(exportFilePath string) backgroundJobSyncCallback {
+	return func(
+		_backgroundJobContext context.Context,
+		_logger *logrus.Entry,
+		_databaseRepo database.DatabaseRepository,
+		_sourceCred *models.SourceCredential,
+	) (sourceModels.SourceClient, sourceModels.UpsertSummary, error) {
+		manualSourceClient, err := factory.GetSourceClient(sourcePkg.GetFastenLighthouseEnv(), sourcePkg.SourceTypeManual, _backgroundJobContext, _logger, _sourceCred)
+		if err != nil {
+			resultErr := fmt.Errorf("an error occurred while initializing hub client using manual source with credential: %w", err)
+			_logger.Errorln(resultErr)
+			return manualSourceClient, sourceModels.UpsertSummary{}, resultErr
+		}
+
+		exportFile, err := os.Open(exportFilePath)
+		if err != nil {
+			resultErr := fmt.Errorf("the uploaded Apple Health export is no longer available, it must be uploaded again: %w", err)
+			_logger.Errorln(resultErr)
+			return manualSourceClient, sourceModels.UpsertSummary{}, resultErr
+		}
+		defer exportFile.Close()
+		exportFileInfo, err := exportFile.Stat()
+		if err != nil {
+			return manualSourceClient, sourceModels.UpsertSummary{}, err
+		}
+		export, err := applehealth.NewExport(exportFile, exportFileInfo.Size())
+		if err != nil {
+			return manualSourceClient, sourceModels.UpsertSummary{}, err
+		}
+
+		summary, err := importAppleHealthExport(_backgroundJobContext, _logger, _databaseRepo, _sourceCred, manualSourceClient, export)
+		return manualSourceClient, summary, err
+	}
+}
+
+// importAppleHealthExport stores the resources of the export. UpdatedResources only includes the clinical records, since an
+// export usually contains hundreds of thousands of HealthKit records.
+func importAppleHealthExport(
+	backgroundJobContext context.Context,
+	logger *logrus.Entry,
+	databaseRepo database.DatabaseRepository,
+	sourceCred *models.SourceCredential,
+	manualSourceClient sourceModels.SourceClient,
+	export *applehealth.Export,
+) (sourceModels.UpsertSummary, error) {
+	summary := sourceModels.UpsertSummary{UpdatedResources: []string{}}
+
+	healthDataSummary, err := export.ReadHealthData(sourceCred.Patient, func(resource applehealth.Resource) error {
+		_, err := databaseRepo.UpsertRawResource(backgroundJobContext, sourceCred, sourceModels.RawResourceFhir{
+			SourceResourceType: resource.ResourceType,
+			SourceResourceID:   resource.ResourceId,
+			ResourceRaw:        resource.ResourceRaw,
+			SortTitle:          resource.SortTitle,
+			SortDate:           resource.SortDate,
+		})
+		if err != nil {
+			return fmt.Errorf("could not store %s/%s: %w", resource.ResourceType, resource.ResourceId, err)
+		}
+		summary.TotalResources++
+		if summary.TotalResources%appleHealthCheckpointInterval == 0 {
+			databaseRepo.BackgroundJobCheckpoint(backgroundJobContext, map[string]interface{}{
+				"resource_count": summary.TotalResources,
+			}, nil)
+		}
+		return nil
+	})
+	if err != nil {
+		resultErr := fmt.Errorf("an error occurred while importing Apple Health records: %w", err)
+		logger.Errorln(resultErr)
+		return summary, resultErr
+	}
+
+	errorData := map[string]interface{}{}
+	if len(healthDataSummary.SkippedRecordTypes) > 0 {
+		errorData["skipped_record_types"] = healthDataSummary.SkippedRecordTypes
+	}
+	if healthDataSummary.InvalidRecordCount > 0 {
+		errorData["invalid_record_count"] = healthDataSummary.InvalidRecordCount
+	}
+
+	if len(healthDataSummary.ClinicalRecords) > 0 {
+		clinicalRecordsSummary, warnings, err := importAppleHealthClinicalRecords(databaseRepo, manualSourceClient, export, healthDataSummary.ClinicalRecords)
+		if len(warnings) > 0 {
+			errorData["clinical_record_warnings"] = warnings
+		}
+		if err != nil {
+			databaseRepo.BackgroundJobCheckpoint(backgroundJobContext, nil, errorData)
+			resultErr := fmt.Errorf("an error occurred while importing Apple Health clinical records: %w", err)
+			logger.Errorln(resultErr)
+			return summary, resultErr
+		}
+		summary.TotalResources += clinicalRecordsSummary.TotalResources
+		summary.UpdatedResources = append(summary.UpdatedResources, clinicalRecordsSummary.UpdatedResources...)
+	}
+
+	databaseRepo.BackgroundJobCheckpoint(backgroundJobContext, map[string]interface{}{
+		"resource_count": summary.TotalResources,
+		"record_count":   healthDataSummary.RecordCount,
+	}, errorData)
+	return summary, nil
+}
+
+// importAppleHealthClinicalRecords imports the clinical records as a bundle, so that they're processed the same way as a manual upload
+func importAppleHealthClinicalRecords(
+	databaseRepo database.DatabaseRepository,
+	manualSourceClient sourceModels.SourceClient,
+	export *applehealth.Export,
+	clinicalRecords []applehealth.ClinicalRecord,
+) (sourceModels.UpsertSummary, []string, error) {
+	bundleFile, err := os.CreateTemp("", "apple_health_clinical_records.*.json")
+	if err != nil {
+		return sourceModels.UpsertSummary{}, nil, fmt.Errorf("could not create temp file")
+	}
+	defer os.Remove(bundleFile.Name())
+	defer bundleFile.Close()
+
+	count, warnings, err := export.WriteClinicalRecordsBundle(bundleFile, clinicalRecords)
+	if err != nil || count == 0 {
+		return sourceModels.UpsertSummary{}, warnings, err
+	}
+	if _, err := bundleFile.Seek(0, io.SeekStart); err != nil {
+		return sourceModels.UpsertSummary{}, warnings, err
+	}
+	summary, err := manualSourceClient.SyncAllBundle(databaseRepo, bundleFile, sourcePkg.FhirVersion401)
+	return summary, warnings, err
+}
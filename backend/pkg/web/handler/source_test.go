@@ -9,6 +9,7 @@ import (
 	mock_config "github.com/fastenhealth/fasten-onprem/backend/pkg/config/mock"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus"
+	mock_job_runner "github.com/fastenhealth/fasten-onprem/backend/pkg/job_runner/mock"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
 	"github.com/gin-gonic/gin"
 	"github.com/golang/mock/gomock"
@@ -36,6 +37,7 @@ type SourceHandlerTestSuite struct {
 	suite.Suite
 	MockCtrl     *gomock.Controller
 	TestDatabase *os.File
+	TestCacheDir string
 
 	AppConfig     *mock_config.MockInterface
 	AppRepository database.DatabaseRepository
@@ -52,8 +54,15 @@ func (suite *SourceHandlerTestSuite) BeforeTest(suiteName, testName string) {
 	}
 	suite.TestDatabase = dbFile
 
+	cacheDir, err := os.MkdirTemp("", fmt.Sprintf("%s.*.cache", testName))
+	if err != nil {
+		log.Fatal(err)
+	}
+	suite.TestCacheDir = cacheDir
+
 	appConfig := mock_config.NewMockInterface(suite.MockCtrl)
 	appConfig.EXPECT().GetString("database.location").Return(suite.TestDatabase.Name()).AnyTimes()
+	appConfig.EXPECT().GetString("cache.location").Return(suite.TestCacheDir).AnyTimes()
 	appConfig.EXPECT().GetString("database.type").Return("sqlite").AnyTimes()
 	appConfig.EXPECT().IsSet("database.encryption.key").Return(false).AnyTimes()
 	appConfig.EXPECT().GetString("log.level").Return("INFO").AnyTimes()
@@ -75,6 +84,7 @@ func (suite *SourceHandlerTestSuite) BeforeTest(suiteName, testName string) {
 func (suite *SourceHandlerTestSuite) AfterTest(suiteName, testName string) {
 	suite.MockCtrl.Finish()
 	os.Remove(suite.TestDatabase.Name())
+	os.RemoveAll(suite.TestCacheDir)
 }
 
 
@@ -155,3 +165,288 @@ func (suite *SourceHandlerTestSuite) TestCreateManualSourceHandler() {
 	}, summary.ResourceTypeCounts[3])
 
 }
+
+func (suite *SourceHandlerTestSuite) TestCreateManualSourceHandler_WithInvalidResources() {
+	//setup
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Set(pkg.ContextKeyTypeLogger, logrus.WithField("test", suite.T().Name()))
+	ctx.Set(pkg.ContextKeyTypeDatabase, suite.AppRepository)
+	ctx.Set(pkg.ContextKeyTypeConfig, suite.AppConfig)
+	ctx.Set(pkg.ContextKeyTypeEventBusServer, suite.AppEventBus)
+	ctx.Set(pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	bundleFile, err := ioutil.TempFile("", "invalid_bundle.*.json")
+	require.NoError(suite.T(), err)
+	defer os.Remove(bundleFile.Name())
+	_, err = bundleFile.WriteString(`{"resourceType":"Bundle","type":"collection","entry":[{"resource":{"resourceType":"Patient","id":"1"}},{"resource":{"resourceType":"Observation","id":"2","status":"invalid-status"}}]}`)
+	require.NoError(suite.T(), err)
+	bundleFile.Close()
+
+	//test
+	req, err := CreateManualSourceHttpRequestFromFile(bundleFile.Name())
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+
+	CreateManualSource(ctx)
+
+	//assert
+	require.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	var respWrapper struct {
+		Success bool `json:"success"`
+		Data    struct {
+			Issue []struct {
+				Severity   string   `json:"severity"`
+				Expression []string `json:"expression"`
+			} `json:"issue"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &respWrapper)
+	require.NoError(suite.T(), err)
+	require.False(suite.T(), respWrapper.Success)
+	require.Len(suite.T(), respWrapper.Data.Issue, 2)
+	require.Equal(suite.T(), []string{"Bundle.entry[1].resource.code"}, respWrapper.Data.Issue[0].Expression)
+	require.Equal(suite.T(), []string{"Bundle.entry[1].resource.status"}, respWrapper.Data.Issue[1].Expression)
+
+	//nothing was stored
+	sources, err := suite.AppRepository.GetSources(ctx)
+	require.NoError(suite.T(), err)
+	for _, source := range sources {
+		require.NotEqual(suite.T(), "manual", string(source.SourceType))
+	}
+}
+
+func (suite *SourceHandlerTestSuite) TestValidateManualSourceHandler() {
+	//setup
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Set(pkg.ContextKeyTypeLogger, logrus.WithField("test", suite.T().Name()))
+	ctx.Set(pkg.ContextKeyTypeDatabase, suite.AppRepository)
+	ctx.Set(pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	//test
+	req, err := CreateManualSourceHttpRequestFromFile("testdata/Tania553_Harris789_545c2380-b77f-4919-ab5d-0f615f877250.json")
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+
+	ValidateManualSource(ctx)
+
+	//assert
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	var respWrapper struct {
+		Success bool `json:"success"`
+		Data    struct {
+			ResourceType string `json:"resourceType"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &respWrapper)
+	require.NoError(suite.T(), err)
+	require.True(suite.T(), respWrapper.Success)
+	require.Equal(suite.T(), "OperationOutcome", respWrapper.Data.ResourceType)
+
+	//nothing was stored
+	sources, err := suite.AppRepository.GetSources(ctx)
+	require.NoError(suite.T(), err)
+	for _, source := range sources {
+		require.NotEqual(suite.T(), "manual", string(source.SourceType))
+	}
+}
+
+func (suite *SourceHandlerTestSuite) TestCreateManualSourceHandler_WithCCDA() {
+	//setup
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Set(pkg.ContextKeyTypeLogger, logrus.WithField("test", suite.T().Name()))
+	ctx.Set(pkg.ContextKeyTypeDatabase, suite.AppRepository)
+	ctx.Set(pkg.ContextKeyTypeConfig, suite.AppConfig)
+	ctx.Set(pkg.ContextKeyTypeEventBusServer, suite.AppEventBus)
+	ctx.Set(pkg.ContextKeyTypeAuthUsername, "test_username")
+	convertedFilesBefore, err := filepath.Glob(filepath.Join(os.TempDir(), "ccda_bundle.*.json"))
+	require.NoError(suite.T(), err)
+
+	//test
+	req, err := CreateManualSourceHttpRequestFromFile("../../ccda/testdata/ccd.xml")
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+
+	CreateManualSource(ctx)
+
+	//assert
+	require.Equal(suite.T(), http.StatusOK, w.Code)
+	var respWrapper struct {
+		Data struct {
+			TotalResources int `json:"TotalResources"`
+		} `json:"data"`
+		Success bool                    `json:"success"`
+		Source  models.SourceCredential `json:"source"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &respWrapper)
+	require.NoError(suite.T(), err)
+	require.True(suite.T(), respWrapper.Success)
+	require.Equal(suite.T(), "manual", string(respWrapper.Source.SourceType))
+	require.Equal(suite.T(), 15, respWrapper.Data.TotalResources)
+
+	//the converted bundle is removed once it has been imported
+	convertedFilesAfter, err := filepath.Glob(filepath.Join(os.TempDir(), "ccda_bundle.*.json"))
+	require.NoError(suite.T(), err)
+	require.ElementsMatch(suite.T(), convertedFilesBefore, convertedFilesAfter)
+
+	//the original document is stored alongside the converted resources
+	patient, err := suite.AppRepository.GetResourceByResourceTypeAndId(ctx, "Patient", respWrapper.Source.Patient)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), respWrapper.Source.ID, patient.SourceID)
+	summary, err := suite.AppRepository.GetSourceSummary(ctx, respWrapper.Source.ID.String())
+	require.NoError(suite.T(), err)
+	resourceTypeCounts := map[string]int64{}
+	for _, resourceTypeCount := range summary.ResourceTypeCounts {
+		resourceTypeCounts[resourceTypeCount["resource_type"].(string)] = resourceTypeCount["count"].(int64)
+	}
+	require.Equal(suite.T(), int64(1), resourceTypeCounts["Binary"])
+	require.Equal(suite.T(), int64(1), resourceTypeCounts["DocumentReference"])
+	require.Equal(suite.T(), int64(5), resourceTypeCounts["Observation"])
+
+	//the conversion warnings are recorded in the background job
+	syncJobType := pkg.BackgroundJobTypeSync
+	backgroundJobs, _, err := suite.AppRepository.ListBackgroundJobs(ctx, models.BackgroundJobQueryOptions{JobType: &syncJobType, Limit: 10})
+	require.NoError(suite.T(), err)
+	require.NotEmpty(suite.T(), backgroundJobs)
+	var backgroundJobSyncData struct {
+		SourceID  string `json:"source_id"`
+		ErrorData struct {
+			ConversionWarnings []struct {
+				Section string `json:"section"`
+				Message string `json:"message"`
+			} `json:"conversion_warnings"`
+		} `json:"error_data"`
+	}
+	err = json.Unmarshal(backgroundJobs[0].Data, &backgroundJobSyncData)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), respWrapper.Source.ID.String(), backgroundJobSyncData.SourceID)
+	require.Len(suite.T(), backgroundJobSyncData.ErrorData.ConversionWarnings, 4)
+	require.Equal(suite.T(), "Social History", backgroundJobSyncData.ErrorData.ConversionWarnings[3].Section)
+}
+
+func (suite *SourceHandlerTestSuite) TestCreateAppleHealthSourceHandler() {
+	//setup
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	fakeJobRunner := mock_job_runner.NewMockInterface(suite.MockCtrl)
+	fakeJobRunner.EXPECT().Notify()
+	ctx.Set(pkg.ContextKeyTypeLogger, logrus.WithField("test", suite.T().Name()))
+	ctx.Set(pkg.ContextKeyTypeDatabase, suite.AppRepository)
+	ctx.Set(pkg.ContextKeyTypeConfig, suite.AppConfig)
+	ctx.Set(pkg.ContextKeyTypeEventBusServer, suite.AppEventBus)
+	ctx.Set(pkg.ContextKeyTypeJobRunner, fakeJobRunner)
+	ctx.Set(pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	//test
+	req, err := CreateManualSourceHttpRequestFromFile("testdata/apple_health_export.zip")
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+
+	CreateAppleHealthSource(ctx)
+
+	//assert
+	require.Equal(suite.T(), http.StatusAccepted, w.Code)
+	var respWrapper struct {
+		Data    models.BackgroundJob    `json:"data"`
+		Success bool                    `json:"success"`
+		Source  models.SourceCredential `json:"source"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &respWrapper)
+	require.NoError(suite.T(), err)
+	require.True(suite.T(), respWrapper.Success)
+	require.Equal(suite.T(), "manual", string(respWrapper.Source.SourceType))
+	require.Equal(suite.T(), pkg.BackgroundJobStatusReady, respWrapper.Data.JobStatus)
+
+	//the export is kept until the queued job has imported it
+	var queuedBackgroundJobSyncData models.BackgroundJobSyncData
+	require.NoError(suite.T(), json.Unmarshal(respWrapper.Data.Data, &queuedBackgroundJobSyncData))
+	require.FileExists(suite.T(), queuedBackgroundJobSyncData.AppleHealthExportFile)
+
+	claimedBackgroundJob, err := suite.AppRepository.ClaimBackgroundJob(ctx, []pkg.BackgroundJobType{pkg.BackgroundJobTypeSync})
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), respWrapper.Data.ID, claimedBackgroundJob.ID)
+	err = BackgroundJobSyncResourcesJobHandler(
+		CreateBackgroundJobContext(ctx, claimedBackgroundJob.ID.String()),
+		logrus.WithField("test", suite.T().Name()),
+		suite.AppRepository,
+		suite.AppEventBus,
+		claimedBackgroundJob,
+	)
+	require.NoError(suite.T(), err)
+	require.NoFileExists(suite.T(), queuedBackgroundJobSyncData.AppleHealthExportFile)
+
+	summary, err := suite.AppRepository.GetSourceSummary(ctx, respWrapper.Source.ID.String())
+	require.NoError(suite.T(), err)
+	resourceTypeCounts := map[string]int64{}
+	for _, resourceTypeCount := range summary.ResourceTypeCounts {
+		resourceTypeCounts[resourceTypeCount["resource_type"].(string)] = resourceTypeCount["count"].(int64)
+	}
+	require.Equal(suite.T(), map[string]int64{
+		"Condition":   1,
+		"Observation": 8,
+		"Patient":     1,
+	}, resourceTypeCounts)
+	patient, err := suite.AppRepository.GetResourceByResourceTypeAndId(ctx, "Patient", respWrapper.Source.Patient)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), respWrapper.Source.ID, patient.SourceID)
+
+	//the skipped records are recorded in the background job
+	syncJobType := pkg.BackgroundJobTypeSync
+	backgroundJobs, _, err := suite.AppRepository.ListBackgroundJobs(ctx, models.BackgroundJobQueryOptions{JobType: &syncJobType, Limit: 10})
+	require.NoError(suite.T(), err)
+	require.NotEmpty(suite.T(), backgroundJobs)
+	require.Equal(suite.T(), pkg.BackgroundJobStatusDone, backgroundJobs[0].JobStatus)
+	var backgroundJobSyncData struct {
+		SourceID       string                 `json:"source_id"`
+		CheckpointData map[string]interface{} `json:"checkpoint_data"`
+		ErrorData      map[string]interface{} `json:"error_data"`
+	}
+	err = json.Unmarshal(backgroundJobs[0].Data, &backgroundJobSyncData)
+	require.NoError(suite.T(), err)
+	require.Equal(suite.T(), respWrapper.Source.ID.String(), backgroundJobSyncData.SourceID)
+	//1 patient, 9 observations (converted from 7 distinct records) & 2 clinical records
+	require.Equal(suite.T(), map[string]interface{}{"resource_count": float64(12), "record_count": float64(12)}, backgroundJobSyncData.CheckpointData)
+	require.Equal(suite.T(), map[string]interface{}{
+		"skipped_record_types": map[string]interface{}{
+			"HKCategoryTypeIdentifierSleepAnalysis":      float64(1),
+			"HKQuantityTypeIdentifierActiveEnergyBurned": float64(1),
+		},
+		"invalid_record_count": float64(1),
+		"clinical_record_warnings": []interface{}{
+			"Immunization-7D8E9F0A-3B4C-4D5E-9F0A-2B3C4D5E6F7A.json: FHIR version 1.0.2 is not supported, skipped",
+		},
+	}, backgroundJobSyncData.ErrorData)
+}
+
+func (suite *SourceHandlerTestSuite) TestCreateAppleHealthSourceHandler_WithInvalidExport() {
+	//setup
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Set(pkg.ContextKeyTypeLogger, logrus.WithField("test", suite.T().Name()))
+	ctx.Set(pkg.ContextKeyTypeDatabase, suite.AppRepository)
+	ctx.Set(pkg.ContextKeyTypeConfig, suite.AppConfig)
+	ctx.Set(pkg.ContextKeyTypeEventBusServer, suite.AppEventBus)
+	ctx.Set(pkg.ContextKeyTypeJobRunner, mock_job_runner.NewMockInterface(suite.MockCtrl))
+	ctx.Set(pkg.ContextKeyTypeAuthUsername, "test_username")
+
+	//test
+	req, err := CreateManualSourceHttpRequestFromFile("../../ccda/testdata/ccd.xml")
+	require.NoError(suite.T(), err)
+	ctx.Request = req
+
+	CreateAppleHealthSource(ctx)
+
+	//assert
+	require.Equal(suite.T(), http.StatusBadRequest, w.Code)
+	importFiles, _ := filepath.Glob(filepath.Join(suite.TestCacheDir, "*", "import", "*"))
+	require.Empty(suite.T(), importFiles)
+
+	//nothing was stored
+	sources, err := suite.AppRepository.GetSources(ctx)
+	require.NoError(suite.T(), err)
+	for _, source := range sources {
+		require.NotEqual(suite.T(), "manual", string(source.SourceType))
+	}
+}
@@ -0,0 +1,15 @@
+package middleware
+
+import (
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/job_runner"
+	"github.com/gin-gonic/gin"
+)
+
+func JobRunnerMiddleware(jobRunner job_runner.Interface) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+		c.Set(pkg.ContextKeyTypeJobRunner, jobRunner)
+		c.Next()
+	}
+}
@@ -1,10 +1,14 @@
 package web
 
 import (
+	"context"
 	"embed"
 	"fmt"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/config"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/database"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/event_bus"
+	"github.com/fastenhealth/fasten-onprem/backend/pkg/job_runner"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/models"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/web/handler"
 	"github.com/fastenhealth/fasten-onprem/backend/pkg/web/middleware"
@@ -13,21 +17,39 @@ import (
 	"net/http"
 	"runtime"
 	"strings"
+	"time"
 )
 
 type AppEngine struct {
 	Config   config.Interface
 	Logger   *logrus.Entry
 	EventBus event_bus.Interface
+
+	//the repository shared by the handlers and the background jobs, created by Setup
+	DatabaseRepo database.DatabaseRepository
+	//background jobs queued by the handlers, started by Start
+	JobRunner job_runner.Interface
 }
 
 func (ae *AppEngine) Setup() (*gin.RouterGroup, *gin.Engine) {
 	r := gin.New()
 
+	//the repository is shared by the handlers and the job runner
+	deviceRepo, err := database.NewRepository(ae.Config, ae.Logger, ae.EventBus)
+	if err != nil {
+		panic(err)
+	}
+	ae.DatabaseRepo = deviceRepo
+	ae.JobRunner = job_runner.NewJobRunner(ae.Config, ae.Logger, deviceRepo, ae.EventBus)
+	ae.JobRunner.RegisterJobHandler(pkg.BackgroundJobTypeSync, handler.BackgroundJobSyncResourcesJobHandler)
+	ae.JobRunner.RegisterJobHandler(pkg.BackgroundJobTypeScheduledSync, handler.BackgroundJobScheduledSyncJobHandler)
+	ae.JobRunner.RegisterJobHandler(pkg.BackgroundJobTypeExport, handler.NewBackgroundJobExportResourcesJobHandler(ae.Config))
+
 	r.Use(middleware.LoggerMiddleware(ae.Logger))
-	r.Use(middleware.RepositoryMiddleware(ae.Config, ae.Logger, ae.EventBus))
+	r.Use(middleware.RepositoryMiddleware(deviceRepo))
 	r.Use(middleware.ConfigMiddleware(ae.Config))
 	r.Use(middleware.EventBusMiddleware(ae.EventBus))
+	r.Use(middleware.JobRunnerMiddleware(ae.JobRunner))
 	r.Use(gin.Recovery())
 
 	basePath := ae.Config.GetString("web.listen.basepath")
@@ -66,25 +88,44 @@ func (ae *AppEngine) Setup() (*gin.RouterGroup, *gin.Engine) {
 
 				secure.POST("/source", handler.CreateReconnectSource)
 				secure.POST("/source/manual", handler.CreateManualSource)
+				secure.POST("/source/manual/validate", handler.ValidateManualSource)
+				secure.POST("/source/manual/apple-health", handler.CreateAppleHealthSource)
 				secure.GET("/source", handler.ListSource)
 				secure.GET("/source/:sourceId", handler.GetSource)
 				secure.DELETE("/source/:sourceId", handler.DeleteSource)
 				secure.POST("/source/:sourceId/sync", handler.SourceSync)
 				secure.GET("/source/:sourceId/summary", handler.GetSourceSummary)
 				secure.GET("/resource/fhir", handler.ListResourceFhir)
+				secure.GET("/resource/search", handler.SearchResourceFhir)
 				secure.POST("/resource/graph/:graphType", handler.GetResourceFhirGraph)
 				secure.GET("/resource/fhir/:sourceId/:resourceId", handler.GetResourceFhir)
+				secure.GET("/resource/fhir/:sourceId/:resourceId/history", handler.GetResourceFhirHistory)
+				secure.GET("/resource/fhir/:sourceId/:resourceId/diff", handler.GetResourceFhirDiff)
+				secure.POST("/resource/fhir/:resourceType", handler.CreateResourceFhir)
+				secure.PUT("/resource/fhir/:resourceType/:resourceId", handler.UpdateResourceFhir)
+				secure.DELETE("/resource/fhir/:resourceType/:resourceId", handler.DeleteResourceFhir)
 
 				secure.POST("/resource/composition", handler.CreateResourceComposition)
 				secure.POST("/resource/related", handler.CreateRelatedResources)
+				secure.POST("/resource/import/csv", handler.ImportCsvResources)
+				secure.GET("/resource/import/csv/templates", handler.ListCsvImportTemplates)
+				secure.POST("/resource/import/csv/templates", handler.SaveCsvImportTemplate)
+				secure.DELETE("/resource/import/csv/templates/:templateName", handler.DeleteCsvImportTemplate)
 
 				secure.GET("/dashboards", handler.GetDashboard)
 				secure.POST("/dashboards", handler.AddDashboardLocation)
 				//secure.GET("/dashboard/:dashboardId", handler.GetDashboard)
 
 				secure.GET("/jobs", handler.ListBackgroundJobs)
+				secure.PUT("/jobs/schedule", handler.SetBackgroundJobSchedule)
+				secure.DELETE("/jobs/schedule", handler.DeleteBackgroundJobSchedule)
+				secure.GET("/jobs/:jobId", handler.GetBackgroundJob)
+				secure.POST("/jobs/:jobId/cancel", handler.CancelBackgroundJob)
+				secure.POST("/jobs/:jobId/retry", handler.RetryBackgroundJob)
+				secure.GET("/jobs/:jobId/logs", handler.ListBackgroundJobLogs)
 
 				secure.POST("/query", handler.QueryResourceFhir)
+				secure.GET("/query/:resourceType", handler.QueryResourceFhirSearch)
 
 				//server-side-events handler (only supported on mac/linux)
 				// TODO: causes deadlock on Windows
@@ -96,6 +137,27 @@ func (ae *AppEngine) Setup() (*gin.RouterGroup, *gin.Engine) {
 				}
 			}
 
+			//read-only FHIR R4 REST api, responses are FHIR resources rather than the {success, data} envelope
+			fhirR4 := api.Group("/fhir/r4")
+			{
+				fhirR4.GET("/metadata", handler.FhirR4Metadata)
+				fhirR4.GET("/$export", middleware.RequireAuth(), handler.FhirR4ExportKickoff)
+				fhirR4.GET("/$export-status/:jobId", middleware.RequireAuth(), handler.FhirR4ExportStatus)
+				fhirR4.DELETE("/$export-status/:jobId", middleware.RequireAuth(), handler.FhirR4ExportDelete)
+				fhirR4.GET("/$export-file/:jobId/:fileName", middleware.RequireAuth(), handler.FhirR4ExportFile)
+				fhirR4.GET("/Patient/$everything", middleware.RequireAuth(), handler.FhirR4PatientEverything)
+				fhirR4.GET("/Patient/$export", middleware.RequireAuth(), handler.FhirR4ExportKickoff)
+				fhirR4.GET("/Observation/$lastn", middleware.RequireAuth(), handler.FhirR4ObservationLastN)
+				fhirR4.GET("/Observation/$stats", middleware.RequireAuth(), handler.FhirR4ObservationStats)
+				fhirR4.POST("/$validate", middleware.RequireAuth(), handler.FhirR4Validate)
+				fhirR4.GET("/:resourceType", middleware.RequireAuth(), handler.FhirR4SearchResources)
+				fhirR4.GET("/:resourceType/:resourceId", middleware.RequireAuth(), handler.FhirR4ReadResource)
+				fhirR4.GET("/:resourceType/:resourceId/$everything", middleware.RequireAuth(), handler.FhirR4PatientEverything)
+				fhirR4.GET("/:resourceType/:resourceId/_history", middleware.RequireAuth(), handler.FhirR4ResourceHistory)
+				fhirR4.GET("/:resourceType/:resourceId/_history/:versionId", middleware.RequireAuth(), handler.FhirR4ReadResourceVersion)
+				fhirR4.POST("/:resourceType/$validate", middleware.RequireAuth(), handler.FhirR4Validate)
+			}
+
 			if ae.Config.GetBool("web.allow_unsafe_endpoints") {
 				//this endpoint lets us request data directly from the source api
 				ae.Logger.Warningln("***UNSAFE***")
@@ -177,5 +239,9 @@ func (ae *AppEngine) Start() error {
 	baseRouterGroup, ginRouter := ae.Setup()
 	r := ae.SetupFrontendRouting(baseRouterGroup, ginRouter)
 
+	ae.JobRunner.Start(context.Background())
+	//expired bulk data export files are removed from the cache
+	go handler.RemoveExpiredExports(context.Background(), ae.Config, ae.Logger, ae.DatabaseRepo, time.Hour)
+
 	return r.Run(fmt.Sprintf("%s:%s", ae.Config.GetString("web.listen.host"), ae.Config.GetString("web.listen.port")))
 }
@@ -0,0 +1,7 @@
+export interface EventBackgroundJob extends Event {
+  event_type: string;
+  background_job_id: string;
+  job_type: 'SYNC' | 'SCHEDULED_SYNC' | 'EXPORT';
+  job_status: 'STATUS_READY' | 'STATUS_LOCKED' | 'STATUS_FAILED' | 'STATUS_DONE';
+  checkpoint_data?: any;
+}
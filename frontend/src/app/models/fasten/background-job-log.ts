@@ -0,0 +1,9 @@
+export class BackgroundJobLog {
+  id: string
+  background_job_id: string
+  level: 'panic' | 'fatal' | 'error' | 'warning' | 'info'
+  message: string
+  resource_type?: string
+  resource_id?: string
+  logged_at: Date
+}
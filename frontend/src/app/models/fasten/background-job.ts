@@ -1,11 +1,13 @@
 export class BackgroundJob {
+  id: string
   created_at: string
   user_id: string
-  job_type?: 'SYNC' | 'SCHEDULED_SYNC'
+  job_type?: 'SYNC' | 'SCHEDULED_SYNC' | 'EXPORT'
   data?: any
-  job_status?: 'STATUS_READY' | 'STATUS_LOCKED' | 'STATUS_FAILED' | 'STATUS_DONE'
+  job_status?: 'STATUS_READY' | 'STATUS_LOCKED' | 'STATUS_FAILED' | 'STATUS_DONE' | 'STATUS_CANCELLED'
   locked_time?: Date
   done_time?: Date
   retries: number
-  schedule?: string
+  schedule?: 'DAILY' | 'WEEKLY' | 'BIWEEKLY' | 'MONTHLY'
+  next_run_time?: Date //scheduled sync jobs only
 }
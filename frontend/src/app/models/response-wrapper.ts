@@ -2,4 +2,8 @@ export class ResponseWrapper {
   data: any
   success: boolean
   error?: string
+
+  //pagination, only returned by list & query endpoints
+  total?: number
+  next?: string //cursor for the next page of results
 }
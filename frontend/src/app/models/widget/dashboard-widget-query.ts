@@ -3,14 +3,17 @@ export class DashboardWidgetQuery {
   select: string[]
   from: string
   where: {[key: string]: string | string[]}
+  sort?: string[] //search parameters, prefixed with `-` for descending (eg. `-date`)
   limit?: number
   offset?: number
+  cursor?: string //`next` cursor returned with the previous page, cannot be used with offset, sort or aggregations
 
   //https://lodash.com/docs/4.17.15#unionBy
   aggregations?: {
     count_by?: DashboardWidgetQueryAggregation, //alias for groupBy and orderBy
     group_by?: DashboardWidgetQueryAggregation,
     order_by?: DashboardWidgetQueryAggregation,
+    series_by?: DashboardWidgetQueryAggregation, //secondary grouping, returned as `series`
   }
   // aggregation_params?: string[]
   // aggregation_type?: 'countBy' | 'groupBy' | 'orderBy' // | 'minBy' | 'maxBy' | 'sumBy' // 'orderBy' | 'sortBy' |
@@ -18,5 +21,7 @@ export class DashboardWidgetQuery {
 
 export class DashboardWidgetQueryAggregation {
   field: string
-  fn?: string
+  fn?: 'count' | 'sum' | 'avg' | 'min' | 'max'
+  unit?: string //UCUM unit code, only for Quantity value fields. Without a unit, results are grouped by unit
+  bucket?: 'year' | 'quarter' | 'month' | 'week' | 'day' //only for date fields
 }
@@ -1,6 +1,7 @@
 import {Component, OnDestroy, OnInit} from '@angular/core';
 import {FastenApiService} from '../../services/fasten-api.service';
 import {BackgroundJob} from '../../models/fasten/background-job';
+import {BackgroundJobLog} from '../../models/fasten/background-job-log';
 import { NgbModal } from '@ng-bootstrap/ng-bootstrap';
 import {interval, Observable, Subscription, timer} from 'rxjs';
 import {mergeMap} from 'rxjs/operators';
@@ -13,6 +14,8 @@ export class BackgroundJobsComponent implements OnInit, OnDestroy {
   backgroundJobsSubscription: Subscription = null
   backgroundJobs: BackgroundJob[] = []
   selectedBackgroundJob: BackgroundJob = null
+  selectedBackgroundJobLogs: BackgroundJobLog[] = []
+  selectedBackgroundJobLogsNext: string = null
 
   constructor(public fastenApi: FastenApiService, private modalService: NgbModal) { }
 
@@ -38,7 +41,18 @@ export class BackgroundJobsComponent implements OnInit, OnDestroy {
 
   openModal(content, backgroundJob: BackgroundJob) {
     this.selectedBackgroundJob = backgroundJob
+    this.selectedBackgroundJobLogs = []
+    this.selectedBackgroundJobLogsNext = null
+    this.loadBackgroundJobLogs()
     this.modalService.open(content, { size: 'lg', scrollable: true });
   }
 
+  loadBackgroundJobLogs() {
+    this.fastenApi.getBackgroundJobLogs(this.selectedBackgroundJob.id, this.selectedBackgroundJobLogsNext)
+      .subscribe((result) => {
+        this.selectedBackgroundJobLogs = this.selectedBackgroundJobLogs.concat(result.logs)
+        this.selectedBackgroundJobLogsNext = result.next
+      })
+  }
+
 }
@@ -7,6 +7,7 @@ import {ToastService} from './toast.service';
 import {Event} from '../models/events/event';
 import {EventSourceComplete} from '../models/events/event_source_complete';
 import {EventSourceSync} from '../models/events/event_source_sync';
+import {EventBackgroundJob} from '../models/events/event_background_job';
 import {GetEndpointAbsolutePath} from '../../lib/utils/endpoint_absolute_path';
 import {environment} from '../../environments/environment';
 import {fetchEventSource} from '@microsoft/fetch-event-source';
@@ -25,6 +26,7 @@ export class EventBusService {
 
   public SourceSyncMessages: Subject<EventSourceSync> = new Subject<EventSourceSync>();
   public SourceCompleteMessages: Subject<EventSourceComplete> = new Subject<EventSourceComplete>();
+  public BackgroundJobMessages: Subject<EventBackgroundJob> = new Subject<EventBackgroundJob>();
 
   constructor(
     public router: Router,
@@ -38,13 +40,15 @@ export class EventBusService {
       console.log("isAuthenticated changed:", isAuthenticated)
       if(isAuthenticated){
         console.log("Started listening to event bus")
-        this.eventBusSubscription = this.listenEventBus().subscribe((event: Event | EventSourceSync | EventSourceComplete)=>{
+        this.eventBusSubscription = this.listenEventBus().subscribe((event: Event | EventSourceSync | EventSourceComplete | EventBackgroundJob)=>{
           console.log("eventbus event:", event)
           //TODO: start toasts.
           if(event.event_type == "source_sync"){
             this.SourceSyncMessages.next(event as EventSourceSync)
           } else if(event.event_type == "source_complete"){
             this.SourceCompleteMessages.next(event as EventSourceComplete)
+          } else if(event.event_type == "background_job"){
+            this.BackgroundJobMessages.next(event as EventBackgroundJob)
           }
         })
       } else {
@@ -25,6 +25,7 @@ import {DashboardWidgetQuery} from '../models/widget/dashboard-widget-query';
 import {ResourceGraphResponse} from '../models/fasten/resource-graph-response';
 import { fetchEventSource } from '@microsoft/fetch-event-source';
 import {BackgroundJob} from '../models/fasten/background-job';
+import {BackgroundJobLog} from '../models/fasten/background-job-log';
 import {SupportRequest} from '../models/fasten/support-request';
 import {
   List
@@ -202,6 +203,24 @@ export class FastenApiService {
       );
   }
 
+  //full-text search across all resource types, results are ranked by relevance
+  searchResources(query: string, sourceResourceTypes?: string[], limit?: number): Observable<any[]> {
+    let queryParams = {"q": query}
+    if(sourceResourceTypes?.length){
+      queryParams["sourceResourceType"] = sourceResourceTypes.join(",")
+    }
+    if(limit){
+      queryParams["limit"] = limit
+    }
+
+    return this._httpClient.get<any>(`${GetEndpointAbsolutePath(globalThis.location, environment.fasten_api_endpoint_base)}/secure/resource/search`, {params: queryParams})
+      .pipe(
+        map((response: ResponseWrapper) => {
+          return response.data as any[]
+        })
+      );
+  }
+
   //TODO: add caching here, we dont want the same query to be run multiple times whne loading the dashboard.
   // we should also add a way to invalidate the cache when a source is synced
   //this function is special, as it returns the raw response, for processing in the DashboardWidgetComponent
@@ -322,6 +341,80 @@ export class FastenApiService {
       );
   }
 
+  getUpcomingBackgroundJobs(): Observable<BackgroundJob[]> {
+    return this._httpClient.get<any>(`${GetEndpointAbsolutePath(globalThis.location, environment.fasten_api_endpoint_base)}/secure/jobs`, {params: {limit: 1}})
+      .pipe(
+        map((response: ResponseWrapper & {upcoming?: BackgroundJob[]}) => {
+          return (response.upcoming || []) as BackgroundJob[]
+        })
+      );
+  }
+
+  //sourceId is optional, the schedule applies to all sources if it's not set
+  setSyncSchedule(schedule: 'DAILY' | 'WEEKLY' | 'BIWEEKLY' | 'MONTHLY', sourceId?: string): Observable<BackgroundJob> {
+    return this._httpClient.put<any>(`${GetEndpointAbsolutePath(globalThis.location, environment.fasten_api_endpoint_base)}/secure/jobs/schedule`, {schedule: schedule, source_id: sourceId})
+      .pipe(
+        map((response: ResponseWrapper) => {
+          return response.data as BackgroundJob
+        })
+      );
+  }
+
+  deleteSyncSchedule(sourceId?: string): Observable<BackgroundJob> {
+    let queryParams = {}
+    if(sourceId){
+      queryParams["source_id"] = sourceId
+    }
+    return this._httpClient.delete<any>(`${GetEndpointAbsolutePath(globalThis.location, environment.fasten_api_endpoint_base)}/secure/jobs/schedule`, {params: queryParams})
+      .pipe(
+        map((response: ResponseWrapper) => {
+          return response.data as BackgroundJob
+        })
+      );
+  }
+
+  getBackgroundJob(jobId: string): Observable<BackgroundJob> {
+    return this._httpClient.get<any>(`${GetEndpointAbsolutePath(globalThis.location, environment.fasten_api_endpoint_base)}/secure/jobs/${jobId}`)
+      .pipe(
+        map((response: ResponseWrapper) => {
+          return response.data as BackgroundJob
+        })
+      );
+  }
+
+  cancelBackgroundJob(jobId: string): Observable<BackgroundJob> {
+    return this._httpClient.post<any>(`${GetEndpointAbsolutePath(globalThis.location, environment.fasten_api_endpoint_base)}/secure/jobs/${jobId}/cancel`, {})
+      .pipe(
+        map((response: ResponseWrapper) => {
+          return response.data as BackgroundJob
+        })
+      );
+  }
+
+  //log entries are returned oldest first, the next cursor is empty on the last page
+  getBackgroundJobLogs(jobId: string, cursor?: string): Observable<{logs: BackgroundJobLog[], next?: string}> {
+    let queryParams = {}
+    if(cursor){
+      queryParams["cursor"] = cursor
+    }
+    return this._httpClient.get<any>(`${GetEndpointAbsolutePath(globalThis.location, environment.fasten_api_endpoint_base)}/secure/jobs/${jobId}/logs`, {params: queryParams})
+      .pipe(
+        map((response: ResponseWrapper) => {
+          return {logs: response.data as BackgroundJobLog[], next: response.next}
+        })
+      );
+  }
+
+  //the retried sync is queued as a new background job
+  retryBackgroundJob(jobId: string): Observable<BackgroundJob> {
+    return this._httpClient.post<any>(`${GetEndpointAbsolutePath(globalThis.location, environment.fasten_api_endpoint_base)}/secure/jobs/${jobId}/retry`, {})
+      .pipe(
+        map((response: ResponseWrapper) => {
+          return response.data as BackgroundJob
+        })
+      );
+  }
+
 
   supportRequest(request: SupportRequest): Observable<any> {
     return this._httpClient.post<any>(`${GetEndpointAbsolutePath(globalThis.location, environment.fasten_api_endpoint_base)}/support/request`, request)
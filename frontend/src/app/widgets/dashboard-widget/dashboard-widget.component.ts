@@ -138,6 +138,10 @@ export class DashboardWidgetComponent implements OnInit, DashboardWidgetComponen
       //list of aggregated results [{"label": "xxx", "value":"xxx"}]
       return results
     }
+    else if(query.select?.length){
+      //list of flat rows, the select clause has already been processed by the backend [{"id": "xxx", "resourceType": "xxx", "alias": "xxx"}]
+      return results
+    }
     else {
       //list of FHIR resources
       return results.map((resource: ResourceFhir) => {